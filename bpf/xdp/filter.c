@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// XDP program that drops IPv4 packets from denied source CIDRs before they reach the kernel
+// stack.  Felix loads one copy per host interface and fills in its maps:
+//
+// - calico_deny: LPM trie of source CIDRs to drop.
+// - calico_failsafe: inbound failsafe protocol/port pairs, which are never dropped.
+//
+// Build with:
+//
+//     clang -O2 -target bpf -c filter.c -o filter.o
+
+#include <linux/bpf.h>
+#include <linux/if_ether.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+
+#define SEC(name) __attribute__((section(name), used))
+
+#ifndef __constant_htons
+#define __constant_htons(x) __builtin_bswap16(x)
+#endif
+
+struct bpf_map_def {
+	unsigned int type;
+	unsigned int key_size;
+	unsigned int value_size;
+	unsigned int max_entries;
+	unsigned int map_flags;
+};
+
+static void *(*bpf_map_lookup_elem)(void *map, void *key) =
+	(void *) BPF_FUNC_map_lookup_elem;
+
+struct deny_key {
+	__u32 prefixlen;
+	__u32 addr;
+};
+
+struct failsafe_key {
+	__u8 protocol;
+	__u8 pad;
+	__u16 port;
+};
+
+struct bpf_map_def SEC("maps") calico_deny = {
+	.type = BPF_MAP_TYPE_LPM_TRIE,
+	.key_size = sizeof(struct deny_key),
+	.value_size = sizeof(__u32),
+	.max_entries = 10240,
+	.map_flags = BPF_F_NO_PREALLOC,
+};
+
+struct bpf_map_def SEC("maps") calico_failsafe = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(struct failsafe_key),
+	.value_size = sizeof(__u32),
+	.max_entries = 64,
+};
+
+SEC("xdp")
+int calico_xdp_filter(struct xdp_md *ctx)
+{
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+	struct ethhdr *eth = data;
+	struct iphdr *ip;
+	struct failsafe_key fs_key = {};
+	struct deny_key deny_key;
+
+	if ((void *)(eth + 1) > data_end)
+		return XDP_PASS;
+	if (eth->h_proto != __constant_htons(ETH_P_IP))
+		return XDP_PASS;
+	ip = (void *)(eth + 1);
+	if ((void *)(ip + 1) > data_end)
+		return XDP_PASS;
+
+	if (ip->protocol == IPPROTO_TCP || ip->protocol == IPPROTO_UDP) {
+		// TCP and UDP both start with the source and destination ports.
+		struct udphdr *l4 = (void *)ip + ip->ihl * 4;
+		if ((void *)(l4 + 1) > data_end)
+			return XDP_PASS;
+		fs_key.protocol = ip->protocol;
+		fs_key.port = l4->dest;
+		if (bpf_map_lookup_elem(&calico_failsafe, &fs_key))
+			return XDP_PASS;
+	}
+
+	deny_key.prefixlen = 32;
+	deny_key.addr = ip->saddr;
+	if (bpf_map_lookup_elem(&calico_deny, &deny_key))
+		return XDP_DROP;
+	return XDP_PASS;
+}
+
+char _license[] SEC("license") = "Apache-2.0";
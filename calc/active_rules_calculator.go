@@ -18,6 +18,7 @@ import (
 	"reflect"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/projectcalico/felix/dispatcher"
 	"github.com/projectcalico/felix/labelindex"
@@ -28,6 +29,17 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/selector"
 )
 
+var (
+	gaugeNumActiveProfiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_active_local_profiles",
+		Help: "Number of active profiles on this host.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(gaugeNumActiveProfiles)
+}
+
 type ruleScanner interface {
 	OnPolicyActive(model.PolicyKey, *model.Policy)
 	OnPolicyInactive(model.PolicyKey)
@@ -301,6 +313,7 @@ func (arc *ActiveRulesCalculator) sendProfileUpdate(profileID string) {
 	} else {
 		arc.RuleScanner.OnProfileInactive(key)
 	}
+	gaugeNumActiveProfiles.Set(float64(arc.profileIDToEndpointKeys.Len()))
 }
 
 func (arc *ActiveRulesCalculator) sendPolicyUpdate(policyKey model.PolicyKey) {
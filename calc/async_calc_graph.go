@@ -25,6 +25,7 @@ import (
 
 	"github.com/projectcalico/felix/config"
 	"github.com/projectcalico/felix/dispatcher"
+	"github.com/projectcalico/felix/health"
 	"github.com/projectcalico/felix/proto"
 	"github.com/projectcalico/libcalico-go/lib/backend/api"
 )
@@ -32,6 +33,9 @@ import (
 const (
 	tickInterval    = 10 * time.Millisecond
 	leakyBucketSize = 10
+
+	healthName     = "async_calc_graph"
+	healthInterval = 10 * time.Second
 )
 
 var (
@@ -81,18 +85,48 @@ type AsyncCalcGraph struct {
 	flushTicks       <-chan time.Time
 	flushLeakyBucket int
 	dirty            bool
+
+	// batcher holds off flushing while a burst of updates is still arriving.  batchTimerC
+	// is non-nil while we're waiting for its flush deadline.
+	batcher     *updateBatcher
+	batchTimerC <-chan time.Time
+
+	// healthAggregator, if non-nil, receives our health reports.  We're live as long as our
+	// loop keeps turning and ready once the datastore is in sync.
+	healthAggregator *health.HealthAggregator
+	healthTicks      <-chan time.Time
+	syncStatus       api.SyncStatus
 }
 
-func NewAsyncCalcGraph(conf *config.Config, outputEvents chan<- interface{}) *AsyncCalcGraph {
-	eventBuffer := NewEventBuffer(conf)
+func NewAsyncCalcGraph(
+	liveConf *config.LiveConfig,
+	outputEvents chan<- interface{},
+	healthAggregator *health.HealthAggregator,
+) *AsyncCalcGraph {
+	// The event buffer merges datastore config into liveConf.  None of the parameters that
+	// we use here are reloadable so we can take them from the config as it is now.
+	conf := liveConf.Current()
+	eventBuffer := NewEventBuffer(liveConf)
 	disp := NewCalculationGraph(eventBuffer, conf.FelixHostname)
 	g := &AsyncCalcGraph{
 		inputEvents:  make(chan interface{}, 10),
 		outputEvents: outputEvents,
 		Dispatcher:   disp,
 		eventBuffer:  eventBuffer,
+		batcher: newUpdateBatcher(
+			time.Duration(conf.CalcGraphBatchQuietPeriodMillis)*time.Millisecond,
+			time.Duration(conf.CalcGraphBatchMaxLatencyMillis)*time.Millisecond,
+		),
+
+		healthAggregator: healthAggregator,
 	}
 	eventBuffer.Callback = g.onEvent
+	if healthAggregator != nil {
+		healthAggregator.RegisterReporter(healthName, &health.HealthReport{
+			Live:  true,
+			Ready: true,
+		}, healthInterval*2)
+	}
 	return g
 }
 
@@ -134,6 +168,8 @@ func (acg *AsyncCalcGraph) loop() {
 				log.WithField("status", update).Debug(
 					"Pulled status update off channel")
 				acg.Dispatcher.OnStatusUpdated(update)
+				acg.syncStatus = update
+				acg.reportHealth()
 				if update == api.InSync && !acg.beenInSync {
 					log.Info("First time we've been in sync")
 					acg.beenInSync = true
@@ -148,21 +184,37 @@ func (acg *AsyncCalcGraph) loop() {
 				log.Fatalf("Unexpected update: %#v", update)
 			}
 			acg.dirty = true
+			acg.batcher.OnUpdate(time.Now())
+		case <-acg.batchTimerC:
+			// Reached the batcher's flush deadline (or a deadline that has since been
+			// extended, in which case maybeFlush() will reschedule).
+			acg.batchTimerC = nil
 		case <-acg.flushTicks:
 			// Timer tick: fill up the leaky bucket.
 			if acg.flushLeakyBucket < leakyBucketSize {
 				acg.flushLeakyBucket++
 			}
+		case <-acg.healthTicks:
+			acg.reportHealth()
 		}
 		acg.maybeFlush()
 	}
 }
 
-// maybeFlush flushes the event buffer if: we know it's dirty and we're not throttled.
+// maybeFlush flushes the event buffer if: we know it's dirty, the current burst of updates
+// is over (or has gone on for too long) and we're not throttled.
 func (acg *AsyncCalcGraph) maybeFlush() {
 	if !acg.dirty {
 		return
 	}
+	now := time.Now()
+	if !acg.batcher.ReadyToFlush(now) {
+		log.Debug("Batching updates: not flushing event buffer yet")
+		if acg.batchTimerC == nil {
+			acg.batchTimerC = time.After(acg.batcher.FlushDeadline().Sub(now))
+		}
+		return
+	}
 	if acg.flushLeakyBucket > 0 {
 		log.Debug("Not throttled: flushing event buffer")
 		acg.flushLeakyBucket--
@@ -173,11 +225,22 @@ func (acg *AsyncCalcGraph) maybeFlush() {
 			acg.needToSendInSync = false
 		}
 		acg.dirty = false
+		acg.batcher.OnFlush()
 	} else {
 		log.Debug("Throttled: not flushing event buffer")
 	}
 }
 
+func (acg *AsyncCalcGraph) reportHealth() {
+	if acg.healthAggregator == nil {
+		return
+	}
+	acg.healthAggregator.Report(healthName, &health.HealthReport{
+		Live:  true,
+		Ready: acg.syncStatus == api.InSync,
+	})
+}
+
 func (acg *AsyncCalcGraph) onEvent(event interface{}) {
 	log.Debug("Sending output event on channel")
 	acg.outputEvents <- event
@@ -189,5 +252,9 @@ func (acg *AsyncCalcGraph) Start() {
 	log.Info("Starting AsyncCalcGraph")
 	flushTicker := time.NewTicker(tickInterval)
 	acg.flushTicks = flushTicker.C
+	if acg.healthAggregator != nil {
+		acg.reportHealth()
+		acg.healthTicks = time.NewTicker(healthInterval).C
+	}
 	go acg.loop()
 }
@@ -921,7 +921,7 @@ var _ = Describe("Async calculation graph state sequencing tests:", func() {
 					conf := config.New()
 					conf.FelixHostname = localHostname
 					outputChan := make(chan interface{})
-					asyncGraph := NewAsyncCalcGraph(conf, outputChan)
+					asyncGraph := NewAsyncCalcGraph(config.NewLiveConfig(conf), outputChan, nil)
 					// And a validation filter, with a channel between it
 					// and the async graph.
 					validator := NewValidationFilter(asyncGraph)
@@ -303,6 +303,28 @@ func (buf *EventSequencer) flushProfileDeletes() {
 	})
 }
 
+// DSCPModeLabel is the endpoint label that requests a DSCP treatment for packets from that
+// endpoint.  Its value is one of "preserve", "zero" or "map".  Since the workload's owner
+// controls its labels, the dataplane only honours a mode that is at least as strict as the
+// configured default (WorkloadDSCPMode).
+const DSCPModeLabel = "projectcalico.org/dscp-mode"
+
+// dscpModeFromLabels returns the DSCP mode requested by the endpoint's labels or "" to use the
+// default.  We ignore unknown values rather than pass them on, since the dataplane would treat
+// them as "preserve", which may be more permissive than the default.
+func dscpModeFromLabels(labels map[string]string) string {
+	mode, ok := labels[DSCPModeLabel]
+	if !ok {
+		return ""
+	}
+	switch mode {
+	case "preserve", "zero", "map":
+		return mode
+	}
+	log.WithField("mode", mode).Warn("Ignoring unknown DSCP mode in endpoint labels")
+	return ""
+}
+
 func ModelWorkloadEndpointToProto(ep *model.WorkloadEndpoint, tiers []*proto.TierInfo) *proto.WorkloadEndpoint {
 	mac := ""
 	if ep.Mac != nil {
@@ -318,6 +340,7 @@ func ModelWorkloadEndpointToProto(ep *model.WorkloadEndpoint, tiers []*proto.Tie
 		Tiers:      tiers,
 		Ipv4Nat:    natsToProtoNatInfo(ep.IPv4NAT),
 		Ipv6Nat:    natsToProtoNatInfo(ep.IPv6NAT),
+		DscpMode:   dscpModeFromLabels(ep.Labels),
 	}
 }
 
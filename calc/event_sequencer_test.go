@@ -59,6 +59,35 @@ var _ = DescribeTable("ModelWorkloadEndpointToProto",
 		},
 		Ipv6Nat: []*proto.NatInfo{},
 	}),
+	Entry("workload endpoint with DSCP mode label", model.WorkloadEndpoint{
+		State:    "up",
+		Name:     "bill",
+		IPv4Nets: []net.IPNet{mustParseNet("10.28.0.13/32")},
+		Labels:   map[string]string{"projectcalico.org/dscp-mode": "zero"},
+	}, proto.WorkloadEndpoint{
+		State:    "up",
+		Name:     "bill",
+		Ipv4Nets: []string{"10.28.0.13/32"},
+		Ipv6Nets: []string{},
+		Tiers:    []*proto.TierInfo{},
+		Ipv4Nat:  []*proto.NatInfo{},
+		Ipv6Nat:  []*proto.NatInfo{},
+		DscpMode: "zero",
+	}),
+	Entry("workload endpoint with unknown DSCP mode label", model.WorkloadEndpoint{
+		State:    "up",
+		Name:     "bill",
+		IPv4Nets: []net.IPNet{mustParseNet("10.28.0.13/32")},
+		Labels:   map[string]string{"projectcalico.org/dscp-mode": "trust-me"},
+	}, proto.WorkloadEndpoint{
+		State:    "up",
+		Name:     "bill",
+		Ipv4Nets: []string{"10.28.0.13/32"},
+		Ipv6Nets: []string{},
+		Tiers:    []*proto.TierInfo{},
+		Ipv4Nat:  []*proto.NatInfo{},
+		Ipv6Nat:  []*proto.NatInfo{},
+	}),
 )
 
 var _ = DescribeTable("ModelHostEndpointToProto",
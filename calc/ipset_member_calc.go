@@ -20,7 +20,6 @@ import (
 	"github.com/projectcalico/felix/dispatcher"
 	"github.com/projectcalico/felix/ip"
 	"github.com/projectcalico/felix/multidict"
-	"github.com/projectcalico/felix/set"
 	"github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 )
@@ -45,6 +44,10 @@ type MemberCalculator struct {
 	keyToMatchingIPSetIDs multidict.IfaceToString
 	ipSetIDToIPToKey      map[string]map[ip.Addr][]model.Key
 
+	// Scratch slices, reused by updateEndpointIPs().
+	scratchAddedIPs   []ip.Addr
+	scratchRemovedIPs []ip.Addr
+
 	callbacks IPAddRemoveCallbacks
 }
 
@@ -119,28 +122,25 @@ func (calc *MemberCalculator) updateEndpointIPs(endpointKey model.Key, ips []ip.
 		calc.keyToIPs[endpointKey] = ips
 	}
 
-	oldIPsSet := set.New()
-	for _, ip := range oldIPs {
-		oldIPsSet.Add(ip)
-	}
-
-	addedIPs := make([]ip.Addr, 0)
-	currentIPs := set.New()
+	// Endpoints only have a handful of IPs so a linear scan is cheaper than building sets.
+	// We reuse the scratch slices to avoid allocating on every endpoint update.
+	addedIPs := calc.scratchAddedIPs[:0]
 	for _, ip := range ips {
-		if !oldIPsSet.Contains(ip) {
+		if !containsIP(oldIPs, ip) && !containsIP(addedIPs, ip) {
 			log.Debugf("Added IP: %v", ip)
 			addedIPs = append(addedIPs, ip)
 		}
-		currentIPs.Add(ip)
 	}
 
-	removedIPs := make([]ip.Addr, 0)
+	removedIPs := calc.scratchRemovedIPs[:0]
 	for _, ip := range oldIPs {
-		if !currentIPs.Contains(ip) {
+		if !containsIP(ips, ip) && !containsIP(removedIPs, ip) {
 			log.Debugf("Removed IP: %v", ip)
 			removedIPs = append(removedIPs, ip)
 		}
 	}
+	calc.scratchAddedIPs = addedIPs[:0]
+	calc.scratchRemovedIPs = removedIPs[:0]
 
 	calc.keyToMatchingIPSetIDs.Iter(endpointKey, func(ipSetID string) {
 		log.Debugf("Updating matching IP set: %v", ipSetID)
@@ -210,3 +210,12 @@ func (calc *MemberCalculator) removeMatchFromIndex(ipSetID string, key model.Key
 		}
 	}
 }
+
+func containsIP(ips []ip.Addr, addr ip.Addr) bool {
+	for _, a := range ips {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc
+
+import (
+	"time"
+)
+
+// updateBatcher decides when the AsyncCalcGraph should flush its output so that a burst of
+// datastore updates (for example, a deployment scaling up by hundreds of pods) is sent to the
+// dataplane as one batch rather than as hundreds of small ones, each of which would trigger a
+// separate dataplane apply.
+//
+// Once an update arrives, the batcher holds off flushing until no more updates have arrived
+// for the quiet period.  If updates keep on arriving, it flushes anyway once the oldest
+// pending update has waited for maxLatency.  A zero quiet period disables batching.
+type updateBatcher struct {
+	quietPeriod time.Duration
+	maxLatency  time.Duration
+
+	// firstPendingUpdate is the time of the oldest update that we've not flushed, or the
+	// zero time if there isn't one.
+	firstPendingUpdate time.Time
+	// lastUpdate is the time of the most recent update.
+	lastUpdate time.Time
+}
+
+func newUpdateBatcher(quietPeriod, maxLatency time.Duration) *updateBatcher {
+	return &updateBatcher{
+		quietPeriod: quietPeriod,
+		maxLatency:  maxLatency,
+	}
+}
+
+// OnUpdate records the arrival of an update at the given time.
+func (b *updateBatcher) OnUpdate(now time.Time) {
+	if b.firstPendingUpdate.IsZero() {
+		b.firstPendingUpdate = now
+	}
+	b.lastUpdate = now
+}
+
+// FlushDeadline returns the time at which the pending updates should be flushed.  It returns
+// the zero time if there are no pending updates.
+func (b *updateBatcher) FlushDeadline() time.Time {
+	if b.firstPendingUpdate.IsZero() {
+		return time.Time{}
+	}
+	deadline := b.lastUpdate.Add(b.quietPeriod)
+	if latestDeadline := b.firstPendingUpdate.Add(b.maxLatency); latestDeadline.Before(deadline) {
+		deadline = latestDeadline
+	}
+	return deadline
+}
+
+// ReadyToFlush returns true if the pending updates should be flushed now.
+func (b *updateBatcher) ReadyToFlush(now time.Time) bool {
+	if b.quietPeriod == 0 {
+		return true
+	}
+	return !now.Before(b.FlushDeadline())
+}
+
+// OnFlush records that the pending updates have been flushed.
+func (b *updateBatcher) OnFlush() {
+	b.firstPendingUpdate = time.Time{}
+}
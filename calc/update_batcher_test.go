@@ -0,0 +1,74 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("updateBatcher", func() {
+	var (
+		b  *updateBatcher
+		t0 time.Time
+	)
+
+	at := func(millis int) time.Time {
+		return t0.Add(time.Duration(millis) * time.Millisecond)
+	}
+
+	BeforeEach(func() {
+		b = newUpdateBatcher(50*time.Millisecond, 200*time.Millisecond)
+		t0 = time.Now()
+	})
+
+	It("should have no deadline with nothing pending", func() {
+		Expect(b.FlushDeadline().IsZero()).To(BeTrue())
+	})
+	It("should wait for the quiet period after an update", func() {
+		b.OnUpdate(at(0))
+		Expect(b.FlushDeadline()).To(Equal(at(50)))
+		Expect(b.ReadyToFlush(at(49))).To(BeFalse())
+		Expect(b.ReadyToFlush(at(50))).To(BeTrue())
+	})
+	It("should extend the deadline while updates keep arriving", func() {
+		b.OnUpdate(at(0))
+		b.OnUpdate(at(40))
+		Expect(b.ReadyToFlush(at(60))).To(BeFalse())
+		Expect(b.FlushDeadline()).To(Equal(at(90)))
+	})
+	It("should flush after the max latency even if updates keep arriving", func() {
+		for millis := 0; millis <= 200; millis += 20 {
+			b.OnUpdate(at(millis))
+		}
+		Expect(b.FlushDeadline()).To(Equal(at(200)))
+		Expect(b.ReadyToFlush(at(200))).To(BeTrue())
+	})
+	It("should start a new batch after a flush", func() {
+		b.OnUpdate(at(0))
+		b.OnFlush()
+		Expect(b.FlushDeadline().IsZero()).To(BeTrue())
+		b.OnUpdate(at(300))
+		Expect(b.FlushDeadline()).To(Equal(at(350)))
+		Expect(b.ReadyToFlush(at(349))).To(BeFalse())
+	})
+	It("should always be ready to flush when disabled", func() {
+		b = newUpdateBatcher(0, 200*time.Millisecond)
+		b.OnUpdate(at(0))
+		Expect(b.ReadyToFlush(at(0))).To(BeTrue())
+	})
+})
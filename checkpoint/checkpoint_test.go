@@ -0,0 +1,186 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package checkpoint_test
+
+import (
+	. "github.com/projectcalico/felix/checkpoint"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var (
+	ipSet1 = &proto.IPSetUpdate{
+		Id:      "s1",
+		Members: []string{"10.0.0.1"},
+		Type:    proto.IPSetUpdate_IP_AND_PORT,
+	}
+	profile1ID = proto.ProfileID{Name: "prof1"}
+	profile1   = &proto.ActiveProfileUpdate{Id: &profile1ID, Profile: &proto.Profile{}}
+	wlID1      = proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: "wl1", EndpointId: "eth0"}
+	wl1        = &proto.WorkloadEndpointUpdate{
+		Id:       &wlID1,
+		Endpoint: &proto.WorkloadEndpoint{Name: "cali1", ProfileIds: []string{"prof1"}},
+	}
+	wlID2 = proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: "wl2", EndpointId: "eth0"}
+	wl2   = &proto.WorkloadEndpointUpdate{
+		Id:       &wlID2,
+		Endpoint: &proto.WorkloadEndpoint{Name: "cali2"},
+	}
+)
+
+var _ = Describe("State", func() {
+	var state *State
+
+	BeforeEach(func() {
+		state = NewState()
+	})
+
+	It("should ignore messages that aren't dataplane state", func() {
+		state.OnUpdate(&proto.ConfigUpdate{})
+		state.OnUpdate(&proto.InSync{})
+		Expect(state.Len()).To(BeZero())
+	})
+
+	It("should apply IP set deltas", func() {
+		state.OnUpdate(ipSet1)
+		state.OnUpdate(&proto.IPSetDeltaUpdate{
+			Id:             "s1",
+			AddedMembers:   []string{"10.0.0.2"},
+			RemovedMembers: []string{"10.0.0.1"},
+		})
+		Expect(state.Snapshot()).To(Equal([]interface{}{&proto.IPSetUpdate{
+			Id:      "s1",
+			Members: []string{"10.0.0.2"},
+			Type:    proto.IPSetUpdate_IP_AND_PORT,
+		}}))
+	})
+
+	It("should handle removes", func() {
+		state.OnUpdate(ipSet1)
+		state.OnUpdate(wl1)
+		state.OnUpdate(&proto.WorkloadEndpointRemove{Id: &wlID1})
+		Expect(state.Snapshot()).To(Equal([]interface{}{ipSet1}))
+	})
+
+	It("should order the snapshot by dependency", func() {
+		state.OnUpdate(wl1)
+		state.OnUpdate(profile1)
+		state.OnUpdate(ipSet1)
+		Expect(state.Snapshot()).To(Equal([]interface{}{ipSet1, profile1, wl1}))
+	})
+})
+
+var _ = Describe("Checkpointer", func() {
+	var dir, path string
+	var now time.Time
+	var cp *Checkpointer
+
+	timeNow := func() time.Time {
+		return now
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-checkpoint")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "subdir", "checkpoint")
+		now = time.Now()
+		cp = NewWithShims(path, time.Hour, timeNow)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should restore nothing if there's no checkpoint", func() {
+		Expect(cp.Restore()).To(BeNil())
+		Expect(cp.StaleRemovals()).To(BeEmpty())
+	})
+
+	It("should not write until the datastore is in sync", func() {
+		cp.OnUpdate(wl1)
+		Expect(cp.Write()).To(Succeed())
+		_, err := os.Stat(path)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should ignore a corrupt checkpoint", func() {
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte("garbage"), 0644)).To(Succeed())
+		Expect(cp.Restore()).To(BeNil())
+	})
+
+	Describe("after writing a checkpoint", func() {
+		BeforeEach(func() {
+			cp.OnUpdate(&proto.ConfigUpdate{})
+			cp.OnUpdate(ipSet1)
+			cp.OnUpdate(profile1)
+			cp.OnUpdate(wl1)
+			cp.OnUpdate(wl2)
+			cp.OnUpdate(&proto.InSync{})
+			Expect(cp.Write()).To(Succeed())
+			_, err := os.Stat(path + ".tmp")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			// Simulate a restart.
+			cp = NewWithShims(path, time.Hour, timeNow)
+		})
+
+		It("should restore the checkpoint followed by InSync", func() {
+			msgs := cp.Restore()
+			Expect(msgs).To(HaveLen(5))
+			Expect(msgs[:2]).To(Equal([]interface{}{ipSet1, profile1}))
+			Expect(msgs[2:4]).To(ConsistOf(wl1, wl2))
+			Expect(msgs[4]).To(Equal(&proto.InSync{}))
+		})
+
+		It("should ignore a checkpoint that's too old", func() {
+			now = now.Add(2 * time.Hour)
+			Expect(cp.Restore()).To(BeNil())
+		})
+
+		It("should not restore if the datastore is already in sync", func() {
+			cp.OnUpdate(&proto.InSync{})
+			Expect(cp.Restore()).To(BeNil())
+		})
+
+		It("should skip objects that the datastore has already sent", func() {
+			cp.OnUpdate(&proto.WorkloadEndpointRemove{Id: &wlID1})
+			Expect(cp.Restore()).To(Equal([]interface{}{
+				ipSet1, profile1, wl2, &proto.InSync{},
+			}))
+		})
+
+		It("should remove restored objects that the datastore doesn't mention", func() {
+			cp.Restore()
+			cp.OnUpdate(profile1)
+			cp.OnUpdate(wl1)
+			cp.OnUpdate(&proto.InSync{})
+			Expect(cp.StaleRemovals()).To(Equal([]interface{}{
+				&proto.WorkloadEndpointRemove{Id: &wlID2},
+				&proto.IPSetRemove{Id: "s1"},
+			}))
+			Expect(cp.StaleRemovals()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,265 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package checkpoint supports fast restart by persisting the desired dataplane state to a
+// local file.
+//
+// The desired state is captured as the stream of messages that the calculation graph sends to
+// the dataplane driver; the driver renders the chains, IP sets and routes from those.  While
+// running, we track the state and periodically write it to the checkpoint file.  After a
+// restart, we replay the checkpoint to the driver, followed by an InSync message, so that the
+// driver can apply immediately instead of waiting for the resync from the datastore.  Updates
+// from the datastore then overwrite the restored objects as they arrive.  Once the datastore
+// is in sync, we remove any restored objects that the datastore didn't mention, since they
+// must have been deleted while we were down.
+//
+// The file uses the same framing as the external dataplane driver protocol: each message is
+// wrapped in a ToDataplane envelope and preceded by its length as an 8-byte little-endian
+// integer.
+package checkpoint
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	pb "github.com/gogo/protobuf/proto"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// Checkpointer maintains the checkpoint file.  It isn't safe for concurrent use.
+type Checkpointer struct {
+	path string
+	// maxAge, if non-zero, is the age beyond which we ignore the checkpoint file.
+	maxAge time.Duration
+
+	// state is the current desired state.
+	state *State
+	// dirty is true if state has changed since we last wrote the checkpoint.
+	dirty           bool
+	datastoreInSync bool
+
+	// seenKeys contains the keys of the objects that we've heard about from the datastore
+	// before restoring the checkpoint; nil once we've restored it.
+	seenKeys map[objKey]bool
+	// restoredKeys contains the keys of the objects that we restored from the checkpoint and
+	// haven't since heard about from the datastore.
+	restoredKeys map[objKey]bool
+
+	// Shim for testing.
+	timeNow func() time.Time
+}
+
+func New(path string, maxAge time.Duration) *Checkpointer {
+	return NewWithShims(path, maxAge, time.Now)
+}
+
+func NewWithShims(path string, maxAge time.Duration, timeNow func() time.Time) *Checkpointer {
+	return &Checkpointer{
+		path:         path,
+		maxAge:       maxAge,
+		state:        NewState(),
+		seenKeys:     map[objKey]bool{},
+		restoredKeys: map[objKey]bool{},
+		timeNow:      timeNow,
+	}
+}
+
+// OnUpdate should be called with each message that the calculation graph sends to the
+// dataplane driver.
+func (c *Checkpointer) OnUpdate(msg interface{}) {
+	if _, ok := msg.(*proto.InSync); ok {
+		c.datastoreInSync = true
+		return
+	}
+	key, _, ok := keyOf(msg)
+	if !ok {
+		return
+	}
+	if c.seenKeys != nil {
+		c.seenKeys[key] = true
+	}
+	delete(c.restoredKeys, key)
+	c.state.OnUpdate(msg)
+	c.dirty = true
+}
+
+// Restore loads the checkpoint file and returns the messages that program its state into the
+// dataplane driver, followed by an InSync message.  Objects that we've already heard about
+// from the datastore are skipped, since the datastore's version is newer.  It returns nil if
+// there's no usable checkpoint or if the datastore is already in sync.  It should be called
+// at most once.
+func (c *Checkpointer) Restore() (msgs []interface{}) {
+	seenKeys := c.seenKeys
+	c.seenKeys = nil
+	if c.datastoreInSync {
+		log.Info("Datastore already in sync, not restoring checkpoint")
+		return nil
+	}
+	restored, err := c.load()
+	if os.IsNotExist(err) {
+		log.WithField("path", c.path).Info("No checkpoint to restore")
+		return nil
+	} else if err != nil {
+		log.WithError(err).WithField("path", c.path).Warn("Failed to load checkpoint, ignoring it")
+		return nil
+	} else if restored == nil {
+		return nil
+	}
+	for _, msg := range restored.Snapshot() {
+		key, _, _ := keyOf(msg)
+		if seenKeys[key] {
+			continue
+		}
+		c.restoredKeys[key] = true
+		msgs = append(msgs, msg)
+	}
+	log.WithFields(log.Fields{
+		"path":       c.path,
+		"numObjects": len(msgs),
+	}).Info("Restored checkpoint")
+	msgs = append(msgs, &proto.InSync{})
+	return
+}
+
+// StaleRemovals returns the messages that remove the restored objects that the datastore
+// hasn't mentioned.  It should be called once the datastore is in sync, before the InSync
+// message is passed to the dataplane driver.  The messages are ordered so that objects are
+// removed before the objects that they may refer to.
+func (c *Checkpointer) StaleRemovals() (msgs []interface{}) {
+	byKind := make([][]interface{}, numKinds)
+	for key := range c.restoredKeys {
+		byKind[key.kind] = append(byKind[key.kind], removeMsg(key))
+	}
+	for i := len(byKind) - 1; i >= 0; i-- {
+		msgs = append(msgs, byKind[i]...)
+	}
+	if len(msgs) > 0 {
+		log.WithField("numObjects", len(msgs)).Info("Removing stale objects restored from checkpoint")
+	}
+	c.restoredKeys = map[objKey]bool{}
+	return
+}
+
+// load reads the checkpoint file.  It returns a nil State if the file is too old to use.
+func (c *Checkpointer) load() (*State, error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if c.maxAge > 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if age := c.timeNow().Sub(info.ModTime()); age > c.maxAge {
+			log.WithFields(log.Fields{
+				"path": c.path,
+				"age":  age,
+			}).Info("Checkpoint is too old, ignoring it")
+			return nil, nil
+		}
+	}
+	state := NewState()
+	r := bufio.NewReader(f)
+	lengthBytes := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, lengthBytes)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		data := make([]byte, binary.LittleEndian.Uint64(lengthBytes))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		envelope := proto.ToDataplane{}
+		if err := pb.Unmarshal(data, &envelope); err != nil {
+			return nil, err
+		}
+		msg := proto.UnwrapToDataplane(&envelope)
+		if _, _, ok := keyOf(msg); !ok {
+			return nil, fmt.Errorf("unexpected message in checkpoint: %v", msg)
+		}
+		state.OnUpdate(msg)
+	}
+	return state, nil
+}
+
+// Write writes the current state to the checkpoint file if it has changed since the last
+// write.  Until the datastore is in sync, the state may be incomplete so we don't write it.
+// The file is replaced atomically so that a crash mid-write can't leave a partial checkpoint.
+func (c *Checkpointer) Write() error {
+	if !c.dirty || !c.datastoreInSync {
+		return nil
+	}
+	startTime := c.timeNow()
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmpPath := c.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	msgs := c.state.Snapshot()
+	err = writeMessages(f, msgs)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, c.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	c.dirty = false
+	log.WithFields(log.Fields{
+		"path":       c.path,
+		"numObjects": len(msgs),
+		"timeTaken":  c.timeNow().Sub(startTime),
+	}).Info("Wrote checkpoint")
+	return nil
+}
+
+func writeMessages(f io.Writer, msgs []interface{}) error {
+	w := bufio.NewWriter(f)
+	lengthBytes := make([]byte, 8)
+	for _, msg := range msgs {
+		data, err := pb.Marshal(proto.WrapToDataplane(msg))
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(lengthBytes, uint64(len(data)))
+		if _, err := w.Write(lengthBytes); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package checkpoint
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/set"
+)
+
+// kind is the type of an object in the desired dataplane state.  The kinds are in dependency
+// order: an object may only refer to objects of earlier kinds.
+type kind int
+
+const (
+	kindIPSet kind = iota
+	kindProfile
+	kindPolicy
+	kindHostEndpoint
+	kindWorkloadEndpoint
+	kindHostMetadata
+	kindIPAMPool
+	numKinds
+)
+
+// objKey identifies an object in the desired dataplane state.  id is the object's ID from the
+// update message: a string or one of the proto ID structs.
+type objKey struct {
+	kind kind
+	id   interface{}
+}
+
+// keyOf returns the key of the object that the given message updates or removes.  ok is false
+// for messages that aren't part of the desired dataplane state, such as ConfigUpdate.
+func keyOf(msg interface{}) (key objKey, remove bool, ok bool) {
+	switch msg := msg.(type) {
+	case *proto.IPSetUpdate:
+		return objKey{kindIPSet, msg.Id}, false, true
+	case *proto.IPSetDeltaUpdate:
+		return objKey{kindIPSet, msg.Id}, false, true
+	case *proto.IPSetRemove:
+		return objKey{kindIPSet, msg.Id}, true, true
+	case *proto.ActiveProfileUpdate:
+		return objKey{kindProfile, *msg.Id}, false, true
+	case *proto.ActiveProfileRemove:
+		return objKey{kindProfile, *msg.Id}, true, true
+	case *proto.ActivePolicyUpdate:
+		return objKey{kindPolicy, *msg.Id}, false, true
+	case *proto.ActivePolicyRemove:
+		return objKey{kindPolicy, *msg.Id}, true, true
+	case *proto.HostEndpointUpdate:
+		return objKey{kindHostEndpoint, *msg.Id}, false, true
+	case *proto.HostEndpointRemove:
+		return objKey{kindHostEndpoint, *msg.Id}, true, true
+	case *proto.WorkloadEndpointUpdate:
+		return objKey{kindWorkloadEndpoint, *msg.Id}, false, true
+	case *proto.WorkloadEndpointRemove:
+		return objKey{kindWorkloadEndpoint, *msg.Id}, true, true
+	case *proto.HostMetadataUpdate:
+		return objKey{kindHostMetadata, msg.Hostname}, false, true
+	case *proto.HostMetadataRemove:
+		return objKey{kindHostMetadata, msg.Hostname}, true, true
+	case *proto.IPAMPoolUpdate:
+		return objKey{kindIPAMPool, msg.Id}, false, true
+	case *proto.IPAMPoolRemove:
+		return objKey{kindIPAMPool, msg.Id}, true, true
+	}
+	return
+}
+
+// removeMsg returns the message that removes the object with the given key.
+func removeMsg(key objKey) interface{} {
+	switch key.kind {
+	case kindIPSet:
+		return &proto.IPSetRemove{Id: key.id.(string)}
+	case kindProfile:
+		id := key.id.(proto.ProfileID)
+		return &proto.ActiveProfileRemove{Id: &id}
+	case kindPolicy:
+		id := key.id.(proto.PolicyID)
+		return &proto.ActivePolicyRemove{Id: &id}
+	case kindHostEndpoint:
+		id := key.id.(proto.HostEndpointID)
+		return &proto.HostEndpointRemove{Id: &id}
+	case kindWorkloadEndpoint:
+		id := key.id.(proto.WorkloadEndpointID)
+		return &proto.WorkloadEndpointRemove{Id: &id}
+	case kindHostMetadata:
+		return &proto.HostMetadataRemove{Hostname: key.id.(string)}
+	case kindIPAMPool:
+		return &proto.IPAMPoolRemove{Id: key.id.(string)}
+	}
+	log.WithField("key", key).Panic("Unknown object kind")
+	return nil
+}
+
+// ipSetState holds the state of an IP set.  We track IP sets' members ourselves, rather than
+// storing the latest message, because they're updated incrementally.
+type ipSetState struct {
+	ipSetType proto.IPSetUpdate_IPSetType
+	members   set.Set
+}
+
+// State tracks the desired dataplane state, as conveyed by the stream of messages from the
+// calculation graph to the dataplane driver.
+type State struct {
+	// objects maps from key to the latest update message for each object, or to an *ipSetState
+	// for IP sets.
+	objects map[objKey]interface{}
+}
+
+func NewState() *State {
+	return &State{
+		objects: map[objKey]interface{}{},
+	}
+}
+
+// OnUpdate updates the state with the given message.  Messages that aren't part of the
+// desired dataplane state are ignored.
+func (s *State) OnUpdate(msg interface{}) {
+	key, remove, ok := keyOf(msg)
+	if !ok {
+		return
+	}
+	if remove {
+		delete(s.objects, key)
+		return
+	}
+	switch msg := msg.(type) {
+	case *proto.IPSetUpdate:
+		members := set.New()
+		for _, m := range msg.Members {
+			members.Add(m)
+		}
+		s.objects[key] = &ipSetState{ipSetType: msg.Type, members: members}
+	case *proto.IPSetDeltaUpdate:
+		ipSet, ok := s.objects[key].(*ipSetState)
+		if !ok {
+			// Shouldn't happen; the calculation graph always sends a full update first.
+			log.WithField("id", msg.Id).Warn("Delta update for unknown IP set")
+			return
+		}
+		for _, m := range msg.RemovedMembers {
+			ipSet.members.Discard(m)
+		}
+		for _, m := range msg.AddedMembers {
+			ipSet.members.Add(m)
+		}
+	default:
+		s.objects[key] = msg
+	}
+}
+
+// Len returns the number of objects in the state.
+func (s *State) Len() int {
+	return len(s.objects)
+}
+
+// Snapshot returns the messages needed to program the state into an empty dataplane.  The
+// messages are ordered so that objects come after the objects that they may refer to.
+func (s *State) Snapshot() (msgs []interface{}) {
+	byKind := make([][]interface{}, numKinds)
+	for key, obj := range s.objects {
+		if ipSet, ok := obj.(*ipSetState); ok {
+			update := &proto.IPSetUpdate{Id: key.id.(string), Type: ipSet.ipSetType}
+			ipSet.members.Iter(func(item interface{}) error {
+				update.Members = append(update.Members, item.(string))
+				return nil
+			})
+			obj = update
+		}
+		byKind[key.kind] = append(byKind[key.kind], obj)
+	}
+	for _, kindMsgs := range byKind {
+		msgs = append(msgs, kindMsgs...)
+	}
+	return
+}
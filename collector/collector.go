@@ -0,0 +1,224 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package collector attributes the packets that Felix's rules drop to the rules that dropped
+// them.
+//
+// If drop attribution is enabled, each rule that drops packets because of policy is preceded
+// by a rule that copies the packets to an NFLOG group, with a prefix that identifies the rule
+// (see the rules.DropPrefix... constants).  Explicit deny rules are identified by their rule
+// ID, so the DropCollector tracks the active policies and profiles in order to map rule IDs
+// back to the policy rules that they came from.
+package collector
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/nflog"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/rules"
+)
+
+// Kinds of RuleOrigin, in addition to "Policy" and "Profile", for drops that aren't caused by
+// an explicit rule.
+const (
+	// KindEndOfTier is the kind of a drop at the end of a tier; the origin's Name is the
+	// name of the tier.
+	KindEndOfTier = "EndOfTier"
+	// KindNoProfile is the kind of a drop because no profile accepted the packet.
+	KindNoProfile = "NoProfile"
+)
+
+var (
+	countDropsAttributed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_collector_drops_attributed",
+		Help: "Number of dropped packets that were attributed to a rule.",
+	})
+	countDropsUnattributed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_collector_drops_unattributed",
+		Help: "Number of dropped packets that couldn't be attributed to a rule.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(countDropsAttributed)
+	prometheus.MustRegister(countDropsUnattributed)
+}
+
+// DropEvent describes a packet that was dropped by one of our rules.
+type DropEvent struct {
+	// Origin describes the rule that dropped the packet.  For implicit drops, Origin.Kind is
+	// KindEndOfTier or KindNoProfile and Origin.RuleIndex is -1.
+	Origin iptables.RuleOrigin
+	// Payload holds the packet, starting with its IP header.
+	Payload []byte
+}
+
+// DropCallback is called for each attributed drop.  It is called from the collector's
+// goroutine so it should not block.
+type DropCallback func(event DropEvent)
+
+// DropCollector maps the drop events from the NFLOG group back to the rules that caused them.
+// It implements the dataplane's Manager interface so that it can track the active policies
+// and profiles.
+type DropCollector struct {
+	lock sync.Mutex
+	// ruleOrigins maps from rule ID to the origin of that rule.
+	ruleOrigins map[string]iptables.RuleOrigin
+	// ruleIDsByOwner maps from policy/profile ID to the IDs of its rules, so that we can
+	// clean up when the policy/profile is removed.
+	ruleIDsByOwner map[interface{}][]string
+
+	callbacks []DropCallback
+}
+
+func New() *DropCollector {
+	return &DropCollector{
+		ruleOrigins:    map[string]iptables.RuleOrigin{},
+		ruleIDsByOwner: map[interface{}][]string{},
+	}
+}
+
+// AddCallback registers a callback for drop events.  It should be called before the
+// collector starts processing packets.
+func (c *DropCollector) AddCallback(cb DropCallback) {
+	c.callbacks = append(c.callbacks, cb)
+}
+
+func (c *DropCollector) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.ActivePolicyUpdate:
+		name := msg.Id.Tier + "/" + msg.Id.Name
+		c.updateRules(*msg.Id, "Policy", name, msg.Policy.InboundRules, msg.Policy.OutboundRules)
+	case *proto.ActivePolicyRemove:
+		c.updateRules(*msg.Id, "", "", nil, nil)
+	case *proto.ActiveProfileUpdate:
+		c.updateRules(*msg.Id, "Profile", msg.Id.Name, msg.Profile.InboundRules, msg.Profile.OutboundRules)
+	case *proto.ActiveProfileRemove:
+		c.updateRules(*msg.Id, "", "", nil, nil)
+	}
+}
+
+func (c *DropCollector) CompleteDeferredWork() error {
+	// Nothing to do, we don't defer any work.
+	return nil
+}
+
+func (c *DropCollector) updateRules(ownerID interface{}, kind, name string, inbound, outbound []*proto.Rule) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, ruleID := range c.ruleIDsByOwner[ownerID] {
+		delete(c.ruleOrigins, ruleID)
+	}
+	delete(c.ruleIDsByOwner, ownerID)
+
+	var ruleIDs []string
+	addRules := func(rules []*proto.Rule, direction string) {
+		for i, rule := range rules {
+			if rule.RuleId == "" {
+				continue
+			}
+			c.ruleOrigins[rule.RuleId] = iptables.RuleOrigin{
+				Kind:      kind,
+				Name:      name,
+				Direction: direction,
+				RuleIndex: i,
+				RuleID:    rule.RuleId,
+			}
+			ruleIDs = append(ruleIDs, rule.RuleId)
+		}
+	}
+	addRules(inbound, "inbound")
+	addRules(outbound, "outbound")
+	if len(ruleIDs) > 0 {
+		c.ruleIDsByOwner[ownerID] = ruleIDs
+	}
+}
+
+// LoopProcessingPackets processes the packets from the drop NFLOG group until the channel is
+// closed.
+func (c *DropCollector) LoopProcessingPackets(packetsC <-chan nflog.Packet) {
+	for packet := range packetsC {
+		c.OnPacket(packet)
+	}
+}
+
+// OnPacket attributes a single packet from the drop NFLOG group and passes the resulting
+// DropEvent to the callbacks.
+func (c *DropCollector) OnPacket(packet nflog.Packet) {
+	origin, ok := c.attribute(packet.Prefix)
+	if !ok {
+		countDropsUnattributed.Inc()
+		log.WithField("prefix", packet.Prefix).Debug("Failed to attribute dropped packet")
+		return
+	}
+	countDropsAttributed.Inc()
+	event := DropEvent{
+		Origin:  origin,
+		Payload: packet.Payload,
+	}
+	log.WithField("origin", origin).Debug("Packet dropped")
+	for _, cb := range c.callbacks {
+		cb(event)
+	}
+}
+
+// attribute parses the NFLOG prefix of a dropped packet and returns the origin of the rule
+// that dropped it.
+func (c *DropCollector) attribute(prefix string) (origin iptables.RuleOrigin, ok bool) {
+	switch {
+	case strings.HasPrefix(prefix, rules.DropPrefixRule):
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		origin, ok = c.ruleOrigins[prefix[len(rules.DropPrefixRule):]]
+		return
+	case strings.HasPrefix(prefix, rules.DropPrefixEndOfTier):
+		// "<i or o>:<tier name>"
+		parts := strings.SplitN(prefix[len(rules.DropPrefixEndOfTier):], ":", 2)
+		if len(parts) != 2 {
+			return
+		}
+		direction, dirOK := parseDirection(parts[0])
+		return iptables.RuleOrigin{
+			Kind:      KindEndOfTier,
+			Name:      parts[1],
+			Direction: direction,
+			RuleIndex: -1,
+		}, dirOK
+	case strings.HasPrefix(prefix, rules.DropPrefixNoProfile):
+		direction, dirOK := parseDirection(prefix[len(rules.DropPrefixNoProfile):])
+		return iptables.RuleOrigin{
+			Kind:      KindNoProfile,
+			Direction: direction,
+			RuleIndex: -1,
+		}, dirOK
+	}
+	return
+}
+
+func parseDirection(s string) (direction string, ok bool) {
+	switch s {
+	case "i":
+		return "inbound", true
+	case "o":
+		return "outbound", true
+	}
+	return "", false
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	. "github.com/projectcalico/felix/collector"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/nflog"
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("DropCollector", func() {
+	var c *DropCollector
+	var events []DropEvent
+
+	BeforeEach(func() {
+		c = New()
+		events = nil
+		c.AddCallback(func(event DropEvent) {
+			events = append(events, event)
+		})
+		c.OnUpdate(&proto.ActivePolicyUpdate{
+			Id: &proto.PolicyID{Tier: "default", Name: "pol1"},
+			Policy: &proto.Policy{
+				InboundRules: []*proto.Rule{
+					{Action: "allow", RuleId: "aaaa"},
+					{Action: "deny", RuleId: "bbbb"},
+				},
+				OutboundRules: []*proto.Rule{{Action: "deny", RuleId: "cccc"}},
+			},
+		})
+		c.OnUpdate(&proto.ActiveProfileUpdate{
+			Id:      &proto.ProfileID{Name: "prof1"},
+			Profile: &proto.Profile{InboundRules: []*proto.Rule{{Action: "deny", RuleId: "dddd"}}},
+		})
+	})
+
+	It("should attribute drops by policy rules", func() {
+		c.OnPacket(nflog.Packet{Prefix: "D:R:bbbb", Payload: []byte{1, 2, 3}})
+		Expect(events).To(Equal([]DropEvent{{
+			Origin: iptables.RuleOrigin{
+				Kind:      "Policy",
+				Name:      "default/pol1",
+				Direction: "inbound",
+				RuleIndex: 1,
+				RuleID:    "bbbb",
+			},
+			Payload: []byte{1, 2, 3},
+		}}))
+	})
+
+	It("should attribute drops by profile rules", func() {
+		c.OnPacket(nflog.Packet{Prefix: "D:R:dddd"})
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Origin.String()).To(Equal("profile prof1 inbound rule 0 (ID dddd)"))
+	})
+
+	It("should attribute drops at the end of a tier", func() {
+		c.OnPacket(nflog.Packet{Prefix: "D:T:o:default"})
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Origin).To(Equal(iptables.RuleOrigin{
+			Kind:      KindEndOfTier,
+			Name:      "default",
+			Direction: "outbound",
+			RuleIndex: -1,
+		}))
+	})
+
+	It("should attribute drops because no profile matched", func() {
+		c.OnPacket(nflog.Packet{Prefix: "D:P:i"})
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Origin.Kind).To(Equal(KindNoProfile))
+		Expect(events[0].Origin.Direction).To(Equal("inbound"))
+	})
+
+	It("should ignore packets that it can't attribute", func() {
+		c.OnPacket(nflog.Packet{Prefix: "D:R:unknown"})
+		c.OnPacket(nflog.Packet{Prefix: "D:T:x:default"})
+		c.OnPacket(nflog.Packet{Prefix: "D:T:i"})
+		c.OnPacket(nflog.Packet{Prefix: "foobar"})
+		Expect(events).To(BeEmpty())
+	})
+
+	It("should forget the rules of removed policies", func() {
+		c.OnUpdate(&proto.ActivePolicyRemove{Id: &proto.PolicyID{Tier: "default", Name: "pol1"}})
+		c.OnPacket(nflog.Packet{Prefix: "D:R:bbbb"})
+		c.OnPacket(nflog.Packet{Prefix: "D:R:dddd"})
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Origin.Name).To(Equal("prof1"))
+	})
+
+	It("should forget the old rules of updated policies", func() {
+		c.OnUpdate(&proto.ActivePolicyUpdate{
+			Id: &proto.PolicyID{Tier: "default", Name: "pol1"},
+			Policy: &proto.Policy{
+				InboundRules: []*proto.Rule{{Action: "deny", RuleId: "eeee"}},
+			},
+		})
+		c.OnPacket(nflog.Packet{Prefix: "D:R:bbbb"})
+		c.OnPacket(nflog.Packet{Prefix: "D:R:eeee"})
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Origin.RuleID).To(Equal("eeee"))
+	})
+})
@@ -0,0 +1,100 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sourceOther is the source label that we use for denied packets from sources beyond the
+// DenyCounter's cap.
+const sourceOther = "other"
+
+var (
+	countDeniedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_denied_packets",
+		Help: "Number of packets denied, by the policy (or tier/profile drop) that denied them.",
+	}, []string{"kind", "name", "direction"})
+	countDeniedPacketsBySource = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_denied_packets_by_source",
+		Help: "Number of packets denied, by policy and source IP.  Once the maximum number " +
+			"of source IPs is being tracked, packets from other sources are counted " +
+			"with source=\"other\".",
+	}, []string{"kind", "name", "direction", "source"})
+)
+
+func init() {
+	prometheus.MustRegister(countDeniedPackets)
+	prometheus.MustRegister(countDeniedPacketsBySource)
+}
+
+// DenyCounter counts the denied packets from the collector's drop events in prometheus
+// metrics.  Per-source counts are optional since each source IP adds a set of time series;
+// the number of source IPs is capped to protect the metrics server.
+type DenyCounter struct {
+	maxSourceIPs int
+	sourceIPs    map[string]bool
+}
+
+// NewDenyCounter creates a DenyCounter that tracks up to maxSourceIPs source IPs; if
+// maxSourceIPs is 0, denied packets are only counted by policy.
+func NewDenyCounter(maxSourceIPs int) *DenyCounter {
+	return &DenyCounter{
+		maxSourceIPs: maxSourceIPs,
+		sourceIPs:    map[string]bool{},
+	}
+}
+
+// OnDropEvent is a DropCallback.  Like the other callbacks, it's called from the collector's
+// goroutine.
+func (c *DenyCounter) OnDropEvent(event DropEvent) {
+	kind := strings.ToLower(event.Origin.Kind)
+	name := event.Origin.Name
+	direction := event.Origin.Direction
+	countDeniedPackets.WithLabelValues(kind, name, direction).Inc()
+
+	if c.maxSourceIPs == 0 {
+		return
+	}
+	hdr, err := ParseHeader(event.Payload)
+	if err != nil {
+		log.WithError(err).Debug("Failed to parse denied packet")
+		return
+	}
+	source := c.sourceLabel(hdr.SrcIP.String())
+	countDeniedPacketsBySource.WithLabelValues(kind, name, direction, source).Inc()
+}
+
+// sourceLabel returns the source label to use for the given IP, starting to track it if we
+// are below the cap.  Once tracked, an IP keeps its own time series for the life of the
+// process, so that its counter stays monotonic.
+func (c *DenyCounter) sourceLabel(ip string) string {
+	if c.sourceIPs[ip] {
+		return ip
+	}
+	if len(c.sourceIPs) >= c.maxSourceIPs {
+		return sourceOther
+	}
+	if len(c.sourceIPs) == c.maxSourceIPs-1 {
+		log.WithField("maxSourceIPs", c.maxSourceIPs).Info(
+			"Reached maximum number of source IPs for denied packet metrics, further " +
+				"sources will be counted as \"other\"")
+	}
+	c.sourceIPs[ip] = true
+	return ip
+}
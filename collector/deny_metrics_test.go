@@ -0,0 +1,36 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DenyCounter", func() {
+	It("should cap the number of source IPs", func() {
+		c := NewDenyCounter(2)
+		Expect(c.sourceLabel("10.0.0.1")).To(Equal("10.0.0.1"))
+		Expect(c.sourceLabel("10.0.0.2")).To(Equal("10.0.0.2"))
+		Expect(c.sourceLabel("10.0.0.3")).To(Equal("other"))
+		Expect(c.sourceLabel("10.0.0.1")).To(Equal("10.0.0.1"))
+	})
+
+	It("should count a drop without a parseable packet", func() {
+		c := NewDenyCounter(2)
+		Expect(func() { c.OnDropEvent(DropEvent{Payload: []byte{1}}) }).NotTo(Panic())
+		Expect(c.sourceIPs).To(BeEmpty())
+	})
+})
@@ -0,0 +1,86 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	protoTCP  = 6
+	protoUDP  = 17
+	protoSCTP = 132
+)
+
+// PacketHeader holds the fields of a dropped packet's headers that we report on.
+type PacketHeader struct {
+	Protocol int
+	SrcIP    net.IP
+	DstIP    net.IP
+	// DstPort is set for TCP, UDP and SCTP packets.
+	DstPort int
+}
+
+// ParseHeader extracts the addresses, protocol and destination port from a packet, starting
+// from its IP header.
+func ParseHeader(packet []byte) (hdr PacketHeader, err error) {
+	if len(packet) < 1 {
+		err = fmt.Errorf("empty packet")
+		return
+	}
+	var l4 []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			err = fmt.Errorf("truncated IPv4 header")
+			return
+		}
+		hdr.Protocol = int(packet[9])
+		hdr.SrcIP = net.IP(packet[12:16])
+		hdr.DstIP = net.IP(packet[16:20])
+		headerLen := int(packet[0]&0x0f) * 4
+		if len(packet) >= headerLen {
+			l4 = packet[headerLen:]
+		}
+	case 6:
+		if len(packet) < 40 {
+			err = fmt.Errorf("truncated IPv6 header")
+			return
+		}
+		// We don't follow extension headers; for packets that have them we report the
+		// next header as the protocol and no port.
+		hdr.Protocol = int(packet[6])
+		hdr.SrcIP = net.IP(packet[8:24])
+		hdr.DstIP = net.IP(packet[24:40])
+		l4 = packet[40:]
+	default:
+		err = fmt.Errorf("unknown IP version %d", packet[0]>>4)
+		return
+	}
+	if hasPorts(hdr.Protocol) && len(l4) >= 4 {
+		hdr.DstPort = int(binary.BigEndian.Uint16(l4[2:4]))
+	}
+	return
+}
+
+func hasPorts(protocol int) bool {
+	switch protocol {
+	case protoTCP, protoUDP, protoSCTP:
+		return true
+	}
+	return false
+}
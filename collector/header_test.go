@@ -0,0 +1,63 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	. "github.com/projectcalico/felix/collector"
+
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseHeader", func() {
+	It("should parse an IPv4 TCP packet", func() {
+		packet := make([]byte, 40)
+		packet[0] = 0x45
+		packet[9] = 6
+		copy(packet[12:16], net.ParseIP("10.0.0.1").To4())
+		copy(packet[16:20], net.ParseIP("10.0.0.2").To4())
+		packet[22], packet[23] = 0x1f, 0x90
+		hdr, err := ParseHeader(packet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hdr.Protocol).To(Equal(6))
+		Expect(hdr.SrcIP.String()).To(Equal("10.0.0.1"))
+		Expect(hdr.DstIP.String()).To(Equal("10.0.0.2"))
+		Expect(hdr.DstPort).To(Equal(8080))
+	})
+
+	It("should parse an IPv6 ICMP packet without a port", func() {
+		packet := make([]byte, 48)
+		packet[0] = 0x60
+		packet[6] = 58
+		copy(packet[8:24], net.ParseIP("fd00::1"))
+		copy(packet[24:40], net.ParseIP("fd00::2"))
+		packet[42], packet[43] = 0x1f, 0x90
+		hdr, err := ParseHeader(packet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hdr.Protocol).To(Equal(58))
+		Expect(hdr.SrcIP.String()).To(Equal("fd00::1"))
+		Expect(hdr.DstIP.String()).To(Equal("fd00::2"))
+		Expect(hdr.DstPort).To(Equal(0))
+	})
+
+	It("should reject truncated packets", func() {
+		_, err := ParseHeader([]byte{0x45, 0, 0})
+		Expect(err).To(HaveOccurred())
+		_, err = ParseHeader(nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
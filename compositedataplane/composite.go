@@ -0,0 +1,214 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// compositedataplane implements a dataplane driver that fans out updates to several
+// underlying drivers, each of which is responsible for a subset of the dataplane.  For
+// example, the internal iptables driver can look after host endpoints while an external
+// driver programs workloads on a SmartNIC.
+package compositedataplane
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// Driver is the interface implemented by the underlying dataplane drivers.
+type Driver interface {
+	SendMessage(msg interface{}) error
+	RecvMessage() (msg interface{}, err error)
+}
+
+// Role is a bitmask of the kinds of updates that a driver is responsible for.  Updates that
+// are needed to interpret the others (config, IP sets, policies and profiles, and the in-sync
+// message) are sent to every driver.
+type Role int
+
+const (
+	RoleHostEndpoints Role = 1 << iota
+	RoleWorkloadEndpoints
+	// RoleOther covers the remaining, host-wide, updates: host metadata, IPAM pools and
+	// services.
+	RoleOther
+
+	RoleAll = RoleHostEndpoints | RoleWorkloadEndpoints | RoleOther
+)
+
+// Member is one of the drivers that make up a CompositeDriver.
+type Member struct {
+	Name   string
+	Driver Driver
+	Roles  Role
+}
+
+type recvResult struct {
+	member int
+	msg    interface{}
+	err    error
+}
+
+// CompositeDriver dispatches each update to the drivers that are responsible for it and
+// merges the status messages that they send back.  Endpoint status messages are passed
+// through since each endpoint is owned by exactly one driver.  Process status heartbeats are
+// merged: we only report a heartbeat once every driver has sent one since the last, so a
+// stalled driver stops the heartbeat as it would in the single-driver case.
+type CompositeDriver struct {
+	members []Member
+
+	recvC chan recvResult
+
+	// heartbeats maps from member index to the most recent heartbeat that we've yet to
+	// report.
+	heartbeats map[int]*proto.ProcessStatusUpdate
+}
+
+// New creates a CompositeDriver and starts reading from the given members.  It panics if no
+// member is responsible for a role since the corresponding updates would be lost.
+func New(members ...Member) *CompositeDriver {
+	var roles Role
+	for _, m := range members {
+		roles |= m.Roles
+	}
+	if roles != RoleAll {
+		log.WithField("members", members).Panic("Composite dataplane doesn't cover all roles")
+	}
+	d := &CompositeDriver{
+		members:    members,
+		recvC:      make(chan recvResult),
+		heartbeats: map[int]*proto.ProcessStatusUpdate{},
+	}
+	for i := range members {
+		go d.loopReadingFromMember(i)
+	}
+	return d
+}
+
+func (d *CompositeDriver) loopReadingFromMember(i int) {
+	for {
+		msg, err := d.members[i].Driver.RecvMessage()
+		d.recvC <- recvResult{member: i, msg: msg, err: err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// rolesFor returns the roles that a driver must have to receive the given message, or 0 if
+// the message should go to every driver.
+func rolesFor(msg interface{}) Role {
+	switch msg.(type) {
+	case *proto.HostEndpointUpdate, *proto.HostEndpointRemove:
+		return RoleHostEndpoints
+	case *proto.WorkloadEndpointUpdate, *proto.WorkloadEndpointRemove:
+		return RoleWorkloadEndpoints
+	case *proto.HostMetadataUpdate, *proto.HostMetadataRemove,
+		*proto.IPAMPoolUpdate, *proto.IPAMPoolRemove:
+		return RoleOther
+	}
+	return 0
+}
+
+// SendMessage sends the message to each of the drivers responsible for it.  It gives up on
+// the first error since the connector treats any error as fatal.
+func (d *CompositeDriver) SendMessage(msg interface{}) error {
+	roles := rolesFor(msg)
+	for _, m := range d.members {
+		if roles != 0 && m.Roles&roles == 0 {
+			continue
+		}
+		if err := m.Driver.SendMessage(msg); err != nil {
+			log.WithError(err).WithField("driver", m.Name).Error(
+				"Failed to send message to dataplane driver")
+			return err
+		}
+	}
+	return nil
+}
+
+// RecvMessage returns the next message from any of the drivers, after merging heartbeats.
+func (d *CompositeDriver) RecvMessage() (interface{}, error) {
+	for {
+		result := <-d.recvC
+		if result.err != nil {
+			log.WithError(result.err).WithField("driver", d.members[result.member].Name).Error(
+				"Failed to read from dataplane driver")
+			return nil, result.err
+		}
+		status, ok := result.msg.(*proto.ProcessStatusUpdate)
+		if !ok {
+			return result.msg, nil
+		}
+		d.heartbeats[result.member] = status
+		if len(d.heartbeats) < len(d.members) {
+			continue
+		}
+		merged := d.mergeHeartbeats()
+		d.heartbeats = map[int]*proto.ProcessStatusUpdate{}
+		return merged, nil
+	}
+}
+
+// mergeHeartbeats combines the pending heartbeats, taking the latest timestamp, the lowest
+// uptime, the oldest apply time and reporting in-sync only if all the drivers are in sync.
+func (d *CompositeDriver) mergeHeartbeats() *proto.ProcessStatusUpdate {
+	var merged *proto.ProcessStatusUpdate
+	var latest, oldestApply time.Time
+	for _, hb := range d.heartbeats {
+		if merged == nil {
+			merged = &proto.ProcessStatusUpdate{
+				IsoTimestamp:          hb.IsoTimestamp,
+				Uptime:                hb.Uptime,
+				LastApplyIsoTimestamp: hb.LastApplyIsoTimestamp,
+				InSync:                hb.InSync,
+				NumEndpoints:          hb.NumEndpoints,
+				NumPolicies:           hb.NumPolicies,
+				NumProfiles:           hb.NumProfiles,
+			}
+			latest, _ = time.Parse(time.RFC3339, hb.IsoTimestamp)
+			oldestApply, _ = time.Parse(time.RFC3339, hb.LastApplyIsoTimestamp)
+			continue
+		}
+		if hb.Uptime < merged.Uptime {
+			merged.Uptime = hb.Uptime
+		}
+		if t, err := time.Parse(time.RFC3339, hb.IsoTimestamp); err == nil && t.After(latest) {
+			latest = t
+			merged.IsoTimestamp = hb.IsoTimestamp
+		}
+		// We're only as up to date as the driver that applied least recently; if any
+		// driver has yet to apply, so have we.
+		if merged.LastApplyIsoTimestamp != "" {
+			t, err := time.Parse(time.RFC3339, hb.LastApplyIsoTimestamp)
+			if err != nil {
+				merged.LastApplyIsoTimestamp = ""
+			} else if t.Before(oldestApply) {
+				oldestApply = t
+				merged.LastApplyIsoTimestamp = hb.LastApplyIsoTimestamp
+			}
+		}
+		merged.InSync = merged.InSync && hb.InSync
+		// Each endpoint goes to a single driver but policies and profiles go to all of
+		// them.
+		merged.NumEndpoints += hb.NumEndpoints
+		if hb.NumPolicies > merged.NumPolicies {
+			merged.NumPolicies = hb.NumPolicies
+		}
+		if hb.NumProfiles > merged.NumProfiles {
+			merged.NumProfiles = hb.NumProfiles
+		}
+	}
+	return merged
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compositedataplane_test
+
+import (
+	. "github.com/projectcalico/felix/compositedataplane"
+
+	"errors"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+type mockDriver struct {
+	lock    sync.Mutex
+	sent    []interface{}
+	sendErr error
+	recvC   chan interface{}
+}
+
+func newMockDriver() *mockDriver {
+	return &mockDriver{
+		recvC: make(chan interface{}),
+	}
+}
+
+func (d *mockDriver) SendMessage(msg interface{}) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.sendErr != nil {
+		return d.sendErr
+	}
+	d.sent = append(d.sent, msg)
+	return nil
+}
+
+func (d *mockDriver) RecvMessage() (interface{}, error) {
+	msg, ok := <-d.recvC
+	if !ok {
+		return nil, errors.New("closed")
+	}
+	return msg, nil
+}
+
+func (d *mockDriver) Sent() []interface{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.sent
+}
+
+var _ = Describe("CompositeDriver", func() {
+	var hostDriver, workloadDriver *mockDriver
+	var driver *CompositeDriver
+
+	BeforeEach(func() {
+		hostDriver = newMockDriver()
+		workloadDriver = newMockDriver()
+		driver = New(
+			Member{Name: "host", Driver: hostDriver, Roles: RoleHostEndpoints | RoleOther},
+			Member{Name: "workload", Driver: workloadDriver, Roles: RoleWorkloadEndpoints},
+		)
+	})
+
+	It("should panic if a role isn't covered", func() {
+		Expect(func() {
+			New(Member{Name: "host", Driver: hostDriver, Roles: RoleHostEndpoints})
+		}).To(Panic())
+	})
+
+	It("should send shared updates to all drivers", func() {
+		msgs := []interface{}{
+			&proto.ConfigUpdate{},
+			&proto.IPSetUpdate{Id: "s1"},
+			&proto.ActivePolicyUpdate{Id: &proto.PolicyID{Tier: "default", Name: "pol1"}},
+			&proto.InSync{},
+		}
+		for _, msg := range msgs {
+			Expect(driver.SendMessage(msg)).To(Succeed())
+		}
+		Expect(hostDriver.Sent()).To(Equal(msgs))
+		Expect(workloadDriver.Sent()).To(Equal(msgs))
+	})
+
+	It("should route endpoint updates to the responsible driver", func() {
+		hepUpd := &proto.HostEndpointUpdate{Id: &proto.HostEndpointID{EndpointId: "eth0"}}
+		wepUpd := &proto.WorkloadEndpointUpdate{Id: &proto.WorkloadEndpointID{WorkloadId: "wl1"}}
+		hostMeta := &proto.HostMetadataUpdate{Hostname: "host1"}
+		Expect(driver.SendMessage(hepUpd)).To(Succeed())
+		Expect(driver.SendMessage(wepUpd)).To(Succeed())
+		Expect(driver.SendMessage(hostMeta)).To(Succeed())
+		Expect(hostDriver.Sent()).To(Equal([]interface{}{hepUpd, hostMeta}))
+		Expect(workloadDriver.Sent()).To(Equal([]interface{}{wepUpd}))
+	})
+
+	It("should return send errors", func() {
+		workloadDriver.sendErr = errors.New("broken")
+		Expect(driver.SendMessage(&proto.InSync{})).NotTo(Succeed())
+	})
+
+	It("should pass through endpoint status", func() {
+		status := &proto.WorkloadEndpointStatusUpdate{Status: &proto.EndpointStatus{Status: "up"}}
+		go func() { workloadDriver.recvC <- status }()
+		msg, err := driver.RecvMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(Equal(status))
+	})
+
+	It("should only report a heartbeat once all drivers have sent one", func() {
+		status := &proto.HostEndpointStatusUpdate{Status: &proto.EndpointStatus{Status: "up"}}
+		go func() {
+			hostDriver.recvC <- &proto.ProcessStatusUpdate{
+				IsoTimestamp: "2017-01-01T00:00:10Z",
+				Uptime:       100,
+			}
+			hostDriver.recvC <- &proto.ProcessStatusUpdate{
+				IsoTimestamp: "2017-01-01T00:00:20Z",
+				Uptime:       110,
+			}
+			hostDriver.recvC <- status
+		}()
+		// The host driver's heartbeats are held back, so its endpoint status comes first.
+		msg, err := driver.RecvMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(Equal(status))
+
+		go func() {
+			workloadDriver.recvC <- &proto.ProcessStatusUpdate{
+				IsoTimestamp: "2017-01-01T00:00:15Z",
+				Uptime:       50,
+			}
+		}()
+		msg, err = driver.RecvMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(Equal(&proto.ProcessStatusUpdate{
+			IsoTimestamp: "2017-01-01T00:00:20Z",
+			Uptime:       50,
+		}))
+	})
+
+	It("should merge the dataplane state in heartbeats", func() {
+		go func() {
+			hostDriver.recvC <- &proto.ProcessStatusUpdate{
+				IsoTimestamp:          "2017-01-01T00:00:10Z",
+				Uptime:                100,
+				LastApplyIsoTimestamp: "2017-01-01T00:00:05Z",
+				InSync:                true,
+				NumEndpoints:          1,
+				NumPolicies:           3,
+				NumProfiles:           2,
+			}
+			workloadDriver.recvC <- &proto.ProcessStatusUpdate{
+				IsoTimestamp:          "2017-01-01T00:00:15Z",
+				Uptime:                50,
+				LastApplyIsoTimestamp: "2017-01-01T00:00:01Z",
+				InSync:                false,
+				NumEndpoints:          10,
+				NumPolicies:           4,
+				NumProfiles:           1,
+			}
+		}()
+		msg, err := driver.RecvMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(Equal(&proto.ProcessStatusUpdate{
+			IsoTimestamp:          "2017-01-01T00:00:15Z",
+			Uptime:                50,
+			LastApplyIsoTimestamp: "2017-01-01T00:00:01Z",
+			InSync:                false,
+			NumEndpoints:          11,
+			NumPolicies:           4,
+			NumProfiles:           2,
+		}))
+	})
+
+	It("should return receive errors", func() {
+		close(hostDriver.recvC)
+		_, err := driver.RecvMessage()
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -21,12 +21,14 @@ import (
 	"os"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/projectcalico/felix/markbits"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/etcd"
 	"github.com/projectcalico/libcalico-go/lib/client"
@@ -35,8 +37,10 @@ import (
 var (
 	IfaceListRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,15}(,[a-zA-Z0-9_-]{1,15})*$`)
 	AuthorityRegexp = regexp.MustCompile(`^[^:/]+:\d+$`)
-	HostnameRegexp  = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
-	StringRegexp    = regexp.MustCompile(`^.*$`)
+	// AuthorityListRegexp matches a comma-separated list of host:port pairs.
+	AuthorityListRegexp = regexp.MustCompile(`^[^:/,]+:\d+(,[^:/,]+:\d+)*$`)
+	HostnameRegexp      = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	StringRegexp        = regexp.MustCompile(`^.*$`)
 )
 
 const (
@@ -46,19 +50,21 @@ const (
 )
 
 // Source of a config value.  Values from higher-numbered sources override
-// those from lower-numbered sources.  Note: some parameters (such as those
+// those from lower-numbered sources.  The datastore sources take precedence over
+// the local ones so that the cluster's config can be managed centrally, with
+// per-host overrides where needed.  Note: some parameters (such as those
 // needed to connect to the datastore) can only be set from a local source.
 type Source uint8
 
 const (
 	Default = iota
-	DatastoreGlobal
-	DatastorePerHost
 	ConfigFile
 	EnvironmentVariable
+	DatastoreGlobal
+	DatastorePerHost
 )
 
-var SourcesInDescendingOrder = []Source{EnvironmentVariable, ConfigFile, DatastorePerHost, DatastoreGlobal}
+var SourcesInDescendingOrder = []Source{DatastorePerHost, DatastoreGlobal, EnvironmentVariable, ConfigFile}
 
 func (source Source) String() string {
 	switch source {
@@ -87,12 +93,23 @@ func (source Source) Local() bool {
 
 // Config contains the best, parsed config values loaded from the various sources.
 // We use tags to control the parsing and validation.
+//
+// UpdateFrom() modifies the Config in place so it may only be used while the Config is private
+// to its owner.  Once the Config is shared with other goroutines, use a LiveConfig to apply
+// updates.
 type Config struct {
 	// Configuration parameters.
 	UseInternalDataplaneDriver bool   `config:"bool;true"`
 	DataplaneDriver            string `config:"file(must-exist,executable);calico-iptables-plugin;non-zero,die-on-fail,skip-default-validation"`
+	// DataplaneDriverAddress, if set, is the address of an external dataplane driver to
+	// connect to over gRPC instead of starting DataplaneDriver as a child process.  Either
+	// "host:port" or "unix:<path>".
+	DataplaneDriverAddress string `config:"string;"`
+	// WorkloadDataplaneDriverAddress, if set, is the address of an external gRPC dataplane
+	// driver that takes over responsibility for workload endpoints from the main driver.
+	WorkloadDataplaneDriverAddress string `config:"string;"`
 
-	DatastoreType string `config:"oneof(kubernetes,etcdv2);etcdv2;non-zero,die-on-fail"`
+	DatastoreType string `config:"oneof(kubernetes,etcdv2,etcdv3,consul,file);etcdv2;non-zero,die-on-fail"`
 
 	FelixHostname string `config:"hostname;;local,non-zero"`
 
@@ -103,10 +120,126 @@ type Config struct {
 	EtcdCaFile    string   `config:"file(must-exist);;local"`
 	EtcdEndpoints []string `config:"endpoint-list;;local"`
 
+	// Consul connection parameters, used when DatastoreType is "consul".
+	ConsulAddr     string `config:"authority;127.0.0.1:8500;local"`
+	ConsulScheme   string `config:"oneof(http,https);http;local"`
+	ConsulToken    string `config:"string;;local"`
+	ConsulKeyFile  string `config:"file(must-exist);;local"`
+	ConsulCertFile string `config:"file(must-exist);;local"`
+	ConsulCaFile   string `config:"file(must-exist);;local"`
+
+	// DatastoreFileDir is the directory of JSON/YAML files to load the datastore from when
+	// DatastoreType is "file".  If DatastoreFileWatch is set, Felix reloads the files when
+	// the directory changes.
+	DatastoreFileDir   string `config:"file(must-exist);;local"`
+	DatastoreFileWatch bool   `config:"bool;true;local"`
+
+	// TyphaAddr, if set, is a comma-separated list of host:port addresses of Typha fan-out
+	// proxies.  Felix receives its datastore updates from one of them, chosen at random,
+	// instead of watching the datastore itself.  If it can't connect to any of them for
+	// TyphaFallbackTimeoutSecs, it falls back to watching the datastore; 0 disables the
+	// fallback.
+	TyphaAddr                string `config:"authority-list;;local"`
+	TyphaReadTimeoutSecs     int    `config:"int(1,3600);30;local"`
+	TyphaFallbackTimeoutSecs int    `config:"int(0,86400);60;local"`
+
 	Ipv6Support    bool `config:"bool;true"`
 	IgnoreLooseRPF bool `config:"bool;false"`
 
-	IptablesRefreshInterval int `config:"int;10"`
+	IptablesRefreshInterval         int  `config:"int;10;reloadable"`
+	IptablesMinResyncIntervalMillis int  `config:"int;0"`
+	IptablesFlushCheckIntervalSecs  int  `config:"int;5"`
+	IptablesPreValidate             bool `config:"bool;false"`
+	IpsetsRefreshInterval           int  `config:"int;10;reloadable"`
+
+	PolicyCountersRefreshIntervalSecs int `config:"int;0"`
+
+	RouteTableProtocol int  `config:"int(0,255);0"`
+	RouteMetric        int  `config:"int;0"`
+	RouteOnLink        bool `config:"bool;false"`
+
+	ConntrackFlushRateLimit            int `config:"int;50"`
+	ConntrackMaxEntries                int `config:"int;0"`
+	ConntrackTCPEstablishedTimeoutSecs int `config:"int;0"`
+	ConntrackUDPTimeoutSecs            int `config:"int;0"`
+	ConntrackGenericTimeoutSecs        int `config:"int;0"`
+
+	FlowLogsFileEnabled               bool   `config:"bool;false"`
+	FlowLogsFileDirectory             string `config:"file;/var/log/calico/flowlogs"`
+	FlowLogsFileMaxFileSizeMB         int    `config:"int(1,100000);100;non-zero"`
+	FlowLogsFileMaxFiles              int    `config:"int;5"`
+	FlowLogsFlushIntervalSecs         int    `config:"int(1,86400);300;non-zero"`
+	FlowLogsConntrackPollIntervalSecs int    `config:"int(1,3600);10;non-zero"`
+	FlowLogsSyslogAddress             string `config:"authority;"`
+	FlowLogsSyslogTLSEnabled          bool   `config:"bool;false"`
+	FlowLogsSyslogCAFile              string `config:"file(must-exist);"`
+	FlowLogsKafkaBrokers              string `config:"authority-list;"`
+	FlowLogsKafkaTopic                string `config:"string;calico-flow-logs;non-zero"`
+	FlowLogsKafkaBatchSize            int    `config:"int(1,100000);100;non-zero"`
+
+	XDPEnabled     bool   `config:"bool;false"`
+	XDPProgramFile string `config:"file;/usr/lib/calico/bpf/xdp-filter.o"`
+
+	IptablesChainDeletionGracePeriodSecs int `config:"int;0"`
+	IptablesMaxChainLength               int `config:"int(0,1000000);0"`
+	// IptablesMaxRestoreLines, if non-zero, splits large iptables updates into several
+	// iptables-restore transactions of at most that many lines.  The update to a single
+	// chain is never split.
+	IptablesMaxRestoreLines int `config:"int(0,10000000);0"`
+
+	// IptablesFailureMode applies to the filter table; the other tables don't support the
+	// failsafe rulesets.
+	IptablesFailureMode       string `config:"oneof(Panic,LeaveUntouched,FailsafeAllow,DropAll);Panic;non-zero"`
+	IptablesNATFailureMode    string `config:"oneof(Panic,LeaveUntouched);Panic;non-zero"`
+	IptablesMangleFailureMode string `config:"oneof(Panic,LeaveUntouched);Panic;non-zero"`
+	IptablesRawFailureMode    string `config:"oneof(Panic,LeaveUntouched);Panic;non-zero"`
+
+	IptablesLockFilePath            string  `config:"file;/run/xtables.lock"`
+	IptablesLockTimeoutSecs         float64 `config:"float;0"`
+	IptablesLockProbeIntervalMillis int     `config:"int;50"`
+
+	// InstanceIDFile is where Felix persists the ID that it records in its iptables instance
+	// marker chains, which lets it recognise the rules left by its own previous run.  It
+	// should be on storage that survives a restart of Felix.
+	InstanceIDFile string `config:"file;/var/lib/calico/felix-instance-id;local"`
+
+	DataplaneBinDir       string `config:"file;"`
+	DataplaneHostNetnsPID int    `config:"int;0"`
+
+	IptablesCommandTimeoutSecs        int `config:"int;30"`
+	DataplaneApplyWatchdogTimeoutSecs int `config:"int;90"`
+	InterfaceDampingIntervalMillis    int `config:"int;0"`
+
+	// DataplaneApplyDelayMillis, if non-zero, is the time that the dataplane waits after
+	// receiving an update before applying it, so that updates that arrive close together
+	// are applied in one batch.  If DataplaneApplyAdaptive is true, the delay widens while
+	// updates keep arriving.  DataplaneApplyMaxDelayMillis bounds the delay; 0 means no
+	// bound.
+	DataplaneApplyDelayMillis    int  `config:"int(0,60000);0"`
+	DataplaneApplyMaxDelayMillis int  `config:"int(0,600000);1000"`
+	DataplaneApplyAdaptive       bool `config:"bool;false"`
+
+	// DataplaneApplyRateLimit is the maximum average number of times per second that the
+	// dataplane applies updates; DataplaneApplyBurst is the number of applies that may happen
+	// back-to-back before the limit kicks in.  Updates that arrive while the dataplane is
+	// throttled are coalesced into the next apply.
+	DataplaneApplyRateLimit int `config:"int(1,1000);10"`
+	DataplaneApplyBurst     int `config:"int(1,1000);10"`
+
+	// GracefulRestartTimeoutSecs, if non-zero, is the maximum time that the dataplane waits
+	// for the datastore to be in sync before it applies its (possibly incomplete) state
+	// anyway.  0 means wait indefinitely.
+	GracefulRestartTimeoutSecs int `config:"int(0,86400);0"`
+
+	DataplaneOfflineRenderDir string `config:"file;"`
+	DataplaneReadOnly         bool   `config:"bool;false"`
+
+	IptablesAuditLogSize int    `config:"int;100"`
+	IptablesAuditLogFile string `config:"file;"`
+
+	IptablesRuleHashAlgorithm string `config:"oneof(sha224,sha256);sha224;non-zero"`
+	IptablesRuleHashLength    int    `config:"int(8,43);16;non-zero"`
+	IptablesRuleHashSeed      string `config:"string;"`
 
 	MetadataAddr string `config:"hostname;127.0.0.1;die-on-fail"`
 	MetadataPort int    `config:"int(0,65535);8775;die-on-fail"`
@@ -115,32 +248,124 @@ type Config struct {
 
 	ChainInsertMode             string `config:"oneof(insert,append);insert;non-zero,die-on-fail"`
 	DefaultEndpointToHostAction string `config:"oneof(DROP,RETURN,ACCEPT);DROP;non-zero,die-on-fail"`
+	IptablesFilterAllowAction   string `config:"oneof(ACCEPT,RETURN);ACCEPT;non-zero"`
 	LogPrefix                   string `config:"string;calico-packet"`
+	LogActionNFLOGGroup         int    `config:"int(0,65535);0"`
+	RejectWith                  string `config:"oneof(port-unreachable,host-unreachable,net-unreachable,admin-prohibited,tcp-reset);port-unreachable;non-zero"`
+	DropNFLOGGroup              int    `config:"int(0,65535);0"`
+
+	DeniedPacketMetricsMaxSourceIPs int `config:"int(0,100000);0"`
+
+	IptablesPolicyNameComments bool `config:"bool;false"`
 
 	LogFilePath string `config:"file;/var/log/calico/felix.log;die-on-fail"`
+	// LogFileFormat selects the format of the log file: "text" (the same format as the
+	// screen target) or "json" (one structured JSON object per line).
+	LogFileFormat string `config:"oneof(text,json);text;non-zero"`
+	// LogFileMaxSizeMB, if non-zero, enables size-based rotation of the log file; we keep
+	// up to LogFileMaxFiles rotated files.  If zero, the file can still be rotated
+	// externally, by logrotate, for example.
+	LogFileMaxSizeMB int `config:"int(0,100000);0"`
+	LogFileMaxFiles  int `config:"int(1,1000);5;non-zero"`
+
+	// LogRateLimitBurst is the number of times that the same log (from the same line of
+	// code, with the same message) may be logged in each LogRateLimitIntervalSecs; further
+	// repeats are suppressed and then summarised at the end of the interval.  Setting
+	// LogRateLimitIntervalSecs to 0 disables rate limiting.
+	LogRateLimitIntervalSecs int `config:"int(0,86400);60"`
+	LogRateLimitBurst        int `config:"int(1,1000000);100;non-zero"`
 
-	LogSeverityFile   string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO"`
-	LogSeverityScreen string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO"`
-	LogSeveritySys    string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO"`
+	LogSeverityFile   string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO;reloadable"`
+	LogSeverityScreen string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO;reloadable"`
+	LogSeveritySys    string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO;reloadable"`
+
+	// LogSeverityXXX, if set, overrides the severity of the above targets for the logs of
+	// one subsystem.  For example, LogSeverityIptables=DEBUG enables debug logs from the
+	// iptables writer only.
+	LogSeverityIptables  string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);;reloadable"`
+	LogSeverityIPSets    string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);;reloadable"`
+	LogSeverityRoutes    string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);;reloadable"`
+	LogSeverityCalcGraph string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);;reloadable"`
+	LogSeverityDatastore string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);;reloadable"`
 
 	IpInIpEnabled    bool   `config:"bool;false"`
-	IpInIpMtu        int    `config:"int;1440;non-zero"`
+	IpInIpMtu        int    `config:"int;1440"`
 	IpInIpTunnelAddr net.IP `config:"ipv4;"`
 
+	VXLANEnabled    bool   `config:"bool;false"`
+	VXLANVNI        int    `config:"int(1,16777215);4096"`
+	VXLANPort       int    `config:"int(1,65535);4789"`
+	VXLANMTU        int    `config:"int;1410;non-zero"`
+	VXLANTunnelAddr net.IP `config:"ipv4;"`
+
+	// WorkloadRoutingTableIndex, if non-zero, enables policy routing rules that look up traffic
+	// from local workloads in the given routing table before the main table.
+	WorkloadRoutingTableIndex   int `config:"int(0,252);0"`
+	WorkloadRoutingRulePriority int `config:"int(1,32765);100;non-zero"`
+
 	ReportingIntervalSecs int `config:"int;30"`
-	ReportingTTLSecs      int `config:"int;90"`
+	ReportingTTLSecs      int `config:"int;90;reloadable"`
 
 	EndpointReportingEnabled   bool    `config:"bool;false"`
 	EndpointReportingDelaySecs float64 `config:"float;1.0"`
 
+	PolicyReadyFile string `config:"file;;local"`
+
+	EndpointStatusFileDirectory string `config:"file;;local"`
+
+	// CheckpointFile, if set, is the file that Felix writes its desired dataplane state to,
+	// every CheckpointIntervalSecs once the datastore is in sync.  On restart, Felix restores
+	// the checkpoint (if it's no older than CheckpointMaxAgeSecs; 0 means no limit) so that the
+	// dataplane can be programmed straight away while the datastore resync completes.
+	CheckpointFile         string `config:"file;;local"`
+	CheckpointIntervalSecs int    `config:"int(1,3600);30"`
+	CheckpointMaxAgeSecs   int    `config:"int(0,604800);3600"`
+
+	// CalcGraphBatchQuietPeriodMillis, if non-zero, makes the calculation graph coalesce
+	// bursts of datastore updates: it holds on to its output until no updates have arrived
+	// for the quiet period so that the dataplane applies the whole burst at once.  If
+	// updates keep arriving, CalcGraphBatchMaxLatencyMillis bounds the delay.
+	CalcGraphBatchQuietPeriodMillis int `config:"int(0,10000);0"`
+	CalcGraphBatchMaxLatencyMillis  int `config:"int(1,60000);500;non-zero"`
+
 	MaxIpsetSize int `config:"int;1048576;non-zero"`
 
 	IptablesMarkMask uint32 `config:"mark-bitmask;0xff000000;non-zero,die-on-fail"`
 
+	KubeIPVSSupportEnabled bool   `config:"bool;false"`
+	KubeProxyMarkMask      uint32 `config:"mark-bitmask;0xc000"`
+
 	DisableConntrackInvalidCheck bool `config:"bool;false"`
 
-	PrometheusMetricsEnabled bool `config:"bool;false"`
-	PrometheusMetricsPort    int  `config:"int(0,65535);9091"`
+	WorkloadDSCPMode string          `config:"oneof(preserve,zero,map);preserve;non-zero,die-on-fail"`
+	WorkloadDSCPMap  map[uint8]uint8 `config:"dscp-map;;die-on-fail"`
+
+	// WorkloadSourceCheck controls whether we drop packets from workloads that don't come
+	// from the endpoint's own IP (and, optionally, MAC) address.
+	WorkloadSourceCheck string `config:"oneof(none,ip,ip-and-mac);none;non-zero,die-on-fail"`
+	// WorkloadSourceCheckExemptIfacePrefixes is a comma-separated list of interface name
+	// prefixes.  Workloads whose interface matches one of them are exempt from the source
+	// check; for example, VMs that act as routers and legitimately forward traffic from other
+	// sources.
+	WorkloadSourceCheckExemptIfacePrefixes string `config:"iface-list;"`
+
+	// HealthEnabled enables the /liveness and /readiness endpoints.  The dataplane is
+	// reported dead if it doesn't complete a pass of its main loop (which includes any
+	// apply) within HealthDataplaneTimeoutSecs.
+	HealthEnabled              bool   `config:"bool;false"`
+	HealthHost                 string `config:"hostname;"`
+	HealthPort                 int    `config:"int(0,65535);9099"`
+	HealthDataplaneTimeoutSecs int    `config:"int(1,86400);90"`
+
+	PrometheusMetricsEnabled bool   `config:"bool;false"`
+	PrometheusMetricsHost    string `config:"hostname;"`
+	PrometheusMetricsPort    int    `config:"int(0,65535);9091"`
+	// PrometheusMetricsCertFile and PrometheusMetricsKeyFile, if set, make the metrics
+	// endpoint serve HTTPS.  If PrometheusMetricsCAFile is also set, clients must present
+	// a certificate signed by that CA.
+	PrometheusMetricsCertFile string `config:"file(must-exist);;local"`
+	PrometheusMetricsKeyFile  string `config:"file(must-exist);;local"`
+	PrometheusMetricsCAFile   string `config:"file(must-exist);;local"`
 
 	FailsafeInboundHostPorts  []ProtoPort `config:"port-list;tcp:22,udp:68;die-on-fail"`
 	FailsafeOutboundHostPorts []ProtoPort `config:"port-list;tcp:2379,tcp:2380,tcp:4001,tcp:7001,udp:53,udp:67;die-on-fail"`
@@ -152,19 +377,29 @@ type Config struct {
 	DebugMemoryProfilePath  string `config:"file;;"`
 	DebugDisableLogDropping bool   `config:"bool;false"`
 
+	DebugServerHost string `config:"hostname;localhost"`
+	DebugServerPort int    `config:"int(0,65535);0"`
+
 	// State tracking.
 
 	// nameToSource tracks where we loaded each config param from.
 	sourceToRawConfig map[Source]map[string]string
 	rawValues         map[string]string
 	Err               error
+	// InvalidValues records the invalid values that we replaced with their defaults rather
+	// than failing, since the parameters aren't critical.
+	InvalidValues []error
 
-	numIptablesBitsAllocated int
+	// rawValueSources records the source of each entry in rawValues.
+	rawValueSources map[string]Source
 }
 
 type ProtoPort struct {
 	Protocol string
 	Port     uint16
+	// Net, if non-empty, is the CIDR that the entry is limited to: the source of inbound
+	// traffic or the destination of outbound traffic.
+	Net string
 }
 
 // Load parses and merges the rawData from one particular source into this config object.
@@ -192,10 +427,111 @@ func (config *Config) UpdateFrom(rawData map[string]string, source Source) (chan
 	return
 }
 
+// copy returns a copy of the config that can be updated without affecting the original.  The
+// parsed values themselves are shared; that's safe because resolve() replaces them rather than
+// modifying them.
+func (config *Config) copy() *Config {
+	c := *config
+	c.sourceToRawConfig = make(map[Source]map[string]string)
+	for source, rawConfig := range config.sourceToRawConfig {
+		c.sourceToRawConfig[source] = rawConfig
+	}
+	return &c
+}
+
+// withLocalSources returns a copy of the config with freshly-loaded environment and config file
+// values merged in, for example after the config file has been edited.  Changes to reloadable
+// parameters are merged in and returned in applied; changes to other parameters would need a
+// restart so they are left out (the previous values are kept) and returned in restartNeeded.
+// If the new values fail validation, an error is returned.
+func (config *Config) withLocalSources(
+	envConfig, fileConfig map[string]string,
+) (updated *Config, applied, restartNeeded []string, err error) {
+	// Work out the effect of the new values on a scratch copy of the config.
+	candidate := &Config{
+		rawValues:         config.rawValues,
+		sourceToRawConfig: make(map[Source]map[string]string),
+	}
+	for source, rawConfig := range config.sourceToRawConfig {
+		candidate.sourceToRawConfig[source] = rawConfig
+	}
+	for _, param := range knownParams {
+		param.setDefault(candidate)
+	}
+	candidate.FelixHostname = config.FelixHostname
+	candidate.UpdateFrom(envConfig, EnvironmentVariable)
+	candidate.UpdateFrom(fileConfig, ConfigFile)
+	candidate.Validate()
+	if candidate.Err != nil {
+		return nil, nil, nil, candidate.Err
+	}
+
+	changed, _ := ChangedParams(config.rawValues, candidate.rawValues)
+	for _, name := range changed {
+		param, ok := knownParams[strings.ToLower(name)]
+		if ok && param.GetMetadata().Reloadable {
+			applied = append(applied, name)
+			continue
+		}
+		restartNeeded = append(restartNeeded, name)
+		// Keep the current value(s) of the parameter.
+		envConfig = replaceRawValue(envConfig, config.sourceToRawConfig[EnvironmentVariable], name)
+		fileConfig = replaceRawValue(fileConfig, config.sourceToRawConfig[ConfigFile], name)
+	}
+	if len(applied) > 0 {
+		updated = config.copy()
+		updated.UpdateFrom(envConfig, EnvironmentVariable)
+		updated.UpdateFrom(fileConfig, ConfigFile)
+	}
+	return
+}
+
+// replaceRawValue returns a copy of newRaw with the value of the named parameter taken from
+// oldRaw (or removed, if it isn't in oldRaw).  Parameter names are case-insensitive.
+func replaceRawValue(newRaw, oldRaw map[string]string, name string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range newRaw {
+		if !strings.EqualFold(k, name) {
+			result[k] = v
+		}
+	}
+	for k, v := range oldRaw {
+		if strings.EqualFold(k, name) {
+			result[k] = v
+		}
+	}
+	return result
+}
+
 func (c *Config) InterfacePrefixes() []string {
 	return strings.Split(c.InterfacePrefix, ",")
 }
 
+// WorkloadSourceCheckExemptIfacePrefixList returns the interface prefixes in
+// WorkloadSourceCheckExemptIfacePrefixes.
+func (c *Config) WorkloadSourceCheckExemptIfacePrefixList() []string {
+	if c.WorkloadSourceCheckExemptIfacePrefixes == "" {
+		return nil
+	}
+	return strings.Split(c.WorkloadSourceCheckExemptIfacePrefixes, ",")
+}
+
+// FlowLogsKafkaBrokerList returns the host:port of each Kafka broker in FlowLogsKafkaBrokers.
+func (c *Config) FlowLogsKafkaBrokerList() []string {
+	if c.FlowLogsKafkaBrokers == "" {
+		return nil
+	}
+	return strings.Split(c.FlowLogsKafkaBrokers, ",")
+}
+
+// TyphaAddrList returns the host:port of each Typha in TyphaAddr.
+func (c *Config) TyphaAddrList() []string {
+	if c.TyphaAddr == "" {
+		return nil
+	}
+	return strings.Split(c.TyphaAddr, ",")
+}
+
 func (config *Config) OpenstackActive() bool {
 	if strings.Contains(strings.ToLower(config.ClusterType), "openstack") {
 		log.Debug("Cluster type contains OpenStack")
@@ -219,17 +555,33 @@ func (config *Config) OpenstackActive() bool {
 	return false
 }
 
-func (config *Config) NextIptablesMark() uint32 {
-	mark := config.NthIPTablesMark(config.numIptablesBitsAllocated)
-	config.numIptablesBitsAllocated++
-	return mark
+// NumIptablesMarkBitsNeeded returns the number of mark bits that the internal dataplane
+// allocates from UsableIptablesMarkMask(): the accept, pass and workload marks, plus the
+// service mark if IPVS support is enabled.
+func (config *Config) NumIptablesMarkBitsNeeded() int {
+	numBits := 3
+	if config.KubeIPVSSupportEnabled {
+		numBits++
+	}
+	return numBits
+}
+
+// UsableIptablesMarkMask returns the mark bits that we can allocate from.  When kube-proxy is
+// running in IPVS mode, it relies on its own mark bits (KubeProxyMarkMask) surviving through
+// our chains so we avoid them.
+func (config *Config) UsableIptablesMarkMask() uint32 {
+	if config.KubeIPVSSupportEnabled {
+		return config.IptablesMarkMask &^ config.KubeProxyMarkMask
+	}
+	return config.IptablesMarkMask
 }
 
 func (config *Config) NthIPTablesMark(n int) uint32 {
+	mask := config.UsableIptablesMarkMask()
 	numBitsFound := 0
 	for shift := uint(0); shift < 32; shift++ {
 		candidate := uint32(1) << shift
-		if config.IptablesMarkMask&candidate > 0 {
+		if mask&candidate > 0 {
 			if numBitsFound == n {
 				return candidate
 			}
@@ -238,6 +590,7 @@ func (config *Config) NthIPTablesMark(n int) uint32 {
 	}
 	log.WithFields(log.Fields{
 		"IptablesMarkMask": config.IptablesMarkMask,
+		"usableMask":       mask,
 		"requestedMark":    n,
 	}).Panic("Not enough iptables mark bits available.")
 	return 0
@@ -246,6 +599,7 @@ func (config *Config) NthIPTablesMark(n int) uint32 {
 func (config *Config) resolve() (changed bool, err error) {
 	newRawValues := make(map[string]string)
 	nameToSource := make(map[string]Source)
+	config.InvalidValues = nil
 	for _, source := range SourcesInDescendingOrder {
 	valueLoop:
 		for rawName, rawValue := range config.sourceToRawConfig[source] {
@@ -301,6 +655,8 @@ func (config *Config) resolve() (changed bool, err error) {
 					} else {
 						logCxt.WithField("default", metadata.Default).Warn(
 							"Replacing invalid value with default")
+						config.InvalidValues = append(config.InvalidValues,
+							fmt.Errorf("%v (from %v)", err, source))
 						value = metadata.Default
 						err = nil
 					}
@@ -321,8 +677,99 @@ func (config *Config) resolve() (changed bool, err error) {
 			nameToSource[name] = source
 		}
 	}
+	// Now that we can apply some config changes without restarting, a parameter that has
+	// been removed from all sources needs to go back to its default value.
+	for name := range config.rawValues {
+		if _, ok := newRawValues[name]; ok {
+			continue
+		}
+		if param, ok := knownParams[strings.ToLower(name)]; ok {
+			log.WithField("name", name).Info("Config parameter removed, reverting to default.")
+			param.setDefault(config)
+		}
+	}
 	changed = !reflect.DeepEqual(newRawValues, config.rawValues)
 	config.rawValues = newRawValues
+	config.rawValueSources = nameToSource
+	return
+}
+
+// EffectiveValue describes the value of a parameter after merging all the sources.
+type EffectiveValue struct {
+	Name string
+	// Value is the parsed value of the parameter.
+	Value interface{}
+	// RawValue is the value as it was given by Source; it is empty if Source is Default.
+	RawValue string
+	Source   Source
+}
+
+// EffectiveValue returns the value of the named parameter (which is case-insensitive) and the
+// source that it came from.  ok is false if the parameter isn't known.
+func (config *Config) EffectiveValue(name string) (value EffectiveValue, ok bool) {
+	param, ok := knownParams[strings.ToLower(name)]
+	if !ok {
+		return
+	}
+	value = config.effectiveValue(param.GetMetadata().Name)
+	return
+}
+
+// EffectiveValues returns the EffectiveValue of every known parameter, sorted by name.
+func (config *Config) EffectiveValues() []EffectiveValue {
+	var names []string
+	for _, param := range knownParams {
+		names = append(names, param.GetMetadata().Name)
+	}
+	sort.Strings(names)
+	values := make([]EffectiveValue, len(names))
+	for i, name := range names {
+		values[i] = config.effectiveValue(name)
+	}
+	return values
+}
+
+func (config *Config) effectiveValue(name string) EffectiveValue {
+	source, ok := config.rawValueSources[name]
+	if !ok {
+		source = Default
+	}
+	return EffectiveValue{
+		Name:     name,
+		Value:    reflect.ValueOf(config).Elem().FieldByName(name).Interface(),
+		RawValue: config.rawValues[name],
+		Source:   source,
+	}
+}
+
+// ChangedParams compares two sets of raw config values, as returned by RawValues(), and
+// returns the names of the parameters that differ.  restartNeeded is true if any of them
+// can't be changed at runtime; that includes any parameters we don't know about since
+// they may be used by an external dataplane driver.
+func ChangedParams(oldRaw, newRaw map[string]string) (changed []string, restartNeeded bool) {
+	if knownParams == nil {
+		loadParams()
+	}
+	names := map[string]bool{}
+	for name := range oldRaw {
+		names[name] = true
+	}
+	for name := range newRaw {
+		names[name] = true
+	}
+	for name := range names {
+		oldValue, oldOK := oldRaw[name]
+		newValue, newOK := newRaw[name]
+		if oldOK == newOK && oldValue == newValue {
+			continue
+		}
+		changed = append(changed, name)
+		param, ok := knownParams[strings.ToLower(name)]
+		if !ok || !param.GetMetadata().Reloadable {
+			restartNeeded = true
+		}
+	}
+	sort.Strings(changed)
 	return
 }
 
@@ -336,14 +783,8 @@ func (config *Config) DatastoreConfig() api.CalicoAPIConfig {
 	if config.DatastoreType == "etcdv2" {
 		// Build a CalicoAPIConfig with the etcd fields filled in from Felix-specific
 		// config.
-		var etcdEndpoints string
-		if len(config.EtcdEndpoints) == 0 {
-			etcdEndpoints = config.EtcdScheme + "://" + config.EtcdAddr
-		} else {
-			etcdEndpoints = strings.Join(config.EtcdEndpoints, ",")
-		}
 		etcdCfg := etcd.EtcdConfig{
-			EtcdEndpoints:  etcdEndpoints,
+			EtcdEndpoints:  strings.Join(config.EtcdEndpointURLs(), ","),
 			EtcdKeyFile:    config.EtcdKeyFile,
 			EtcdCertFile:   config.EtcdCertFile,
 			EtcdCACertFile: config.EtcdCaFile,
@@ -371,22 +812,32 @@ func (config *Config) DatastoreConfig() api.CalicoAPIConfig {
 		cfg.Spec.DatastoreType = api.DatastoreType(config.DatastoreType)
 	}
 
-	if !config.IpInIpEnabled {
+	if !config.IpInIpEnabled && !config.VXLANEnabled {
 		// Polling k8s for node updates is expensive (because we get many superfluous
 		// updates) so disable if we don't need it.
-		log.Info("IPIP disabled, disabling node poll (if KDD is in use).")
+		log.Info("IPIP and VXLAN disabled, disabling node poll (if KDD is in use).")
 		cfg.Spec.K8sDisableNodePoll = true
 	}
 	return *cfg
 }
 
+// EtcdEndpointURLs returns the URLs of the etcd servers, from EtcdEndpoints or, if that isn't
+// set, from EtcdScheme and EtcdAddr.
+func (config *Config) EtcdEndpointURLs() []string {
+	if len(config.EtcdEndpoints) == 0 {
+		return []string{config.EtcdScheme + "://" + config.EtcdAddr}
+	}
+	return config.EtcdEndpoints
+}
+
 // Validate() performs cross-field validation.
 func (config *Config) Validate() (err error) {
 	if config.FelixHostname == "" {
 		err = errors.New("Failed to determine hostname")
 	}
 
-	if config.DatastoreType == "etcdv2" && len(config.EtcdEndpoints) == 0 {
+	usingEtcd := config.DatastoreType == "etcdv2" || config.DatastoreType == "etcdv3"
+	if usingEtcd && len(config.EtcdEndpoints) == 0 {
 		if config.EtcdScheme == "" {
 			err = errors.New("EtcdEndpoints and EtcdScheme both missing")
 		}
@@ -395,6 +846,32 @@ func (config *Config) Validate() (err error) {
 		}
 	}
 
+	if config.DatastoreType == "file" && config.DatastoreFileDir == "" {
+		err = errors.New("DatastoreFileDir must be set when DatastoreType is file")
+	}
+
+	if config.IptablesMaxChainLength == 1 {
+		// Each shard but the last needs room for a rule and the jump to the next shard.
+		err = errors.New("IptablesMaxChainLength must be 0 (disabled) or at least 2")
+	}
+
+	if config.IptablesRuleHashAlgorithm == "sha224" && config.IptablesRuleHashLength > 38 {
+		err = errors.New("IptablesRuleHashLength must be at most 38 for sha224")
+	}
+
+	if (config.PrometheusMetricsCertFile == "") != (config.PrometheusMetricsKeyFile == "") {
+		err = errors.New("PrometheusMetricsCertFile and PrometheusMetricsKeyFile must be set together")
+	}
+	if config.PrometheusMetricsCAFile != "" && config.PrometheusMetricsCertFile == "" {
+		err = errors.New("PrometheusMetricsCAFile requires PrometheusMetricsCertFile")
+	}
+
+	markBits := markbits.NewMarkBitsManager(config.UsableIptablesMarkMask(), "validation")
+	if markBits.AvailableMarkBitCount() < config.NumIptablesMarkBitsNeeded() {
+		err = fmt.Errorf("IptablesMarkMask has %d usable bits but %d are needed",
+			markBits.AvailableMarkBitCount(), config.NumIptablesMarkBitsNeeded())
+	}
+
 	if err != nil {
 		config.Err = err
 	}
@@ -462,12 +939,17 @@ func loadParams() {
 		case "authority":
 			param = &RegexpParam{Regexp: AuthorityRegexp,
 				Msg: "invalid URL authority"}
+		case "authority-list":
+			param = &RegexpParam{Regexp: AuthorityListRegexp,
+				Msg: "invalid list of URL authorities"}
 		case "ipv4":
 			param = &Ipv4Param{}
 		case "endpoint-list":
 			param = &EndpointListParam{}
 		case "port-list":
 			param = &PortListParam{}
+		case "dscp-map":
+			param = &DSCPMapParam{}
 		case "hostname":
 			param = &RegexpParam{Regexp: HostnameRegexp,
 				Msg: "invalid hostname"}
@@ -498,6 +980,9 @@ func loadParams() {
 		if strings.Index(flags, "local") > -1 {
 			metadata.Local = true
 		}
+		if strings.Index(flags, "reloadable") > -1 {
+			metadata.Reloadable = true
+		}
 
 		if defaultStr != "" {
 			if strings.Index(flags, "skip-default-validation") > -1 {
@@ -518,8 +1003,13 @@ func loadParams() {
 	}
 }
 
+// RawValues returns a copy of the raw values of the parameters, after merging all the sources.
 func (config *Config) RawValues() map[string]string {
-	return config.rawValues
+	rawValues := make(map[string]string, len(config.rawValues))
+	for k, v := range config.rawValues {
+		rawValues[k] = v
+	}
+	return rawValues
 }
 
 func New() *Config {
@@ -17,6 +17,7 @@ package config_test
 import (
 	. "github.com/projectcalico/felix/config"
 
+	"fmt"
 	"net"
 	"reflect"
 
@@ -48,6 +49,33 @@ var _ = DescribeTable("Config parsing",
 	Entry("EtcdAddr host", "EtcdAddr", "host:1234", "host:1234"),
 	Entry("EtcdScheme", "EtcdScheme", "https", "https"),
 
+	Entry("DatastoreType etcdv3", "DatastoreType", "etcdv3", "etcdv3"),
+	Entry("DatastoreType consul", "DatastoreType", "consul", "consul"),
+	Entry("DatastoreType file", "DatastoreType", "file", "file"),
+	Entry("DatastoreFileWatch", "DatastoreFileWatch", "false", false),
+	Entry("GracefulRestartTimeoutSecs", "GracefulRestartTimeoutSecs", "120", 120),
+	Entry("GracefulRestartTimeoutSecs bad value -> defaulted", "GracefulRestartTimeoutSecs", "-1", 0),
+	Entry("CalcGraphBatchQuietPeriodMillis", "CalcGraphBatchQuietPeriodMillis", "50", 50),
+	Entry("CalcGraphBatchQuietPeriodMillis bad value -> defaulted", "CalcGraphBatchQuietPeriodMillis", "-1", 0),
+	Entry("CalcGraphBatchMaxLatencyMillis", "CalcGraphBatchMaxLatencyMillis", "1000", 1000),
+	Entry("CalcGraphBatchMaxLatencyMillis zero -> defaulted", "CalcGraphBatchMaxLatencyMillis", "0", 500),
+	Entry("DataplaneApplyDelayMillis", "DataplaneApplyDelayMillis", "100", 100),
+	Entry("DataplaneApplyDelayMillis bad value -> defaulted", "DataplaneApplyDelayMillis", "-1", 0),
+	Entry("DataplaneApplyMaxDelayMillis", "DataplaneApplyMaxDelayMillis", "5000", 5000),
+	Entry("DataplaneApplyMaxDelayMillis unbounded", "DataplaneApplyMaxDelayMillis", "0", 0),
+	Entry("DataplaneApplyAdaptive", "DataplaneApplyAdaptive", "true", true),
+	Entry("DataplaneApplyRateLimit", "DataplaneApplyRateLimit", "2", 2),
+	Entry("DataplaneApplyRateLimit zero -> defaulted", "DataplaneApplyRateLimit", "0", 10),
+	Entry("DataplaneApplyBurst", "DataplaneApplyBurst", "50", 50),
+	Entry("IptablesMaxRestoreLines", "IptablesMaxRestoreLines", "5000", 5000),
+	Entry("ConsulAddr", "ConsulAddr", "consul.local:8500", "consul.local:8500"),
+	Entry("ConsulScheme", "ConsulScheme", "https", "https"),
+
+	Entry("TyphaAddr", "TyphaAddr", "typha1:5473,10.0.0.2:5473", "typha1:5473,10.0.0.2:5473"),
+	Entry("TyphaAddr bad value -> defaulted", "TyphaAddr", "typha1", ""),
+	Entry("TyphaReadTimeoutSecs", "TyphaReadTimeoutSecs", "10", 10),
+	Entry("TyphaFallbackTimeoutSecs disabled", "TyphaFallbackTimeoutSecs", "0", 0),
+
 	// Etcd key files will be tested for existence, skipping for now.
 
 	Entry("EtcdEndpoints HTTP", "EtcdEndpoints",
@@ -60,14 +88,107 @@ var _ = DescribeTable("Config parsing",
 	Entry("InterfacePrefix", "InterfacePrefix", "tap", "tap"),
 	Entry("InterfacePrefix list", "InterfacePrefix", "tap,cali", "tap,cali"),
 
+	Entry("IptablesPreValidate", "IptablesPreValidate", "true", true),
+	Entry("IptablesMinResyncIntervalMillis", "IptablesMinResyncIntervalMillis", "500", 500),
+	Entry("IptablesFlushCheckIntervalSecs", "IptablesFlushCheckIntervalSecs", "2", 2),
+	Entry("IptablesChainDeletionGracePeriodSecs", "IptablesChainDeletionGracePeriodSecs", "30", 30),
+	Entry("IptablesMaxChainLength", "IptablesMaxChainLength", "1000", 1000),
+	Entry("IptablesMaxChainLength negative -> defaulted", "IptablesMaxChainLength", "-1", 0),
+	Entry("IptablesFailureMode", "IptablesFailureMode", "DropAll", "DropAll"),
+	Entry("IptablesFailureMode default", "IptablesFailureMode", "", "Panic"),
+	Entry("IptablesNATFailureMode", "IptablesNATFailureMode", "LeaveUntouched", "LeaveUntouched"),
+	Entry("IptablesNATFailureMode default", "IptablesNATFailureMode", "", "Panic"),
+	Entry("IptablesMangleFailureMode", "IptablesMangleFailureMode", "LeaveUntouched", "LeaveUntouched"),
+	Entry("IptablesRawFailureMode", "IptablesRawFailureMode", "LeaveUntouched", "LeaveUntouched"),
+	Entry("IptablesRawFailureMode DropAll -> defaulted", "IptablesRawFailureMode", "DropAll", "Panic"),
+	Entry("IptablesLockTimeoutSecs", "IptablesLockTimeoutSecs", "2.5", 2.5),
+	Entry("IptablesLockProbeIntervalMillis", "IptablesLockProbeIntervalMillis", "100", 100),
+	Entry("DataplaneBinDir", "DataplaneBinDir", "/host/sbin", "/host/sbin"),
+	Entry("DataplaneHostNetnsPID", "DataplaneHostNetnsPID", "1", 1),
+	Entry("IptablesCommandTimeoutSecs", "IptablesCommandTimeoutSecs", "60", 60),
+	Entry("DataplaneApplyWatchdogTimeoutSecs", "DataplaneApplyWatchdogTimeoutSecs", "30", 30),
+	Entry("InterfaceDampingIntervalMillis", "InterfaceDampingIntervalMillis", "500", 500),
+	Entry("DataplaneOfflineRenderDir", "DataplaneOfflineRenderDir", "/tmp/render", "/tmp/render"),
+	Entry("DataplaneReadOnly", "DataplaneReadOnly", "true", true),
+	Entry("IpsetsRefreshInterval", "IpsetsRefreshInterval", "60", int(60)),
+	Entry("IpsetsRefreshInterval default", "IpsetsRefreshInterval", "", int(10)),
+	Entry("PolicyCountersRefreshIntervalSecs", "PolicyCountersRefreshIntervalSecs", "30", int(30)),
+	Entry("RouteTableProtocol", "RouteTableProtocol", "80", int(80)),
+	Entry("RouteTableProtocol default", "RouteTableProtocol", "", int(0)),
+	Entry("RouteMetric", "RouteMetric", "100", int(100)),
+	Entry("RouteOnLink", "RouteOnLink", "true", true),
+	Entry("ConntrackFlushRateLimit", "ConntrackFlushRateLimit", "10", int(10)),
+	Entry("ConntrackMaxEntries", "ConntrackMaxEntries", "1000000", int(1000000)),
+	Entry("ConntrackTCPEstablishedTimeoutSecs", "ConntrackTCPEstablishedTimeoutSecs", "3600", int(3600)),
+	Entry("FlowLogsFileEnabled", "FlowLogsFileEnabled", "true", true),
+	Entry("FlowLogsFileDirectory", "FlowLogsFileDirectory", "/tmp/flows", "/tmp/flows"),
+	Entry("FlowLogsFileMaxFileSizeMB", "FlowLogsFileMaxFileSizeMB", "10", int(10)),
+	Entry("FlowLogsFlushIntervalSecs", "FlowLogsFlushIntervalSecs", "60", int(60)),
+	Entry("FlowLogsFlushIntervalSecs bad value -> defaulted", "FlowLogsFlushIntervalSecs", "0", int(300)),
+	Entry("FlowLogsSyslogAddress", "FlowLogsSyslogAddress", "syslog.example.com:6514", "syslog.example.com:6514"),
+	Entry("FlowLogsSyslogTLSEnabled", "FlowLogsSyslogTLSEnabled", "true", true),
+	Entry("FlowLogsKafkaBrokers", "FlowLogsKafkaBrokers", "kafka1:9092,kafka2:9092", "kafka1:9092,kafka2:9092"),
+	Entry("FlowLogsKafkaBrokers bad value -> defaulted", "FlowLogsKafkaBrokers", "kafka1", ""),
+	Entry("FlowLogsKafkaTopic", "FlowLogsKafkaTopic", "flows", "flows"),
+	Entry("FlowLogsKafkaBatchSize", "FlowLogsKafkaBatchSize", "500", int(500)),
+	Entry("XDPEnabled", "XDPEnabled", "true", true),
+	Entry("KubeIPVSSupportEnabled", "KubeIPVSSupportEnabled", "true", true),
+	Entry("LogActionNFLOGGroup", "LogActionNFLOGGroup", "42", int(42)),
+	Entry("RejectWith", "RejectWith", "TCP-Reset", "tcp-reset"),
+	Entry("RejectWith bad value -> defaulted", "RejectWith", "icmp-foo", "port-unreachable"),
+	Entry("DropNFLOGGroup", "DropNFLOGGroup", "7", int(7)),
+	Entry("DeniedPacketMetricsMaxSourceIPs", "DeniedPacketMetricsMaxSourceIPs", "100", int(100)),
+	Entry("KubeProxyMarkMask", "KubeProxyMarkMask", "0xc0000", uint32(0xc0000)),
+	Entry("DataplaneDriverAddress", "DataplaneDriverAddress", "unix:/var/run/calico/driver.sock", "unix:/var/run/calico/driver.sock"),
+	Entry("WorkloadDataplaneDriverAddress", "WorkloadDataplaneDriverAddress", "127.0.0.1:9000", "127.0.0.1:9000"),
+
+	Entry("VXLANEnabled", "VXLANEnabled", "true", true),
+	Entry("VXLANVNI", "VXLANVNI", "1", int(1)),
+	Entry("VXLANVNI default", "VXLANVNI", "", int(4096)),
+	Entry("VXLANVNI too big", "VXLANVNI", "16777216", int(4096)),
+	Entry("VXLANPort", "VXLANPort", "8472", int(8472)),
+	Entry("VXLANMTU", "VXLANMTU", "1450", int(1450)),
+	Entry("VXLANTunnelAddr", "VXLANTunnelAddr", "10.0.0.1", net.ParseIP("10.0.0.1")),
+	Entry("WorkloadRoutingTableIndex", "WorkloadRoutingTableIndex", "200", int(200)),
+	Entry("WorkloadRoutingTableIndex default", "WorkloadRoutingTableIndex", "", int(0)),
+	Entry("WorkloadRoutingTableIndex main table", "WorkloadRoutingTableIndex", "254", int(0)),
+	Entry("WorkloadRoutingRulePriority", "WorkloadRoutingRulePriority", "500", int(500)),
+	Entry("WorkloadRoutingRulePriority default", "WorkloadRoutingRulePriority", "", int(100)),
+	Entry("IptablesAuditLogSize", "IptablesAuditLogSize", "10", int(10)),
+	Entry("IptablesAuditLogSize default", "IptablesAuditLogSize", "", int(100)),
+	Entry("IptablesAuditLogFile", "IptablesAuditLogFile", "/var/log/calico/iptables-audit.log",
+		"/var/log/calico/iptables-audit.log"),
+	Entry("IptablesRuleHashAlgorithm", "IptablesRuleHashAlgorithm", "sha256", "sha256"),
+	Entry("IptablesRuleHashLength", "IptablesRuleHashLength", "24", int(24)),
+	Entry("IptablesRuleHashLength too long -> defaulted", "IptablesRuleHashLength", "44",
+		int(16)),
+	Entry("IptablesRuleHashSeed", "IptablesRuleHashSeed", "my-cluster", "my-cluster"),
+
 	Entry("ChainInsertMode append", "ChainInsertMode", "append", "append"),
 
 	Entry("DefaultEndpointToHostAction", "DefaultEndpointToHostAction",
 		"RETURN", "RETURN"),
 	Entry("DefaultEndpointToHostAction", "DefaultEndpointToHostAction",
 		"ACCEPT", "ACCEPT"),
+	Entry("IptablesFilterAllowAction", "IptablesFilterAllowAction",
+		"RETURN", "RETURN"),
+	Entry("IptablesFilterAllowAction default", "IptablesFilterAllowAction",
+		"", "ACCEPT"),
+	Entry("IptablesFilterAllowAction invalid -> defaulted", "IptablesFilterAllowAction",
+		"DROP", "ACCEPT"),
+
+	Entry("IptablesPolicyNameComments", "IptablesPolicyNameComments", "true", true),
 
 	Entry("LogFilePath", "LogFilePath", "/tmp/felix.log", "/tmp/felix.log"),
+	Entry("LogFileFormat", "LogFileFormat", "json", "json"),
+	Entry("LogFileFormat", "LogFileFormat", "JSON", "json"),
+	Entry("LogFileFormat bad value -> defaulted", "LogFileFormat", "yaml", "text"),
+	Entry("LogFileMaxSizeMB", "LogFileMaxSizeMB", "100", 100),
+	Entry("LogFileMaxFiles", "LogFileMaxFiles", "10", 10),
+	Entry("LogFileMaxFiles zero -> defaulted", "LogFileMaxFiles", "0", 5),
+	Entry("LogRateLimitIntervalSecs", "LogRateLimitIntervalSecs", "10", 10),
+	Entry("LogRateLimitIntervalSecs disabled", "LogRateLimitIntervalSecs", "0", 0),
+	Entry("LogRateLimitBurst", "LogRateLimitBurst", "1000", 1000),
 
 	Entry("LogSeverityFile", "LogSeverityFile", "debug", "DEBUG"),
 	Entry("LogSeverityFile", "LogSeverityFile", "warning", "WARNING"),
@@ -84,11 +205,16 @@ var _ = DescribeTable("Config parsing",
 	Entry("LogSeveritySys", "LogSeveritySys", "error", "ERROR"),
 	Entry("LogSeveritySys", "LogSeveritySys", "critical", "CRITICAL"),
 
+	Entry("LogSeverityIptables", "LogSeverityIptables", "debug", "DEBUG"),
+	Entry("LogSeverityIPSets", "LogSeverityIPSets", "warning", "WARNING"),
+	Entry("LogSeverityCalcGraph", "LogSeverityCalcGraph", "error", "ERROR"),
+
 	Entry("IpInIpEnabled", "IpInIpEnabled", "true", true),
 	Entry("IpInIpEnabled", "IpInIpEnabled", "y", true),
 	Entry("IpInIpEnabled", "IpInIpEnabled", "True", true),
 
 	Entry("IpInIpMtu", "IpInIpMtu", "1234", int(1234)),
+	Entry("IpInIpMtu auto-detect", "IpInIpMtu", "0", int(0)),
 	Entry("IpInIpTunnelAddr", "IpInIpTunnelAddr",
 		"10.0.0.1", net.ParseIP("10.0.0.1")),
 
@@ -102,11 +228,55 @@ var _ = DescribeTable("Config parsing",
 	Entry("EndpointReportingDelaySecs", "EndpointReportingDelaySecs",
 		"10", float64(10)),
 
+	Entry("PolicyReadyFile", "PolicyReadyFile",
+		"/var/run/calico/policy-ready", "/var/run/calico/policy-ready"),
+	Entry("EndpointStatusFileDirectory", "EndpointStatusFileDirectory",
+		"/var/run/calico/endpoint-status", "/var/run/calico/endpoint-status"),
+	Entry("CheckpointFile", "CheckpointFile",
+		"/var/lib/calico/felix-checkpoint", "/var/lib/calico/felix-checkpoint"),
+	Entry("CheckpointIntervalSecs", "CheckpointIntervalSecs", "60", 60),
+	Entry("CheckpointIntervalSecs zero -> defaulted", "CheckpointIntervalSecs", "0", 30),
+	Entry("CheckpointMaxAgeSecs", "CheckpointMaxAgeSecs", "0", 0),
+	Entry("InstanceIDFile", "InstanceIDFile",
+		"/var/run/calico/felix-instance-id", "/var/run/calico/felix-instance-id"),
+	Entry("InstanceIDFile empty -> defaulted", "InstanceIDFile",
+		"", "/var/lib/calico/felix-instance-id"),
+
 	Entry("MaxIpsetSize", "MaxIpsetSize", "12345", int(12345)),
 	Entry("IptablesMarkMask", "IptablesMarkMask", "0xf0f0", uint32(0xf0f0)),
 
+	Entry("WorkloadDSCPMode", "WorkloadDSCPMode", "zero", "zero"),
+	Entry("WorkloadDSCPMode map", "WorkloadDSCPMode", "map", "map"),
+	Entry("WorkloadDSCPMap", "WorkloadDSCPMap", "46:0, 34:10",
+		map[uint8]uint8{46: 0, 34: 10}),
+	Entry("WorkloadDSCPMap out of range -> defaulted", "WorkloadDSCPMap", "64:0",
+		map[uint8]uint8(nil), true),
+	Entry("WorkloadDSCPMap bad syntax -> defaulted", "WorkloadDSCPMap", "46",
+		map[uint8]uint8(nil), true),
+
+	Entry("WorkloadSourceCheck default", "WorkloadSourceCheck", "", "none"),
+	Entry("WorkloadSourceCheck", "WorkloadSourceCheck", "ip", "ip"),
+	Entry("WorkloadSourceCheck with MAC", "WorkloadSourceCheck", "ip-and-mac", "ip-and-mac"),
+	Entry("WorkloadSourceCheckExemptIfacePrefixes", "WorkloadSourceCheckExemptIfacePrefixes",
+		"tap,vmrouter", "tap,vmrouter"),
+	Entry("WorkloadSourceCheckExemptIfacePrefixes bad value -> defaulted",
+		"WorkloadSourceCheckExemptIfacePrefixes", "tap,", ""),
+
+	Entry("HealthEnabled", "HealthEnabled", "true", true),
+	Entry("HealthHost", "HealthHost", "127.0.0.1", "127.0.0.1"),
+	Entry("HealthPort", "HealthPort", "9098", int(9098)),
+	Entry("HealthDataplaneTimeoutSecs", "HealthDataplaneTimeoutSecs", "300", int(300)),
+	Entry("HealthDataplaneTimeoutSecs bad value -> defaulted", "HealthDataplaneTimeoutSecs", "0",
+		int(90)),
+
 	Entry("PrometheusMetricsEnabled", "PrometheusMetricsEnabled", "true", true),
 	Entry("PrometheusMetricsPort", "PrometheusMetricsPort", "1234", int(1234)),
+	Entry("PrometheusMetricsHost", "PrometheusMetricsHost", "10.0.0.1", "10.0.0.1"),
+	Entry("PrometheusMetricsCertFile", "PrometheusMetricsCertFile", "/dev/null", "/dev/null"),
+	Entry("PrometheusMetricsCertFile missing -> defaulted", "PrometheusMetricsCertFile",
+		"/does/not/exist", ""),
+	Entry("DebugServerPort", "DebugServerPort", "9099", int(9099)),
+	Entry("DebugServerHost", "DebugServerHost", "0.0.0.0", "0.0.0.0"),
 
 	Entry("FailsafeInboundHostPorts old syntax", "FailsafeInboundHostPorts", "1,2,3,4",
 		[]ProtoPort{
@@ -143,6 +313,18 @@ var _ = DescribeTable("Config parsing",
 			{Protocol: "udp", Port: 2},
 		}),
 
+	Entry("FailsafeInboundHostPorts with nets", "FailsafeInboundHostPorts", "tcp:10.0.0.0/8:22,udp:[fd00::/8]:53,tcp:10.0.0.1:179",
+		[]ProtoPort{
+			{Protocol: "tcp", Port: 22, Net: "10.0.0.0/8"},
+			{Protocol: "udp", Port: 53, Net: "fd00::/8"},
+			{Protocol: "tcp", Port: 179, Net: "10.0.0.1/32"},
+		}),
+	Entry("FailsafeOutboundHostPorts with nets", "FailsafeOutboundHostPorts", "tcp:fd00::1:2379,udp:10.1.2.3/16:53",
+		[]ProtoPort{
+			{Protocol: "tcp", Port: 2379, Net: "fd00::1/128"},
+			{Protocol: "udp", Port: 53, Net: "10.1.0.0/16"},
+		}),
+
 	Entry("FailsafeInboundHostPorts bad syntax -> defaulted", "FailsafeInboundHostPorts", "foo:1",
 		[]ProtoPort{
 			{Protocol: "tcp", Port: 22},
@@ -194,21 +376,73 @@ var _ = DescribeTable("Mark bit calculation tests",
 	Entry("0th bit of 0xff000000", "0xff000000", 0, uint32(0x01000000)),
 )
 
-var _ = DescribeTable("Next mark bit calculation tests",
-	func(mask string, numCalls int, expected uint32) {
+var _ = Describe("Mark bit calculation with kube-proxy IPVS support", func() {
+	var config *Config
+	BeforeEach(func() {
+		config = New()
+		config.UpdateFrom(map[string]string{
+			"IptablesMarkMask":       "0xf000",
+			"KubeIPVSSupportEnabled": "true",
+		}, EnvironmentVariable)
+	})
+
+	It("should skip kube-proxy's mark bits", func() {
+		Expect(config.UsableIptablesMarkMask()).To(Equal(uint32(0x3000)))
+		Expect(config.NthIPTablesMark(0)).To(Equal(uint32(0x1000)))
+		Expect(config.NthIPTablesMark(1)).To(Equal(uint32(0x2000)))
+	})
+
+	It("should panic if there aren't enough bits left", func() {
+		Expect(func() { config.NthIPTablesMark(2) }).To(Panic())
+	})
+})
+
+var _ = DescribeTable("Mark bit validation",
+	func(params map[string]string, expectValid bool) {
 		config := New()
-		config.UpdateFrom(map[string]string{"IptablesMarkMask": mask}, EnvironmentVariable)
-		var mark uint32
-		for i := 0; i < numCalls; i++ {
-			mark = config.NextIptablesMark()
+		config.UpdateFrom(params, EnvironmentVariable)
+		config.FelixHostname = "myhost"
+		err := config.Validate()
+		if expectValid {
+			Expect(err).NotTo(HaveOccurred())
+		} else {
+			Expect(err).To(HaveOccurred())
+		}
+	},
+	Entry("default mask", map[string]string{}, true),
+	Entry("3 bits", map[string]string{"IptablesMarkMask": "0x7"}, true),
+	Entry("2 bits", map[string]string{"IptablesMarkMask": "0x3"}, false),
+	Entry("3 bits with IPVS support", map[string]string{
+		"IptablesMarkMask":       "0x7",
+		"KubeIPVSSupportEnabled": "true",
+	}, false),
+	Entry("kube-proxy bits excluded", map[string]string{
+		"IptablesMarkMask":       "0xf000",
+		"KubeIPVSSupportEnabled": "true",
+	}, false),
+	Entry("kube-proxy bits excluded, enough left", map[string]string{
+		"IptablesMarkMask":       "0xff000",
+		"KubeIPVSSupportEnabled": "true",
+	}, true),
+)
+
+var _ = DescribeTable("Max chain length validation",
+	func(maxChainLength string, expectValid bool) {
+		config := New()
+		config.UpdateFrom(map[string]string{"IptablesMaxChainLength": maxChainLength},
+			EnvironmentVariable)
+		config.FelixHostname = "myhost"
+		err := config.Validate()
+		if expectValid {
+			Expect(err).NotTo(HaveOccurred())
+		} else {
+			Expect(err).To(HaveOccurred())
 		}
-		Expect(mark).To(Equal(expected))
 	},
-	Entry("0th bit in 0xf", "0xf", 1, uint32(0x1)),
-	Entry("1st bit in 0xf", "0xf", 2, uint32(0x2)),
-	Entry("7th bit in 0xff", "0xff", 8, uint32(0x80)),
-	Entry("7th bit in 0xf00f", "0xf00f", 8, uint32(0x8000)),
-	Entry("0th bit of 0xff000000", "0xff000000", 1, uint32(0x01000000)),
+	Entry("disabled", "0", true),
+	Entry("too short to shard", "1", false),
+	Entry("shortest shardable", "2", true),
+	Entry("negative, replaced by default", "-5", true),
 )
 
 var _ = Describe("DatastoreConfig tests", func() {
@@ -234,3 +468,138 @@ var _ = Describe("DatastoreConfig tests", func() {
 		})
 	})
 })
+
+var _ = Describe("EtcdEndpointURLs", func() {
+	It("should default to EtcdScheme and EtcdAddr", func() {
+		c := New()
+		c.UpdateFrom(map[string]string{"EtcdAddr": "10.0.0.1:1234"}, EnvironmentVariable)
+		Expect(c.EtcdEndpointURLs()).To(Equal([]string{"http://10.0.0.1:1234"}))
+	})
+	It("should prefer EtcdEndpoints", func() {
+		c := New()
+		c.UpdateFrom(map[string]string{
+			"EtcdAddr":      "10.0.0.1:1234",
+			"EtcdEndpoints": "https://host:2345",
+		}, EnvironmentVariable)
+		Expect(c.EtcdEndpointURLs()).To(Equal([]string{"https://host:2345/"}))
+	})
+})
+
+var _ = Describe("Config updates", func() {
+	var config *Config
+	BeforeEach(func() {
+		config = New()
+		config.UpdateFrom(map[string]string{
+			"LogSeverityScreen":       "DEBUG",
+			"IptablesRefreshInterval": "30",
+		}, DatastoreGlobal)
+	})
+
+	It("should revert a removed parameter to its default", func() {
+		config.UpdateFrom(map[string]string{
+			"LogSeverityScreen": "DEBUG",
+		}, DatastoreGlobal)
+		Expect(config.LogSeverityScreen).To(Equal("DEBUG"))
+		Expect(config.IptablesRefreshInterval).To(Equal(10))
+	})
+
+	It("should fall back to a lower-priority source", func() {
+		config.UpdateFrom(map[string]string{
+			"IptablesRefreshInterval": "60",
+		}, DatastorePerHost)
+		Expect(config.IptablesRefreshInterval).To(Equal(60))
+		config.UpdateFrom(map[string]string{}, DatastorePerHost)
+		Expect(config.IptablesRefreshInterval).To(Equal(30))
+	})
+})
+
+var _ = DescribeTable("Config precedence",
+	func(sources []Source, expectedValue int, expectedSource Source) {
+		config := New()
+		for _, source := range sources {
+			config.UpdateFrom(map[string]string{
+				"IptablesRefreshInterval": fmt.Sprint(int(source) * 10),
+			}, source)
+		}
+		Expect(config.IptablesRefreshInterval).To(Equal(expectedValue))
+		value, ok := config.EffectiveValue("iptablesrefreshinterval")
+		Expect(ok).To(BeTrue())
+		Expect(value.Source).To(Equal(expectedSource))
+		Expect(value.Value).To(Equal(expectedValue))
+	},
+	Entry("default", []Source{}, 10, Source(Default)),
+	Entry("environment over config file",
+		[]Source{EnvironmentVariable, ConfigFile}, 20, Source(EnvironmentVariable)),
+	Entry("global datastore over environment",
+		[]Source{EnvironmentVariable, DatastoreGlobal, ConfigFile}, 30, Source(DatastoreGlobal)),
+	Entry("per-host datastore over everything",
+		[]Source{DatastorePerHost, DatastoreGlobal, EnvironmentVariable, ConfigFile},
+		40, Source(DatastorePerHost)),
+)
+
+var _ = Describe("EffectiveValues", func() {
+	It("should report the value and source of each parameter", func() {
+		config := New()
+		config.UpdateFrom(map[string]string{"LogSeverityScreen": "debug"}, ConfigFile)
+		values := config.EffectiveValues()
+		Expect(len(values)).To(BeNumerically(">", 100))
+		found := false
+		for _, value := range values {
+			if value.Name == "LogSeverityScreen" {
+				Expect(value).To(Equal(EffectiveValue{
+					Name:     "LogSeverityScreen",
+					Value:    "DEBUG",
+					RawValue: "debug",
+					Source:   ConfigFile,
+				}))
+				found = true
+			}
+		}
+		Expect(found).To(BeTrue())
+	})
+
+	It("should record invalid values that were replaced by defaults", func() {
+		config := New()
+		config.UpdateFrom(map[string]string{"IptablesRuleHashLength": "44"}, ConfigFile)
+		Expect(config.Err).NotTo(HaveOccurred())
+		Expect(config.InvalidValues).To(HaveLen(1))
+		value, _ := config.EffectiveValue("IptablesRuleHashLength")
+		Expect(value.Value).To(Equal(16))
+
+		config.UpdateFrom(map[string]string{}, ConfigFile)
+		Expect(config.InvalidValues).To(BeEmpty())
+	})
+
+	It("should ignore unknown parameters", func() {
+		_, ok := New().EffectiveValue("NotAParam")
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = DescribeTable("ChangedParams",
+	func(oldRaw, newRaw map[string]string, expectedChanged []string, expectedRestart bool) {
+		changed, restartNeeded := ChangedParams(oldRaw, newRaw)
+		Expect(changed).To(Equal(expectedChanged))
+		Expect(restartNeeded).To(Equal(expectedRestart))
+	},
+	Entry("no change",
+		map[string]string{"LogSeverityScreen": "INFO"},
+		map[string]string{"LogSeverityScreen": "INFO"},
+		[]string(nil), false),
+	Entry("reloadable change",
+		map[string]string{"LogSeverityScreen": "INFO"},
+		map[string]string{"LogSeverityScreen": "DEBUG", "IpsetsRefreshInterval": "30"},
+		[]string{"IpsetsRefreshInterval", "LogSeverityScreen"}, false),
+	Entry("reloadable parameter removed",
+		map[string]string{"LogSeverityScreen": "INFO"},
+		map[string]string{},
+		[]string{"LogSeverityScreen"}, false),
+	Entry("non-reloadable change",
+		map[string]string{"LogSeverityScreen": "INFO", "IptablesMarkMask": "0xff000000"},
+		map[string]string{"LogSeverityScreen": "DEBUG", "IptablesMarkMask": "0xff00"},
+		[]string{"IptablesMarkMask", "LogSeverityScreen"}, true),
+	Entry("unknown parameter",
+		map[string]string{},
+		map[string]string{"SomePluginParam": "foo"},
+		[]string{"SomePluginParam"}, true),
+)
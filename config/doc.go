@@ -22,14 +22,26 @@
 // The UpdateFrom() method returns an error, but, as a convenience, it also
 // stores the error in config.Err.
 //
+// Once the config is in use by other goroutines, it must not be modified.
+// Instead, wrap it in a LiveConfig, whose UpdateFrom() method merges updates
+// into a copy of the config and then makes the copy current:
+//
+//    liveConfig := config.NewLiveConfig(config)
+//    liveConfig.UpdateFrom(datastoreConfig, config.DatastoreGlobal)
+//    currentConfig := liveConfig.Current()
+//
 // Config inheritance
 //
 // Config from higher-priority sources overrides config from lower-priority
 // sources.  The priorities, in increasing order of priority, are:
 //
 //     Default              // Default value of a parameter
-//     DatastoreGlobal      // Cluster-wide config parameters from the datastore.
-//     DatastorePerHost     // Per-host overrides from the datastore.
 //     ConfigFile           // The local config file.
 //     EnvironmentVariable  // Environment variables.
+//     DatastoreGlobal      // Cluster-wide config parameters from the datastore.
+//     DatastorePerHost     // Per-host overrides from the datastore.
+//
+// Parameters that are needed to connect to the datastore can only be set from
+// the local sources.  Config.EffectiveValue() returns the value of a parameter
+// along with the source that it came from.
 package config
@@ -0,0 +1,90 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "sync"
+
+// LiveConfig holds the config of a running Felix, which may be updated from the datastore or
+// by reloading the local config.  The Config that it holds is never modified: updates are
+// merged into a copy, which then replaces it.  Hence, the Config returned by Current() can be
+// read without locking but it won't see later updates; code that uses a reloadable parameter
+// should call Current() each time that it needs the value.
+type LiveConfig struct {
+	// updateLock serialises updates.  The calculation graph merges in datastore config
+	// while the local config can be reloaded from a signal handler.
+	updateLock sync.Mutex
+
+	lock    sync.RWMutex
+	current *Config
+}
+
+// NewLiveConfig returns a LiveConfig that starts with the given Config, which the caller must
+// not modify from now on.
+func NewLiveConfig(initial *Config) *LiveConfig {
+	return &LiveConfig{
+		current: initial,
+	}
+}
+
+// Current returns the current config.  It must not be modified.
+func (l *LiveConfig) Current() *Config {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.current
+}
+
+func (l *LiveConfig) setCurrent(config *Config) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.current = config
+}
+
+// UpdateFrom merges the rawData from one particular source into a copy of the current config,
+// which becomes current unless there was an error.  See Config.UpdateFrom().
+func (l *LiveConfig) UpdateFrom(rawData map[string]string, source Source) (changed bool, err error) {
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+
+	updated := l.Current().copy()
+	changed, err = updated.UpdateFrom(rawData, source)
+	if err != nil {
+		return
+	}
+	l.setCurrent(updated)
+	return
+}
+
+// UpdateLocalSources re-merges freshly-loaded environment and config file values, for example
+// after the config file has been edited.  Changes to reloadable parameters are merged in and
+// returned in applied; changes to other parameters would need a restart so they are left out
+// (the previous values are kept) and returned in restartNeeded.  If the new values fail
+// validation, nothing is changed and an error is returned.
+func (l *LiveConfig) UpdateLocalSources(
+	envConfig, fileConfig map[string]string,
+) (applied, restartNeeded []string, err error) {
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+
+	updated, applied, restartNeeded, err := l.Current().withLocalSources(envConfig, fileConfig)
+	if updated != nil {
+		l.setCurrent(updated)
+	}
+	return
+}
+
+// RawValues returns a copy of the raw values of the current config.
+func (l *LiveConfig) RawValues() map[string]string {
+	return l.Current().RawValues()
+}
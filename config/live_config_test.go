@@ -0,0 +1,95 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config_test
+
+import (
+	. "github.com/projectcalico/felix/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LiveConfig", func() {
+	var live *LiveConfig
+	var initial *Config
+	BeforeEach(func() {
+		initial = New()
+		initial.UpdateFrom(map[string]string{
+			"FelixHostname": "host1",
+		}, EnvironmentVariable)
+		initial.UpdateFrom(map[string]string{
+			"LogSeverityScreen": "INFO",
+			"IptablesMarkMask":  "0xff000000",
+		}, ConfigFile)
+		live = NewLiveConfig(initial)
+	})
+
+	It("should replace the current config rather than modifying it", func() {
+		changed, err := live.UpdateFrom(map[string]string{
+			"IptablesRefreshInterval": "30",
+		}, DatastoreGlobal)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(live.Current()).NotTo(BeIdenticalTo(initial))
+		Expect(live.Current().IptablesRefreshInterval).To(Equal(30))
+		Expect(live.Current().LogSeverityScreen).To(Equal("INFO"))
+		Expect(initial.IptablesRefreshInterval).To(Equal(10))
+		Expect(initial.RawValues()).NotTo(HaveKey("IptablesRefreshInterval"))
+	})
+
+	It("should return a copy of the raw values", func() {
+		live.RawValues()["IptablesMarkMask"] = "0xff"
+		Expect(live.RawValues()["IptablesMarkMask"]).To(Equal("0xff000000"))
+	})
+
+	Describe("UpdateLocalSources", func() {
+		It("should apply reloadable changes and hold back the rest", func() {
+			applied, restartNeeded, err := live.UpdateLocalSources(
+				map[string]string{"FelixHostname": "host1"},
+				map[string]string{
+					"LogSeverityScreen": "DEBUG",
+					"IptablesMarkMask":  "0xff00",
+				},
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(applied).To(Equal([]string{"LogSeverityScreen"}))
+			Expect(restartNeeded).To(Equal([]string{"IptablesMarkMask"}))
+			Expect(live.Current().LogSeverityScreen).To(Equal("DEBUG"))
+			Expect(live.Current().IptablesMarkMask).To(Equal(uint32(0xff000000)))
+			Expect(live.RawValues()["IptablesMarkMask"]).To(Equal("0xff000000"))
+			Expect(initial.LogSeverityScreen).To(Equal("INFO"))
+		})
+
+		It("should hold back removal of a parameter that needs a restart", func() {
+			applied, restartNeeded, err := live.UpdateLocalSources(
+				map[string]string{"FelixHostname": "host1"},
+				map[string]string{"LogSeverityScreen": "INFO"},
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(applied).To(BeEmpty())
+			Expect(restartNeeded).To(Equal([]string{"IptablesMarkMask"}))
+			Expect(live.Current()).To(BeIdenticalTo(initial))
+		})
+
+		It("should reject invalid config", func() {
+			_, _, err := live.UpdateLocalSources(
+				map[string]string{"FelixHostname": "host1"},
+				map[string]string{"IptablesMarkMask": "0x1"},
+			)
+			Expect(err).To(HaveOccurred())
+			Expect(live.Current()).To(BeIdenticalTo(initial))
+		})
+	})
+})
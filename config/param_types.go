@@ -41,6 +41,8 @@ type Metadata struct {
 	NonZero           bool
 	DieOnParseFailure bool
 	Local             bool
+	// Reloadable is set for parameters that can be changed without restarting Felix.
+	Reloadable bool
 }
 
 func (m *Metadata) GetMetadata() *Metadata {
@@ -218,15 +220,32 @@ func (p *PortListParam) Parse(raw string) (interface{}, error) {
 			continue
 		}
 
+		// Entries are <protocol>:<net>:<number>, <protocol>:<number> or <number>.  Since
+		// an IPv6 CIDR contains colons, the net is everything between the first and last
+		// colons.  It may be wrapped in square brackets.
 		parts := strings.Split(portStr, ":")
-		if len(parts) > 2 {
-			return nil, p.parseFailed(raw,
-				"ports should be <protocol>:<number> or <number>")
-		}
 		protocolStr := "tcp"
+		netStr := ""
 		if len(parts) > 1 {
 			protocolStr = strings.ToLower(parts[0])
-			portStr = parts[1]
+			portStr = parts[len(parts)-1]
+		}
+		if len(parts) > 2 {
+			netStr = strings.Join(parts[1:len(parts)-1], ":")
+			netStr = strings.TrimSuffix(strings.TrimPrefix(netStr, "["), "]")
+			if !strings.Contains(netStr, "/") {
+				if strings.Contains(netStr, ":") {
+					netStr += "/128"
+				} else {
+					netStr += "/32"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(netStr)
+			if err != nil {
+				return nil, p.parseFailed(raw,
+					"ports should be <protocol>:<net>:<number>, <protocol>:<number> or <number>")
+			}
+			netStr = ipNet.String()
 		}
 		if protocolStr != "tcp" && protocolStr != "udp" {
 			return nil, p.parseFailed(raw, "unknown protocol: "+protocolStr)
@@ -244,11 +263,44 @@ func (p *PortListParam) Parse(raw string) (interface{}, error) {
 		result = append(result, ProtoPort{
 			Protocol: protocolStr,
 			Port:     uint16(port),
+			Net:      netStr,
 		})
 	}
 	return result, nil
 }
 
+type DSCPMapParam struct {
+	Metadata
+}
+
+// Parse parses a comma-separated list of <from>:<to> DSCP value pairs, such as "46:0,34:10".
+func (p *DSCPMapParam) Parse(raw string) (interface{}, error) {
+	result := map[uint8]uint8{}
+	for _, pairStr := range strings.Split(raw, ",") {
+		pairStr = strings.Trim(pairStr, " ")
+		if pairStr == "" {
+			continue
+		}
+		parts := strings.Split(pairStr, ":")
+		if len(parts) != 2 {
+			return nil, p.parseFailed(raw, "entries should be <from>:<to>")
+		}
+		var values [2]uint8
+		for i, part := range parts {
+			value, err := strconv.Atoi(strings.Trim(part, " "))
+			if err != nil {
+				return nil, p.parseFailed(raw, "DSCP values should be integers")
+			}
+			if value < 0 || value > 63 {
+				return nil, p.parseFailed(raw, "DSCP values must be in range 0-63")
+			}
+			values[i] = uint8(value)
+		}
+		result[values[0]] = values[1]
+	}
+	return result, nil
+}
+
 type EndpointListParam struct {
 	Metadata
 }
@@ -114,6 +114,58 @@ var _ = Describe("Conntrack", func() {
 			}))
 		})
 	})
+
+	Describe("listing flows", func() {
+		BeforeEach(func() {
+			cmdRec.nextOutput = "tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=42 dport=80 " +
+				"packets=3 bytes=180 src=10.0.0.2 dst=10.0.0.1 sport=80 dport=42 packets=2 bytes=120 " +
+				"[ASSURED] mark=0 use=1\n" +
+				"udp      17 29 src=10.0.0.1 dst=10.0.0.3 sport=53 dport=53 [UNREPLIED] " +
+				"src=10.0.0.3 dst=10.0.0.1 sport=53 dport=53 mark=0 use=1\n" +
+				"conntrack v1.4.4 (conntrack-tools): 2 flow entries have been shown.\n"
+		})
+
+		It("should dump the right family", func() {
+			_, err := conntrack.ListFlows(6)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cmdRec.cmdArgs).To(Equal([][]string{
+				[]string{"--family", "ipv6", "--dump"},
+			}))
+		})
+		It("should parse the flows", func() {
+			flows, err := conntrack.ListFlows(4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(flows).To(Equal([]Flow{
+				{
+					Protocol: 6,
+					Orig: Tuple{
+						Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.2"),
+						SrcPort: 42, DstPort: 80, Packets: 3, Bytes: 180,
+					},
+					Reply: Tuple{
+						Src: net.ParseIP("10.0.0.2"), Dst: net.ParseIP("10.0.0.1"),
+						SrcPort: 80, DstPort: 42, Packets: 2, Bytes: 120,
+					},
+				},
+				{
+					Protocol: 17,
+					Orig: Tuple{
+						Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.3"),
+						SrcPort: 53, DstPort: 53,
+					},
+					Reply: Tuple{
+						Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("10.0.0.1"),
+						SrcPort: 53, DstPort: 53,
+					},
+				},
+			}))
+		})
+		It("should return an error if the dump fails", func() {
+			cmdRec.nextError = errors.New("who knows")
+			_, err := conntrack.ListFlows(4)
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
 
 type cmdRecorder struct {
@@ -121,11 +173,12 @@ type cmdRecorder struct {
 	cmdArgs         [][]string
 	nextError       error
 	persistentError error
+	nextOutput      string
 }
 
 func (r *cmdRecorder) newCmd(name string, arg ...string) CmdIface {
 	Expect(name).To(Equal("conntrack"))
-	mc := &mockCmd{}
+	mc := &mockCmd{output: r.nextOutput}
 	if r.nextError != nil {
 		mc.err = r.nextError
 		r.nextError = nil
@@ -139,12 +192,13 @@ func (r *cmdRecorder) newCmd(name string, arg ...string) CmdIface {
 }
 
 type mockCmd struct {
-	err error
+	err    error
+	output string
 }
 
 func (c *mockCmd) CombinedOutput() ([]byte, error) {
 	if c.err != nil {
 		return []byte(c.err.Error()), c.err
 	}
-	return []byte(""), nil
+	return []byte(c.output), nil
 }
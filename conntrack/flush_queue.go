@@ -0,0 +1,172 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrack
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	gaugeFlushQueueLen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_conntrack_flush_queue_len",
+		Help: "Number of IPs waiting for their conntrack flows to be removed.",
+	})
+	countFlushes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_flushes",
+		Help: "Number of IPs that have had their conntrack flows removed.",
+	})
+	countFlushesCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_flushes_coalesced",
+		Help: "Number of conntrack flush requests that were merged with an already-queued request.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		gaugeFlushQueueLen,
+		countFlushes,
+		countFlushesCoalesced,
+	)
+}
+
+// flushBatchSize is the maximum number of requests that we take off the queue at once.
+const flushBatchSize = 100
+
+type flowRemover interface {
+	RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP)
+}
+
+type flushRequest struct {
+	ipVersion uint8
+	ipAddr    string
+}
+
+// FlushQueue removes conntrack flows in the background so that a mass deletion of endpoints
+// doesn't stall the dataplane loop.  Each removal runs several conntrack commands so we limit
+// the rate at which we work through the queue to avoid swamping the host.  If the same IP is
+// queued again before we get to it, the requests are coalesced.
+//
+// RemoveConntrackFlows() only queues the request; Loop() must be running in its own goroutine
+// to do the work.
+type FlushQueue struct {
+	lock        sync.Mutex
+	pending     []flushRequest
+	pendingKeys map[flushRequest]bool
+	wakeC       chan struct{}
+
+	remover flowRemover
+	// interval is the minimum time between removals, or 0 for no limit.
+	interval time.Duration
+
+	// Shims for testing.
+	sleep func(time.Duration)
+}
+
+// NewFlushQueue creates a FlushQueue that removes flows using the given remover (normally a
+// *Conntrack), limited to maxPerSecond IPs per second.  A limit of 0 disables rate limiting.
+func NewFlushQueue(remover flowRemover, maxPerSecond int) *FlushQueue {
+	return NewFlushQueueWithShims(remover, maxPerSecond, time.Sleep)
+}
+
+// NewFlushQueueWithShims is a test constructor that allows the sleep function to be replaced.
+func NewFlushQueueWithShims(
+	remover flowRemover,
+	maxPerSecond int,
+	sleep func(time.Duration),
+) *FlushQueue {
+	var interval time.Duration
+	if maxPerSecond > 0 {
+		interval = time.Second / time.Duration(maxPerSecond)
+	}
+	return &FlushQueue{
+		pendingKeys: map[flushRequest]bool{},
+		wakeC:       make(chan struct{}, 1),
+		remover:     remover,
+		interval:    interval,
+		sleep:       sleep,
+	}
+}
+
+// RemoveConntrackFlows queues the removal of the conntrack flows for the given IP.  It never
+// blocks.
+func (q *FlushQueue) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
+	req := flushRequest{ipVersion: ipVersion, ipAddr: ipAddr.String()}
+
+	q.lock.Lock()
+	if q.pendingKeys[req] {
+		q.lock.Unlock()
+		log.WithField("ip", req.ipAddr).Debug("Conntrack flush already queued")
+		countFlushesCoalesced.Inc()
+		return
+	}
+	q.pendingKeys[req] = true
+	q.pending = append(q.pending, req)
+	gaugeFlushQueueLen.Set(float64(len(q.pending)))
+	q.lock.Unlock()
+
+	log.WithField("ip", req.ipAddr).Debug("Queued conntrack flush")
+	select {
+	case q.wakeC <- struct{}{}:
+	default:
+		// Already a wake-up pending.
+	}
+}
+
+// Loop processes the queue until the process exits.
+func (q *FlushQueue) Loop() {
+	for range q.wakeC {
+		for q.ProcessBatch() > 0 {
+		}
+	}
+}
+
+// ProcessBatch removes the flows for up to flushBatchSize queued IPs, in the order that they
+// were queued, and returns the number processed.  It sleeps after each removal as needed to
+// respect the rate limit.
+func (q *FlushQueue) ProcessBatch() int {
+	q.lock.Lock()
+	numToProcess := len(q.pending)
+	if numToProcess > flushBatchSize {
+		numToProcess = flushBatchSize
+	}
+	batch := q.pending[:numToProcess]
+	q.pending = q.pending[numToProcess:]
+	for _, req := range batch {
+		// Once we've taken a request off the queue, a new request for the same IP needs a
+		// new flush since there may be new flows by the time we get to it.
+		delete(q.pendingKeys, req)
+	}
+	gaugeFlushQueueLen.Set(float64(len(q.pending)))
+	q.lock.Unlock()
+
+	if numToProcess > 0 {
+		log.WithField("numIPs", numToProcess).Debug("Processing batch of conntrack flushes")
+	}
+	for _, req := range batch {
+		q.remover.RemoveConntrackFlows(req.ipVersion, net.ParseIP(req.ipAddr))
+		countFlushes.Inc()
+		if q.interval > 0 {
+			// Sleep after each removal, rather than before, so that the rate limit also
+			// applies across batches.
+			q.sleep(q.interval)
+		}
+	}
+	return numToProcess
+}
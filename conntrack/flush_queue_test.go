@@ -0,0 +1,107 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrack_test
+
+import (
+	. "github.com/projectcalico/felix/conntrack"
+
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FlushQueue", func() {
+	var queue *FlushQueue
+	var remover *mockRemover
+	var sleeps []time.Duration
+
+	BeforeEach(func() {
+		remover = &mockRemover{}
+		sleeps = nil
+		queue = NewFlushQueueWithShims(remover, 10, func(d time.Duration) {
+			sleeps = append(sleeps, d)
+		})
+	})
+
+	It("should not remove flows until the queue is processed", func() {
+		queue.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		Expect(remover.removed).To(BeEmpty())
+	})
+
+	It("should process nothing when the queue is empty", func() {
+		Expect(queue.ProcessBatch()).To(Equal(0))
+		Expect(sleeps).To(BeEmpty())
+	})
+
+	It("should remove flows in order, rate limited", func() {
+		queue.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		queue.RemoveConntrackFlows(6, net.ParseIP("fe80::beef"))
+		Expect(queue.ProcessBatch()).To(Equal(2))
+		Expect(remover.removed).To(Equal([]string{"4:10.0.0.1", "6:fe80::beef"}))
+		Expect(sleeps).To(Equal([]time.Duration{100 * time.Millisecond, 100 * time.Millisecond}))
+	})
+
+	It("should coalesce repeated requests for the same IP", func() {
+		queue.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		queue.RemoveConntrackFlows(4, net.ParseIP("10.0.0.2"))
+		queue.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		Expect(queue.ProcessBatch()).To(Equal(2))
+		Expect(remover.removed).To(Equal([]string{"4:10.0.0.1", "4:10.0.0.2"}))
+	})
+
+	It("should flush again if the IP is requeued after being processed", func() {
+		queue.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		queue.ProcessBatch()
+		queue.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		Expect(queue.ProcessBatch()).To(Equal(1))
+		Expect(remover.removed).To(Equal([]string{"4:10.0.0.1", "4:10.0.0.1"}))
+	})
+
+	It("should process a large queue in batches", func() {
+		for i := 0; i < 150; i++ {
+			queue.RemoveConntrackFlows(4, net.ParseIP(fmt.Sprintf("10.0.%d.%d", i/256, i%256)))
+		}
+		Expect(queue.ProcessBatch()).To(Equal(100))
+		Expect(queue.ProcessBatch()).To(Equal(50))
+		Expect(queue.ProcessBatch()).To(Equal(0))
+		Expect(remover.removed).To(HaveLen(150))
+	})
+
+	Describe("with rate limiting disabled", func() {
+		BeforeEach(func() {
+			queue = NewFlushQueueWithShims(remover, 0, func(d time.Duration) {
+				sleeps = append(sleeps, d)
+			})
+		})
+
+		It("should not sleep", func() {
+			queue.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+			queue.RemoveConntrackFlows(4, net.ParseIP("10.0.0.2"))
+			Expect(queue.ProcessBatch()).To(Equal(2))
+			Expect(sleeps).To(BeEmpty())
+		})
+	})
+})
+
+type mockRemover struct {
+	removed []string
+}
+
+func (r *mockRemover) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
+	r.removed = append(r.removed, fmt.Sprintf("%d:%s", ipVersion, ipAddr))
+}
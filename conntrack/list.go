@@ -0,0 +1,138 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Tuple is one direction of a conntrack entry, along with its packet and byte counters.  The
+// counters are only maintained by the kernel if nf_conntrack_acct is enabled.
+type Tuple struct {
+	Src     net.IP
+	Dst     net.IP
+	SrcPort int
+	DstPort int
+	Packets uint64
+	Bytes   uint64
+}
+
+// Flow is a conntrack entry.  Orig is the direction of the packet that created the entry;
+// Reply is the expected direction of the return traffic.
+type Flow struct {
+	Protocol int
+	Orig     Tuple
+	Reply    Tuple
+}
+
+// ListFlows dumps the conntrack table for the given IP version.
+func (c Conntrack) ListFlows(ipVersion uint8) ([]Flow, error) {
+	var family string
+	switch ipVersion {
+	case 4:
+		family = "ipv4"
+	case 6:
+		family = "ipv6"
+	default:
+		log.WithField("version", ipVersion).Panic("Unknown IP version")
+	}
+	cmd := c.newCmd("conntrack", "--family", family, "--dump")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump conntrack table: %v: %s", err, output)
+	}
+	return ParseFlows(string(output)), nil
+}
+
+// ParseFlows parses the output of "conntrack --dump".  Lines that aren't conntrack entries,
+// such as the summary line that conntrack writes to stderr, are ignored.
+func ParseFlows(output string) []Flow {
+	var flows []Flow
+	for _, line := range strings.Split(output, "\n") {
+		flow, ok := parseFlow(line)
+		if !ok {
+			continue
+		}
+		flows = append(flows, flow)
+	}
+	return flows
+}
+
+// parseFlow parses a line such as
+//
+//	tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=42 dport=80 packets=3
+//	bytes=180 src=10.0.0.2 dst=10.0.0.1 sport=80 dport=42 packets=2 bytes=120 [ASSURED]
+//	mark=0 use=1
+//
+// (all on one line).  The first src= starts the original tuple and the second starts the
+// reply tuple.
+func parseFlow(line string) (flow Flow, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return
+	}
+	protocol, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return
+	}
+	flow.Protocol = protocol
+	var tuple *Tuple
+	numTuples := 0
+	for _, field := range fields[2:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], parts[1]
+		if key == "src" {
+			numTuples++
+			switch numTuples {
+			case 1:
+				tuple = &flow.Orig
+			case 2:
+				tuple = &flow.Reply
+			default:
+				return
+			}
+		}
+		if tuple == nil {
+			continue
+		}
+		switch key {
+		case "src":
+			tuple.Src = net.ParseIP(value)
+		case "dst":
+			tuple.Dst = net.ParseIP(value)
+		case "sport":
+			tuple.SrcPort, _ = strconv.Atoi(value)
+		case "dport":
+			tuple.DstPort, _ = strconv.Atoi(value)
+		case "packets":
+			tuple.Packets, _ = strconv.ParseUint(value, 10, 64)
+		case "bytes":
+			tuple.Bytes, _ = strconv.ParseUint(value, 10, 64)
+		}
+	}
+	if numTuples != 2 || flow.Orig.Src == nil || flow.Orig.Dst == nil {
+		return
+	}
+	ok = true
+	return
+}
@@ -0,0 +1,358 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package consul implements a datastore client that stores Calico's data in Consul's KV store.
+// It uses the same key/value layout as libcalico-go's etcd backend, minus the leading "/"
+// since Consul keys are relative.
+package consul
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+const (
+	// Consul limits session TTLs to this range.
+	minSessionTTL = 10 * time.Second
+	maxSessionTTL = 24 * time.Hour
+)
+
+// Config contains the Consul connection parameters.
+type Config struct {
+	// Address is the host:port of the Consul agent.
+	Address  string
+	Scheme   string
+	Token    string
+	KeyFile  string
+	CertFile string
+	CAFile   string
+}
+
+// KVAPI is the subset of Consul's KV API that we use; it is implemented by *api.KV.
+type KVAPI interface {
+	Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error)
+	List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error)
+	Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error)
+	CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+	Acquire(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+	DeleteCAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+}
+
+// SessionAPI is the subset of Consul's session API that we use; it is implemented by
+// *api.Session.
+type SessionAPI interface {
+	Create(se *api.SessionEntry, q *api.WriteOptions) (string, *api.WriteMeta, error)
+	RenewPeriodic(initialTTL string, id string, q *api.WriteOptions, doneCh chan struct{}) error
+}
+
+// Client is a libcalico-go backend API client that stores Calico's data in Consul.
+type Client struct {
+	kv       KVAPI
+	sessions SessionAPI
+
+	// lock protects sessionIDs.
+	lock sync.Mutex
+	// sessionIDs contains the ID of the session that we use for each TTL.  Consul doesn't
+	// support TTLs on keys so, to emulate them, we attach keys to a session with that TTL
+	// and the "delete" behaviour.  We keep the session alive while we're running; if we
+	// die, it expires and Consul deletes the keys.
+	sessionIDs map[time.Duration]string
+}
+
+// Client must be usable as a drop-in replacement for libcalico-go's clients.
+var _ bapi.Client = (*Client)(nil)
+
+func NewClient(config Config) (*Client, error) {
+	consulConfig := api.DefaultConfig()
+	consulConfig.Address = config.Address
+	consulConfig.Scheme = config.Scheme
+	consulConfig.Token = config.Token
+	consulConfig.TLSConfig = api.TLSConfig{
+		CAFile:   config.CAFile,
+		CertFile: config.CertFile,
+		KeyFile:  config.KeyFile,
+	}
+	consulClient, err := api.NewClient(consulConfig)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithShims(consulClient.KV(), consulClient.Session()), nil
+}
+
+// NewClientWithShims is a test constructor that allows the Consul APIs to be replaced.
+func NewClientWithShims(kv KVAPI, sessions SessionAPI) *Client {
+	return &Client{
+		kv:         kv,
+		sessions:   sessions,
+		sessionIDs: map[time.Duration]string{},
+	}
+}
+
+// EnsureInitialized creates the ready flag, if it doesn't already exist.
+func (c *Client) EnsureInitialized() error {
+	_, err := c.Create(&model.KVPair{Key: model.ReadyFlagKey{}, Value: true})
+	if _, ok := err.(errors.ErrorResourceAlreadyExists); ok {
+		return nil
+	}
+	return err
+}
+
+// EnsureCalicoNodeInitialized is a no-op; Consul needs no per-node initialization.
+func (c *Client) EnsureCalicoNodeInitialized(node string) error {
+	return nil
+}
+
+// Create creates the given KV, failing if the key already exists.
+func (c *Client) Create(d *model.KVPair) (*model.KVPair, error) {
+	consulKV, err := c.toConsulKV(d)
+	if err != nil {
+		return nil, err
+	}
+	// A CAS with index 0 only succeeds if the key doesn't exist.
+	consulKV.ModifyIndex = 0
+	ok, err := c.write(consulKV)
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+	}
+	if !ok {
+		return nil, errors.ErrorResourceAlreadyExists{Identifier: d.Key}
+	}
+	return d, nil
+}
+
+// Update updates the given KV, failing if the key doesn't exist.  If the KV has a Revision
+// then the update only succeeds if the stored KV still has that revision.
+func (c *Client) Update(d *model.KVPair) (*model.KVPair, error) {
+	consulKV, err := c.toConsulKV(d)
+	if err != nil {
+		return nil, err
+	}
+	revision, revisionSet := d.Revision.(uint64)
+	if !revisionSet {
+		// Consul has no "update only if present" operation; read the current index and
+		// then do a CAS against that.
+		existing, _, err := c.kv.Get(consulKV.Key, nil)
+		if err != nil {
+			return nil, errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+		}
+		if existing == nil {
+			return nil, errors.ErrorResourceDoesNotExist{Identifier: d.Key}
+		}
+		revision = existing.ModifyIndex
+	}
+	consulKV.ModifyIndex = revision
+	ok, err := c.write(consulKV)
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+	}
+	if !ok {
+		return nil, errors.ErrorResourceUpdateConflict{Identifier: d.Key}
+	}
+	return d, nil
+}
+
+// Apply creates or updates the given KV.
+func (c *Client) Apply(d *model.KVPair) (*model.KVPair, error) {
+	consulKV, err := c.toConsulKV(d)
+	if err != nil {
+		return nil, err
+	}
+	if consulKV.Session != "" {
+		_, _, err = c.kv.Acquire(consulKV, nil)
+	} else {
+		_, err = c.kv.Put(consulKV, nil)
+	}
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+	}
+	return d, nil
+}
+
+// Delete deletes the given KV.  If the KV has a Revision then the delete only succeeds if the
+// stored KV still has that revision.
+func (c *Client) Delete(d *model.KVPair) error {
+	path, err := keyToConsulPath(d.Key)
+	if err != nil {
+		return err
+	}
+	revision, revisionSet := d.Revision.(uint64)
+	if !revisionSet {
+		// Consul doesn't tell us whether a plain delete found the key so read it first.
+		existing, _, err := c.kv.Get(path, nil)
+		if err != nil {
+			return errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+		}
+		if existing == nil {
+			return errors.ErrorResourceDoesNotExist{Identifier: d.Key}
+		}
+		revision = existing.ModifyIndex
+	}
+	ok, _, err := c.kv.DeleteCAS(&api.KVPair{Key: path, ModifyIndex: revision}, nil)
+	if err != nil {
+		return errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+	}
+	if !ok {
+		return errors.ErrorResourceUpdateConflict{Identifier: d.Key}
+	}
+	return nil
+}
+
+// Get returns the KV with the given key.
+func (c *Client) Get(k model.Key) (*model.KVPair, error) {
+	path, err := keyToConsulPath(k)
+	if err != nil {
+		return nil, err
+	}
+	consulKV, _, err := c.kv.Get(path, nil)
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: k}
+	}
+	if consulKV == nil {
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: k}
+	}
+	value, err := model.ParseValue(k, consulKV.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &model.KVPair{
+		Key:      k,
+		Value:    value,
+		Revision: consulKV.ModifyIndex,
+	}, nil
+}
+
+// List returns the KVs that match the given list options.
+func (c *Client) List(l model.ListInterface) ([]*model.KVPair, error) {
+	root := strings.TrimPrefix(model.ListOptionsToDefaultPathRoot(l), "/")
+	consulKVs, _, err := c.kv.List(root, nil)
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: l}
+	}
+	kvs := []*model.KVPair{}
+	for _, consulKV := range consulKVs {
+		// The prefix match may pick up keys that don't match the list options; for example,
+		// a prefix of calico/v1/host/foo also matches calico/v1/host/foobar.
+		key := l.KeyFromDefaultPath("/" + consulKV.Key)
+		if key == nil {
+			continue
+		}
+		value, err := model.ParseValue(key, consulKV.Value)
+		if err != nil {
+			log.WithError(err).WithField("key", consulKV.Key).Warn(
+				"Failed to parse value, skipping")
+			continue
+		}
+		kvs = append(kvs, &model.KVPair{
+			Key:      key,
+			Value:    value,
+			Revision: consulKV.ModifyIndex,
+		})
+	}
+	return kvs, nil
+}
+
+// Syncer returns a syncer that sends the whole of Calico's data to the given callbacks, and
+// then keeps them up to date.
+func (c *Client) Syncer(callbacks bapi.SyncerCallbacks) bapi.Syncer {
+	return newSyncer(c.kv, callbacks)
+}
+
+// write does a CAS of the given KV, acquiring the KV's session, if it has one.
+func (c *Client) write(consulKV *api.KVPair) (bool, error) {
+	if consulKV.Session != "" {
+		// Acquire doesn't support CAS so we may race with another writer here; that's
+		// acceptable for the keys that have TTLs, which are only written by their owner.
+		ok, _, err := c.kv.Acquire(consulKV, nil)
+		return ok, err
+	}
+	ok, _, err := c.kv.CAS(consulKV, nil)
+	return ok, err
+}
+
+func (c *Client) toConsulKV(d *model.KVPair) (*api.KVPair, error) {
+	path, err := keyToConsulPath(d.Key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := model.SerializeValue(d)
+	if err != nil {
+		return nil, err
+	}
+	consulKV := &api.KVPair{
+		Key:   path,
+		Value: value,
+	}
+	if d.TTL != 0 {
+		consulKV.Session, err = c.sessionForTTL(d.TTL)
+		if err != nil {
+			return nil, errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+		}
+	}
+	return consulKV, nil
+}
+
+// sessionForTTL returns the ID of our session with the given TTL, creating it if needed.
+func (c *Client) sessionForTTL(ttl time.Duration) (string, error) {
+	if ttl < minSessionTTL {
+		ttl = minSessionTTL
+	} else if ttl > maxSessionTTL {
+		ttl = maxSessionTTL
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if id, ok := c.sessionIDs[ttl]; ok {
+		return id, nil
+	}
+	ttlStr := ttl.String()
+	id, _, err := c.sessions.Create(&api.SessionEntry{
+		Name:     "calico-felix",
+		Behavior: api.SessionBehaviorDelete,
+		TTL:      ttlStr,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(log.Fields{"id": id, "ttl": ttlStr}).Info("Created Consul session")
+	go func() {
+		// RenewPeriodic only returns if the session is lost, in which case we need a new
+		// one.
+		err := c.sessions.RenewPeriodic(ttlStr, id, nil, nil)
+		log.WithError(err).WithField("id", id).Warn("Lost Consul session")
+		c.lock.Lock()
+		if c.sessionIDs[ttl] == id {
+			delete(c.sessionIDs, ttl)
+		}
+		c.lock.Unlock()
+	}()
+	c.sessionIDs[ttl] = id
+	return id, nil
+}
+
+// keyToConsulPath converts a key to its Consul path: the default path without the leading "/".
+func keyToConsulPath(k model.Key) (string, error) {
+	path, err := model.KeyToDefaultPath(k)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(path, "/"), nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul_test
+
+import (
+	. "github.com/projectcalico/felix/consul"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	calierrors "github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+var _ = Describe("Client", func() {
+	var kv *mockKV
+	var sessions *mockSessions
+	var client *Client
+
+	BeforeEach(func() {
+		kv = newMockKV()
+		sessions = newMockSessions()
+		client = NewClientWithShims(kv, sessions)
+	})
+
+	It("should put a KV without a session if it has no TTL", func() {
+		_, err := client.Apply(&model.KVPair{
+			Key:   model.GlobalConfigKey{Name: "LogSeverityScreen"},
+			Value: "Debug",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kv.getValues()).To(Equal(map[string]string{
+			"calico/v1/config/LogSeverityScreen": "Debug",
+		}))
+		Expect(kv.getSession("calico/v1/config/LogSeverityScreen")).To(Equal(""))
+		Expect(sessions.getTTLs()).To(BeEmpty())
+	})
+
+	It("should attach a KV with a TTL to a shared session", func() {
+		for _, name := range []string{"Foo", "Bar"} {
+			_, err := client.Apply(&model.KVPair{
+				Key:   model.GlobalConfigKey{Name: name},
+				Value: "value",
+				TTL:   90 * time.Second,
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(sessions.getTTLs()).To(Equal([]string{"1m30s"}))
+		Expect(kv.getSession("calico/v1/config/Foo")).To(Equal("session-1"))
+		Expect(kv.getSession("calico/v1/config/Bar")).To(Equal("session-1"))
+		// The session should be kept alive.
+		Eventually(sessions.renewing).Should(Receive(Equal("session-1")))
+	})
+
+	It("should clamp a short TTL to Consul's minimum", func() {
+		_, err := client.Apply(&model.KVPair{
+			Key:   model.GlobalConfigKey{Name: "Foo"},
+			Value: "bar",
+			TTL:   time.Second,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sessions.getTTLs()).To(Equal([]string{"10s"}))
+	})
+
+	It("should not write the KV if the session can't be created", func() {
+		sessions.err = errors.New("no leader")
+		_, err := client.Apply(&model.KVPair{
+			Key:   model.GlobalConfigKey{Name: "Foo"},
+			Value: "bar",
+			TTL:   90 * time.Second,
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(kv.getValues()).To(BeEmpty())
+	})
+
+	It("should only create a KV that doesn't exist", func() {
+		kvp := &model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}, Value: "bar"}
+		_, err := client.Create(kvp)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.Create(kvp)
+		Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceAlreadyExists{}))
+	})
+
+	It("should only update a KV that exists", func() {
+		kvp := &model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}, Value: "bar"}
+		_, err := client.Update(kvp)
+		Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceDoesNotExist{}))
+		kv.set("calico/v1/config/Foo", "old")
+		_, err = client.Update(kvp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kv.getValues()).To(Equal(map[string]string{"calico/v1/config/Foo": "bar"}))
+	})
+
+	It("should fail an update with a stale revision", func() {
+		kv.set("calico/v1/config/Foo", "old")
+		existing, err := client.Get(model.GlobalConfigKey{Name: "Foo"})
+		Expect(err).NotTo(HaveOccurred())
+		kv.set("calico/v1/config/Foo", "newer")
+		existing.Value = "bar"
+		_, err = client.Update(existing)
+		Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceUpdateConflict{}))
+		Expect(kv.getValues()).To(Equal(map[string]string{"calico/v1/config/Foo": "newer"}))
+	})
+
+	It("should get a KV", func() {
+		kv.set("calico/v1/config/Foo", "bar")
+		kvp, err := client.Get(model.GlobalConfigKey{Name: "Foo"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kvp.Key).To(Equal(model.GlobalConfigKey{Name: "Foo"}))
+		Expect(kvp.Value).To(Equal("bar"))
+		Expect(kvp.Revision).To(Equal(uint64(1)))
+	})
+
+	It("should return does-not-exist from Get for a missing key", func() {
+		_, err := client.Get(model.GlobalConfigKey{Name: "Foo"})
+		Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceDoesNotExist{}))
+	})
+
+	It("should list KVs, skipping values that fail to parse", func() {
+		kv.set("calico/v1/config/Foo", "bar")
+		kv.set("calico/v1/config/Baz", "bad")
+		kv.set("calico/v1/Ready", "true")
+		kvps, err := client.List(model.GlobalConfigListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kvps).To(HaveLen(1))
+		Expect(kvps[0].Key).To(Equal(model.GlobalConfigKey{Name: "Foo"}))
+	})
+
+	It("should delete a KV", func() {
+		kv.set("calico/v1/config/Foo", "bar")
+		err := client.Delete(&model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kv.getValues()).To(BeEmpty())
+		err = client.Delete(&model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}})
+		Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceDoesNotExist{}))
+	})
+})
@@ -0,0 +1,210 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+const (
+	// calicoPrefix is the prefix of all of Calico's keys.  Note: no leading "/" in Consul.
+	calicoPrefix = "calico/v1/"
+
+	// blockingQueryWaitTime is the maximum time that Consul holds each of our blocking
+	// queries open if nothing changes.
+	blockingQueryWaitTime = 5 * time.Minute
+	pollRetryInterval     = 1 * time.Second
+)
+
+var (
+	countPolls = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_consul_polls",
+		Help: "Number of blocking queries that the Consul syncer has completed.",
+	})
+	countPollErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_consul_poll_errors",
+		Help: "Number of blocking queries that the Consul syncer has failed to complete.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(countPolls)
+	prometheus.MustRegister(countPollErrors)
+}
+
+// syncer watches Calico's keys using Consul blocking queries.
+//
+// Each blocking query lists the whole of Calico's prefix, returning once the prefix's index
+// moves past the one that we pass in (or the wait time expires).  Since every response is a
+// complete snapshot, we calculate the updates to send by diffing it against what we sent
+// previously: updates for new keys and keys whose ModifyIndex has changed, and deletions for
+// keys that have disappeared.
+type syncer struct {
+	kv        KVAPI
+	callbacks bapi.SyncerCallbacks
+
+	// knownKeys contains the Calico key and ModifyIndex of each Consul key that we've sent
+	// to the callbacks.
+	knownKeys map[string]knownKey
+	// inSync is set once we've completed our first snapshot.
+	inSync bool
+
+	// Shim for testing.
+	sleep func(time.Duration)
+}
+
+type knownKey struct {
+	key         model.Key
+	modifyIndex uint64
+}
+
+func newSyncer(kv KVAPI, callbacks bapi.SyncerCallbacks) *syncer {
+	return &syncer{
+		kv:        kv,
+		callbacks: callbacks,
+		knownKeys: map[string]knownKey{},
+		sleep:     time.Sleep,
+	}
+}
+
+func (s *syncer) Start() {
+	go s.loop()
+}
+
+func (s *syncer) loop() {
+	s.callbacks.OnStatusUpdated(bapi.WaitForDatastore)
+	var index uint64
+	for {
+		var err error
+		index, err = s.poll(index)
+		if err != nil {
+			log.WithError(err).Warn("Failed to list keys from Consul, will retry")
+			countPollErrors.Inc()
+			s.sleep(pollRetryInterval)
+		}
+	}
+}
+
+// poll does a blocking query for changes after the given index and sends the differences from
+// the previously-sent state to the callbacks.  It returns the index to use for the next query.
+func (s *syncer) poll(index uint64) (uint64, error) {
+	consulKVs, meta, err := s.kv.List(calicoPrefix, &api.QueryOptions{
+		WaitIndex: index,
+		WaitTime:  blockingQueryWaitTime,
+	})
+	if err != nil {
+		return index, err
+	}
+	countPolls.Inc()
+	if !s.inSync {
+		s.callbacks.OnStatusUpdated(bapi.ResyncInProgress)
+	}
+
+	var updates []bapi.Update
+	seenKeys := map[string]bool{}
+	for _, consulKV := range consulKVs {
+		seenKeys[consulKV.Key] = true
+		if update := s.parseUpdate(consulKV); update != nil {
+			updates = append(updates, *update)
+		}
+	}
+	for path := range s.knownKeys {
+		if !seenKeys[path] {
+			updates = append(updates, s.deletion(path))
+		}
+	}
+	if len(updates) > 0 {
+		log.WithFields(log.Fields{
+			"index":      meta.LastIndex,
+			"numUpdates": len(updates),
+		}).Debug("Loaded changes from Consul")
+		s.callbacks.OnUpdates(updates)
+	}
+
+	if !s.inSync {
+		log.WithField("index", meta.LastIndex).Info("Loaded initial snapshot from Consul")
+		s.callbacks.OnStatusUpdated(bapi.InSync)
+		s.inSync = true
+	}
+
+	// Consul's index can go backwards, for example, if the cluster is restored from a
+	// snapshot.  If we kept using the old index, our queries would block until the wait time
+	// expires so start again from scratch.  Since we diff every response, that's safe.
+	if meta.LastIndex < index {
+		log.WithFields(log.Fields{
+			"oldIndex": index,
+			"newIndex": meta.LastIndex,
+		}).Warn("Consul index went backwards, resetting")
+		return 0, nil
+	}
+	return meta.LastIndex, nil
+}
+
+// parseUpdate converts a Consul KV into an update, recording the key as known.  It returns nil
+// if the key isn't one of Calico's or if it hasn't changed since we last sent it.  A value that
+// fails to parse is treated as a deletion since it can't be used.
+func (s *syncer) parseUpdate(consulKV *api.KVPair) *bapi.Update {
+	path := consulKV.Key
+	known, isKnown := s.knownKeys[path]
+	if isKnown && known.modifyIndex == consulKV.ModifyIndex {
+		return nil
+	}
+	key := model.KeyFromDefaultPath("/" + path)
+	if key == nil {
+		log.WithField("key", path).Debug("Ignoring unknown Consul key")
+		return nil
+	}
+	value, err := model.ParseValue(key, consulKV.Value)
+	if err != nil {
+		log.WithError(err).WithField("key", path).Warn("Failed to parse value from Consul")
+		if !isKnown {
+			return nil
+		}
+		deletion := s.deletion(path)
+		return &deletion
+	}
+	updateType := bapi.UpdateTypeKVNew
+	if isKnown {
+		updateType = bapi.UpdateTypeKVUpdated
+	}
+	s.knownKeys[path] = knownKey{key: key, modifyIndex: consulKV.ModifyIndex}
+	return &bapi.Update{
+		KVPair: model.KVPair{
+			Key:      key,
+			Value:    value,
+			Revision: consulKV.ModifyIndex,
+		},
+		UpdateType: updateType,
+	}
+}
+
+// deletion returns a deletion update for the given known key and forgets it.
+func (s *syncer) deletion(path string) bapi.Update {
+	key := s.knownKeys[path].key
+	delete(s.knownKeys, path)
+	return bapi.Update{
+		KVPair: model.KVPair{
+			Key: key,
+		},
+		UpdateType: bapi.UpdateTypeKVDeleted,
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul_test
+
+import (
+	. "github.com/projectcalico/felix/consul"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+var _ = Describe("Syncer", func() {
+	var kv *mockKV
+	var callbacks *mockCallbacks
+
+	BeforeEach(func() {
+		kv = newMockKV()
+		kv.set("calico/v1/Ready", "true")
+		kv.set("calico/v1/config/Foo", "bar")
+		kv.set("calico/v1/config/Baz", "qux")
+		callbacks = &mockCallbacks{}
+		NewClientWithShims(kv, newMockSessions()).Syncer(callbacks).Start()
+		Eventually(callbacks.getStatuses).Should(HaveLen(3))
+	})
+
+	It("should send the snapshot and then the changes", func() {
+		Expect(callbacks.getStatuses()).To(Equal([]bapi.SyncStatus{
+			bapi.WaitForDatastore,
+			bapi.ResyncInProgress,
+			bapi.InSync,
+		}))
+		Expect(callbacks.getUpdates()).To(ConsistOf(
+			newUpdate(model.ReadyFlagKey{}, true, bapi.UpdateTypeKVNew),
+			newUpdate(model.GlobalConfigKey{Name: "Foo"}, "bar", bapi.UpdateTypeKVNew),
+			newUpdate(model.GlobalConfigKey{Name: "Baz"}, "qux", bapi.UpdateTypeKVNew),
+		))
+
+		callbacks.clearUpdates()
+		kv.update(func() {
+			kv.setLocked("calico/v1/config/Foo", "bar2")
+			kv.setLocked("calico/v1/config/New", "value")
+			delete(kv.kvs, "calico/v1/config/Baz")
+		})
+		// Only the changed keys should be sent.
+		Eventually(callbacks.getUpdates).Should(ConsistOf(
+			newUpdate(model.GlobalConfigKey{Name: "Foo"}, "bar2", bapi.UpdateTypeKVUpdated),
+			newUpdate(model.GlobalConfigKey{Name: "New"}, "value", bapi.UpdateTypeKVNew),
+			newUpdate(model.GlobalConfigKey{Name: "Baz"}, nil, bapi.UpdateTypeKVDeleted),
+		))
+		Expect(callbacks.getStatuses()).To(HaveLen(3))
+	})
+
+	It("should treat a value that fails to parse as a deletion", func() {
+		callbacks.clearUpdates()
+		kv.set("calico/v1/config/Foo", "bad")
+		Eventually(callbacks.getUpdates).Should(Equal([]bapi.Update{
+			newUpdate(model.GlobalConfigKey{Name: "Foo"}, nil, bapi.UpdateTypeKVDeleted),
+		}))
+	})
+
+	It("should recover if the index goes backwards", func() {
+		callbacks.clearUpdates()
+		kv.update(func() {
+			kv.index = 1
+			kv.setLocked("calico/v1/config/Baz", "restored")
+		})
+		Eventually(callbacks.getUpdates).Should(Equal([]bapi.Update{
+			newUpdate(model.GlobalConfigKey{Name: "Baz"}, "restored", bapi.UpdateTypeKVUpdated),
+		}))
+
+		// Subsequent changes should be picked up.
+		callbacks.clearUpdates()
+		kv.set("calico/v1/config/New", "value")
+		Eventually(callbacks.getUpdates).Should(Equal([]bapi.Update{
+			newUpdate(model.GlobalConfigKey{Name: "New"}, "value", bapi.UpdateTypeKVNew),
+		}))
+	})
+})
+
+func newUpdate(key model.Key, value interface{}, updateType bapi.UpdateType) bapi.Update {
+	return bapi.Update{
+		KVPair:     model.KVPair{Key: key, Value: value},
+		UpdateType: updateType,
+	}
+}
+
+// mockKV is a minimal in-memory implementation of Consul's KV API.  List supports blocking
+// queries: it waits until the store's index moves past the query's WaitIndex.
+type mockKV struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	kvs   map[string]*api.KVPair
+	index uint64
+}
+
+func newMockKV() *mockKV {
+	kv := &mockKV{kvs: map[string]*api.KVPair{}}
+	kv.cond = sync.NewCond(&kv.lock)
+	return kv
+}
+
+// update calls f with the lock held and then wakes any blocking queries.
+func (kv *mockKV) update(f func()) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	f()
+	kv.cond.Broadcast()
+}
+
+func (kv *mockKV) set(key, value string) {
+	kv.update(func() {
+		kv.setLocked(key, value)
+	})
+}
+
+func (kv *mockKV) setLocked(key, value string) {
+	kv.index++
+	kv.kvs[key] = &api.KVPair{Key: key, Value: []byte(value), ModifyIndex: kv.index}
+}
+
+func (kv *mockKV) getValues() map[string]string {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	values := map[string]string{}
+	for k, v := range kv.kvs {
+		values[k] = string(v.Value)
+	}
+	return values
+}
+
+func (kv *mockKV) getSession(key string) string {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	return kv.kvs[key].Session
+}
+
+func (kv *mockKV) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if p, ok := kv.kvs[key]; ok {
+		copied := *p
+		return &copied, &api.QueryMeta{LastIndex: kv.index}, nil
+	}
+	return nil, &api.QueryMeta{LastIndex: kv.index}, nil
+}
+
+func (kv *mockKV) List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	for q != nil && q.WaitIndex != 0 && kv.index == q.WaitIndex {
+		kv.cond.Wait()
+	}
+	var pairs api.KVPairs
+	for k, p := range kv.kvs {
+		if strings.HasPrefix(k, prefix) {
+			copied := *p
+			pairs = append(pairs, &copied)
+		}
+	}
+	return pairs, &api.QueryMeta{LastIndex: kv.index}, nil
+}
+
+func (kv *mockKV) Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error) {
+	kv.update(func() {
+		kv.putLocked(p)
+	})
+	return &api.WriteMeta{}, nil
+}
+
+func (kv *mockKV) CAS(p *api.KVPair, q *api.WriteOptions) (ok bool, _ *api.WriteMeta, _ error) {
+	kv.update(func() {
+		existing, exists := kv.kvs[p.Key]
+		if (!exists && p.ModifyIndex == 0) || (exists && existing.ModifyIndex == p.ModifyIndex) {
+			kv.putLocked(p)
+			ok = true
+		}
+	})
+	return ok, &api.WriteMeta{}, nil
+}
+
+func (kv *mockKV) Acquire(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	if p.Session == "" {
+		return false, nil, fmt.Errorf("missing session")
+	}
+	kv.update(func() {
+		kv.putLocked(p)
+	})
+	return true, &api.WriteMeta{}, nil
+}
+
+func (kv *mockKV) DeleteCAS(p *api.KVPair, q *api.WriteOptions) (ok bool, _ *api.WriteMeta, _ error) {
+	kv.update(func() {
+		if existing, exists := kv.kvs[p.Key]; exists && existing.ModifyIndex == p.ModifyIndex {
+			kv.index++
+			delete(kv.kvs, p.Key)
+			ok = true
+		}
+	})
+	return ok, &api.WriteMeta{}, nil
+}
+
+func (kv *mockKV) putLocked(p *api.KVPair) {
+	kv.index++
+	copied := *p
+	copied.ModifyIndex = kv.index
+	kv.kvs[p.Key] = &copied
+}
+
+type mockSessions struct {
+	lock sync.Mutex
+	ttls []string
+	err  error
+
+	// renewing receives the ID of each session that is passed to RenewPeriodic.
+	renewing chan string
+}
+
+func newMockSessions() *mockSessions {
+	return &mockSessions{renewing: make(chan string, 10)}
+}
+
+func (s *mockSessions) Create(se *api.SessionEntry, q *api.WriteOptions) (string, *api.WriteMeta, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return "", nil, s.err
+	}
+	s.ttls = append(s.ttls, se.TTL)
+	return fmt.Sprintf("session-%d", len(s.ttls)), &api.WriteMeta{}, nil
+}
+
+// RenewPeriodic blocks forever, as if the session never expires.
+func (s *mockSessions) RenewPeriodic(initialTTL string, id string, q *api.WriteOptions, doneCh chan struct{}) error {
+	s.renewing <- id
+	select {}
+}
+
+func (s *mockSessions) getTTLs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ttls
+}
+
+type mockCallbacks struct {
+	lock     sync.Mutex
+	statuses []bapi.SyncStatus
+	updates  []bapi.Update
+}
+
+func (c *mockCallbacks) OnStatusUpdated(status bapi.SyncStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.statuses = append(c.statuses, status)
+}
+
+func (c *mockCallbacks) OnUpdates(updates []bapi.Update) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, u := range updates {
+		// Revisions depend on the mock's implementation, ignore them.
+		u.Revision = nil
+		c.updates = append(c.updates, u)
+	}
+}
+
+func (c *mockCallbacks) getStatuses() []bapi.SyncStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.statuses
+}
+
+func (c *mockCallbacks) getUpdates() []bapi.Update {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.updates
+}
+
+func (c *mockCallbacks) clearUpdates() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updates = nil
+}
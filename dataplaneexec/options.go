@@ -0,0 +1,79 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dataplaneexec contains the options that control how we run the commands that
+// program the dataplane, such as iptables-restore and ipset.  They're shared by the iptables
+// and ipsets packages so that both run their commands in the same way.
+package dataplaneexec
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Options controls how we run the dataplane commands.  This is useful when Felix runs in a
+// container, where it needs to use the host's binaries and the host's xtables lock file.
+type Options struct {
+	// BinDir, if non-empty, is the directory that contains the binaries.  Otherwise, they
+	// are looked up on the PATH.
+	BinDir string
+	// HostNetnsPID, if non-zero, causes the commands to be run via nsenter, in the network
+	// and mount namespaces of the given process; typically PID 1 of the host.
+	HostNetnsPID int
+	// Timeout, if non-zero, is the time after which we kill a command that hasn't finished.
+	// For example, iptables-save can hang indefinitely if the kernel is stuck holding a
+	// lock.  A killed command returns an error so the caller retries as it would for any
+	// other failure.
+	Timeout time.Duration
+	// RenderOnly, if non-nil, causes us to write the input that we would have passed to
+	// iptables-restore or "ipset restore" to the writer instead of running any commands.
+	// The dataplane appears to be empty.
+	RenderOnly io.Writer
+	// ReadOnly, if true, causes us to run the commands that read the dataplane as normal
+	// but, instead of running the commands that modify it, to log the updates that we would
+	// have made.
+	ReadOnly bool
+}
+
+// CommandLine returns the command and arguments to execute in order to run the given command.
+func (o Options) CommandLine(name string, arg []string) (string, []string) {
+	if o.BinDir != "" {
+		name = filepath.Join(o.BinDir, name)
+	}
+	if o.HostNetnsPID != 0 {
+		nsenterArgs := []string{
+			fmt.Sprintf("--target=%d", o.HostNetnsPID),
+			"--net",
+			"--mount",
+			"--",
+			name,
+		}
+		arg = append(nsenterArgs, arg...)
+		name = "nsenter"
+	}
+	return name, arg
+}
+
+// HostPath returns the path at which we can open the given file as seen by the commands.  If
+// the commands run in the host's mount namespace, that is the file under the host process's
+// root.  For example, we take the xtables lock on the same file as the host's iptables.
+func (o Options) HostPath(path string) string {
+	if o.HostNetnsPID == 0 {
+		return path
+	}
+	return filepath.Join("/proc", strconv.Itoa(o.HostNetnsPID), "root", path)
+}
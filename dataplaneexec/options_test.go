@@ -0,0 +1,48 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplaneexec_test
+
+import (
+	. "github.com/projectcalico/felix/dataplaneexec"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("Options command lines",
+	func(opts Options, expectedName string, expectedArgs []string) {
+		name, args := opts.CommandLine("iptables-restore", []string{"--noflush", "--verbose"})
+		Expect(name).To(Equal(expectedName))
+		Expect(args).To(Equal(expectedArgs))
+	},
+	Entry("default", Options{},
+		"iptables-restore", []string{"--noflush", "--verbose"}),
+	Entry("bin dir", Options{BinDir: "/host/sbin"},
+		"/host/sbin/iptables-restore", []string{"--noflush", "--verbose"}),
+	Entry("host netns", Options{HostNetnsPID: 1},
+		"nsenter", []string{"--target=1", "--net", "--mount", "--",
+			"iptables-restore", "--noflush", "--verbose"}),
+	Entry("host netns with bin dir", Options{BinDir: "/sbin", HostNetnsPID: 1},
+		"nsenter", []string{"--target=1", "--net", "--mount", "--",
+			"/sbin/iptables-restore", "--noflush", "--verbose"}),
+)
+
+var _ = DescribeTable("Options host paths",
+	func(opts Options, expectedPath string) {
+		Expect(opts.HostPath("/run/xtables.lock")).To(Equal(expectedPath))
+	},
+	Entry("default", Options{}, "/run/xtables.lock"),
+	Entry("host netns", Options{HostNetnsPID: 1}, "/proc/1/root/run/xtables.lock"),
+)
@@ -0,0 +1,315 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package etcdv3 implements a datastore client that uses the etcd v3 API.  The key/value
+// layout is the same as libcalico-go's etcd v2 backend, so the two can be used with the same
+// data (once it's been migrated to the v3 store).
+package etcdv3
+
+import (
+	"crypto/tls"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/pkg/transport"
+	"golang.org/x/net/context"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+const clientTimeout = 10 * time.Second
+
+// Config contains the etcd connection parameters.
+type Config struct {
+	// Endpoints are the URLs of the etcd servers, for example "https://10.0.0.1:2379".
+	Endpoints  []string
+	KeyFile    string
+	CertFile   string
+	CACertFile string
+}
+
+// Client is a libcalico-go backend API client that stores Calico's data in etcd, using the
+// etcd v3 API.
+type Client struct {
+	kv      clientv3.KV
+	watcher clientv3.Watcher
+	lease   clientv3.Lease
+}
+
+// Client must be usable as a drop-in replacement for libcalico-go's clients.
+var _ bapi.Client = (*Client)(nil)
+
+func NewClient(config Config) (*Client, error) {
+	var tlsConfig *tls.Config
+	if config.KeyFile != "" || config.CertFile != "" || config.CACertFile != "" {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      config.CertFile,
+			KeyFile:       config.KeyFile,
+			TrustedCAFile: config.CACertFile,
+		}
+		var err error
+		tlsConfig, err = tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints:   config.Endpoints,
+		DialTimeout: clientTimeout,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithShims(etcdClient, etcdClient, etcdClient), nil
+}
+
+// NewClientWithShims is a test constructor that allows the etcd client to be replaced.
+func NewClientWithShims(kv clientv3.KV, watcher clientv3.Watcher, lease clientv3.Lease) *Client {
+	return &Client{
+		kv:      kv,
+		watcher: watcher,
+		lease:   lease,
+	}
+}
+
+// EnsureInitialized creates the ready flag, if it doesn't already exist.
+func (c *Client) EnsureInitialized() error {
+	_, err := c.Create(&model.KVPair{Key: model.ReadyFlagKey{}, Value: true})
+	if _, ok := err.(errors.ErrorResourceAlreadyExists); ok {
+		return nil
+	}
+	return err
+}
+
+// EnsureCalicoNodeInitialized is a no-op; etcd needs no per-node initialization.
+func (c *Client) EnsureCalicoNodeInitialized(node string) error {
+	return nil
+}
+
+// Create creates the given KV, failing if the key already exists.
+func (c *Client) Create(d *model.KVPair) (*model.KVPair, error) {
+	path, value, err := pathAndValue(d)
+	if err != nil {
+		return nil, err
+	}
+	putOpts, err := c.putOptions(d)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	resp, err := c.kv.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(path), "=", 0),
+	).Then(
+		clientv3.OpPut(path, value, putOpts...),
+	).Commit()
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+	}
+	if !resp.Succeeded {
+		return nil, errors.ErrorResourceAlreadyExists{Identifier: d.Key}
+	}
+	return withRevision(d, resp.Header.Revision), nil
+}
+
+// Update updates the given KV, failing if the key doesn't exist.  If the KV has a Revision
+// then the update only succeeds if the stored KV still has that revision.
+func (c *Client) Update(d *model.KVPair) (*model.KVPair, error) {
+	path, value, err := pathAndValue(d)
+	if err != nil {
+		return nil, err
+	}
+	putOpts, err := c.putOptions(d)
+	if err != nil {
+		return nil, err
+	}
+	cmp := clientv3.Compare(clientv3.CreateRevision(path), "!=", 0)
+	revision, revisionSet := d.Revision.(int64)
+	if revisionSet {
+		cmp = clientv3.Compare(clientv3.ModRevision(path), "=", revision)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	resp, err := c.kv.Txn(ctx).If(cmp).Then(clientv3.OpPut(path, value, putOpts...)).Commit()
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+	}
+	if !resp.Succeeded {
+		if revisionSet {
+			return nil, errors.ErrorResourceUpdateConflict{Identifier: d.Key}
+		}
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: d.Key}
+	}
+	return withRevision(d, resp.Header.Revision), nil
+}
+
+// Apply creates or updates the given KV.
+func (c *Client) Apply(d *model.KVPair) (*model.KVPair, error) {
+	path, value, err := pathAndValue(d)
+	if err != nil {
+		return nil, err
+	}
+	putOpts, err := c.putOptions(d)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	resp, err := c.kv.Put(ctx, path, value, putOpts...)
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+	}
+	return withRevision(d, resp.Header.Revision), nil
+}
+
+// Delete deletes the given KV.  If the KV has a Revision then the delete only succeeds if the
+// stored KV still has that revision.
+func (c *Client) Delete(d *model.KVPair) error {
+	path, err := model.KeyToDefaultPath(d.Key)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	if revision, ok := d.Revision.(int64); ok {
+		resp, err := c.kv.Txn(ctx).If(
+			clientv3.Compare(clientv3.ModRevision(path), "=", revision),
+		).Then(
+			clientv3.OpDelete(path),
+		).Commit()
+		if err != nil {
+			return errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+		}
+		if !resp.Succeeded {
+			return errors.ErrorResourceUpdateConflict{Identifier: d.Key}
+		}
+		return nil
+	}
+	resp, err := c.kv.Delete(ctx, path)
+	if err != nil {
+		return errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+	}
+	if resp.Deleted == 0 {
+		return errors.ErrorResourceDoesNotExist{Identifier: d.Key}
+	}
+	return nil
+}
+
+// Get returns the KV with the given key.
+func (c *Client) Get(k model.Key) (*model.KVPair, error) {
+	path, err := model.KeyToDefaultPath(k)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	resp, err := c.kv.Get(ctx, path)
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: k}
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: k}
+	}
+	value, err := model.ParseValue(k, resp.Kvs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	return &model.KVPair{
+		Key:      k,
+		Value:    value,
+		Revision: resp.Kvs[0].ModRevision,
+	}, nil
+}
+
+// List returns the KVs that match the given list options.
+func (c *Client) List(l model.ListInterface) ([]*model.KVPair, error) {
+	root := model.ListOptionsToDefaultPathRoot(l)
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	resp, err := c.kv.Get(ctx, root, clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: l}
+	}
+	kvs := []*model.KVPair{}
+	for _, etcdKV := range resp.Kvs {
+		// The prefix match may pick up keys that don't match the list options; for example,
+		// a prefix of /calico/v1/host/foo also matches /calico/v1/host/foobar.
+		key := l.KeyFromDefaultPath(string(etcdKV.Key))
+		if key == nil {
+			continue
+		}
+		value, err := model.ParseValue(key, etcdKV.Value)
+		if err != nil {
+			log.WithError(err).WithField("key", string(etcdKV.Key)).Warn(
+				"Failed to parse value, skipping")
+			continue
+		}
+		kvs = append(kvs, &model.KVPair{
+			Key:      key,
+			Value:    value,
+			Revision: etcdKV.ModRevision,
+		})
+	}
+	return kvs, nil
+}
+
+// Syncer returns a syncer that sends the whole of Calico's data to the given callbacks, and
+// then keeps them up to date.
+func (c *Client) Syncer(callbacks bapi.SyncerCallbacks) bapi.Syncer {
+	return newSyncer(c.kv, c.watcher, callbacks)
+}
+
+// putOptions returns the options to use when writing the given KV.  etcd v3 doesn't support
+// TTLs on keys directly so, if the KV has a TTL, we grant a lease with that TTL and attach the
+// key to it; etcd deletes the key when the lease expires.
+func (c *Client) putOptions(d *model.KVPair) ([]clientv3.OpOption, error) {
+	if d.TTL == 0 {
+		return nil, nil
+	}
+	ttlSecs := int64(d.TTL.Seconds())
+	if ttlSecs < 1 {
+		// etcd's minimum granularity.
+		ttlSecs = 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	resp, err := c.lease.Grant(ctx, ttlSecs)
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: d.Key}
+	}
+	return []clientv3.OpOption{clientv3.WithLease(resp.ID)}, nil
+}
+
+func pathAndValue(d *model.KVPair) (path, value string, err error) {
+	path, err = model.KeyToDefaultPath(d.Key)
+	if err != nil {
+		return
+	}
+	bytes, err := model.SerializeValue(d)
+	if err != nil {
+		return
+	}
+	value = string(bytes)
+	return
+}
+
+func withRevision(d *model.KVPair, revision int64) *model.KVPair {
+	updated := *d
+	updated.Revision = revision
+	return &updated
+}
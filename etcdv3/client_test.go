@@ -0,0 +1,117 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3_test
+
+import (
+	. "github.com/projectcalico/felix/etcdv3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	calierrors "github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+var _ = Describe("Client", func() {
+	var kv *mockKV
+	var lease *mockLease
+	var client *Client
+
+	BeforeEach(func() {
+		kv = newMockKV()
+		lease = &mockLease{}
+		client = NewClientWithShims(kv, &mockWatcher{}, lease)
+	})
+
+	It("should put a KV without a lease if it has no TTL", func() {
+		kvp, err := client.Apply(&model.KVPair{
+			Key:   model.GlobalConfigKey{Name: "LogSeverityScreen"},
+			Value: "Debug",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kvp.Revision).To(Equal(int64(1)))
+		Expect(kv.values).To(Equal(map[string]string{
+			"/calico/v1/config/LogSeverityScreen": "Debug",
+		}))
+		Expect(lease.grantedTTLs).To(BeEmpty())
+	})
+
+	It("should grant a lease for a KV with a TTL", func() {
+		_, err := client.Apply(&model.KVPair{
+			Key:   model.GlobalConfigKey{Name: "Foo"},
+			Value: "bar",
+			TTL:   90 * time.Second,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lease.grantedTTLs).To(Equal([]int64{90}))
+		Expect(kv.values).To(HaveKey("/calico/v1/config/Foo"))
+	})
+
+	It("should round a sub-second TTL up to etcd's minimum", func() {
+		_, err := client.Apply(&model.KVPair{
+			Key:   model.GlobalConfigKey{Name: "Foo"},
+			Value: "bar",
+			TTL:   100 * time.Millisecond,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lease.grantedTTLs).To(Equal([]int64{1}))
+	})
+
+	It("should not write the KV if the lease can't be granted", func() {
+		lease.err = errors.New("no leader")
+		_, err := client.Apply(&model.KVPair{
+			Key:   model.GlobalConfigKey{Name: "Foo"},
+			Value: "bar",
+			TTL:   90 * time.Second,
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(kv.values).To(BeEmpty())
+	})
+
+	It("should get a KV", func() {
+		kv.values["/calico/v1/config/Foo"] = "bar"
+		kvp, err := client.Get(model.GlobalConfigKey{Name: "Foo"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kvp.Key).To(Equal(model.GlobalConfigKey{Name: "Foo"}))
+		Expect(kvp.Value).To(Equal("bar"))
+	})
+
+	It("should return does-not-exist from Get for a missing key", func() {
+		_, err := client.Get(model.GlobalConfigKey{Name: "Foo"})
+		Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceDoesNotExist{}))
+	})
+
+	It("should list KVs, skipping values that fail to parse", func() {
+		kv.values["/calico/v1/config/Foo"] = "bar"
+		kv.values["/calico/v1/config/Baz"] = "bad"
+		kv.values["/calico/v1/Ready"] = "true"
+		kvps, err := client.List(model.GlobalConfigListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kvps).To(HaveLen(1))
+		Expect(kvps[0].Key).To(Equal(model.GlobalConfigKey{Name: "Foo"}))
+	})
+
+	It("should delete a KV", func() {
+		kv.values["/calico/v1/config/Foo"] = "bar"
+		err := client.Delete(&model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kv.values).To(BeEmpty())
+		err = client.Delete(&model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}})
+		Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceDoesNotExist{}))
+	})
+})
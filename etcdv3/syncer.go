@@ -0,0 +1,238 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+const (
+	// calicoPrefix is the prefix of all of Calico's keys.
+	calicoPrefix = "/calico/v1/"
+
+	resyncRetryInterval = 1 * time.Second
+
+	// Causes of resyncs, used as the label of the resync counter.
+	resyncCauseInitial       = "initial"
+	resyncCauseCompaction    = "compaction"
+	resyncCauseWatchError    = "watch-error"
+	resyncCauseSnapshotError = "snapshot-error"
+)
+
+var countResyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "felix_etcdv3_resyncs",
+	Help: "Number of times that the etcd v3 syncer loaded a new snapshot, by cause.",
+}, []string{"cause"})
+
+func init() {
+	prometheus.MustRegister(countResyncs)
+}
+
+// syncer loads a snapshot of Calico's keys and then watches for changes from the snapshot's
+// revision onwards.
+//
+// etcd only keeps a limited history so, if we fall behind (for example, because we lost our
+// connection to etcd for a while), the revision that we need to watch from may have been
+// compacted away.  Rather than getting stuck, we load a new snapshot and send the differences
+// from what we'd previously sent: updates for any changed keys and deletions for any keys that
+// are no longer present.  Then we resume watching from the new snapshot's revision.
+type syncer struct {
+	kv        clientv3.KV
+	watcher   clientv3.Watcher
+	callbacks bapi.SyncerCallbacks
+
+	// knownKeys contains the Calico key of each etcd key that we've sent to the callbacks,
+	// so that we can calculate deletions after a resync.
+	knownKeys map[string]model.Key
+	// inSync is set once we've completed our first snapshot.
+	inSync bool
+
+	// Shim for testing.
+	sleep func(time.Duration)
+}
+
+func newSyncer(kv clientv3.KV, watcher clientv3.Watcher, callbacks bapi.SyncerCallbacks) *syncer {
+	return &syncer{
+		kv:        kv,
+		watcher:   watcher,
+		callbacks: callbacks,
+		knownKeys: map[string]model.Key{},
+		sleep:     time.Sleep,
+	}
+}
+
+func (s *syncer) Start() {
+	go s.loop()
+}
+
+func (s *syncer) loop() {
+	s.callbacks.OnStatusUpdated(bapi.WaitForDatastore)
+	cause := resyncCauseInitial
+	for {
+		countResyncs.WithLabelValues(cause).Inc()
+		revision, err := s.resync()
+		if err != nil {
+			log.WithError(err).Warn("Failed to load snapshot from etcd, will retry")
+			cause = resyncCauseSnapshotError
+			s.sleep(resyncRetryInterval)
+			continue
+		}
+		cause = s.watch(revision)
+		log.WithField("cause", cause).Warn("etcd watch stopped, resyncing")
+	}
+}
+
+// resync loads a snapshot of all of Calico's keys and sends the differences from the
+// previously-sent state to the callbacks.  It returns the snapshot's revision.
+func (s *syncer) resync() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	resp, err := s.kv.Get(ctx, calicoPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	if !s.inSync {
+		s.callbacks.OnStatusUpdated(bapi.ResyncInProgress)
+	}
+
+	var updates []bapi.Update
+	seenKeys := map[string]bool{}
+	for _, etcdKV := range resp.Kvs {
+		path := string(etcdKV.Key)
+		seenKeys[path] = true
+		if update := s.parseUpdate(path, etcdKV.Value, etcdKV.ModRevision); update != nil {
+			updates = append(updates, *update)
+		}
+	}
+	for path := range s.knownKeys {
+		if !seenKeys[path] {
+			updates = append(updates, s.deletion(path))
+		}
+	}
+	log.WithFields(log.Fields{
+		"revision":   resp.Header.Revision,
+		"numUpdates": len(updates),
+	}).Info("Loaded snapshot from etcd")
+	if len(updates) > 0 {
+		s.callbacks.OnUpdates(updates)
+	}
+
+	if !s.inSync {
+		s.callbacks.OnStatusUpdated(bapi.InSync)
+		s.inSync = true
+	}
+	return resp.Header.Revision, nil
+}
+
+// watch watches for changes after the given revision, sending them to the callbacks, until
+// the watch fails.  It returns the cause of the failure.
+func (s *syncer) watch(revision int64) (cause string) {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+	defer cancel()
+	watchChan := s.watcher.Watch(ctx, calicoPrefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+	for resp := range watchChan {
+		if resp.CompactRevision != 0 {
+			log.WithFields(log.Fields{
+				"revision":        revision,
+				"compactRevision": resp.CompactRevision,
+			}).Warn("etcd compacted the revision that we were watching from")
+			return resyncCauseCompaction
+		}
+		if err := resp.Err(); err != nil {
+			if err == rpctypes.ErrCompacted {
+				return resyncCauseCompaction
+			}
+			log.WithError(err).Warn("etcd watch failed")
+			return resyncCauseWatchError
+		}
+
+		var updates []bapi.Update
+		for _, event := range resp.Events {
+			path := string(event.Kv.Key)
+			var update *bapi.Update
+			if event.Type == clientv3.EventTypeDelete {
+				if _, known := s.knownKeys[path]; known {
+					deletion := s.deletion(path)
+					update = &deletion
+				}
+			} else {
+				update = s.parseUpdate(path, event.Kv.Value, event.Kv.ModRevision)
+			}
+			if update != nil {
+				updates = append(updates, *update)
+			}
+			revision = event.Kv.ModRevision
+		}
+		if len(updates) > 0 {
+			s.callbacks.OnUpdates(updates)
+		}
+	}
+	log.Warn("etcd watch channel closed")
+	return resyncCauseWatchError
+}
+
+// parseUpdate converts an etcd KV into an update, recording the key as known.  It returns nil
+// if the key isn't one of Calico's.  A value that fails to parse is treated as a deletion
+// since it can't be used.
+func (s *syncer) parseUpdate(path string, rawValue []byte, revision int64) *bapi.Update {
+	key := model.KeyFromDefaultPath(path)
+	if key == nil {
+		log.WithField("key", path).Debug("Ignoring unknown etcd key")
+		return nil
+	}
+	value, err := model.ParseValue(key, rawValue)
+	if err != nil {
+		log.WithError(err).WithField("key", path).Warn("Failed to parse value from etcd")
+		if _, known := s.knownKeys[path]; !known {
+			return nil
+		}
+		deletion := s.deletion(path)
+		return &deletion
+	}
+	updateType := bapi.UpdateTypeKVNew
+	if _, known := s.knownKeys[path]; known {
+		updateType = bapi.UpdateTypeKVUpdated
+	}
+	s.knownKeys[path] = key
+	return &bapi.Update{
+		KVPair: model.KVPair{
+			Key:      key,
+			Value:    value,
+			Revision: revision,
+		},
+		UpdateType: updateType,
+	}
+}
+
+// deletion returns a deletion update for the given known key and forgets it.
+func (s *syncer) deletion(path string) bapi.Update {
+	key := s.knownKeys[path]
+	delete(s.knownKeys, path)
+	return bapi.Update{
+		KVPair: model.KVPair{
+			Key: key,
+		},
+		UpdateType: bapi.UpdateTypeKVDeleted,
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3_test
+
+import (
+	. "github.com/projectcalico/felix/etcdv3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+var _ = Describe("Syncer", func() {
+	var kv *mockKV
+	var watcher *mockWatcher
+	var callbacks *mockCallbacks
+
+	BeforeEach(func() {
+		kv = newMockKV()
+		kv.values["/calico/v1/Ready"] = "true"
+		kv.values["/calico/v1/config/Foo"] = "bar"
+		kv.values["/calico/v1/config/Baz"] = "qux"
+		kv.revision = 10
+		watcher = &mockWatcher{watchChans: make(chan chan clientv3.WatchResponse, 10)}
+		callbacks = &mockCallbacks{}
+		NewClientWithShims(kv, watcher, &mockLease{}).Syncer(callbacks).Start()
+	})
+
+	nextWatch := func() chan clientv3.WatchResponse {
+		var c chan clientv3.WatchResponse
+		Eventually(watcher.watchChans).Should(Receive(&c))
+		return c
+	}
+
+	It("should send the snapshot and then the watched changes", func() {
+		c := nextWatch()
+		Expect(callbacks.getStatuses()).To(Equal([]bapi.SyncStatus{
+			bapi.WaitForDatastore,
+			bapi.ResyncInProgress,
+			bapi.InSync,
+		}))
+		Expect(callbacks.getUpdates()).To(ConsistOf(
+			newUpdate(model.ReadyFlagKey{}, true, bapi.UpdateTypeKVNew),
+			newUpdate(model.GlobalConfigKey{Name: "Foo"}, "bar", bapi.UpdateTypeKVNew),
+			newUpdate(model.GlobalConfigKey{Name: "Baz"}, "qux", bapi.UpdateTypeKVNew),
+		))
+
+		callbacks.clearUpdates()
+		c <- clientv3.WatchResponse{Events: []*clientv3.Event{
+			putEvent("/calico/v1/config/Foo", "bar2", 11),
+			putEvent("/calico/v1/config/New", "value", 12),
+			deleteEvent("/calico/v1/config/Baz", 13),
+			putEvent("/calico/v2/unknown", "value", 14),
+		}}
+		Eventually(callbacks.getUpdates).Should(Equal([]bapi.Update{
+			newUpdate(model.GlobalConfigKey{Name: "Foo"}, "bar2", bapi.UpdateTypeKVUpdated),
+			newUpdate(model.GlobalConfigKey{Name: "New"}, "value", bapi.UpdateTypeKVNew),
+			newUpdate(model.GlobalConfigKey{Name: "Baz"}, nil, bapi.UpdateTypeKVDeleted),
+		}))
+	})
+
+	It("should resync from a new snapshot if the watch revision is compacted", func() {
+		c := nextWatch()
+		callbacks.clearUpdates()
+
+		// While we're out of touch, Foo gets updated, Baz gets deleted and New gets
+		// created.
+		kv.lock.Lock()
+		kv.values["/calico/v1/config/Foo"] = "bar2"
+		delete(kv.values, "/calico/v1/config/Baz")
+		kv.values["/calico/v1/config/New"] = "value"
+		kv.revision = 20
+		kv.lock.Unlock()
+		c <- clientv3.WatchResponse{CompactRevision: 15}
+
+		c = nextWatch()
+		Expect(callbacks.getUpdates()).To(ConsistOf(
+			newUpdate(model.ReadyFlagKey{}, true, bapi.UpdateTypeKVUpdated),
+			newUpdate(model.GlobalConfigKey{Name: "Foo"}, "bar2", bapi.UpdateTypeKVUpdated),
+			newUpdate(model.GlobalConfigKey{Name: "New"}, "value", bapi.UpdateTypeKVNew),
+			newUpdate(model.GlobalConfigKey{Name: "Baz"}, nil, bapi.UpdateTypeKVDeleted),
+		))
+		// We stay in sync throughout.
+		Expect(callbacks.getStatuses()).To(HaveLen(3))
+
+		// And carry on watching from the new snapshot.
+		callbacks.clearUpdates()
+		c <- clientv3.WatchResponse{Events: []*clientv3.Event{
+			deleteEvent("/calico/v1/config/New", 21),
+		}}
+		Eventually(callbacks.getUpdates).Should(Equal([]bapi.Update{
+			newUpdate(model.GlobalConfigKey{Name: "New"}, nil, bapi.UpdateTypeKVDeleted),
+		}))
+	})
+
+	It("should resync if the watch channel is closed", func() {
+		c := nextWatch()
+		callbacks.clearUpdates()
+		close(c)
+		nextWatch()
+		// Nothing changed so the resync only sends updates for the existing keys.
+		Expect(callbacks.getUpdates()).To(ConsistOf(
+			newUpdate(model.ReadyFlagKey{}, true, bapi.UpdateTypeKVUpdated),
+			newUpdate(model.GlobalConfigKey{Name: "Foo"}, "bar", bapi.UpdateTypeKVUpdated),
+			newUpdate(model.GlobalConfigKey{Name: "Baz"}, "qux", bapi.UpdateTypeKVUpdated),
+		))
+	})
+})
+
+func newUpdate(key model.Key, value interface{}, updateType bapi.UpdateType) bapi.Update {
+	return bapi.Update{
+		KVPair:     model.KVPair{Key: key, Value: value},
+		UpdateType: updateType,
+	}
+}
+
+func putEvent(key, value string, revision int64) *clientv3.Event {
+	return &clientv3.Event{
+		Type: clientv3.EventTypePut,
+		Kv:   &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value), ModRevision: revision},
+	}
+}
+
+func deleteEvent(key string, revision int64) *clientv3.Event {
+	return &clientv3.Event{
+		Type: clientv3.EventTypeDelete,
+		Kv:   &mvccpb.KeyValue{Key: []byte(key), ModRevision: revision},
+	}
+}
+
+// mockKV is a minimal in-memory implementation of the parts of clientv3.KV that we use, other
+// than transactions.
+type mockKV struct {
+	clientv3.KV
+
+	lock     sync.Mutex
+	values   map[string]string
+	revision int64
+}
+
+func newMockKV() *mockKV {
+	return &mockKV{values: map[string]string{}}
+}
+
+func (kv *mockKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.revision++
+	kv.values[key] = val
+	return &clientv3.PutResponse{Header: &pb.ResponseHeader{Revision: kv.revision}}, nil
+}
+
+// Get returns the given key or, if opts are passed, we assume WithPrefix() and return all keys
+// with the given prefix.
+func (kv *mockKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	resp := &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: kv.revision}}
+	for k, v := range kv.values {
+		if k == key || (len(opts) > 0 && len(k) > len(key) && k[:len(key)] == key) {
+			// We don't track per-key revisions, use the current revision.
+			resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{
+				Key:         []byte(k),
+				Value:       []byte(v),
+				ModRevision: kv.revision,
+			})
+		}
+	}
+	return resp, nil
+}
+
+func (kv *mockKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	resp := &clientv3.DeleteResponse{Header: &pb.ResponseHeader{Revision: kv.revision}}
+	if _, ok := kv.values[key]; ok {
+		kv.revision++
+		delete(kv.values, key)
+		resp.Deleted = 1
+	}
+	return resp, nil
+}
+
+type mockLease struct {
+	clientv3.Lease
+
+	grantedTTLs []int64
+	err         error
+}
+
+func (l *mockLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	l.grantedTTLs = append(l.grantedTTLs, ttl)
+	return &clientv3.LeaseGrantResponse{ID: clientv3.LeaseID(len(l.grantedTTLs)), TTL: ttl}, nil
+}
+
+// mockWatcher sends the channel for each call to Watch() on watchChans, so that the test can
+// send events.
+type mockWatcher struct {
+	clientv3.Watcher
+
+	watchChans chan chan clientv3.WatchResponse
+}
+
+func (w *mockWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	c := make(chan clientv3.WatchResponse)
+	w.watchChans <- c
+	return c
+}
+
+type mockCallbacks struct {
+	lock     sync.Mutex
+	statuses []bapi.SyncStatus
+	updates  []bapi.Update
+}
+
+func (c *mockCallbacks) OnStatusUpdated(status bapi.SyncStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.statuses = append(c.statuses, status)
+}
+
+func (c *mockCallbacks) OnUpdates(updates []bapi.Update) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, u := range updates {
+		// Revisions depend on the mock's implementation, ignore them.
+		u.Revision = nil
+		c.updates = append(c.updates, u)
+	}
+}
+
+func (c *mockCallbacks) getStatuses() []bapi.SyncStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.statuses
+}
+
+func (c *mockCallbacks) getUpdates() []bapi.Update {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.updates
+}
+
+func (c *mockCallbacks) clearUpdates() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updates = nil
+}
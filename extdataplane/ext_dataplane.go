@@ -12,8 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// extdataplane implements the connection to an external dataplane driver, connected via
-// a pair of pipes.
+// extdataplane implements the connection to an external dataplane driver, connected either
+// via a pair of pipes or over gRPC.
 package extdataplane
 
 import (
@@ -73,6 +73,11 @@ func StartExtDataplaneDriver(driverFilename string) (*extDataplaneConn, *exec.Cm
 	dataplaneConnection := &extDataplaneConn{
 		toDataplane:   toDriverW,
 		fromDataplane: fromDriverR,
+		hello:         newHelloWaiter(helloTimeout),
+	}
+	if err := dataplaneConnection.SendMessage(newHello()); err != nil {
+		cmd.Process.Kill()
+		log.WithError(err).Fatal("Failed to send Hello to dataplane driver")
 	}
 	return dataplaneConnection, cmd
 }
@@ -81,9 +86,25 @@ type extDataplaneConn struct {
 	fromDataplane io.Reader
 	toDataplane   io.Writer
 	nextSeqNumber uint64
+
+	// hello collects the driver's reply to our Hello, if it sends one.
+	hello *helloWaiter
 }
 
+// RecvMessage reads the next message from the driver.  The driver's Hello is handled here
+// rather than being returned.
 func (c *extDataplaneConn) RecvMessage() (msg interface{}, err error) {
+	for {
+		msg, err = c.recvOne()
+		if hello, ok := msg.(*proto.Hello); ok && err == nil {
+			c.hello.OnDriverHello(hello)
+			continue
+		}
+		return
+	}
+}
+
+func (c *extDataplaneConn) recvOne() (msg interface{}, err error) {
 	buf := make([]byte, 8)
 	_, err = io.ReadFull(c.fromDataplane, buf)
 	if err != nil {
@@ -104,70 +125,20 @@ func (c *extDataplaneConn) RecvMessage() (msg interface{}, err error) {
 	}
 	log.WithField("envelope", envelope).Debug("Received message from dataplane.")
 
-	switch payload := envelope.Payload.(type) {
-	case *proto.FromDataplane_ProcessStatusUpdate:
-		msg = payload.ProcessStatusUpdate
-	case *proto.FromDataplane_WorkloadEndpointStatusUpdate:
-		msg = payload.WorkloadEndpointStatusUpdate
-	case *proto.FromDataplane_WorkloadEndpointStatusRemove:
-		msg = payload.WorkloadEndpointStatusRemove
-	case *proto.FromDataplane_HostEndpointStatusUpdate:
-		msg = payload.HostEndpointStatusUpdate
-	case *proto.FromDataplane_HostEndpointStatusRemove:
-		msg = payload.HostEndpointStatusRemove
-	default:
-		log.WithField("payload", payload).Warn("Ignoring unknown message from dataplane")
-	}
-
+	msg = unwrapFromDataplane(&envelope)
 	return
 }
 
 func (fc *extDataplaneConn) SendMessage(msg interface{}) error {
+	if !fc.hello.ShouldSend(msg) {
+		return nil
+	}
 	log.Debugf("Writing msg (%v) to felix: %#v", fc.nextSeqNumber, msg)
 	// Wrap the payload message in an envelope so that protobuf takes care of deserialising
 	// it as the correct type.
-	envelope := &proto.ToDataplane{
-		SequenceNumber: fc.nextSeqNumber,
-	}
+	envelope := proto.WrapToDataplane(msg)
+	envelope.SequenceNumber = fc.nextSeqNumber
 	fc.nextSeqNumber += 1
-	switch msg := msg.(type) {
-	case *proto.ConfigUpdate:
-		envelope.Payload = &proto.ToDataplane_ConfigUpdate{msg}
-	case *proto.InSync:
-		envelope.Payload = &proto.ToDataplane_InSync{msg}
-	case *proto.IPSetUpdate:
-		envelope.Payload = &proto.ToDataplane_IpsetUpdate{msg}
-	case *proto.IPSetDeltaUpdate:
-		envelope.Payload = &proto.ToDataplane_IpsetDeltaUpdate{msg}
-	case *proto.IPSetRemove:
-		envelope.Payload = &proto.ToDataplane_IpsetRemove{msg}
-	case *proto.ActivePolicyUpdate:
-		envelope.Payload = &proto.ToDataplane_ActivePolicyUpdate{msg}
-	case *proto.ActivePolicyRemove:
-		envelope.Payload = &proto.ToDataplane_ActivePolicyRemove{msg}
-	case *proto.ActiveProfileUpdate:
-		envelope.Payload = &proto.ToDataplane_ActiveProfileUpdate{msg}
-	case *proto.ActiveProfileRemove:
-		envelope.Payload = &proto.ToDataplane_ActiveProfileRemove{msg}
-	case *proto.HostEndpointUpdate:
-		envelope.Payload = &proto.ToDataplane_HostEndpointUpdate{msg}
-	case *proto.HostEndpointRemove:
-		envelope.Payload = &proto.ToDataplane_HostEndpointRemove{msg}
-	case *proto.WorkloadEndpointUpdate:
-		envelope.Payload = &proto.ToDataplane_WorkloadEndpointUpdate{msg}
-	case *proto.WorkloadEndpointRemove:
-		envelope.Payload = &proto.ToDataplane_WorkloadEndpointRemove{msg}
-	case *proto.HostMetadataUpdate:
-		envelope.Payload = &proto.ToDataplane_HostMetadataUpdate{msg}
-	case *proto.HostMetadataRemove:
-		envelope.Payload = &proto.ToDataplane_HostMetadataRemove{msg}
-	case *proto.IPAMPoolUpdate:
-		envelope.Payload = &proto.ToDataplane_IpamPoolUpdate{msg}
-	case *proto.IPAMPoolRemove:
-		envelope.Payload = &proto.ToDataplane_IpamPoolRemove{msg}
-	default:
-		log.WithField("msg", msg).Panic("Unknown message type")
-	}
 	data, err := pb.Marshal(envelope)
 
 	if err != nil {
@@ -194,3 +165,38 @@ func (fc *extDataplaneConn) SendMessage(msg interface{}) error {
 	}
 	return nil
 }
+
+// unwrapFromDataplane extracts the payload message from the given FromDataplane envelope.
+// It returns nil if the payload is of an unknown type.
+func unwrapFromDataplane(envelope *proto.FromDataplane) (msg interface{}) {
+	switch payload := envelope.Payload.(type) {
+	case *proto.FromDataplane_ProcessStatusUpdate:
+		msg = payload.ProcessStatusUpdate
+	case *proto.FromDataplane_WorkloadEndpointStatusUpdate:
+		msg = payload.WorkloadEndpointStatusUpdate
+	case *proto.FromDataplane_WorkloadEndpointStatusRemove:
+		msg = payload.WorkloadEndpointStatusRemove
+	case *proto.FromDataplane_HostEndpointStatusUpdate:
+		msg = payload.HostEndpointStatusUpdate
+	case *proto.FromDataplane_HostEndpointStatusRemove:
+		msg = payload.HostEndpointStatusRemove
+	case *proto.FromDataplane_Ack:
+		msg = payload.Ack
+	case *proto.FromDataplane_ResyncRequest:
+		msg = payload.ResyncRequest
+	case *proto.FromDataplane_Hello:
+		msg = payload.Hello
+	case *proto.FromDataplane_PolicyStatusUpdate:
+		msg = payload.PolicyStatusUpdate
+	case *proto.FromDataplane_PolicyStatusRemove:
+		msg = payload.PolicyStatusRemove
+	case *proto.FromDataplane_ProfileStatusUpdate:
+		msg = payload.ProfileStatusUpdate
+	case *proto.FromDataplane_ProfileStatusRemove:
+		msg = payload.ProfileStatusRemove
+	default:
+		log.WithField("payload", payload).Warn("Ignoring unknown message from dataplane")
+	}
+
+	return
+}
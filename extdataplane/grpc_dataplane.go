@@ -0,0 +1,399 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extdataplane
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var (
+	countGRPCConnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ext_dataplane_connects",
+		Help: "Number of times that we've (re)connected to the external dataplane driver.",
+	})
+	countGRPCResyncs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ext_dataplane_resyncs",
+		Help: "Number of complete snapshots sent to the external dataplane driver.",
+	})
+	gaugeGRPCUnackedMsgs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_ext_dataplane_unacked_msgs",
+		Help: "Number of messages sent to the external dataplane driver that it has yet to acknowledge.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		countGRPCConnects,
+		countGRPCResyncs,
+		gaugeGRPCUnackedMsgs,
+	)
+}
+
+const (
+	grpcDialTimeout       = 10 * time.Second
+	grpcReconnectInterval = 1 * time.Second
+	grpcSendTimeout       = 10 * time.Second
+
+	// grpcMaxQueuedMsgs is the number of messages that we queue for a slow driver before
+	// we give up on the queue and send it a fresh snapshot instead.
+	grpcMaxQueuedMsgs = 1000
+)
+
+var (
+	errNoHello     = errors.New("dataplane driver didn't reply to our Hello")
+	errSendTimeout = errors.New("timed out sending to dataplane driver")
+)
+
+// toDataplaneStream is the subset of the generated gRPC stream client that we use.
+type toDataplaneStream interface {
+	Send(*proto.ToDataplane) error
+	Recv() (*proto.FromDataplane, error)
+}
+
+// grpcDataplaneConn is a connection to an external dataplane driver that listens for gRPC
+// connections.  Unlike the pipe-based driver, the driver may come and go: if the stream
+// fails, we reconnect in the background and replay our current desired state, which we keep
+// in a desiredStateCache.  While we're disconnected, SendMessage() only updates the cache.
+//
+// Sends to the driver may block, so they're never done with the lock held.  Instead,
+// SendMessage() queues the message and a per-connection goroutine sends it.  If the queue
+// fills up, or the driver asks for a resync, the queue is replaced by a snapshot of the
+// desired state, which the sending goroutine takes when it next wakes up.
+type grpcDataplaneConn struct {
+	address string
+
+	lock          sync.Mutex
+	state         *desiredStateCache
+	connected     bool
+	features      *driverFeatures
+	queuedMsgs    []interface{}
+	resyncPending bool
+	nextSeqNumber uint64
+	lastAcked     uint64
+
+	// sendWakeC wakes the sending goroutine after we queue a message or request a resync.
+	sendWakeC      chan struct{}
+	fromDataplaneC chan interface{}
+
+	// Shims for testing.
+	connect       func() (stream toDataplaneStream, closer func(), err error)
+	sleep         func(time.Duration)
+	after         func(time.Duration) <-chan time.Time
+	maxQueuedMsgs int
+}
+
+// StartGRPCDataplaneDriver returns a connection to the external dataplane driver listening
+// on the given address.  The connection is established (and re-established) in the
+// background.
+func StartGRPCDataplaneDriver(address string) *grpcDataplaneConn {
+	c := newGRPCDataplaneConn(address)
+	c.connect = c.dial
+	go c.loopMaintainingConnection()
+	return c
+}
+
+func newGRPCDataplaneConn(address string) *grpcDataplaneConn {
+	return &grpcDataplaneConn{
+		address:        address,
+		state:          newDesiredStateCache(),
+		nextSeqNumber:  1,
+		sendWakeC:      make(chan struct{}, 1),
+		fromDataplaneC: make(chan interface{}),
+		sleep:          time.Sleep,
+		after:          time.After,
+		maxQueuedMsgs:  grpcMaxQueuedMsgs,
+	}
+}
+
+func (c *grpcDataplaneConn) dial() (toDataplaneStream, func(), error) {
+	opts := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithTimeout(grpcDialTimeout),
+	}
+	target := c.address
+	if strings.HasPrefix(target, "unix:") {
+		target = strings.TrimPrefix(strings.TrimPrefix(target, "unix:"), "//")
+		opts = append(opts, grpc.WithDialer(func(path string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", path, timeout)
+		}))
+	}
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream, err := proto.NewDataplaneDriverClient(conn).Connect(context.Background())
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return stream, func() { conn.Close() }, nil
+}
+
+func (c *grpcDataplaneConn) loopMaintainingConnection() {
+	logCxt := log.WithField("address", c.address)
+	for {
+		logCxt.Info("Connecting to dataplane driver")
+		stream, closer, err := c.connect()
+		if err != nil {
+			logCxt.WithError(err).Warn("Failed to connect to dataplane driver, will retry")
+			c.sleep(grpcReconnectInterval)
+			continue
+		}
+		countGRPCConnects.Inc()
+		// Closing the connection aborts any send or receive that's in progress on the
+		// stream.  Both our goroutines may need to do that so make sure it only happens
+		// once.
+		var closeOnce sync.Once
+		closeConn := func() { closeOnce.Do(closer) }
+
+		features, err := c.handshake(stream)
+		if err == nil {
+			logCxt.Info("Connected to dataplane driver, sending snapshot")
+			c.lock.Lock()
+			c.connected = true
+			c.features = features
+			c.lock.Unlock()
+			c.requestResync()
+
+			stopSendingC := make(chan struct{})
+			sendingDoneC := make(chan struct{})
+			go func() {
+				defer close(sendingDoneC)
+				if err := c.loopSendingToStream(stream, stopSendingC); err != nil {
+					logCxt.WithError(err).Warn("Failed to send to dataplane driver, closing connection")
+					closeConn()
+				}
+			}()
+			err = c.loopReadingFromStream(stream)
+			// The stream is broken; closing the connection aborts any send that the
+			// sending goroutine is blocked in rather than waiting for it to time out.
+			close(stopSendingC)
+			closeConn()
+			<-sendingDoneC
+		}
+		logCxt.WithError(err).Warn("Lost connection to dataplane driver, will reconnect")
+
+		c.lock.Lock()
+		c.connected = false
+		c.features = nil
+		c.queuedMsgs = nil
+		c.resyncPending = false
+		c.lock.Unlock()
+		closeConn()
+		c.sleep(grpcReconnectInterval)
+	}
+}
+
+// handshake exchanges Hellos with the driver.  Unlike pipe-connected drivers, all gRPC drivers
+// support the handshake so we insist on a reply.
+func (c *grpcDataplaneConn) handshake(stream toDataplaneStream) (*driverFeatures, error) {
+	c.lock.Lock()
+	envelope := c.nextEnvelope(newHello())
+	c.lock.Unlock()
+	if err := c.sendWithDeadline(stream, envelope); err != nil {
+		return nil, err
+	}
+	reply, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	hello, ok := unwrapFromDataplane(reply).(*proto.Hello)
+	if !ok {
+		return nil, errNoHello
+	}
+	return newDriverFeatures(hello), nil
+}
+
+func (c *grpcDataplaneConn) loopReadingFromStream(stream toDataplaneStream) error {
+	for {
+		envelope, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch msg := unwrapFromDataplane(envelope).(type) {
+		case nil:
+			// Already logged by unwrapFromDataplane.
+		case *proto.Ack:
+			c.onAck(msg.SequenceNumber)
+		case *proto.ResyncRequest:
+			log.Info("Dataplane driver requested a resync")
+			c.requestResync()
+		default:
+			c.fromDataplaneC <- msg
+		}
+	}
+}
+
+func (c *grpcDataplaneConn) onAck(seqNo uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if seqNo <= c.lastAcked {
+		return
+	}
+	if seqNo >= c.nextSeqNumber {
+		log.WithFields(log.Fields{
+			"ack":      seqNo,
+			"lastSent": c.nextSeqNumber - 1,
+		}).Warn("Dataplane driver acknowledged a message that we haven't sent, ignoring")
+		return
+	}
+	c.lastAcked = seqNo
+	c.updateUnackedGauge()
+}
+
+func (c *grpcDataplaneConn) updateUnackedGauge() {
+	gaugeGRPCUnackedMsgs.Set(float64(c.nextSeqNumber - 1 - c.lastAcked))
+}
+
+// requestResync discards any queued messages and arranges for the sending goroutine to send
+// a snapshot of the complete desired state instead.
+func (c *grpcDataplaneConn) requestResync() {
+	c.lock.Lock()
+	c.queuedMsgs = nil
+	c.resyncPending = true
+	c.lock.Unlock()
+	c.wakeSender()
+}
+
+func (c *grpcDataplaneConn) wakeSender() {
+	select {
+	case c.sendWakeC <- struct{}{}:
+	default:
+		// Already a wake-up pending.
+	}
+}
+
+// loopSendingToStream sends queued messages, or a snapshot if a resync is pending, to the
+// driver until stopC is closed or a send fails.
+func (c *grpcDataplaneConn) loopSendingToStream(stream toDataplaneStream, stopC <-chan struct{}) error {
+	for {
+		select {
+		case <-c.sendWakeC:
+		case <-stopC:
+			return nil
+		}
+		for {
+			envelopes := c.takeQueuedEnvelopes()
+			if len(envelopes) == 0 {
+				break
+			}
+			for _, envelope := range envelopes {
+				if err := c.sendWithDeadline(stream, envelope); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// takeQueuedEnvelopes empties the queue, or takes the snapshot if a resync is pending, and
+// wraps the messages in envelopes, skipping any that the driver doesn't support.
+func (c *grpcDataplaneConn) takeQueuedEnvelopes() []*proto.ToDataplane {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	msgs := c.queuedMsgs
+	if c.resyncPending {
+		msgs = c.state.Snapshot()
+		log.WithField("numMsgs", len(msgs)).Info("Sending snapshot to dataplane driver")
+		countGRPCResyncs.Inc()
+		c.resyncPending = false
+	}
+	c.queuedMsgs = nil
+
+	var envelopes []*proto.ToDataplane
+	for _, msg := range msgs {
+		if !c.features.ShouldSend(msg) {
+			continue
+		}
+		envelopes = append(envelopes, c.nextEnvelope(msg))
+	}
+	return envelopes
+}
+
+// sendWithDeadline sends the envelope on the stream, giving up if the driver doesn't accept
+// it within grpcSendTimeout.  A send that times out is aborted when our caller closes the
+// connection.
+func (c *grpcDataplaneConn) sendWithDeadline(stream toDataplaneStream, envelope *proto.ToDataplane) error {
+	errC := make(chan error, 1)
+	go func() {
+		errC <- stream.Send(envelope)
+	}()
+	select {
+	case err := <-errC:
+		return err
+	case <-c.after(grpcSendTimeout):
+		return errSendTimeout
+	}
+}
+
+// nextEnvelope wraps the message in an envelope with the next sequence number.  Must be
+// called with the lock held.
+func (c *grpcDataplaneConn) nextEnvelope(msg interface{}) *proto.ToDataplane {
+	envelope := proto.WrapToDataplane(msg)
+	envelope.SequenceNumber = c.nextSeqNumber
+	c.nextSeqNumber++
+	c.updateUnackedGauge()
+	return envelope
+}
+
+// SendMessage records the message in our cache of the desired state and, if we're connected,
+// queues it to be sent to the driver.  It never blocks on the driver.  Failure to send isn't
+// reported to the caller: we close the connection and resend our state once we reconnect.
+func (c *grpcDataplaneConn) SendMessage(msg interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.state.OnUpdate(msg)
+	if !c.connected {
+		log.WithField("msg", msg).Debug("Not connected to dataplane driver, queued for resync")
+		return nil
+	}
+	if c.resyncPending {
+		// The snapshot that we're about to send will include this update.
+		return nil
+	}
+	if !c.features.ShouldSend(msg) {
+		return nil
+	}
+	if len(c.queuedMsgs) >= c.maxQueuedMsgs {
+		log.WithField("maxQueuedMsgs", c.maxQueuedMsgs).Warn(
+			"Dataplane driver isn't keeping up, discarding queued messages and resyncing")
+		c.queuedMsgs = nil
+		c.resyncPending = true
+	} else {
+		c.queuedMsgs = append(c.queuedMsgs, msg)
+	}
+	c.wakeSender()
+	return nil
+}
+
+// RecvMessage blocks until the driver sends a status message.
+func (c *grpcDataplaneConn) RecvMessage() (msg interface{}, err error) {
+	msg = <-c.fromDataplaneC
+	return
+}
@@ -0,0 +1,414 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extdataplane
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("desiredStateCache", func() {
+	var cache *desiredStateCache
+
+	BeforeEach(func() {
+		cache = newDesiredStateCache()
+	})
+
+	It("should return an empty snapshot before the config is known", func() {
+		cache.OnUpdate(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}})
+		Expect(cache.Snapshot()).To(BeNil())
+	})
+
+	It("should replay the current state", func() {
+		config := &proto.ConfigUpdate{Config: map[string]string{"foo": "bar"}}
+		cache.OnUpdate(config)
+		cache.OnUpdate(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1", "10.0.0.2"}})
+		cache.OnUpdate(&proto.IPSetDeltaUpdate{
+			Id:             "s1",
+			AddedMembers:   []string{"10.0.0.3"},
+			RemovedMembers: []string{"10.0.0.1"},
+		})
+		cache.OnUpdate(&proto.IPSetUpdate{Id: "s2"})
+		cache.OnUpdate(&proto.IPSetRemove{Id: "s2"})
+		polUpd := &proto.ActivePolicyUpdate{
+			Id:     &proto.PolicyID{Tier: "default", Name: "pol1"},
+			Policy: &proto.Policy{},
+		}
+		cache.OnUpdate(polUpd)
+		wepUpd := &proto.WorkloadEndpointUpdate{
+			Id:       &proto.WorkloadEndpointID{WorkloadId: "wl1", EndpointId: "ep1"},
+			Endpoint: &proto.WorkloadEndpoint{Name: "cali1234"},
+		}
+		cache.OnUpdate(wepUpd)
+		cache.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id: &proto.WorkloadEndpointID{WorkloadId: "wl2", EndpointId: "ep1"},
+		})
+		cache.OnUpdate(&proto.WorkloadEndpointRemove{
+			Id: &proto.WorkloadEndpointID{WorkloadId: "wl2", EndpointId: "ep1"},
+		})
+		cache.OnUpdate(&proto.InSync{})
+
+		snapshot := cache.Snapshot()
+		Expect(snapshot).To(HaveLen(5))
+		Expect(snapshot[0]).To(Equal(config))
+		Expect(snapshot[1].(*proto.IPSetUpdate).Id).To(Equal("s1"))
+		Expect(snapshot[1].(*proto.IPSetUpdate).Members).To(ConsistOf("10.0.0.2", "10.0.0.3"))
+		Expect(snapshot[2:]).To(Equal([]interface{}{
+			polUpd,
+			wepUpd,
+			&proto.InSync{},
+		}))
+	})
+})
+
+// mockStream is a toDataplaneStream.  It is written by the connection's goroutines and read
+// by the test so its fields are protected by the lock.
+type mockStream struct {
+	lock          sync.Mutex
+	sent          []*proto.ToDataplane
+	unblockSendsC chan struct{}
+	blockedSends  int
+	recvC         chan *proto.FromDataplane
+	closedC       chan struct{}
+	closeOnce     sync.Once
+}
+
+func newMockStream() *mockStream {
+	return &mockStream{
+		recvC:   make(chan *proto.FromDataplane),
+		closedC: make(chan struct{}),
+	}
+}
+
+// blockSends makes Send block until the returned function is called or the connection is
+// closed.
+func (s *mockStream) blockSends() (unblock func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.unblockSendsC = make(chan struct{})
+	unblockC := s.unblockSendsC
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.unblockSendsC = nil
+		close(unblockC)
+	}
+}
+
+func (s *mockStream) numBlockedSends() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.blockedSends
+}
+
+func (s *mockStream) Send(envelope *proto.ToDataplane) error {
+	s.lock.Lock()
+	unblockC := s.unblockSendsC
+	if unblockC != nil {
+		s.blockedSends++
+	}
+	s.lock.Unlock()
+	if unblockC != nil {
+		select {
+		case <-unblockC:
+		case <-s.closedC:
+			return errors.New("connection closed")
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sent = append(s.sent, envelope)
+	return nil
+}
+
+func (s *mockStream) Recv() (*proto.FromDataplane, error) {
+	select {
+	case envelope, ok := <-s.recvC:
+		if ok {
+			return envelope, nil
+		}
+	case <-s.closedC:
+	}
+	return nil, errors.New("stream closed")
+}
+
+// close simulates closing the underlying connection, which aborts any Send or Recv.
+func (s *mockStream) close() {
+	s.closeOnce.Do(func() {
+		close(s.closedC)
+	})
+}
+
+func (s *mockStream) isClosed() bool {
+	select {
+	case <-s.closedC:
+		return true
+	default:
+		return false
+	}
+}
+
+var _ = Describe("grpcDataplaneConn", func() {
+	var conn *grpcDataplaneConn
+	var streams chan *mockStream
+	var sendTimeoutC chan time.Time
+	var ourHello *proto.ToDataplane_Hello
+
+	BeforeEach(func() {
+		ourHello = &proto.ToDataplane_Hello{newHello()}
+		conn = newGRPCDataplaneConn("unix:/tmp/driver.sock")
+		// The connection's goroutines outlive the test so they mustn't refer to the
+		// variables that the next test overwrites.
+		streamsC := make(chan *mockStream)
+		streams = streamsC
+		conn.connect = func() (toDataplaneStream, func(), error) {
+			s := <-streamsC
+			return s, s.close, nil
+		}
+		conn.sleep = func(time.Duration) {}
+		timeoutC := make(chan time.Time)
+		sendTimeoutC = timeoutC
+		conn.after = func(time.Duration) <-chan time.Time {
+			return timeoutC
+		}
+		conn.maxQueuedMsgs = 2
+		go conn.loopMaintainingConnection()
+	})
+
+	// sentPayloads returns the payloads sent on the stream so far.
+	sentPayloads := func(s *mockStream) func() []interface{} {
+		return func() []interface{} {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			var payloads []interface{}
+			for _, e := range s.sent {
+				payloads = append(payloads, e.Payload)
+			}
+			return payloads
+		}
+	}
+
+	config := &proto.ConfigUpdate{Config: map[string]string{"foo": "bar"}}
+	ipSet := &proto.IPSetUpdate{Id: "s1"}
+	hostMeta := &proto.HostMetadataUpdate{Hostname: "host1", Ipv4Addr: "10.0.0.1"}
+	driverHello := &proto.FromDataplane{
+		Payload: &proto.FromDataplane_Hello{&proto.Hello{
+			ProtocolVersion: 1,
+			Features:        []string{featureTest},
+		}},
+	}
+
+	It("should cache messages while disconnected and send a snapshot on connection", func() {
+		Expect(conn.SendMessage(config)).To(Succeed())
+		Expect(conn.SendMessage(ipSet)).To(Succeed())
+		s := newMockStream()
+		streams <- s
+		s.recvC <- driverHello
+		Eventually(sentPayloads(s)).Should(Equal([]interface{}{
+			ourHello,
+			&proto.ToDataplane_ConfigUpdate{config},
+			&proto.ToDataplane_IpsetUpdate{ipSet},
+		}))
+	})
+
+	It("should reconnect if the driver doesn't reply with a Hello", func() {
+		s := newMockStream()
+		streams <- s
+		s.recvC <- &proto.FromDataplane{
+			Payload: &proto.FromDataplane_ProcessStatusUpdate{&proto.ProcessStatusUpdate{}},
+		}
+		s2 := newMockStream()
+		streams <- s2
+		Expect(s.isClosed()).To(BeTrue())
+	})
+
+	It("should not send messages for features that the driver doesn't support", func() {
+		Expect(conn.SendMessage(config)).To(Succeed())
+		Expect(conn.SendMessage(hostMeta)).To(Succeed())
+		s := newMockStream()
+		streams <- s
+		s.recvC <- &proto.FromDataplane{
+			Payload: &proto.FromDataplane_Hello{&proto.Hello{ProtocolVersion: 0}},
+		}
+		Eventually(sentPayloads(s)).Should(Equal([]interface{}{
+			ourHello,
+			&proto.ToDataplane_ConfigUpdate{config},
+		}))
+		Expect(conn.SendMessage(hostMeta)).To(Succeed())
+		Expect(conn.SendMessage(ipSet)).To(Succeed())
+		Eventually(sentPayloads(s)).Should(Equal([]interface{}{
+			ourHello,
+			&proto.ToDataplane_ConfigUpdate{config},
+			&proto.ToDataplane_IpsetUpdate{ipSet},
+		}))
+	})
+
+	Describe("when connected", func() {
+		var s *mockStream
+
+		BeforeEach(func() {
+			s = newMockStream()
+			streams <- s
+			s.recvC <- driverHello
+			Expect(conn.SendMessage(config)).To(Succeed())
+			Eventually(sentPayloads(s)).Should(HaveLen(2))
+		})
+
+		It("should send messages with increasing sequence numbers", func() {
+			Expect(conn.SendMessage(ipSet)).To(Succeed())
+			Eventually(sentPayloads(s)).Should(HaveLen(3))
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			Expect(s.sent[0].SequenceNumber).To(BeNumerically("==", 1))
+			Expect(s.sent[1].SequenceNumber).To(BeNumerically("==", 2))
+			Expect(s.sent[2].SequenceNumber).To(BeNumerically("==", 3))
+		})
+
+		It("should send messages for supported features", func() {
+			Expect(conn.SendMessage(hostMeta)).To(Succeed())
+			Eventually(sentPayloads(s)).Should(HaveLen(3))
+			Expect(sentPayloads(s)()[2]).To(Equal(&proto.ToDataplane_HostMetadataUpdate{hostMeta}))
+		})
+
+		It("should resend the snapshot on request", func() {
+			Expect(conn.SendMessage(ipSet)).To(Succeed())
+			Eventually(sentPayloads(s)).Should(HaveLen(3))
+			s.recvC <- &proto.FromDataplane{
+				Payload: &proto.FromDataplane_ResyncRequest{&proto.ResyncRequest{}},
+			}
+			Eventually(sentPayloads(s)).Should(HaveLen(5))
+			Expect(sentPayloads(s)()[3:]).To(Equal([]interface{}{
+				&proto.ToDataplane_ConfigUpdate{config},
+				&proto.ToDataplane_IpsetUpdate{ipSet},
+			}))
+		})
+
+		It("should track acknowledgements", func() {
+			Expect(conn.SendMessage(ipSet)).To(Succeed())
+			Eventually(sentPayloads(s)).Should(HaveLen(3))
+			s.recvC <- &proto.FromDataplane{
+				Payload: &proto.FromDataplane_Ack{&proto.Ack{SequenceNumber: 3}},
+			}
+			Eventually(func() uint64 {
+				conn.lock.Lock()
+				defer conn.lock.Unlock()
+				return conn.lastAcked
+			}).Should(BeNumerically("==", 3))
+		})
+
+		It("should ignore acknowledgements for unsent messages", func() {
+			s.recvC <- &proto.FromDataplane{
+				Payload: &proto.FromDataplane_Ack{&proto.Ack{SequenceNumber: 10}},
+			}
+			// Sending a second message synchronises with the read loop.
+			s.recvC <- &proto.FromDataplane{
+				Payload: &proto.FromDataplane_Ack{&proto.Ack{SequenceNumber: 1}},
+			}
+			Eventually(func() uint64 {
+				conn.lock.Lock()
+				defer conn.lock.Unlock()
+				return conn.lastAcked
+			}).Should(BeNumerically("==", 1))
+		})
+
+		It("should pass status messages to RecvMessage", func() {
+			status := &proto.ProcessStatusUpdate{IsoTimestamp: "now"}
+			go func() {
+				s.recvC <- &proto.FromDataplane{
+					Payload: &proto.FromDataplane_ProcessStatusUpdate{status},
+				}
+			}()
+			msg, err := conn.RecvMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg).To(Equal(status))
+		})
+
+		It("should reconnect and resend the snapshot if the stream fails", func() {
+			close(s.recvC)
+			s2 := newMockStream()
+			streams <- s2
+			s2.recvC <- driverHello
+			Eventually(sentPayloads(s2)).Should(Equal([]interface{}{
+				ourHello,
+				&proto.ToDataplane_ConfigUpdate{config},
+			}))
+			Expect(s.isClosed()).To(BeTrue())
+		})
+
+		Describe("with a driver that isn't reading", func() {
+			var unblockSends func()
+
+			BeforeEach(func() {
+				unblockSends = s.blockSends()
+				Expect(conn.SendMessage(&proto.IPSetUpdate{Id: "s1"})).To(Succeed())
+				Eventually(s.numBlockedSends).Should(Equal(1))
+			})
+
+			It("should not block SendMessage or the read loop", func() {
+				Expect(conn.SendMessage(&proto.IPSetUpdate{Id: "s2"})).To(Succeed())
+				s.recvC <- &proto.FromDataplane{
+					Payload: &proto.FromDataplane_Ack{&proto.Ack{SequenceNumber: 2}},
+				}
+				Eventually(func() uint64 {
+					conn.lock.Lock()
+					defer conn.lock.Unlock()
+					return conn.lastAcked
+				}).Should(BeNumerically("==", 2))
+				unblockSends()
+				Eventually(sentPayloads(s)).Should(HaveLen(4))
+				Expect(sentPayloads(s)()[3]).To(Equal(
+					&proto.ToDataplane_IpsetUpdate{&proto.IPSetUpdate{Id: "s2"}}))
+			})
+
+			It("should replace the queue with a snapshot if the queue overflows", func() {
+				for _, id := range []string{"s2", "s3", "s4"} {
+					Expect(conn.SendMessage(&proto.IPSetUpdate{Id: id})).To(Succeed())
+				}
+				unblockSends()
+				Eventually(sentPayloads(s)).Should(HaveLen(8))
+				payloads := sentPayloads(s)()
+				Expect(payloads[2]).To(Equal(
+					&proto.ToDataplane_IpsetUpdate{&proto.IPSetUpdate{Id: "s1"}}))
+				Expect(payloads[3]).To(Equal(&proto.ToDataplane_ConfigUpdate{config}))
+				Expect(payloads[4:]).To(ConsistOf(
+					&proto.ToDataplane_IpsetUpdate{&proto.IPSetUpdate{Id: "s1"}},
+					&proto.ToDataplane_IpsetUpdate{&proto.IPSetUpdate{Id: "s2"}},
+					&proto.ToDataplane_IpsetUpdate{&proto.IPSetUpdate{Id: "s3"}},
+					&proto.ToDataplane_IpsetUpdate{&proto.IPSetUpdate{Id: "s4"}},
+				))
+			})
+
+			It("should reconnect and resend the snapshot if a send times out", func() {
+				sendTimeoutC <- time.Now()
+				s2 := newMockStream()
+				streams <- s2
+				Expect(s.isClosed()).To(BeTrue())
+				s2.recvC <- driverHello
+				Eventually(sentPayloads(s2)).Should(Equal([]interface{}{
+					ourHello,
+					&proto.ToDataplane_ConfigUpdate{config},
+					&proto.ToDataplane_IpsetUpdate{&proto.IPSetUpdate{Id: "s1"}},
+				}))
+			})
+		})
+	})
+})
@@ -0,0 +1,148 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extdataplane
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/set"
+)
+
+// ProtocolVersion is the version of the dataplane driver protocol that we speak.  It should
+// be incremented whenever we add an optional feature.
+const ProtocolVersion = 1
+
+// optionalFeatures maps from the type of each message that belongs to an optional feature of
+// the dataplane driver protocol to the name of that feature.  We only send such messages to
+// drivers that have declared support for the feature in their Hello.  There are no optional
+// features yet; new message types should be added here so that older drivers keep working.
+var optionalFeatures = map[reflect.Type]string{}
+
+// helloTimeout is the time that we wait for a pipe-connected driver to reply to our Hello
+// before assuming that it predates the handshake.
+const helloTimeout = 10 * time.Second
+
+// featureForMsg returns the optional feature that a driver must support to be sent the given
+// message, or "" if the message is understood by all drivers.
+func featureForMsg(msg interface{}) string {
+	return optionalFeatures[reflect.TypeOf(msg)]
+}
+
+func newHello() *proto.Hello {
+	features := set.New()
+	for _, feature := range optionalFeatures {
+		features.Add(feature)
+	}
+	hello := &proto.Hello{ProtocolVersion: ProtocolVersion}
+	features.Iter(func(item interface{}) error {
+		hello.Features = append(hello.Features, item.(string))
+		return nil
+	})
+	sort.Strings(hello.Features)
+	return hello
+}
+
+// driverFeatures records the features supported by a driver, as declared in its Hello.
+type driverFeatures struct {
+	protocolVersion uint32
+	features        set.Set
+}
+
+func newDriverFeatures(hello *proto.Hello) *driverFeatures {
+	f := &driverFeatures{features: set.New()}
+	if hello != nil {
+		f.protocolVersion = hello.ProtocolVersion
+		for _, feature := range hello.Features {
+			f.features.Add(feature)
+		}
+	}
+	log.WithFields(log.Fields{
+		"driverProtocolVersion": f.protocolVersion,
+		"driverFeatures":        f.features,
+		"ourProtocolVersion":    ProtocolVersion,
+	}).Info("Negotiated dataplane driver protocol")
+	return f
+}
+
+// ShouldSend returns true if the driver supports the given message.
+func (f *driverFeatures) ShouldSend(msg interface{}) bool {
+	feature := featureForMsg(msg)
+	if feature == "" || f.features.Contains(feature) {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"feature": feature,
+		"msg":     msg,
+	}).Debug("Dataplane driver doesn't support feature, not sending message")
+	return false
+}
+
+// helloWaiter waits for a driver's Hello, for the pipe-connected driver, where we can't tell
+// whether the driver will ever reply.  The first call to Features() that needs to know the
+// driver's features waits until the driver's Hello arrives or we time out; after that, we
+// stick with the answer.
+type helloWaiter struct {
+	timeout time.Duration
+
+	once     sync.Once
+	helloC   chan *proto.Hello
+	features *driverFeatures
+}
+
+func newHelloWaiter(timeout time.Duration) *helloWaiter {
+	return &helloWaiter{
+		timeout: timeout,
+		helloC:  make(chan *proto.Hello, 1),
+	}
+}
+
+// OnDriverHello should be called when the driver's Hello arrives.
+func (w *helloWaiter) OnDriverHello(hello *proto.Hello) {
+	select {
+	case w.helloC <- hello:
+	default:
+		log.Warn("Dataplane driver sent more than one Hello, ignoring")
+	}
+}
+
+// Features returns the driver's features, waiting for its Hello if needed.
+func (w *helloWaiter) Features() *driverFeatures {
+	w.once.Do(func() {
+		var hello *proto.Hello
+		select {
+		case hello = <-w.helloC:
+		case <-time.After(w.timeout):
+			log.Warn("Dataplane driver didn't reply to our Hello, assuming it predates " +
+				"protocol negotiation.")
+		}
+		w.features = newDriverFeatures(hello)
+	})
+	return w.features
+}
+
+// ShouldSend returns true if the driver supports the given message.  Messages that don't
+// belong to an optional feature never wait for the driver's Hello.
+func (w *helloWaiter) ShouldSend(msg interface{}) bool {
+	if featureForMsg(msg) == "" {
+		return true
+	}
+	return w.Features().ShouldSend(msg)
+}
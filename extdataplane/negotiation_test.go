@@ -0,0 +1,77 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extdataplane
+
+import (
+	"reflect"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// There are no optional features yet so the tests make one up.
+const featureTest = "test"
+
+func init() {
+	optionalFeatures[reflect.TypeOf(&proto.HostMetadataUpdate{})] = featureTest
+}
+
+var _ = Describe("newHello", func() {
+	It("should list the optional features", func() {
+		Expect(newHello()).To(Equal(&proto.Hello{
+			ProtocolVersion: ProtocolVersion,
+			Features:        []string{featureTest},
+		}))
+	})
+})
+
+var _ = Describe("helloWaiter", func() {
+	var waiter *helloWaiter
+	hostMeta := &proto.HostMetadataUpdate{Hostname: "host1", Ipv4Addr: "10.0.0.1"}
+
+	BeforeEach(func() {
+		waiter = newHelloWaiter(10 * time.Millisecond)
+	})
+
+	It("should always send messages that aren't part of an optional feature", func() {
+		Expect(waiter.ShouldSend(&proto.InSync{})).To(BeTrue())
+	})
+
+	It("should send messages for features that the driver supports", func() {
+		waiter.OnDriverHello(&proto.Hello{
+			ProtocolVersion: 1,
+			Features:        []string{featureTest},
+		})
+		Expect(waiter.ShouldSend(hostMeta)).To(BeTrue())
+	})
+
+	It("should not send messages for features that the driver doesn't support", func() {
+		waiter.OnDriverHello(&proto.Hello{ProtocolVersion: 1})
+		Expect(waiter.ShouldSend(hostMeta)).To(BeFalse())
+	})
+
+	It("should assume no optional features if the driver doesn't reply", func() {
+		Expect(waiter.ShouldSend(hostMeta)).To(BeFalse())
+		// A late reply doesn't change the answer.
+		waiter.OnDriverHello(&proto.Hello{
+			ProtocolVersion: 1,
+			Features:        []string{featureTest},
+		})
+		Expect(waiter.ShouldSend(hostMeta)).To(BeFalse())
+	})
+})
@@ -0,0 +1,145 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extdataplane
+
+import (
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/set"
+)
+
+// desiredStateCache tracks the current desired state of the dataplane, as conveyed by the
+// stream of messages that we send to the driver, so that we can replay it to a driver that
+// has reconnected or lost its state.
+type desiredStateCache struct {
+	config *proto.ConfigUpdate
+	inSync bool
+
+	ipSets            map[string]set.Set
+	profiles          map[proto.ProfileID]*proto.ActiveProfileUpdate
+	policies          map[proto.PolicyID]*proto.ActivePolicyUpdate
+	hostEndpoints     map[proto.HostEndpointID]*proto.HostEndpointUpdate
+	workloadEndpoints map[proto.WorkloadEndpointID]*proto.WorkloadEndpointUpdate
+	hostMetadata      map[string]*proto.HostMetadataUpdate
+	ipamPools         map[string]*proto.IPAMPoolUpdate
+}
+
+func newDesiredStateCache() *desiredStateCache {
+	return &desiredStateCache{
+		ipSets:            map[string]set.Set{},
+		profiles:          map[proto.ProfileID]*proto.ActiveProfileUpdate{},
+		policies:          map[proto.PolicyID]*proto.ActivePolicyUpdate{},
+		hostEndpoints:     map[proto.HostEndpointID]*proto.HostEndpointUpdate{},
+		workloadEndpoints: map[proto.WorkloadEndpointID]*proto.WorkloadEndpointUpdate{},
+		hostMetadata:      map[string]*proto.HostMetadataUpdate{},
+		ipamPools:         map[string]*proto.IPAMPoolUpdate{},
+	}
+}
+
+// OnUpdate updates the cache with the given message, which should be one of the messages that
+// we send to the driver.
+func (c *desiredStateCache) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.ConfigUpdate:
+		c.config = msg
+	case *proto.InSync:
+		c.inSync = true
+	case *proto.IPSetUpdate:
+		members := set.New()
+		for _, m := range msg.Members {
+			members.Add(m)
+		}
+		c.ipSets[msg.Id] = members
+	case *proto.IPSetDeltaUpdate:
+		members := c.ipSets[msg.Id]
+		if members == nil {
+			// Shouldn't happen; the calculation graph always sends a full update first.
+			members = set.New()
+			c.ipSets[msg.Id] = members
+		}
+		for _, m := range msg.RemovedMembers {
+			members.Discard(m)
+		}
+		for _, m := range msg.AddedMembers {
+			members.Add(m)
+		}
+	case *proto.IPSetRemove:
+		delete(c.ipSets, msg.Id)
+	case *proto.ActiveProfileUpdate:
+		c.profiles[*msg.Id] = msg
+	case *proto.ActiveProfileRemove:
+		delete(c.profiles, *msg.Id)
+	case *proto.ActivePolicyUpdate:
+		c.policies[*msg.Id] = msg
+	case *proto.ActivePolicyRemove:
+		delete(c.policies, *msg.Id)
+	case *proto.HostEndpointUpdate:
+		c.hostEndpoints[*msg.Id] = msg
+	case *proto.HostEndpointRemove:
+		delete(c.hostEndpoints, *msg.Id)
+	case *proto.WorkloadEndpointUpdate:
+		c.workloadEndpoints[*msg.Id] = msg
+	case *proto.WorkloadEndpointRemove:
+		delete(c.workloadEndpoints, *msg.Id)
+	case *proto.HostMetadataUpdate:
+		c.hostMetadata[msg.Hostname] = msg
+	case *proto.HostMetadataRemove:
+		delete(c.hostMetadata, msg.Hostname)
+	case *proto.IPAMPoolUpdate:
+		c.ipamPools[msg.Id] = msg
+	case *proto.IPAMPoolRemove:
+		delete(c.ipamPools, msg.Id)
+	}
+}
+
+// Snapshot returns the messages needed to bring a driver with no state up to date.  The
+// messages are ordered so that IP sets, profiles and policies are sent before the endpoints
+// that refer to them.  If we haven't yet seen the config, there's nothing useful that the
+// driver can do so Snapshot returns nil.
+func (c *desiredStateCache) Snapshot() (msgs []interface{}) {
+	if c.config == nil {
+		return nil
+	}
+	msgs = append(msgs, c.config)
+	for id, members := range c.ipSets {
+		update := &proto.IPSetUpdate{Id: id}
+		members.Iter(func(item interface{}) error {
+			update.Members = append(update.Members, item.(string))
+			return nil
+		})
+		msgs = append(msgs, update)
+	}
+	for _, msg := range c.profiles {
+		msgs = append(msgs, msg)
+	}
+	for _, msg := range c.policies {
+		msgs = append(msgs, msg)
+	}
+	for _, msg := range c.hostEndpoints {
+		msgs = append(msgs, msg)
+	}
+	for _, msg := range c.workloadEndpoints {
+		msgs = append(msgs, msg)
+	}
+	for _, msg := range c.hostMetadata {
+		msgs = append(msgs, msg)
+	}
+	for _, msg := range c.ipamPools {
+		msgs = append(msgs, msg)
+	}
+	if c.inSync {
+		msgs = append(msgs, &proto.InSync{})
+	}
+	return
+}
@@ -15,13 +15,18 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	httppprof "net/http/pprof"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"runtime/debug"
@@ -36,15 +41,25 @@ import (
 
 	"github.com/projectcalico/felix/buildinfo"
 	"github.com/projectcalico/felix/calc"
+	"github.com/projectcalico/felix/checkpoint"
+	"github.com/projectcalico/felix/compositedataplane"
 	"github.com/projectcalico/felix/config"
 	_ "github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/consul"
+	"github.com/projectcalico/felix/etcdv3"
 	"github.com/projectcalico/felix/extdataplane"
+	"github.com/projectcalico/felix/filestore"
+	"github.com/projectcalico/felix/flowlog"
+	"github.com/projectcalico/felix/health"
 	"github.com/projectcalico/felix/intdataplane"
 	"github.com/projectcalico/felix/ipsets"
 	"github.com/projectcalico/felix/logutils"
+	"github.com/projectcalico/felix/markbits"
 	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/routetable"
 	"github.com/projectcalico/felix/rules"
 	"github.com/projectcalico/felix/statusrep"
+	"github.com/projectcalico/felix/syncclient"
 	"github.com/projectcalico/felix/usagerep"
 	"github.com/projectcalico/libcalico-go/lib/backend"
 	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
@@ -58,6 +73,17 @@ Usage:
 
 Options:
   -c --config-file=<filename>  Config file to load [default: /etc/calico/felix.cfg].
+  --validate-config            Load and validate the config from all sources, print the
+                               effective value of each parameter and where it came from,
+                               then exit.  Exits non-zero if the config has errors.
+  --load-gen                   Instead of connecting to the datastore, synthesize endpoints
+                               and policies, program them through the calculation graph and
+                               dataplane, report the programming throughput and latency,
+                               then exit.  Uses an in-memory mock dataplane unless
+                               --load-gen-real-dataplane is given.
+  --load-gen-endpoints=<n>     Number of endpoints to synthesize [default: 1000].
+  --load-gen-policies=<n>      Number of policies to synthesize [default: 100].
+  --load-gen-real-dataplane    Program the real dataplane in --load-gen mode.
   --version                    Print the version and exit.
 `
 
@@ -94,7 +120,8 @@ const (
 //
 // To avoid having to maintain rarely-used code paths, Felix handles updates to its
 // main config parameters by exiting and allowing itself to be restarted by the init
-// daemon.
+// daemon.  The exceptions are the few parameters marked as reloadable, such as the log
+// levels, which are applied to the running subsystems by reloadConfig().
 func main() {
 	// Go's RNG is not seeded by default.  Do that now.
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -129,6 +156,13 @@ func main() {
 	buildInfoLogCxt.Info("Felix starting up")
 	log.Infof("Command line arguments: %v", arguments)
 
+	if arguments["--validate-config"].(bool) {
+		os.Exit(validateConfig(arguments["--config-file"].(string)))
+	}
+	if arguments["--load-gen"].(bool) {
+		os.Exit(runLoadGen(arguments))
+	}
+
 	// Load the configuration from all the different sources including the
 	// datastore and merge. Keep retrying on failure.  We'll sit in this
 	// loop until the datastore is ready.
@@ -168,8 +202,7 @@ configRetry:
 
 		// We should now have enough config to connect to the datastore
 		// so we can load the remainder of the config.
-		datastoreConfig := configParams.DatastoreConfig()
-		datastore, err = backend.NewClient(datastoreConfig)
+		datastore, err = newDatastoreClient(configParams)
 		if err != nil {
 			log.WithError(err).Error("Failed to connect to datastore")
 			time.Sleep(1 * time.Second)
@@ -189,7 +222,11 @@ configRetry:
 		break configRetry
 	}
 
-	// If we get here, we've loaded the configuration successfully.
+	// If we get here, we've loaded the configuration successfully.  From now on, the config
+	// is shared with other goroutines so updates go through liveConfig, which replaces the
+	// current config with an updated copy.  configParams itself is never modified again so we
+	// can read it directly for parameters that can't change without a restart.
+	liveConfig := config.NewLiveConfig(configParams)
 	// Update log levels before we do anything else.
 	logutils.ConfigureLogging(configParams)
 	// Since we may have enabled more logging, log with the build context
@@ -197,80 +234,73 @@ configRetry:
 	buildInfoLogCxt.WithField("config", configParams).Info(
 		"Successfully loaded configuration.")
 
+	// If enabled, create the health aggregator, which the calculation graph and the
+	// internal dataplane report their health to.
+	var healthAggregator *health.HealthAggregator
+	if configParams.HealthEnabled {
+		log.Info("Health enabled.  Starting server.")
+		healthAggregator = health.NewHealthAggregator()
+		go healthAggregator.ServeHTTP(configParams.HealthHost, configParams.HealthPort)
+	}
+
 	// Start up the dataplane driver.  This may be the internal go-based driver or an external
 	// one.
 	var dpDriver dataplaneDriver
 	var dpDriverCmd *exec.Cmd
+	var debugHandlers map[string]http.Handler
+	var intDP *intdataplane.InternalDataplane
 	if configParams.UseInternalDataplaneDriver {
 		log.Info("Using internal dataplane driver.")
-		markAccept := configParams.NextIptablesMark()
-		markPass := configParams.NextIptablesMark()
-		markWorkload := configParams.NextIptablesMark()
-		log.WithFields(log.Fields{
-			"acceptMark":   markAccept,
-			"passMark":     markPass,
-			"workloadMark": markWorkload,
-		}).Info("Calculated iptables mark bits")
-		dpConfig := intdataplane.Config{
-			RulesConfig: rules.Config{
-				WorkloadIfacePrefixes: configParams.InterfacePrefixes(),
-
-				IPSetConfigV4: ipsets.NewIPVersionConfig(
-					ipsets.IPFamilyV4,
-					rules.IPSetNamePrefix,
-					rules.AllHistoricIPSetNamePrefixes,
-					rules.LegacyV4IPSetNames,
-				),
-				IPSetConfigV6: ipsets.NewIPVersionConfig(
-					ipsets.IPFamilyV6,
-					rules.IPSetNamePrefix,
-					rules.AllHistoricIPSetNamePrefixes,
-					nil,
-				),
-
-				OpenStackSpecialCasesEnabled: configParams.OpenstackActive(),
-				OpenStackMetadataIP:          net.ParseIP(configParams.MetadataAddr),
-				OpenStackMetadataPort:        uint16(configParams.MetadataPort),
-
-				IptablesMarkAccept:       markAccept,
-				IptablesMarkPass:         markPass,
-				IptablesMarkFromWorkload: markWorkload,
-
-				IPIPEnabled:       configParams.IpInIpEnabled,
-				IPIPTunnelAddress: configParams.IpInIpTunnelAddr,
-
-				IptablesLogPrefix:    configParams.LogPrefix,
-				EndpointToHostAction: configParams.DefaultEndpointToHostAction,
-
-				FailsafeInboundHostPorts:  configParams.FailsafeInboundHostPorts,
-				FailsafeOutboundHostPorts: configParams.FailsafeOutboundHostPorts,
-
-				DisableConntrackInvalid: configParams.DisableConntrackInvalidCheck,
-			},
-			IPIPMTU:                 configParams.IpInIpMtu,
-			IptablesRefreshInterval: time.Duration(configParams.IptablesRefreshInterval) * time.Second,
-			IptablesInsertMode:      configParams.ChainInsertMode,
-			MaxIPSetSize:            configParams.MaxIpsetSize,
-			IgnoreLooseRPF:          configParams.IgnoreLooseRPF,
-			IPv6Enabled:             configParams.Ipv6Support,
-			StatusReportingInterval: time.Duration(configParams.ReportingIntervalSecs) *
-				time.Second,
-
-			PostInSyncCallback: func() { dumpHeapMemoryProfile(configParams) },
-		}
-		intDP := intdataplane.NewIntDataplaneDriver(dpConfig)
+		dpConfig := newIntDataplaneConfig(configParams, healthAggregator)
+		intDP = intdataplane.NewIntDataplaneDriver(dpConfig)
 		intDP.Start()
+		debugHandlers = map[string]http.Handler{
+			"/debug/iptables":       intDP.IptablesStateHandler(),
+			"/debug/iptables-audit": intDP.IptablesAuditHandler(),
+			"/debug/dump-caches":    intDP.CacheDumpHandler(),
+		}
 		dpDriver = intDP
+	} else if configParams.DataplaneDriverAddress != "" {
+		log.WithField("address", configParams.DataplaneDriverAddress).Info(
+			"Using external dataplane driver over gRPC.")
+		dpDriver = extdataplane.StartGRPCDataplaneDriver(configParams.DataplaneDriverAddress)
 	} else {
 		log.WithField("driver", configParams.DataplaneDriver).Info(
 			"Using external dataplane driver.")
 		dpDriver, dpDriverCmd = extdataplane.StartExtDataplaneDriver(configParams.DataplaneDriver)
 	}
+	if configParams.WorkloadDataplaneDriverAddress != "" {
+		log.WithField("address", configParams.WorkloadDataplaneDriverAddress).Info(
+			"Using external dataplane driver for workload endpoints.")
+		dpDriver = compositedataplane.New(
+			compositedataplane.Member{
+				Name:   "main",
+				Driver: dpDriver,
+				Roles:  compositedataplane.RoleHostEndpoints | compositedataplane.RoleOther,
+			},
+			compositedataplane.Member{
+				Name:   "workload",
+				Driver: extdataplane.StartGRPCDataplaneDriver(configParams.WorkloadDataplaneDriverAddress),
+				Roles:  compositedataplane.RoleWorkloadEndpoints,
+			},
+		)
+	}
+	if configParams.DebugServerPort != 0 {
+		log.Info("Debug server enabled.  Starting server.")
+		go serveDebugEndpoints(
+			configParams.DebugServerHost,
+			configParams.DebugServerPort,
+			debugHandlers,
+		)
+	}
 
 	// Initialise the glue logic that connects the calculation graph to/from the dataplane driver.
 	log.Info("Connect to the dataplane driver.")
 	failureReportChan := make(chan string)
-	dpConnector := newConnector(configParams, datastore, dpDriver, failureReportChan)
+	dpConnector := newConnector(liveConfig, datastore, dpDriver, failureReportChan)
+	dpConnector.reloadConfig = func(changedParams []string) error {
+		return reloadConfig(liveConfig.Current(), intDP, changedParams)
+	}
 
 	// Now create the calculation graph, which receives updates from the
 	// datastore and outputs dataplane updates for the dataplane driver.
@@ -285,15 +315,29 @@ configRetry:
 	//        KVPair            KVPair             protobufs
 
 	// Get a Syncer from the datastore, which will feed the calculation
-	// graph with updates, bringing Felix into sync..
+	// graph with updates, bringing Felix into sync..  If Typha is configured, we get our
+	// updates from Typha instead, using the datastore's Syncer only as a fallback.
 	syncerToValidator := calc.NewSyncerCallbacksDecoupler()
-	syncer := datastore.Syncer(syncerToValidator)
+	var syncer bapi.Syncer
+	if typhaAddrs := configParams.TyphaAddrList(); len(typhaAddrs) > 0 {
+		log.WithField("addresses", typhaAddrs).Info("Using Typha for datastore updates.")
+		syncer = syncclient.New(syncclient.Options{
+			Addresses:       typhaAddrs,
+			ReadTimeout:     time.Duration(configParams.TyphaReadTimeoutSecs) * time.Second,
+			FallbackTimeout: time.Duration(configParams.TyphaFallbackTimeoutSecs) * time.Second,
+			Hostname:        configParams.FelixHostname,
+			Version:         buildinfo.GitVersion,
+			Info:            buildinfo.GitRevision,
+		}, syncerToValidator, datastore.Syncer)
+	} else {
+		syncer = datastore.Syncer(syncerToValidator)
+	}
 	log.Debugf("Created Syncer: %#v", syncer)
 
 	// Create the ipsets/active policy calculation graph, which will
 	// do the dynamic calculation of ipset memberships and active policies
 	// etc.
-	asyncCalcGraph := calc.NewAsyncCalcGraph(configParams, dpConnector.ToDataplane)
+	asyncCalcGraph := calc.NewAsyncCalcGraph(liveConfig, dpConnector.ToDataplane, healthAggregator)
 
 	if configParams.UsageReportingEnabled {
 		// Usage reporting enabled, add stats collector to graph.  When it detects an update
@@ -378,14 +422,24 @@ configRetry:
 	// Send the opening message to the dataplane driver, giving it its
 	// config.
 	dpConnector.ToDataplane <- &proto.ConfigUpdate{
-		Config: configParams.RawValues(),
+		Config: liveConfig.RawValues(),
 	}
 
 	if configParams.PrometheusMetricsEnabled {
 		log.Info("Prometheus metrics enabled.  Starting server.")
-		go servePrometheusMetrics(configParams.PrometheusMetricsPort)
+		go servePrometheusMetrics(configParams)
 	}
 
+	// On receipt of SIGHUP, re-read the local config.
+	hupSignalChan := make(chan os.Signal, 1)
+	signal.Notify(hupSignalChan, syscall.SIGHUP)
+	go func() {
+		for {
+			<-hupSignalChan
+			reloadLocalConfig(liveConfig, arguments["--config-file"].(string), dpConnector)
+		}
+	}()
+
 	// On receipt of SIGUSR1, write out heap profile.
 	usr1SignalChan := make(chan os.Signal, 1)
 	signal.Notify(usr1SignalChan, syscall.SIGUSR1)
@@ -401,6 +455,254 @@ configRetry:
 	monitorAndManageShutdown(failureReportChan, dpDriverCmd, stopSignalChans)
 }
 
+// newIntDataplaneConfig calculates the iptables mark bits that the internal dataplane should
+// use and returns its config.
+func newIntDataplaneConfig(
+	configParams *config.Config,
+	healthAggregator *health.HealthAggregator,
+) intdataplane.Config {
+	if configParams.KubeIPVSSupportEnabled &&
+		configParams.IptablesMarkMask&configParams.KubeProxyMarkMask != 0 {
+		log.WithFields(log.Fields{
+			"IptablesMarkMask":  configParams.IptablesMarkMask,
+			"KubeProxyMarkMask": configParams.KubeProxyMarkMask,
+		}).Warn("IptablesMarkMask overlaps kube-proxy's mark bits, not using those bits.")
+	}
+	markBitsManager := markbits.NewMarkBitsManager(configParams.UsableIptablesMarkMask(), "felix-iptables")
+	nextMark := func(purpose string) uint32 {
+		mark, err := markBitsManager.NextSingleBitMark()
+		if err != nil {
+			// Shouldn't happen; config validation checks that there are enough bits.
+			log.WithError(err).WithFields(log.Fields{
+				"IptablesMarkMask": configParams.IptablesMarkMask,
+				"purpose":          purpose,
+			}).Fatal("Failed to allocate iptables mark bit")
+		}
+		return mark
+	}
+	markAccept := nextMark("accept")
+	markPass := nextMark("pass")
+	markWorkload := nextMark("workload")
+	var markService uint32
+	if configParams.KubeIPVSSupportEnabled {
+		markService = nextMark("service")
+	}
+	log.WithFields(log.Fields{
+		"acceptMark":   markAccept,
+		"passMark":     markPass,
+		"workloadMark": markWorkload,
+		"serviceMark":  markService,
+	}).Info("Calculated iptables mark bits")
+	return intdataplane.Config{
+		RulesConfig: rules.Config{
+			WorkloadIfacePrefixes: configParams.InterfacePrefixes(),
+
+			IPSetConfigV4: ipsets.NewIPVersionConfig(
+				ipsets.IPFamilyV4,
+				rules.IPSetNamePrefix,
+				rules.AllHistoricIPSetNamePrefixes,
+				rules.LegacyV4IPSetNames,
+			),
+			IPSetConfigV6: ipsets.NewIPVersionConfig(
+				ipsets.IPFamilyV6,
+				rules.IPSetNamePrefix,
+				rules.AllHistoricIPSetNamePrefixes,
+				nil,
+			),
+
+			OpenStackSpecialCasesEnabled: configParams.OpenstackActive(),
+			OpenStackMetadataIP:          net.ParseIP(configParams.MetadataAddr),
+			OpenStackMetadataPort:        uint16(configParams.MetadataPort),
+
+			IptablesMarkAccept:       markAccept,
+			IptablesMarkPass:         markPass,
+			IptablesMarkFromWorkload: markWorkload,
+			IptablesMarkService:      markService,
+
+			IPIPEnabled:       configParams.IpInIpEnabled,
+			IPIPTunnelAddress: configParams.IpInIpTunnelAddr,
+
+			IptablesLogPrefix:     configParams.LogPrefix,
+			IptablesLogNFLOGGroup: uint16(configParams.LogActionNFLOGGroup),
+			EndpointToHostAction:  configParams.DefaultEndpointToHostAction,
+			FilterAllowAction:     configParams.IptablesFilterAllowAction,
+			RejectWith:            configParams.RejectWith,
+			DropNFLOGGroup:        uint16(configParams.DropNFLOGGroup),
+
+			FailsafeInboundHostPorts:  configParams.FailsafeInboundHostPorts,
+			FailsafeOutboundHostPorts: configParams.FailsafeOutboundHostPorts,
+
+			DisableConntrackInvalid: configParams.DisableConntrackInvalidCheck,
+			PolicyNameComments:      configParams.IptablesPolicyNameComments,
+
+			WorkloadDSCPMap: configParams.WorkloadDSCPMap,
+
+			WorkloadSourceCheck:                    configParams.WorkloadSourceCheck,
+			WorkloadSourceCheckExemptIfacePrefixes: configParams.WorkloadSourceCheckExemptIfacePrefixList(),
+
+			KubeIPVSSupportEnabled: configParams.KubeIPVSSupportEnabled,
+		},
+		IPIPMTU:                 configParams.IpInIpMtu,
+		VXLANEnabled:            configParams.VXLANEnabled,
+		VXLANVNI:                configParams.VXLANVNI,
+		VXLANPort:               configParams.VXLANPort,
+		VXLANMTU:                configParams.VXLANMTU,
+		VXLANTunnelAddress:      configParams.VXLANTunnelAddr,
+		Hostname:                configParams.FelixHostname,
+		IptablesRefreshInterval: time.Duration(configParams.IptablesRefreshInterval) * time.Second,
+		IptablesInsertMode:      configParams.ChainInsertMode,
+		IptablesPreValidate:     configParams.IptablesPreValidate,
+		MaxIPSetSize:            configParams.MaxIpsetSize,
+		IpsetsRefreshInterval:   time.Duration(configParams.IpsetsRefreshInterval) * time.Second,
+		IgnoreLooseRPF:          configParams.IgnoreLooseRPF,
+		IPv6Enabled:             configParams.Ipv6Support,
+		StatusReportingInterval: time.Duration(configParams.ReportingIntervalSecs) *
+			time.Second,
+
+		WorkloadDSCPMode: configParams.WorkloadDSCPMode,
+
+		RouteTableOptions: routetable.Options{
+			Metric:   configParams.RouteMetric,
+			Protocol: configParams.RouteTableProtocol,
+			OnLink:   configParams.RouteOnLink,
+		},
+		ConntrackFlushRateLimit: configParams.ConntrackFlushRateLimit,
+		ConntrackTuning: intdataplane.ConntrackTuning{
+			MaxEntries: configParams.ConntrackMaxEntries,
+			TCPEstablishedTimeout: time.Duration(configParams.ConntrackTCPEstablishedTimeoutSecs) *
+				time.Second,
+			UDPTimeout:     time.Duration(configParams.ConntrackUDPTimeoutSecs) * time.Second,
+			GenericTimeout: time.Duration(configParams.ConntrackGenericTimeoutSecs) * time.Second,
+		},
+		XDPEnabled:     configParams.XDPEnabled,
+		XDPProgramFile: configParams.XDPProgramFile,
+
+		DeniedPacketMetricsMaxSourceIPs: configParams.DeniedPacketMetricsMaxSourceIPs,
+
+		PolicyCountersRefreshInterval: time.Duration(configParams.PolicyCountersRefreshIntervalSecs) *
+			time.Second,
+
+		FlowLogs: flowlog.Config{
+			FileEnabled: configParams.FlowLogsFileEnabled,
+			File:        filepath.Join(configParams.FlowLogsFileDirectory, "flows.log"),
+			MaxFileSize: int64(configParams.FlowLogsFileMaxFileSizeMB) * 1024 * 1024,
+			MaxFiles:    configParams.FlowLogsFileMaxFiles,
+			ConntrackPollInterval: time.Duration(configParams.FlowLogsConntrackPollIntervalSecs) *
+				time.Second,
+			FlushInterval: time.Duration(configParams.FlowLogsFlushIntervalSecs) * time.Second,
+			Syslog: flowlog.SyslogConfig{
+				Address:  configParams.FlowLogsSyslogAddress,
+				TLS:      configParams.FlowLogsSyslogTLSEnabled,
+				CAFile:   configParams.FlowLogsSyslogCAFile,
+				Hostname: configParams.FelixHostname,
+			},
+			Kafka: flowlog.KafkaConfig{
+				Brokers:       configParams.FlowLogsKafkaBrokerList(),
+				Topic:         configParams.FlowLogsKafkaTopic,
+				BatchSize:     configParams.FlowLogsKafkaBatchSize,
+				FlushInterval: time.Second,
+			},
+		},
+
+		IptablesRuleHashAlgorithm: configParams.IptablesRuleHashAlgorithm,
+		IptablesRuleHashLength:    configParams.IptablesRuleHashLength,
+		IptablesRuleHashSeed:      configParams.IptablesRuleHashSeed,
+
+		IptablesMinResyncInterval: time.Duration(configParams.IptablesMinResyncIntervalMillis) *
+			time.Millisecond,
+		IptablesFlushCheckInterval: time.Duration(configParams.IptablesFlushCheckIntervalSecs) *
+			time.Second,
+		IptablesChainDeletionGracePeriod: time.Duration(
+			configParams.IptablesChainDeletionGracePeriodSecs) * time.Second,
+		IptablesMaxChainLength:  configParams.IptablesMaxChainLength,
+		IptablesMaxRestoreLines: configParams.IptablesMaxRestoreLines,
+
+		IptablesFailureMode:       configParams.IptablesFailureMode,
+		IptablesNATFailureMode:    configParams.IptablesNATFailureMode,
+		IptablesMangleFailureMode: configParams.IptablesMangleFailureMode,
+		IptablesRawFailureMode:    configParams.IptablesRawFailureMode,
+
+		WorkloadRoutingTableIndex:   configParams.WorkloadRoutingTableIndex,
+		WorkloadRoutingRulePriority: configParams.WorkloadRoutingRulePriority,
+
+		IptablesLockFilePath: configParams.IptablesLockFilePath,
+		IptablesLockTimeout: time.Duration(configParams.IptablesLockTimeoutSecs*1000000) *
+			time.Microsecond,
+		IptablesLockProbeInterval: time.Duration(configParams.IptablesLockProbeIntervalMillis) *
+			time.Millisecond,
+		InstanceIDFile:        configParams.InstanceIDFile,
+		DataplaneBinDir:       configParams.DataplaneBinDir,
+		DataplaneHostNetnsPID: configParams.DataplaneHostNetnsPID,
+		IptablesCommandTimeout: time.Duration(configParams.IptablesCommandTimeoutSecs) *
+			time.Second,
+		ApplyWatchdogTimeout: time.Duration(configParams.DataplaneApplyWatchdogTimeoutSecs) *
+			time.Second,
+		ApplyDelay: time.Duration(configParams.DataplaneApplyDelayMillis) *
+			time.Millisecond,
+		ApplyMaxDelay: time.Duration(configParams.DataplaneApplyMaxDelayMillis) *
+			time.Millisecond,
+		ApplyAdaptive:  configParams.DataplaneApplyAdaptive,
+		ApplyRateLimit: configParams.DataplaneApplyRateLimit,
+		ApplyBurst:     configParams.DataplaneApplyBurst,
+		InterfaceDampingInterval: time.Duration(configParams.InterfaceDampingIntervalMillis) *
+			time.Millisecond,
+		IptablesStateSnapshots: configParams.DebugServerPort != 0,
+		IptablesAuditLogSize:   configParams.IptablesAuditLogSize,
+		IptablesAuditLogFile:   configParams.IptablesAuditLogFile,
+
+		OfflineRenderDir: configParams.DataplaneOfflineRenderDir,
+		OfflineRenderCompleteCallback: func() {
+			log.WithField("dir", configParams.DataplaneOfflineRenderDir).Info(
+				"Finished rendering dataplane offline, exiting.")
+			os.Exit(0)
+		},
+		ReadOnly: configParams.DataplaneReadOnly,
+
+		PolicyReadyFile:        configParams.PolicyReadyFile,
+		GracefulRestartTimeout: time.Duration(configParams.GracefulRestartTimeoutSecs) * time.Second,
+		PostInSyncCallback:     func() { dumpHeapMemoryProfile(configParams) },
+
+		EndpointStatusFileDirectory: configParams.EndpointStatusFileDirectory,
+
+		HealthAggregator: healthAggregator,
+		HealthTimeout:    time.Duration(configParams.HealthDataplaneTimeoutSecs) * time.Second,
+	}
+}
+
+// reloadLocalConfig re-reads the config file and environment and merges any changes to
+// reloadable parameters into liveConfig.  Then it sends the merged config down the same path
+// as a datastore config update so that the connector applies the changes, and the dataplane
+// driver hears about them.  Changes to other parameters are logged and otherwise ignored until
+// the next restart.  (The environment of a running process doesn't change so, in practice, it's
+// the config file that matters.)
+func reloadLocalConfig(liveConfig *config.LiveConfig, configFile string, dpConnector *DataplaneConnector) {
+	logCxt := log.WithField("configFile", configFile)
+	logCxt.Info("Received SIGHUP, reloading local config.")
+	envConfig := config.LoadConfigFromEnvironment(os.Environ())
+	fileConfig, err := config.LoadConfigFile(configFile)
+	if err != nil {
+		logCxt.WithError(err).Error("Failed to load configuration file, ignoring SIGHUP.")
+		return
+	}
+	applied, restartNeeded, err := liveConfig.UpdateLocalSources(envConfig, fileConfig)
+	if err != nil {
+		logCxt.WithError(err).Error("New local configuration is invalid, ignoring SIGHUP.")
+		return
+	}
+	if len(restartNeeded) > 0 {
+		logCxt.WithField("params", restartNeeded).Warn(
+			"Some config changes can only be applied by restarting Felix; ignoring them for now.")
+	}
+	if len(applied) == 0 {
+		logCxt.Info("No reloadable config changes to apply.")
+		return
+	}
+	logCxt.WithField("params", applied).Info("Applying config changes.")
+	dpConnector.ToDataplane <- &proto.ConfigUpdate{
+		Config: liveConfig.RawValues(),
+	}
+}
+
 func dumpHeapMemoryProfile(configParams *config.Config) {
 	// If a memory profile file name is configured, dump a heap memory profile.  If the
 	// configured filename includes "<timestamp>", that will be replaced with a stamp indicating
@@ -437,17 +739,80 @@ func dumpHeapMemoryProfile(configParams *config.Config) {
 	}
 }
 
-func servePrometheusMetrics(port int) {
+// servePrometheusMetrics serves our prometheus metrics.  If a certificate and key are
+// configured, it serves HTTPS, optionally requiring a client certificate signed by the
+// configured CA.
+func servePrometheusMetrics(configParams *config.Config) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	addr := net.JoinHostPort(configParams.PrometheusMetricsHost,
+		fmt.Sprint(configParams.PrometheusMetricsPort))
+	server := &http.Server{Addr: addr, Handler: mux}
+	certFile := configParams.PrometheusMetricsCertFile
+	keyFile := configParams.PrometheusMetricsKeyFile
+	tlsEnabled := certFile != ""
+	if tlsEnabled && configParams.PrometheusMetricsCAFile != "" {
+		// Only allow clients that present a certificate signed by the configured CA.
+		caPEM, err := ioutil.ReadFile(configParams.PrometheusMetricsCAFile)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to read prometheus metrics CA file")
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			log.WithField("file", configParams.PrometheusMetricsCAFile).Fatal(
+				"No certificates found in prometheus metrics CA file")
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  clientCAs,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
 	for {
-		log.WithField("port", port).Info("Starting prometheus metrics endpoint")
-		http.Handle("/metrics", promhttp.Handler())
-		err := http.ListenAndServe(fmt.Sprintf(":%v", port), nil)
+		log.WithFields(log.Fields{
+			"addr": addr,
+			"tls":  tlsEnabled,
+		}).Info("Starting prometheus metrics endpoint")
+		var err error
+		if tlsEnabled {
+			err = server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
 		log.WithError(err).Error(
 			"Prometheus metrics endpoint failed, trying to restart it...")
 		time.Sleep(1 * time.Second)
 	}
 }
 
+// serveDebugEndpoints serves our debug handlers.  Since they expose the details of our
+// policy, and the profiles can be expensive to collect, they are served on their own port,
+// which should only be reachable locally.  As well as the given handlers (any of which may
+// be nil if disabled), we serve the standard pprof profiles under /debug/pprof/, which
+// include goroutine dumps (/debug/pprof/goroutine?debug=2).
+func serveDebugEndpoints(host string, port int, handlers map[string]http.Handler) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	for path, handler := range handlers {
+		if handler != nil {
+			mux.Handle(path, handler)
+		}
+	}
+	for {
+		log.WithFields(log.Fields{
+			"host": host,
+			"port": port,
+		}).Info("Starting debug endpoint")
+		err := http.ListenAndServe(fmt.Sprintf("%v:%v", host, port), mux)
+		log.WithError(err).Error(
+			"Debug endpoint failed, trying to restart it...")
+		time.Sleep(1 * time.Second)
+	}
+}
+
 func monitorAndManageShutdown(failureReportChan <-chan string, driverCmd *exec.Cmd, stopSignalChans []chan<- bool) {
 	// Ask the runtime to tell us if we get a term signal.
 	termSignalChan := make(chan os.Signal, 1)
@@ -534,6 +899,47 @@ func monitorAndManageShutdown(failureReportChan <-chan string, driverCmd *exec.C
 	logCxt.Fatal("Exiting immediately")
 }
 
+// newDatastoreClient creates a client for the configured datastore.  libcalico-go doesn't support
+// the etcd v3 API, Consul or loading from files so we use our own clients for those.
+func newDatastoreClient(configParams *config.Config) (bapi.Client, error) {
+	switch configParams.DatastoreType {
+	case "file":
+		fileClient, err := filestore.NewClient(filestore.Config{
+			Dir:   configParams.DatastoreFileDir,
+			Watch: configParams.DatastoreFileWatch,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return fileClient, nil
+	case "consul":
+		consulClient, err := consul.NewClient(consul.Config{
+			Address:  configParams.ConsulAddr,
+			Scheme:   configParams.ConsulScheme,
+			Token:    configParams.ConsulToken,
+			KeyFile:  configParams.ConsulKeyFile,
+			CertFile: configParams.ConsulCertFile,
+			CAFile:   configParams.ConsulCaFile,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return consulClient, nil
+	case "etcdv3":
+		etcdClient, err := etcdv3.NewClient(etcdv3.Config{
+			Endpoints:  configParams.EtcdEndpointURLs(),
+			KeyFile:    configParams.EtcdKeyFile,
+			CertFile:   configParams.EtcdCertFile,
+			CACertFile: configParams.EtcdCaFile,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return etcdClient, nil
+	}
+	return backend.NewClient(configParams.DatastoreConfig())
+}
+
 func loadConfigFromDatastore(datastore bapi.Client, hostname string) (globalConfig, hostConfig map[string]string) {
 	for {
 		log.Info("Waiting for the datastore to be ready")
@@ -547,47 +953,59 @@ func loadConfigFromDatastore(datastore bapi.Client, hostname string) (globalConf
 			continue
 		}
 
-		log.Info("Loading global config from datastore")
-		kvs, err := datastore.List(model.GlobalConfigListOptions{})
-		if err != nil {
-			log.WithError(err).Error("Failed to load config from datastore")
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		globalConfig = make(map[string]string)
-		for _, kv := range kvs {
-			key := kv.Key.(model.GlobalConfigKey)
-			value := kv.Value.(string)
-			globalConfig[key.Name] = value
-		}
-
-		log.Infof("Loading per-host config from datastore; hostname=%v", hostname)
-		kvs, err = datastore.List(
-			model.HostConfigListOptions{Hostname: hostname})
+		var err error
+		globalConfig, hostConfig, err = tryLoadConfigFromDatastore(datastore, hostname)
 		if err != nil {
 			log.WithError(err).Error("Failed to load config from datastore")
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		hostConfig = make(map[string]string)
-		for _, kv := range kvs {
-			key := kv.Key.(model.HostConfigKey)
-			value := kv.Value.(string)
-			hostConfig[key.Name] = value
-		}
 		log.Info("Loaded config from datastore")
 		break
 	}
 	return globalConfig, hostConfig
 }
 
+// tryLoadConfigFromDatastore makes a single attempt to load the global and per-host config from
+// the datastore.
+func tryLoadConfigFromDatastore(
+	datastore bapi.Client,
+	hostname string,
+) (globalConfig, hostConfig map[string]string, err error) {
+	log.Info("Loading global config from datastore")
+	kvs, err := datastore.List(model.GlobalConfigListOptions{})
+	if err != nil {
+		return
+	}
+	globalConfig = make(map[string]string)
+	for _, kv := range kvs {
+		key := kv.Key.(model.GlobalConfigKey)
+		value := kv.Value.(string)
+		globalConfig[key.Name] = value
+	}
+
+	log.Infof("Loading per-host config from datastore; hostname=%v", hostname)
+	kvs, err = datastore.List(
+		model.HostConfigListOptions{Hostname: hostname})
+	if err != nil {
+		return
+	}
+	hostConfig = make(map[string]string)
+	for _, kv := range kvs {
+		key := kv.Key.(model.HostConfigKey)
+		value := kv.Value.(string)
+		hostConfig[key.Name] = value
+	}
+	return
+}
+
 type dataplaneDriver interface {
 	SendMessage(msg interface{}) error
 	RecvMessage() (msg interface{}, err error)
 }
 
 type DataplaneConnector struct {
-	config                     *config.Config
+	config                     *config.LiveConfig
 	ToDataplane                chan interface{}
 	StatusUpdatesFromDataplane chan interface{}
 	InSync                     chan bool
@@ -599,18 +1017,27 @@ type DataplaneConnector struct {
 	datastoreInSync bool
 
 	firstStatusReportSent bool
+
+	// checkpointer, if non-nil, persists the desired dataplane state so that we can restore
+	// it quickly after a restart.
+	checkpointer *checkpoint.Checkpointer
+
+	// reloadConfig, if non-nil, is called to apply a change that only touches reloadable
+	// config parameters.  If it returns an error, we fall back to restarting.
+	reloadConfig func(changedParams []string) error
 }
 
 type Startable interface {
 	Start()
 }
 
-func newConnector(configParams *config.Config,
+func newConnector(liveConfig *config.LiveConfig,
 	datastore bapi.Client,
 	dataplane dataplaneDriver,
 	failureReportChan chan<- string) *DataplaneConnector {
+	configParams := liveConfig.Current()
 	felixConn := &DataplaneConnector{
-		config:                     configParams,
+		config:                     liveConfig,
 		datastore:                  datastore,
 		ToDataplane:                make(chan interface{}),
 		StatusUpdatesFromDataplane: make(chan interface{}),
@@ -618,6 +1045,12 @@ func newConnector(configParams *config.Config,
 		failureReportChan: failureReportChan,
 		dataplane:         dataplane,
 	}
+	if configParams.CheckpointFile != "" {
+		felixConn.checkpointer = checkpoint.New(
+			configParams.CheckpointFile,
+			time.Duration(configParams.CheckpointMaxAgeSecs)*time.Second,
+		)
+	}
 	return felixConn
 }
 
@@ -652,6 +1085,11 @@ func (fc *DataplaneConnector) readMessagesFromDataplane() {
 			if fc.statusReporter != nil {
 				fc.StatusUpdatesFromDataplane <- msg
 			}
+		case *proto.PolicyStatusUpdate, *proto.PolicyStatusRemove,
+			*proto.ProfileStatusUpdate, *proto.ProfileStatusRemove:
+			// Our version of the datastore model has no home for policy status yet so,
+			// for now, we only log it.  (The internal dataplane logs failures itself.)
+			log.WithField("msg", msg).Debug("Policy status update from dataplane")
 		default:
 			log.WithField("msg", msg).Warning("Unknown message from dataplane")
 		}
@@ -659,17 +1097,40 @@ func (fc *DataplaneConnector) readMessagesFromDataplane() {
 	}
 }
 
+// felixStatusReport extends the datastore's status report with the state of our dataplane so
+// that operators can spot wedged, as well as dead, Felixes.  The datastore stores the report
+// as JSON so the extra fields are simply ignored by clients that don't know about them.
+type felixStatusReport struct {
+	model.StatusReport
+	FelixVersion       string `json:"felix_version"`
+	LastApplyTimestamp string `json:"last_apply_time,omitempty"`
+	InSync             bool   `json:"in_sync"`
+	NumEndpoints       uint32 `json:"num_endpoints"`
+	NumPolicies        uint32 `json:"num_policies"`
+	NumProfiles        uint32 `json:"num_profiles"`
+}
+
 func (fc *DataplaneConnector) handleProcessStatusUpdate(msg *proto.ProcessStatusUpdate) {
 	log.Debugf("Status update from dataplane driver: %v", *msg)
-	statusReport := model.StatusReport{
-		Timestamp:     msg.IsoTimestamp,
-		UptimeSeconds: msg.Uptime,
-		FirstUpdate:   !fc.firstStatusReportSent,
+	statusReport := felixStatusReport{
+		StatusReport: model.StatusReport{
+			Timestamp:     msg.IsoTimestamp,
+			UptimeSeconds: msg.Uptime,
+			FirstUpdate:   !fc.firstStatusReportSent,
+		},
+		FelixVersion:       buildinfo.GitVersion,
+		LastApplyTimestamp: msg.LastApplyIsoTimestamp,
+		InSync:             msg.InSync,
+		NumEndpoints:       msg.NumEndpoints,
+		NumPolicies:        msg.NumPolicies,
+		NumProfiles:        msg.NumProfiles,
 	}
+	// ReportingTTLSecs is reloadable so we read it from the current config each time.
+	configParams := fc.config.Current()
 	kv := model.KVPair{
-		Key:   model.ActiveStatusReportKey{Hostname: fc.config.FelixHostname},
+		Key:   model.ActiveStatusReportKey{Hostname: configParams.FelixHostname},
 		Value: &statusReport,
-		TTL:   time.Duration(fc.config.ReportingTTLSecs) * time.Second,
+		TTL:   time.Duration(configParams.ReportingTTLSecs) * time.Second,
 	}
 	_, err := fc.datastore.Apply(&kv)
 	if err != nil {
@@ -678,7 +1139,7 @@ func (fc *DataplaneConnector) handleProcessStatusUpdate(msg *proto.ProcessStatus
 		fc.firstStatusReportSent = true
 	}
 	kv = model.KVPair{
-		Key:   model.LastStatusReportKey{Hostname: fc.config.FelixHostname},
+		Key:   model.LastStatusReportKey{Hostname: configParams.FelixHostname},
 		Value: &statusReport,
 	}
 	_, err = fc.datastore.Apply(&kv)
@@ -692,9 +1153,24 @@ func (fc *DataplaneConnector) sendMessagesToDataplaneDriver() {
 		fc.shutDownProcess("Failed to send messages to dataplane")
 	}()
 
-	var config map[string]string
+	var checkpointC <-chan time.Time
+	if fc.checkpointer != nil {
+		checkpointC = time.NewTicker(
+			time.Duration(fc.config.Current().CheckpointIntervalSecs) * time.Second).C
+	}
+
+	var lastConfig map[string]string
 	for {
-		msg := <-fc.ToDataplane
+		var msg interface{}
+		select {
+		case msg = <-fc.ToDataplane:
+		case <-checkpointC:
+			if err := fc.checkpointer.Write(); err != nil {
+				log.WithError(err).Warn("Failed to write checkpoint")
+			}
+			continue
+		}
+		restoreCheckpoint := false
 		switch msg := msg.(type) {
 		case *proto.InSync:
 			log.Info("Datastore now in sync.")
@@ -702,31 +1178,99 @@ func (fc *DataplaneConnector) sendMessagesToDataplaneDriver() {
 				log.Info("Datastore in sync for first time, sending message to status reporter.")
 				fc.datastoreInSync = true
 				fc.InSync <- true
+				if fc.checkpointer != nil {
+					// Clean up anything that we restored from the checkpoint that
+					// has since been deleted, before the driver sees the InSync.
+					fc.sendToDataplaneDriver(fc.checkpointer.StaleRemovals())
+				}
 			}
 		case *proto.ConfigUpdate:
 			logCxt := log.WithFields(log.Fields{
-				"old": config,
+				"old": lastConfig,
 				"new": msg.Config,
 			})
 			logCxt.Info("Possible config update")
-			if config != nil && !reflect.DeepEqual(msg.Config, config) {
-				logCxt.Warn("Felix configuration changed. Need to restart.")
-				fc.shutDownProcess("config changed")
-			} else if config == nil {
-				logCxt.Info("Config resolved.")
-				config = make(map[string]string)
-				for k, v := range msg.Config {
-					config[k] = v
+			if lastConfig != nil && !reflect.DeepEqual(msg.Config, lastConfig) {
+				changed, restartNeeded := config.ChangedParams(lastConfig, msg.Config)
+				logCxt = logCxt.WithField("changed", changed)
+				if restartNeeded || fc.reloadConfig == nil {
+					logCxt.Warn("Felix configuration changed. Need to restart.")
+					fc.shutDownProcess("config changed")
+				} else if err := fc.reloadConfig(changed); err != nil {
+					logCxt.WithError(err).Warn(
+						"Failed to apply config change at runtime. Need to restart.")
+					fc.shutDownProcess("config changed")
 				}
+				logCxt.Info("Applied config change without restarting.")
+			} else if lastConfig == nil {
+				logCxt.Info("Config resolved.")
+				// The driver needs its config first so we restore the checkpoint
+				// straight after passing on the first config update.
+				restoreCheckpoint = fc.checkpointer != nil
+			}
+			lastConfig = make(map[string]string)
+			for k, v := range msg.Config {
+				lastConfig[k] = v
 			}
 		case *calc.DatastoreNotReady:
 			log.Warn("Datastore became unready, need to restart.")
 			fc.shutDownProcess("datastore became unready")
 		}
+		if fc.checkpointer != nil {
+			fc.checkpointer.OnUpdate(msg)
+		}
 		if err := fc.dataplane.SendMessage(msg); err != nil {
 			fc.shutDownProcess("Failed to write to dataplane driver")
 		}
+		if restoreCheckpoint {
+			fc.sendToDataplaneDriver(fc.checkpointer.Restore())
+		}
+	}
+}
+
+// sendToDataplaneDriver sends messages that didn't come from the calculation graph, such as
+// those restored from the checkpoint, to the dataplane driver.
+func (fc *DataplaneConnector) sendToDataplaneDriver(msgs []interface{}) {
+	for _, msg := range msgs {
+		if err := fc.dataplane.SendMessage(msg); err != nil {
+			fc.shutDownProcess("Failed to write to dataplane driver")
+		}
+	}
+}
+
+// reloadConfig applies a change to the reloadable config parameters to the running subsystems.
+// By the time we're called, the calculation graph has already merged the change into the live
+// config and configParams is the resulting, current, config.  intDP is nil if we're using an external dataplane driver, which receives the
+// ConfigUpdate message and handles it itself.
+func reloadConfig(
+	configParams *config.Config,
+	intDP *intdataplane.InternalDataplane,
+	changedParams []string,
+) error {
+	logLevelsChanged := false
+	refreshIntervalsChanged := false
+	for _, name := range changedParams {
+		switch {
+		case strings.HasPrefix(name, "LogSeverity"):
+			logLevelsChanged = true
+		case name == "IptablesRefreshInterval", name == "IpsetsRefreshInterval":
+			refreshIntervalsChanged = true
+		}
+	}
+	if logLevelsChanged {
+		if err := logutils.UpdateLogLevels(configParams); err != nil {
+			return err
+		}
+	}
+	if refreshIntervalsChanged && intDP != nil {
+		intDP.UpdateRefreshIntervals(
+			time.Duration(configParams.IptablesRefreshInterval)*time.Second,
+			time.Duration(configParams.IpsetsRefreshInterval)*time.Second,
+		)
 	}
+	// Other reloadable parameters, such as ReportingTTLSecs, are read from the current config
+	// each time they're used.
+	return nil
 }
 
 func (fc *DataplaneConnector) shutDownProcess(reason string) {
@@ -0,0 +1,398 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filestore implements a datastore client that loads the whole of Calico's data from a
+// directory of JSON or YAML files, optionally watching the directory for changes.  It allows
+// Felix to run without a real datastore; for example, for air-gapped testing, to reproduce a
+// state captured in a support bundle or for deterministic integration tests.
+//
+// Each file contains a list of entries, each of which has a "key", which is a datastore path,
+// such as "/calico/v1/config/LogSeverityScreen", and a "value".  String values are used as-is;
+// other values are converted to JSON.  For example:
+//
+//	[
+//	  {"key": "/calico/v1/Ready", "value": "true"},
+//	  {"key": "/calico/v1/policy/tier/default/policy/allow-all",
+//	   "value": {"selector": "all()", "inbound_rules": [{"action": "allow"}]}}
+//	]
+//
+// Files are loaded in name order; if a key appears more than once then the last value wins.
+// Writes made through the client are held in memory, on top of the files' contents; they're
+// never written back to the files.
+package filestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+	"github.com/ghodss/yaml"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+// reloadDelay is how long we wait after a change to the directory before reloading it, so that
+// a burst of changes (such as an editor's save) only causes one reload.
+const reloadDelay = 100 * time.Millisecond
+
+// Config contains the file datastore's parameters.
+type Config struct {
+	// Dir is the directory to load the files from.
+	Dir string
+	// Watch enables reloading the files when the directory changes.
+	Watch bool
+}
+
+// Client is a libcalico-go backend API client that serves Calico's data from files.
+type Client struct {
+	dir string
+
+	// lock protects the fields below.
+	lock sync.Mutex
+	// fileValues maps from datastore path to raw value for each key that we loaded from the
+	// files.
+	fileValues map[string]string
+	// writtenValues contains the values written through the client, which take precedence
+	// over the files.  A nil value records a deletion.
+	writtenValues map[string]*string
+	// listeners are poked (without blocking) whenever the data changes.
+	listeners []chan struct{}
+}
+
+// Client must be usable as a drop-in replacement for libcalico-go's clients.
+var _ bapi.Client = (*Client)(nil)
+
+// NewClient creates a client and does the initial load of the files.  It fails if the files
+// can't be loaded.
+func NewClient(config Config) (*Client, error) {
+	c := &Client{
+		dir:           config.Dir,
+		writtenValues: map[string]*string{},
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	if config.Watch {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		if err := watcher.Add(config.Dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		go c.loopWatchingDir(watcher)
+	}
+	return c, nil
+}
+
+// Reload re-reads the files.  If any of the files fail to load, the previously-loaded data is
+// kept, so that a partially-edited file doesn't wipe out the dataplane.
+func (c *Client) Reload() error {
+	values, err := loadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"dir":     c.dir,
+		"numKeys": len(values),
+	}).Info("Loaded datastore files")
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.fileValues = values
+	c.notifyListeners()
+	return nil
+}
+
+func (c *Client) loopWatchingDir(watcher *fsnotify.Watcher) {
+	var reloadTimer <-chan time.Time
+	for {
+		select {
+		case event := <-watcher.Events:
+			log.WithField("event", event).Debug("Datastore directory changed")
+			if reloadTimer == nil {
+				reloadTimer = time.After(reloadDelay)
+			}
+		case err := <-watcher.Errors:
+			log.WithError(err).Warn("Error while watching datastore directory")
+		case <-reloadTimer:
+			reloadTimer = nil
+			if err := c.Reload(); err != nil {
+				log.WithError(err).Error(
+					"Failed to reload datastore files, keeping previous data")
+			}
+		}
+	}
+}
+
+// loadDir loads all the .json, .yaml and .yml files in the given directory, returning a map
+// from datastore path to raw value.
+func loadDir(dir string) (map[string]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasPrefix(name, ".") {
+			// Skip hidden files, such as editor swap files.
+			continue
+		}
+		switch filepath.Ext(name) {
+		case ".json", ".yaml", ".yml":
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	values := map[string]string{}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := loadFile(path, values); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %v", path, err)
+		}
+	}
+	return values, nil
+}
+
+// fileEntry is the format of each entry in a file.
+type fileEntry struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+func loadFile(path string, values map[string]string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if filepath.Ext(path) != ".json" {
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return err
+		}
+	}
+	var entries []fileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		if !strings.HasPrefix(entry.Key, "/calico/") {
+			return fmt.Errorf("entry %d has invalid key %q", i, entry.Key)
+		}
+		if len(entry.Value) == 0 {
+			return fmt.Errorf("entry %d (%s) has no value", i, entry.Key)
+		}
+		value := string(entry.Value)
+		var s string
+		if json.Unmarshal(entry.Value, &s) == nil {
+			value = s
+		}
+		if _, ok := values[entry.Key]; ok {
+			log.WithFields(log.Fields{
+				"key":  entry.Key,
+				"file": path,
+			}).Warn("Key defined more than once, using the last value")
+		}
+		values[entry.Key] = value
+	}
+	return nil
+}
+
+// EnsureInitialized is a no-op; the files are the whole of the datastore.
+func (c *Client) EnsureInitialized() error {
+	return nil
+}
+
+// EnsureCalicoNodeInitialized is a no-op; the files are the whole of the datastore.
+func (c *Client) EnsureCalicoNodeInitialized(node string) error {
+	return nil
+}
+
+// Create stores the given KV in memory, failing if the key already exists.
+func (c *Client) Create(d *model.KVPair) (*model.KVPair, error) {
+	return c.write(d, func(exists bool) error {
+		if exists {
+			return errors.ErrorResourceAlreadyExists{Identifier: d.Key}
+		}
+		return nil
+	})
+}
+
+// Update stores the given KV in memory, failing if the key doesn't exist.  Revisions aren't
+// supported so there is no check for conflicting updates.
+func (c *Client) Update(d *model.KVPair) (*model.KVPair, error) {
+	return c.write(d, func(exists bool) error {
+		if !exists {
+			return errors.ErrorResourceDoesNotExist{Identifier: d.Key}
+		}
+		return nil
+	})
+}
+
+// Apply stores the given KV in memory.  TTLs are ignored.
+func (c *Client) Apply(d *model.KVPair) (*model.KVPair, error) {
+	return c.write(d, func(exists bool) error {
+		return nil
+	})
+}
+
+func (c *Client) write(d *model.KVPair, check func(exists bool) error) (*model.KVPair, error) {
+	path, err := model.KeyToDefaultPath(d.Key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := model.SerializeValue(d)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, exists := c.lookup(path)
+	if err := check(exists); err != nil {
+		return nil, err
+	}
+	valueStr := string(value)
+	c.writtenValues[path] = &valueStr
+	c.notifyListeners()
+	return d, nil
+}
+
+// Delete deletes the given KV from memory.
+func (c *Client) Delete(d *model.KVPair) error {
+	path, err := model.KeyToDefaultPath(d.Key)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, exists := c.lookup(path); !exists {
+		return errors.ErrorResourceDoesNotExist{Identifier: d.Key}
+	}
+	c.writtenValues[path] = nil
+	c.notifyListeners()
+	return nil
+}
+
+// Get returns the KV with the given key.
+func (c *Client) Get(k model.Key) (*model.KVPair, error) {
+	path, err := model.KeyToDefaultPath(k)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	rawValue, exists := c.lookup(path)
+	c.lock.Unlock()
+
+	if !exists {
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: k}
+	}
+	value, err := model.ParseValue(k, []byte(rawValue))
+	if err != nil {
+		return nil, err
+	}
+	return &model.KVPair{Key: k, Value: value}, nil
+}
+
+// List returns the KVs that match the given list options.
+func (c *Client) List(l model.ListInterface) ([]*model.KVPair, error) {
+	root := model.ListOptionsToDefaultPathRoot(l)
+	kvs := []*model.KVPair{}
+	for path, rawValue := range c.snapshot() {
+		if !strings.HasPrefix(path, root) {
+			continue
+		}
+		key := l.KeyFromDefaultPath(path)
+		if key == nil {
+			continue
+		}
+		value, err := model.ParseValue(key, []byte(rawValue))
+		if err != nil {
+			log.WithError(err).WithField("key", path).Warn("Failed to parse value, skipping")
+			continue
+		}
+		kvs = append(kvs, &model.KVPair{Key: key, Value: value})
+	}
+	return kvs, nil
+}
+
+// Syncer returns a syncer that sends the whole of Calico's data to the given callbacks, and
+// then sends any changes.
+func (c *Client) Syncer(callbacks bapi.SyncerCallbacks) bapi.Syncer {
+	return newSyncer(c, callbacks)
+}
+
+// snapshot returns a copy of the current data, as a map from datastore path to raw value.
+func (c *Client) snapshot() map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	values := make(map[string]string, len(c.fileValues))
+	for path, value := range c.fileValues {
+		values[path] = value
+	}
+	for path, value := range c.writtenValues {
+		if value == nil {
+			delete(values, path)
+		} else {
+			values[path] = *value
+		}
+	}
+	return values
+}
+
+// addListener returns a channel that is poked whenever the data changes.
+func (c *Client) addListener() <-chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	listener := make(chan struct{}, 1)
+	c.listeners = append(c.listeners, listener)
+	return listener
+}
+
+// lookup returns the current value for the given path.  Must be called with the lock held.
+func (c *Client) lookup(path string) (string, bool) {
+	if value, ok := c.writtenValues[path]; ok {
+		if value == nil {
+			return "", false
+		}
+		return *value, true
+	}
+	value, ok := c.fileValues[path]
+	return value, ok
+}
+
+// notifyListeners pokes each listener, without blocking.  Must be called with the lock held.
+func (c *Client) notifyListeners() {
+	for _, listener := range c.listeners {
+		select {
+		case listener <- struct{}{}:
+		default:
+			// Already has a poke pending.
+		}
+	}
+}
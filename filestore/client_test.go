@@ -0,0 +1,256 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore_test
+
+import (
+	. "github.com/projectcalico/felix/filestore"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	calierrors "github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+var _ = Describe("Client", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-filestore")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeFile := func(name, contents string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	newClient := func(watch bool) *Client {
+		client, err := NewClient(Config{Dir: dir, Watch: watch})
+		Expect(err).NotTo(HaveOccurred())
+		return client
+	}
+
+	Describe("loading", func() {
+		BeforeEach(func() {
+			writeFile("a.json", `[
+				{"key": "/calico/v1/Ready", "value": "true"},
+				{"key": "/calico/v1/config/Foo", "value": "bar"}
+			]`)
+			writeFile("b.yaml", `[{"key": "/calico/v1/config/Foo", "value": "overridden"}]`)
+			writeFile("c.json", `[{"key": "/calico/v1/config/Baz", "value": {"a": 1}}]`)
+			writeFile("ignored.txt", `not JSON`)
+			writeFile(".hidden.json", `not JSON`)
+		})
+
+		It("should load the files in order, ignoring other files", func() {
+			client := newClient(false)
+			kvp, err := client.Get(model.ReadyFlagKey{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kvp.Value).To(Equal(true))
+			kvp, err = client.Get(model.GlobalConfigKey{Name: "Foo"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kvp.Value).To(Equal("overridden"))
+		})
+
+		It("should convert non-string values to JSON", func() {
+			client := newClient(false)
+			kvp, err := client.Get(model.GlobalConfigKey{Name: "Baz"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kvp.Value).To(Equal(`{"a": 1}`))
+		})
+
+		It("should list KVs", func() {
+			client := newClient(false)
+			kvps, err := client.List(model.GlobalConfigListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kvps).To(HaveLen(2))
+		})
+
+		It("should fail if a file is invalid", func() {
+			writeFile("d.json", `[{"key": "/calico/v1/config/Foo"`)
+			_, err := NewClient(Config{Dir: dir})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail if a key is invalid", func() {
+			writeFile("d.json", `[{"key": "config/Foo", "value": "bar"}]`)
+			_, err := NewClient(Config{Dir: dir})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should keep the old data if a reload fails", func() {
+			client := newClient(false)
+			writeFile("a.json", `[`)
+			Expect(client.Reload()).NotTo(Succeed())
+			_, err := client.Get(model.ReadyFlagKey{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("writes", func() {
+		var client *Client
+
+		BeforeEach(func() {
+			writeFile("a.json", `[{"key": "/calico/v1/config/Foo", "value": "bar"}]`)
+			client = newClient(false)
+		})
+
+		It("should apply writes in memory", func() {
+			_, err := client.Create(&model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}, Value: "x"})
+			Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceAlreadyExists{}))
+			_, err = client.Update(&model.KVPair{Key: model.GlobalConfigKey{Name: "New"}, Value: "x"})
+			Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceDoesNotExist{}))
+
+			_, err = client.Update(&model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}, Value: "bar2"})
+			Expect(err).NotTo(HaveOccurred())
+			kvp, err := client.Get(model.GlobalConfigKey{Name: "Foo"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kvp.Value).To(Equal("bar2"))
+
+			// The file should be untouched.
+			data, err := ioutil.ReadFile(filepath.Join(dir, "a.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"bar"`))
+		})
+
+		It("should keep writes across a reload", func() {
+			Expect(client.Delete(&model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}})).To(Succeed())
+			Expect(client.Reload()).To(Succeed())
+			_, err := client.Get(model.GlobalConfigKey{Name: "Foo"})
+			Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceDoesNotExist{}))
+			err = client.Delete(&model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}})
+			Expect(err).To(BeAssignableToTypeOf(calierrors.ErrorResourceDoesNotExist{}))
+		})
+	})
+
+	Describe("syncer", func() {
+		var callbacks *mockCallbacks
+
+		BeforeEach(func() {
+			writeFile("a.json", `[
+				{"key": "/calico/v1/Ready", "value": "true"},
+				{"key": "/calico/v1/config/Foo", "value": "bar"},
+				{"key": "/calico/v1/config/Baz", "value": "qux"}
+			]`)
+			callbacks = &mockCallbacks{}
+		})
+
+		It("should send the snapshot and then the changes", func() {
+			client := newClient(false)
+			client.Syncer(callbacks).Start()
+			Eventually(callbacks.getStatuses).Should(Equal([]bapi.SyncStatus{
+				bapi.WaitForDatastore,
+				bapi.ResyncInProgress,
+				bapi.InSync,
+			}))
+			Expect(callbacks.getUpdates()).To(ConsistOf(
+				newUpdate(model.ReadyFlagKey{}, true, bapi.UpdateTypeKVNew),
+				newUpdate(model.GlobalConfigKey{Name: "Foo"}, "bar", bapi.UpdateTypeKVNew),
+				newUpdate(model.GlobalConfigKey{Name: "Baz"}, "qux", bapi.UpdateTypeKVNew),
+			))
+
+			callbacks.clearUpdates()
+			writeFile("a.json", `[
+				{"key": "/calico/v1/Ready", "value": "true"},
+				{"key": "/calico/v1/config/Foo", "value": "bar2"},
+				{"key": "/calico/v1/config/New", "value": "value"}
+			]`)
+			Expect(client.Reload()).To(Succeed())
+			Eventually(callbacks.getUpdates).Should(ConsistOf(
+				newUpdate(model.GlobalConfigKey{Name: "Foo"}, "bar2", bapi.UpdateTypeKVUpdated),
+				newUpdate(model.GlobalConfigKey{Name: "New"}, "value", bapi.UpdateTypeKVNew),
+				newUpdate(model.GlobalConfigKey{Name: "Baz"}, nil, bapi.UpdateTypeKVDeleted),
+			))
+		})
+
+		It("should send in-memory writes", func() {
+			client := newClient(false)
+			client.Syncer(callbacks).Start()
+			Eventually(callbacks.getStatuses).Should(HaveLen(3))
+			callbacks.clearUpdates()
+			_, err := client.Apply(&model.KVPair{Key: model.GlobalConfigKey{Name: "Foo"}, Value: "bar2"})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(callbacks.getUpdates).Should(Equal([]bapi.Update{
+				newUpdate(model.GlobalConfigKey{Name: "Foo"}, "bar2", bapi.UpdateTypeKVUpdated),
+			}))
+		})
+
+		It("should reload when watching and a file changes", func() {
+			client := newClient(true)
+			client.Syncer(callbacks).Start()
+			Eventually(callbacks.getStatuses).Should(HaveLen(3))
+			callbacks.clearUpdates()
+			writeFile("b.json", `[{"key": "/calico/v1/config/New", "value": "value"}]`)
+			Eventually(callbacks.getUpdates).Should(Equal([]bapi.Update{
+				newUpdate(model.GlobalConfigKey{Name: "New"}, "value", bapi.UpdateTypeKVNew),
+			}))
+		})
+	})
+})
+
+func newUpdate(key model.Key, value interface{}, updateType bapi.UpdateType) bapi.Update {
+	return bapi.Update{
+		KVPair:     model.KVPair{Key: key, Value: value},
+		UpdateType: updateType,
+	}
+}
+
+type mockCallbacks struct {
+	lock     sync.Mutex
+	statuses []bapi.SyncStatus
+	updates  []bapi.Update
+}
+
+func (c *mockCallbacks) OnStatusUpdated(status bapi.SyncStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.statuses = append(c.statuses, status)
+}
+
+func (c *mockCallbacks) OnUpdates(updates []bapi.Update) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updates = append(c.updates, updates...)
+}
+
+func (c *mockCallbacks) getStatuses() []bapi.SyncStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.statuses
+}
+
+func (c *mockCallbacks) getUpdates() []bapi.Update {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.updates
+}
+
+func (c *mockCallbacks) clearUpdates() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updates = nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+// calicoPrefix is the prefix of the keys that we send to the syncer's callbacks.
+const calicoPrefix = "/calico/v1/"
+
+// syncer sends the client's data to its callbacks and then, each time the data changes,
+// sends the differences from what it previously sent.
+type syncer struct {
+	client    *Client
+	callbacks bapi.SyncerCallbacks
+
+	// knownKeys contains the Calico key and raw value of each path that we've sent to the
+	// callbacks.
+	knownKeys map[string]knownKey
+}
+
+type knownKey struct {
+	key      model.Key
+	rawValue string
+}
+
+func newSyncer(client *Client, callbacks bapi.SyncerCallbacks) *syncer {
+	return &syncer{
+		client:    client,
+		callbacks: callbacks,
+		knownKeys: map[string]knownKey{},
+	}
+}
+
+func (s *syncer) Start() {
+	// Register before taking the first snapshot so that we can't miss a change.
+	changes := s.client.addListener()
+	go s.loop(changes)
+}
+
+func (s *syncer) loop(changes <-chan struct{}) {
+	s.callbacks.OnStatusUpdated(bapi.WaitForDatastore)
+	s.callbacks.OnStatusUpdated(bapi.ResyncInProgress)
+	s.sendChanges()
+	s.callbacks.OnStatusUpdated(bapi.InSync)
+	for range changes {
+		s.sendChanges()
+	}
+}
+
+// sendChanges sends updates for keys that are new or whose values have changed, and deletions
+// for keys that have disappeared, since the last call.
+func (s *syncer) sendChanges() {
+	values := s.client.snapshot()
+	var updates []bapi.Update
+	for path, rawValue := range values {
+		if !strings.HasPrefix(path, calicoPrefix) {
+			continue
+		}
+		known, isKnown := s.knownKeys[path]
+		if isKnown && known.rawValue == rawValue {
+			continue
+		}
+		if update := s.parseUpdate(path, rawValue); update != nil {
+			updates = append(updates, *update)
+		}
+	}
+	for path := range s.knownKeys {
+		if _, ok := values[path]; !ok {
+			updates = append(updates, s.deletion(path))
+		}
+	}
+	log.WithField("numUpdates", len(updates)).Debug("Calculated changes to datastore files")
+	if len(updates) > 0 {
+		s.callbacks.OnUpdates(updates)
+	}
+}
+
+// parseUpdate converts a raw value into an update, recording the key as known.  It returns nil
+// if the key isn't one of Calico's.  A value that fails to parse is treated as a deletion
+// since it can't be used.
+func (s *syncer) parseUpdate(path string, rawValue string) *bapi.Update {
+	key := model.KeyFromDefaultPath(path)
+	if key == nil {
+		log.WithField("key", path).Debug("Ignoring unknown key")
+		return nil
+	}
+	_, isKnown := s.knownKeys[path]
+	value, err := model.ParseValue(key, []byte(rawValue))
+	if err != nil {
+		log.WithError(err).WithField("key", path).Warn("Failed to parse value")
+		if !isKnown {
+			return nil
+		}
+		deletion := s.deletion(path)
+		return &deletion
+	}
+	updateType := bapi.UpdateTypeKVNew
+	if isKnown {
+		updateType = bapi.UpdateTypeKVUpdated
+	}
+	s.knownKeys[path] = knownKey{key: key, rawValue: rawValue}
+	return &bapi.Update{
+		KVPair: model.KVPair{
+			Key:   key,
+			Value: value,
+		},
+		UpdateType: updateType,
+	}
+}
+
+// deletion returns a deletion update for the given known key and forgets it.
+func (s *syncer) deletion(path string) bapi.Update {
+	key := s.knownKeys[path].key
+	delete(s.knownKeys, path)
+	return bapi.Update{
+		KVPair: model.KVPair{
+			Key: key,
+		},
+		UpdateType: bapi.UpdateTypeKVDeleted,
+	}
+}
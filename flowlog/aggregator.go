@@ -0,0 +1,371 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flowlog builds flow logs: periodic summaries of the connections to and from the
+// local endpoints, enriched with the names of the endpoints and, for denied traffic, the
+// policy rule that denied it.
+//
+// Allowed traffic is learned by polling the conntrack table; denied traffic never makes it
+// into conntrack so it is learned from the collector's drop events instead.  Connections are
+// aggregated by source IP, destination IP and port, protocol and outcome, ignoring the
+// (usually ephemeral) source port.  The Reporter periodically passes the aggregated records
+// to its Sinks: a local file of JSON lines, for ingestion by a log shipper, a remote syslog
+// server and/or a Kafka topic.
+package flowlog
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/collector"
+	"github.com/projectcalico/felix/conntrack"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+
+	protoTCP  = 6
+	protoUDP  = 17
+	protoSCTP = 132
+)
+
+// Record is an aggregated flow log entry.
+type Record struct {
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Action    string    `json:"action"`
+	Protocol  int       `json:"proto"`
+
+	SrcIP       string `json:"source_ip"`
+	SrcEndpoint string `json:"source_endpoint,omitempty"`
+	DstIP       string `json:"dest_ip"`
+	DstPort     int    `json:"dest_port,omitempty"`
+	DstEndpoint string `json:"dest_endpoint,omitempty"`
+
+	// Policy describes the rule that denied the traffic; it is only set for denied flows.
+	Policy string `json:"policy,omitempty"`
+
+	// NumFlows is the number of connections that started in the interval.
+	NumFlows int `json:"num_flows"`
+	// Packets and Bytes count the traffic from the source to the destination; ReplyPackets
+	// and ReplyBytes count the return traffic.  For allowed flows, the counts are only
+	// available if the kernel's conntrack accounting is enabled.
+	Packets      uint64 `json:"packets"`
+	Bytes        uint64 `json:"bytes"`
+	ReplyPackets uint64 `json:"reply_packets"`
+	ReplyBytes   uint64 `json:"reply_bytes"`
+}
+
+type recordKey struct {
+	action   string
+	protocol int
+	srcIP    string
+	dstIP    string
+	dstPort  int
+	policy   string
+}
+
+// connKey identifies a conntrack entry by its original tuple.
+type connKey struct {
+	protocol int
+	srcIP    string
+	dstIP    string
+	srcPort  int
+	dstPort  int
+}
+
+type counters struct {
+	packets, bytes, replyPackets, replyBytes uint64
+}
+
+// Aggregator accumulates flow records between flushes.  It implements the dataplane's
+// Manager interface so that it can track the IPs of the local workload endpoints.  Its
+// methods may be called from different goroutines.
+type Aggregator struct {
+	lock sync.Mutex
+
+	endpointIDsByIP map[string]string
+	ipsByEndpoint   map[proto.WorkloadEndpointID][]string
+
+	// lastCounters holds the counters of each conntrack entry at the last poll, so that we
+	// can report the traffic in each interval rather than the lifetime totals.
+	lastCounters map[connKey]counters
+
+	startTime time.Time
+	records   map[recordKey]*Record
+
+	timeNow func() time.Time
+}
+
+func NewAggregator() *Aggregator {
+	return NewAggregatorWithShims(time.Now)
+}
+
+// NewAggregatorWithShims is a test constructor that allows for shimming time.Now.
+func NewAggregatorWithShims(timeNow func() time.Time) *Aggregator {
+	return &Aggregator{
+		endpointIDsByIP: map[string]string{},
+		ipsByEndpoint:   map[proto.WorkloadEndpointID][]string{},
+		lastCounters:    map[connKey]counters{},
+		startTime:       timeNow(),
+		records:         map[recordKey]*Record{},
+		timeNow:         timeNow,
+	}
+}
+
+func (a *Aggregator) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.WorkloadEndpointUpdate:
+		var ips []string
+		for _, cidr := range append(msg.Endpoint.Ipv4Nets, msg.Endpoint.Ipv6Nets...) {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.WithError(err).WithField("cidr", cidr).Warn("Failed to parse endpoint IP")
+				continue
+			}
+			ips = append(ips, ip.String())
+		}
+		a.updateEndpoint(*msg.Id, ips)
+	case *proto.WorkloadEndpointRemove:
+		a.updateEndpoint(*msg.Id, nil)
+	}
+}
+
+func (a *Aggregator) CompleteDeferredWork() error {
+	// Nothing to do, we don't defer any work.
+	return nil
+}
+
+func (a *Aggregator) updateEndpoint(id proto.WorkloadEndpointID, ips []string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, ip := range a.ipsByEndpoint[id] {
+		delete(a.endpointIDsByIP, ip)
+	}
+	delete(a.ipsByEndpoint, id)
+	if len(ips) == 0 {
+		return
+	}
+	endpointID := fmt.Sprintf("%s/%s/%s", id.OrchestratorId, id.WorkloadId, id.EndpointId)
+	for _, ip := range ips {
+		a.endpointIDsByIP[ip] = endpointID
+	}
+	a.ipsByEndpoint[id] = ips
+}
+
+// OnConntrackFlows updates the allowed flow records from a dump of the conntrack table for
+// one IP version.  Connections that neither start nor end at a local endpoint are ignored.
+// Connections that open and close between polls are missed.
+func (a *Aggregator) OnConntrackFlows(ipVersion uint8, flows []conntrack.Flow) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	seen := map[connKey]counters{}
+	for _, flow := range flows {
+		srcIP := flow.Orig.Src.String()
+		dstIP := flow.Orig.Dst.String()
+		if a.endpointIDsByIP[srcIP] == "" && a.endpointIDsByIP[dstIP] == "" {
+			continue
+		}
+		key := connKey{
+			protocol: flow.Protocol,
+			srcIP:    srcIP,
+			dstIP:    dstIP,
+			srcPort:  flow.Orig.SrcPort,
+			dstPort:  flow.Orig.DstPort,
+		}
+		current := counters{
+			packets:      flow.Orig.Packets,
+			bytes:        flow.Orig.Bytes,
+			replyPackets: flow.Reply.Packets,
+			replyBytes:   flow.Reply.Bytes,
+		}
+		seen[key] = current
+
+		delta := current
+		numFlows := 1
+		if last, ok := a.lastCounters[key]; ok && last.packets <= current.packets &&
+			last.replyPackets <= current.replyPackets {
+			// Same conntrack entry as last time; only report the new traffic.
+			delta = counters{
+				packets:      current.packets - last.packets,
+				bytes:        current.bytes - last.bytes,
+				replyPackets: current.replyPackets - last.replyPackets,
+				replyBytes:   current.replyBytes - last.replyBytes,
+			}
+			numFlows = 0
+			if delta == (counters{}) {
+				continue
+			}
+		}
+
+		record := a.record(recordKey{
+			action:   ActionAllow,
+			protocol: flow.Protocol,
+			srcIP:    srcIP,
+			dstIP:    dstIP,
+			dstPort:  portOrZero(flow.Protocol, flow.Orig.DstPort),
+		})
+		record.NumFlows += numFlows
+		record.Packets += delta.packets
+		record.Bytes += delta.bytes
+		record.ReplyPackets += delta.replyPackets
+		record.ReplyBytes += delta.replyBytes
+	}
+
+	// Forget the entries of this IP version that have gone away, keeping those of the other
+	// IP version.
+	for key := range a.lastCounters {
+		if ipVersionOf(key.srcIP) == ipVersion {
+			delete(a.lastCounters, key)
+		}
+	}
+	for key, c := range seen {
+		a.lastCounters[key] = c
+	}
+}
+
+// OnDropEvent updates the denied flow records from a packet that one of our rules dropped.
+// It is suitable for use as a collector.DropCallback.
+func (a *Aggregator) OnDropEvent(event collector.DropEvent) {
+	hdr, err := collector.ParseHeader(event.Payload)
+	if err != nil {
+		log.WithError(err).Debug("Failed to parse dropped packet")
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	record := a.record(recordKey{
+		action:   ActionDeny,
+		protocol: hdr.Protocol,
+		srcIP:    hdr.SrcIP.String(),
+		dstIP:    hdr.DstIP.String(),
+		dstPort:  hdr.DstPort,
+		policy:   describeOrigin(event.Origin),
+	})
+	// Each dropped packet is a (possibly retried) attempt to open a connection.
+	record.NumFlows++
+	record.Packets++
+	record.Bytes += uint64(len(event.Payload))
+}
+
+// record returns the record for the given key, creating it if needed.  Must be called with
+// the lock held.
+func (a *Aggregator) record(key recordKey) *Record {
+	record := a.records[key]
+	if record == nil {
+		record = &Record{
+			Action:      key.action,
+			Protocol:    key.protocol,
+			SrcIP:       key.srcIP,
+			SrcEndpoint: a.endpointIDsByIP[key.srcIP],
+			DstIP:       key.dstIP,
+			DstPort:     key.dstPort,
+			DstEndpoint: a.endpointIDsByIP[key.dstIP],
+			Policy:      key.policy,
+		}
+		a.records[key] = record
+	}
+	return record
+}
+
+// Flush returns the records accumulated since the last flush, sorted for determinism, and
+// starts a new interval.
+func (a *Aggregator) Flush() []Record {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := a.timeNow()
+	records := make([]Record, 0, len(a.records))
+	for _, record := range a.records {
+		record.StartTime = a.startTime
+		record.EndTime = now
+		records = append(records, *record)
+	}
+	sort.Sort(recordsByKey(records))
+	a.records = map[recordKey]*Record{}
+	a.startTime = now
+	return records
+}
+
+type recordsByKey []Record
+
+func (r recordsByKey) Len() int {
+	return len(r)
+}
+
+func (r recordsByKey) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+func (r recordsByKey) Less(i, j int) bool {
+	a, b := r[i], r[j]
+	if a.SrcIP != b.SrcIP {
+		return a.SrcIP < b.SrcIP
+	}
+	if a.DstIP != b.DstIP {
+		return a.DstIP < b.DstIP
+	}
+	if a.DstPort != b.DstPort {
+		return a.DstPort < b.DstPort
+	}
+	if a.Protocol != b.Protocol {
+		return a.Protocol < b.Protocol
+	}
+	if a.Action != b.Action {
+		return a.Action < b.Action
+	}
+	return a.Policy < b.Policy
+}
+
+// describeOrigin returns a human-readable description of the rule that dropped a packet.
+func describeOrigin(origin iptables.RuleOrigin) string {
+	switch origin.Kind {
+	case collector.KindEndOfTier:
+		return fmt.Sprintf("end of tier %s %s", origin.Name, origin.Direction)
+	case collector.KindNoProfile:
+		return fmt.Sprintf("no profile %s", origin.Direction)
+	}
+	return fmt.Sprintf("%s %s %s rule %d",
+		strings.ToLower(origin.Kind), origin.Name, origin.Direction, origin.RuleIndex)
+}
+
+// portOrZero returns the port for protocols that have ports, or 0 for those, such as ICMP,
+// that don't (and for which conntrack reports no port).
+func portOrZero(protocol, port int) int {
+	switch protocol {
+	case protoTCP, protoUDP, protoSCTP:
+		return port
+	}
+	return 0
+}
+
+func ipVersionOf(ip string) uint8 {
+	if strings.Contains(ip, ":") {
+		return 6
+	}
+	return 4
+}
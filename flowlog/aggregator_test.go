@@ -0,0 +1,227 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flowlog_test
+
+import (
+	. "github.com/projectcalico/felix/flowlog"
+
+	"bytes"
+	"errors"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/collector"
+	"github.com/projectcalico/felix/conntrack"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+)
+
+var t0 = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func tcpFlow(src, dst string, srcPort int, packets, replyPackets uint64) conntrack.Flow {
+	return conntrack.Flow{
+		Protocol: 6,
+		Orig: conntrack.Tuple{
+			Src: net.ParseIP(src), Dst: net.ParseIP(dst),
+			SrcPort: srcPort, DstPort: 80,
+			Packets: packets, Bytes: packets * 100,
+		},
+		Reply: conntrack.Tuple{
+			Src: net.ParseIP(dst), Dst: net.ParseIP(src),
+			SrcPort: 80, DstPort: srcPort,
+			Packets: replyPackets, Bytes: replyPackets * 100,
+		},
+	}
+}
+
+// tcpSYN returns the headers of a TCP packet from 10.0.0.1:1234 to 10.0.0.2:80.
+func tcpSYN() []byte {
+	packet := make([]byte, 40)
+	packet[0] = 0x45
+	packet[9] = 6
+	copy(packet[12:16], net.ParseIP("10.0.0.1").To4())
+	copy(packet[16:20], net.ParseIP("10.0.0.2").To4())
+	packet[20], packet[21] = 0x04, 0xd2
+	packet[22], packet[23] = 0, 80
+	return packet
+}
+
+var _ = Describe("Aggregator", func() {
+	var agg *Aggregator
+	var now time.Time
+
+	BeforeEach(func() {
+		now = t0
+		agg = NewAggregatorWithShims(func() time.Time { return now })
+		agg.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "k8s",
+				WorkloadId:     "default/pod-a",
+				EndpointId:     "eth0",
+			},
+			Endpoint: &proto.WorkloadEndpoint{
+				Ipv4Nets: []string{"10.0.0.2/32"},
+			},
+		})
+	})
+
+	It("should aggregate connections and report only new traffic", func() {
+		agg.OnConntrackFlows(4, []conntrack.Flow{
+			tcpFlow("10.0.0.1", "10.0.0.2", 1000, 2, 1),
+			tcpFlow("10.0.0.1", "10.0.0.2", 1001, 3, 2),
+			// Not to or from a local endpoint.
+			tcpFlow("10.0.0.1", "10.0.0.3", 1001, 3, 2),
+		})
+		now = t0.Add(time.Minute)
+		Expect(agg.Flush()).To(Equal([]Record{{
+			StartTime:    t0,
+			EndTime:      t0.Add(time.Minute),
+			Action:       ActionAllow,
+			Protocol:     6,
+			SrcIP:        "10.0.0.1",
+			DstIP:        "10.0.0.2",
+			DstPort:      80,
+			DstEndpoint:  "k8s/default/pod-a/eth0",
+			NumFlows:     2,
+			Packets:      5,
+			Bytes:        500,
+			ReplyPackets: 3,
+			ReplyBytes:   300,
+		}}))
+
+		agg.OnConntrackFlows(4, []conntrack.Flow{
+			tcpFlow("10.0.0.1", "10.0.0.2", 1000, 2, 1),
+			tcpFlow("10.0.0.1", "10.0.0.2", 1001, 5, 4),
+		})
+		records := agg.Flush()
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].StartTime).To(Equal(t0.Add(time.Minute)))
+		Expect(records[0].NumFlows).To(Equal(0))
+		Expect(records[0].Packets).To(Equal(uint64(2)))
+		Expect(records[0].ReplyPackets).To(Equal(uint64(2)))
+	})
+
+	It("should treat a connection whose counters go backwards as a new connection", func() {
+		agg.OnConntrackFlows(4, []conntrack.Flow{tcpFlow("10.0.0.1", "10.0.0.2", 1000, 5, 5)})
+		agg.Flush()
+		agg.OnConntrackFlows(4, []conntrack.Flow{tcpFlow("10.0.0.1", "10.0.0.2", 1000, 1, 0)})
+		records := agg.Flush()
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].NumFlows).To(Equal(1))
+		Expect(records[0].Packets).To(Equal(uint64(1)))
+	})
+
+	It("should forget endpoints that are removed", func() {
+		agg.OnUpdate(&proto.WorkloadEndpointRemove{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "k8s",
+				WorkloadId:     "default/pod-a",
+				EndpointId:     "eth0",
+			},
+		})
+		agg.OnConntrackFlows(4, []conntrack.Flow{tcpFlow("10.0.0.1", "10.0.0.2", 1000, 2, 1)})
+		Expect(agg.Flush()).To(BeEmpty())
+	})
+
+	It("should record denied packets with their policy", func() {
+		event := collector.DropEvent{
+			Origin: iptables.RuleOrigin{
+				Kind:      "Policy",
+				Name:      "default/deny-web",
+				Direction: "inbound",
+				RuleIndex: 1,
+			},
+			Payload: tcpSYN(),
+		}
+		agg.OnDropEvent(event)
+		agg.OnDropEvent(event)
+		Expect(agg.Flush()).To(Equal([]Record{{
+			StartTime:   t0,
+			EndTime:     t0,
+			Action:      ActionDeny,
+			Protocol:    6,
+			SrcIP:       "10.0.0.1",
+			DstIP:       "10.0.0.2",
+			DstPort:     80,
+			DstEndpoint: "k8s/default/pod-a/eth0",
+			Policy:      "policy default/deny-web inbound rule 1",
+			NumFlows:    2,
+			Packets:     2,
+			Bytes:       80,
+		}}))
+	})
+
+	It("should describe end-of-tier drops", func() {
+		agg.OnDropEvent(collector.DropEvent{
+			Origin: iptables.RuleOrigin{
+				Kind:      collector.KindEndOfTier,
+				Name:      "default",
+				Direction: "inbound",
+				RuleIndex: -1,
+			},
+			Payload: tcpSYN(),
+		})
+		records := agg.Flush()
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].Policy).To(Equal("end of tier default inbound"))
+	})
+
+	It("should ignore unparseable drops", func() {
+		agg.OnDropEvent(collector.DropEvent{Payload: []byte{0x45}})
+		Expect(agg.Flush()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Reporter", func() {
+	var agg *Aggregator
+	var output *bytes.Buffer
+	var listErr error
+	var reporter *Reporter
+
+	BeforeEach(func() {
+		agg = NewAggregatorWithShims(func() time.Time { return t0 })
+		agg.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id:       &proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: "w", EndpointId: "e"},
+			Endpoint: &proto.WorkloadEndpoint{Ipv4Nets: []string{"10.0.0.2/32"}},
+		})
+		output = &bytes.Buffer{}
+		listErr = nil
+		reporter = NewReporterWithShims(Config{}, agg, []uint8{4},
+			func(ipVersion uint8) ([]conntrack.Flow, error) {
+				return []conntrack.Flow{tcpFlow("10.0.0.1", "10.0.0.2", 1000, 1, 1)}, listErr
+			},
+			[]Sink{NewWriterSink(output)})
+	})
+
+	It("should write a JSON line per record", func() {
+		reporter.PollConntrack()
+		Expect(reporter.Flush()).To(Succeed())
+		Expect(output.String()).To(Equal(
+			`{"start_time":"2017-06-01T12:00:00Z","end_time":"2017-06-01T12:00:00Z",` +
+				`"action":"allow","proto":6,"source_ip":"10.0.0.1","dest_ip":"10.0.0.2",` +
+				`"dest_port":80,"dest_endpoint":"k8s/w/e","num_flows":1,"packets":1,` +
+				`"bytes":100,"reply_packets":1,"reply_bytes":100}` + "\n"))
+	})
+
+	It("should skip failed polls", func() {
+		listErr = errors.New("dump failed")
+		reporter.PollConntrack()
+		Expect(reporter.Flush()).To(Succeed())
+		Expect(output.String()).To(BeEmpty())
+	})
+})
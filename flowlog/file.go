@@ -0,0 +1,109 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flowlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// RotatingFile is an io.WriteCloser that writes to a file, rotating it once it reaches a
+// maximum size.  Rotated files are renamed to <path>.1, <path>.2 and so on, with the oldest
+// being deleted so that at most maxFiles rotated files are kept.  Each Write is kept
+// whole, so as long as callers write complete lines, no line is split across files.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+func NewRotatingFile(path string, maxSize int64, maxFiles int) *RotatingFile {
+	return &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if f.maxFiles <= 0 {
+		return os.Remove(f.path)
+	}
+	// Shuffle the older files along, overwriting the oldest.
+	for i := f.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(f.rotatedPath(i), f.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.rotatedPath(1))
+}
+
+func (f *RotatingFile) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flowlog_test
+
+import (
+	. "github.com/projectcalico/felix/flowlog"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RotatingFile", func() {
+	var dir, path string
+	var file *RotatingFile
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-flowlog")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "flowlogs", "flows.log")
+		file = NewRotatingFile(path, 10, 2)
+	})
+
+	AfterEach(func() {
+		file.Close()
+		os.RemoveAll(dir)
+	})
+
+	readFile := func(path string) string {
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	It("should create the directory and append", func() {
+		_, err := file.Write([]byte("abc\n"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = file.Write([]byte("def\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readFile(path)).To(Equal("abc\ndef\n"))
+	})
+
+	It("should rotate when the file would exceed the maximum size", func() {
+		for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"} {
+			_, err := file.Write([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(readFile(path)).To(Equal("line-4\n"))
+		Expect(readFile(path + ".1")).To(Equal("line-3\n"))
+		Expect(readFile(path + ".2")).To(Equal("line-2\n"))
+		_, err := os.Stat(path + ".3")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should keep writing a line that's bigger than the maximum size", func() {
+		_, err := file.Write([]byte("a very long line\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readFile(path)).To(Equal("a very long line\n"))
+	})
+})
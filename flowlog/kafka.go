@@ -0,0 +1,126 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flowlog
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	kafkaRetryInterval   = 5 * time.Second
+	kafkaDefaultQueueLen = 10000
+)
+
+// KafkaConfig controls the Kafka sink.
+type KafkaConfig struct {
+	Brokers []string
+	Topic   string
+	// BatchSize is the number of records that the producer tries to send in each request;
+	// it also sends whatever it has every FlushInterval.
+	BatchSize     int
+	FlushInterval time.Duration
+	// QueueLen is the number of records that we buffer while the brokers are unavailable.
+	QueueLen int
+}
+
+// KafkaSink sends each record, as JSON, as a message on a Kafka topic.
+type KafkaSink struct {
+	config KafkaConfig
+	queue  messageQueue
+
+	// Shims for testing.
+	newProducer func() (sarama.AsyncProducer, error)
+	sleep       func(time.Duration)
+}
+
+func NewKafkaSink(config KafkaConfig) *KafkaSink {
+	return NewKafkaSinkWithShims(config, func() (sarama.AsyncProducer, error) {
+		saramaConfig := sarama.NewConfig()
+		saramaConfig.ClientID = "calico-felix"
+		saramaConfig.Producer.Flush.Messages = config.BatchSize
+		saramaConfig.Producer.Flush.Frequency = config.FlushInterval
+		saramaConfig.Producer.Return.Errors = true
+		return sarama.NewAsyncProducer(config.Brokers, saramaConfig)
+	}, time.Sleep)
+}
+
+// NewKafkaSinkWithShims is a test constructor that allows for shimming the producer and
+// time.Sleep.
+func NewKafkaSinkWithShims(
+	config KafkaConfig,
+	newProducer func() (sarama.AsyncProducer, error),
+	sleep func(time.Duration),
+) *KafkaSink {
+	if config.QueueLen == 0 {
+		config.QueueLen = kafkaDefaultQueueLen
+	}
+	return &KafkaSink{
+		config:      config,
+		queue:       newMessageQueue("kafka", config.QueueLen),
+		newProducer: newProducer,
+		sleep:       sleep,
+	}
+}
+
+func (s *KafkaSink) Write(records []Record) error {
+	for _, record := range records {
+		msg, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		s.queue.enqueue(msg)
+	}
+	return nil
+}
+
+// Loop connects to the brokers and then feeds the queued messages to the producer, which
+// batches them.  If the producer can't keep up, we block here and the queue fills up.
+func (s *KafkaSink) Loop() {
+	logCxt := log.WithFields(log.Fields{
+		"brokers": s.config.Brokers,
+		"topic":   s.config.Topic,
+	})
+	var producer sarama.AsyncProducer
+	for {
+		var err error
+		producer, err = s.newProducer()
+		if err == nil {
+			break
+		}
+		logCxt.WithError(err).Warn("Failed to connect to Kafka, will retry")
+		s.sleep(kafkaRetryInterval)
+	}
+	logCxt.Info("Connected to Kafka")
+
+	go func() {
+		// The producer retries internally; errors here mean that it has given up on a
+		// message.
+		for err := range producer.Errors() {
+			countRecordsDropped.WithLabelValues("kafka").Inc()
+			logCxt.WithError(err.Err).Warn("Failed to send flow log record to Kafka")
+		}
+	}()
+
+	for msg := range s.queue.c {
+		producer.Input() <- &sarama.ProducerMessage{
+			Topic: s.config.Topic,
+			Value: sarama.ByteEncoder(msg),
+		}
+	}
+}
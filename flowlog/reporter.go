@@ -0,0 +1,166 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flowlog
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/felix/conntrack"
+)
+
+var (
+	countRecordsWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_flow_logs_records_written",
+		Help: "Number of flow log records written.",
+	})
+	countConntrackPollErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_flow_logs_conntrack_poll_errors",
+		Help: "Number of failures to dump the conntrack table.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(countRecordsWritten)
+	prometheus.MustRegister(countConntrackPollErrors)
+}
+
+// Config controls flow logging.  Flow logging is enabled if any of the sinks is.
+type Config struct {
+	// FileEnabled enables writing the records to File; it is rotated when it exceeds
+	// MaxFileSize, keeping MaxFiles old files.
+	FileEnabled bool
+	File        string
+	MaxFileSize int64
+	MaxFiles    int
+
+	// Syslog.Address, if non-empty, enables sending the records to a syslog server.
+	Syslog SyslogConfig
+	// Kafka.Brokers, if non-empty, enables sending the records to a Kafka topic.
+	Kafka KafkaConfig
+
+	// ConntrackPollInterval is the interval at which we read the conntrack table; shorter
+	// intervals catch more short-lived connections at the cost of CPU.
+	ConntrackPollInterval time.Duration
+	// FlushInterval is the interval at which we write out the aggregated records.
+	FlushInterval time.Duration
+}
+
+func (c Config) Enabled() bool {
+	return c.FileEnabled || c.Syslog.Address != "" || len(c.Kafka.Brokers) > 0
+}
+
+// Reporter periodically feeds the conntrack table to an Aggregator and writes out its
+// records.
+type Reporter struct {
+	config     Config
+	aggregator *Aggregator
+	ipVersions []uint8
+	listFlows  func(ipVersion uint8) ([]conntrack.Flow, error)
+	sinks      []Sink
+}
+
+func NewReporter(config Config, aggregator *Aggregator, ipVersions []uint8) *Reporter {
+	var sinks []Sink
+	if config.FileEnabled {
+		file := NewRotatingFile(config.File, config.MaxFileSize, config.MaxFiles)
+		sinks = append(sinks, NewWriterSink(file))
+	}
+	if config.Syslog.Address != "" {
+		sink, err := NewSyslogSink(config.Syslog)
+		if err != nil {
+			log.WithError(err).Error("Failed to create syslog flow log sink, not using it")
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	if len(config.Kafka.Brokers) > 0 {
+		sinks = append(sinks, NewKafkaSink(config.Kafka))
+	}
+	return NewReporterWithShims(config, aggregator, ipVersions, conntrack.New().ListFlows, sinks)
+}
+
+// NewReporterWithShims is a test constructor that allows for shimming the conntrack dump and
+// the sinks.
+func NewReporterWithShims(
+	config Config,
+	aggregator *Aggregator,
+	ipVersions []uint8,
+	listFlows func(ipVersion uint8) ([]conntrack.Flow, error),
+	sinks []Sink,
+) *Reporter {
+	return &Reporter{
+		config:     config,
+		aggregator: aggregator,
+		ipVersions: ipVersions,
+		listFlows:  listFlows,
+		sinks:      sinks,
+	}
+}
+
+// Loop polls conntrack and flushes records forever.
+func (r *Reporter) Loop() {
+	log.WithField("numSinks", len(r.sinks)).Info("Started flow log reporter")
+	for _, sink := range r.sinks {
+		if l, ok := sink.(looper); ok {
+			go l.Loop()
+		}
+	}
+	pollTicker := time.NewTicker(r.config.ConntrackPollInterval)
+	flushTicker := time.NewTicker(r.config.FlushInterval)
+	for {
+		select {
+		case <-pollTicker.C:
+			r.PollConntrack()
+		case <-flushTicker.C:
+			// Make sure the records are up to date before we write them out.
+			r.PollConntrack()
+			if err := r.Flush(); err != nil {
+				log.WithError(err).Error("Failed to write flow logs")
+			}
+		}
+	}
+}
+
+// PollConntrack passes the current contents of the conntrack table to the aggregator.
+func (r *Reporter) PollConntrack() {
+	for _, ipVersion := range r.ipVersions {
+		flows, err := r.listFlows(ipVersion)
+		if err != nil {
+			countConntrackPollErrors.Inc()
+			log.WithError(err).WithField("ipVersion", ipVersion).Warn(
+				"Failed to read conntrack table, flow logs will be incomplete")
+			continue
+		}
+		r.aggregator.OnConntrackFlows(ipVersion, flows)
+	}
+}
+
+// Flush passes the records that the aggregator has accumulated to each sink.  It returns the
+// last error from the sinks; a failing sink doesn't stop the others from getting the records.
+func (r *Reporter) Flush() (err error) {
+	records := r.aggregator.Flush()
+	for _, sink := range r.sinks {
+		if sinkErr := sink.Write(records); sinkErr != nil {
+			log.WithError(sinkErr).Warn("Flow log sink failed")
+			err = sinkErr
+		}
+	}
+	countRecordsWritten.Add(float64(len(records)))
+	log.WithField("numRecords", len(records)).Debug("Wrote flow logs")
+	return
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flowlog
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var countRecordsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "felix_flow_logs_records_dropped",
+	Help: "Number of flow log records dropped because a sink couldn't keep up.",
+}, []string{"sink"})
+
+func init() {
+	prometheus.MustRegister(countRecordsDropped)
+}
+
+// Sink receives the records from each flush.  Write is called from the reporter's goroutine;
+// sinks that send records over the network should queue them rather than block.
+type Sink interface {
+	Write(records []Record) error
+}
+
+// looper is implemented by sinks that need a background goroutine; the Reporter starts
+// their loops.
+type looper interface {
+	Loop()
+}
+
+// WriterSink writes records to an io.Writer, such as a RotatingFile, as JSON lines.
+type WriterSink struct {
+	w io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(records []Record) error {
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if _, err := s.w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// messageQueue is a bounded queue of encoded records waiting to be sent by a sink's loop.
+// When the queue is full, because the remote end is down or too slow, new records are
+// dropped rather than blocking the reporter or using unbounded memory.
+type messageQueue struct {
+	sinkName string
+	c        chan []byte
+}
+
+func newMessageQueue(sinkName string, size int) messageQueue {
+	return messageQueue{
+		sinkName: sinkName,
+		c:        make(chan []byte, size),
+	}
+}
+
+// enqueue adds the message to the queue, returning false if it had to be dropped.
+func (q messageQueue) enqueue(msg []byte) bool {
+	select {
+	case q.c <- msg:
+		return true
+	default:
+		countRecordsDropped.WithLabelValues(q.sinkName).Inc()
+		return false
+	}
+}
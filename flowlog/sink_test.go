@@ -0,0 +1,116 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flowlog_test
+
+import (
+	. "github.com/projectcalico/felix/flowlog"
+
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var allowRecord = Record{
+	StartTime: t0,
+	EndTime:   t0.Add(time.Minute),
+	Action:    ActionAllow,
+	Protocol:  6,
+	SrcIP:     "10.0.0.1",
+	DstIP:     "10.0.0.2",
+	DstPort:   80,
+	NumFlows:  1,
+}
+
+var _ = Describe("SyslogSink", func() {
+	var listener net.Listener
+	var sink *SyslogSink
+	var dialErr error
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		dialErr = nil
+		sink = NewSyslogSinkWithShims(
+			SyslogConfig{Address: listener.Addr().String(), Hostname: "host1", QueueLen: 2},
+			func() (net.Conn, error) {
+				if dialErr != nil {
+					err := dialErr
+					dialErr = nil
+					return nil, err
+				}
+				return net.Dial("tcp", listener.Addr().String())
+			},
+			func(time.Duration) {},
+		)
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	// readMessage reads one octet-counted message from the connection.
+	readMessage := func(r *bufio.Reader) string {
+		lenStr, err := r.ReadString(' ')
+		Expect(err).NotTo(HaveOccurred())
+		msgLen, err := strconv.Atoi(strings.TrimSpace(lenStr))
+		Expect(err).NotTo(HaveOccurred())
+		buf := make([]byte, msgLen)
+		_, err = io.ReadFull(r, buf)
+		Expect(err).NotTo(HaveOccurred())
+		return string(buf)
+	}
+
+	It("should send RFC 5424 messages, retrying the connection", func() {
+		dialErr = errors.New("connection refused")
+		deny := allowRecord
+		deny.Action = ActionDeny
+		Expect(sink.Write([]Record{allowRecord, deny})).To(Succeed())
+		go sink.Loop()
+
+		conn, err := listener.Accept()
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		msg := readMessage(r)
+		Expect(msg).To(MatchRegexp(
+			`^<134>1 2017-06-01T12:01:00Z host1 calico-felix \d+ flow - \{"start_time":.*"action":"allow".*\}$`))
+		msg = readMessage(r)
+		Expect(msg).To(MatchRegexp(`^<133>1 .*"action":"deny"`))
+	})
+
+	It("should drop records when the queue is full", func() {
+		Expect(sink.Write([]Record{allowRecord, allowRecord, allowRecord})).To(Succeed())
+		go sink.Loop()
+
+		conn, err := listener.Accept()
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		readMessage(r)
+		readMessage(r)
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err = r.ReadByte()
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,179 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flowlog
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	syslogAppName = "calico-felix"
+	syslogMsgID   = "flow"
+
+	// We log as facility local0; allowed flows at severity info and denied flows at notice.
+	syslogFacilityLocal0  = 16
+	syslogSeverityNotice  = 5
+	syslogSeverityInfo    = 6
+	syslogRetryInterval   = 5 * time.Second
+	syslogDefaultQueueLen = 10000
+)
+
+// SyslogConfig controls the syslog sink.
+type SyslogConfig struct {
+	// Address is the host:port of the syslog server.
+	Address string
+	// TLS enables TLS, verifying the server's certificate against the CAs in CAFile or,
+	// if that is empty, the system's CAs.
+	TLS    bool
+	CAFile string
+	// Hostname is the HOSTNAME field of the messages.
+	Hostname string
+	// QueueLen is the number of records that we buffer while the server is unavailable.
+	QueueLen int
+}
+
+// SyslogSink sends records to a remote syslog server as RFC 5424 messages over TCP (or TLS),
+// using the octet-counting framing of RFC 6587.  The MSG part of each message is the record
+// as JSON.
+type SyslogSink struct {
+	config SyslogConfig
+	queue  messageQueue
+	conn   net.Conn
+	pid    int
+
+	// Shims for testing.
+	dial  func() (net.Conn, error)
+	sleep func(time.Duration)
+}
+
+func NewSyslogSink(config SyslogConfig) (*SyslogSink, error) {
+	dial := func() (net.Conn, error) {
+		return net.DialTimeout("tcp", config.Address, 10*time.Second)
+	}
+	if config.TLS {
+		host, _, err := net.SplitHostPort(config.Address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{ServerName: host}
+		if config.CAFile != "" {
+			pem, err := ioutil.ReadFile(config.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+			}
+		}
+		dial = func() (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: 10 * time.Second}
+			return tls.DialWithDialer(dialer, "tcp", config.Address, tlsConfig)
+		}
+	}
+	return NewSyslogSinkWithShims(config, dial, time.Sleep), nil
+}
+
+// NewSyslogSinkWithShims is a test constructor that allows for shimming the connection to the
+// server and time.Sleep.
+func NewSyslogSinkWithShims(
+	config SyslogConfig,
+	dial func() (net.Conn, error),
+	sleep func(time.Duration),
+) *SyslogSink {
+	if config.QueueLen == 0 {
+		config.QueueLen = syslogDefaultQueueLen
+	}
+	return &SyslogSink{
+		config: config,
+		queue:  newMessageQueue("syslog", config.QueueLen),
+		pid:    os.Getpid(),
+		dial:   dial,
+		sleep:  sleep,
+	}
+}
+
+func (s *SyslogSink) Write(records []Record) error {
+	for _, record := range records {
+		msg, err := s.format(record)
+		if err != nil {
+			return err
+		}
+		s.queue.enqueue(msg)
+	}
+	return nil
+}
+
+// format renders a record as a framed syslog message.
+func (s *SyslogSink) format(record Record) ([]byte, error) {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	severity := syslogSeverityInfo
+	if record.Action == ActionDeny {
+		severity = syslogSeverityNotice
+	}
+	hostname := s.config.Hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		syslogFacilityLocal0*8+severity,
+		record.EndTime.UTC().Format(time.RFC3339),
+		hostname,
+		syslogAppName,
+		s.pid,
+		syslogMsgID,
+		body,
+	)
+	return []byte(fmt.Sprintf("%d %s", len(msg), msg)), nil
+}
+
+// Loop sends the queued messages, reconnecting to the server as needed.  While the server is
+// unavailable, messages accumulate in the queue until it is full.
+func (s *SyslogSink) Loop() {
+	logCxt := log.WithField("address", s.config.Address)
+	for msg := range s.queue.c {
+		for {
+			if s.conn == nil {
+				conn, err := s.dial()
+				if err != nil {
+					logCxt.WithError(err).Warn("Failed to connect to syslog server, will retry")
+					s.sleep(syslogRetryInterval)
+					continue
+				}
+				logCxt.Info("Connected to syslog server")
+				s.conn = conn
+			}
+			if _, err := s.conn.Write(msg); err != nil {
+				logCxt.WithError(err).Warn("Failed to write to syslog server, reconnecting")
+				s.conn.Close()
+				s.conn = nil
+				continue
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hashutils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// NameCollisionError is returned by NameRegistry.Register if two different names would be
+// shortened to the same name.
+type NameCollisionError struct {
+	Name          string
+	OtherName     string
+	ShortenedName string
+}
+
+func (e NameCollisionError) Error() string {
+	return fmt.Sprintf("names %q and %q both shorten to %q", e.Name, e.OtherName, e.ShortenedName)
+}
+
+// NameRegistry keeps track of the shortened names that are in use, for example, the results of
+// GetLengthLimitedID, so that it can detect two different names being shortened to the same
+// name.
+type NameRegistry struct {
+	lock            sync.Mutex
+	shortenedToName map[string]string
+	nameToShortened map[string]string
+}
+
+func NewNameRegistry() *NameRegistry {
+	return &NameRegistry{
+		shortenedToName: map[string]string{},
+		nameToShortened: map[string]string{},
+	}
+}
+
+// Register records that the given name is shortened to the given shortened name.  If a
+// different name has already been registered with the same shortened form, it returns a
+// NameCollisionError and doesn't record the name.
+func (r *NameRegistry) Register(name, shortened string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if otherName, ok := r.shortenedToName[shortened]; ok && otherName != name {
+		return NameCollisionError{
+			Name:          name,
+			OtherName:     otherName,
+			ShortenedName: shortened,
+		}
+	}
+	if oldShortened, ok := r.nameToShortened[name]; ok && oldShortened != shortened {
+		delete(r.shortenedToName, oldShortened)
+	}
+	r.shortenedToName[shortened] = name
+	r.nameToShortened[name] = shortened
+	return nil
+}
+
+// Unregister removes the given name from the registry, allowing its shortened form to be
+// reused.  It is a no-op if the name isn't registered.
+func (r *NameRegistry) Unregister(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	shortened, ok := r.nameToShortened[name]
+	if !ok {
+		return
+	}
+	delete(r.nameToShortened, name)
+	delete(r.shortenedToName, shortened)
+}
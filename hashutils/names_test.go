@@ -0,0 +1,52 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hashutils_test
+
+import (
+	. "github.com/projectcalico/felix/hashutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NameRegistry", func() {
+	var registry *NameRegistry
+	var short string
+	BeforeEach(func() {
+		registry = NewNameRegistry()
+		short = GetLengthLimitedID("cali-", "foobarbaz", 10)
+		Expect(registry.Register("cali-foobarbaz", short)).To(Succeed())
+	})
+
+	It("should allow the same name to be registered twice", func() {
+		Expect(registry.Register("cali-foobarbaz", short)).To(Succeed())
+	})
+	It("should detect a collision with an already-shortened name", func() {
+		// A name that happens to look like the shortened form of another name.
+		Expect(registry.Register(short, short)).To(Equal(NameCollisionError{
+			Name:          short,
+			OtherName:     "cali-foobarbaz",
+			ShortenedName: short,
+		}))
+	})
+	It("should allow a shortened name to be reused after Unregister()", func() {
+		registry.Unregister("cali-foobarbaz")
+		Expect(registry.Register(short, short)).To(Succeed())
+	})
+	It("should release the old shortened name if a name is re-registered", func() {
+		Expect(registry.Register("cali-foobarbaz", "cali-other")).To(Succeed())
+		Expect(registry.Register(short, short)).To(Succeed())
+	})
+})
@@ -0,0 +1,218 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package health aggregates the health of Felix's components and serves it over HTTP, in a
+// form suitable for Kubernetes liveness and readiness probes.
+//
+// Each component registers with the HealthAggregator, saying whether it reports liveness,
+// readiness or both, and how long its reports remain valid.  The component must then report
+// periodically; if its latest report has timed out, it is treated as neither live nor ready.
+// That allows a component that has wedged, and so stopped reporting, to be detected.
+package health
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// HealthReport is a component's view of its own health.  When registering, it indicates
+// which of liveness and readiness the component reports on.
+type HealthReport struct {
+	Live  bool
+	Ready bool
+}
+
+type reporterState struct {
+	// The health indicators that this reporter reports.
+	reports HealthReport
+	// Validity timeout for the latest report.
+	timeout time.Duration
+
+	latest    HealthReport
+	timestamp time.Time
+}
+
+// HealthAggregator combines the reports of the registered components.  It is safe to use from
+// multiple goroutines.
+type HealthAggregator struct {
+	lock      sync.Mutex
+	reporters map[string]*reporterState
+
+	// Shim for testing.
+	timeNow func() time.Time
+}
+
+func NewHealthAggregator() *HealthAggregator {
+	return NewHealthAggregatorWithShims(time.Now)
+}
+
+func NewHealthAggregatorWithShims(timeNow func() time.Time) *HealthAggregator {
+	return &HealthAggregator{
+		reporters: map[string]*reporterState{},
+		timeNow:   timeNow,
+	}
+}
+
+// RegisterReporter registers a component.  reports indicates whether the component reports
+// liveness, readiness or both.  The component's reports are valid for timeout, after which
+// it must report again to remain live/ready.
+func (aggregator *HealthAggregator) RegisterReporter(name string, reports *HealthReport, timeout time.Duration) {
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	aggregator.reporters[name] = &reporterState{
+		reports: *reports,
+		timeout: timeout,
+	}
+	log.WithFields(log.Fields{
+		"name":    name,
+		"reports": *reports,
+		"timeout": timeout,
+	}).Info("Registered health reporter")
+}
+
+// Report records the current health of a registered component.
+func (aggregator *HealthAggregator) Report(name string, report *HealthReport) {
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	reporter, ok := aggregator.reporters[name]
+	if !ok {
+		log.WithField("name", name).Panic("Health report from unregistered reporter")
+	}
+	if report.Live != reporter.latest.Live || report.Ready != reporter.latest.Ready {
+		log.WithFields(log.Fields{
+			"name":   name,
+			"report": *report,
+		}).Debug("Health report changed")
+	}
+	reporter.latest = *report
+	reporter.timestamp = aggregator.timeNow()
+}
+
+// componentStatus is the health of one component, as seen by the aggregator.
+type componentStatus struct {
+	name   string
+	live   bool
+	ready  bool
+	reason string
+}
+
+func (aggregator *HealthAggregator) componentStatuses() []componentStatus {
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	now := aggregator.timeNow()
+	var statuses []componentStatus
+	for name, reporter := range aggregator.reporters {
+		status := componentStatus{
+			name:  name,
+			live:  reporter.latest.Live,
+			ready: reporter.latest.Ready,
+		}
+		if reporter.timestamp.IsZero() {
+			status.live = false
+			status.ready = false
+			status.reason = "no report yet"
+		} else if age := now.Sub(reporter.timestamp); age > reporter.timeout {
+			status.live = false
+			status.ready = false
+			status.reason = fmt.Sprintf("report timed out after %v", age)
+		}
+		// Only the indicators that the component reports count against it.
+		if !reporter.reports.Live {
+			status.live = true
+		}
+		if !reporter.reports.Ready {
+			status.ready = true
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Sort(statusesByName(statuses))
+	return statuses
+}
+
+type statusesByName []componentStatus
+
+func (s statusesByName) Len() int           { return len(s) }
+func (s statusesByName) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s statusesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Summary returns the overall health: live if all the liveness reporters are live and ready
+// if all the readiness reporters are ready.
+func (aggregator *HealthAggregator) Summary() *HealthReport {
+	summary := &HealthReport{Live: true, Ready: true}
+	for _, status := range aggregator.componentStatuses() {
+		summary.Live = summary.Live && status.live
+		summary.Ready = summary.Ready && status.ready
+	}
+	return summary
+}
+
+// LivenessHandler returns an http.Handler that responds with 200 if Felix is live and 503
+// otherwise.  The body lists the liveness of each component.
+func (aggregator *HealthAggregator) LivenessHandler() http.Handler {
+	return aggregator.handler(func(s componentStatus) bool { return s.live })
+}
+
+// ReadinessHandler returns an http.Handler that responds with 200 if Felix is ready and 503
+// otherwise.  The body lists the readiness of each component.
+func (aggregator *HealthAggregator) ReadinessHandler() http.Handler {
+	return aggregator.handler(func(s componentStatus) bool { return s.ready })
+}
+
+func (aggregator *HealthAggregator) handler(healthy func(componentStatus) bool) http.Handler {
+	return http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		statuses := aggregator.componentStatuses()
+		allHealthy := true
+		for _, status := range statuses {
+			allHealthy = allHealthy && healthy(status)
+		}
+		rsp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if allHealthy {
+			rsp.WriteHeader(http.StatusOK)
+		} else {
+			rsp.WriteHeader(http.StatusServiceUnavailable)
+		}
+		for _, status := range statuses {
+			state := "ok"
+			if !healthy(status) {
+				state = "failed"
+				if status.reason != "" {
+					state += " (" + status.reason + ")"
+				}
+			}
+			fmt.Fprintf(rsp, "%s: %s\n", status.name, state)
+		}
+	})
+}
+
+// ServeHTTP serves the /liveness and /readiness endpoints on the given address.  It never
+// returns; if the server fails, it is restarted.
+func (aggregator *HealthAggregator) ServeHTTP(host string, port int) {
+	mux := http.NewServeMux()
+	mux.Handle("/liveness", aggregator.LivenessHandler())
+	mux.Handle("/readiness", aggregator.ReadinessHandler())
+	addr := net.JoinHostPort(host, fmt.Sprint(port))
+	for {
+		log.WithField("addr", addr).Info("Starting health endpoints")
+		err := http.ListenAndServe(addr, mux)
+		log.WithError(err).Error(
+			"Health endpoints failed, trying to restart them...")
+		time.Sleep(1 * time.Second)
+	}
+}
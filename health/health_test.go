@@ -0,0 +1,101 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health_test
+
+import (
+	. "github.com/projectcalico/felix/health"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("HealthAggregator", func() {
+	var aggregator *HealthAggregator
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+		aggregator = NewHealthAggregatorWithShims(func() time.Time { return now })
+		aggregator.RegisterReporter("calc", &HealthReport{Live: true, Ready: true}, 20*time.Second)
+		aggregator.RegisterReporter("dataplane", &HealthReport{Live: true}, 90*time.Second)
+	})
+
+	get := func(handler http.Handler) (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	It("should be neither live nor ready before any reports", func() {
+		Expect(*aggregator.Summary()).To(Equal(HealthReport{Live: false, Ready: false}))
+		code, body := get(aggregator.LivenessHandler())
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(Equal("calc: failed (no report yet)\ndataplane: failed (no report yet)\n"))
+	})
+
+	Describe("after all components report healthy", func() {
+		BeforeEach(func() {
+			aggregator.Report("calc", &HealthReport{Live: true, Ready: true})
+			aggregator.Report("dataplane", &HealthReport{Live: true})
+		})
+
+		It("should be live and ready", func() {
+			Expect(*aggregator.Summary()).To(Equal(HealthReport{Live: true, Ready: true}))
+			code, body := get(aggregator.ReadinessHandler())
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(Equal("calc: ok\ndataplane: ok\n"))
+		})
+
+		It("should not be ready if a readiness reporter isn't ready", func() {
+			aggregator.Report("calc", &HealthReport{Live: true, Ready: false})
+			Expect(*aggregator.Summary()).To(Equal(HealthReport{Live: true, Ready: false}))
+			code, _ := get(aggregator.LivenessHandler())
+			Expect(code).To(Equal(http.StatusOK))
+			code, body := get(aggregator.ReadinessHandler())
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(body).To(Equal("calc: failed\ndataplane: ok\n"))
+		})
+
+		It("should ignore readiness from a component that only reports liveness", func() {
+			aggregator.Report("dataplane", &HealthReport{Live: true, Ready: false})
+			Expect(*aggregator.Summary()).To(Equal(HealthReport{Live: true, Ready: true}))
+		})
+
+		It("should time out each component separately", func() {
+			now = now.Add(30 * time.Second)
+			aggregator.Report("dataplane", &HealthReport{Live: true})
+			Expect(*aggregator.Summary()).To(Equal(HealthReport{Live: false, Ready: false}))
+			code, body := get(aggregator.LivenessHandler())
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(body).To(Equal("calc: failed (report timed out after 30s)\ndataplane: ok\n"))
+
+			aggregator.Report("calc", &HealthReport{Live: true, Ready: true})
+			now = now.Add(80 * time.Second)
+			Expect(*aggregator.Summary()).To(Equal(HealthReport{Live: false, Ready: false}))
+			aggregator.Report("calc", &HealthReport{Live: true, Ready: true})
+			Expect(*aggregator.Summary()).To(Equal(HealthReport{Live: true, Ready: true}))
+		})
+	})
+
+	It("should panic on a report from an unregistered component", func() {
+		Expect(func() {
+			aggregator.Report("unknown", &HealthReport{Live: true})
+		}).To(Panic())
+	})
+})
@@ -19,11 +19,23 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/vishvananda/netlink"
 
 	"github.com/projectcalico/felix/set"
 )
 
+var (
+	countNumDampedTransitions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iface_monitor_damped_transitions",
+		Help: "Number of interface state transitions coalesced by flap damping.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(countNumDampedTransitions)
+}
+
 type netlinkStub interface {
 	Subscribe(
 		linkUpdates chan netlink.LinkUpdate,
@@ -51,6 +63,23 @@ type InterfaceMonitor struct {
 	AddrCallback AddrStateCallback
 	ifaceName    map[int]string
 	ifaceAddrs   map[int]set.Set
+
+	// DampingInterval, if non-zero, enables flap damping: rather than reporting each
+	// up/down transition as it happens, we wait until an interface's state has been stable
+	// for the interval and then report its final state (if it differs from the state that we
+	// last reported).  Must be set before calling MonitorInterfaces().
+	DampingInterval time.Duration
+	// pendingStates contains the damped state transitions that we've yet to report.
+	pendingStates map[string]pendingState
+	// reportedUpIfaces contains the interfaces that we've reported as up when damping is
+	// enabled.
+	reportedUpIfaces set.Set
+	dampingTimer     *time.Timer
+}
+
+type pendingState struct {
+	state    State
+	deadline time.Time
 }
 
 func New() *InterfaceMonitor {
@@ -66,6 +95,9 @@ func NewWithStubs(netlinkStub netlinkStub, resyncC <-chan time.Time) *InterfaceM
 		upIfaces:    set.New(),
 		ifaceName:   map[int]string{},
 		ifaceAddrs:  map[int]set.Set{},
+
+		pendingStates:    map[string]pendingState{},
+		reportedUpIfaces: set.New(),
 	}
 }
 
@@ -89,6 +121,10 @@ func (m *InterfaceMonitor) MonitorInterfaces() {
 
 readLoop:
 	for {
+		var dampingC <-chan time.Time
+		if m.dampingTimer != nil {
+			dampingC = m.dampingTimer.C
+		}
 		log.WithFields(log.Fields{
 			"updates":     updates,
 			"addrUpdates": addrUpdates,
@@ -115,11 +151,68 @@ readLoop:
 			if err != nil {
 				log.WithError(err).Fatal("Failed to read link states from netlink.")
 			}
+		case <-dampingC:
+			log.Debug("Damping timer popped")
+			m.dampingTimer = nil
+			m.reportDampedStates(time.Now())
 		}
 	}
 	log.Fatal("Failed to read events from Netlink.")
 }
 
+// notifyLinkState reports an interface state transition, either immediately or, if damping is
+// enabled, once the interface's state has been stable for the damping interval.
+func (m *InterfaceMonitor) notifyLinkState(ifaceName string, state State) {
+	if m.DampingInterval == 0 {
+		m.Callback(ifaceName, state)
+		return
+	}
+	if _, ok := m.pendingStates[ifaceName]; ok {
+		log.WithField("ifaceName", ifaceName).Debug("Interface flapping, extending damping")
+		countNumDampedTransitions.Inc()
+	}
+	deadline := time.Now().Add(m.DampingInterval)
+	m.pendingStates[ifaceName] = pendingState{state: state, deadline: deadline}
+	if m.dampingTimer == nil {
+		m.dampingTimer = time.NewTimer(m.DampingInterval)
+	}
+}
+
+// reportDampedStates reports the final state of any interfaces that have been stable for the
+// damping interval and reschedules the damping timer for the remainder.
+func (m *InterfaceMonitor) reportDampedStates(now time.Time) {
+	var nextDeadline time.Time
+	for ifaceName, pending := range m.pendingStates {
+		if pending.deadline.After(now) {
+			if nextDeadline.IsZero() || pending.deadline.Before(nextDeadline) {
+				nextDeadline = pending.deadline
+			}
+			continue
+		}
+		delete(m.pendingStates, ifaceName)
+		wasUp := m.reportedUpIfaces.Contains(ifaceName)
+		isUp := pending.state == StateUp
+		logCxt := log.WithFields(log.Fields{
+			"ifaceName": ifaceName,
+			"state":     pending.state,
+		})
+		if wasUp == isUp {
+			logCxt.Info("Interface returned to its previous state, suppressing update")
+			continue
+		}
+		logCxt.Debug("Interface state stable, reporting it")
+		if isUp {
+			m.reportedUpIfaces.Add(ifaceName)
+		} else {
+			m.reportedUpIfaces.Discard(ifaceName)
+		}
+		m.Callback(ifaceName, pending.state)
+	}
+	if !nextDeadline.IsZero() {
+		m.dampingTimer = time.NewTimer(nextDeadline.Sub(now))
+	}
+}
+
 func (m *InterfaceMonitor) handleNetlinkUpdate(update netlink.LinkUpdate) {
 	attrs := update.Attrs()
 	if attrs == nil {
@@ -237,11 +330,11 @@ func (m *InterfaceMonitor) storeAndNotifyLinkInner(ifaceExists bool, ifaceName s
 	if ifaceIsUp && !ifaceWasUp {
 		logCxt.Debug("Interface now up")
 		m.upIfaces.Add(ifaceName)
-		m.Callback(ifaceName, StateUp)
+		m.notifyLinkState(ifaceName, StateUp)
 	} else if ifaceWasUp && !ifaceIsUp {
 		logCxt.Debug("Interface now down")
 		m.upIfaces.Discard(ifaceName)
-		m.Callback(ifaceName, StateDown)
+		m.notifyLinkState(ifaceName, StateDown)
 	} else {
 		logCxt.WithField("ifaceIsUp", ifaceIsUp).Debug("Nothing to notify")
 	}
@@ -293,7 +386,7 @@ func (m *InterfaceMonitor) resync() error {
 			return nil
 		}
 		log.WithField("ifaceName", name).Info("Spotted interface removal on resync.")
-		m.Callback(name.(string), StateDown)
+		m.notifyLinkState(name.(string), StateDown)
 		m.AddrCallback(name.(string), nil)
 		return set.RemoveItem
 	})
@@ -316,8 +316,13 @@ var _ = Describe("ifacemonitor", func() {
 	var resyncC chan time.Time
 	var im *ifacemonitor.InterfaceMonitor
 	var dp *mockDataplane
+	var dampingInterval time.Duration
 
 	BeforeEach(func() {
+		dampingInterval = 0
+	})
+
+	JustBeforeEach(func() {
 		// Make an Interface Monitor that uses a test netlink stub implementation and resync
 		// trigger channel - both controlled by this code.
 		nl = &netlinkTest{
@@ -340,6 +345,7 @@ var _ = Describe("ifacemonitor", func() {
 		}
 		im.Callback = dp.linkStateCallback
 		im.AddrCallback = dp.addrStateCallback
+		im.DampingInterval = dampingInterval
 
 		// Start the monitor running, and wait until it has subscribed to our test netlink
 		// stub.
@@ -439,4 +445,33 @@ var _ = Describe("ifacemonitor", func() {
 		resyncC <- time.Time{}
 		resyncC <- time.Time{}
 	})
+
+	Describe("with flap damping", func() {
+		BeforeEach(func() {
+			dampingInterval = 200 * time.Millisecond
+		})
+
+		JustBeforeEach(func() {
+			nl.addLink("eth0")
+			resyncC <- time.Time{}
+			dp.expectAddrStateCb("eth0", "", true)
+		})
+
+		It("should coalesce a flapping link into a single update", func() {
+			nl.changeLinkState("eth0", "up")
+			nl.changeLinkState("eth0", "down")
+			nl.changeLinkState("eth0", "up")
+			Consistently(dp.linkC, "100ms").ShouldNot(Receive())
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp)
+			Consistently(dp.linkC, "300ms").ShouldNot(Receive())
+		})
+
+		It("should suppress a bounce back to the previously-reported state", func() {
+			nl.changeLinkState("eth0", "up")
+			dp.expectLinkStateCb("eth0", ifacemonitor.StateUp)
+			nl.changeLinkState("eth0", "down")
+			nl.changeLinkState("eth0", "up")
+			Consistently(dp.linkC, "400ms").ShouldNot(Receive())
+		})
+	})
 })
@@ -0,0 +1,151 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// adaptiveMinDelay is the delay that we widen to from a base delay of 0 in adaptive mode.
+const adaptiveMinDelay = 10 * time.Millisecond
+
+var gaugeApplyDelay = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "felix_int_dataplane_apply_delay_seconds",
+	Help: "Current time that the dataplane waits after it becomes dirty before applying, " +
+		"to batch up updates.",
+})
+
+func init() {
+	prometheus.MustRegister(gaugeApplyDelay)
+}
+
+// applyScheduler decides when the dataplane should apply its pending updates.
+//
+// With the default delay of 0, we apply as soon as the dataplane becomes dirty (subject to
+// the apply throttle).  With a non-zero delay, we wait for that long after the dataplane
+// first becomes dirty so that updates that arrive in quick succession get applied together.
+// Each apply runs an iptables-restore for every dirty table so that trades programming
+// latency for fewer, larger restores.
+//
+// In adaptive mode, the delay widens while the dataplane is churning: if it becomes dirty
+// again soon after an apply, we double the delay, up to maxDelay.  Once the updates slow
+// down, the delay shrinks back towards its base value.
+type applyScheduler struct {
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	adaptive  bool
+
+	currentDelay time.Duration
+	// dirtySince is the time that the dataplane became dirty, or the zero time if it's
+	// in sync.
+	dirtySince time.Time
+	// lastApply is the time that the last apply finished.
+	lastApply time.Time
+}
+
+func newApplyScheduler(baseDelay, maxDelay time.Duration, adaptive bool) *applyScheduler {
+	if maxDelay > 0 && baseDelay > maxDelay {
+		log.WithFields(log.Fields{
+			"delay":    baseDelay,
+			"maxDelay": maxDelay,
+		}).Warn("Dataplane apply delay is longer than the maximum delay, using the maximum")
+		baseDelay = maxDelay
+	}
+	s := &applyScheduler{
+		baseDelay: baseDelay,
+		maxDelay:  maxDelay,
+		adaptive:  adaptive,
+	}
+	s.setDelay(baseDelay)
+	return s
+}
+
+// OnDirty records that the dataplane has pending updates.  It's idempotent: only the first
+// call after an apply is significant.
+func (s *applyScheduler) OnDirty(now time.Time) {
+	if !s.dirtySince.IsZero() {
+		return
+	}
+	s.dirtySince = now
+	if !s.adaptive || s.lastApply.IsZero() {
+		return
+	}
+	sinceApply := now.Sub(s.lastApply)
+	switch {
+	case sinceApply < s.churnWindow():
+		// Dirty again soon after the last apply; widen the batches.
+		newDelay := s.currentDelay * 2
+		if newDelay < adaptiveMinDelay {
+			newDelay = adaptiveMinDelay
+		}
+		if s.maxDelay > 0 && newDelay > s.maxDelay {
+			newDelay = s.maxDelay
+		}
+		s.setDelay(newDelay)
+	case s.maxDelay <= 0 || sinceApply >= s.maxDelay:
+		// Been quiet for a while, go straight back to the base delay.
+		s.setDelay(s.baseDelay)
+	default:
+		// Updates slowing down, shrink the delay gradually.
+		newDelay := s.currentDelay / 2
+		if newDelay < s.baseDelay {
+			newDelay = s.baseDelay
+		}
+		s.setDelay(newDelay)
+	}
+}
+
+// churnWindow is the time after an apply within which we treat further updates as churn.
+func (s *applyScheduler) churnWindow() time.Duration {
+	if s.currentDelay < adaptiveMinDelay {
+		return adaptiveMinDelay
+	}
+	return s.currentDelay
+}
+
+func (s *applyScheduler) setDelay(delay time.Duration) {
+	if delay != s.currentDelay {
+		log.WithField("delay", delay).Debug("Updating dataplane apply delay")
+	}
+	s.currentDelay = delay
+	gaugeApplyDelay.Set(delay.Seconds())
+}
+
+// ApplyDue returns true if the pending updates have waited for long enough.
+func (s *applyScheduler) ApplyDue(now time.Time) bool {
+	if s.dirtySince.IsZero() || s.currentDelay == 0 {
+		return true
+	}
+	return !now.Before(s.NextApplyTime())
+}
+
+// NextApplyTime returns the time at which the pending updates are due to be applied.
+func (s *applyScheduler) NextApplyTime() time.Time {
+	return s.dirtySince.Add(s.currentDelay)
+}
+
+// OnApplyComplete records that an apply has finished.  If stillDirty is true, the apply
+// failed to bring the dataplane in sync; we retry after the current delay.
+func (s *applyScheduler) OnApplyComplete(now time.Time, stillDirty bool) {
+	s.lastApply = now
+	if stillDirty {
+		s.dirtySince = now
+		return
+	}
+	s.dirtySince = time.Time{}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Apply scheduler", func() {
+	var (
+		sched *applyScheduler
+		t0    time.Time
+	)
+
+	at := func(millis int) time.Time {
+		return t0.Add(time.Duration(millis) * time.Millisecond)
+	}
+
+	BeforeEach(func() {
+		t0 = time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	Describe("with the default config", func() {
+		BeforeEach(func() {
+			sched = newApplyScheduler(0, time.Second, false)
+		})
+
+		It("should apply immediately", func() {
+			sched.OnDirty(at(0))
+			Expect(sched.ApplyDue(at(0))).To(BeTrue())
+		})
+	})
+
+	Describe("with a fixed delay", func() {
+		BeforeEach(func() {
+			sched = newApplyScheduler(100*time.Millisecond, time.Second, false)
+		})
+
+		It("should wait for the delay after the dataplane first becomes dirty", func() {
+			sched.OnDirty(at(0))
+			sched.OnDirty(at(50))
+			Expect(sched.ApplyDue(at(99))).To(BeFalse())
+			Expect(sched.NextApplyTime()).To(Equal(at(100)))
+			Expect(sched.ApplyDue(at(100))).To(BeTrue())
+		})
+		It("should not change the delay under churn", func() {
+			sched.OnDirty(at(0))
+			sched.OnApplyComplete(at(100), false)
+			sched.OnDirty(at(101))
+			Expect(sched.NextApplyTime()).To(Equal(at(201)))
+		})
+		It("should retry after the delay if the apply fails", func() {
+			sched.OnDirty(at(0))
+			sched.OnApplyComplete(at(100), true)
+			sched.OnDirty(at(150))
+			Expect(sched.NextApplyTime()).To(Equal(at(200)))
+		})
+	})
+
+	It("should clamp the delay to the maximum", func() {
+		sched = newApplyScheduler(2*time.Second, time.Second, false)
+		sched.OnDirty(at(0))
+		Expect(sched.NextApplyTime()).To(Equal(at(1000)))
+	})
+
+	Describe("in adaptive mode", func() {
+		BeforeEach(func() {
+			sched = newApplyScheduler(0, 100*time.Millisecond, true)
+		})
+
+		// churn simulates an update arriving immediately after each apply.
+		churn := func(n int) (now int) {
+			for i := 0; i < n; i++ {
+				sched.OnDirty(at(now))
+				now = int(sched.NextApplyTime().Sub(t0) / time.Millisecond)
+				Expect(sched.ApplyDue(at(now))).To(BeTrue())
+				sched.OnApplyComplete(at(now), false)
+				now++
+			}
+			return
+		}
+
+		It("should start with the base delay", func() {
+			sched.OnDirty(at(0))
+			Expect(sched.ApplyDue(at(0))).To(BeTrue())
+		})
+		It("should widen the delay under churn, up to the maximum", func() {
+			churn(1)
+			Expect(sched.currentDelay).To(BeZero())
+			churn(1)
+			Expect(sched.currentDelay).To(Equal(10 * time.Millisecond))
+			churn(1)
+			Expect(sched.currentDelay).To(Equal(20 * time.Millisecond))
+			churn(10)
+			Expect(sched.currentDelay).To(Equal(100 * time.Millisecond))
+		})
+		It("should shrink the delay as updates slow down", func() {
+			now := churn(5)
+			Expect(sched.currentDelay).To(Equal(80 * time.Millisecond))
+			sched.OnDirty(at(now + 90))
+			Expect(sched.currentDelay).To(Equal(40 * time.Millisecond))
+		})
+		It("should return to the base delay once updates stop", func() {
+			now := churn(5)
+			sched.OnDirty(at(now + 100))
+			Expect(sched.currentDelay).To(BeZero())
+		})
+	})
+})
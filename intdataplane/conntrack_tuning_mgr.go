@@ -0,0 +1,148 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	conntrackMaxPath                   = "/proc/sys/net/netfilter/nf_conntrack_max"
+	conntrackTCPEstablishedTimeoutPath = "/proc/sys/net/netfilter/nf_conntrack_tcp_timeout_established"
+	conntrackUDPTimeoutPath            = "/proc/sys/net/netfilter/nf_conntrack_udp_timeout"
+	conntrackGenericTimeoutPath        = "/proc/sys/net/netfilter/nf_conntrack_generic_timeout"
+)
+
+// ConntrackTuning controls the size of the conntrack table and the protocol timeouts.  Zero
+// values leave the kernel's setting alone.
+type ConntrackTuning struct {
+	MaxEntries            int
+	TCPEstablishedTimeout time.Duration
+	UDPTimeout            time.Duration
+	GenericTimeout        time.Duration
+}
+
+// Enabled returns true if any of the settings are non-zero.
+func (t ConntrackTuning) Enabled() bool {
+	return t.MaxEntries != 0 ||
+		t.TCPEstablishedTimeout != 0 ||
+		t.UDPTimeout != 0 ||
+		t.GenericTimeout != 0
+}
+
+type procSysSetting struct {
+	path  string
+	value string
+}
+
+// conntrackTuningManager applies the configured conntrack table size and timeouts.  It
+// checks the settings on the first apply and again after each call to QueueResync(), since
+// another process (or the loading of the nf_conntrack module) may have reset them.  Each
+// value that we write is read back to verify that the kernel accepted it.
+type conntrackTuningManager struct {
+	settings []procSysSetting
+	inSync   bool
+
+	// Shims for testing.
+	readProcSys  func(path string) (string, error)
+	writeProcSys procSysWriter
+}
+
+func newConntrackTuningManager(tuning ConntrackTuning) *conntrackTuningManager {
+	return newConntrackTuningManagerWithShims(tuning, readProcSys, writeProcSys)
+}
+
+func newConntrackTuningManagerWithShims(
+	tuning ConntrackTuning,
+	readProcSys func(path string) (string, error),
+	writeProcSys procSysWriter,
+) *conntrackTuningManager {
+	var settings []procSysSetting
+	addSetting := func(path string, value int) {
+		if value == 0 {
+			return
+		}
+		settings = append(settings, procSysSetting{path: path, value: fmt.Sprint(value)})
+	}
+	addSetting(conntrackMaxPath, tuning.MaxEntries)
+	addSetting(conntrackTCPEstablishedTimeoutPath, int(tuning.TCPEstablishedTimeout.Seconds()))
+	addSetting(conntrackUDPTimeoutPath, int(tuning.UDPTimeout.Seconds()))
+	addSetting(conntrackGenericTimeoutPath, int(tuning.GenericTimeout.Seconds()))
+	return &conntrackTuningManager{
+		settings:     settings,
+		readProcSys:  readProcSys,
+		writeProcSys: writeProcSys,
+	}
+}
+
+func (m *conntrackTuningManager) OnUpdate(msg interface{}) {
+}
+
+// QueueResync forces a check of the settings on the next call to CompleteDeferredWork().
+func (m *conntrackTuningManager) QueueResync() {
+	m.inSync = false
+}
+
+func (m *conntrackTuningManager) CompleteDeferredWork() error {
+	if m.inSync {
+		return nil
+	}
+	for _, s := range m.settings {
+		if err := m.applySetting(s); err != nil {
+			log.WithError(err).WithField("path", s.path).Warn(
+				"Failed to apply conntrack setting, will retry...")
+			return err
+		}
+	}
+	m.inSync = true
+	return nil
+}
+
+func (m *conntrackTuningManager) applySetting(s procSysSetting) error {
+	logCxt := log.WithFields(log.Fields{"path": s.path, "value": s.value})
+	current, err := m.readProcSys(s.path)
+	if err != nil {
+		return err
+	}
+	if current == s.value {
+		logCxt.Debug("Conntrack setting already correct")
+		return nil
+	}
+	logCxt.WithField("oldValue", current).Info("Updating conntrack setting")
+	if err := m.writeProcSys(s.path, s.value); err != nil {
+		return err
+	}
+	current, err = m.readProcSys(s.path)
+	if err != nil {
+		return err
+	}
+	if current != s.value {
+		return fmt.Errorf("kernel rejected value %s for %s, read back %s", s.value, s.path, current)
+	}
+	return nil
+}
+
+func readProcSys(path string) (string, error) {
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"time"
+)
+
+var _ = Describe("Conntrack tuning manager", func() {
+	var (
+		mgr      *conntrackTuningManager
+		procSys  map[string]string
+		writes   []string
+		rejected bool
+	)
+
+	BeforeEach(func() {
+		procSys = map[string]string{
+			conntrackMaxPath:                   "65536",
+			conntrackTCPEstablishedTimeoutPath: "432000",
+			conntrackUDPTimeoutPath:            "30",
+			conntrackGenericTimeoutPath:        "600",
+		}
+		writes = nil
+		rejected = false
+		mgr = newConntrackTuningManagerWithShims(
+			ConntrackTuning{
+				MaxEntries:            1000000,
+				TCPEstablishedTimeout: time.Hour,
+				UDPTimeout:            30 * time.Second,
+			},
+			func(path string) (string, error) {
+				value, ok := procSys[path]
+				if !ok {
+					return "", errors.New("no such file")
+				}
+				return value, nil
+			},
+			func(path, value string) error {
+				writes = append(writes, path+"="+value)
+				if !rejected {
+					procSys[path] = value
+				}
+				return nil
+			},
+		)
+	})
+
+	It("should only write the settings that differ", func() {
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		Expect(writes).To(Equal([]string{
+			conntrackMaxPath + "=1000000",
+			conntrackTCPEstablishedTimeoutPath + "=3600",
+		}))
+		Expect(procSys[conntrackGenericTimeoutPath]).To(Equal("600"))
+	})
+
+	It("should do nothing on the next apply", func() {
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		procSys[conntrackMaxPath] = "65536"
+		writes = nil
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		Expect(writes).To(BeEmpty())
+	})
+
+	It("should reapply settings after a resync", func() {
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		procSys[conntrackMaxPath] = "65536"
+		writes = nil
+		mgr.QueueResync()
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		Expect(writes).To(Equal([]string{conntrackMaxPath + "=1000000"}))
+	})
+
+	It("should return an error and retry if the kernel rejects a value", func() {
+		rejected = true
+		Expect(mgr.CompleteDeferredWork()).NotTo(Succeed())
+		rejected = false
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		Expect(procSys[conntrackMaxPath]).To(Equal("1000000"))
+	})
+
+	It("should return an error if the setting can't be read", func() {
+		delete(procSys, conntrackMaxPath)
+		Expect(mgr.CompleteDeferredWork()).NotTo(Succeed())
+	})
+
+	It("should only be enabled if something is set", func() {
+		Expect(ConntrackTuning{}.Enabled()).To(BeFalse())
+		Expect(ConntrackTuning{UDPTimeout: time.Second}.Enabled()).To(BeTrue())
+	})
+})
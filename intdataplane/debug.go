@@ -0,0 +1,159 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+// iptablesStateSnapshot is the JSON document served by the iptables state debug handler.
+type iptablesStateSnapshot struct {
+	Time   time.Time                 `json:"time"`
+	Tables []*iptables.TableSnapshot `json:"tables"`
+}
+
+// iptablesStateCache holds the most recent snapshot of our iptables Tables.  The Tables
+// aren't thread-safe so the snapshot is taken by the dataplane goroutine at the end of each
+// apply and then served from the cache.
+type iptablesStateCache struct {
+	lock     sync.Mutex
+	snapshot *iptablesStateSnapshot
+}
+
+func (c *iptablesStateCache) Update(tables []iptablesTableInfo) {
+	snapshot := &iptablesStateSnapshot{Time: time.Now()}
+	for _, t := range tables {
+		snapshot.Tables = append(snapshot.Tables, t.Snapshot())
+	}
+	c.lock.Lock()
+	c.snapshot = snapshot
+	c.lock.Unlock()
+}
+
+func (c *iptablesStateCache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.lock.Lock()
+	snapshot := c.snapshot
+	c.lock.Unlock()
+	if snapshot == nil {
+		http.Error(w, "Dataplane not yet programmed", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(snapshot); err != nil {
+		log.WithError(err).Warn("Failed to write iptables state debug response")
+	}
+}
+
+// IptablesStateHandler returns an HTTP handler that serves, as JSON, the desired and actual
+// state of each of our iptables tables as of the most recent apply.  It returns nil unless
+// Config.IptablesStateSnapshots is set.
+func (d *InternalDataplane) IptablesStateHandler() http.Handler {
+	if d.iptablesStateCache == nil {
+		return nil
+	}
+	return d.iptablesStateCache
+}
+
+// newIptablesAuditLog creates the audit log that records our iptables updates, or returns nil
+// if auditing is disabled.
+func newIptablesAuditLog(size int, path string) *iptables.AuditLog {
+	if size == 0 && path == "" {
+		return nil
+	}
+	var out io.Writer
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.WithError(err).WithField("path", path).Panic("Failed to open iptables audit log file")
+		}
+		log.WithField("path", path).Info("Writing iptables audit log to file")
+		out = f
+	}
+	return iptables.NewAuditLog(size, out)
+}
+
+// IptablesAuditHandler returns an HTTP handler that serves, as JSON, the most recent updates
+// that we've made to iptables.  It returns nil unless Config.IptablesAuditLogSize is set.
+func (d *InternalDataplane) IptablesAuditHandler() http.Handler {
+	if d.config.IptablesAuditLogSize == 0 || d.iptablesAuditLog == nil {
+		return nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(d.iptablesAuditLog.Events()); err != nil {
+			log.WithError(err).Warn("Failed to write iptables audit debug response")
+		}
+	})
+}
+
+// CacheDumpHandler returns an HTTP handler that, when POSTed to, asks the main loop to log
+// the state of our iptables and IP set caches.  It returns once the request is queued, since
+// the main loop may be busy with an apply.
+func (d *InternalDataplane) CacheDumpHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		select {
+		case d.cacheDumpRequests <- struct{}{}:
+		default:
+			// A dump is already queued, no need for another.
+		}
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "Cache dump queued, see the Felix log for the output.\n")
+	})
+}
+
+// cacheDumper is implemented by the programming layer objects that can log the contents of
+// their caches.
+type cacheDumper interface {
+	DumpCacheToLog()
+}
+
+func (d *InternalDataplane) dumpCachesToLog() {
+	log.Info("Dumping dataplane caches to log")
+	for _, t := range d.allIptablesTables {
+		snapshot, err := json.Marshal(t.Snapshot())
+		if err != nil {
+			log.WithError(err).Warn("Failed to marshal iptables table snapshot")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"table":     t.name,
+			"ipVersion": t.ipVersion,
+			"snapshot":  string(snapshot),
+		}).Info("Cached state of iptables table")
+	}
+	for _, ipSets := range d.ipSets {
+		if dumper, ok := ipSets.IPSets.(cacheDumper); ok {
+			dumper.DumpCacheToLog()
+		}
+	}
+	log.Info("Finished dumping dataplane caches to log")
+}
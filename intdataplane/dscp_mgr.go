@@ -0,0 +1,126 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/rules"
+)
+
+// dscpManager programs the 'cali-from-wl-dscp' chain in the iptables 'mangle' table, which
+// applies the DSCP treatment (preserve, zero or map) for packets from each local workload
+// endpoint.  This prevents workloads from self-assigning a premium QoS class.  Each endpoint
+// can ask for its own mode, using the calc.DSCPModeLabel label.  Since anyone who can label a
+// workload can set that label, we only honour it if it is at least as strict as the configured
+// default; other endpoints get the default.  The chain is statically linked from
+// cali-PREROUTING in the mangle table.
+type dscpManager struct {
+	// Our dependencies.
+	mangleTable  iptablesTable
+	ruleRenderer rules.RuleRenderer
+
+	defaultMode string
+
+	// Internal state.
+	activeChain     *iptables.Chain
+	endpointToIface map[proto.WorkloadEndpointID]string
+	endpointToMode  map[proto.WorkloadEndpointID]string
+	dirty           bool
+}
+
+func newDSCPManager(
+	mangleTable iptablesTable,
+	ruleRenderer rules.RuleRenderer,
+	defaultMode string,
+) *dscpManager {
+	if defaultMode == "" {
+		defaultMode = rules.DSCPModePreserve
+	}
+	return &dscpManager{
+		mangleTable:  mangleTable,
+		ruleRenderer: ruleRenderer,
+		defaultMode:  defaultMode,
+
+		endpointToIface: map[proto.WorkloadEndpointID]string{},
+		endpointToMode:  map[proto.WorkloadEndpointID]string{},
+		dirty:           true,
+	}
+}
+
+// dscpModeStrictness orders the DSCP modes by how much control they take away from the
+// workload.
+var dscpModeStrictness = map[string]int{
+	rules.DSCPModePreserve: 0,
+	rules.DSCPModeMap:      1,
+	rules.DSCPModeZero:     2,
+}
+
+// effectiveMode returns the mode to use for an endpoint that asked for the given mode: the
+// requested mode if it is at least as strict as the default, otherwise the default.
+func (m *dscpManager) effectiveMode(requested string) string {
+	strictness, ok := dscpModeStrictness[requested]
+	if !ok || strictness < dscpModeStrictness[m.defaultMode] {
+		return m.defaultMode
+	}
+	return requested
+}
+
+func (m *dscpManager) OnUpdate(protoBufMsg interface{}) {
+	switch msg := protoBufMsg.(type) {
+	case *proto.WorkloadEndpointUpdate:
+		mode := m.effectiveMode(msg.Endpoint.DscpMode)
+		if mode != msg.Endpoint.DscpMode && msg.Endpoint.DscpMode != "" {
+			log.WithFields(log.Fields{
+				"id":        msg.Id,
+				"requested": msg.Endpoint.DscpMode,
+				"default":   m.defaultMode,
+			}).Info("Ignoring endpoint DSCP mode that is less strict than the default")
+		}
+		m.endpointToIface[*msg.Id] = msg.Endpoint.Name
+		m.endpointToMode[*msg.Id] = mode
+		m.dirty = true
+	case *proto.WorkloadEndpointRemove:
+		delete(m.endpointToIface, *msg.Id)
+		delete(m.endpointToMode, *msg.Id)
+		m.dirty = true
+	}
+}
+
+func (m *dscpManager) CompleteDeferredWork() error {
+	if !m.dirty {
+		return nil
+	}
+	ifaceToMode := map[string]string{}
+	for id, ifaceName := range m.endpointToIface {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"iface": ifaceName,
+			"mode":  m.endpointToMode[id],
+		}).Debug("Workload DSCP mode")
+		ifaceToMode[ifaceName] = m.endpointToMode[id]
+	}
+	chain := m.ruleRenderer.WorkloadDSCPChain(ifaceToMode)
+	if !reflect.DeepEqual(m.activeChain, chain) {
+		m.mangleTable.UpdateChain(chain)
+		m.activeChain = chain
+	}
+	m.dirty = false
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/rules"
+)
+
+var _ = Describe("DSCP manager", func() {
+	var (
+		dscpMgr     *dscpManager
+		mangleTable *mockTable
+		defaultMode string
+	)
+
+	BeforeEach(func() {
+		defaultMode = "map"
+	})
+
+	JustBeforeEach(func() {
+		renderer := rules.NewRenderer(rules.Config{
+			IPSetConfigV4:      ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+			IPSetConfigV6:      ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+			IptablesMarkAccept: 0x8,
+			IptablesMarkPass:   0x10,
+		})
+		mangleTable = newMockTable("mangle")
+		dscpMgr = newDSCPManager(mangleTable, renderer, defaultMode)
+	})
+
+	endpointUpdate := func(workloadID, ifaceName, mode string) *proto.WorkloadEndpointUpdate {
+		return &proto.WorkloadEndpointUpdate{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "k8s",
+				WorkloadId:     workloadID,
+				EndpointId:     "eth0",
+			},
+			Endpoint: &proto.WorkloadEndpoint{
+				State:    "up",
+				Name:     ifaceName,
+				DscpMode: mode,
+			},
+		}
+	}
+
+	It("should program an empty chain at start of day", func() {
+		dscpMgr.CompleteDeferredWork()
+		mangleTable.checkChains([][]*iptables.Chain{{{
+			Name:  "cali-from-wl-dscp",
+			Rules: []iptables.Rule{},
+		}}})
+	})
+
+	Context("with endpoints using default and explicit modes", func() {
+		JustBeforeEach(func() {
+			dscpMgr.OnUpdate(endpointUpdate("pod-1", "cali1", ""))
+			dscpMgr.OnUpdate(endpointUpdate("pod-2", "cali2", "zero"))
+			dscpMgr.CompleteDeferredWork()
+		})
+
+		It("should program the per-endpoint rules", func() {
+			mangleTable.checkChains([][]*iptables.Chain{{{
+				Name: "cali-from-wl-dscp",
+				Rules: []iptables.Rule{
+					{
+						Match:  iptables.Match().InInterface("cali1"),
+						Action: iptables.GotoAction{Target: "cali-dscp-map"},
+					},
+					{
+						Match:  iptables.Match().InInterface("cali2"),
+						Action: iptables.GotoAction{Target: "cali-dscp-zero"},
+					},
+				},
+			}}})
+		})
+
+		It("should ignore a mode that is less strict than the default", func() {
+			dscpMgr.OnUpdate(endpointUpdate("pod-3", "cali3", "preserve"))
+			dscpMgr.CompleteDeferredWork()
+			chain := mangleTable.currentChains["cali-from-wl-dscp"]
+			Expect(chain.Rules).To(HaveLen(3))
+			Expect(chain.Rules[2]).To(Equal(iptables.Rule{
+				Match:  iptables.Match().InInterface("cali3"),
+				Action: iptables.GotoAction{Target: "cali-dscp-map"},
+			}))
+		})
+
+		It("should remove the rule when the endpoint is removed", func() {
+			dscpMgr.OnUpdate(&proto.WorkloadEndpointRemove{
+				Id: &proto.WorkloadEndpointID{
+					OrchestratorId: "k8s",
+					WorkloadId:     "pod-1",
+					EndpointId:     "eth0",
+				},
+			})
+			dscpMgr.CompleteDeferredWork()
+			mangleTable.checkChains([][]*iptables.Chain{{{
+				Name: "cali-from-wl-dscp",
+				Rules: []iptables.Rule{
+					{
+						Match:  iptables.Match().InInterface("cali2"),
+						Action: iptables.GotoAction{Target: "cali-dscp-zero"},
+					},
+				},
+			}}})
+		})
+
+		It("should not rewrite the chain if nothing changed", func() {
+			mangleTable.UpdateCalled = false
+			dscpMgr.OnUpdate(endpointUpdate("pod-2", "cali2", "zero"))
+			dscpMgr.CompleteDeferredWork()
+			Expect(mangleTable.UpdateCalled).To(BeFalse())
+		})
+	})
+})
@@ -17,6 +17,7 @@ package intdataplane
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"reflect"
@@ -36,6 +37,7 @@ import (
 
 type routeTable interface {
 	SetRoutes(ifaceName string, targets []routetable.Target)
+	Conflicts() []routetable.RouteConflict
 }
 
 // endpointManager manages the dataplane resources that belong to each endpoint as well as
@@ -76,6 +78,10 @@ type endpointManager struct {
 	// their configuration (sysctls etc.) refreshed.
 	wlIfaceNamesToReconfigure set.Set
 
+	// wlIfaceNamesWithRouteConflicts contains names of workload interfaces whose routes are
+	// blocked by a conflicting route.  We report such endpoints as being in error.
+	wlIfaceNamesWithRouteConflicts set.Set
+
 	// epIDsToUpdateStatus contains IDs of endpoints that we need to report status for.
 	// Mix of host and workload endpoint IDs.
 	epIDsToUpdateStatus set.Set
@@ -163,7 +169,8 @@ func newEndpointManagerWithShims(
 		activeWlIfaceNameToID: map[string]proto.WorkloadEndpointID{},
 		activeWlIDToChains:    map[proto.WorkloadEndpointID][]*iptables.Chain{},
 
-		wlIfaceNamesToReconfigure: set.New(),
+		wlIfaceNamesToReconfigure:      set.New(),
+		wlIfaceNamesWithRouteConflicts: set.New(),
 
 		epIDsToUpdateStatus: set.New(),
 
@@ -244,6 +251,7 @@ func (m *endpointManager) CompleteDeferredWork() error {
 	}
 
 	m.resolveWorkloadEndpoints()
+	m.updateRouteConflicts()
 
 	if m.hostEndpointsDirty {
 		log.Debug("Host endpoints updated, resolving them.")
@@ -257,6 +265,31 @@ func (m *endpointManager) CompleteDeferredWork() error {
 	return nil
 }
 
+// updateRouteConflicts picks up the current route conflicts from the route table and marks any
+// endpoints whose conflict state has changed for a status update.
+func (m *endpointManager) updateRouteConflicts() {
+	ifaceNames := set.New()
+	for _, conflict := range m.routeTable.Conflicts() {
+		ifaceNames.Add(conflict.IfaceName)
+	}
+	m.wlIfaceNamesWithRouteConflicts.Iter(func(item interface{}) error {
+		ifaceName := item.(string)
+		if !ifaceNames.Contains(ifaceName) {
+			m.markEndpointStatusDirtyByIface(ifaceName)
+			return set.RemoveItem
+		}
+		return nil
+	})
+	ifaceNames.Iter(func(item interface{}) error {
+		ifaceName := item.(string)
+		if !m.wlIfaceNamesWithRouteConflicts.Contains(ifaceName) {
+			m.markEndpointStatusDirtyByIface(ifaceName)
+			m.wlIfaceNamesWithRouteConflicts.Add(ifaceName)
+		}
+		return nil
+	})
+}
+
 func (m *endpointManager) markEndpointStatusDirtyByIface(ifaceName string) {
 	logCxt := log.WithField("ifaceName", ifaceName)
 	if epID, ok := m.activeWlIfaceNameToID[ifaceName]; ok {
@@ -297,7 +330,8 @@ func (m *endpointManager) calculateWorkloadEndpointStatus(id proto.WorkloadEndpo
 	if known {
 		adminUp = workload.State == "active"
 		operUp = m.activeUpIfaces.Contains(workload.Name)
-		failed = m.wlIfaceNamesToReconfigure.Contains(workload.Name)
+		failed = m.wlIfaceNamesToReconfigure.Contains(workload.Name) ||
+			m.wlIfaceNamesWithRouteConflicts.Contains(workload.Name)
 	}
 
 	// Note: if endpoint is not known (i.e. has been deleted), status will be "", which signals
@@ -366,6 +400,20 @@ func (m *endpointManager) calculateHostEndpointStatus(id proto.HostEndpointID) (
 	return status
 }
 
+// workloadSourceNets returns the nets, of our IP version, that the workload may send from.
+func (m *endpointManager) workloadSourceNets(workload *proto.WorkloadEndpoint) []string {
+	var nets []string
+	if m.ipVersion == 4 {
+		nets = append(nets, workload.Ipv4Nets...)
+	} else {
+		nets = append(nets, workload.Ipv6Nets...)
+		// The workload also sends from its link-local address; for example, for
+		// neighbor discovery.
+		nets = append(nets, "fe80::/10")
+	}
+	return nets
+}
+
 func (m *endpointManager) resolveWorkloadEndpoints() {
 	if len(m.pendingWlEpUpdates) > 0 {
 		// We're about to make endpoint updates, make sure we recheck the dispatch chains.
@@ -385,16 +433,14 @@ func (m *endpointManager) resolveWorkloadEndpoints() {
 				m.wlIfaceNamesToReconfigure.Discard(oldWorkload.Name)
 				delete(m.activeWlIfaceNameToID, oldWorkload.Name)
 			}
-			var policyNames []string
-			if len(workload.Tiers) > 0 {
-				policyNames = workload.Tiers[0].Policies
-			}
 			adminUp := workload.State == "active"
 			chains := m.ruleRenderer.WorkloadEndpointToIptablesChains(
 				workload.Name,
 				adminUp,
-				policyNames,
+				workload.Tiers,
 				workload.ProfileIds,
+				m.workloadSourceNets(workload),
+				workload.Mac,
 			)
 			m.filterTable.UpdateChains(chains)
 			m.activeWlIDToChains[id] = chains
@@ -612,13 +658,9 @@ func (m *endpointManager) resolveHostEndpoints() {
 		hostEp := m.rawHostEndpoints[id]
 
 		// Update the filter chain, for normal traffic.
-		var policyNames []string
-		if len(hostEp.Tiers) > 0 {
-			policyNames = hostEp.Tiers[0].Policies
-		}
 		filtChains := m.ruleRenderer.HostEndpointToFilterChains(
 			ifaceName,
-			policyNames,
+			hostEp.Tiers,
 			hostEp.ProfileIds,
 		)
 		if !reflect.DeepEqual(filtChains, m.activeHostIfaceToFiltChains[ifaceName]) {
@@ -634,13 +676,9 @@ func (m *endpointManager) resolveHostEndpoints() {
 		hostEp := m.rawHostEndpoints[id]
 
 		// Update the raw chain, for untracked traffic.
-		var policyNames []string
-		if len(hostEp.UntrackedTiers) > 0 {
-			policyNames = hostEp.UntrackedTiers[0].Policies
-		}
 		rawChains := m.ruleRenderer.HostEndpointToRawChains(
 			ifaceName,
-			policyNames,
+			hostEp.UntrackedTiers,
 		)
 		if !reflect.DeepEqual(rawChains, m.activeHostIfaceToRawChains[ifaceName]) {
 			m.rawTable.UpdateChains(rawChains)
@@ -790,3 +828,20 @@ func writeProcSys(path, value string) error {
 	}
 	return err
 }
+
+// readOnlyWriteProcSys is the procSysWriter that we use in read-only mode.  Rather than writing
+// the value, it logs a warning if the current value differs.
+func readOnlyWriteProcSys(path, value string) error {
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(current)) != value {
+		log.WithFields(log.Fields{
+			"path":     path,
+			"current":  strings.TrimSpace(string(current)),
+			"expected": value,
+		}).Warn("Read-only mode: /proc/sys value differs from desired value, not updating it")
+	}
+	return nil
+}
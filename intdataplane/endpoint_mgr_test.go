@@ -150,7 +150,7 @@ func chainsForIfaces(ifaceMetadata []string, host bool, raw bool) []*iptables.Ch
 			outRules = append(outRules, iptables.Rule{
 				Match:   iptables.Match(),
 				Action:  iptables.ClearMarkAction{Mark: 16},
-				Comment: "Start of policies",
+				Comment: "Start of tier default",
 			})
 			outRules = append(outRules, iptables.Rule{
 				Match:  iptables.Match().MarkClear(16),
@@ -216,7 +216,7 @@ func chainsForIfaces(ifaceMetadata []string, host bool, raw bool) []*iptables.Ch
 			inRules = append(inRules, iptables.Rule{
 				Match:   iptables.Match(),
 				Action:  iptables.ClearMarkAction{Mark: 16},
-				Comment: "Start of policies",
+				Comment: "Start of tier default",
 			})
 			// For untracked policy, we expect a tier with a policy in it.
 			inRules = append(inRules, iptables.Rule{
@@ -306,6 +306,7 @@ func chainsForIfaces(ifaceMetadata []string, host bool, raw bool) []*iptables.Ch
 
 type mockRouteTable struct {
 	currentRoutes map[string][]routetable.Target
+	conflicts     []routetable.RouteConflict
 }
 
 func (t *mockRouteTable) SetRoutes(ifaceName string, targets []routetable.Target) {
@@ -316,6 +317,10 @@ func (t *mockRouteTable) SetRoutes(ifaceName string, targets []routetable.Target
 	t.currentRoutes[ifaceName] = targets
 }
 
+func (t *mockRouteTable) Conflicts() []routetable.RouteConflict {
+	return t.conflicts
+}
+
 func (t *mockRouteTable) checkRoutes(ifaceName string, expected []routetable.Target) {
 	Expect(t.currentRoutes[ifaceName]).To(Equal(expected))
 }
@@ -874,6 +879,54 @@ func endpointManagerTests(ipVersion uint8) func() {
 
 		Describe("workload endpoints", func() {
 
+			Context("with the workload source check enabled", func() {
+				BeforeEach(func() {
+					rrConfigNormal.WorkloadSourceCheck = rules.SourceCheckIP
+				})
+				JustBeforeEach(func() {
+					epMgr.OnUpdate(&proto.WorkloadEndpointUpdate{
+						Id: &proto.WorkloadEndpointID{
+							OrchestratorId: "k8s",
+							WorkloadId:     "pod-11",
+							EndpointId:     "endpoint-id-11",
+						},
+						Endpoint: &proto.WorkloadEndpoint{
+							State:      "active",
+							Name:       "cali12345-ab",
+							ProfileIds: []string{},
+							Tiers:      []*proto.TierInfo{},
+							Ipv4Nets:   []string{"10.0.240.2/32", "10.0.240.3/32"},
+							Ipv6Nets:   []string{"2001:db8:2::2/128"},
+						},
+					})
+					epMgr.CompleteDeferredWork()
+				})
+
+				It("should allow the endpoint's addresses of the right IP version", func() {
+					nets := []string{"10.0.240.2/32", "10.0.240.3/32"}
+					if ipVersion == 6 {
+						nets = []string{"2001:db8:2::2/128", "fe80::/10"}
+					}
+					expectedRules := []iptables.Rule{
+						{Action: iptables.ClearMarkAction{Mark: 0x8}},
+					}
+					for _, n := range nets {
+						expectedRules = append(expectedRules, iptables.Rule{
+							Match:  iptables.Match().SourceNet(n),
+							Action: iptables.SetMarkAction{Mark: 0x8},
+						})
+					}
+					expectedRules = append(expectedRules, iptables.Rule{
+						Match:   iptables.Match().MarkClear(0x8),
+						Action:  iptables.DropAction{},
+						Comment: "Drop packets from spoofed source IP",
+					})
+					chain := filterTable.currentChains["cali-fw-cali12345-ab"]
+					Expect(chain).NotTo(BeNil())
+					Expect(chain.Rules[:len(expectedRules)]).To(Equal(expectedRules))
+				})
+			})
+
 			Context("with a workload endpoint", func() {
 				wlEPID1 := proto.WorkloadEndpointID{
 					OrchestratorId: "k8s",
@@ -957,6 +1010,30 @@ func endpointManagerTests(ipVersion uint8) func() {
 						}))
 					})
 
+					Context("with a conflicting route", func() {
+						JustBeforeEach(func() {
+							routeTable.conflicts = []routetable.RouteConflict{{
+								CIDR:      ip.MustParseCIDR("10.0.240.0/24"),
+								IfaceName: "cali12345-ab",
+							}}
+							epMgr.CompleteDeferredWork()
+						})
+
+						It("should report the endpoint in error", func() {
+							Expect(statusReportRec.currentState).To(Equal(map[interface{}]string{
+								wlEPID1: "error",
+							}))
+						})
+
+						It("should report the endpoint up once the conflict is resolved", func() {
+							routeTable.conflicts = nil
+							epMgr.CompleteDeferredWork()
+							Expect(statusReportRec.currentState).To(Equal(map[interface{}]string{
+								wlEPID1: "up",
+							}))
+						})
+					})
+
 					It("should write /proc/sys entries", func() {
 						if ipVersion == 6 {
 							mockProcSys.checkState(map[string]string{
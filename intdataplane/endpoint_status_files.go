@@ -0,0 +1,155 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// endpointStatusFiles maintains a directory that contains a file for each local workload
+// endpoint that is up with its policy programmed.  The CNI plugin (or a readiness gate) can
+// wait for the file before declaring the pod ready.  Like the policy ready file, the directory
+// is emptied at start of day so that a stale file can't be mistaken for programmed policy.
+type endpointStatusFiles struct {
+	dir string
+
+	// pendingStatuses contains the statuses that we've been told about but have yet to
+	// reflect in the directory.  An empty status means that the endpoint was removed.
+	pendingStatuses map[proto.WorkloadEndpointID]string
+
+	// Shims for testing.
+	timeNow func() time.Time
+}
+
+// endpointStatusFileContents is written, as JSON, to each file.
+type endpointStatusFileContents struct {
+	OrchestratorID string    `json:"orchestratorID"`
+	WorkloadID     string    `json:"workloadID"`
+	EndpointID     string    `json:"endpointID"`
+	Time           time.Time `json:"time"`
+}
+
+func newEndpointStatusFiles(dir string) *endpointStatusFiles {
+	return &endpointStatusFiles{
+		dir:             dir,
+		pendingStatuses: map[proto.WorkloadEndpointID]string{},
+		timeNow:         time.Now,
+	}
+}
+
+// endpointStatusFilename returns the name of the status file for the given endpoint.  It
+// joins the parts of the ID with spaces after escaping them so that, for example, the "/" in
+// a Kubernetes workload ID can't escape the directory.
+func endpointStatusFilename(id proto.WorkloadEndpointID) string {
+	return strings.Join([]string{
+		url.PathEscape(id.OrchestratorId),
+		url.PathEscape(id.WorkloadId),
+		url.PathEscape(id.EndpointId),
+	}, " ")
+}
+
+// RemoveAll removes any files left in the directory, creating it if needed.  It is a no-op if
+// no directory was configured.
+func (f *endpointStatusFiles) RemoveAll() {
+	if f.dir == "" {
+		return
+	}
+	logCxt := log.WithField("dir", f.dir)
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		logCxt.WithError(err).Warn("Failed to create endpoint status directory")
+		return
+	}
+	names, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to list endpoint status directory")
+		return
+	}
+	for _, info := range names {
+		if info.IsDir() {
+			continue
+		}
+		err := os.Remove(filepath.Join(f.dir, info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			logCxt.WithError(err).WithField("file", info.Name()).Warn(
+				"Failed to remove stale endpoint status file")
+		}
+	}
+	logCxt.WithField("numFiles", len(names)).Info("Cleaned up endpoint status directory")
+}
+
+// OnEndpointStatus records the combined status of an endpoint, to be reflected in the directory
+// by the next call to Apply().
+func (f *endpointStatusFiles) OnEndpointStatus(id proto.WorkloadEndpointID, status string) {
+	if f.dir == "" {
+		return
+	}
+	f.pendingStatuses[id] = status
+}
+
+// Apply writes the file for each pending endpoint that is "up" and removes the file of any
+// other pending endpoint.  Writes are deferred until policyRulesInSync is true, since the
+// endpoint's status alone doesn't tell us that its policy made it into iptables.
+func (f *endpointStatusFiles) Apply(policyRulesInSync bool) {
+	for id, status := range f.pendingStatuses {
+		if status == "up" && !policyRulesInSync {
+			continue
+		}
+		f.updateFile(id, status)
+		delete(f.pendingStatuses, id)
+	}
+}
+
+func (f *endpointStatusFiles) updateFile(id proto.WorkloadEndpointID, status string) {
+	path := filepath.Join(f.dir, endpointStatusFilename(id))
+	logCxt := log.WithFields(log.Fields{"path": path, "status": status})
+	if status != "up" {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			logCxt.WithError(err).Warn("Failed to remove endpoint status file")
+		}
+		return
+	}
+	data, err := json.Marshal(endpointStatusFileContents{
+		OrchestratorID: id.OrchestratorId,
+		WorkloadID:     id.WorkloadId,
+		EndpointID:     id.EndpointId,
+		Time:           f.timeNow().UTC(),
+	})
+	if err != nil {
+		logCxt.WithError(err).Panic("Failed to marshal endpoint status file")
+	}
+	// Write to a temporary file and then rename it into place so that readers never see a
+	// partially-written file.
+	tmpPath := filepath.Join(f.dir, ".tmp")
+	err = ioutil.WriteFile(tmpPath, append(data, '\n'), 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to write endpoint status file")
+		return
+	}
+	logCxt.Debug("Wrote endpoint status file")
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("Endpoint status files", func() {
+	var (
+		dir    string
+		files  *endpointStatusFiles
+		wlID   proto.WorkloadEndpointID
+		wlPath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-endpoint-status")
+		Expect(err).NotTo(HaveOccurred())
+		files = newEndpointStatusFiles(filepath.Join(dir, "status"))
+		files.timeNow = func() time.Time { return time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC) }
+		wlID = proto.WorkloadEndpointID{
+			OrchestratorId: "k8s",
+			WorkloadId:     "default/nginx",
+			EndpointId:     "eth0",
+		}
+		wlPath = filepath.Join(dir, "status", "k8s default%2Fnginx eth0")
+		files.RemoveAll()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	It("should escape the parts of the filename", func() {
+		Expect(endpointStatusFilename(wlID)).To(Equal("k8s default%2Fnginx eth0"))
+	})
+
+	It("should remove stale files at start of day", func() {
+		stalePath := filepath.Join(dir, "status", "stale")
+		Expect(ioutil.WriteFile(stalePath, []byte("stale"), 0644)).To(Succeed())
+		files.RemoveAll()
+		Expect(exists(stalePath)).To(BeFalse())
+	})
+
+	It("should write the file once the endpoint is up and policy is in sync", func() {
+		files.OnEndpointStatus(wlID, "up")
+		files.Apply(false)
+		Expect(exists(wlPath)).To(BeFalse())
+		files.Apply(true)
+		data, err := ioutil.ReadFile(wlPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(
+			`{"orchestratorID":"k8s","workloadID":"default/nginx","endpointID":"eth0",` +
+				`"time":"2017-03-01T12:00:00Z"}` + "\n"))
+	})
+
+	It("should not write a file for an endpoint that isn't up", func() {
+		files.OnEndpointStatus(wlID, "down")
+		files.Apply(true)
+		Expect(exists(wlPath)).To(BeFalse())
+	})
+
+	Describe("with a file written", func() {
+		BeforeEach(func() {
+			files.OnEndpointStatus(wlID, "up")
+			files.Apply(true)
+			Expect(exists(wlPath)).To(BeTrue())
+		})
+
+		It("should remove the file when the endpoint is removed", func() {
+			files.OnEndpointStatus(wlID, "")
+			files.Apply(false)
+			Expect(exists(wlPath)).To(BeFalse())
+		})
+
+		It("should remove the file when the endpoint goes into error", func() {
+			files.OnEndpointStatus(wlID, "error")
+			files.Apply(true)
+			Expect(exists(wlPath)).To(BeFalse())
+		})
+	})
+
+	It("should do nothing if disabled", func() {
+		files = newEndpointStatusFiles("")
+		files.RemoveAll()
+		files.OnEndpointStatus(wlID, "up")
+		files.Apply(true)
+		Expect(exists(filepath.Join(dir, "status"))).To(BeTrue())
+		Expect(exists(wlPath)).To(BeFalse())
+	})
+})
@@ -0,0 +1,181 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var (
+	gaugeFirstInSyncApplySecs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_int_dataplane_first_in_sync_apply_seconds",
+		Help: "Time in seconds from start-up until the first dataplane apply after the " +
+			"datastore was in sync finished; 0 until then.",
+	})
+	gaugeGracefulRestartTimedOut = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_int_dataplane_graceful_restart_timed_out",
+		Help: "1 if the graceful restart timeout expired before the datastore was in sync, " +
+			"causing us to apply a potentially-incomplete dataplane.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(gaugeFirstInSyncApplySecs)
+	prometheus.MustRegister(gaugeGracefulRestartTimedOut)
+}
+
+// gracefulRestart tracks the graceful restart window: the period after start-up in which we
+// leave the existing dataplane untouched until the datastore is in sync, so that we don't
+// disrupt already-programmed endpoints by applying an incomplete picture of the dataplane.
+//
+// If timeout is non-zero, we give up waiting after that long and apply anyway; that trades
+// the risk of a temporary disruption for not leaving new endpoints unprogrammed indefinitely
+// when the datastore is slow to sync.
+//
+// It also records how long each endpoint had to wait to be programmed, from when we first
+// heard about it until the apply that programmed it, for endpoints that we hear about before
+// the first in-sync apply.
+type gracefulRestart struct {
+	timeout   time.Duration
+	startTime time.Time
+
+	datastoreInSync      bool
+	timedOut             bool
+	doneFirstInSyncApply bool
+
+	// endpointsFirstSeen contains the time that we first heard about each endpoint that has
+	// yet to be applied.  The keys are proto.WorkloadEndpointIDs and proto.HostEndpointIDs.
+	// Set to nil once we've done the first in-sync apply.
+	endpointsFirstSeen map[interface{}]time.Time
+
+	// Shim for testing.
+	timeNow func() time.Time
+}
+
+func newGracefulRestart(timeout time.Duration) *gracefulRestart {
+	return newGracefulRestartWithShims(timeout, time.Now)
+}
+
+func newGracefulRestartWithShims(timeout time.Duration, timeNow func() time.Time) *gracefulRestart {
+	return &gracefulRestart{
+		timeout:            timeout,
+		startTime:          timeNow(),
+		endpointsFirstSeen: map[interface{}]time.Time{},
+		timeNow:            timeNow,
+	}
+}
+
+// OnUpdate should be called with each message from the calculation graph.
+func (g *gracefulRestart) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.InSync:
+		g.datastoreInSync = true
+	case *proto.WorkloadEndpointUpdate:
+		g.recordEndpoint(*msg.Id)
+	case *proto.HostEndpointUpdate:
+		g.recordEndpoint(*msg.Id)
+	case *proto.WorkloadEndpointRemove:
+		delete(g.endpointsFirstSeen, *msg.Id)
+	case *proto.HostEndpointRemove:
+		delete(g.endpointsFirstSeen, *msg.Id)
+	}
+}
+
+func (g *gracefulRestart) recordEndpoint(id interface{}) {
+	if g.endpointsFirstSeen == nil {
+		return
+	}
+	if _, ok := g.endpointsFirstSeen[id]; !ok {
+		g.endpointsFirstSeen[id] = g.timeNow()
+	}
+}
+
+// ApplyAllowed returns true if we're allowed to apply the dataplane: once the datastore is in
+// sync, or once the timeout has expired.
+func (g *gracefulRestart) ApplyAllowed() bool {
+	if g.datastoreInSync || g.timedOut {
+		return true
+	}
+	if g.timeout == 0 {
+		return false
+	}
+	waited := g.timeNow().Sub(g.startTime)
+	if waited < g.timeout {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"timeout":          g.timeout,
+		"endpointsWaiting": len(g.endpointsFirstSeen),
+	}).Warn("Datastore still not in sync after graceful restart timeout, applying " +
+		"a potentially-incomplete dataplane")
+	gaugeGracefulRestartTimedOut.Set(1)
+	g.timedOut = true
+	return true
+}
+
+// TimeUntilTimeout returns how long remains until the timeout expires, or 0 if there's no
+// timeout or we're no longer waiting.
+func (g *gracefulRestart) TimeUntilTimeout() time.Duration {
+	if g.timeout == 0 || g.datastoreInSync || g.timedOut {
+		return 0
+	}
+	remaining := g.timeout - g.timeNow().Sub(g.startTime)
+	if remaining <= 0 {
+		// Round up so that the caller always gets a non-zero duration while we're waiting.
+		return time.Nanosecond
+	}
+	return remaining
+}
+
+// OnApplyComplete should be called after each apply.  It returns true the first time that it
+// is called after the datastore is in sync; i.e. at the end of the graceful restart.
+func (g *gracefulRestart) OnApplyComplete() (firstInSyncApply bool) {
+	now := g.timeNow()
+	if len(g.endpointsFirstSeen) > 0 {
+		var maxWait time.Duration
+		for id, firstSeen := range g.endpointsFirstSeen {
+			wait := now.Sub(firstSeen)
+			log.WithFields(log.Fields{
+				"id":   id,
+				"wait": wait,
+			}).Debug("Endpoint programmed")
+			if wait > maxWait {
+				maxWait = wait
+			}
+		}
+		log.WithFields(log.Fields{
+			"numEndpoints":    len(g.endpointsFirstSeen),
+			"maxWaitSecs":     maxWait.Seconds(),
+			"datastoreInSync": g.datastoreInSync,
+		}).Info("Programmed endpoints that were waiting for the graceful restart")
+		g.endpointsFirstSeen = map[interface{}]time.Time{}
+	}
+
+	if !g.datastoreInSync || g.doneFirstInSyncApply {
+		return false
+	}
+	g.doneFirstInSyncApply = true
+	g.endpointsFirstSeen = nil
+	secsSinceStart := now.Sub(g.startTime).Seconds()
+	gaugeFirstInSyncApplySecs.Set(secsSinceStart)
+	log.WithField("secsSinceStart", secsSinceStart).Info(
+		"Completed first in-sync update to dataplane, graceful restart complete.")
+	return true
+}
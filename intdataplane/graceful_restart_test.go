@@ -0,0 +1,97 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("Graceful restart", func() {
+	var (
+		gr  *gracefulRestart
+		now time.Time
+	)
+
+	wlID := proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "pod1",
+		EndpointId:     "eth0",
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+		gr = newGracefulRestartWithShims(30*time.Second, func() time.Time { return now })
+	})
+
+	It("should only allow applies once the datastore is in sync", func() {
+		Expect(gr.ApplyAllowed()).To(BeFalse())
+		Expect(gr.TimeUntilTimeout()).To(Equal(30 * time.Second))
+		gr.OnUpdate(&proto.InSync{})
+		Expect(gr.ApplyAllowed()).To(BeTrue())
+		Expect(gr.TimeUntilTimeout()).To(BeZero())
+	})
+
+	It("should allow applies once the timeout expires", func() {
+		now = now.Add(29 * time.Second)
+		Expect(gr.ApplyAllowed()).To(BeFalse())
+		Expect(gr.TimeUntilTimeout()).To(Equal(time.Second))
+		now = now.Add(time.Second)
+		Expect(gr.ApplyAllowed()).To(BeTrue())
+		Expect(gr.TimeUntilTimeout()).To(BeZero())
+	})
+
+	It("should wait indefinitely with no timeout", func() {
+		gr = newGracefulRestartWithShims(0, func() time.Time { return now })
+		now = now.Add(time.Hour)
+		Expect(gr.ApplyAllowed()).To(BeFalse())
+		Expect(gr.TimeUntilTimeout()).To(BeZero())
+	})
+
+	It("should only report the first in-sync apply", func() {
+		now = now.Add(30 * time.Second)
+		Expect(gr.ApplyAllowed()).To(BeTrue())
+		Expect(gr.OnApplyComplete()).To(BeFalse())
+		gr.OnUpdate(&proto.InSync{})
+		Expect(gr.OnApplyComplete()).To(BeTrue())
+		Expect(gr.OnApplyComplete()).To(BeFalse())
+	})
+
+	It("should track endpoints until they're applied", func() {
+		gr.OnUpdate(&proto.WorkloadEndpointUpdate{Id: &wlID})
+		gr.OnUpdate(&proto.HostEndpointUpdate{Id: &proto.HostEndpointID{EndpointId: "eth1"}})
+		Expect(gr.endpointsFirstSeen).To(HaveLen(2))
+		gr.OnUpdate(&proto.HostEndpointRemove{Id: &proto.HostEndpointID{EndpointId: "eth1"}})
+		Expect(gr.endpointsFirstSeen).To(Equal(map[interface{}]time.Time{wlID: now}))
+
+		// A later update shouldn't reset the time that we first saw the endpoint.
+		firstSeen := now
+		now = now.Add(time.Second)
+		gr.OnUpdate(&proto.WorkloadEndpointUpdate{Id: &wlID})
+		Expect(gr.endpointsFirstSeen).To(Equal(map[interface{}]time.Time{wlID: firstSeen}))
+
+		gr.OnUpdate(&proto.InSync{})
+		gr.OnApplyComplete()
+		Expect(gr.endpointsFirstSeen).To(BeNil())
+
+		// After the first in-sync apply, we stop tracking.
+		gr.OnUpdate(&proto.WorkloadEndpointUpdate{Id: &wlID})
+		Expect(gr.endpointsFirstSeen).To(BeNil())
+	})
+})
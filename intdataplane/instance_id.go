@@ -0,0 +1,91 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// instanceIDRegexp matches a valid instance ID; it must be usable in an iptables comment.
+var instanceIDRegexp = regexp.MustCompile(`^[0-9a-zA-Z]+$`)
+
+// loadOrCreateInstanceID returns the ID that identifies this instance of Felix in the instance
+// marker chains.  The ID is persisted in the given file so that it survives restarts; that
+// lets us tell our own rules, left by a previous run, from those of another instance.  If the
+// file doesn't exist (or doesn't hold a valid ID), we generate a new ID and write it.  If no
+// path is configured, or we fail to write the file, we fall back to an ID for this run only.
+func loadOrCreateInstanceID(path string) string {
+	logCxt := log.WithField("path", path)
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		id := strings.TrimSpace(string(data))
+		if err == nil && instanceIDRegexp.MatchString(id) {
+			logCxt.WithField("id", id).Info("Loaded instance ID.")
+			return id
+		}
+		if err != nil && !os.IsNotExist(err) {
+			logCxt.WithError(err).Warn("Failed to read instance ID file, generating a new ID.")
+		} else if err == nil {
+			logCxt.WithField("contents", id).Warn("Invalid instance ID file, generating a new ID.")
+		}
+	}
+
+	id := randomHexString(8)
+	logCxt = logCxt.WithField("id", id)
+	if path == "" {
+		logCxt.Info("No instance ID file configured, generated an ID for this run only.")
+		return id
+	}
+
+	// Write to a temporary file and then rename it into place so that a crash can't leave
+	// a partially-written ID behind.
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(tmpPath, []byte(id+"\n"), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to persist instance ID, using it for this run only.")
+		return id
+	}
+	logCxt.Info("Generated and persisted new instance ID.")
+	return id
+}
+
+// newInstanceEpoch returns a random epoch for this run of Felix.  We record it in the instance
+// marker chains alongside the persisted ID so that we can detect another live instance that
+// shares our ID.
+func newInstanceEpoch() string {
+	return randomHexString(4)
+}
+
+func randomHexString(numBytes int) string {
+	buf := make([]byte, numBytes)
+	if _, err := cryptorand.Read(buf); err != nil {
+		log.WithError(err).Panic("Failed to read random bytes")
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Instance ID", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-instance-id")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "calico", "felix-instance-id")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should generate and persist a new ID", func() {
+		id := loadOrCreateInstanceID(path)
+		Expect(id).To(MatchRegexp(`^[0-9a-f]{16}$`))
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(id + "\n"))
+	})
+
+	It("should return the same ID on the next run", func() {
+		id := loadOrCreateInstanceID(path)
+		Expect(loadOrCreateInstanceID(path)).To(Equal(id))
+	})
+
+	It("should replace an invalid ID", func() {
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte("not valid!\n"), 0644)).To(Succeed())
+		id := loadOrCreateInstanceID(path)
+		Expect(id).To(MatchRegexp(`^[0-9a-f]{16}$`))
+		Expect(loadOrCreateInstanceID(path)).To(Equal(id))
+	})
+
+	It("should generate a different ID each run if no path is configured", func() {
+		Expect(loadOrCreateInstanceID("")).NotTo(Equal(loadOrCreateInstanceID("")))
+	})
+
+	It("should fall back to a per-run ID if the file can't be written", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "calico"), nil, 0644)).To(Succeed())
+		id := loadOrCreateInstanceID(path)
+		Expect(id).To(MatchRegexp(`^[0-9a-f]{16}$`))
+		_, err := os.Stat(path)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Instance epoch", func() {
+	It("should generate a different epoch each run", func() {
+		epoch := newInstanceEpoch()
+		Expect(epoch).To(MatchRegexp(`^[0-9a-f]{8}$`))
+		Expect(newInstanceEpoch()).NotTo(Equal(epoch))
+	})
+})
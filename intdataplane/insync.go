@@ -0,0 +1,111 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Names of the components whose in-sync state we report.  Each iptables table is reported
+// separately, as "iptables-<table>-v<IP version>"; each IP version of IP sets is reported
+// as "ipsets-<family>".
+const (
+	// InSyncComponentDataplane is the aggregate state of the dataplane as a whole.  It is
+	// in-sync once we've completed our first apply and the most recent apply left nothing
+	// outstanding.
+	InSyncComponentDataplane = "dataplane"
+	InSyncComponentManagers  = "managers"
+	InSyncComponentRoutes    = "routes"
+	// InSyncComponentIptablesHealth is out-of-sync while any of our iptables tables has
+	// given up on an update and fallen back to its failure mode.
+	InSyncComponentIptablesHealth = "iptables-health"
+)
+
+// InSyncCallback is called when a component of the dataplane transitions between in-sync and
+// out-of-sync.  It is called from the dataplane's goroutine so it must not block.
+type InSyncCallback func(component string, inSync bool)
+
+// inSyncReporter tracks the in-sync state of each component of the dataplane and notifies
+// its callbacks of transitions.
+type inSyncReporter struct {
+	lock      sync.Mutex
+	callbacks []InSyncCallback
+	states    map[string]bool
+}
+
+func newInSyncReporter() *inSyncReporter {
+	return &inSyncReporter{
+		states: map[string]bool{},
+	}
+}
+
+// AddCallback registers a callback.  The callback is immediately called with the current
+// state of each component that has already reported.
+func (r *inSyncReporter) AddCallback(cb InSyncCallback) {
+	r.lock.Lock()
+	r.callbacks = append(r.callbacks, cb)
+	var components []string
+	states := map[string]bool{}
+	for component, inSync := range r.states {
+		components = append(components, component)
+		states[component] = inSync
+	}
+	r.lock.Unlock()
+
+	sort.Strings(components)
+
+	for _, component := range components {
+		cb(component, states[component])
+	}
+}
+
+// Report records the current state of the given component, calling the callbacks if it has
+// changed.
+func (r *inSyncReporter) Report(component string, inSync bool) {
+	r.lock.Lock()
+	oldInSync, known := r.states[component]
+	if known && oldInSync == inSync {
+		r.lock.Unlock()
+		return
+	}
+	r.states[component] = inSync
+	callbacks := r.callbacks
+	r.lock.Unlock()
+
+	logCxt := log.WithFields(log.Fields{
+		"component": component,
+		"inSync":    inSync,
+	})
+	if known {
+		logCxt.Info("Dataplane component changed in-sync state")
+	} else {
+		logCxt.Debug("Dataplane component reported initial in-sync state")
+	}
+	for _, cb := range callbacks {
+		cb(component, inSync)
+	}
+}
+
+// InSync returns the most recently reported state of the given component.  known is false
+// if the component has yet to report.
+func (r *inSyncReporter) InSync(component string) (inSync, known bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	inSync, known = r.states[component]
+	return
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type inSyncEvent struct {
+	component string
+	inSync    bool
+}
+
+var _ = Describe("In-sync reporter", func() {
+	var reporter *inSyncReporter
+	var events []inSyncEvent
+
+	recordEvent := func(component string, inSync bool) {
+		events = append(events, inSyncEvent{component, inSync})
+	}
+
+	BeforeEach(func() {
+		reporter = newInSyncReporter()
+		events = nil
+		reporter.AddCallback(recordEvent)
+	})
+
+	It("should report the first state of each component", func() {
+		reporter.Report("routes", true)
+		reporter.Report("dataplane", false)
+		Expect(events).To(Equal([]inSyncEvent{
+			{"routes", true},
+			{"dataplane", false},
+		}))
+	})
+
+	It("should only report transitions", func() {
+		reporter.Report("routes", true)
+		reporter.Report("routes", true)
+		reporter.Report("routes", false)
+		reporter.Report("routes", false)
+		reporter.Report("routes", true)
+		Expect(events).To(Equal([]inSyncEvent{
+			{"routes", true},
+			{"routes", false},
+			{"routes", true},
+		}))
+	})
+
+	It("should return the current state", func() {
+		_, known := reporter.InSync("routes")
+		Expect(known).To(BeFalse())
+		reporter.Report("routes", false)
+		inSync, known := reporter.InSync("routes")
+		Expect(known).To(BeTrue())
+		Expect(inSync).To(BeFalse())
+	})
+
+	It("should replay the current state to a late subscriber", func() {
+		reporter.Report("routes", true)
+		reporter.Report("dataplane", false)
+		var lateEvents []inSyncEvent
+		reporter.AddCallback(func(component string, inSync bool) {
+			lateEvents = append(lateEvents, inSyncEvent{component, inSync})
+		})
+		Expect(lateEvents).To(Equal([]inSyncEvent{
+			{"dataplane", false},
+			{"routes", true},
+		}))
+	})
+})
@@ -17,6 +17,7 @@ package intdataplane
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"reflect"
 	"strconv"
@@ -28,11 +29,18 @@ import (
 	"github.com/gavv/monotime"
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/projectcalico/felix/collector"
+	"github.com/projectcalico/felix/conntrack"
+	"github.com/projectcalico/felix/dataplaneexec"
+	"github.com/projectcalico/felix/flowlog"
+	"github.com/projectcalico/felix/health"
 	"github.com/projectcalico/felix/ifacemonitor"
 	"github.com/projectcalico/felix/ipsets"
 	"github.com/projectcalico/felix/iptables"
 	"github.com/projectcalico/felix/jitter"
+	"github.com/projectcalico/felix/nflog"
 	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/routerule"
 	"github.com/projectcalico/felix/routetable"
 	"github.com/projectcalico/felix/rules"
 	"github.com/projectcalico/felix/set"
@@ -44,6 +52,19 @@ const (
 	// channel before we apply the changes.  Higher values allow us to batch up more work on
 	// the channel for greater throughput when we're under load (at cost of higher latency).
 	msgPeekLimit = 100
+
+	// policyReadyFileRefreshInterval is the minimum interval between rewrites of the policy
+	// ready file.  The main loop wakes up at least every 10s so, in steady state, the file is
+	// refreshed every 10s.
+	policyReadyFileRefreshInterval = 5 * time.Second
+
+	// defaultApplyRateLimit and defaultApplyBurst are used if the corresponding Config
+	// fields are zero: at most 10 applies per second on average, with bursts of up to 10.
+	defaultApplyRateLimit = 10
+	defaultApplyBurst     = 10
+
+	// healthName is the name under which we report our health.
+	healthName = "int_dataplane"
 )
 
 var (
@@ -55,6 +76,10 @@ var (
 		Name: "felix_int_dataplane_messages",
 		Help: "Number dataplane messages by type.",
 	}, []string{"type"})
+	countApplyThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_int_dataplane_apply_throttled",
+		Help: "Number of times that dataplane updates were held back by the apply rate limit.",
+	})
 	summaryApplyTime = prometheus.NewSummary(prometheus.SummaryOpts{
 		Name: "felix_int_dataplane_apply_time_seconds",
 		Help: "Time in seconds that it took to apply a dataplane update.",
@@ -81,6 +106,7 @@ var (
 func init() {
 	prometheus.MustRegister(countDataplaneSyncErrors)
 	prometheus.MustRegister(summaryApplyTime)
+	prometheus.MustRegister(countApplyThrottled)
 	prometheus.MustRegister(countMessages)
 	prometheus.MustRegister(summaryBatchSize)
 	prometheus.MustRegister(summaryIfaceBatchSize)
@@ -94,16 +120,179 @@ type Config struct {
 	IPIPMTU              int
 	IgnoreLooseRPF       bool
 
-	MaxIPSetSize int
+	// ProgrammingLayerOverride, if non-nil, replaces the objects that program iptables, IP
+	// sets and routes; see ProgrammingLayer.
+	ProgrammingLayerOverride ProgrammingLayer
+
+	// VXLANEnabled enables the VXLAN tunnel device, which is configured with the given VNI,
+	// port, MTU and address.  Hostname is used to find our own host IP, from which we derive
+	// the device's MAC and source address.
+	VXLANEnabled       bool
+	VXLANVNI           int
+	VXLANPort          int
+	VXLANMTU           int
+	VXLANTunnelAddress net.IP
+	Hostname           string
+
+	// WorkloadRoutingTableIndex, if non-zero, is the auxiliary routing table in which traffic
+	// from local workloads is looked up first; see policyRoutingManager.  The policy routing
+	// rules are added with WorkloadRoutingRulePriority.
+	WorkloadRoutingTableIndex   int
+	WorkloadRoutingRulePriority int
 
-	IptablesRefreshInterval time.Duration
-	IptablesInsertMode      string
+	MaxIPSetSize int
+	// IpsetsRefreshInterval, if non-zero, is the interval at which we read back our IP sets
+	// and repair any members that another process has added or removed.
+	IpsetsRefreshInterval time.Duration
+	// PolicyCountersRefreshInterval, if non-zero, enables the per-policy packet and byte
+	// counter metrics, which are recalculated from the iptables counters at this interval.
+	PolicyCountersRefreshInterval time.Duration
+
+	// RouteTableOptions controls the metric, protocol and onlink flag of the routes that we
+	// program.
+	RouteTableOptions routetable.Options
+	// ConntrackFlushRateLimit is the maximum number of IPs per second that we remove conntrack
+	// flows for when endpoints are removed or change IP; 0 means no limit.  The removals are
+	// done in the background so that a mass deletion doesn't stall the main loop.
+	ConntrackFlushRateLimit int
+	// ConntrackTuning controls the conntrack table size and timeouts.
+	ConntrackTuning ConntrackTuning
+
+	// XDPEnabled enables dropping traffic denied by untracked host endpoint policies with
+	// the XDP program in XDPProgramFile.
+	XDPEnabled     bool
+	XDPProgramFile string
+
+	// DeniedPacketMetricsMaxSourceIPs is the maximum number of source IPs that we track in
+	// the per-source denied packet metrics; 0 disables them.  Denied packet metrics need
+	// drop attribution to be enabled by RulesConfig.DropNFLOGGroup.
+	DeniedPacketMetricsMaxSourceIPs int
+
+	// FlowLogs controls the writing of flow logs.  Denied flows are only logged if drop
+	// attribution is enabled by RulesConfig.DropNFLOGGroup.
+	FlowLogs flowlog.Config
+
+	IptablesRefreshInterval    time.Duration
+	IptablesMinResyncInterval  time.Duration
+	IptablesFlushCheckInterval time.Duration
+	IptablesInsertMode         string
+	IptablesPreValidate        bool
+
+	IptablesRuleHashAlgorithm string
+	IptablesRuleHashLength    int
+	IptablesRuleHashSeed      string
+
+	// IptablesChainDeletionGracePeriod is the time that removed chains are kept in the
+	// dataplane before being deleted; see iptables.TableOptions.
+	IptablesChainDeletionGracePeriod time.Duration
+	// IptablesMaxChainLength is the number of rules above which chains are split into
+	// shards, or 0 to disable sharding.
+	IptablesMaxChainLength int
+	// IptablesMaxRestoreLines, if non-zero, limits the size of each iptables-restore
+	// transaction; see iptables.TableOptions.
+	IptablesMaxRestoreLines int
+
+	// IptablesFailureMode is the iptables.FailureModeXXX to use for the filter tables if we
+	// fail to program them.  The other tables have their own setting since they only support
+	// iptables.FailureModePanic and iptables.FailureModeLeaveUntouched.
+	IptablesFailureMode       string
+	IptablesNATFailureMode    string
+	IptablesMangleFailureMode string
+	IptablesRawFailureMode    string
+
+	// IptablesLockTimeout, if non-zero, enables taking the xtables lock around our
+	// iptables-restore calls.  Only needed with versions of iptables-restore that don't take
+	// the lock themselves.
+	IptablesLockFilePath      string
+	IptablesLockTimeout       time.Duration
+	IptablesLockProbeInterval time.Duration
+
+	// InstanceIDFile is the file in which we persist the ID that we write to the instance
+	// marker chains.  If empty, we generate a new ID on each start.
+	InstanceIDFile string
+
+	// DataplaneBinDir and DataplaneHostNetnsPID control how we run the iptables and ipset
+	// commands; see dataplaneexec.Options.
+	DataplaneBinDir       string
+	DataplaneHostNetnsPID int
+
+	// IptablesCommandTimeout, if non-zero, is the time after which we kill an iptables or
+	// ipset command that hasn't finished.  It should be shorter than ApplyWatchdogTimeout so
+	// that a hung command is killed, and retried, before the watchdog reports us as stuck.
+	IptablesCommandTimeout time.Duration
+	// ApplyWatchdogTimeout, if non-zero, is the time after which we log diagnostics and
+	// report the dataplane as out-of-sync if an apply hasn't finished.
+	ApplyWatchdogTimeout time.Duration
+	// ApplyDelay, if non-zero, is the time that we wait after the dataplane becomes dirty
+	// before applying, so that updates that arrive close together get applied in one batch.
+	// If ApplyAdaptive is true, the delay widens while updates keep arriving.  ApplyMaxDelay,
+	// if non-zero, bounds the delay.  See applyScheduler.
+	ApplyDelay    time.Duration
+	ApplyMaxDelay time.Duration
+	ApplyAdaptive bool
+	// ApplyRateLimit and ApplyBurst configure the token bucket that limits how often we
+	// apply updates to the dataplane: on average, at most ApplyRateLimit applies per second,
+	// with bursts of up to ApplyBurst.  Updates that arrive while we're throttled are
+	// coalesced into the next apply.  Zero values mean the defaults of 10 and 10.
+	ApplyRateLimit int
+	ApplyBurst     int
+
+	// InterfaceDampingInterval, if non-zero, enables flap damping in the interface monitor;
+	// see ifacemonitor.InterfaceMonitor.DampingInterval.
+	InterfaceDampingInterval time.Duration
+
+	// IptablesStateSnapshots, if true, enables IptablesStateHandler().  Taking the snapshots
+	// has a cost on every apply so it is disabled by default.
+	IptablesStateSnapshots bool
+
+	// IptablesAuditLogSize, if non-zero, is the number of recent iptables updates that we
+	// keep for IptablesAuditHandler().  IptablesAuditLogFile, if non-empty, is the path of a
+	// file that we append every update to, as a line of JSON.
+	IptablesAuditLogSize int
+	IptablesAuditLogFile string
+
+	// OfflineRenderDir, if non-empty, enables the offline render mode.  Rather than
+	// programming the dataplane, we write the input that we would pass to iptables-restore
+	// and ipset restore to files in the directory, as if the dataplane were empty.  Once the
+	// first complete update has been rendered, we call OfflineRenderCompleteCallback.
+	OfflineRenderDir              string
+	OfflineRenderCompleteCallback func()
+
+	// ReadOnly, if true, enables the read-only mode, in which we calculate the updates needed
+	// to bring the dataplane into sync as normal but, rather than making them, we log them.
+	ReadOnly bool
 
 	RulesConfig rules.Config
 
 	StatusReportingInterval time.Duration
 
+	// WorkloadDSCPMode is the default DSCP treatment for packets from workloads that don't
+	// specify their own; one of the rules.DSCPMode... constants.
+	WorkloadDSCPMode string
+
+	// PolicyReadyFile, if non-empty, is the path of a file that we write once the dataplane
+	// is in sync (and refresh periodically thereafter).  The CNI plugin can check for the file
+	// before networking new pods.
+	PolicyReadyFile string
+
+	// EndpointStatusFileDirectory, if non-empty, is a directory in which we write a file for
+	// each local workload endpoint once its policy is programmed, and remove it when the
+	// endpoint goes away.  See endpointStatusFilename() for the naming of the files.
+	EndpointStatusFileDirectory string
+
+	// GracefulRestartTimeout, if non-zero, is the maximum time that we wait for the datastore
+	// to be in sync before applying the dataplane anyway.  If zero, we wait indefinitely.
+	GracefulRestartTimeout time.Duration
+	// PostInSyncCallback, if non-nil, is called once the first apply after the datastore is
+	// in sync has finished; i.e. at the end of the graceful restart.
 	PostInSyncCallback func()
+
+	// HealthAggregator, if non-nil, receives our health reports.  We report ourselves live
+	// as long as our main loop keeps turning, and ready once we've completed our first apply
+	// after the datastore is in sync and our most recent apply succeeded.  HealthTimeout should allow for the longest
+	// apply that we expect.
+	HealthAggregator *health.HealthAggregator
+	HealthTimeout    time.Duration
 }
 
 // InternalDataplane implements an in-process Felix dataplane driver based on iptables
@@ -138,19 +327,35 @@ type InternalDataplane struct {
 	toDataplane   chan interface{}
 	fromDataplane chan interface{}
 
-	allIptablesTables    []*iptables.Table
-	iptablesNATTables    []*iptables.Table
-	iptablesRawTables    []*iptables.Table
-	iptablesFilterTables []*iptables.Table
-	ipSets               []*ipsets.IPSets
+	allIptablesTables    []iptablesTableInfo
+	iptablesNATTables    []iptablesTableInfo
+	iptablesRawTables    []iptablesTableInfo
+	iptablesMangleTables []iptablesTableInfo
+	iptablesFilterTables []iptablesTableInfo
+	ipSets               []ipSetsInfo
+
+	ipipManager  *ipipManager
+	vxlanManager *vxlanManager
+
+	conntrackTuningManager *conntrackTuningManager
+	xdpManager             *xdpManager
 
-	ipipManager *ipipManager
+	// dropCollector attributes dropped packets to rules, if enabled by
+	// RulesConfig.DropNFLOGGroup.
+	dropCollector *collector.DropCollector
+	// flowLogAggregator accumulates flow logs, if enabled by Config.FlowLogs.
+	flowLogAggregator *flowlog.Aggregator
+	// policyCounters exports per-policy counters, if enabled by
+	// Config.PolicyCountersRefreshInterval.
+	policyCounters *policyCounters
 
 	ifaceMonitor     *ifacemonitor.InterfaceMonitor
 	ifaceUpdates     chan *ifaceUpdate
 	ifaceAddrUpdates chan *ifaceAddrsUpdate
 
 	endpointStatusCombiner *endpointStatusCombiner
+	policyStatusReporter   *policyStatusReporter
+	processStatus          *processStatus
 
 	allManagers []Manager
 
@@ -158,10 +363,12 @@ type InternalDataplane struct {
 
 	interfacePrefixes []string
 
-	routeTables []*routetable.RouteTable
+	routeTables []RouteTable
+	routeRules  []RouteRules
 
 	dataplaneNeedsSync    bool
 	forceDataplaneRefresh bool
+	forceIPSetsRefresh    bool
 	cleanupPending        bool
 
 	reschedTimer *time.Timer
@@ -169,6 +376,27 @@ type InternalDataplane struct {
 
 	applyThrottle *throttle.Throttle
 
+	policyReadyFile     *policyReadyFile
+	endpointStatusFiles *endpointStatusFiles
+	inSyncReporter      *inSyncReporter
+	applyWatchdog       *applyWatchdog
+
+	conntrackFlushQueue *conntrack.FlushQueue
+
+	iptablesStateCache *iptablesStateCache
+	iptablesAuditLog   *iptables.AuditLog
+	offlineRenderer    *offlineRenderer
+	// cacheDumpRequests receives requests (from the debug server) to log the state of our
+	// caches.  The dump is done by the main loop since the caches aren't thread-safe.
+	cacheDumpRequests chan struct{}
+	// refreshIntervalUpdates receives new refresh intervals from UpdateRefreshIntervals().
+	refreshIntervalUpdates chan refreshIntervals
+	// usingKernel is false if we're rendering offline or using an overridden programming
+	// layer.  In either case, we mustn't touch the kernel directly.
+	usingKernel bool
+
+	writeProcSys procSysWriter
+
 	config Config
 }
 
@@ -188,125 +416,302 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		ifaceUpdates:      make(chan *ifaceUpdate, 100),
 		ifaceAddrUpdates:  make(chan *ifaceAddrsUpdate, 100),
 		config:            config,
-		applyThrottle:     throttle.New(10),
+		applyThrottle:     throttle.New(applyBurst(config)),
+		policyReadyFile:   newPolicyReadyFile(config.PolicyReadyFile, policyReadyFileRefreshInterval),
+		inSyncReporter:    newInSyncReporter(),
+		writeProcSys:      writeProcSys,
+		cacheDumpRequests: make(chan struct{}, 1),
+
+		refreshIntervalUpdates: make(chan refreshIntervals, 1),
+	}
+	if config.ReadOnly {
+		log.Warn("Running in read-only mode, dataplane updates will be logged but not applied.")
+		dp.writeProcSys = readOnlyWriteProcSys
+	}
+
+	dp.ifaceMonitor.DampingInterval = config.InterfaceDampingInterval
+	dp.offlineRenderer = newOfflineRenderer(config.OfflineRenderDir)
+	dp.usingKernel = dp.offlineRenderer == nil && config.ProgrammingLayerOverride == nil
+	programmingLayer := config.ProgrammingLayerOverride
+	if programmingLayer == nil {
+		programmingLayer = kernelProgrammingLayer{readOnly: config.ReadOnly}
+	}
+	if config.IptablesStateSnapshots {
+		dp.iptablesStateCache = &iptablesStateCache{}
+	}
+	if dp.usingKernel && !config.ReadOnly {
+		// Only audit real updates to the dataplane.
+		dp.iptablesAuditLog = newIptablesAuditLog(config.IptablesAuditLogSize, config.IptablesAuditLogFile)
+	}
+	if config.ApplyWatchdogTimeout > 0 {
+		dp.applyWatchdog = newApplyWatchdog(config.ApplyWatchdogTimeout, func(stuck bool) {
+			if stuck {
+				// The main loop reports the state again once the apply finishes.
+				dp.inSyncReporter.Report(InSyncComponentDataplane, false)
+			}
+		})
+	}
+
+	if config.HealthAggregator != nil {
+		config.HealthAggregator.RegisterReporter(healthName, &health.HealthReport{
+			Live:  true,
+			Ready: true,
+		}, config.HealthTimeout)
 	}
 
 	dp.ifaceMonitor.Callback = dp.onIfaceStateChange
 	dp.ifaceMonitor.AddrCallback = dp.onIfaceAddrsChange
 
-	natTableV4 := iptables.NewTable(
-		"nat",
-		4,
-		rules.RuleHashPrefix,
-		iptables.TableOptions{
-			HistoricChainPrefixes:    rules.AllHistoricChainNamePrefixes,
-			ExtraCleanupRegexPattern: rules.HistoricInsertedNATRuleRegex,
-			InsertMode:               config.IptablesInsertMode,
-			RefreshInterval:          config.IptablesRefreshInterval,
-		},
-	)
-	rawTableV4 := iptables.NewTable(
-		"raw",
-		4,
-		rules.RuleHashPrefix,
-		iptables.TableOptions{
-			HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
-			InsertMode:            config.IptablesInsertMode,
-			RefreshInterval:       config.IptablesRefreshInterval,
-		})
-	filterTableV4 := iptables.NewTable(
-		"filter",
-		4,
-		rules.RuleHashPrefix,
-		iptables.TableOptions{
-			HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
-			InsertMode:            config.IptablesInsertMode,
-			RefreshInterval:       config.IptablesRefreshInterval,
-		})
-	ipSetsConfigV4 := config.RulesConfig.IPSetConfigV4
-	ipSetsV4 := ipsets.NewIPSets(ipSetsConfigV4)
+	// Load the persisted ID that identifies this instance of Felix.  We record it in a marker
+	// chain in each table so that we can tell our previous run's rules from those of another
+	// instance.  The marker also acts as a sentinel that lets us quickly detect that a table
+	// has been flushed.
+	instanceID := loadOrCreateInstanceID(config.InstanceIDFile)
+
+	execOptions := dataplaneexec.Options{
+		BinDir:       config.DataplaneBinDir,
+		HostNetnsPID: config.DataplaneHostNetnsPID,
+		Timeout:      config.IptablesCommandTimeout,
+		ReadOnly:     config.ReadOnly,
+	}
+
+	// Our tables are applied in parallel.  If enabled, they share the xtables lock so that
+	// they exclude other processes without excluding each other.  If we run the commands in
+	// the host's namespaces, they use the host's lock file so we must lock that one too.
+	var iptablesLock sync.Locker
+	if config.IptablesLockTimeout > 0 {
+		iptablesLock = iptables.NewSharedLock(
+			execOptions.HostPath(config.IptablesLockFilePath),
+			config.IptablesLockTimeout,
+			config.IptablesLockProbeInterval,
+		)
+	}
+
+	// All our tables share the same options, other than the NAT table, which also needs to
+	// clean up some historic rules.
+	iptablesOptions := iptables.TableOptions{
+		HistoricChainPrefixes:    rules.AllHistoricChainNamePrefixes,
+		InsertMode:               config.IptablesInsertMode,
+		RefreshInterval:          config.IptablesRefreshInterval,
+		MinResyncInterval:        config.IptablesMinResyncInterval,
+		ChainDeletionGracePeriod: config.IptablesChainDeletionGracePeriod,
+		MaxChainLength:           config.IptablesMaxChainLength,
+		MaxRestoreLines:          config.IptablesMaxRestoreLines,
+		PreValidate:              config.IptablesPreValidate,
+		HashAlgorithm:            config.IptablesRuleHashAlgorithm,
+		HashLength:               config.IptablesRuleHashLength,
+		HashSeed:                 config.IptablesRuleHashSeed,
+		InstanceMarkerChain:      rules.ChainInstanceMarker,
+		InstanceID:               instanceID,
+		InstanceEpoch:            newInstanceEpoch(),
+		FlushCheckInterval:       config.IptablesFlushCheckInterval,
+		Lock:                     iptablesLock,
+		AuditLog:                 dp.iptablesAuditLog,
+		Exec:                     execOptions,
+	}
+	if config.ReadOnly {
+		// We never write our instance marker rule so there's nothing to check for.
+		iptablesOptions.FlushCheckInterval = 0
+	}
+	iptablesFilterOptions := iptablesOptions
+	iptablesFilterOptions.FailureMode = config.IptablesFailureMode
+	iptablesMangleOptions := iptablesOptions
+	iptablesMangleOptions.FailureMode = config.IptablesMangleFailureMode
+	iptablesRawOptions := iptablesOptions
+	iptablesRawOptions.FailureMode = config.IptablesRawFailureMode
+	iptablesNATOptions := iptablesOptions
+	iptablesNATOptions.FailureMode = config.IptablesNATFailureMode
+	iptablesNATOptions.ExtraCleanupRegexPattern = rules.HistoricInsertedNATRuleRegex
+
+	newTable := func(name string, ipVersion uint8, options iptables.TableOptions) iptablesTableInfo {
+		options = dp.offlineRenderer.TableOptions(options, name, ipVersion)
+		return iptablesTableInfo{
+			IptablesTable: programmingLayer.NewIptablesTable(name, ipVersion, options),
+			name:          name,
+			ipVersion:     ipVersion,
+		}
+	}
+	newIPSets := func(ipSetsConfig *ipsets.IPVersionConfig) ipSetsInfo {
+		return ipSetsInfo{
+			IPSets: programmingLayer.NewIPSets(
+				ipSetsConfig,
+				dp.offlineRenderer.IPSetsExec(execOptions, ipSetsConfig.Family),
+			),
+			family: ipSetsConfig.Family,
+		}
+	}
+	routeTableOptions := config.RouteTableOptions
+	if dp.usingKernel && !config.ReadOnly {
+		dp.conntrackFlushQueue = conntrack.NewFlushQueue(conntrack.New(), config.ConntrackFlushRateLimit)
+		routeTableOptions.Conntrack = dp.conntrackFlushQueue
+	}
+	newRouteTable := func(ipVersion uint8) RouteTable {
+		return programmingLayer.NewRouteTable(
+			config.RulesConfig.WorkloadIfacePrefixes, ipVersion, routeTableOptions)
+	}
+	// registerPolicyRoutingManager creates the auxiliary route table and the policy routing
+	// rules for the given IP version, along with the manager that programs them.
+	registerPolicyRoutingManager := func(ipVersion uint8) {
+		if !dp.usingKernel || config.ReadOnly {
+			log.Info("Workload routing table configured but not programming the kernel " +
+				"or in read-only mode, not adding policy routing rules.")
+			return
+		}
+		auxOptions := routeTableOptions
+		auxOptions.TableIndex = config.WorkloadRoutingTableIndex
+		auxRouteTable := programmingLayer.NewRouteTable(
+			config.RulesConfig.WorkloadIfacePrefixes, ipVersion, auxOptions)
+		routeRules := routerule.New(ipVersion, []int{config.WorkloadRoutingTableIndex})
+		dp.routeTables = append(dp.routeTables, auxRouteTable)
+		dp.routeRules = append(dp.routeRules, routeRules)
+		dp.RegisterManager(newPolicyRoutingManager(
+			routeRules,
+			auxRouteTable,
+			ipVersion,
+			config.WorkloadRoutingTableIndex,
+			config.WorkloadRoutingRulePriority,
+		))
+	}
+
+	natTableV4 := newTable("nat", 4, iptablesNATOptions)
+	rawTableV4 := newTable("raw", 4, iptablesRawOptions)
+	filterTableV4 := newTable("filter", 4, iptablesFilterOptions)
+	mangleTableV4 := newTable("mangle", 4, iptablesMangleOptions)
+	ipSetsV4 := newIPSets(config.RulesConfig.IPSetConfigV4)
 	dp.iptablesNATTables = append(dp.iptablesNATTables, natTableV4)
 	dp.iptablesRawTables = append(dp.iptablesRawTables, rawTableV4)
+	dp.iptablesMangleTables = append(dp.iptablesMangleTables, mangleTableV4)
 	dp.iptablesFilterTables = append(dp.iptablesFilterTables, filterTableV4)
 	dp.ipSets = append(dp.ipSets, ipSetsV4)
 
-	routeTableV4 := routetable.New(config.RulesConfig.WorkloadIfacePrefixes, 4)
-	dp.routeTables = append(dp.routeTables, routeTableV4)
+	routeTableV4 := newRouteTable(4)
+	if dp.offlineRenderer == nil {
+		// In offline mode, the endpoint manager still calculates routes but we never
+		// apply them.
+		dp.routeTables = append(dp.routeTables, routeTableV4)
+	}
 
-	dp.endpointStatusCombiner = newEndpointStatusCombiner(dp.fromDataplane, config.IPv6Enabled)
+	dp.endpointStatusFiles = newEndpointStatusFiles(config.EndpointStatusFileDirectory)
+	dp.endpointStatusCombiner = newEndpointStatusCombiner(
+		dp.fromDataplane,
+		config.IPv6Enabled,
+		dp.endpointStatusFiles.OnEndpointStatus,
+	)
+	dp.policyStatusReporter = newPolicyStatusReporter(dp.fromDataplane)
+	dp.RegisterManager(dp.policyStatusReporter)
+	dp.processStatus = newProcessStatus()
+	dp.RegisterManager(dp.processStatus)
 
 	dp.RegisterManager(newIPSetsManager(ipSetsV4, config.MaxIPSetSize))
 	dp.RegisterManager(newPolicyManager(rawTableV4, filterTableV4, ruleRenderer, 4))
-	dp.RegisterManager(newEndpointManager(
+	dp.RegisterManager(newEndpointManagerWithShims(
 		rawTableV4,
 		filterTableV4,
 		ruleRenderer,
 		routeTableV4,
 		4,
 		config.RulesConfig.WorkloadIfacePrefixes,
-		dp.endpointStatusCombiner.OnEndpointStatusUpdate))
+		dp.endpointStatusCombiner.OnEndpointStatusUpdate,
+		dp.writeProcSys))
 	dp.RegisterManager(newFloatingIPManager(natTableV4, ruleRenderer, 4))
 	dp.RegisterManager(newMasqManager(ipSetsV4, natTableV4, ruleRenderer, config.MaxIPSetSize, 4))
+	dp.RegisterManager(newDSCPManager(mangleTableV4, ruleRenderer, config.WorkloadDSCPMode))
 	if config.RulesConfig.IPIPEnabled {
 		// Add a manger to keep the all-hosts IP set up to date.
 		dp.ipipManager = newIPIPManager(ipSetsV4, config.MaxIPSetSize)
 		dp.RegisterManager(dp.ipipManager) // IPv4-only
 	}
+	if config.VXLANEnabled {
+		if !dp.usingKernel || config.ReadOnly {
+			log.Info("VXLAN enabled but not programming the kernel or in read-only mode, " +
+				"not managing the VXLAN device.")
+		} else {
+			dp.vxlanManager = newVXLANManager(
+				config.Hostname,
+				config.VXLANVNI,
+				config.VXLANPort,
+				config.VXLANMTU,
+				config.VXLANTunnelAddress,
+			)
+			dp.RegisterManager(dp.vxlanManager) // IPv4-only
+		}
+	}
+	if config.WorkloadRoutingTableIndex != 0 {
+		registerPolicyRoutingManager(4)
+	}
+	if config.XDPEnabled {
+		if !dp.usingKernel || config.ReadOnly {
+			log.Info("XDP enabled but not programming the kernel or in read-only mode, " +
+				"not using XDP.")
+		} else {
+			dp.xdpManager = newXDPManager(
+				config.XDPProgramFile, config.RulesConfig.FailsafeInboundHostPorts)
+			dp.RegisterManager(dp.xdpManager) // IPv4-only
+		}
+	}
+	if config.ConntrackTuning.Enabled() {
+		if !dp.usingKernel || config.ReadOnly {
+			log.Info("Conntrack tuning enabled but not programming the kernel or in " +
+				"read-only mode, not applying it.")
+		} else {
+			dp.conntrackTuningManager = newConntrackTuningManager(config.ConntrackTuning)
+			dp.RegisterManager(dp.conntrackTuningManager)
+		}
+	}
 	if config.IPv6Enabled {
-		natTableV6 := iptables.NewTable(
-			"nat",
-			6,
-			rules.RuleHashPrefix,
-			iptables.TableOptions{
-				HistoricChainPrefixes:    rules.AllHistoricChainNamePrefixes,
-				ExtraCleanupRegexPattern: rules.HistoricInsertedNATRuleRegex,
-				InsertMode:               config.IptablesInsertMode,
-				RefreshInterval:          config.IptablesRefreshInterval,
-			},
-		)
-		rawTableV6 := iptables.NewTable(
-			"raw",
-			6,
-			rules.RuleHashPrefix,
-			iptables.TableOptions{
-				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
-				InsertMode:            config.IptablesInsertMode,
-				RefreshInterval:       config.IptablesRefreshInterval,
-			},
-		)
-		filterTableV6 := iptables.NewTable(
-			"filter",
-			6,
-			rules.RuleHashPrefix,
-			iptables.TableOptions{
-				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
-				InsertMode:            config.IptablesInsertMode,
-				RefreshInterval:       config.IptablesRefreshInterval,
-			},
-		)
-
-		ipSetsConfigV6 := config.RulesConfig.IPSetConfigV6
-		ipSetsV6 := ipsets.NewIPSets(ipSetsConfigV6)
+		natTableV6 := newTable("nat", 6, iptablesNATOptions)
+		rawTableV6 := newTable("raw", 6, iptablesRawOptions)
+		filterTableV6 := newTable("filter", 6, iptablesFilterOptions)
+		mangleTableV6 := newTable("mangle", 6, iptablesMangleOptions)
+		ipSetsV6 := newIPSets(config.RulesConfig.IPSetConfigV6)
 		dp.ipSets = append(dp.ipSets, ipSetsV6)
 		dp.iptablesNATTables = append(dp.iptablesNATTables, natTableV6)
 		dp.iptablesRawTables = append(dp.iptablesRawTables, rawTableV6)
+		dp.iptablesMangleTables = append(dp.iptablesMangleTables, mangleTableV6)
 		dp.iptablesFilterTables = append(dp.iptablesFilterTables, filterTableV6)
 
-		routeTableV6 := routetable.New(config.RulesConfig.WorkloadIfacePrefixes, 6)
-		dp.routeTables = append(dp.routeTables, routeTableV6)
+		routeTableV6 := newRouteTable(6)
+		if dp.offlineRenderer == nil {
+			dp.routeTables = append(dp.routeTables, routeTableV6)
+		}
 
 		dp.RegisterManager(newIPSetsManager(ipSetsV6, config.MaxIPSetSize))
 		dp.RegisterManager(newPolicyManager(rawTableV6, filterTableV6, ruleRenderer, 6))
-		dp.RegisterManager(newEndpointManager(
+		dp.RegisterManager(newEndpointManagerWithShims(
 			rawTableV6,
 			filterTableV6,
 			ruleRenderer,
 			routeTableV6,
 			6,
 			config.RulesConfig.WorkloadIfacePrefixes,
-			dp.endpointStatusCombiner.OnEndpointStatusUpdate))
+			dp.endpointStatusCombiner.OnEndpointStatusUpdate,
+			dp.writeProcSys))
 		dp.RegisterManager(newFloatingIPManager(natTableV6, ruleRenderer, 6))
 		dp.RegisterManager(newMasqManager(ipSetsV6, natTableV6, ruleRenderer, config.MaxIPSetSize, 6))
+		dp.RegisterManager(newDSCPManager(mangleTableV6, ruleRenderer, config.WorkloadDSCPMode))
+		if config.WorkloadRoutingTableIndex != 0 {
+			registerPolicyRoutingManager(6)
+		}
+	}
+	if config.RulesConfig.DropNFLOGGroup != 0 {
+		dp.dropCollector = collector.New()
+		dp.RegisterManager(dp.dropCollector)
+		denyCounter := collector.NewDenyCounter(config.DeniedPacketMetricsMaxSourceIPs)
+		dp.dropCollector.AddCallback(denyCounter.OnDropEvent)
+	}
+	if config.FlowLogs.Enabled() {
+		dp.flowLogAggregator = flowlog.NewAggregator()
+		dp.RegisterManager(dp.flowLogAggregator)
+		if dp.dropCollector != nil {
+			dp.dropCollector.AddCallback(dp.flowLogAggregator.OnDropEvent)
+		} else {
+			log.Warn("Flow logs enabled but drop attribution is disabled, denied flows " +
+				"won't be logged.  Set DropNFLOGGroup to log them.")
+		}
+	}
+
+	if config.PolicyCountersRefreshInterval > 0 {
+		dp.policyCounters = policyCountersCollector
 	}
 
 	for _, t := range dp.iptablesNATTables {
@@ -318,6 +723,9 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 	for _, t := range dp.iptablesRawTables {
 		dp.allIptablesTables = append(dp.allIptablesTables, t)
 	}
+	for _, t := range dp.iptablesMangleTables {
+		dp.allIptablesTables = append(dp.allIptablesTables, t)
+	}
 
 	return dp
 }
@@ -333,18 +741,56 @@ type Manager interface {
 	CompleteDeferredWork() error
 }
 
+// RegisterInSyncCallback registers a callback that is notified when the dataplane as a whole
+// (InSyncComponentDataplane), or one of its components, transitions between in-sync and
+// out-of-sync.  The callback is immediately called with the current state of any components
+// that have already reported.  It may be called concurrently with Start().
+func (d *InternalDataplane) RegisterInSyncCallback(cb InSyncCallback) {
+	d.inSyncReporter.AddCallback(cb)
+}
+
 func (d *InternalDataplane) RegisterManager(mgr Manager) {
 	d.allManagers = append(d.allManagers, mgr)
 }
 
 func (d *InternalDataplane) Start() {
+	// Make sure that we don't signal readiness until we've programmed the dataplane.
+	d.policyReadyFile.Remove()
+	d.endpointStatusFiles.RemoveAll()
+
 	// Do our start-of-day configuration.
 	d.doStaticDataplaneConfig()
 
 	// Then, start the worker threads.
 	go d.loopUpdatingDataplane()
 	go d.loopReportingStatus()
-	go d.ifaceMonitor.MonitorInterfaces()
+	if d.usingKernel {
+		go d.ifaceMonitor.MonitorInterfaces()
+	}
+	if d.applyWatchdog != nil {
+		go d.applyWatchdog.Loop()
+	}
+	if d.conntrackFlushQueue != nil {
+		go d.conntrackFlushQueue.Loop()
+	}
+	if d.dropCollector != nil && d.usingKernel {
+		packets := make(chan nflog.Packet, 1000)
+		group := d.config.RulesConfig.DropNFLOGGroup
+		if err := nflog.Subscribe(group, packets); err != nil {
+			log.WithError(err).WithField("group", group).Error(
+				"Failed to subscribe to drop NFLOG group, drops won't be attributed")
+		} else {
+			go d.dropCollector.LoopProcessingPackets(packets)
+		}
+	}
+	if d.flowLogAggregator != nil && d.usingKernel {
+		ipVersions := []uint8{4}
+		if d.config.IPv6Enabled {
+			ipVersions = append(ipVersions, 6)
+		}
+		reporter := flowlog.NewReporter(d.config.FlowLogs, d.flowLogAggregator, ipVersions)
+		go reporter.Loop()
+	}
 }
 
 // onIfaceStateChange is our interface monitor callback.  It gets called from the monitor's thread.
@@ -395,16 +841,28 @@ func (d *InternalDataplane) RecvMessage() (interface{}, error) {
 // once at start of day before starting the main loop.  The actual iptables programming is deferred
 // to the main loop.
 func (d *InternalDataplane) doStaticDataplaneConfig() {
-	// Check/configure global kernel parameters.
-	d.configureKernel()
-
-	// Endure that the default value of rp_filter is set to "strict" for newly-created
-	// interfaces.  This is required to prevent a race between starting an interface and
-	// Felix being able to configure it.
-	writeProcSys("/proc/sys/net/ipv4/conf/default/rp_filter", "1")
+	if d.usingKernel {
+		// Check/configure global kernel parameters.
+		d.configureKernel()
+
+		// Endure that the default value of rp_filter is set to "strict" for newly-created
+		// interfaces.  This is required to prevent a race between starting an interface
+		// and Felix being able to configure it.
+		d.writeProcSys("/proc/sys/net/ipv4/conf/default/rp_filter", "1")
+
+		if d.config.FlowLogs.Enabled() {
+			// Flow logs get their packet and byte counts from conntrack, which only
+			// maintains them if accounting is enabled.
+			err := d.writeProcSys("/proc/sys/net/netfilter/nf_conntrack_acct", "1")
+			if err != nil {
+				log.WithError(err).Warn("Failed to enable conntrack accounting, flow " +
+					"logs won't include packet and byte counts")
+			}
+		}
+	}
 
 	for _, t := range d.iptablesRawTables {
-		rawChains := d.ruleRenderer.StaticRawTableChains(t.IPVersion)
+		rawChains := d.ruleRenderer.StaticRawTableChains(t.ipVersion)
 		t.UpdateChains(rawChains)
 		t.SetRuleInsertions("PREROUTING", []iptables.Rule{{
 			Action: iptables.JumpAction{Target: rules.ChainRawPrerouting},
@@ -414,8 +872,16 @@ func (d *InternalDataplane) doStaticDataplaneConfig() {
 		}})
 	}
 
+	for _, t := range d.iptablesMangleTables {
+		mangleChains := d.ruleRenderer.StaticMangleTableChains(t.ipVersion)
+		t.UpdateChains(mangleChains)
+		t.SetRuleInsertions("PREROUTING", []iptables.Rule{{
+			Action: iptables.JumpAction{Target: rules.ChainManglePrerouting},
+		}})
+	}
+
 	for _, t := range d.iptablesFilterTables {
-		filterChains := d.ruleRenderer.StaticFilterTableChains(t.IPVersion)
+		filterChains := d.ruleRenderer.StaticFilterTableChains(t.ipVersion)
 		t.UpdateChains(filterChains)
 		t.SetRuleInsertions("FORWARD", []iptables.Rule{{
 			Action: iptables.JumpAction{Target: rules.ChainFilterForward},
@@ -428,7 +894,11 @@ func (d *InternalDataplane) doStaticDataplaneConfig() {
 		}})
 	}
 
-	if d.config.RulesConfig.IPIPEnabled {
+	if d.config.RulesConfig.IPIPEnabled && !d.usingKernel {
+		log.Info("IPIP enabled but not programming the kernel, not starting tunnel update thread.")
+	} else if d.config.RulesConfig.IPIPEnabled && d.config.ReadOnly {
+		log.Info("IPIP enabled but in read-only mode, not starting tunnel update thread.")
+	} else if d.config.RulesConfig.IPIPEnabled {
 		log.Info("IPIP enabled, starting thread to keep tunnel configuration in sync.")
 		go d.ipipManager.KeepIPIPDeviceInSync(
 			d.config.IPIPMTU,
@@ -439,7 +909,7 @@ func (d *InternalDataplane) doStaticDataplaneConfig() {
 	}
 
 	for _, t := range d.iptablesNATTables {
-		t.UpdateChains(d.ruleRenderer.StaticNATTableChains(t.IPVersion))
+		t.UpdateChains(d.ruleRenderer.StaticNATTableChains(t.ipVersion))
 		t.SetRuleInsertions("PREROUTING", []iptables.Rule{{
 			Action: iptables.JumpAction{Target: rules.ChainNATPrerouting},
 		}})
@@ -452,26 +922,85 @@ func (d *InternalDataplane) doStaticDataplaneConfig() {
 	}
 }
 
+// applyBurst returns the size of the apply throttle's token bucket.
+func applyBurst(config Config) int {
+	if config.ApplyBurst <= 0 {
+		return defaultApplyBurst
+	}
+	return config.ApplyBurst
+}
+
+// applyRefillInterval returns the interval at which we add a token to the apply throttle's
+// bucket in order to allow ApplyRateLimit applies per second.
+func applyRefillInterval(config Config) time.Duration {
+	rate := config.ApplyRateLimit
+	if rate <= 0 {
+		rate = defaultApplyRateLimit
+	}
+	return time.Second / time.Duration(rate)
+}
+
 func (d *InternalDataplane) loopUpdatingDataplane() {
 	log.Info("Started internal iptables dataplane driver loop")
 
 	// Retry any failed operations every 10s.
 	retryTicker := time.NewTicker(10 * time.Second)
-	var refreshC <-chan time.Time
-	if d.config.IptablesRefreshInterval > 0 {
-		refreshTicker := jitter.NewTicker(
-			d.config.IptablesRefreshInterval,
-			d.config.IptablesRefreshInterval/10,
-		)
-		refreshC = refreshTicker.C
+	var refreshTicker, ipSetsRefreshTicker *jitter.Ticker
+	var refreshC, ipSetsRefreshC <-chan time.Time
+	startRefreshTickers := func() {
+		if refreshTicker != nil {
+			refreshTicker.Stop()
+			refreshTicker, refreshC = nil, nil
+		}
+		if d.config.IptablesRefreshInterval > 0 {
+			refreshTicker = jitter.NewTicker(
+				d.config.IptablesRefreshInterval,
+				d.config.IptablesRefreshInterval/10,
+			)
+			refreshC = refreshTicker.C
+		}
+		if ipSetsRefreshTicker != nil {
+			ipSetsRefreshTicker.Stop()
+			ipSetsRefreshTicker, ipSetsRefreshC = nil, nil
+		}
+		if d.config.IpsetsRefreshInterval > 0 {
+			ipSetsRefreshTicker = jitter.NewTicker(
+				d.config.IpsetsRefreshInterval,
+				d.config.IpsetsRefreshInterval/10,
+			)
+			ipSetsRefreshC = ipSetsRefreshTicker.C
+		}
+	}
+	startRefreshTickers()
+
+	var policyCountersC <-chan time.Time
+	if d.policyCounters != nil {
+		policyCountersC = jitter.NewTicker(
+			d.config.PolicyCountersRefreshInterval,
+			d.config.PolicyCountersRefreshInterval/10,
+		).C
 	}
 
 	// Fill the apply throttle leaky bucket.
-	throttleC := jitter.NewTicker(100*time.Millisecond, 10*time.Millisecond).C
+	refillInterval := applyRefillInterval(d.config)
+	throttleC := jitter.NewTicker(refillInterval, refillInterval/10).C
 	beingThrottled := false
 
-	datastoreInSync := false
+	// Until the datastore is in sync (or the graceful restart timeout expires), we hold off
+	// applying the dataplane so that we don't disrupt existing endpoints.
+	gracefulRestart := newGracefulRestart(d.config.GracefulRestartTimeout)
+	var gracefulRestartC <-chan time.Time
+	if timeout := gracefulRestart.TimeUntilTimeout(); timeout > 0 {
+		gracefulRestartC = time.After(timeout)
+	}
+	// The apply scheduler may hold off applying to batch up updates.  applyDelayC is
+	// non-nil while we're waiting for it.
+	applySched := newApplyScheduler(d.config.ApplyDelay, d.config.ApplyMaxDelay, d.config.ApplyAdaptive)
+	var applyDelayC <-chan time.Time
+
 	doneFirstApply := false
+	doneFirstInSyncApply := false
+	lastApplyFailed := false
 
 	processMsgFromCalcGraph := func(msg interface{}) {
 		log.WithField("msg", msgStringer{msg: msg}).Infof(
@@ -480,11 +1009,11 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 		for _, mgr := range d.allManagers {
 			mgr.OnUpdate(msg)
 		}
+		gracefulRestart.OnUpdate(msg)
 		switch msg.(type) {
 		case *proto.InSync:
 			log.WithField("timeSinceStart", monotime.Since(processStartTime)).Info(
 				"Datastore in sync, flushing the dataplane for the first time...")
-			datastoreInSync = true
 		}
 	}
 
@@ -563,6 +1092,38 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 			log.Debug("Refreshing dataplane state")
 			d.forceDataplaneRefresh = true
 			d.dataplaneNeedsSync = true
+			if d.vxlanManager != nil {
+				// Check the VXLAN device and its FDB/ARP entries on the next apply.
+				d.vxlanManager.QueueResync()
+			}
+			if d.conntrackTuningManager != nil {
+				// Check that nothing has reset the conntrack settings.
+				d.conntrackTuningManager.QueueResync()
+			}
+			if d.xdpManager != nil {
+				// Reload the XDP deny lists and retry any interfaces that didn't
+				// support XDP.
+				d.xdpManager.QueueResync()
+			}
+		case <-ipSetsRefreshC:
+			log.Debug("Refreshing IP sets state")
+			d.forceIPSetsRefresh = true
+			d.dataplaneNeedsSync = true
+		case <-policyCountersC:
+			d.policyCounters.Update(d.allIptablesTables)
+		case <-d.cacheDumpRequests:
+			d.dumpCachesToLog()
+		case intervals := <-d.refreshIntervalUpdates:
+			log.WithFields(log.Fields{
+				"iptables": intervals.iptables,
+				"ipSets":   intervals.ipSets,
+			}).Info("Updating dataplane refresh intervals")
+			d.config.IptablesRefreshInterval = intervals.iptables
+			d.config.IpsetsRefreshInterval = intervals.ipSets
+			for _, t := range d.allIptablesTables {
+				t.SetRefreshInterval(intervals.iptables)
+			}
+			startRefreshTickers()
 		case <-d.reschedC:
 			log.Debug("Reschedule kick received")
 			d.dataplaneNeedsSync = true
@@ -571,10 +1132,25 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 		case <-throttleC:
 			log.Debug("Throttle kick received")
 			d.applyThrottle.Refill()
+		case <-gracefulRestartC:
+			log.Debug("Graceful restart timeout kick received")
+			gracefulRestartC = nil
+		case <-applyDelayC:
+			log.Debug("Apply delay kick received")
+			applyDelayC = nil
 		case <-retryTicker.C:
 		}
 
-		if datastoreInSync && d.dataplaneNeedsSync {
+		now := time.Now()
+		if d.dataplaneNeedsSync {
+			applySched.OnDirty(now)
+		}
+		if gracefulRestart.ApplyAllowed() && d.dataplaneNeedsSync && !applySched.ApplyDue(now) {
+			// Batching up updates; make sure we come back when the delay expires.
+			if applyDelayC == nil {
+				applyDelayC = time.After(applySched.NextApplyTime().Sub(now))
+			}
+		} else if gracefulRestart.ApplyAllowed() && d.dataplaneNeedsSync {
 			// Dataplane is out-of-sync, check if we're throttled.
 			if d.applyThrottle.Admit() {
 				if beingThrottled && d.applyThrottle.WouldAdmit() {
@@ -585,21 +1161,45 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 				applyStart := monotime.Now()
 
 				// Actually apply the changes to the dataplane.
+				if d.applyWatchdog != nil {
+					d.applyWatchdog.OnApplyStart()
+				}
 				d.apply()
+				if d.applyWatchdog != nil {
+					d.applyWatchdog.OnApplyEnd()
+				}
 
 				// Record stats.
 				applyTime := monotime.Since(applyStart)
 				summaryApplyTime.Observe(applyTime.Seconds())
+				d.processStatus.OnApplyComplete(time.Now(), !d.dataplaneNeedsSync)
+				applySched.OnApplyComplete(time.Now(), d.dataplaneNeedsSync)
 
-				if d.dataplaneNeedsSync {
+				lastApplyFailed = d.dataplaneNeedsSync
+				if lastApplyFailed {
 					// Dataplane is still dirty, record an error.
 					countDataplaneSyncErrors.Inc()
 				}
 				log.WithField("msecToApply", applyTime.Seconds()*1000.0).Info(
 					"Finished applying updates to dataplane.")
+
+				if gracefulRestart.OnApplyComplete() {
+					doneFirstInSyncApply = true
+					if d.config.PostInSyncCallback != nil {
+						d.config.PostInSyncCallback()
+					}
+					if d.offlineRenderer != nil {
+						log.Info("Finished rendering dataplane updates offline.")
+						d.offlineRenderer.Close()
+						if d.config.OfflineRenderCompleteCallback != nil {
+							d.config.OfflineRenderCompleteCallback()
+						}
+					}
+				}
 			} else {
 				if !beingThrottled {
 					log.Info("Dataplane updates throttled")
+					countApplyThrottled.Inc()
 					beingThrottled = true
 				}
 			}
@@ -608,14 +1208,32 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 					"secsSinceStart", monotime.Since(processStartTime).Seconds(),
 				).Info("Completed first update to dataplane.")
 				doneFirstApply = true
-				if d.config.PostInSyncCallback != nil {
-					d.config.PostInSyncCallback()
-				}
 			}
 		}
+		// An apply before the datastore is in sync (after the graceful restart timeout) may
+		// be incomplete so we don't count it as being in sync.
+		if doneFirstInSyncApply {
+			d.inSyncReporter.Report(InSyncComponentDataplane, !d.dataplaneNeedsSync)
+		}
+		if doneFirstInSyncApply && !d.dataplaneNeedsSync {
+			d.policyReadyFile.OnDataplaneInSync()
+		}
+		// The retry ticker guarantees that we get here at least every 10s, unless an apply
+		// is stuck.
+		d.reportHealth(doneFirstInSyncApply && !lastApplyFailed)
 	}
 }
 
+func (d *InternalDataplane) reportHealth(ready bool) {
+	if d.config.HealthAggregator == nil {
+		return
+	}
+	d.config.HealthAggregator.Report(healthName, &health.HealthReport{
+		Live:  true,
+		Ready: ready,
+	})
+}
+
 func (d *InternalDataplane) configureKernel() {
 	// For IPv4, we rely on the kernel's reverse path filtering to prevent workloads from
 	// spoofing their IP addresses.
@@ -663,7 +1281,7 @@ func (d *InternalDataplane) configureKernel() {
 
 	// Make sure the default for new interfaces is set to strict checking so that there's no
 	// race when a new interface is added and felix hasn't configured it yet.
-	writeProcSys("/proc/sys/net/ipv4/conf/default/rp_filter", "1")
+	d.writeProcSys("/proc/sys/net/ipv4/conf/default/rp_filter", "1")
 }
 
 func readRPFilter() (value int64, err error) {
@@ -693,12 +1311,15 @@ func (d *InternalDataplane) apply() {
 	d.dataplaneNeedsSync = false
 
 	// First, give the managers a chance to update IP sets and iptables.
+	managersInSync := true
 	for _, mgr := range d.allManagers {
 		err := mgr.CompleteDeferredWork()
 		if err != nil {
 			d.dataplaneNeedsSync = true
+			managersInSync = false
 		}
 	}
+	d.inSyncReporter.Report(InSyncComponentManagers, managersInSync)
 
 	if d.forceDataplaneRefresh {
 		// Refresh timer popped, ask the dataplane to resync as part of its update.
@@ -706,11 +1327,19 @@ func (d *InternalDataplane) apply() {
 			// Queue a resync on the next Apply().
 			r.QueueResync()
 		}
+		for _, r := range d.routeRules {
+			r.QueueResync()
+		}
+		d.forceDataplaneRefresh = false
+	}
+	if d.forceIPSetsRefresh {
+		// IP sets refresh timer popped, read back the IP sets and fix any members that
+		// have been changed by another process.
 		for _, r := range d.ipSets {
 			// Queue a resync on the next Apply().
 			r.QueueResync()
 		}
-		d.forceDataplaneRefresh = false
+		d.forceIPSetsRefresh = false
 	}
 
 	// Next, create/update IP sets.  We defer deletions of IP sets until after we update
@@ -718,7 +1347,7 @@ func (d *InternalDataplane) apply() {
 	var ipSetsWG sync.WaitGroup
 	for _, ipSets := range d.ipSets {
 		ipSetsWG.Add(1)
-		go func(ipSets *ipsets.IPSets) {
+		go func(ipSets IPSets) {
 			ipSets.ApplyUpdates()
 			ipSetsWG.Done()
 		}(ipSets)
@@ -727,20 +1356,26 @@ func (d *InternalDataplane) apply() {
 	// Update the routing table in parallel with the other updates.  We'll wait for it to finish
 	// before we return.
 	var routesWG sync.WaitGroup
-	for _, r := range d.routeTables {
+	routeErrs := make([]error, len(d.routeTables))
+	for i, r := range d.routeTables {
 		routesWG.Add(1)
-		go func(r *routetable.RouteTable) {
+		go func(i int, r RouteTable) {
 			err := r.Apply()
 			if err != nil {
 				log.Warn("Failed to synchronize routing table, will retry...")
 				d.dataplaneNeedsSync = true
 			}
+			routeErrs[i] = err
 			routesWG.Done()
-		}(r)
+		}(i, r)
 	}
 
 	// Wait for the IP sets update to finish.  We can't update iptables until it has.
 	ipSetsWG.Wait()
+	for _, ipSets := range d.ipSets {
+		// ApplyUpdates() panics if it fails to sync.
+		d.inSyncReporter.Report("ipsets-"+string(ipSets.family), true)
+	}
 
 	// Update iptables, this should sever any references to now-unused IP sets.
 	var reschedDelayMutex sync.Mutex
@@ -748,7 +1383,7 @@ func (d *InternalDataplane) apply() {
 	var iptablesWG sync.WaitGroup
 	for _, t := range d.allIptablesTables {
 		iptablesWG.Add(1)
-		go func(t *iptables.Table) {
+		go func(t IptablesTable) {
 			tableReschedAfter := t.Apply()
 
 			reschedDelayMutex.Lock()
@@ -760,22 +1395,79 @@ func (d *InternalDataplane) apply() {
 		}(t)
 	}
 	iptablesWG.Wait()
+	iptablesHealthy := true
+	ipSetRefsRemoved := true
+	policyRulesInSync := true
+	for _, t := range d.allIptablesTables {
+		d.inSyncReporter.Report(fmt.Sprintf("iptables-%s-v%d", t.name, t.ipVersion), t.InSync())
+		if t.Degraded() {
+			iptablesHealthy = false
+		}
+		if t.Degraded() || !t.InSync() {
+			// Make sure we retry and that we don't report ready until the table
+			// has caught up.
+			d.dataplaneNeedsSync = true
+		}
+		if (t.name == "filter" || t.name == "raw") && !t.InSync() {
+			// Policy and profile chains live in these tables.
+			policyRulesInSync = false
+		}
+		if !t.InSync() || t.HasPendingChainDeletions() {
+			// The dataplane may still have rules that reference the IP sets that we're
+			// about to delete.
+			ipSetRefsRemoved = false
+		}
+	}
+	d.inSyncReporter.Report(InSyncComponentIptablesHealth, iptablesHealthy)
+	if d.iptablesStateCache != nil {
+		d.iptablesStateCache.Update(d.allIptablesTables)
+	}
 
-	// Now clean up any left-over IP sets.
-	for _, ipSets := range d.ipSets {
-		ipSetsWG.Add(1)
-		go func(s *ipsets.IPSets) {
-			s.ApplyDeletions()
-			ipSetsWG.Done()
-		}(ipSets)
+	// Now clean up any left-over IP sets.  Deleting an IP set that is still referenced by an
+	// iptables rule would fail so, if iptables isn't fully up to date, we defer the deletions
+	// to a later apply.
+	if ipSetRefsRemoved {
+		for _, ipSets := range d.ipSets {
+			ipSetsWG.Add(1)
+			go func(s IPSets) {
+				s.ApplyDeletions()
+				ipSetsWG.Done()
+			}(ipSets)
+		}
+		ipSetsWG.Wait()
+	} else {
+		log.Debug("iptables may still reference IP sets, deferring IP set deletions.")
 	}
-	ipSetsWG.Wait()
 
 	// Wait for the route updates to finish.
 	routesWG.Wait()
+	routesInSync := true
+	for _, err := range routeErrs {
+		if err != nil {
+			routesInSync = false
+		}
+	}
+	for _, r := range d.routeTables {
+		if r.ConflictsChanged() {
+			// Schedule another apply so that the endpoint managers report the
+			// change in endpoint status.
+			d.dataplaneNeedsSync = true
+		}
+	}
+	for _, r := range d.routeRules {
+		// The rules point at routing tables that we've just updated.
+		if err := r.Apply(); err != nil {
+			log.Warn("Failed to synchronize routing rules, will retry...")
+			d.dataplaneNeedsSync = true
+			routesInSync = false
+		}
+	}
+	d.inSyncReporter.Report(InSyncComponentRoutes, routesInSync)
 
 	// And publish and status updates.
 	d.endpointStatusCombiner.Apply()
+	d.endpointStatusFiles.Apply(policyRulesInSync)
+	d.policyStatusReporter.Apply(policyRulesInSync)
 
 	// Set up any needed rescheduling kick.
 	if d.reschedC != nil {
@@ -813,14 +1505,42 @@ func (d *InternalDataplane) loopReportingStatus() {
 	time.Sleep(10 * time.Second)
 	for {
 		uptimeSecs := monotime.Since(processStartTime).Seconds()
-		d.fromDataplane <- &proto.ProcessStatusUpdate{
+		update := &proto.ProcessStatusUpdate{
 			IsoTimestamp: time.Now().UTC().Format(time.RFC3339),
 			Uptime:       uptimeSecs,
 		}
+		d.processStatus.Report(update)
+		d.fromDataplane <- update
 		time.Sleep(d.config.StatusReportingInterval)
 	}
 }
 
+// refreshIntervals holds the intervals at which we re-read the dataplane to check for changes
+// made by other processes.
+type refreshIntervals struct {
+	iptables time.Duration
+	ipSets   time.Duration
+}
+
+// UpdateRefreshIntervals changes the iptables and IP sets refresh intervals without restarting
+// the dataplane.  The change is made asynchronously by the main loop; if several updates are
+// made in quick succession, only the latest is guaranteed to be applied.
+func (d *InternalDataplane) UpdateRefreshIntervals(iptablesInterval, ipSetsInterval time.Duration) {
+	update := refreshIntervals{iptables: iptablesInterval, ipSets: ipSetsInterval}
+	for {
+		select {
+		case d.refreshIntervalUpdates <- update:
+			return
+		default:
+			// Discard the stale update that's blocking the channel and try again.
+			select {
+			case <-d.refreshIntervalUpdates:
+			default:
+			}
+		}
+	}
+}
+
 // iptablesTable is a shim interface for iptables.Table.
 type iptablesTable interface {
 	UpdateChain(chain *iptables.Chain)
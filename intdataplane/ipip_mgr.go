@@ -71,8 +71,15 @@ func newIPIPManagerWithShim(
 	return ipipMgr
 }
 
+// ipipOverhead is the number of bytes added to each packet by IPIP encapsulation.
+const ipipOverhead = 20
+
+// defaultIPIPMTU is the MTU we fall back to if MTU detection fails.
+const defaultIPIPMTU = 1440
+
 // KeepIPIPDeviceInSync is a goroutine that configures the IPIP tunnel device, then periodically
-// checks that it is still correctly configured.
+// checks that it is still correctly configured.  If mtu is 0, the MTU is detected from the
+// host's interfaces.
 func (d *ipipManager) KeepIPIPDeviceInSync(mtu int, address net.IP) {
 	log.Info("IPIP thread started.")
 	for {
@@ -88,6 +95,9 @@ func (d *ipipManager) KeepIPIPDeviceInSync(mtu int, address net.IP) {
 
 // configureIPIPDevice ensures the IPIP tunnel device is up and configures correctly.
 func (d *ipipManager) configureIPIPDevice(mtu int, address net.IP) error {
+	if mtu == 0 {
+		mtu = d.detectIPIPMTU()
+	}
 	logCxt := log.WithFields(log.Fields{
 		"mtu":        mtu,
 		"tunnelAddr": address,
@@ -130,28 +140,60 @@ func (d *ipipManager) configureIPIPDevice(mtu int, address net.IP) error {
 		logCxt.Info("Set tunnel admin up")
 	}
 
-	if err := d.setLinkAddressV4("tunl0", address); err != nil {
+	if err := setLinkAddressV4(d.dataplane, "tunl0", address); err != nil {
 		log.WithError(err).Warn("Failed to set tunnel device IP")
 		return err
 	}
 	return nil
 }
 
+// detectIPIPMTU calculates the MTU for the tunnel device from the smallest MTU of the host's
+// physical (or bond/VLAN) interfaces that are up, allowing for the IPIP overhead.
+func (d *ipipManager) detectIPIPMTU() int {
+	links, err := d.dataplane.LinkList()
+	if err != nil {
+		log.WithError(err).Warn("Failed to list interfaces for MTU detection, using default")
+		return defaultIPIPMTU
+	}
+	smallestMTU := 0
+	for _, link := range links {
+		switch link.Type() {
+		case "device", "bond", "vlan":
+		default:
+			continue
+		}
+		attrs := link.Attrs()
+		if attrs.Flags&net.FlagUp == 0 || attrs.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if smallestMTU == 0 || attrs.MTU < smallestMTU {
+			smallestMTU = attrs.MTU
+		}
+	}
+	if smallestMTU == 0 {
+		log.Warn("Failed to find any host interfaces for MTU detection, using default")
+		return defaultIPIPMTU
+	}
+	mtu := smallestMTU - ipipOverhead
+	log.WithField("mtu", mtu).Debug("Detected IPIP tunnel MTU")
+	return mtu
+}
+
 // setLinkAddressV4 updates the given link to set its local IP address.  It removes any other
 // addresses.
-func (d *ipipManager) setLinkAddressV4(linkName string, address net.IP) error {
+func setLinkAddressV4(dataplane linkAddrDataplane, linkName string, address net.IP) error {
 	logCxt := log.WithFields(log.Fields{
 		"link": linkName,
 		"addr": address,
 	})
 	logCxt.Debug("Setting local IPv4 address on link.")
-	link, err := d.dataplane.LinkByName(linkName)
+	link, err := dataplane.LinkByName(linkName)
 	if err != nil {
 		log.WithError(err).WithField("name", linkName).Warning("Failed to get device")
 		return err
 	}
 
-	addrs, err := d.dataplane.AddrList(link, netlink.FAMILY_V4)
+	addrs, err := dataplane.AddrList(link, netlink.FAMILY_V4)
 	if err != nil {
 		log.WithError(err).Warn("Failed to list interface addresses")
 		return err
@@ -165,7 +207,7 @@ func (d *ipipManager) setLinkAddressV4(linkName string, address net.IP) error {
 			continue
 		}
 		logCxt.WithField("oldAddr", oldAddr).Info("Removing old address")
-		if err := d.dataplane.AddrDel(link, &oldAddr); err != nil {
+		if err := dataplane.AddrDel(link, &oldAddr); err != nil {
 			log.WithError(err).Warn("Failed to delete address")
 			return err
 		}
@@ -181,7 +223,7 @@ func (d *ipipManager) setLinkAddressV4(linkName string, address net.IP) error {
 		addr := &netlink.Addr{
 			IPNet: &ipNet,
 		}
-		if err := d.dataplane.AddrAdd(link, addr); err != nil {
+		if err := dataplane.AddrAdd(link, addr); err != nil {
 			log.WithError(err).WithField("addr", address).Warn("Failed to add address")
 			return err
 		}
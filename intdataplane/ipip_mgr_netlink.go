@@ -20,14 +20,20 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
-// ipipDataplane is a shim interface for mocking netlink and os/exec in the IPIP manager.
-type ipipDataplane interface {
+// linkAddrDataplane is a shim interface for the netlink calls used by setLinkAddressV4().
+type linkAddrDataplane interface {
 	LinkByName(name string) (netlink.Link, error)
-	LinkSetMTU(link netlink.Link, mtu int) error
-	LinkSetUp(link netlink.Link) error
 	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
 	AddrAdd(link netlink.Link, addr *netlink.Addr) error
 	AddrDel(link netlink.Link, addr *netlink.Addr) error
+}
+
+// ipipDataplane is a shim interface for mocking netlink and os/exec in the IPIP manager.
+type ipipDataplane interface {
+	linkAddrDataplane
+	LinkList() ([]netlink.Link, error)
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetUp(link netlink.Link) error
 	RunCmd(name string, args ...string) error
 }
 
@@ -36,6 +42,10 @@ type realIPIPNetlink struct{}
 func (r realIPIPNetlink) LinkByName(name string) (netlink.Link, error) {
 	return netlink.LinkByName(name)
 }
+func (r realIPIPNetlink) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
 func (r realIPIPNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
 	return netlink.LinkSetMTU(link, mtu)
 }
@@ -139,6 +139,38 @@ var _ = Describe("IpipMgr (tunnel configuration)", func() {
 		})
 	})
 
+	Describe("after calling configureIPIPDevice with no MTU", func() {
+		BeforeEach(func() {
+			dataplane.hostLinks = []netlink.Link{
+				&netlink.Device{LinkAttrs: netlink.LinkAttrs{
+					Name: "lo", MTU: 65536, Flags: net.FlagUp | net.FlagLoopback}},
+				&netlink.Device{LinkAttrs: netlink.LinkAttrs{
+					Name: "eth0", MTU: 9000, Flags: net.FlagUp}},
+				&netlink.Device{LinkAttrs: netlink.LinkAttrs{
+					Name: "eth1", MTU: 1500, Flags: net.FlagUp}},
+				&netlink.Device{LinkAttrs: netlink.LinkAttrs{
+					Name: "eth2", MTU: 1000}},
+				&netlink.Veth{LinkAttrs: netlink.LinkAttrs{
+					Name: "cali1234", MTU: 1200, Flags: net.FlagUp}},
+			}
+			ipipMgr.configureIPIPDevice(0, ip)
+		})
+
+		It("should detect the MTU from the smallest up host interface", func() {
+			Expect(dataplane.tunnelLinkAttrs.MTU).To(Equal(1480))
+		})
+	})
+
+	Describe("after calling configureIPIPDevice with no MTU and no host interfaces", func() {
+		BeforeEach(func() {
+			ipipMgr.configureIPIPDevice(0, ip)
+		})
+
+		It("should use the default MTU", func() {
+			Expect(dataplane.tunnelLinkAttrs.MTU).To(Equal(1440))
+		})
+	})
+
 	Describe("after calling configureIPIPDevice with no IP", func() {
 		BeforeEach(func() {
 			ipipMgr.configureIPIPDevice(1400, nil)
@@ -327,6 +359,7 @@ type mockIPIPDataplane struct {
 	tunnelLink      *mockLink
 	tunnelLinkAttrs *netlink.LinkAttrs
 	addrs           []netlink.Addr
+	hostLinks       []netlink.Link
 
 	RunCmdCalled     bool
 	LinkSetMTUCalled bool
@@ -367,6 +400,17 @@ func (d *mockIPIPDataplane) LinkByName(name string) (netlink.Link, error) {
 	return d.tunnelLink, nil
 }
 
+func (d *mockIPIPDataplane) LinkList() ([]netlink.Link, error) {
+	if err := d.incCallCount(); err != nil {
+		return nil, err
+	}
+	links := append([]netlink.Link{}, d.hostLinks...)
+	if d.tunnelLink != nil {
+		links = append(links, d.tunnelLink)
+	}
+	return links, nil
+}
+
 func (d *mockIPIPDataplane) LinkSetMTU(link netlink.Link, mtu int) error {
 	d.LinkSetMTUCalled = true
 	if err := d.incCallCount(); err != nil {
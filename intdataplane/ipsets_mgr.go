@@ -44,8 +44,17 @@ func (m *ipSetsManager) OnUpdate(msg interface{}) {
 		m.ipsetsDataplane.RemoveMembers(msg.Id, msg.RemovedMembers)
 	case *proto.IPSetUpdate:
 		log.WithField("ipSetId", msg.Id).Debug("IP set update")
+		setType := ipsets.IPSetTypeHashIP
+		switch msg.Type {
+		case proto.IPSetUpdate_IP_AND_PORT:
+			// Named port IP sets, members look like "10.0.0.1,tcp:8080".
+			setType = ipsets.IPSetTypeHashIPPort
+		case proto.IPSetUpdate_NET:
+			// Selectors that match network sets; members are CIDRs.
+			setType = ipsets.IPSetTypeHashNet
+		}
 		metadata := ipsets.IPSetMetadata{
-			Type:    ipsets.IPSetTypeHashIP,
+			Type:    setType,
 			SetID:   msg.Id,
 			MaxSize: m.maxSize,
 		}
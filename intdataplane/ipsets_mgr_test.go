@@ -18,6 +18,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/projectcalico/felix/ipsets"
 	"github.com/projectcalico/felix/proto"
 	"github.com/projectcalico/felix/set"
 )
@@ -100,4 +101,39 @@ var _ = Describe("IP Sets manager", func() {
 			})
 		})
 	})
+	Describe("after sending a replace for a named port IP set", func() {
+		BeforeEach(func() {
+			ipsetsMgr.OnUpdate(&proto.IPSetUpdate{
+				Id:      "id2",
+				Type:    proto.IPSetUpdate_IP_AND_PORT,
+				Members: []string{"10.0.0.1,tcp:8080", "10.0.0.2,udp:53"},
+			})
+			ipsetsMgr.CompleteDeferredWork()
+		})
+		It("should create a hash:ip,port IP set", func() {
+			Expect(ipSets.Metadata["id2"].Type).To(Equal(ipsets.IPSetTypeHashIPPort))
+		})
+		It("should add the right members", func() {
+			expMembers := set.From("10.0.0.1,tcp:8080", "10.0.0.2,udp:53")
+			Expect(ipSets.Members["id2"]).To(Equal(expMembers))
+		})
+	})
+
+	Describe("after sending a replace for a network IP set", func() {
+		BeforeEach(func() {
+			ipsetsMgr.OnUpdate(&proto.IPSetUpdate{
+				Id:      "id3",
+				Type:    proto.IPSetUpdate_NET,
+				Members: []string{"10.0.0.0/8", "192.168.1.1/32"},
+			})
+			ipsetsMgr.CompleteDeferredWork()
+		})
+		It("should create a hash:net IP set", func() {
+			Expect(ipSets.Metadata["id3"].Type).To(Equal(ipsets.IPSetTypeHashNet))
+		})
+		It("should add the right members", func() {
+			expMembers := set.From("10.0.0.0/8", "192.168.1.1/32")
+			Expect(ipSets.Members["id3"]).To(Equal(expMembers))
+		})
+	})
 })
@@ -0,0 +1,102 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/dataplaneexec"
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/iptables"
+)
+
+// offlineRenderer supports the offline render mode, in which, rather than programming the
+// dataplane, we write the input that we would have passed to iptables-restore and
+// ipset restore to files, as if the dataplane started out empty.  A nil *offlineRenderer
+// leaves the options unchanged so that callers don't need to check whether the mode is
+// enabled.
+type offlineRenderer struct {
+	dir   string
+	files []*os.File
+}
+
+func newOfflineRenderer(dir string) *offlineRenderer {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.WithError(err).WithField("dir", dir).Panic("Failed to create offline render directory")
+	}
+	return &offlineRenderer{dir: dir}
+}
+
+func (o *offlineRenderer) openFile(name string) *os.File {
+	path := filepath.Join(o.dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Panic("Failed to create offline render file")
+	}
+	log.WithField("path", path).Info("Rendering dataplane updates to file")
+	o.files = append(o.files, f)
+	return f
+}
+
+// TableOptions returns a copy of the given options, modified to render the given table to a
+// file.
+func (o *offlineRenderer) TableOptions(
+	options iptables.TableOptions,
+	table string,
+	ipVersion uint8,
+) iptables.TableOptions {
+	if o == nil {
+		return options
+	}
+	options.Exec.RenderOnly = o.openFile(fmt.Sprintf("iptables-v%d-%s.rules", ipVersion, table))
+	// There's no dataplane to check or lock.
+	options.FlushCheckInterval = 0
+	options.PreValidate = false
+	options.Lock = nil
+	return options
+}
+
+// IPSetsExec returns a copy of the given options, modified to render the IP sets of the
+// given family to a file.
+func (o *offlineRenderer) IPSetsExec(
+	execOptions dataplaneexec.Options,
+	family ipsets.IPFamily,
+) dataplaneexec.Options {
+	if o == nil {
+		return execOptions
+	}
+	execOptions.RenderOnly = o.openFile(fmt.Sprintf("ipsets-%s.rules", family))
+	return execOptions
+}
+
+// Close closes the files.
+func (o *offlineRenderer) Close() {
+	if o == nil {
+		return
+	}
+	for _, f := range o.files {
+		if err := f.Close(); err != nil {
+			log.WithError(err).WithField("path", f.Name()).Error("Failed to close offline render file")
+		}
+	}
+	o.files = nil
+}
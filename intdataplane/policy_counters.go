@@ -0,0 +1,143 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+var (
+	descPolicyPackets = prometheus.NewDesc(
+		"felix_policy_packets",
+		"Number of packets that matched a rule of the policy or profile.",
+		[]string{"kind", "name", "direction"},
+		nil,
+	)
+	descPolicyBytes = prometheus.NewDesc(
+		"felix_policy_bytes",
+		"Number of bytes that matched a rule of the policy or profile.",
+		[]string{"kind", "name", "direction"},
+		nil,
+	)
+
+	// policyCountersCollector is shared by all dataplane drivers in the process, since a
+	// Collector can only be registered once.  It exports nothing until a driver with policy
+	// counters enabled starts updating it.
+	policyCountersCollector = newPolicyCounters()
+)
+
+func init() {
+	prometheus.MustRegister(policyCountersCollector)
+}
+
+// ruleCounterKey identifies a policy rule as rendered into a particular table; the same
+// policy is rendered into more than one table, for example for each IP version.
+type ruleCounterKey struct {
+	table     string
+	ipVersion uint8
+	origin    iptables.RuleOrigin
+}
+
+type policyCounterKey struct {
+	kind      string
+	name      string
+	direction string
+}
+
+// policyCounters is a prometheus Collector that exports per-policy and per-profile packet and
+// byte counters.  The counters come from the iptables rules that we render from each policy,
+// which we map back to the policy via the rule hashes.  Since the kernel resets a rule's
+// counters when we rewrite it, the exported counters go backwards when a policy is updated;
+// prometheus treats that as a counter reset.
+type policyCounters struct {
+	lock     sync.Mutex
+	counters map[policyCounterKey]iptables.RuleCounters
+}
+
+func newPolicyCounters() *policyCounters {
+	return &policyCounters{
+		counters: map[policyCounterKey]iptables.RuleCounters{},
+	}
+}
+
+func (c *policyCounters) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descPolicyPackets
+	ch <- descPolicyBytes
+}
+
+func (c *policyCounters) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, counters := range c.counters {
+		ch <- prometheus.MustNewConstMetric(descPolicyPackets, prometheus.CounterValue,
+			float64(counters.Packets), key.kind, key.name, key.direction)
+		ch <- prometheus.MustNewConstMetric(descPolicyBytes, prometheus.CounterValue,
+			float64(counters.Bytes), key.kind, key.name, key.direction)
+	}
+}
+
+// Update reads the rule counters from the given tables and recalculates the per-policy
+// counters.  It must be called from the dataplane goroutine since it uses the tables.  If any
+// table fails, the previous counters are kept so that the totals don't jump around.
+func (c *policyCounters) Update(tables []iptablesTableInfo) {
+	// A policy rule may be rendered as several iptables rules, for example one to match
+	// and mark the packet and another to return.  Counting each of those would count the
+	// same packets more than once so we take the largest counters of the iptables rules
+	// that came from each policy rule.
+	ruleCounters := map[ruleCounterKey]iptables.RuleCounters{}
+	for _, t := range tables {
+		hashToCounters, err := t.ReadRuleCounters()
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"table":     t.name,
+				"ipVersion": t.ipVersion,
+			}).Warn("Failed to read iptables counters, will retry")
+			return
+		}
+		for hash, counters := range hashToCounters {
+			info, ok := t.LookupRuleHash(hash)
+			if !ok || info.Origin == nil {
+				continue
+			}
+			key := ruleCounterKey{table: t.name, ipVersion: t.ipVersion, origin: *info.Origin}
+			if counters.Packets >= ruleCounters[key].Packets {
+				ruleCounters[key] = counters
+			}
+		}
+	}
+
+	newCounters := map[policyCounterKey]iptables.RuleCounters{}
+	for ruleKey, counters := range ruleCounters {
+		key := policyCounterKey{
+			kind:      strings.ToLower(ruleKey.origin.Kind),
+			name:      ruleKey.origin.Name,
+			direction: ruleKey.origin.Direction,
+		}
+		total := newCounters[key]
+		total.Packets += counters.Packets
+		total.Bytes += counters.Bytes
+		newCounters[key] = total
+	}
+
+	c.lock.Lock()
+	c.counters = newCounters
+	c.lock.Unlock()
+}
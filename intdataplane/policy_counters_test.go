@@ -0,0 +1,108 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+// counterTable is a mock IptablesTable that only supports reading rule counters.
+type counterTable struct {
+	IptablesTable
+	counters map[string]iptables.RuleCounters
+	infos    map[string]iptables.RuleInfo
+	err      error
+}
+
+func (t *counterTable) ReadRuleCounters() (map[string]iptables.RuleCounters, error) {
+	return t.counters, t.err
+}
+
+func (t *counterTable) LookupRuleHash(hash string) (iptables.RuleInfo, bool) {
+	info, ok := t.infos[hash]
+	return info, ok
+}
+
+var _ = Describe("Policy counters", func() {
+	var pc *policyCounters
+	var v4, v6 *counterTable
+	var tables []iptablesTableInfo
+
+	allowRule0 := &iptables.RuleOrigin{Kind: "Policy", Name: "default/allow", Direction: "inbound"}
+	allowRule1 := &iptables.RuleOrigin{Kind: "Policy", Name: "default/allow", Direction: "inbound", RuleIndex: 1}
+	profileRule := &iptables.RuleOrigin{Kind: "Profile", Name: "prof", Direction: "outbound"}
+
+	BeforeEach(func() {
+		pc = newPolicyCounters()
+		v4 = &counterTable{
+			counters: map[string]iptables.RuleCounters{
+				// Rule 0 is rendered as two iptables rules.
+				"hash-a": {Packets: 10, Bytes: 1000},
+				"hash-b": {Packets: 8, Bytes: 800},
+				"hash-c": {Packets: 1, Bytes: 100},
+				"hash-d": {Packets: 3, Bytes: 300},
+				// No origin.
+				"hash-e": {Packets: 100, Bytes: 10000},
+			},
+			infos: map[string]iptables.RuleInfo{
+				"hash-a": {Chain: "cali-pi-default/allow", RuleNum: 1, Origin: allowRule0},
+				"hash-b": {Chain: "cali-pi-default/allow", RuleNum: 2, Origin: allowRule0},
+				"hash-c": {Chain: "cali-pi-default/allow", RuleNum: 3, Origin: allowRule1},
+				"hash-d": {Chain: "cali-pro-prof", RuleNum: 1, Origin: profileRule},
+				"hash-e": {Chain: "cali-FORWARD", RuleNum: 1},
+			},
+		}
+		v6 = &counterTable{
+			counters: map[string]iptables.RuleCounters{
+				"hash-a": {Packets: 5, Bytes: 500},
+			},
+			infos: map[string]iptables.RuleInfo{
+				"hash-a": {Chain: "cali-pi-default/allow", RuleNum: 1, Origin: allowRule0},
+			},
+		}
+		tables = []iptablesTableInfo{
+			{IptablesTable: v4, name: "filter", ipVersion: 4},
+			{IptablesTable: v6, name: "filter", ipVersion: 6},
+		}
+	})
+
+	It("should total the counters of each policy and profile", func() {
+		pc.Update(tables)
+		Expect(pc.counters).To(Equal(map[policyCounterKey]iptables.RuleCounters{
+			{kind: "policy", name: "default/allow", direction: "inbound"}: {Packets: 16, Bytes: 1600},
+			{kind: "profile", name: "prof", direction: "outbound"}:        {Packets: 3, Bytes: 300},
+		}))
+	})
+
+	It("should keep the previous counters if a table fails", func() {
+		pc.Update(tables)
+		v6.err = errors.New("iptables-save failed")
+		v4.counters["hash-d"] = iptables.RuleCounters{Packets: 4, Bytes: 400}
+		pc.Update(tables)
+		Expect(pc.counters[policyCounterKey{kind: "profile", name: "prof", direction: "outbound"}]).To(
+			Equal(iptables.RuleCounters{Packets: 3, Bytes: 300}))
+	})
+
+	It("should already be registered with prometheus", func() {
+		// Drivers share the package-level collector; registering another would fail.
+		Expect(prometheus.Register(newPolicyCounters())).To(HaveOccurred())
+	})
+})
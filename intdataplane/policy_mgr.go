@@ -33,6 +33,7 @@ type policyManager struct {
 
 type policyRenderer interface {
 	PolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain
+	RawPolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain
 	ProfileToIptablesChains(profileID *proto.ProfileID, policy *proto.Profile, ipVersion uint8) []*iptables.Chain
 }
 
@@ -49,9 +50,10 @@ func (m *policyManager) OnUpdate(msg interface{}) {
 	switch msg := msg.(type) {
 	case *proto.ActivePolicyUpdate:
 		log.WithField("id", msg.Id).Debug("Updating policy chains")
-		chains := m.ruleRenderer.PolicyToIptablesChains(msg.Id, msg.Policy, m.ipVersion)
-		m.rawTable.UpdateChains(chains)
-		m.filterTable.UpdateChains(chains)
+		m.rawTable.UpdateChains(
+			m.ruleRenderer.RawPolicyToIptablesChains(msg.Id, msg.Policy, m.ipVersion))
+		m.filterTable.UpdateChains(
+			m.ruleRenderer.PolicyToIptablesChains(msg.Id, msg.Policy, m.ipVersion))
 	case *proto.ActivePolicyRemove:
 		log.WithField("id", msg.Id).Debug("Removing policy chains")
 		inName := rules.PolicyChainName(rules.PolicyInboundPfx, msg.Id)
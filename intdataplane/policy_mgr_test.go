@@ -95,10 +95,10 @@ var _ = Describe("Policy manager", func() {
 			policyMgr.CompleteDeferredWork()
 		})
 
-		It("should install the raw chains", func() {
+		It("should install the raw table's rendering of the chains", func() {
 			rawTable.checkChains([][]*iptables.Chain{{
-				{Name: "cali-pi-pol1"},
-				{Name: "cali-po-pol1"},
+				{Name: "cali-pi-pol1", Rules: []iptables.Rule{{Comment: "raw"}}},
+				{Name: "cali-po-pol1", Rules: []iptables.Rule{{Comment: "raw"}}},
 			}})
 		})
 		It("should install to the filter chain", func() {
@@ -172,6 +172,14 @@ func (r *mockPolRenderer) PolicyToIptablesChains(policyID *proto.PolicyID, polic
 		{Name: outName},
 	}
 }
+func (r *mockPolRenderer) RawPolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain {
+	inName := rules.PolicyChainName(rules.PolicyInboundPfx, policyID)
+	outName := rules.PolicyChainName(rules.PolicyOutboundPfx, policyID)
+	return []*iptables.Chain{
+		{Name: inName, Rules: []iptables.Rule{{Comment: "raw"}}},
+		{Name: outName, Rules: []iptables.Rule{{Comment: "raw"}}},
+	}
+}
 func (r *mockPolRenderer) ProfileToIptablesChains(profID *proto.ProfileID, policy *proto.Profile, ipVersion uint8) []*iptables.Chain {
 	inName := rules.ProfileChainName(rules.ProfileInboundPfx, profID)
 	outName := rules.ProfileChainName(rules.ProfileOutboundPfx, profID)
@@ -0,0 +1,88 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// policyReadyFile manages a file that signals to the CNI plugin that Felix has programmed
+// policy into the dataplane.  The file is removed at start of day, so that a stale file left
+// over from before a reboot can't be mistaken for readiness, then it is written once the
+// dataplane is first in sync and refreshed periodically while it stays in sync.  The file
+// contains the time of the last refresh so that consumers can detect a stalled Felix.
+type policyReadyFile struct {
+	path            string
+	refreshInterval time.Duration
+	lastWrite       time.Time
+
+	// Shims for testing.
+	timeNow func() time.Time
+}
+
+func newPolicyReadyFile(path string, refreshInterval time.Duration) *policyReadyFile {
+	return &policyReadyFile{
+		path:            path,
+		refreshInterval: refreshInterval,
+		timeNow:         time.Now,
+	}
+}
+
+// Remove removes the file, if it exists.  It is a no-op if no path was configured.
+func (f *policyReadyFile) Remove() {
+	if f.path == "" {
+		return
+	}
+	err := os.Remove(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("path", f.path).Warn("Failed to remove policy ready file")
+	}
+	f.lastWrite = time.Time{}
+}
+
+// OnDataplaneInSync should be called each time the dataplane is found to be in sync.  It
+// (re)writes the file if it hasn't been written within the refresh interval.
+func (f *policyReadyFile) OnDataplaneInSync() {
+	if f.path == "" {
+		return
+	}
+	now := f.timeNow()
+	if !f.lastWrite.IsZero() && now.Sub(f.lastWrite) < f.refreshInterval {
+		return
+	}
+	logCxt := log.WithField("path", f.path)
+	// Write to a temporary file and then rename it into place so that readers never see a
+	// partially-written file.
+	tmpPath := filepath.Join(filepath.Dir(f.path), "."+filepath.Base(f.path)+".tmp")
+	err := ioutil.WriteFile(tmpPath, []byte(now.UTC().Format(time.RFC3339)+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, f.path)
+	}
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to write policy ready file")
+		return
+	}
+	if f.lastWrite.IsZero() {
+		logCxt.Info("Wrote policy ready file")
+	} else {
+		logCxt.Debug("Refreshed policy ready file")
+	}
+	f.lastWrite = now
+}
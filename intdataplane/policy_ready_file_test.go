@@ -0,0 +1,91 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy ready file", func() {
+	var (
+		dir       string
+		path      string
+		readyFile *policyReadyFile
+		now       time.Time
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-ready-file")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "policy-ready")
+		now = time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+		readyFile = newPolicyReadyFile(path, 5*time.Second)
+		readyFile.timeNow = func() time.Time { return now }
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	readContents := func() string {
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	It("should remove a stale file", func() {
+		Expect(ioutil.WriteFile(path, []byte("stale"), 0644)).To(Succeed())
+		readyFile.Remove()
+		_, err := os.Stat(path)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should tolerate removing a non-existent file", func() {
+		readyFile.Remove()
+		_, err := os.Stat(path)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should write the file once in sync", func() {
+		readyFile.OnDataplaneInSync()
+		Expect(readContents()).To(Equal("2017-03-01T12:00:00Z\n"))
+	})
+
+	It("should only refresh the file after the refresh interval", func() {
+		readyFile.OnDataplaneInSync()
+		now = now.Add(4 * time.Second)
+		readyFile.OnDataplaneInSync()
+		Expect(readContents()).To(Equal("2017-03-01T12:00:00Z\n"))
+		now = now.Add(time.Second)
+		readyFile.OnDataplaneInSync()
+		Expect(readContents()).To(Equal("2017-03-01T12:00:05Z\n"))
+	})
+
+	It("should be a no-op with no path configured", func() {
+		readyFile = newPolicyReadyFile("", 5*time.Second)
+		readyFile.Remove()
+		readyFile.OnDataplaneInSync()
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+})
@@ -0,0 +1,159 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/routerule"
+	"github.com/projectcalico/felix/routetable"
+)
+
+// routeRules is the interface to the policy routing rules that the policyRoutingManager
+// programs; it is implemented by routerule.RouteRules.
+type routeRules interface {
+	SetRule(rule routerule.Rule)
+	RemoveRule(rule routerule.Rule)
+}
+
+// RouteRules is the interface to the policy routing rules of one IP version that the
+// dataplane applies.
+type RouteRules interface {
+	routeRules
+	QueueResync()
+	Apply() error
+}
+
+// policyRoutingManager steers traffic from local workloads into an auxiliary routing table.
+// For each active workload endpoint, it adds a policy routing rule that looks up traffic from
+// the endpoint's IPs in the auxiliary table and it mirrors the endpoint's routes into that
+// table so that traffic between local workloads still reaches them.  The operator supplies
+// whatever other routes they need in the table (for example, a default route via an egress
+// gateway).  Traffic that doesn't match a route in the table falls through to the main table.
+type policyRoutingManager struct {
+	ipVersion  uint8
+	tableIndex int
+	priority   int
+
+	// Our dependencies.
+	routeRules routeRules
+	routeTable routeTable
+
+	// Internal state.
+	activeRules  map[proto.WorkloadEndpointID][]routerule.Rule
+	activeIfaces map[proto.WorkloadEndpointID]string
+}
+
+func newPolicyRoutingManager(
+	routeRules routeRules,
+	routeTable routeTable,
+	ipVersion uint8,
+	tableIndex int,
+	priority int,
+) *policyRoutingManager {
+	return &policyRoutingManager{
+		ipVersion:    ipVersion,
+		tableIndex:   tableIndex,
+		priority:     priority,
+		routeRules:   routeRules,
+		routeTable:   routeTable,
+		activeRules:  map[proto.WorkloadEndpointID][]routerule.Rule{},
+		activeIfaces: map[proto.WorkloadEndpointID]string{},
+	}
+}
+
+func (m *policyRoutingManager) OnUpdate(protoBufMsg interface{}) {
+	switch msg := protoBufMsg.(type) {
+	case *proto.WorkloadEndpointUpdate:
+		m.onWorkloadEndpointUpdate(*msg.Id, msg.Endpoint)
+	case *proto.WorkloadEndpointRemove:
+		m.removeEndpoint(*msg.Id)
+	}
+}
+
+func (m *policyRoutingManager) onWorkloadEndpointUpdate(
+	id proto.WorkloadEndpointID,
+	workload *proto.WorkloadEndpoint,
+) {
+	logCxt := log.WithField("id", id)
+	if oldIface, ok := m.activeIfaces[id]; ok && oldIface != workload.Name {
+		logCxt.Debug("Endpoint interface changed, removing routes from old interface")
+		m.routeTable.SetRoutes(oldIface, nil)
+	}
+
+	var cidrs []ip.CIDR
+	if workload.State == "active" {
+		ipStrings := workload.Ipv4Nets
+		if m.ipVersion == 6 {
+			ipStrings = workload.Ipv6Nets
+		}
+		for _, s := range ipStrings {
+			cidrs = append(cidrs, ip.MustParseCIDR(s))
+		}
+	}
+
+	var mac net.HardwareAddr
+	if workload.Mac != "" {
+		var err error
+		mac, err = net.ParseMAC(workload.Mac)
+		if err != nil {
+			logCxt.WithError(err).Error("Failed to parse endpoint's MAC address")
+		}
+	}
+
+	// Remove the old rules before adding the new ones so that rules that are in both
+	// survive.
+	for _, rule := range m.activeRules[id] {
+		m.routeRules.RemoveRule(rule)
+	}
+	var rules []routerule.Rule
+	var routeTargets []routetable.Target
+	for _, cidr := range cidrs {
+		rule := routerule.Rule{
+			Priority:   m.priority,
+			Src:        cidr,
+			TableIndex: m.tableIndex,
+		}
+		m.routeRules.SetRule(rule)
+		rules = append(rules, rule)
+		routeTargets = append(routeTargets, routetable.Target{
+			CIDR:    cidr,
+			DestMAC: mac,
+		})
+	}
+	m.routeTable.SetRoutes(workload.Name, routeTargets)
+	m.activeRules[id] = rules
+	m.activeIfaces[id] = workload.Name
+}
+
+func (m *policyRoutingManager) removeEndpoint(id proto.WorkloadEndpointID) {
+	for _, rule := range m.activeRules[id] {
+		m.routeRules.RemoveRule(rule)
+	}
+	if iface, ok := m.activeIfaces[id]; ok {
+		m.routeTable.SetRoutes(iface, nil)
+	}
+	delete(m.activeRules, id)
+	delete(m.activeIfaces, id)
+}
+
+func (m *policyRoutingManager) CompleteDeferredWork() error {
+	// The rules and routes are applied by the dataplane along with the other route tables.
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/routerule"
+	"github.com/projectcalico/felix/routetable"
+	"github.com/projectcalico/felix/set"
+)
+
+var _ = Describe("Policy routing manager", func() {
+	var (
+		mgr        *policyRoutingManager
+		rules      *mockRouteRules
+		routeTable *mockRouteTable
+	)
+
+	BeforeEach(func() {
+		rules = &mockRouteRules{rules: set.New()}
+		routeTable = &mockRouteTable{currentRoutes: map[string][]routetable.Target{}}
+		mgr = newPolicyRoutingManager(rules, routeTable, 4, 200, 100)
+	})
+
+	wlID := proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "pod-1",
+		EndpointId:     "eth0",
+	}
+	endpointUpdate := func(state, ifaceName string, nets ...string) *proto.WorkloadEndpointUpdate {
+		return &proto.WorkloadEndpointUpdate{
+			Id: &wlID,
+			Endpoint: &proto.WorkloadEndpoint{
+				State:    state,
+				Name:     ifaceName,
+				Mac:      "01:02:03:04:05:06",
+				Ipv4Nets: nets,
+				Ipv6Nets: []string{"fd00::1/128"},
+			},
+		}
+	}
+	ruleFor := func(cidr string) routerule.Rule {
+		return routerule.Rule{Priority: 100, Src: ip.MustParseCIDR(cidr), TableIndex: 200}
+	}
+	targetFor := func(cidr string) routetable.Target {
+		mac, _ := net.ParseMAC("01:02:03:04:05:06")
+		return routetable.Target{CIDR: ip.MustParseCIDR(cidr), DestMAC: mac}
+	}
+
+	Describe("after adding an active endpoint", func() {
+		BeforeEach(func() {
+			mgr.OnUpdate(endpointUpdate("active", "cali12345", "10.0.0.1/32", "10.0.0.2/32"))
+			Expect(mgr.CompleteDeferredWork()).NotTo(HaveOccurred())
+		})
+
+		It("should add a rule for each of its IPs", func() {
+			Expect(rules.rules).To(Equal(set.From(ruleFor("10.0.0.1/32"), ruleFor("10.0.0.2/32"))))
+		})
+
+		It("should mirror its routes into the table", func() {
+			routeTable.checkRoutes("cali12345", []routetable.Target{
+				targetFor("10.0.0.1/32"),
+				targetFor("10.0.0.2/32"),
+			})
+		})
+
+		It("should handle a change of IPs", func() {
+			mgr.OnUpdate(endpointUpdate("active", "cali12345", "10.0.0.2/32", "10.0.0.3/32"))
+			Expect(rules.rules).To(Equal(set.From(ruleFor("10.0.0.2/32"), ruleFor("10.0.0.3/32"))))
+			routeTable.checkRoutes("cali12345", []routetable.Target{
+				targetFor("10.0.0.2/32"),
+				targetFor("10.0.0.3/32"),
+			})
+		})
+
+		It("should handle a change of interface", func() {
+			mgr.OnUpdate(endpointUpdate("active", "cali67890", "10.0.0.1/32"))
+			routeTable.checkRoutes("cali12345", nil)
+			routeTable.checkRoutes("cali67890", []routetable.Target{targetFor("10.0.0.1/32")})
+		})
+
+		It("should remove the rules and routes when the endpoint goes down", func() {
+			mgr.OnUpdate(endpointUpdate("down", "cali12345", "10.0.0.1/32"))
+			Expect(rules.rules.Len()).To(BeZero())
+			routeTable.checkRoutes("cali12345", nil)
+		})
+
+		It("should remove the rules and routes when the endpoint is removed", func() {
+			mgr.OnUpdate(&proto.WorkloadEndpointRemove{Id: &wlID})
+			Expect(rules.rules.Len()).To(BeZero())
+			routeTable.checkRoutes("cali12345", nil)
+		})
+	})
+
+	It("should use the IPv6 addresses in an IPv6 manager", func() {
+		mgr = newPolicyRoutingManager(rules, routeTable, 6, 200, 100)
+		mgr.OnUpdate(endpointUpdate("active", "cali12345", "10.0.0.1/32"))
+		Expect(rules.rules).To(Equal(set.From(ruleFor("fd00::1/128"))))
+	})
+})
+
+type mockRouteRules struct {
+	rules set.Set
+}
+
+func (r *mockRouteRules) SetRule(rule routerule.Rule) {
+	r.rules.Add(rule)
+}
+
+func (r *mockRouteRules) RemoveRule(rule routerule.Rule) {
+	r.rules.Discard(rule)
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/set"
+)
+
+const (
+	policyStatusApplied = "applied"
+	policyStatusError   = "error"
+
+	policyStatusErrIptables = "Failed to program iptables rules, will retry"
+)
+
+// policyStatusReporter tracks the active policies and profiles and, after each apply, reports
+// whether their rules have been programmed.  An ID is reported once it has been programmed
+// (or has failed to be) and again whenever it is updated or removed.
+type policyStatusReporter struct {
+	// reported maps proto.PolicyID and proto.ProfileID to the status that we last reported
+	// for it, or to nil if it is active but we've yet to report it.
+	reported map[interface{}]*proto.PolicyStatus
+	// dirtyIDs contains the IDs whose status needs to be (re)calculated after the next apply.
+	dirtyIDs set.Set
+
+	fromDataplane chan interface{}
+}
+
+func newPolicyStatusReporter(fromDataplane chan interface{}) *policyStatusReporter {
+	return &policyStatusReporter{
+		reported:      map[interface{}]*proto.PolicyStatus{},
+		dirtyIDs:      set.New(),
+		fromDataplane: fromDataplane,
+	}
+}
+
+func (r *policyStatusReporter) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.ActivePolicyUpdate:
+		r.onActive(*msg.Id)
+	case *proto.ActivePolicyRemove:
+		r.onInactive(*msg.Id)
+	case *proto.ActiveProfileUpdate:
+		r.onActive(*msg.Id)
+	case *proto.ActiveProfileRemove:
+		r.onInactive(*msg.Id)
+	}
+}
+
+func (r *policyStatusReporter) onActive(id interface{}) {
+	if _, ok := r.reported[id]; !ok {
+		r.reported[id] = nil
+	}
+	r.dirtyIDs.Add(id)
+}
+
+func (r *policyStatusReporter) onInactive(id interface{}) {
+	status, ok := r.reported[id]
+	if !ok {
+		return
+	}
+	delete(r.reported, id)
+	if status == nil {
+		// Never reported, nothing to clean up.
+		r.dirtyIDs.Discard(id)
+		return
+	}
+	r.dirtyIDs.Add(id)
+}
+
+func (r *policyStatusReporter) CompleteDeferredWork() error {
+	// Nothing to do, we report status from Apply(), once the dataplane has been updated.
+	return nil
+}
+
+// Apply reports the status of any policies and profiles that have changed.  rulesInSync should
+// be true if the most recent apply successfully programmed all the policy rules.
+func (r *policyStatusReporter) Apply(rulesInSync bool) {
+	r.dirtyIDs.Iter(func(item interface{}) error {
+		oldStatus, active := r.reported[item]
+		if !active {
+			r.sendRemove(item)
+			return set.RemoveItem
+		}
+		newStatus := &proto.PolicyStatus{Status: policyStatusApplied}
+		if !rulesInSync {
+			newStatus = &proto.PolicyStatus{
+				Status: policyStatusError,
+				Error:  policyStatusErrIptables,
+			}
+		}
+		if oldStatus == nil || oldStatus.Status != newStatus.Status || oldStatus.Error != newStatus.Error {
+			r.sendUpdate(item, newStatus)
+			r.reported[item] = newStatus
+		}
+		if !rulesInSync {
+			// Keep the ID dirty so that we report it as applied once the retry
+			// succeeds.
+			return nil
+		}
+		return set.RemoveItem
+	})
+}
+
+func (r *policyStatusReporter) sendUpdate(item interface{}, status *proto.PolicyStatus) {
+	logCxt := log.WithFields(log.Fields{"id": item, "status": status.Status})
+	if status.Status == policyStatusError {
+		logCxt.WithField("error", status.Error).Warn("Failed to program policy")
+	} else {
+		logCxt.Debug("Reporting policy programmed")
+	}
+	switch id := item.(type) {
+	case proto.PolicyID:
+		r.fromDataplane <- &proto.PolicyStatusUpdate{Id: &id, Status: status}
+	case proto.ProfileID:
+		r.fromDataplane <- &proto.ProfileStatusUpdate{Id: &id, Status: status}
+	}
+}
+
+func (r *policyStatusReporter) sendRemove(item interface{}) {
+	log.WithField("id", item).Debug("Reporting policy status removed")
+	switch id := item.(type) {
+	case proto.PolicyID:
+		r.fromDataplane <- &proto.PolicyStatusRemove{Id: &id}
+	case proto.ProfileID:
+		r.fromDataplane <- &proto.ProfileStatusRemove{Id: &id}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("Policy status reporter", func() {
+	var (
+		fromDataplane chan interface{}
+		reporter      *policyStatusReporter
+	)
+
+	polID := proto.PolicyID{Tier: "default", Name: "pol1"}
+	profID := proto.ProfileID{Name: "prof1"}
+	applied := &proto.PolicyStatus{Status: "applied"}
+	failed := &proto.PolicyStatus{
+		Status: "error",
+		Error:  "Failed to program iptables rules, will retry",
+	}
+
+	BeforeEach(func() {
+		fromDataplane = make(chan interface{}, 10)
+		reporter = newPolicyStatusReporter(fromDataplane)
+	})
+
+	It("should report nothing before any updates", func() {
+		reporter.Apply(true)
+		Expect(fromDataplane).NotTo(Receive())
+	})
+
+	Describe("after policy and profile updates", func() {
+		BeforeEach(func() {
+			reporter.OnUpdate(&proto.ActivePolicyUpdate{Id: &polID, Policy: &proto.Policy{}})
+			reporter.OnUpdate(&proto.ActiveProfileUpdate{Id: &profID, Profile: &proto.Profile{}})
+		})
+
+		It("should report them applied once the rules are in sync", func() {
+			reporter.Apply(true)
+			Expect(fromDataplane).To(HaveLen(2))
+			Expect([]interface{}{<-fromDataplane, <-fromDataplane}).To(ConsistOf(
+				&proto.PolicyStatusUpdate{Id: &polID, Status: applied},
+				&proto.ProfileStatusUpdate{Id: &profID, Status: applied},
+			))
+
+			By("not reporting them again")
+			reporter.Apply(true)
+			Expect(fromDataplane).NotTo(Receive())
+		})
+
+		It("should report an error and then recovery", func() {
+			reporter.Apply(false)
+			Expect(fromDataplane).To(HaveLen(2))
+			Expect([]interface{}{<-fromDataplane, <-fromDataplane}).To(ConsistOf(
+				&proto.PolicyStatusUpdate{Id: &polID, Status: failed},
+				&proto.ProfileStatusUpdate{Id: &profID, Status: failed},
+			))
+
+			By("not repeating the error")
+			reporter.Apply(false)
+			Expect(fromDataplane).NotTo(Receive())
+
+			By("reporting them applied once the retry succeeds")
+			reporter.Apply(true)
+			Expect(fromDataplane).To(HaveLen(2))
+			Expect([]interface{}{<-fromDataplane, <-fromDataplane}).To(ConsistOf(
+				&proto.PolicyStatusUpdate{Id: &polID, Status: applied},
+				&proto.ProfileStatusUpdate{Id: &profID, Status: applied},
+			))
+		})
+
+		It("should report removal of a reported policy", func() {
+			reporter.Apply(true)
+			<-fromDataplane
+			<-fromDataplane
+			reporter.OnUpdate(&proto.ActivePolicyRemove{Id: &polID})
+			reporter.Apply(true)
+			Expect(fromDataplane).To(Receive(Equal(&proto.PolicyStatusRemove{Id: &polID})))
+			Expect(fromDataplane).NotTo(Receive())
+		})
+
+		It("should report nothing for a policy removed before it was reported", func() {
+			reporter.OnUpdate(&proto.ActivePolicyRemove{Id: &polID})
+			reporter.Apply(true)
+			Expect(fromDataplane).To(Receive(Equal(
+				&proto.ProfileStatusUpdate{Id: &profID, Status: applied},
+			)))
+			Expect(fromDataplane).NotTo(Receive())
+		})
+	})
+})
@@ -0,0 +1,94 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"sync"
+	"time"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/set"
+)
+
+// processStatus tracks the state that we include in our periodic ProcessStatusUpdate
+// heartbeats.  It is updated by the main loop, as a manager, and read by the status reporting
+// goroutine.
+type processStatus struct {
+	lock sync.Mutex
+
+	endpointIDs set.Set
+	policyIDs   set.Set
+	profileIDs  set.Set
+
+	lastApply time.Time
+	inSync    bool
+}
+
+func newProcessStatus() *processStatus {
+	return &processStatus{
+		endpointIDs: set.New(),
+		policyIDs:   set.New(),
+		profileIDs:  set.New(),
+	}
+}
+
+func (s *processStatus) OnUpdate(msg interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch msg := msg.(type) {
+	case *proto.WorkloadEndpointUpdate:
+		s.endpointIDs.Add(*msg.Id)
+	case *proto.WorkloadEndpointRemove:
+		s.endpointIDs.Discard(*msg.Id)
+	case *proto.HostEndpointUpdate:
+		s.endpointIDs.Add(*msg.Id)
+	case *proto.HostEndpointRemove:
+		s.endpointIDs.Discard(*msg.Id)
+	case *proto.ActivePolicyUpdate:
+		s.policyIDs.Add(*msg.Id)
+	case *proto.ActivePolicyRemove:
+		s.policyIDs.Discard(*msg.Id)
+	case *proto.ActiveProfileUpdate:
+		s.profileIDs.Add(*msg.Id)
+	case *proto.ActiveProfileRemove:
+		s.profileIDs.Discard(*msg.Id)
+	}
+}
+
+func (s *processStatus) CompleteDeferredWork() error {
+	// Nothing to do, we only keep counts.
+	return nil
+}
+
+// OnApplyComplete records the completion of an apply.
+func (s *processStatus) OnApplyComplete(t time.Time, inSync bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastApply = t
+	s.inSync = inSync
+}
+
+// Report fills in the dataplane fields of the given heartbeat.
+func (s *processStatus) Report(update *proto.ProcessStatusUpdate) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.lastApply.IsZero() {
+		update.LastApplyIsoTimestamp = s.lastApply.UTC().Format(time.RFC3339)
+	}
+	update.InSync = s.inSync
+	update.NumEndpoints = uint32(s.endpointIDs.Len())
+	update.NumPolicies = uint32(s.policyIDs.Len())
+	update.NumProfiles = uint32(s.profileIDs.Len())
+}
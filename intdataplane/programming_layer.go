@@ -0,0 +1,126 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"time"
+
+	"github.com/projectcalico/felix/dataplaneexec"
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/routetable"
+	"github.com/projectcalico/felix/rules"
+)
+
+// ProgrammingLayer creates the objects that the internal dataplane uses to program iptables,
+// IP sets and routes.  The managers calculate the desired state and pass it to these objects,
+// which batch up the changes and apply them to the kernel on Apply().
+//
+// The default implementation programs the kernel.  Substituting another implementation (via
+// Config.ProgrammingLayerOverride) allows the dataplane to be embedded in another agent or
+// run against an in-memory mock (see the mockdataplane package) without root access.  When
+// an override is in use, we also skip the parts of the dataplane that talk to the kernel
+// directly, such as the interface monitor and the IPIP/VXLAN devices.
+type ProgrammingLayer interface {
+	NewIptablesTable(table string, ipVersion uint8, options iptables.TableOptions) IptablesTable
+	NewIPSets(ipVersionConfig *ipsets.IPVersionConfig, execOptions dataplaneexec.Options) IPSets
+	NewRouteTable(interfacePrefixes []string, ipVersion uint8, options routetable.Options) RouteTable
+}
+
+// IptablesTable is the interface to a single iptables table; it is implemented by
+// iptables.Table.
+type IptablesTable interface {
+	iptablesTable
+	SetRuleInsertions(chainName string, rules []iptables.Rule)
+	SetRefreshInterval(interval time.Duration)
+	// Apply applies any pending changes.  It returns the time after which it should be
+	// called again, or 0 if there's no need.
+	Apply() (rescheduleAfter time.Duration)
+	InSync() bool
+	Degraded() bool
+	HasPendingChainDeletions() bool
+	Snapshot() *iptables.TableSnapshot
+	// ReadRuleCounters and LookupRuleHash allow the counters of the rules in the dataplane
+	// to be attributed to policies.
+	ReadRuleCounters() (map[string]iptables.RuleCounters, error)
+	LookupRuleHash(hash string) (info iptables.RuleInfo, ok bool)
+}
+
+// IPSets is the interface to the IP sets of one IP version; it is implemented by
+// ipsets.IPSets.
+type IPSets interface {
+	ipsetsDataplane
+	QueueResync()
+	ApplyUpdates()
+	ApplyDeletions()
+}
+
+// RouteTable is the interface to the routes of one IP version; it is implemented by
+// routetable.RouteTable.
+type RouteTable interface {
+	routeTable
+	OnIfaceStateChanged(ifaceName string, state ifacemonitor.State)
+	QueueResync()
+	Apply() error
+	ConflictsChanged() bool
+}
+
+// kernelProgrammingLayer is the default ProgrammingLayer.
+type kernelProgrammingLayer struct {
+	readOnly bool
+}
+
+var _ ProgrammingLayer = kernelProgrammingLayer{}
+
+func (l kernelProgrammingLayer) NewIptablesTable(
+	table string,
+	ipVersion uint8,
+	options iptables.TableOptions,
+) IptablesTable {
+	return iptables.NewTable(table, ipVersion, rules.RuleHashPrefix, options)
+}
+
+func (l kernelProgrammingLayer) NewIPSets(
+	ipVersionConfig *ipsets.IPVersionConfig,
+	execOptions dataplaneexec.Options,
+) IPSets {
+	return ipsets.NewIPSets(ipVersionConfig, execOptions)
+}
+
+func (l kernelProgrammingLayer) NewRouteTable(
+	interfacePrefixes []string,
+	ipVersion uint8,
+	options routetable.Options,
+) RouteTable {
+	if l.readOnly {
+		return routetable.NewReadOnly(interfacePrefixes, ipVersion, options)
+	}
+	return routetable.New(interfacePrefixes, ipVersion, options)
+}
+
+// iptablesTableInfo is an IptablesTable along with the name and IP version that it was
+// created with.
+type iptablesTableInfo struct {
+	IptablesTable
+	name      string
+	ipVersion uint8
+}
+
+// ipSetsInfo is an IPSets along with the IP family that it was created for.
+type ipSetsInfo struct {
+	IPSets
+	family ipsets.IPFamily
+}
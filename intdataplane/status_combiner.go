@@ -27,13 +27,22 @@ type endpointStatusCombiner struct {
 	ipVersionToStatuses map[uint8]map[interface{}]string
 	dirtyIDs            set.Set
 	fromDataplane       chan interface{}
+
+	// onWorkloadStatus, if non-nil, is called with the combined status of each workload
+	// endpoint that we report; the status is "" if the endpoint was removed.
+	onWorkloadStatus func(id proto.WorkloadEndpointID, status string)
 }
 
-func newEndpointStatusCombiner(fromDataplane chan interface{}, ipv6Enabled bool) *endpointStatusCombiner {
+func newEndpointStatusCombiner(
+	fromDataplane chan interface{},
+	ipv6Enabled bool,
+	onWorkloadStatus func(id proto.WorkloadEndpointID, status string),
+) *endpointStatusCombiner {
 	e := &endpointStatusCombiner{
 		ipVersionToStatuses: map[uint8]map[interface{}]string{},
 		dirtyIDs:            set.New(),
 		fromDataplane:       fromDataplane,
+		onWorkloadStatus:    onWorkloadStatus,
 	}
 
 	// IPv4 is always enabled.
@@ -82,6 +91,9 @@ func (e *endpointStatusCombiner) Apply() {
 				statusToReport = "up"
 			}
 		}
+		if id, ok := id.(proto.WorkloadEndpointID); ok && e.onWorkloadStatus != nil {
+			e.onWorkloadStatus(id, statusToReport)
+		}
 		if statusToReport == "" {
 			logCxt.Info("Reporting endpoint removed.")
 			switch id := id.(type) {
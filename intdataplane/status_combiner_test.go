@@ -38,7 +38,7 @@ var _ = Describe("StatusCombiner", func() {
 
 	Describe("with IPv6 enabled", func() {
 		BeforeEach(func() {
-			statusCombiner = newEndpointStatusCombiner(fromDataplane, true)
+			statusCombiner = newEndpointStatusCombiner(fromDataplane, true, nil)
 		})
 
 		DescribeTable("it should calculate correct status",
@@ -101,7 +101,7 @@ var _ = Describe("StatusCombiner", func() {
 
 	Describe("with IPv6 disabled", func() {
 		BeforeEach(func() {
-			statusCombiner = newEndpointStatusCombiner(fromDataplane, false)
+			statusCombiner = newEndpointStatusCombiner(fromDataplane, false, nil)
 		})
 
 		DescribeTable("it should calculate correct status",
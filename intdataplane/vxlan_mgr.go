@@ -0,0 +1,308 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"net"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+const VXLANIfaceName = "vxlan.calico"
+
+// vxlanManager manages the VXLAN tunnel device and the forwarding database (FDB) and ARP
+// entries that tell the kernel how to reach the VXLAN tunnel endpoint (VTEP) of each remote
+// host.
+//
+// To avoid the need to distribute VTEP MAC addresses, each host's VTEP MAC is derived from its
+// host IP; see vtepMACForHostIP().  For each remote host, we program:
+//
+// - an FDB entry that sends frames for the host's VTEP MAC to the host's IP.
+// - an ARP entry on the tunnel device that resolves the host's IP to its VTEP MAC.
+//
+// Routes to remote workloads can then use the remote host's IP as an onlink next hop via
+// the tunnel device.  We don't program those routes ourselves: the datastore syncer doesn't
+// send us the IPAM block affinities that say which host owns each block, so, as with IPIP,
+// they're left to the routing daemon.
+type vxlanManager struct {
+	hostname string
+	vni      int
+	port     int
+	mtu      int
+	// tunnelAddress is the IP to assign to the tunnel device, or nil for no address.
+	tunnelAddress net.IP
+
+	// activeHostnameToIP maps hostname to string IP address.
+	activeHostnameToIP map[string]string
+
+	// deviceInSync is cleared to force us to check the configuration of the tunnel device.
+	deviceInSync bool
+	// neighsInSync is cleared when the set of remote hosts changes, or to force a resync of
+	// the FDB and ARP entries.
+	neighsInSync bool
+
+	// Dataplane shim.
+	dataplane vxlanDataplane
+}
+
+func newVXLANManager(
+	hostname string,
+	vni int,
+	port int,
+	mtu int,
+	tunnelAddress net.IP,
+) *vxlanManager {
+	return newVXLANManagerWithShim(hostname, vni, port, mtu, tunnelAddress, realVXLANNetlink{})
+}
+
+func newVXLANManagerWithShim(
+	hostname string,
+	vni int,
+	port int,
+	mtu int,
+	tunnelAddress net.IP,
+	dataplane vxlanDataplane,
+) *vxlanManager {
+	return &vxlanManager{
+		hostname:           hostname,
+		vni:                vni,
+		port:               port,
+		mtu:                mtu,
+		tunnelAddress:      tunnelAddress,
+		activeHostnameToIP: map[string]string{},
+		dataplane:          dataplane,
+	}
+}
+
+func (m *vxlanManager) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.HostMetadataUpdate:
+		log.WithField("hostname", msg.Hostname).Debug("Host update/create")
+		if msg.Hostname == m.hostname && m.activeHostnameToIP[msg.Hostname] != msg.Ipv4Addr {
+			// Our VTEP's MAC and source address are derived from our IP.
+			m.deviceInSync = false
+		}
+		m.activeHostnameToIP[msg.Hostname] = msg.Ipv4Addr
+		m.neighsInSync = false
+	case *proto.HostMetadataRemove:
+		log.WithField("hostname", msg.Hostname).Debug("Host removed")
+		delete(m.activeHostnameToIP, msg.Hostname)
+		m.neighsInSync = false
+	}
+}
+
+// QueueResync forces a check of the tunnel device and its FDB and ARP entries on the next call
+// to CompleteDeferredWork().
+func (m *vxlanManager) QueueResync() {
+	m.deviceInSync = false
+	m.neighsInSync = false
+}
+
+func (m *vxlanManager) CompleteDeferredWork() error {
+	if m.deviceInSync && m.neighsInSync {
+		return nil
+	}
+	localIP := net.ParseIP(m.activeHostnameToIP[m.hostname]).To4()
+	if localIP == nil {
+		log.WithField("hostname", m.hostname).Info(
+			"Don't know our own host IP yet, deferring VXLAN configuration.")
+		return nil
+	}
+	if !m.deviceInSync {
+		if err := m.configureVXLANDevice(localIP); err != nil {
+			log.WithError(err).Warn("Failed to configure VXLAN tunnel device, will retry...")
+			return err
+		}
+		m.deviceInSync = true
+	}
+	if !m.neighsInSync {
+		if err := m.syncNeighbours(); err != nil {
+			log.WithError(err).Warn("Failed to sync VXLAN FDB/ARP entries, will retry...")
+			return err
+		}
+		m.neighsInSync = true
+	}
+	return nil
+}
+
+// configureVXLANDevice ensures that the VXLAN device exists, that it is up and that it is
+// correctly configured.
+func (m *vxlanManager) configureVXLANDevice(localIP net.IP) error {
+	mac := vtepMACForHostIP(localIP)
+	logCxt := log.WithFields(log.Fields{
+		"vni":     m.vni,
+		"port":    m.port,
+		"mtu":     m.mtu,
+		"localIP": localIP,
+		"mac":     mac,
+	})
+	logCxt.Debug("Configuring VXLAN tunnel device")
+	desired := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         VXLANIfaceName,
+			HardwareAddr: mac,
+			MTU:          m.mtu,
+		},
+		VxlanId: m.vni,
+		Port:    m.port,
+		SrcAddr: localIP,
+	}
+
+	link, err := m.dataplane.LinkByName(VXLANIfaceName)
+	if err == nil {
+		// The VNI, port and source address can't be changed on an existing device so, if
+		// they're wrong, we need to recreate it.
+		oldVXLAN, ok := link.(*netlink.Vxlan)
+		if !ok || oldVXLAN.VxlanId != m.vni || oldVXLAN.Port != m.port ||
+			!oldVXLAN.SrcAddr.Equal(localIP) {
+			logCxt.WithField("oldLink", link).Info(
+				"Existing VXLAN device has incorrect configuration, recreating it")
+			if err := m.dataplane.LinkDel(link); err != nil {
+				logCxt.WithError(err).Warn("Failed to delete VXLAN device")
+				return err
+			}
+			link = nil
+		}
+	} else {
+		logCxt.WithError(err).Info("Failed to get VXLAN tunnel device, assuming it isn't present")
+		link = nil
+	}
+	if link == nil {
+		if err := m.dataplane.LinkAdd(desired); err != nil {
+			logCxt.WithError(err).Warn("Failed to add VXLAN tunnel device")
+			return err
+		}
+		link, err = m.dataplane.LinkByName(VXLANIfaceName)
+		if err != nil {
+			logCxt.WithError(err).Warn("Failed to get VXLAN tunnel device after creating it")
+			return err
+		}
+		logCxt.Info("Created VXLAN tunnel device")
+	}
+
+	attrs := link.Attrs()
+	if attrs.MTU != m.mtu {
+		logCxt.WithField("oldMTU", attrs.MTU).Info("VXLAN device MTU needs to be updated")
+		if err := m.dataplane.LinkSetMTU(link, m.mtu); err != nil {
+			logCxt.WithError(err).Warn("Failed to set VXLAN device MTU")
+			return err
+		}
+	}
+	if attrs.HardwareAddr.String() != mac.String() {
+		logCxt.WithField("oldMAC", attrs.HardwareAddr).Info("VXLAN device MAC needs to be updated")
+		if err := m.dataplane.LinkSetHardwareAddr(link, mac); err != nil {
+			logCxt.WithError(err).Warn("Failed to set VXLAN device MAC")
+			return err
+		}
+	}
+	if attrs.Flags&net.FlagUp == 0 {
+		logCxt.WithField("flags", attrs.Flags).Info("VXLAN device wasn't admin up, enabling it")
+		if err := m.dataplane.LinkSetUp(link); err != nil {
+			logCxt.WithError(err).Warn("Failed to set VXLAN device up")
+			return err
+		}
+	}
+
+	return setLinkAddressV4(m.dataplane, VXLANIfaceName, m.tunnelAddress)
+}
+
+// syncNeighbours programs the FDB and ARP entries for each remote host and removes any that
+// are no longer needed.
+func (m *vxlanManager) syncNeighbours() error {
+	link, err := m.dataplane.LinkByName(VXLANIfaceName)
+	if err != nil {
+		return err
+	}
+	linkIndex := link.Attrs().Index
+
+	// Calculate the desired entries, indexed by remote host IP.
+	remoteIPToMAC := map[string]net.HardwareAddr{}
+	for hostname, ipStr := range m.activeHostnameToIP {
+		if hostname == m.hostname {
+			continue
+		}
+		hostIP := net.ParseIP(ipStr).To4()
+		if hostIP == nil {
+			log.WithFields(log.Fields{
+				"hostname": hostname,
+				"ip":       ipStr,
+			}).Warn("Ignoring remote host with invalid IPv4 address")
+			continue
+		}
+		remoteIPToMAC[hostIP.String()] = vtepMACForHostIP(hostIP)
+	}
+
+	// Remove any stale entries.
+	for _, family := range []int{syscall.AF_BRIDGE, netlink.FAMILY_V4} {
+		neighs, err := m.dataplane.NeighList(linkIndex, family)
+		if err != nil {
+			return err
+		}
+		for _, neigh := range neighs {
+			if neigh.IP == nil || neigh.State&netlink.NUD_PERMANENT == 0 {
+				continue
+			}
+			mac, ok := remoteIPToMAC[neigh.IP.String()]
+			if ok && neigh.HardwareAddr.String() == mac.String() {
+				continue
+			}
+			log.WithField("neigh", neigh).Info("Removing stale VXLAN FDB/ARP entry")
+			neigh := neigh
+			if err := m.dataplane.NeighDel(&neigh); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Then (idempotently) program the desired entries.
+	for ipStr, mac := range remoteIPToMAC {
+		hostIP := net.ParseIP(ipStr).To4()
+		fdb := &netlink.Neigh{
+			LinkIndex:    linkIndex,
+			Family:       syscall.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT,
+			Flags:        netlink.NTF_SELF,
+			IP:           hostIP,
+			HardwareAddr: mac,
+		}
+		if err := m.dataplane.NeighSet(fdb); err != nil {
+			log.WithError(err).WithField("fdb", fdb).Warn("Failed to set VXLAN FDB entry")
+			return err
+		}
+		arp := &netlink.Neigh{
+			LinkIndex:    linkIndex,
+			Family:       netlink.FAMILY_V4,
+			State:        netlink.NUD_PERMANENT,
+			IP:           hostIP,
+			HardwareAddr: mac,
+		}
+		if err := m.dataplane.NeighSet(arp); err != nil {
+			log.WithError(err).WithField("arp", arp).Warn("Failed to set VXLAN ARP entry")
+			return err
+		}
+	}
+	return nil
+}
+
+// vtepMACForHostIP calculates the MAC address of the VTEP on the host with the given IP.  We
+// use a locally-administered unicast MAC with the host IP in its lower four bytes.
+func vtepMACForHostIP(hostIP net.IP) net.HardwareAddr {
+	ip4 := hostIP.To4()
+	return net.HardwareAddr{0xee, 0xee, ip4[0], ip4[1], ip4[2], ip4[3]}
+}
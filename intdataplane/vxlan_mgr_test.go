@@ -0,0 +1,238 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("VXLAN manager", func() {
+	var (
+		vxlanMgr  *vxlanManager
+		dataplane *mockVXLANDataplane
+	)
+
+	localIP := net.ParseIP("10.0.0.1").To4()
+	remoteIP := net.ParseIP("10.0.0.2").To4()
+	localMAC := net.HardwareAddr{0xee, 0xee, 10, 0, 0, 1}
+	remoteMAC := net.HardwareAddr{0xee, 0xee, 10, 0, 0, 2}
+
+	BeforeEach(func() {
+		dataplane = &mockVXLANDataplane{}
+		vxlanMgr = newVXLANManagerWithShim(
+			"host1", 4096, 4789, 1410, net.ParseIP("172.16.0.1"), dataplane)
+	})
+
+	It("should wait for our host IP before creating the device", func() {
+		Expect(vxlanMgr.CompleteDeferredWork()).To(Succeed())
+		Expect(dataplane.link).To(BeNil())
+	})
+
+	It("should calculate VTEP MACs from host IPs", func() {
+		Expect(vtepMACForHostIP(net.ParseIP("192.168.1.254"))).To(Equal(
+			net.HardwareAddr{0xee, 0xee, 192, 168, 1, 254}))
+	})
+
+	Describe("after receiving our host IP and a remote host's IP", func() {
+		BeforeEach(func() {
+			vxlanMgr.OnUpdate(&proto.HostMetadataUpdate{Hostname: "host1", Ipv4Addr: "10.0.0.1"})
+			vxlanMgr.OnUpdate(&proto.HostMetadataUpdate{Hostname: "host2", Ipv4Addr: "10.0.0.2"})
+			Expect(vxlanMgr.CompleteDeferredWork()).To(Succeed())
+		})
+
+		It("should create the device", func() {
+			Expect(dataplane.link).NotTo(BeNil())
+			Expect(dataplane.link.VxlanId).To(Equal(4096))
+			Expect(dataplane.link.Port).To(Equal(4789))
+			Expect(dataplane.link.SrcAddr).To(Equal(localIP))
+			Expect(dataplane.link.MTU).To(Equal(1410))
+			Expect(dataplane.link.HardwareAddr).To(Equal(localMAC))
+			Expect(dataplane.link.Flags & net.FlagUp).NotTo(BeZero())
+		})
+
+		It("should set the tunnel address", func() {
+			Expect(dataplane.addrs).To(HaveLen(1))
+			Expect(dataplane.addrs[0].IP.String()).To(Equal("172.16.0.1"))
+		})
+
+		It("should program FDB and ARP entries for the remote host only", func() {
+			Expect(dataplane.neighs).To(ConsistOf(
+				netlink.Neigh{
+					LinkIndex:    1,
+					Family:       syscall.AF_BRIDGE,
+					State:        netlink.NUD_PERMANENT,
+					Flags:        netlink.NTF_SELF,
+					IP:           remoteIP,
+					HardwareAddr: remoteMAC,
+				},
+				netlink.Neigh{
+					LinkIndex:    1,
+					Family:       netlink.FAMILY_V4,
+					State:        netlink.NUD_PERMANENT,
+					IP:           remoteIP,
+					HardwareAddr: remoteMAC,
+				},
+			))
+		})
+
+		It("should remove the entries when the remote host is removed", func() {
+			vxlanMgr.OnUpdate(&proto.HostMetadataRemove{Hostname: "host2"})
+			Expect(vxlanMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.neighs).To(BeEmpty())
+		})
+
+		It("should repair the device on resync", func() {
+			dataplane.link.MTU = 1500
+			dataplane.link.Flags = 0
+			vxlanMgr.QueueResync()
+			Expect(vxlanMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.link.MTU).To(Equal(1410))
+			Expect(dataplane.link.Flags & net.FlagUp).NotTo(BeZero())
+		})
+
+		It("should recreate the device if its VNI is wrong", func() {
+			dataplane.link.VxlanId = 1
+			vxlanMgr.QueueResync()
+			Expect(vxlanMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.numLinkDels).To(Equal(1))
+			Expect(dataplane.link.VxlanId).To(Equal(4096))
+		})
+
+		It("should not touch the device if nothing changed", func() {
+			dataplane.numCalls = 0
+			Expect(vxlanMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.numCalls).To(BeZero())
+		})
+	})
+})
+
+// mockVXLANDataplane is an in-memory model of the VXLAN device and its neighbour entries.
+type mockVXLANDataplane struct {
+	link   *netlink.Vxlan
+	addrs  []netlink.Addr
+	neighs []netlink.Neigh
+
+	numCalls    int
+	numLinkDels int
+}
+
+func (d *mockVXLANDataplane) LinkByName(name string) (netlink.Link, error) {
+	d.numCalls++
+	Expect(name).To(Equal(VXLANIfaceName))
+	if d.link == nil {
+		return nil, notFound
+	}
+	return d.link, nil
+}
+
+func (d *mockVXLANDataplane) LinkAdd(link netlink.Link) error {
+	d.numCalls++
+	Expect(d.link).To(BeNil())
+	vxlan := *link.(*netlink.Vxlan)
+	vxlan.Index = 1
+	d.link = &vxlan
+	return nil
+}
+
+func (d *mockVXLANDataplane) LinkDel(link netlink.Link) error {
+	d.numCalls++
+	d.numLinkDels++
+	d.link = nil
+	d.addrs = nil
+	d.neighs = nil
+	return nil
+}
+
+func (d *mockVXLANDataplane) LinkSetMTU(link netlink.Link, mtu int) error {
+	d.numCalls++
+	d.link.MTU = mtu
+	return nil
+}
+
+func (d *mockVXLANDataplane) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	d.numCalls++
+	d.link.HardwareAddr = hwaddr
+	return nil
+}
+
+func (d *mockVXLANDataplane) LinkSetUp(link netlink.Link) error {
+	d.numCalls++
+	d.link.Flags |= net.FlagUp
+	return nil
+}
+
+func (d *mockVXLANDataplane) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	d.numCalls++
+	return d.addrs, nil
+}
+
+func (d *mockVXLANDataplane) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	d.numCalls++
+	d.addrs = append(d.addrs, *addr)
+	return nil
+}
+
+func (d *mockVXLANDataplane) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	d.numCalls++
+	for i, a := range d.addrs {
+		if a.IP.Equal(addr.IP) {
+			d.addrs = append(d.addrs[:i], d.addrs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (d *mockVXLANDataplane) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	d.numCalls++
+	var neighs []netlink.Neigh
+	for _, n := range d.neighs {
+		if n.LinkIndex == linkIndex && n.Family == family {
+			neighs = append(neighs, n)
+		}
+	}
+	return neighs, nil
+}
+
+func (d *mockVXLANDataplane) NeighSet(neigh *netlink.Neigh) error {
+	d.numCalls++
+	for i, n := range d.neighs {
+		if n.Family == neigh.Family && n.IP.Equal(neigh.IP) {
+			d.neighs[i] = *neigh
+			return nil
+		}
+	}
+	d.neighs = append(d.neighs, *neigh)
+	return nil
+}
+
+func (d *mockVXLANDataplane) NeighDel(neigh *netlink.Neigh) error {
+	d.numCalls++
+	for i, n := range d.neighs {
+		if n.Family == neigh.Family && n.IP.Equal(neigh.IP) {
+			d.neighs = append(d.neighs[:i], d.neighs[i+1:]...)
+			return nil
+		}
+	}
+	return notFound
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	countApplyStuck = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_int_dataplane_apply_stuck",
+		Help: "Number of times that an apply took longer than the watchdog timeout.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(countApplyStuck)
+}
+
+// applyWatchdog detects when an apply of the dataplane has been running for longer than its
+// timeout.  That usually means that we're blocked on a child process that has hung; since the
+// dataplane goroutine can't report on itself, the watchdog logs the stacks of all goroutines
+// to help diagnose the problem and reports the dataplane as out-of-sync until the apply
+// finishes.  The iptables command timeout is responsible for killing the stuck process.
+type applyWatchdog struct {
+	lock       sync.Mutex
+	timeout    time.Duration
+	applyStart time.Time
+	applying   bool
+	stuck      bool
+
+	onStuckChanged func(stuck bool)
+
+	// Shims for testing.
+	timeNow   func() time.Time
+	dumpStack func() string
+}
+
+func newApplyWatchdog(timeout time.Duration, onStuckChanged func(stuck bool)) *applyWatchdog {
+	return &applyWatchdog{
+		timeout:        timeout,
+		onStuckChanged: onStuckChanged,
+		timeNow:        time.Now,
+		dumpStack:      dumpAllStacks,
+	}
+}
+
+// OnApplyStart should be called before each apply.
+func (w *applyWatchdog) OnApplyStart() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.applyStart = w.timeNow()
+	w.applying = true
+}
+
+// OnApplyEnd should be called after each apply.
+func (w *applyWatchdog) OnApplyEnd() {
+	w.lock.Lock()
+	w.applying = false
+	wasStuck := w.stuck
+	w.stuck = false
+	elapsed := w.timeNow().Sub(w.applyStart)
+	w.lock.Unlock()
+
+	if wasStuck {
+		log.WithField("elapsed", elapsed).Warn("Previously-stuck dataplane apply finished")
+		w.onStuckChanged(false)
+	}
+}
+
+// Check checks whether the current apply, if any, has exceeded the timeout.
+func (w *applyWatchdog) Check() {
+	w.lock.Lock()
+	if !w.applying || w.stuck {
+		w.lock.Unlock()
+		return
+	}
+	elapsed := w.timeNow().Sub(w.applyStart)
+	if elapsed < w.timeout {
+		w.lock.Unlock()
+		return
+	}
+	w.stuck = true
+	w.lock.Unlock()
+
+	countApplyStuck.Inc()
+	log.WithFields(log.Fields{
+		"elapsed": elapsed,
+		"timeout": w.timeout,
+		"stacks":  w.dumpStack(),
+	}).Error("Dataplane apply has been running for longer than the watchdog timeout, " +
+		"it may be stuck")
+	w.onStuckChanged(true)
+}
+
+// Loop calls Check() periodically.  It never returns.
+func (w *applyWatchdog) Loop() {
+	ticker := time.NewTicker(w.timeout / 4)
+	for range ticker.C {
+		w.Check()
+	}
+}
+
+func dumpAllStacks() string {
+	buf := make([]byte, 1<<20)
+	n := runtime.Stack(buf, true)
+	return string(buf[:n])
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Apply watchdog", func() {
+	var (
+		watchdog *applyWatchdog
+		now      time.Time
+		stuck    []bool
+	)
+
+	BeforeEach(func() {
+		stuck = nil
+		now = time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+		watchdog = newApplyWatchdog(10*time.Second, func(s bool) {
+			stuck = append(stuck, s)
+		})
+		watchdog.timeNow = func() time.Time { return now }
+		watchdog.dumpStack = func() string { return "stacks" }
+	})
+
+	It("should do nothing if no apply is in progress", func() {
+		now = now.Add(time.Minute)
+		watchdog.Check()
+		Expect(stuck).To(BeEmpty())
+	})
+
+	It("should do nothing if the apply finishes in time", func() {
+		watchdog.OnApplyStart()
+		now = now.Add(9 * time.Second)
+		watchdog.Check()
+		watchdog.OnApplyEnd()
+		Expect(stuck).To(BeEmpty())
+	})
+
+	It("should report a stuck apply once, then its recovery", func() {
+		watchdog.OnApplyStart()
+		now = now.Add(10 * time.Second)
+		watchdog.Check()
+		now = now.Add(10 * time.Second)
+		watchdog.Check()
+		Expect(stuck).To(Equal([]bool{true}))
+		watchdog.OnApplyEnd()
+		Expect(stuck).To(Equal([]bool{true, false}))
+	})
+})
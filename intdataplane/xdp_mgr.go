@@ -0,0 +1,342 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/set"
+)
+
+var (
+	countXDPFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_xdp_fallbacks",
+		Help: "Number of times that we failed to attach an XDP program to a host interface " +
+			"and fell back to raw-table rules.",
+	})
+	gaugeXDPIfaces = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_xdp_ifaces",
+		Help: "Number of host interfaces with an XDP deny program attached.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		countXDPFallbacks,
+		gaugeXDPIfaces,
+	)
+}
+
+// xdpPolicy records whether a policy can be accelerated by XDP and, if so, the source CIDRs
+// that it denies.
+type xdpPolicy struct {
+	compatible bool
+	denyCIDRs  []ip.CIDR
+}
+
+// xdpManager accelerates untracked deny policies on host interfaces by dropping packets from
+// the denied source CIDRs in an XDP program, before they reach the kernel stack.
+//
+// Only a prefix of each host endpoint's untracked policies can be accelerated: we walk the
+// policies in order and stop at the first one that does anything other than deny traffic by
+// (IPv4) source CIDR.  Any traffic denied by the policies that we accelerate would be denied
+// by the untracked iptables rules anyway so we leave those rules in place; if the NIC or driver
+// doesn't support XDP, or the program can't be attached, the raw table still enforces the
+// policy.  Like the raw table, the program lets the inbound failsafe ports through.
+//
+// Host endpoints that are matched by IP address rather than interface name aren't
+// accelerated.
+type xdpManager struct {
+	policies      map[proto.PolicyID]*xdpPolicy
+	hostEndpoints map[proto.HostEndpointID]*proto.HostEndpoint
+	failsafePorts []config.ProtoPort
+
+	// ifaceToCIDRs contains the CIDRs that we've programmed for each interface that has our
+	// program attached.
+	ifaceToCIDRs map[string]set.Set
+	// unsupportedIfaces contains the interfaces that we failed to attach the program to.
+	// We don't retry them until the next resync.
+	unsupportedIfaces set.Set
+
+	dirty bool
+	// resyncNeeded is set to force us to reload the dataplane state.
+	resyncNeeded bool
+
+	dataplane xdpDataplane
+}
+
+type xdpDataplane interface {
+	// ListAttachedIfaces returns the interfaces that have our program attached.
+	ListAttachedIfaces() ([]string, error)
+	// Attach loads our program for the given interface, populates its failsafe ports and
+	// attaches it.  It replaces any program that's already attached.
+	Attach(ifaceName string, failsafePorts []config.ProtoPort) error
+	Detach(ifaceName string) error
+	ListCIDRs(ifaceName string) ([]ip.CIDR, error)
+	AddCIDR(ifaceName string, cidr ip.CIDR) error
+	RemoveCIDR(ifaceName string, cidr ip.CIDR) error
+}
+
+func newXDPManager(programFile string, failsafePorts []config.ProtoPort) *xdpManager {
+	return newXDPManagerWithShim(failsafePorts, newBPFToolXDPDataplane(programFile))
+}
+
+func newXDPManagerWithShim(failsafePorts []config.ProtoPort, dataplane xdpDataplane) *xdpManager {
+	return &xdpManager{
+		policies:          map[proto.PolicyID]*xdpPolicy{},
+		hostEndpoints:     map[proto.HostEndpointID]*proto.HostEndpoint{},
+		failsafePorts:     failsafePorts,
+		ifaceToCIDRs:      map[string]set.Set{},
+		unsupportedIfaces: set.New(),
+		dirty:             true,
+		resyncNeeded:      true,
+		dataplane:         dataplane,
+	}
+}
+
+func (m *xdpManager) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.ActivePolicyUpdate:
+		m.policies[*msg.Id] = calculateXDPPolicy(msg.Policy)
+		m.dirty = true
+	case *proto.ActivePolicyRemove:
+		delete(m.policies, *msg.Id)
+		m.dirty = true
+	case *proto.HostEndpointUpdate:
+		m.hostEndpoints[*msg.Id] = msg.Endpoint
+		m.dirty = true
+	case *proto.HostEndpointRemove:
+		delete(m.hostEndpoints, *msg.Id)
+		m.dirty = true
+	}
+}
+
+// calculateXDPPolicy checks whether a policy's inbound rules only deny traffic by source CIDR.
+func calculateXDPPolicy(policy *proto.Policy) *xdpPolicy {
+	p := &xdpPolicy{compatible: true}
+	for _, r := range policy.InboundRules {
+		if r.Action != "deny" || !ruleOnlyMatchesSrcNet(r) {
+			return &xdpPolicy{}
+		}
+		if r.IpVersion == proto.IPVersion_IPV6 {
+			// Doesn't apply to IPv4 traffic so it can't allow anything that we'd drop.
+			continue
+		}
+		srcNet := r.SrcNet
+		if srcNet == "" {
+			srcNet = "0.0.0.0/0"
+		}
+		_, ipNet, err := net.ParseCIDR(srcNet)
+		if err != nil || ipNet.IP.To4() == nil {
+			// IPv6 CIDR (or garbage, which shouldn't get through validation).
+			continue
+		}
+		p.denyCIDRs = append(p.denyCIDRs, ip.CIDRFromIPNet(ipNet))
+	}
+	return p
+}
+
+func ruleOnlyMatchesSrcNet(r *proto.Rule) bool {
+	return r.Protocol == nil &&
+		len(r.SrcPorts) == 0 &&
+		r.DstNet == "" &&
+		len(r.DstPorts) == 0 &&
+		r.Icmp == nil &&
+		len(r.SrcIpSetIds) == 0 &&
+		len(r.DstIpSetIds) == 0 &&
+		len(r.SrcNamedPortIpSetIds) == 0 &&
+		len(r.DstNamedPortIpSetIds) == 0 &&
+		r.NotProtocol == nil &&
+		r.NotSrcNet == "" &&
+		len(r.NotSrcPorts) == 0 &&
+		r.NotDstNet == "" &&
+		len(r.NotDstPorts) == 0 &&
+		r.NotIcmp == nil &&
+		len(r.NotSrcIpSetIds) == 0 &&
+		len(r.NotDstIpSetIds) == 0 &&
+		len(r.NotSrcNamedPortIpSetIds) == 0 &&
+		len(r.NotDstNamedPortIpSetIds) == 0
+}
+
+// QueueResync forces us to reload the state of the dataplane on the next call to
+// CompleteDeferredWork() and to retry any interfaces that we failed to attach to.
+func (m *xdpManager) QueueResync() {
+	m.resyncNeeded = true
+	m.dirty = true
+}
+
+func (m *xdpManager) CompleteDeferredWork() error {
+	if !m.dirty {
+		return nil
+	}
+	if m.resyncNeeded {
+		if err := m.resync(); err != nil {
+			log.WithError(err).Warn("Failed to load XDP state, will retry...")
+			return err
+		}
+		m.resyncNeeded = false
+	}
+
+	desired := m.calculateDesiredCIDRs()
+	for ifaceName := range m.ifaceToCIDRs {
+		if _, ok := desired[ifaceName]; ok {
+			continue
+		}
+		log.WithField("iface", ifaceName).Info("Interface no longer needs XDP, detaching program")
+		if err := m.dataplane.Detach(ifaceName); err != nil {
+			log.WithError(err).WithField("iface", ifaceName).Warn(
+				"Failed to detach XDP program, will retry...")
+			return err
+		}
+		delete(m.ifaceToCIDRs, ifaceName)
+	}
+	for ifaceName, cidrs := range desired {
+		if err := m.syncIface(ifaceName, cidrs); err != nil {
+			log.WithError(err).WithField("iface", ifaceName).Warn(
+				"Failed to update XDP deny list, will retry...")
+			return err
+		}
+	}
+	gaugeXDPIfaces.Set(float64(len(m.ifaceToCIDRs)))
+	m.dirty = false
+	return nil
+}
+
+// resync reloads the CIDRs that are programmed for each interface that has our program
+// attached, including any left over from a previous run.
+func (m *xdpManager) resync() error {
+	m.unsupportedIfaces = set.New()
+	m.ifaceToCIDRs = map[string]set.Set{}
+	ifaceNames, err := m.dataplane.ListAttachedIfaces()
+	if err != nil {
+		return err
+	}
+	for _, ifaceName := range ifaceNames {
+		cidrs, err := m.dataplane.ListCIDRs(ifaceName)
+		if err != nil {
+			// Probably a half-removed program.  Skip it, if it's still needed, we'll
+			// attach it again from scratch.
+			log.WithError(err).WithField("iface", ifaceName).Warn(
+				"Failed to read XDP deny list, will reattach if needed")
+			continue
+		}
+		cidrSet := set.New()
+		for _, cidr := range cidrs {
+			cidrSet.Add(cidr)
+		}
+		m.ifaceToCIDRs[ifaceName] = cidrSet
+	}
+	return nil
+}
+
+// calculateDesiredCIDRs returns the set of CIDRs to deny for each host interface that has some
+// policy that we can accelerate.
+func (m *xdpManager) calculateDesiredCIDRs() map[string]set.Set {
+	desired := map[string]set.Set{}
+	for _, hostEp := range m.hostEndpoints {
+		if hostEp.Name == "" || len(hostEp.UntrackedTiers) == 0 {
+			continue
+		}
+		cidrs := set.New()
+		for _, polName := range hostEp.UntrackedTiers[0].Policies {
+			polID := proto.PolicyID{Tier: hostEp.UntrackedTiers[0].Name, Name: polName}
+			pol := m.policies[polID]
+			if pol == nil || !pol.compatible {
+				// This policy may allow traffic that a later policy denies so we
+				// have to stop here.
+				break
+			}
+			for _, cidr := range pol.denyCIDRs {
+				cidrs.Add(cidr)
+			}
+		}
+		if cidrs.Len() == 0 {
+			continue
+		}
+		if existing, ok := desired[hostEp.Name]; ok {
+			// Multiple endpoints for the same interface; the endpoint manager will only
+			// apply one of them so don't try to accelerate either.
+			log.WithField("iface", hostEp.Name).Warn(
+				"Multiple host endpoints for interface, not using XDP")
+			existing.Clear()
+			continue
+		}
+		desired[hostEp.Name] = cidrs
+	}
+	for ifaceName, cidrs := range desired {
+		if cidrs.Len() == 0 {
+			delete(desired, ifaceName)
+		}
+	}
+	return desired
+}
+
+func (m *xdpManager) syncIface(ifaceName string, desiredCIDRs set.Set) error {
+	logCxt := log.WithField("iface", ifaceName)
+	if m.unsupportedIfaces.Contains(ifaceName) {
+		logCxt.Debug("XDP not supported on interface, relying on iptables")
+		return nil
+	}
+	programmed, ok := m.ifaceToCIDRs[ifaceName]
+	if !ok {
+		logCxt.Info("Attaching XDP program to host interface")
+		if err := m.dataplane.Attach(ifaceName, m.failsafePorts); err != nil {
+			// Most likely the driver doesn't support XDP.  The untracked iptables rules
+			// still apply so there's nothing more to do.
+			logCxt.WithError(err).Warn(
+				"Failed to attach XDP program, falling back to iptables raw table")
+			countXDPFallbacks.Inc()
+			m.unsupportedIfaces.Add(ifaceName)
+			return nil
+		}
+		programmed = set.New()
+		m.ifaceToCIDRs[ifaceName] = programmed
+	}
+
+	var err error
+	programmed.Iter(func(item interface{}) error {
+		cidr := item.(ip.CIDR)
+		if desiredCIDRs.Contains(cidr) {
+			return nil
+		}
+		if err = m.dataplane.RemoveCIDR(ifaceName, cidr); err != nil {
+			return set.StopIteration
+		}
+		logCxt.WithField("cidr", cidr).Debug("Removed CIDR from XDP deny list")
+		return set.RemoveItem
+	})
+	if err != nil {
+		return err
+	}
+	desiredCIDRs.Iter(func(item interface{}) error {
+		cidr := item.(ip.CIDR)
+		if programmed.Contains(cidr) {
+			return nil
+		}
+		if err = m.dataplane.AddCIDR(ifaceName, cidr); err != nil {
+			return set.StopIteration
+		}
+		logCxt.WithField("cidr", cidr).Debug("Added CIDR to XDP deny list")
+		programmed.Add(cidr)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/ip"
+)
+
+const (
+	// xdpPinDir is where we pin the program and maps that we load for each interface, in
+	// a subdirectory named after the interface.  Pinning the maps allows us to update them
+	// with bpftool and to find them again after a restart.
+	xdpPinDir = "/sys/fs/bpf/calico/xdp"
+
+	xdpDenyMapName     = "calico_deny"
+	xdpFailsafeMapName = "calico_failsafe"
+)
+
+// bpfToolXDPDataplane loads and attaches our XDP program using the ip and bpftool commands.
+type bpfToolXDPDataplane struct {
+	programFile string
+}
+
+func newBPFToolXDPDataplane(programFile string) *bpfToolXDPDataplane {
+	return &bpfToolXDPDataplane{programFile: programFile}
+}
+
+func (d *bpfToolXDPDataplane) ListAttachedIfaces() ([]string, error) {
+	entries, err := ioutil.ReadDir(xdpPinDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ifaceNames []string
+	for _, e := range entries {
+		if e.IsDir() {
+			ifaceNames = append(ifaceNames, e.Name())
+		}
+	}
+	return ifaceNames, nil
+}
+
+func (d *bpfToolXDPDataplane) Attach(ifaceName string, failsafePorts []config.ProtoPort) error {
+	pinDir := filepath.Join(xdpPinDir, ifaceName)
+	// Start from scratch in case there's a half-loaded program from an earlier attempt.
+	if err := os.RemoveAll(pinDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(pinDir, 0700); err != nil {
+		return err
+	}
+	progPath := filepath.Join(pinDir, "prog")
+	err := runXDPCmd("bpftool", "prog", "load", d.programFile, progPath,
+		"type", "xdp", "pinmaps", filepath.Join(pinDir, "maps"))
+	if err == nil {
+		for _, pp := range failsafePorts {
+			// The map is keyed only on protocol and port so an entry that is limited
+			// to a CIDR exempts traffic from any source.  We err on the side of not
+			// locking the operator out.
+			var proto byte
+			switch pp.Protocol {
+			case "tcp":
+				proto = 6
+			case "udp":
+				proto = 17
+			default:
+				continue
+			}
+			key := []byte{proto, 0, byte(pp.Port >> 8), byte(pp.Port)}
+			err = runXDPCmd(mapUpdateArgs(d.mapPath(ifaceName, xdpFailsafeMapName), key)...)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		// Use driver (native) mode; generic mode runs after the kernel has allocated the
+		// socket buffer so it would be no faster than the raw table.
+		err = runXDPCmd("ip", "-force", "link", "set", "dev", ifaceName, "xdpdrv",
+			"pinned", progPath)
+	}
+	if err != nil {
+		os.RemoveAll(pinDir)
+		return err
+	}
+	return nil
+}
+
+func (d *bpfToolXDPDataplane) Detach(ifaceName string) error {
+	err := runXDPCmd("ip", "link", "set", "dev", ifaceName, "xdpdrv", "off")
+	if err != nil {
+		if _, lErr := net.InterfaceByName(ifaceName); lErr == nil {
+			return err
+		}
+		// The interface has gone, taking the program with it.
+		log.WithField("iface", ifaceName).Debug("Interface gone, cleaning up XDP pins")
+	}
+	return os.RemoveAll(filepath.Join(xdpPinDir, ifaceName))
+}
+
+func (d *bpfToolXDPDataplane) ListCIDRs(ifaceName string) ([]ip.CIDR, error) {
+	out, err := exec.Command("bpftool", "-j", "map", "dump",
+		"pinned", d.mapPath(ifaceName, xdpDenyMapName)).Output()
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Key []string `json:"key"`
+	}
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, err
+	}
+	var cidrs []ip.CIDR
+	for _, e := range entries {
+		key, err := parseBPFToolBytes(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 8 {
+			return nil, fmt.Errorf("unexpected XDP map key length %d", len(key))
+		}
+		cidrs = append(cidrs, ip.CIDRFromIPNet(&net.IPNet{
+			IP:   net.IP(key[4:8]),
+			Mask: net.CIDRMask(int(binary.LittleEndian.Uint32(key[0:4])), 32),
+		}))
+	}
+	return cidrs, nil
+}
+
+func (d *bpfToolXDPDataplane) AddCIDR(ifaceName string, cidr ip.CIDR) error {
+	return runXDPCmd(mapUpdateArgs(d.mapPath(ifaceName, xdpDenyMapName), denyMapKey(cidr))...)
+}
+
+func (d *bpfToolXDPDataplane) RemoveCIDR(ifaceName string, cidr ip.CIDR) error {
+	args := []string{
+		"bpftool", "map", "delete", "pinned", d.mapPath(ifaceName, xdpDenyMapName), "key", "hex",
+	}
+	args = append(args, hexBytes(denyMapKey(cidr))...)
+	return runXDPCmd(args...)
+}
+
+func (d *bpfToolXDPDataplane) mapPath(ifaceName, mapName string) string {
+	return filepath.Join(xdpPinDir, ifaceName, "maps", mapName)
+}
+
+// denyMapKey returns the LPM trie key for the given CIDR: the prefix length, in host byte
+// order, followed by the address.
+func denyMapKey(cidr ip.CIDR) []byte {
+	key := make([]byte, 8)
+	// All the architectures that we build for are little-endian.
+	binary.LittleEndian.PutUint32(key[0:4], uint32(cidr.Prefix()))
+	copy(key[4:8], cidr.Addr().AsNetIP().To4())
+	return key
+}
+
+// mapUpdateArgs returns the bpftool command to add the given key to a map.  Our maps are
+// only used as sets so the value is always 1.
+func mapUpdateArgs(mapPath string, key []byte) []string {
+	args := []string{"bpftool", "map", "update", "pinned", mapPath, "key", "hex"}
+	args = append(args, hexBytes(key)...)
+	args = append(args, "value", "hex", "01", "00", "00", "00")
+	return args
+}
+
+func hexBytes(b []byte) []string {
+	var out []string
+	for _, x := range b {
+		out = append(out, fmt.Sprintf("%02x", x))
+	}
+	return out
+}
+
+// parseBPFToolBytes parses the "0x12"-style byte strings that bpftool uses in its JSON output.
+func parseBPFToolBytes(s []string) ([]byte, error) {
+	var out []byte
+	for _, x := range s {
+		v, err := strconv.ParseUint(strings.TrimPrefix(x, "0x"), 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, byte(v))
+	}
+	return out, nil
+}
+
+func runXDPCmd(args ...string) error {
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cmd":    args,
+			"output": string(out),
+		}).WithError(err).Warn("XDP command failed")
+		return err
+	}
+	return nil
+}
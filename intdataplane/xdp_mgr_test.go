@@ -0,0 +1,254 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/set"
+)
+
+var _ = Describe("XDP manager", func() {
+	var (
+		xdpMgr    *xdpManager
+		dataplane *mockXDPDataplane
+	)
+
+	failsafePorts := []config.ProtoPort{{Protocol: "tcp", Port: 22}}
+
+	denyPolicy := func(cidrs ...string) *proto.Policy {
+		p := &proto.Policy{Untracked: true}
+		for _, cidr := range cidrs {
+			p.InboundRules = append(p.InboundRules, &proto.Rule{Action: "deny", SrcNet: cidr})
+		}
+		return p
+	}
+	updatePolicy := func(name string, policy *proto.Policy) {
+		xdpMgr.OnUpdate(&proto.ActivePolicyUpdate{
+			Id:     &proto.PolicyID{Tier: "default", Name: name},
+			Policy: policy,
+		})
+	}
+	updateHostEp := func(id, ifaceName string, policies ...string) {
+		xdpMgr.OnUpdate(&proto.HostEndpointUpdate{
+			Id: &proto.HostEndpointID{EndpointId: id},
+			Endpoint: &proto.HostEndpoint{
+				Name: ifaceName,
+				UntrackedTiers: []*proto.TierInfo{
+					{Name: "default", Policies: policies},
+				},
+			},
+		})
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockXDPDataplane()
+		xdpMgr = newXDPManagerWithShim(failsafePorts, dataplane)
+	})
+
+	It("should do nothing with no host endpoints", func() {
+		Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+		Expect(dataplane.ifaceToCIDRs).To(BeEmpty())
+	})
+
+	It("should clean up programs left over from a previous run", func() {
+		dataplane.ifaceToCIDRs["eth1"] = set.From(ip.MustParseCIDR("10.0.0.0/8"))
+		Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+		Expect(dataplane.ifaceToCIDRs).To(BeEmpty())
+	})
+
+	Describe("with a deny policy on a host endpoint", func() {
+		BeforeEach(func() {
+			updatePolicy("pol1", denyPolicy("10.0.0.0/8", "192.168.1.1/32", "fe80::/64"))
+			updateHostEp("ep1", "eth0", "pol1")
+			Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+		})
+
+		It("should attach the program with the failsafe ports", func() {
+			Expect(dataplane.failsafePorts["eth0"]).To(Equal(failsafePorts))
+		})
+
+		It("should program the IPv4 CIDRs", func() {
+			Expect(dataplane.ifaceToCIDRs["eth0"]).To(Equal(set.From(
+				ip.MustParseCIDR("10.0.0.0/8"),
+				ip.MustParseCIDR("192.168.1.1/32"),
+			)))
+		})
+
+		It("should update the CIDRs when the policy changes", func() {
+			updatePolicy("pol1", denyPolicy("10.0.0.0/8", "172.16.0.0/12"))
+			Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.ifaceToCIDRs["eth0"]).To(Equal(set.From(
+				ip.MustParseCIDR("10.0.0.0/8"),
+				ip.MustParseCIDR("172.16.0.0/12"),
+			)))
+			Expect(dataplane.numAttaches).To(Equal(1))
+		})
+
+		It("should detach when the policy stops being compatible", func() {
+			p := denyPolicy("10.0.0.0/8")
+			p.InboundRules[0].DstPorts = []*proto.PortRange{{First: 80, Last: 80}}
+			updatePolicy("pol1", p)
+			Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.ifaceToCIDRs).To(BeEmpty())
+		})
+
+		It("should detach when the host endpoint is removed", func() {
+			xdpMgr.OnUpdate(&proto.HostEndpointRemove{Id: &proto.HostEndpointID{EndpointId: "ep1"}})
+			Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.ifaceToCIDRs).To(BeEmpty())
+		})
+
+		It("should restore CIDRs that were removed behind our back after a resync", func() {
+			dataplane.ifaceToCIDRs["eth0"].Discard(ip.MustParseCIDR("10.0.0.0/8"))
+			xdpMgr.QueueResync()
+			Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.ifaceToCIDRs["eth0"].Contains(ip.MustParseCIDR("10.0.0.0/8"))).To(BeTrue())
+		})
+
+		It("should retry after a failure to update the map", func() {
+			dataplane.failNextUpdate = true
+			updatePolicy("pol1", denyPolicy("172.16.0.0/12"))
+			Expect(xdpMgr.CompleteDeferredWork()).NotTo(Succeed())
+			Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.ifaceToCIDRs["eth0"]).To(Equal(set.From(
+				ip.MustParseCIDR("172.16.0.0/12"),
+			)))
+		})
+	})
+
+	It("should only accelerate policies up to the first non-deny policy", func() {
+		updatePolicy("pol1", denyPolicy("10.0.0.0/8"))
+		updatePolicy("pol2", &proto.Policy{InboundRules: []*proto.Rule{
+			{Action: "allow", SrcNet: "172.16.0.0/12"},
+		}})
+		updatePolicy("pol3", denyPolicy("172.16.0.0/12"))
+		updateHostEp("ep1", "eth0", "pol1", "pol2", "pol3")
+		Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+		Expect(dataplane.ifaceToCIDRs["eth0"]).To(Equal(set.From(
+			ip.MustParseCIDR("10.0.0.0/8"),
+		)))
+	})
+
+	It("should ignore host endpoints without an interface name", func() {
+		updatePolicy("pol1", denyPolicy("10.0.0.0/8"))
+		updateHostEp("ep1", "", "pol1")
+		Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+		Expect(dataplane.ifaceToCIDRs).To(BeEmpty())
+	})
+
+	Describe("with an interface that doesn't support XDP", func() {
+		BeforeEach(func() {
+			dataplane.unsupportedIfaces.Add("eth0")
+			updatePolicy("pol1", denyPolicy("10.0.0.0/8"))
+			updateHostEp("ep1", "eth0", "pol1")
+		})
+
+		It("should fall back without returning an error", func() {
+			Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.ifaceToCIDRs).To(BeEmpty())
+			Expect(dataplane.numAttaches).To(Equal(1))
+		})
+
+		It("should not retry until the next resync", func() {
+			Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+			updatePolicy("pol1", denyPolicy("10.0.0.0/16"))
+			Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.numAttaches).To(Equal(1))
+
+			dataplane.unsupportedIfaces.Discard("eth0")
+			xdpMgr.QueueResync()
+			Expect(xdpMgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.numAttaches).To(Equal(2))
+			Expect(dataplane.ifaceToCIDRs["eth0"]).To(Equal(set.From(
+				ip.MustParseCIDR("10.0.0.0/16"),
+			)))
+		})
+	})
+})
+
+type mockXDPDataplane struct {
+	ifaceToCIDRs      map[string]set.Set
+	failsafePorts     map[string][]config.ProtoPort
+	unsupportedIfaces set.Set
+	numAttaches       int
+	failNextUpdate    bool
+}
+
+func newMockXDPDataplane() *mockXDPDataplane {
+	return &mockXDPDataplane{
+		ifaceToCIDRs:      map[string]set.Set{},
+		failsafePorts:     map[string][]config.ProtoPort{},
+		unsupportedIfaces: set.New(),
+	}
+}
+
+func (d *mockXDPDataplane) ListAttachedIfaces() ([]string, error) {
+	var ifaceNames []string
+	for ifaceName := range d.ifaceToCIDRs {
+		ifaceNames = append(ifaceNames, ifaceName)
+	}
+	return ifaceNames, nil
+}
+
+func (d *mockXDPDataplane) Attach(ifaceName string, failsafePorts []config.ProtoPort) error {
+	d.numAttaches++
+	if d.unsupportedIfaces.Contains(ifaceName) {
+		return errors.New("XDP not supported")
+	}
+	d.ifaceToCIDRs[ifaceName] = set.New()
+	d.failsafePorts[ifaceName] = failsafePorts
+	return nil
+}
+
+func (d *mockXDPDataplane) Detach(ifaceName string) error {
+	Expect(d.ifaceToCIDRs).To(HaveKey(ifaceName))
+	delete(d.ifaceToCIDRs, ifaceName)
+	delete(d.failsafePorts, ifaceName)
+	return nil
+}
+
+func (d *mockXDPDataplane) ListCIDRs(ifaceName string) ([]ip.CIDR, error) {
+	var cidrs []ip.CIDR
+	d.ifaceToCIDRs[ifaceName].Iter(func(item interface{}) error {
+		cidrs = append(cidrs, item.(ip.CIDR))
+		return nil
+	})
+	return cidrs, nil
+}
+
+func (d *mockXDPDataplane) AddCIDR(ifaceName string, cidr ip.CIDR) error {
+	if d.failNextUpdate {
+		d.failNextUpdate = false
+		return errors.New("dummy failure")
+	}
+	d.ifaceToCIDRs[ifaceName].Add(cidr)
+	return nil
+}
+
+func (d *mockXDPDataplane) RemoveCIDR(ifaceName string, cidr ip.CIDR) error {
+	if d.failNextUpdate {
+		d.failNextUpdate = false
+		return errors.New("dummy failure")
+	}
+	d.ifaceToCIDRs[ifaceName].Discard(cidr)
+	return nil
+}
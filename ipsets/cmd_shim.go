@@ -16,8 +16,18 @@ package ipsets
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/dataplaneexec"
 )
 
 type WriteFlusher interface {
@@ -51,6 +61,35 @@ func newRealCmd(name string, arg ...string) CmdIface {
 	return (*cmdAdapter)(cmd)
 }
 
+// execCmdFactory returns a cmdFactory that runs the ipset commands as specified by the given
+// options.  In read-only mode, only "ipset list" is run.  If a command is killed after the
+// timeout, its Wait() returns an error so the IP set is resynced.
+func execCmdFactory(o dataplaneexec.Options) cmdFactory {
+	return func(name string, arg ...string) CmdIface {
+		return newExecCmd(o, name, arg...)
+	}
+}
+
+func newExecCmd(o dataplaneexec.Options, name string, arg ...string) CmdIface {
+	if o.RenderOnly != nil {
+		return &renderOnlyCmd{
+			isRestore: len(arg) > 0 && arg[0] == "restore",
+			out:       o.RenderOnly,
+		}
+	}
+	if o.ReadOnly && len(arg) > 0 && arg[0] != "list" {
+		return &readOnlyCmd{args: arg}
+	}
+	name, arg = o.CommandLine(name, arg)
+	if o.Timeout > 0 {
+		return &timeoutCmd{
+			cmdAdapter: (*cmdAdapter)(exec.Command(name, arg...)),
+			timeout:    o.Timeout,
+		}
+	}
+	return newRealCmd(name, arg...)
+}
+
 type cmdAdapter exec.Cmd
 
 func (c *cmdAdapter) StdinPipe() (WriteCloserFlusher, error) {
@@ -113,3 +152,189 @@ func (c *cmdAdapter) Output() ([]byte, error) {
 func (c *cmdAdapter) CombinedOutput() ([]byte, error) {
 	return (*exec.Cmd)(c).CombinedOutput()
 }
+
+// timeoutCmd is a cmdAdapter that kills its process if it runs for longer than its timeout.
+// Since ipset is used via pipes, the timer is started by Start() and stopped by Wait(); killing
+// the process closes its end of the pipes so that a caller blocked on them sees an error.
+type timeoutCmd struct {
+	*cmdAdapter
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut int32
+}
+
+func (c *timeoutCmd) Start() error {
+	if err := c.cmdAdapter.Start(); err != nil {
+		return err
+	}
+	c.timer = time.AfterFunc(c.timeout, c.kill)
+	return nil
+}
+
+func (c *timeoutCmd) kill() {
+	atomic.StoreInt32(&c.timedOut, 1)
+	logCxt := log.WithFields(log.Fields{
+		"cmd":     (*exec.Cmd)(c.cmdAdapter).Args,
+		"pid":     c.Process.Pid,
+		"timeout": c.timeout,
+	})
+	logCxt.Error("ipset command timed out, killing it")
+	countNumIPSetCommandTimeouts.Inc()
+	if err := c.Process.Kill(); err != nil {
+		logCxt.WithError(err).Error("Failed to kill timed-out ipset command")
+	}
+}
+
+func (c *timeoutCmd) Wait() error {
+	err := c.cmdAdapter.Wait()
+	c.timer.Stop()
+	if atomic.LoadInt32(&c.timedOut) != 0 {
+		return fmt.Errorf("ipset command %v timed out after %v", c.Args, c.timeout)
+	}
+	return err
+}
+
+// Output and CombinedOutput are reimplemented in terms of our Start() and Wait(); the
+// exec.Cmd versions would bypass the timer.  Wait() returns only after the output has been
+// copied into the buffer so it is safe to read it afterwards.
+func (c *timeoutCmd) Output() ([]byte, error) {
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	err := c.Wait()
+	return stdout.Bytes(), err
+}
+
+func (c *timeoutCmd) CombinedOutput() ([]byte, error) {
+	var output bytes.Buffer
+	c.Stdout = &output
+	c.Stderr = &output
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	err := c.Wait()
+	return output.Bytes(), err
+}
+
+// renderOnlyCmd is a fake command that simulates an empty dataplane.  It captures the input
+// to "ipset restore" instead of applying it.
+type renderOnlyCmd struct {
+	isRestore bool
+	out       io.Writer
+	stdin     io.Reader
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func (c *renderOnlyCmd) StdinPipe() (WriteCloserFlusher, error) {
+	out := ioutil.Discard
+	if c.isRestore {
+		out = c.out
+	}
+	return &BufferedCloser{
+		BufWriter: bufio.NewWriter(out),
+		Closer:    nopCloser{},
+	}, nil
+}
+
+func (c *renderOnlyCmd) StdoutPipe() (io.ReadCloser, error) {
+	return ioutil.NopCloser(&bytes.Buffer{}), nil
+}
+
+func (c *renderOnlyCmd) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *renderOnlyCmd) SetStdout(w io.Writer) {}
+
+func (c *renderOnlyCmd) SetStderr(w io.Writer) {}
+
+func (c *renderOnlyCmd) Start() error {
+	return nil
+}
+
+func (c *renderOnlyCmd) Wait() error {
+	if c.isRestore && c.stdin != nil {
+		_, err := io.Copy(c.out, c.stdin)
+		return err
+	}
+	return nil
+}
+
+func (c *renderOnlyCmd) Output() ([]byte, error) {
+	return nil, c.Wait()
+}
+
+func (c *renderOnlyCmd) CombinedOutput() ([]byte, error) {
+	return nil, c.Wait()
+}
+
+// readOnlyCmd is a fake command that stands in for the ipset commands that modify the dataplane.
+// Rather than running the command, it logs the input, which is the drift between the dataplane
+// and our desired state.
+type readOnlyCmd struct {
+	args  []string
+	input bytes.Buffer
+	stdin io.Reader
+}
+
+func (c *readOnlyCmd) StdinPipe() (WriteCloserFlusher, error) {
+	return &BufferedCloser{
+		BufWriter: bufio.NewWriter(&c.input),
+		Closer:    nopCloser{},
+	}, nil
+}
+
+func (c *readOnlyCmd) StdoutPipe() (io.ReadCloser, error) {
+	return ioutil.NopCloser(&bytes.Buffer{}), nil
+}
+
+func (c *readOnlyCmd) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *readOnlyCmd) SetStdout(w io.Writer) {}
+
+func (c *readOnlyCmd) SetStderr(w io.Writer) {}
+
+func (c *readOnlyCmd) Start() error {
+	return nil
+}
+
+func (c *readOnlyCmd) Wait() error {
+	if c.stdin != nil {
+		if _, err := io.Copy(&c.input, c.stdin); err != nil {
+			return err
+		}
+	}
+	input := c.input.String()
+	numLines := 1
+	if c.args[0] == "restore" {
+		// Don't count the COMMIT.
+		numLines = strings.Count(input, "\n") - 1
+		if numLines <= 0 {
+			return nil
+		}
+	}
+	countNumIPSetReadOnlyLinesSuppressed.Add(float64(numLines))
+	log.WithFields(log.Fields{
+		"args":     c.args,
+		"numLines": numLines,
+		"input":    input,
+	}).Warn("Read-only mode: IP sets differ from desired state, not applying updates")
+	return nil
+}
+
+func (c *readOnlyCmd) Output() ([]byte, error) {
+	return nil, c.Wait()
+}
+
+func (c *readOnlyCmd) CombinedOutput() ([]byte, error) {
+	return nil, c.Wait()
+}
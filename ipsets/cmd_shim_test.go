@@ -0,0 +1,52 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipsets
+
+import (
+	"io/ioutil"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/dataplaneexec"
+)
+
+var _ = Describe("Commands with a timeout", func() {
+	newCmd := execCmdFactory(dataplaneexec.Options{Timeout: 100 * time.Millisecond})
+
+	It("should kill a command that runs for too long", func() {
+		start := time.Now()
+		_, err := newCmd("sleep", "10").Output()
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("should unblock a reader of a command that runs for too long", func() {
+		cmd := newCmd("sh", "-c", "sleep 10")
+		out, err := cmd.StdoutPipe()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cmd.Start()).To(Succeed())
+		_, err = ioutil.ReadAll(out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cmd.Wait()).To(HaveOccurred())
+	})
+
+	It("should return the output of a command that finishes in time", func() {
+		out, err := newCmd("echo", "hello").CombinedOutput()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("hello\n"))
+	})
+})
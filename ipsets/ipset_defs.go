@@ -18,7 +18,9 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
 
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/projectcalico/felix/ip"
@@ -46,6 +48,46 @@ var (
 		Name: "felix_ipset_lines_executed",
 		Help: "Number of ipset operations executed.",
 	})
+	countNumIPSetInconsistencies = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ipset_resync_inconsistencies",
+		Help: "Number of IP set members that a resync found to be missing or unexpected.",
+	})
+	countNumIPSetDeletionsDeferred = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ipset_deletions_deferred",
+		Help: "Number of IP set deletions that we deferred because the IP set was still in use.",
+	})
+	countNumIPSetCommandTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ipset_command_timeouts",
+		Help: "Number of ipset commands that we killed because they exceeded their timeout.",
+	})
+	countNumIPSetReadOnlyLinesSuppressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_ipset_read_only_lines_suppressed",
+		Help: "Number of ipset operations that we didn't execute because we're in read-only mode.",
+	})
+	gaugeVecIPSetMembers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_ipset_members",
+		Help: "Number of members in each of our IP sets.",
+	}, []string{"set_name"})
+	gaugeVecIPSetMaxMembers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_ipset_max_members",
+		Help: "Maximum number of members of each of our IP sets.",
+	}, []string{"set_name"})
+	countVecIPSetMemberAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_ipset_member_adds",
+		Help: "Number of members added to each of our IP sets by incremental updates.",
+	}, []string{"set_name"})
+	countVecIPSetMemberDeletes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_ipset_member_deletes",
+		Help: "Number of members removed from each of our IP sets by incremental updates.",
+	}, []string{"set_name"})
+	countVecIPSetRewrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_ipset_rewrites",
+		Help: "Number of full rewrites of each of our IP sets.",
+	}, []string{"set_name"})
+	countVecIPSetRestoreFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_ipset_restore_failures",
+		Help: "Number of failed ipset restore calls.",
+	}, []string{"ip_version"})
 	summaryExecStart = prometheus.NewSummary(prometheus.SummaryOpts{
 		Name: "felix_exec_time_micros",
 		Help: "Summary of time taken to fork/exec child processes",
@@ -58,6 +100,16 @@ func init() {
 	prometheus.MustRegister(countNumIPSetCalls)
 	prometheus.MustRegister(countNumIPSetErrors)
 	prometheus.MustRegister(countNumIPSetLinesExecuted)
+	prometheus.MustRegister(countNumIPSetInconsistencies)
+	prometheus.MustRegister(countNumIPSetDeletionsDeferred)
+	prometheus.MustRegister(countNumIPSetCommandTimeouts)
+	prometheus.MustRegister(countNumIPSetReadOnlyLinesSuppressed)
+	prometheus.MustRegister(gaugeVecIPSetMembers)
+	prometheus.MustRegister(gaugeVecIPSetMaxMembers)
+	prometheus.MustRegister(countVecIPSetMemberAdds)
+	prometheus.MustRegister(countVecIPSetMemberDeletes)
+	prometheus.MustRegister(countVecIPSetRewrites)
+	prometheus.MustRegister(countVecIPSetRestoreFailures)
 	prometheus.MustRegister(summaryExecStart)
 }
 
@@ -67,8 +119,11 @@ const MaxIPSetNameLength = 31
 type IPSetType string
 
 const (
-	IPSetTypeHashIP  IPSetType = "hash:ip"
-	IPSetTypeHashNet IPSetType = "hash:net"
+	IPSetTypeHashIP        IPSetType = "hash:ip"
+	IPSetTypeHashNet       IPSetType = "hash:net"
+	IPSetTypeHashNetPort   IPSetType = "hash:net,port"
+	IPSetTypeHashIPPort    IPSetType = "hash:ip,port"
+	IPSetTypeHashIPPortNet IPSetType = "hash:ip,port,net"
 )
 
 func (t IPSetType) SetType() string {
@@ -90,18 +145,136 @@ func (t IPSetType) CanonicaliseMember(member string) ipSetMember {
 	case IPSetTypeHashNet:
 		// Convert the string into our ip.CIDR type, which is backed by a struct.
 		return ip.MustParseCIDR(member)
+	case IPSetTypeHashNetPort:
+		// Members look like "10.0.0.0/24,tcp:80".
+		parts := strings.Split(member, ",")
+		if len(parts) != 2 {
+			log.WithField("member", member).Panic("Failed to parse net,port member")
+		}
+		protocol, port := parseProtoPort(parts[1])
+		return netPort{
+			net:      parseNet(parts[0]),
+			protocol: protocol,
+			port:     port,
+		}
+	case IPSetTypeHashIPPort:
+		// Members look like "10.0.0.1,tcp:80".
+		parts := strings.Split(member, ",")
+		if len(parts) != 2 {
+			log.WithField("member", member).Panic("Failed to parse ip,port member")
+		}
+		ipAddr := ip.FromString(parts[0])
+		if ipAddr == nil {
+			log.WithField("ip", parts[0]).Panic("Failed to parse IP")
+		}
+		protocol, port := parseProtoPort(parts[1])
+		return ipPort{
+			addr:     ipAddr,
+			protocol: protocol,
+			port:     port,
+		}
+	case IPSetTypeHashIPPortNet:
+		// Members look like "10.0.0.1,tcp:80,10.1.0.0/16".
+		parts := strings.Split(member, ",")
+		if len(parts) != 3 {
+			log.WithField("member", member).Panic("Failed to parse ip,port,net member")
+		}
+		ipAddr := ip.FromString(parts[0])
+		if ipAddr == nil {
+			log.WithField("ip", parts[0]).Panic("Failed to parse IP")
+		}
+		protocol, port := parseProtoPort(parts[1])
+		return ipPortNet{
+			addr:     ipAddr,
+			protocol: protocol,
+			port:     port,
+			net:      parseNet(parts[2]),
+		}
 	}
 	log.WithField("type", string(t)).Panic("Unknown IPSetType")
 	return nil
 }
 
+// parseNet parses the network part of a member.  "ipset list" omits the prefix length of
+// networks that are a single address, so we accept a plain IP too.
+func parseNet(s string) ip.CIDR {
+	if !strings.Contains(s, "/") {
+		ipAddr := ip.FromString(s)
+		if ipAddr == nil {
+			log.WithField("cidr", s).Panic("Failed to parse CIDR")
+		}
+		prefixLen := 32
+		if ipAddr.Version() == 6 {
+			prefixLen = 128
+		}
+		return ip.MustParseCIDR(fmt.Sprintf("%s/%d", s, prefixLen))
+	}
+	return ip.MustParseCIDR(s)
+}
+
+// parseProtoPort parses the port part of a member, such as "tcp:80".  As for the ipset
+// command, the protocol defaults to TCP.
+func parseProtoPort(s string) (protocol string, port uint16) {
+	protocol = "tcp"
+	portStr := s
+	if parts := strings.SplitN(s, ":", 2); len(parts) == 2 {
+		protocol = strings.ToLower(parts[0])
+		portStr = parts[1]
+	}
+	switch protocol {
+	case "tcp", "udp", "sctp", "udplite":
+	default:
+		log.WithField("protocol", protocol).Panic("Unsupported IP set member protocol")
+	}
+	p, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		log.WithError(err).WithField("port", portStr).Panic("Failed to parse IP set member port")
+	}
+	return protocol, uint16(p)
+}
+
 type ipSetMember interface {
 	String() string
 }
 
+// netPort is the canonical form of a member of a hash:net,port IP set.
+type netPort struct {
+	net      ip.CIDR
+	protocol string
+	port     uint16
+}
+
+func (m netPort) String() string {
+	return fmt.Sprintf("%s,%s:%d", m.net, m.protocol, m.port)
+}
+
+// ipPort is the canonical form of a member of a hash:ip,port IP set.
+type ipPort struct {
+	addr     ip.Addr
+	protocol string
+	port     uint16
+}
+
+func (m ipPort) String() string {
+	return fmt.Sprintf("%s,%s:%d", m.addr, m.protocol, m.port)
+}
+
+// ipPortNet is the canonical form of a member of a hash:ip,port,net IP set.
+type ipPortNet struct {
+	addr     ip.Addr
+	protocol string
+	port     uint16
+	net      ip.CIDR
+}
+
+func (m ipPortNet) String() string {
+	return fmt.Sprintf("%s,%s:%d,%s", m.addr, m.protocol, m.port, m.net)
+}
+
 func (t IPSetType) IsValid() bool {
 	switch t {
-	case IPSetTypeHashIP, IPSetTypeHashNet:
+	case IPSetTypeHashIP, IPSetTypeHashNet, IPSetTypeHashNetPort, IPSetTypeHashIPPort,
+		IPSetTypeHashIPPortNet:
 		return true
 	}
 	return false
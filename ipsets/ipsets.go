@@ -17,8 +17,10 @@ package ipsets
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 
@@ -27,6 +29,8 @@ import (
 
 	"github.com/gavv/monotime"
 
+	"github.com/projectcalico/felix/dataplaneexec"
+	"github.com/projectcalico/felix/hashutils"
 	"github.com/projectcalico/felix/set"
 )
 
@@ -36,6 +40,9 @@ type IPSets struct {
 
 	ipSetIDToIPSet       map[string]*ipSet
 	mainIPSetNameToIPSet map[string]*ipSet
+	// setNames records the (truncated) dataplane name of each IP set so that we can detect
+	// two IDs that truncate to the same name.
+	setNames *hashutils.NameRegistry
 
 	existingIPSetNames set.Set
 
@@ -52,15 +59,16 @@ type IPSets struct {
 	// Shim for time.Sleep()
 	sleep func(time.Duration)
 
-	gaugeNumIpsets prometheus.Gauge
+	gaugeNumIpsets          prometheus.Gauge
+	countNumRestoreFailures prometheus.Counter
 
 	logCxt *log.Entry
 }
 
-func NewIPSets(ipVersionConfig *IPVersionConfig) *IPSets {
+func NewIPSets(ipVersionConfig *IPVersionConfig, execOptions dataplaneexec.Options) *IPSets {
 	return NewIPSetsWithShims(
 		ipVersionConfig,
-		newRealCmd,
+		execCmdFactory(execOptions),
 		time.Sleep,
 	)
 }
@@ -77,6 +85,7 @@ func NewIPSetsWithShims(
 
 		ipSetIDToIPSet:       map[string]*ipSet{},
 		mainIPSetNameToIPSet: map[string]*ipSet{},
+		setNames:             hashutils.NewNameRegistry(),
 
 		dirtyIPSetIDs:         set.New(),
 		pendingIPSetDeletions: set.New(),
@@ -85,7 +94,8 @@ func NewIPSetsWithShims(
 		existingIPSetNames:    set.New(),
 		resyncRequired:        true,
 
-		gaugeNumIpsets: gaugeVecNumCalicoIpsets.WithLabelValues(familyStr),
+		gaugeNumIpsets:          gaugeVecNumCalicoIpsets.WithLabelValues(familyStr),
+		countNumRestoreFailures: countVecIPSetRestoreFailures.WithLabelValues(familyStr),
 
 		logCxt: log.WithFields(log.Fields{
 			"family": ipVersionConfig.Family,
@@ -108,9 +118,14 @@ func (s *IPSets) AddOrReplaceIPSet(setMetadata IPSetMetadata, members []string)
 
 	// Create the IP set struct and store it off.
 	setID := setMetadata.SetID
+	mainIPSetName := s.IPVersionConfig.NameForMainIPSet(setID)
+	if err := s.setNames.Register(setID, mainIPSetName); err != nil {
+		// Sharing the IP set would silently merge the two sets' members.
+		s.logCxt.WithError(err).Panic("IP set name collides with another IP set")
+	}
 	ipSet := &ipSet{
 		IPSetMetadata:    setMetadata,
-		MainIPSetName:    s.IPVersionConfig.NameForMainIPSet(setID),
+		MainIPSetName:    mainIPSetName,
 		TempIPSetName:    s.IPVersionConfig.NameForTempIPSet(setID),
 		pendingReplace:   canonMembers,
 		pendingAdds:      set.New(),
@@ -118,6 +133,7 @@ func (s *IPSets) AddOrReplaceIPSet(setMetadata IPSetMetadata, members []string)
 	}
 	s.ipSetIDToIPSet[setID] = ipSet
 	s.mainIPSetNameToIPSet[ipSet.MainIPSetName] = ipSet
+	gaugeVecIPSetMaxMembers.WithLabelValues(ipSet.MainIPSetName).Set(float64(setMetadata.MaxSize))
 
 	// Mark IP set dirty so ApplyUpdates() will rewrite it.
 	s.dirtyIPSetIDs.Add(setID)
@@ -132,10 +148,12 @@ func (s *IPSets) AddOrReplaceIPSet(setMetadata IPSetMetadata, members []string)
 func (s *IPSets) RemoveIPSet(setID string) {
 	s.logCxt.WithField("setID", setID).Info("Queueing IP set for removal")
 	delete(s.ipSetIDToIPSet, setID)
+	s.setNames.Unregister(setID)
 	mainIPSetName := s.IPVersionConfig.NameForMainIPSet(setID)
 	tempIPSetName := s.IPVersionConfig.NameForTempIPSet(setID)
 	delete(s.mainIPSetNameToIPSet, mainIPSetName)
 	s.dirtyIPSetIDs.Discard(setID)
+	deleteIPSetMetrics(mainIPSetName)
 	s.pendingIPSetDeletions.Add(mainIPSetName)
 	s.pendingIPSetDeletions.Add(tempIPSetName)
 }
@@ -219,7 +237,9 @@ func (s *IPSets) filterAndCanonicaliseMembers(ipSetType IPSetType, members []str
 	filtered := set.New()
 	wantIPV6 := s.IPVersionConfig.Family == IPFamilyV6
 	for _, member := range members {
-		isIPV6 := strings.Index(member, ":") >= 0
+		// Members of the port types contain a ":" in their port part, so only check the
+		// first, address, part of the member.
+		isIPV6 := strings.Contains(strings.Split(member, ",")[0], ":")
 		if wantIPV6 != isIPV6 {
 			continue
 		}
@@ -249,6 +269,7 @@ func (s *IPSets) ApplyUpdates() {
 			if numProblems > 0 {
 				s.logCxt.WithField("numProblems", numProblems).Info(
 					"Found inconsistencies in dataplane")
+				countNumIPSetInconsistencies.Add(float64(numProblems))
 			}
 			s.resyncRequired = false
 		}
@@ -257,6 +278,7 @@ func (s *IPSets) ApplyUpdates() {
 			s.logCxt.WithError(err).Error("Failed to update IP sets.")
 			s.resyncRequired = true
 			countNumIPSetErrors.Inc()
+			s.countNumRestoreFailures.Inc()
 			backOff()
 			continue
 		}
@@ -594,7 +616,9 @@ func (s *IPSets) tryUpdates() error {
 	// and figure out how much of our update succeeded.
 	s.dirtyIPSetIDs.Iter(func(item interface{}) error {
 		ipSet := s.ipSetIDToIPSet[item.(string)]
+		setName := ipSet.MainIPSetName
 		if ipSet.pendingReplace != nil {
+			countVecIPSetRewrites.WithLabelValues(setName).Inc()
 			ipSet.members = ipSet.pendingReplace
 			ipSet.pendingReplace = nil
 
@@ -602,6 +626,8 @@ func (s *IPSets) tryUpdates() error {
 			s.existingIPSetNames.Add(ipSet.MainIPSetName)
 			s.existingIPSetNames.Discard(ipSet.TempIPSetName)
 		} else {
+			countVecIPSetMemberAdds.WithLabelValues(setName).Add(float64(ipSet.pendingAdds.Len()))
+			countVecIPSetMemberDeletes.WithLabelValues(setName).Add(float64(ipSet.pendingDeletions.Len()))
 			ipSet.pendingAdds.Iter(func(m interface{}) error {
 				ipSet.members.Add(m)
 				return set.RemoveItem
@@ -611,6 +637,7 @@ func (s *IPSets) tryUpdates() error {
 				return set.RemoveItem
 			})
 		}
+		gaugeVecIPSetMembers.WithLabelValues(setName).Set(float64(ipSet.members.Len()))
 		return set.RemoveItem
 	})
 
@@ -744,15 +771,20 @@ func (s *IPSets) writeDeltas(ipSet *ipSet, out io.Writer, logCxt log.FieldLogger
 	return
 }
 
-// ApplyDeletions tries to delete any IP sets that are no longer needed.
-// Failures are ignored, deletions will be retried the next time we do a resync.
+// ApplyDeletions tries to delete any IP sets that are no longer needed.  It should be called
+// once the iptables rules that referenced the IP sets have been removed.  IP sets that are still
+// in use are left pending and retried on the next call.  Other failures are ignored, deletions
+// will be retried the next time we do a resync.
 func (s *IPSets) ApplyDeletions() {
 	s.pendingIPSetDeletions.Iter(func(item interface{}) error {
 		setName := item.(string)
 		logCxt := s.logCxt.WithField("setName", setName)
 		if s.existingIPSetNames.Contains(setName) {
 			logCxt.Info("Deleting IP set.")
-			if err := s.deleteIPSet(setName); err != nil {
+			if err := s.deleteIPSet(setName); err == errIPSetInUse {
+				logCxt.Info("IP set still in use, will retry deletion on next apply.")
+				return nil
+			} else if err != nil {
 				logCxt.WithError(err).Warning("Failed to delete IP set.")
 			}
 		}
@@ -764,10 +796,19 @@ func (s *IPSets) ApplyDeletions() {
 	s.gaugeNumIpsets.Set(float64(len(s.ipSetIDToIPSet)))
 }
 
+// errIPSetInUse is returned by deleteIPSet if the IP set is still referenced; typically by an
+// iptables rule.
+var errIPSetInUse = errors.New("IP set is in use")
+
 func (s *IPSets) deleteIPSet(setName string) error {
 	s.logCxt.WithField("setName", setName).Info("Deleting IP set.")
 	cmd := s.newCmd("ipset", "destroy", string(setName))
 	if output, err := cmd.CombinedOutput(); err != nil {
+		if strings.Contains(string(output), "in use") {
+			// Not a sign that we're out of sync, no need to resync.
+			countNumIPSetDeletionsDeferred.Inc()
+			return errIPSetInUse
+		}
 		s.logCxt.WithError(err).WithFields(log.Fields{
 			"setName": setName,
 			"output":  string(output),
@@ -791,6 +832,50 @@ func (s *IPSets) dumpIPSetsToLog() {
 	s.logCxt.WithField("output", string(output)).Info("Current state of IP sets")
 }
 
+// DumpCacheToLog logs our cached view of each IP set, for debugging.  Members are only
+// counted, since the sets can be large.
+func (s *IPSets) DumpCacheToLog() {
+	var setIDs []string
+	for setID := range s.ipSetIDToIPSet {
+		setIDs = append(setIDs, setID)
+	}
+	sort.Strings(setIDs)
+	for _, setID := range setIDs {
+		ipSet := s.ipSetIDToIPSet[setID]
+		fields := log.Fields{
+			"setID":            setID,
+			"mainName":         ipSet.MainIPSetName,
+			"type":             ipSet.Type,
+			"dirty":            s.dirtyIPSetIDs.Contains(setID),
+			"pendingAdds":      ipSet.pendingAdds.Len(),
+			"pendingDeletions": ipSet.pendingDeletions.Len(),
+		}
+		if ipSet.members != nil {
+			fields["members"] = ipSet.members.Len()
+		}
+		if ipSet.pendingReplace != nil {
+			fields["pendingReplace"] = ipSet.pendingReplace.Len()
+		}
+		s.logCxt.WithFields(fields).Info("Cached state of IP set")
+	}
+	s.logCxt.WithFields(log.Fields{
+		"numIPSets":           len(setIDs),
+		"numExistingIPSets":   s.existingIPSetNames.Len(),
+		"numPendingDeletions": s.pendingIPSetDeletions.Len(),
+		"resyncRequired":      s.resyncRequired,
+	}).Info("Cached state of IP sets")
+}
+
+// deleteIPSetMetrics removes the per-IP set metrics of an IP set that we no longer own so that we
+// don't keep reporting stale values.
+func deleteIPSetMetrics(setName string) {
+	gaugeVecIPSetMembers.DeleteLabelValues(setName)
+	gaugeVecIPSetMaxMembers.DeleteLabelValues(setName)
+	countVecIPSetMemberAdds.DeleteLabelValues(setName)
+	countVecIPSetMemberDeletes.DeleteLabelValues(setName)
+	countVecIPSetRewrites.DeleteLabelValues(setName)
+}
+
 func firstNonNilErr(errs ...error) error {
 	for _, err := range errs {
 		if err != nil {
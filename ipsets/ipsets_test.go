@@ -73,6 +73,50 @@ var _ = Describe("IPSetType", func() {
 		Expect(IPSetTypeHashNet.CanonicaliseMember("feed::beef/24")).
 			To(Equal(ip.MustParseCIDR("feed::/24")))
 	})
+	It("should treat hash:net,port as valid", func() {
+		Expect(IPSetType("hash:net,port").IsValid()).To(BeTrue())
+	})
+	It("should treat hash:ip,port as valid", func() {
+		Expect(IPSetType("hash:ip,port").IsValid()).To(BeTrue())
+	})
+	It("should treat hash:ip,port,net as valid", func() {
+		Expect(IPSetType("hash:ip,port,net").IsValid()).To(BeTrue())
+	})
+	It("should canonicalise a net,port", func() {
+		Expect(IPSetTypeHashNetPort.CanonicaliseMember("10.0.0.1/24,TCP:80")).
+			To(Equal(IPSetTypeHashNetPort.CanonicaliseMember("10.0.0.0/24,tcp:80")))
+		Expect(IPSetTypeHashNetPort.CanonicaliseMember("10.0.0.1/24,udp:53").String()).
+			To(Equal("10.0.0.0/24,udp:53"))
+	})
+	It("should default the protocol of a net,port to TCP", func() {
+		Expect(IPSetTypeHashNetPort.CanonicaliseMember("10.0.0.0/24,80")).
+			To(Equal(IPSetTypeHashNetPort.CanonicaliseMember("10.0.0.0/24,tcp:80")))
+	})
+	It("should canonicalise a net,port with a single-address net as listed by ipset", func() {
+		Expect(IPSetTypeHashNetPort.CanonicaliseMember("10.0.0.1,tcp:80")).
+			To(Equal(IPSetTypeHashNetPort.CanonicaliseMember("10.0.0.1/32,tcp:80")))
+		Expect(IPSetTypeHashNetPort.CanonicaliseMember("feed::1,tcp:80")).
+			To(Equal(IPSetTypeHashNetPort.CanonicaliseMember("feed::1/128,tcp:80")))
+	})
+	It("should canonicalise an ip,port", func() {
+		Expect(IPSetTypeHashIPPort.CanonicaliseMember("10.0.0.1,UDP:53")).
+			To(Equal(IPSetTypeHashIPPort.CanonicaliseMember("10.0.0.1,udp:53")))
+		Expect(IPSetTypeHashIPPort.CanonicaliseMember("feed:0::beef,8080").String()).
+			To(Equal("feed::beef,tcp:8080"))
+	})
+	It("should panic on bad ip,port", func() {
+		Expect(func() { IPSetTypeHashIPPort.CanonicaliseMember("10.0.0.1") }).To(Panic())
+		Expect(func() { IPSetTypeHashIPPort.CanonicaliseMember("10.0.0.0/24,tcp:80") }).To(Panic())
+	})
+	It("should canonicalise an ip,port,net", func() {
+		Expect(IPSetTypeHashIPPortNet.CanonicaliseMember("10.0.0.1,tcp:80,10.1.2.3/16").String()).
+			To(Equal("10.0.0.1,tcp:80,10.1.0.0/16"))
+	})
+	It("should panic on bad net,port", func() {
+		Expect(func() { IPSetTypeHashNetPort.CanonicaliseMember("10.0.0.0/24") }).To(Panic())
+		Expect(func() { IPSetTypeHashNetPort.CanonicaliseMember("10.0.0.0/24,icmp:8") }).To(Panic())
+		Expect(func() { IPSetTypeHashNetPort.CanonicaliseMember("10.0.0.0/24,tcp:foo") }).To(Panic())
+	})
 	It("should panic on bad IP", func() {
 		Expect(func() { IPSetTypeHashIP.CanonicaliseMember("foobar") }).To(Panic())
 	})
@@ -112,6 +156,11 @@ var _ = Describe("IP sets dataplane", func() {
 		SetID:   ipSetID,
 		Type:    IPSetTypeHashNet,
 	}
+	metaNetPorts := IPSetMetadata{
+		MaxSize: 1234,
+		SetID:   ipSetID,
+		Type:    IPSetTypeHashNetPort,
+	}
 	v4VersionConf := NewIPVersionConfig(
 		IPFamilyV4,
 		"cali",
@@ -187,6 +236,42 @@ var _ = Describe("IP sets dataplane", func() {
 		Expect(dataplane.CmdNames).To(BeNil(), "updates should have been no-ops")
 	})
 
+	It("should dump its cache without making any changes", func() {
+		ipsets.AddOrReplaceIPSet(meta, []string{"10.0.0.1", "10.0.0.2"})
+		apply()
+		ipsets.AddMembers(ipSetID, []string{"10.0.0.3"})
+		ipsets.AddOrReplaceIPSet(meta2, []string{"10.0.0.4"})
+		dataplane.CmdNames = nil
+
+		ipsets.DumpCacheToLog()
+
+		Expect(dataplane.CmdNames).To(BeNil())
+		apply()
+		dataplane.ExpectMembers(map[string][]string{
+			v4MainIPSetName:  {"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			v4MainIPSetName2: {"10.0.0.4"},
+		})
+	})
+
+	It("should reject an IP set whose name collides with another IP set", func() {
+		ipsets.AddOrReplaceIPSet(meta, []string{"10.0.0.1"})
+		clashingMeta := meta
+		clashingMeta.SetID = ipSetID[:len(ipSetID)-1] + "e"
+		Expect(func() { ipsets.AddOrReplaceIPSet(clashingMeta, nil) }).To(Panic())
+	})
+
+	It("should allow an IP set name to be reused once the IP set is removed", func() {
+		ipsets.AddOrReplaceIPSet(meta, []string{"10.0.0.1"})
+		ipsets.RemoveIPSet(ipSetID)
+		reusingMeta := meta
+		reusingMeta.SetID = ipSetID[:len(ipSetID)-1] + "e"
+		ipsets.AddOrReplaceIPSet(reusingMeta, []string{"10.0.0.2"})
+		apply()
+		dataplane.ExpectMembers(map[string][]string{
+			v4MainIPSetName: {"10.0.0.2"},
+		})
+	})
+
 	Describe("with left-over IP sets in place", func() {
 		BeforeEach(func() {
 			dataplane.IPSetMembers = map[string]set.Set{
@@ -507,6 +592,29 @@ var _ = Describe("IP sets dataplane", func() {
 		})
 	})
 
+	Describe("with a hash:net,port IP set", func() {
+		BeforeEach(func() {
+			ipsets.AddOrReplaceIPSet(metaNetPorts, []string{"10.1.2.3/16,tcp:80", "10.0.0.1/32,udp:53"})
+			apply()
+		})
+		It("should write canonical form", func() {
+			Expect(dataplane.IPSetMembers[v4MainIPSetName]).
+				To(Equal(set.From("10.1.0.0/16,tcp:80", "10.0.0.1/32,udp:53")))
+		})
+		It("shouldn't do any work on resync", func() {
+			dataplane.CmdNames = nil
+			resyncAndApply()
+			Expect(dataplane.CmdNames).To(ConsistOf("list"))
+		})
+		It("should apply deltas", func() {
+			ipsets.AddMembers(ipSetID, []string{"10.0.0.2,tcp:443"})
+			ipsets.RemoveMembers(ipSetID, []string{"10.0.0.1,udp:53"})
+			apply()
+			Expect(dataplane.IPSetMembers[v4MainIPSetName]).
+				To(Equal(set.From("10.1.0.0/16,tcp:80", "10.0.0.2/32,tcp:443")))
+		})
+	})
+
 	It("remove set before apply should be no-op", func() {
 		// This checks that the dirty flag is set by the remove method.
 		ipsets.AddOrReplaceIPSet(meta, []string{"10.0.0.1", "10.0.0.2"})
@@ -529,6 +637,21 @@ var _ = Describe("IP sets dataplane", func() {
 		resyncAndApply()
 		dataplane.ExpectMembers(map[string][]string{})
 	})
+	It("remove set should be retried on next apply if the set is in use", func() {
+		ipsets.AddOrReplaceIPSet(meta, v4Members1And2)
+		apply()
+
+		dataplane.IPSetsInUse.Add(v4MainIPSetName)
+		ipsets.RemoveIPSet(ipSetID)
+		apply()
+		dataplane.ExpectMembers(map[string][]string{v4MainIPSetName: v4Members1And2})
+
+		dataplane.IPSetsInUse.Discard(v4MainIPSetName)
+		dataplane.CmdNames = nil
+		apply()
+		dataplane.ExpectMembers(map[string][]string{})
+		Expect(dataplane.CmdNames).To(Equal([]string{"destroy"}))
+	})
 	It("cleanup should remove unknown IP sets", func() {
 		staleSet := set.New()
 		staleSet.Add("10.0.0.1")
@@ -48,6 +48,7 @@ func newMockDataplane() *mockDataplane {
 	return &mockDataplane{
 		IPSetMembers:  make(map[string]set.Set),
 		IPSetMetadata: make(map[string]setMetadata),
+		IPSetsInUse:   set.New(),
 	}
 }
 
@@ -61,6 +62,8 @@ type mockDataplane struct {
 	ListOpFailures    []string
 	RestoreOpFailures []string
 	FailNextDestroy   bool
+	// IPSetsInUse contains the names of IP sets that can't be destroyed.
+	IPSetsInUse set.Set
 
 	// Record when various (expected) error cases are hit.
 	TriedToDeleteNonExistent bool
@@ -452,6 +455,10 @@ func (d *destroyCmd) CombinedOutput() ([]byte, error) {
 		d.Dataplane.FailNextDestroy = false
 		return nil, &exec.ExitError{}
 	}
+	if d.Dataplane.IPSetsInUse.Contains(d.SetName) {
+		return []byte("ipset v6.29: Set cannot be destroyed: it is in use by a kernel component"),
+			&exec.ExitError{}
+	}
 	if _, ok := d.Dataplane.IPSetMembers[d.SetName]; ok {
 		// IP set exists.
 		delete(d.Dataplane.IPSetMembers, d.SetName)
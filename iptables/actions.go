@@ -70,6 +70,25 @@ func (g DropAction) String() string {
 	return "Drop"
 }
 
+// RejectAction drops the packet and sends an error back to the sender.  With is the
+// iptables name of the error to send, such as "icmp-port-unreachable" or "tcp-reset"; if it
+// is empty, iptables' default applies.
+type RejectAction struct {
+	With       string
+	TypeReject struct{}
+}
+
+func (g RejectAction) ToFragment() string {
+	if g.With == "" {
+		return "--jump REJECT"
+	}
+	return "--jump REJECT --reject-with " + g.With
+}
+
+func (g RejectAction) String() string {
+	return "Reject:" + g.With
+}
+
 type LogAction struct {
 	Prefix  string
 	TypeLog struct{}
@@ -83,6 +102,25 @@ func (g LogAction) String() string {
 	return "Log"
 }
 
+// NflogAction sends a copy of the packet to userspace via the given NFLOG group.  Unlike
+// LogAction, the packet's contents are available to the listener.
+type NflogAction struct {
+	Group     uint16
+	Prefix    string
+	TypeNflog struct{}
+}
+
+func (n NflogAction) ToFragment() string {
+	if n.Prefix == "" {
+		return fmt.Sprintf("--jump NFLOG --nflog-group %d", n.Group)
+	}
+	return fmt.Sprintf(`--jump NFLOG --nflog-group %d --nflog-prefix "%s"`, n.Group, n.Prefix)
+}
+
+func (n NflogAction) String() string {
+	return fmt.Sprintf("Nflog:%d", n.Group)
+}
+
 type AcceptAction struct {
 	TypeAccept struct{}
 }
@@ -164,6 +202,19 @@ func (c SetMarkAction) String() string {
 	return fmt.Sprintf("Set:%#x", c.Mark)
 }
 
+type SetDSCPAction struct {
+	Value       uint8
+	TypeSetDSCP struct{}
+}
+
+func (c SetDSCPAction) ToFragment() string {
+	return fmt.Sprintf("--jump DSCP --set-dscp %#x", c.Value)
+}
+
+func (c SetDSCPAction) String() string {
+	return fmt.Sprintf("SetDSCP:%#x", c.Value)
+}
+
 type NoTrackAction struct {
 	TypeNoTrack struct{}
 }
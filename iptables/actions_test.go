@@ -29,10 +29,16 @@ var _ = DescribeTable("Actions",
 	Entry("JumpAction", JumpAction{Target: "cali-abcd"}, "--jump cali-abcd"),
 	Entry("ReturnAction", ReturnAction{}, "--jump RETURN"),
 	Entry("DropAction", DropAction{}, "--jump DROP"),
+	Entry("RejectAction", RejectAction{}, "--jump REJECT"),
+	Entry("RejectAction with type", RejectAction{With: "tcp-reset"}, "--jump REJECT --reject-with tcp-reset"),
 	Entry("AcceptAction", AcceptAction{}, "--jump ACCEPT"),
 	Entry("LogAction", LogAction{Prefix: "prefix"}, `--jump LOG --log-prefix "prefix: " --log-level 5`),
+	Entry("NflogAction", NflogAction{Group: 53}, "--jump NFLOG --nflog-group 53"),
+	Entry("NflogAction with prefix", NflogAction{Group: 1, Prefix: "abcd"}, `--jump NFLOG --nflog-group 1 --nflog-prefix "abcd"`),
 	Entry("DNATAction", DNATAction{DestAddr: "10.0.0.1", DestPort: 8081}, "--jump DNAT --to-destination 10.0.0.1:8081"),
 	Entry("MasqAction", MasqAction{}, "--jump MASQUERADE"),
 	Entry("ClearMarkAction", ClearMarkAction{Mark: 0x1000}, "--jump MARK --set-mark 0/0x1000"),
 	Entry("SetMarkAction", SetMarkAction{Mark: 0x1000}, "--jump MARK --set-mark 0x1000/0x1000"),
+	Entry("SetDSCPAction", SetDSCPAction{Value: 0x2e}, "--jump DSCP --set-dscp 0x2e"),
+	Entry("SetDSCPAction zero", SetDSCPAction{Value: 0}, "--jump DSCP --set-dscp 0x0"),
 )
@@ -0,0 +1,126 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// AuditEvent records a single update that a Table made to the dataplane.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Table     string    `json:"table"`
+	IPVersion uint8     `json:"ipVersion"`
+	// Input is the input that we passed to iptables-restore.
+	Input string `json:"input"`
+	// HashesBefore and HashesAfter hold the rule hashes of the chains that the update
+	// touched, before and after the update.  A chain that was created is missing from
+	// HashesBefore; a chain that was deleted maps to nil in HashesAfter.
+	HashesBefore map[string][]string `json:"hashesBefore"`
+	HashesAfter  map[string][]string `json:"hashesAfter"`
+}
+
+// AuditLog keeps a record of the updates that our Tables make to the dataplane.  It holds the
+// most recent events in a fixed-size ring buffer and, optionally, writes every event to an
+// io.Writer as a line of JSON.  It may be shared between Tables, which record their events
+// from their own goroutines.
+type AuditLog struct {
+	lock   sync.Mutex
+	events []AuditEvent
+	next   int
+	full   bool
+
+	out     io.Writer
+	encoder *json.Encoder
+}
+
+// NewAuditLog creates an AuditLog that keeps the most recent size events.  If out is non-nil,
+// each event is also written to it.
+func NewAuditLog(size int, out io.Writer) *AuditLog {
+	if size < 0 {
+		log.WithField("size", size).Panic("Invalid audit log size")
+	}
+	a := &AuditLog{
+		events: make([]AuditEvent, size),
+		out:    out,
+	}
+	if out != nil {
+		a.encoder = json.NewEncoder(out)
+	}
+	return a
+}
+
+// Record adds an event to the log.
+func (a *AuditLog) Record(event AuditEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.events) > 0 {
+		a.events[a.next] = event
+		a.next++
+		if a.next == len(a.events) {
+			a.next = 0
+			a.full = true
+		}
+	}
+	if a.encoder != nil {
+		if err := a.encoder.Encode(event); err != nil {
+			log.WithError(err).Error("Failed to write iptables audit event")
+		}
+	}
+}
+
+// Events returns the events in the ring buffer, oldest first.
+func (a *AuditLog) Events() []AuditEvent {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	events := []AuditEvent{}
+	if a.full {
+		events = append(events, a.events[a.next:]...)
+	}
+	return append(events, a.events[:a.next]...)
+}
+
+// recordAuditEvent records an update that we've just made to the dataplane.  newHashes holds
+// the hashes of the chains that we updated; it must be called before they're stored.
+func (t *Table) recordAuditEvent(input string, newHashes map[string][]string) {
+	if t.auditLog == nil {
+		return
+	}
+	before := map[string][]string{}
+	for chainName := range newHashes {
+		if hashes, ok := t.chainToDataplaneHashes[chainName]; ok {
+			before[chainName] = append([]string(nil), hashes...)
+		}
+	}
+	after := map[string][]string{}
+	for chainName, hashes := range newHashes {
+		after[chainName] = append([]string(nil), hashes...)
+	}
+	t.auditLog.Record(AuditEvent{
+		Time:         t.timeNow(),
+		Table:        t.Name,
+		IPVersion:    t.IPVersion,
+		Input:        input,
+		HashesBefore: before,
+		HashesAfter:  after,
+	})
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/projectcalico/felix/rules"
+)
+
+var _ = Describe("AuditLog", func() {
+	It("should keep only the most recent events", func() {
+		auditLog := NewAuditLog(2, nil)
+		auditLog.Record(AuditEvent{Table: "raw"})
+		Expect(auditLog.Events()).To(HaveLen(1))
+		auditLog.Record(AuditEvent{Table: "nat"})
+		auditLog.Record(AuditEvent{Table: "filter"})
+		events := auditLog.Events()
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Table).To(Equal("nat"))
+		Expect(events[1].Table).To(Equal("filter"))
+	})
+
+	It("should write every event as a line of JSON", func() {
+		var out bytes.Buffer
+		auditLog := NewAuditLog(0, &out)
+		auditLog.Record(AuditEvent{Table: "raw"})
+		auditLog.Record(AuditEvent{Table: "nat"})
+		Expect(auditLog.Events()).To(BeEmpty())
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+		var event AuditEvent
+		Expect(json.Unmarshal([]byte(lines[1]), &event)).To(Succeed())
+		Expect(event.Table).To(Equal("nat"))
+	})
+})
+
+var _ = Describe("Table with an audit log", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var auditLog *AuditLog
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		auditLog = NewAuditLog(10, nil)
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				AuditLog:              auditLog,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+	})
+
+	It("should record the update", func() {
+		events := auditLog.Events()
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Table).To(Equal("filter"))
+		Expect(events[0].IPVersion).To(Equal(uint8(4)))
+		Expect(events[0].Input).To(ContainSubstring("-A cali-foobar "))
+		Expect(events[0].HashesBefore).NotTo(HaveKey("cali-foobar"))
+		Expect(events[0].HashesAfter["cali-foobar"]).To(HaveLen(1))
+	})
+
+	It("should record the before and after hashes of a later update", func() {
+		oldHashes := auditLog.Events()[0].HashesAfter["cali-foobar"]
+		table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: DropAction{}}}})
+		table.Apply()
+		events := auditLog.Events()
+		Expect(events).To(HaveLen(2))
+		Expect(events[1].HashesBefore["cali-foobar"]).To(Equal(oldHashes))
+		Expect(events[1].HashesAfter["cali-foobar"]).NotTo(Equal(oldHashes))
+	})
+
+	It("should not record anything if there's nothing to do", func() {
+		table.Apply()
+		Expect(auditLog.Events()).To(HaveLen(1))
+	})
+})
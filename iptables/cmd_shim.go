@@ -15,11 +15,35 @@
 package iptables
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectcalico/felix/dataplaneexec"
 )
 
+var (
+	countNumCommandTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_command_timeouts",
+		Help: "Number of iptables commands that we killed because they exceeded their timeout.",
+	})
+	countNumReadOnlyLinesSuppressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_read_only_lines_suppressed",
+		Help: "Number of iptables updates that we didn't apply because we're in read-only mode.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(countNumCommandTimeouts)
+	prometheus.MustRegister(countNumReadOnlyLinesSuppressed)
+}
+
 type CmdIface interface {
 	SetStdin(io.Reader)
 	SetStdout(io.Writer)
@@ -36,6 +60,49 @@ func newRealCmd(name string, arg ...string) CmdIface {
 	return (*cmdAdapter)(cmd)
 }
 
+// execCmdFactory returns a cmdFactory that runs the iptables commands as specified by the
+// given options.  In read-only mode, since the Table believes that its updates succeeded, the
+// drift is reported again each time that the Table re-reads the dataplane.
+func execCmdFactory(o dataplaneexec.Options) cmdFactory {
+	return func(name string, arg ...string) CmdIface {
+		return newExecCmd(o, name, arg...)
+	}
+}
+
+func newExecCmd(o dataplaneexec.Options, name string, arg ...string) CmdIface {
+	if o.RenderOnly != nil {
+		return &renderOnlyCmd{name: name, args: arg, out: o.RenderOnly}
+	}
+	var cmd CmdIface
+	cmdName, cmdArgs := o.CommandLine(name, arg)
+	if o.Timeout > 0 {
+		cmd = &timeoutCmd{
+			cmdAdapter: (*cmdAdapter)(exec.Command(cmdName, cmdArgs...)),
+			timeout:    o.Timeout,
+		}
+	} else {
+		cmd = newRealCmd(cmdName, cmdArgs...)
+	}
+	if o.ReadOnly && isRestoreUpdate(name, arg) {
+		return &readOnlyCmd{CmdIface: cmd}
+	}
+	return cmd
+}
+
+// isRestoreUpdate returns true if the command is an ip(6)tables-restore that would modify the
+// dataplane, as opposed to one that only validates its input.
+func isRestoreUpdate(name string, arg []string) bool {
+	if !strings.HasSuffix(name, "-restore") {
+		return false
+	}
+	for _, a := range arg {
+		if a == "--test" {
+			return false
+		}
+	}
+	return true
+}
+
 type cmdAdapter exec.Cmd
 
 func (c *cmdAdapter) SetStdin(r io.Reader) {
@@ -61,3 +128,151 @@ func (c *cmdAdapter) Output() ([]byte, error) {
 func (c *cmdAdapter) String() string {
 	return fmt.Sprintf("%v", (*exec.Cmd)(c))
 }
+
+// timeoutCmd is a cmdAdapter that kills its process if it runs for longer than its timeout.
+type timeoutCmd struct {
+	*cmdAdapter
+	timeout time.Duration
+}
+
+func (c *timeoutCmd) Run() error {
+	// If the command times out, the goroutines that copy its output may still be writing
+	// after we return.  Give the command its own buffers and only pass the output on to the
+	// caller's writers once the command has finished.
+	stdout, stderr := c.Stdout, c.Stderr
+	var stdoutBuf, stderrBuf bytes.Buffer
+	if stdout != nil {
+		c.Stdout = &stdoutBuf
+	}
+	if stderr != nil {
+		c.Stderr = &stderrBuf
+	}
+	finished, err := c.run()
+	if !finished {
+		return err
+	}
+	if stdout != nil {
+		stdoutBuf.WriteTo(stdout)
+	}
+	if stderr != nil {
+		stderrBuf.WriteTo(stderr)
+	}
+	return err
+}
+
+// run runs the command and waits for it to finish or time out.  finished is true if Wait()
+// returned, after which the command's output has been fully written.
+func (c *timeoutCmd) run() (finished bool, err error) {
+	cmd := (*exec.Cmd)(c.cmdAdapter)
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+		finished = true
+		return
+	case <-timer.C:
+		logCxt := log.WithFields(log.Fields{
+			"cmd":     c.String(),
+			"pid":     cmd.Process.Pid,
+			"timeout": c.timeout,
+		})
+		logCxt.Error("Command timed out, killing it")
+		countNumCommandTimeouts.Inc()
+		if err := cmd.Process.Kill(); err != nil {
+			logCxt.WithError(err).Error("Failed to kill timed-out command")
+		}
+		// Note: we don't wait for the Wait() goroutine to finish; if the process left a
+		// child holding its output pipes open, Wait() could block indefinitely.
+		err = fmt.Errorf("command %v timed out after %v", c, c.timeout)
+		return
+	}
+}
+
+func (c *timeoutCmd) Output() ([]byte, error) {
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	finished, err := c.run()
+	if !finished {
+		// The goroutine that copies the command's output may still be writing to the
+		// buffer, so we can't safely read it.
+		return nil, err
+	}
+	return stdout.Bytes(), err
+}
+
+// renderOnlyCmd is a fake command that simulates an empty dataplane.  It captures the input
+// to iptables-restore instead of applying it.
+type renderOnlyCmd struct {
+	name  string
+	args  []string
+	out   io.Writer
+	stdin io.Reader
+}
+
+func (c *renderOnlyCmd) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *renderOnlyCmd) SetStdout(w io.Writer) {}
+
+func (c *renderOnlyCmd) SetStderr(w io.Writer) {}
+
+func (c *renderOnlyCmd) Run() error {
+	if !isRestoreUpdate(c.name, c.args) || c.stdin == nil {
+		return nil
+	}
+	_, err := io.Copy(c.out, c.stdin)
+	return err
+}
+
+func (c *renderOnlyCmd) Output() ([]byte, error) {
+	return nil, c.Run()
+}
+
+func (c *renderOnlyCmd) String() string {
+	return fmt.Sprintf("render-only %s %v", c.name, c.args)
+}
+
+// readOnlyCmd wraps an iptables-restore command.  Rather than running the command, it logs the
+// input, which is the drift between the dataplane and our desired state.
+type readOnlyCmd struct {
+	CmdIface
+	stdin io.Reader
+}
+
+func (c *readOnlyCmd) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *readOnlyCmd) Run() error {
+	if c.stdin == nil {
+		return nil
+	}
+	var input bytes.Buffer
+	if _, err := io.Copy(&input, c.stdin); err != nil {
+		return err
+	}
+	// Don't count the table header and the COMMIT.
+	numLines := strings.Count(input.String(), "\n") - 2
+	if numLines <= 0 {
+		return nil
+	}
+	countNumReadOnlyLinesSuppressed.Add(float64(numLines))
+	log.WithFields(log.Fields{
+		"cmd":      c.String(),
+		"numLines": numLines,
+		"input":    input.String(),
+	}).Warn("Read-only mode: iptables differs from desired state, not applying updates")
+	return nil
+}
+
+func (c *readOnlyCmd) Output() ([]byte, error) {
+	return nil, c.Run()
+}
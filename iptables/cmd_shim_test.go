@@ -0,0 +1,81 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/dataplaneexec"
+)
+
+var _ = Describe("Commands with a timeout", func() {
+	newCmd := execCmdFactory(dataplaneexec.Options{Timeout: 100 * time.Millisecond})
+
+	It("should kill a command that runs for too long", func() {
+		start := time.Now()
+		err := newCmd("sleep", "10").Run()
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("should return the output of a command that finishes in time", func() {
+		out, err := newCmd("echo", "hello").Output()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("hello\n"))
+	})
+
+	It("should pass on the output of a command that finishes in time", func() {
+		var stdout bytes.Buffer
+		cmd := newCmd("echo", "hello")
+		cmd.SetStdout(&stdout)
+		Expect(cmd.Run()).To(Succeed())
+		Expect(stdout.String()).To(Equal("hello\n"))
+	})
+
+	It("should not write to the caller's buffers after a timeout", func() {
+		var stdout bytes.Buffer
+		cmd := newCmd("sh", "-c", "echo hello; sleep 10")
+		cmd.SetStdout(&stdout)
+		Expect(cmd.Run()).NotTo(Succeed())
+		Expect(stdout.Len()).To(BeZero())
+	})
+})
+
+var _ = Describe("Commands in read-only mode", func() {
+	newCmd := execCmdFactory(dataplaneexec.Options{ReadOnly: true})
+
+	It("should run commands that only read the dataplane", func() {
+		out, err := newCmd("echo", "hello").Output()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("hello\n"))
+	})
+
+	It("should not run iptables-restore", func() {
+		cmd := newCmd("iptables-restore", "--noflush", "--verbose")
+		Expect(cmd).To(BeAssignableToTypeOf(&readOnlyCmd{}))
+		cmd.SetStdin(strings.NewReader("*filter\n-A cali-foo -j ACCEPT\nCOMMIT\n"))
+		Expect(cmd.Run()).To(Succeed())
+	})
+
+	It("should still validate with iptables-restore --test", func() {
+		cmd := newCmd("iptables-restore", "--noflush", "--test")
+		Expect(cmd).NotTo(BeAssignableToTypeOf(&readOnlyCmd{}))
+	})
+})
@@ -0,0 +1,76 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// counterRegexp matches an iptables-save -c output line for an append operation, capturing
+// the packet and byte counters.
+var counterRegexp = regexp.MustCompile(`^\[(\d+):(\d+)\] -A \S+`)
+
+// RuleCounters holds the packet and byte counters of a rule.
+type RuleCounters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// ReadRuleCounters reads the counters of our rules from the dataplane, using iptables-save -c.
+// It returns the counters indexed by rule hash; combined with LookupRuleHash, that allows the
+// counters to be attributed to policies.  Rules that we didn't write are skipped.  Unlike the
+// loads that we do before applying updates, it doesn't retry; if iptables-save fails, the
+// caller can try again later.  Like the rest of the Table's methods, it should be called from
+// the same goroutine as Apply().
+func (t *Table) ReadRuleCounters() (map[string]RuleCounters, error) {
+	countNumSaveCalls.Inc()
+	output, err := t.runSave("-c", "-t", t.Name)
+	if err != nil {
+		countNumSaveErrors.Inc()
+		return nil, fmt.Errorf("%s command failed: %v", t.iptablesSaveCmd, err)
+	}
+	return t.getCountersFromBuffer(bytes.NewBuffer(output)), nil
+}
+
+func (t *Table) getCountersFromBuffer(buf *bytes.Buffer) map[string]RuleCounters {
+	counters := map[string]RuleCounters{}
+	for {
+		line, err := buf.ReadString('\n')
+		if err != nil { // EOF
+			break
+		}
+		captures := counterRegexp.FindStringSubmatch(line)
+		if captures == nil {
+			continue
+		}
+		hashCaptures := t.hashCommentRegexp.FindStringSubmatch(line)
+		if hashCaptures == nil {
+			continue
+		}
+		numPackets, err := strconv.ParseUint(captures[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		numBytes, err := strconv.ParseUint(captures[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		counters[hashCaptures[1]] = RuleCounters{Packets: numPackets, Bytes: numBytes}
+	}
+	return counters
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SharedLock allows our Tables to apply their updates in parallel with each other while
+// excluding other processes that use the xtables lock file.
+//
+// The xtables lock is a flock() on a well-known file, taken by the iptables commands to
+// serialise updates between processes.  The kernel keeps each table separate so our own
+// Tables don't need to exclude each other; hence the first Table to call Lock() takes the
+// file lock and subsequent callers share it until the last of them calls Unlock().
+type SharedLock struct {
+	lock           sync.Mutex
+	referenceCount int
+
+	lockFilePath  string
+	lockFile      *os.File
+	timeout       time.Duration
+	probeInterval time.Duration
+
+	// Shims for testing.
+	openFile func(path string) (*os.File, error)
+	flock    func(fd int, how int) error
+	timeNow  func() time.Time
+	sleep    func(time.Duration)
+}
+
+func NewSharedLock(lockFilePath string, timeout, probeInterval time.Duration) *SharedLock {
+	return &SharedLock{
+		lockFilePath:  lockFilePath,
+		timeout:       timeout,
+		probeInterval: probeInterval,
+		openFile: func(path string) (*os.File, error) {
+			return os.OpenFile(path, os.O_CREATE, 0600)
+		},
+		flock:   syscall.Flock,
+		timeNow: time.Now,
+		sleep:   time.Sleep,
+	}
+}
+
+// Lock takes a reference to the lock, acquiring the xtables file lock if we don't already
+// hold it.  It panics if the file lock can't be acquired within the timeout; that is likely
+// to mean that another process is stuck holding the lock.
+func (l *SharedLock) Lock() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.referenceCount == 0 {
+		logCxt := log.WithField("path", l.lockFilePath)
+		f, err := l.openFile(l.lockFilePath)
+		if err != nil {
+			logCxt.WithError(err).Panic("Failed to open iptables lock file")
+		}
+		startTime := l.timeNow()
+		for {
+			err = l.flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err == nil {
+				break
+			}
+			if l.timeNow().Sub(startTime) >= l.timeout {
+				f.Close()
+				logCxt.WithError(err).Panic("Timed out waiting for iptables lock")
+			}
+			logCxt.WithError(err).Debug("iptables lock held by another process, waiting...")
+			l.sleep(l.probeInterval)
+		}
+		logCxt.Debug("Acquired iptables lock")
+		l.lockFile = f
+	}
+	l.referenceCount++
+}
+
+// Unlock releases a reference to the lock, releasing the xtables file lock if this was the
+// last reference.
+func (l *SharedLock) Unlock() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.referenceCount--
+	if l.referenceCount < 0 {
+		log.Panic("Unbalanced iptables lock Unlock() call")
+	}
+	if l.referenceCount == 0 {
+		// Closing the file releases the flock().
+		err := l.lockFile.Close()
+		if err != nil {
+			log.WithError(err).Panic("Failed to release iptables lock")
+		}
+		l.lockFile = nil
+		log.WithField("path", l.lockFilePath).Debug("Released iptables lock")
+	}
+}
+
+// dummyLock is used when locking is disabled.
+type dummyLock struct{}
+
+func (dummyLock) Lock()   {}
+func (dummyLock) Unlock() {}
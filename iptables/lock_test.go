@@ -0,0 +1,76 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var _ = Describe("SharedLock", func() {
+	var dir, path string
+	var lock *SharedLock
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-iptables-lock")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "xtables.lock")
+		lock = NewSharedLock(path, 50*time.Millisecond, time.Millisecond)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	// tryLock tries to take the file lock as another process would, returning whether it
+	// succeeded.
+	tryLock := func() bool {
+		f, err := os.OpenFile(path, os.O_CREATE, 0600)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+		return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+	}
+
+	It("should hold the file lock while any reference is held", func() {
+		lock.Lock()
+		lock.Lock()
+		Expect(tryLock()).To(BeFalse())
+		lock.Unlock()
+		Expect(tryLock()).To(BeFalse())
+		lock.Unlock()
+		Expect(tryLock()).To(BeTrue())
+	})
+
+	It("should time out if another process holds the lock", func() {
+		f, err := os.OpenFile(path, os.O_CREATE, 0600)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+		Expect(syscall.Flock(int(f.Fd()), syscall.LOCK_EX)).To(Succeed())
+		Expect(lock.Lock).To(Panic())
+	})
+
+	It("should panic on an unbalanced Unlock()", func() {
+		Expect(lock.Unlock).To(Panic())
+	})
+})
@@ -89,6 +89,16 @@ func (m MatchCriteria) SrcAddrType(addrType AddrType, limitIfaceOut bool) MatchC
 	}
 }
 
+// IPVSForwarded matches packets in the original direction of an IPVS connection; i.e. packets
+// that IPVS is forwarding to a backend.
+func (m MatchCriteria) IPVSForwarded() MatchCriteria {
+	return append(m, "-m ipvs --ipvs --vdir ORIGINAL")
+}
+
+func (m MatchCriteria) DSCP(value uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-m dscp --dscp %#x", value))
+}
+
 func (m MatchCriteria) ConntrackState(stateNames string) MatchCriteria {
 	return append(m, fmt.Sprintf("-m conntrack --ctstate %s", stateNames))
 }
@@ -117,6 +127,14 @@ func (m MatchCriteria) NotSourceNet(net string) MatchCriteria {
 	return append(m, fmt.Sprintf("! --source %s", net))
 }
 
+func (m MatchCriteria) SourceMAC(mac string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m mac --mac-source %s", mac))
+}
+
+func (m MatchCriteria) NotSourceMAC(mac string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m mac ! --mac-source %s", mac))
+}
+
 func (m MatchCriteria) DestNet(net string) MatchCriteria {
 	return append(m, fmt.Sprintf("--destination %s", net))
 }
@@ -133,14 +151,32 @@ func (m MatchCriteria) NotSourceIPSet(name string) MatchCriteria {
 	return append(m, fmt.Sprintf("-m set ! --match-set %s src", name))
 }
 
+// SourceIPPortSet matches the source IP and port against a hash:ip,port IP set.
+func (m MatchCriteria) SourceIPPortSet(name string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m set --match-set %s src,src", name))
+}
+
+func (m MatchCriteria) NotSourceIPPortSet(name string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m set ! --match-set %s src,src", name))
+}
+
 func (m MatchCriteria) DestIPSet(name string) MatchCriteria {
 	return append(m, fmt.Sprintf("-m set --match-set %s dst", name))
 }
 
+// DestIPPortSet matches the destination IP and port against a hash:ip,port IP set.
+func (m MatchCriteria) DestIPPortSet(name string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m set --match-set %s dst,dst", name))
+}
+
 func (m MatchCriteria) NotDestIPSet(name string) MatchCriteria {
 	return append(m, fmt.Sprintf("-m set ! --match-set %s dst", name))
 }
 
+func (m MatchCriteria) NotDestIPPortSet(name string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m set ! --match-set %s dst,dst", name))
+}
+
 func (m MatchCriteria) SourcePorts(ports ...uint16) MatchCriteria {
 	portsString := PortsToMultiport(ports)
 	return append(m, fmt.Sprintf("-m multiport --source-ports %s", portsString))
@@ -36,6 +36,7 @@ var _ = DescribeTable("MatchBuilder",
 	Entry("MarkClear", Match().MarkClear(0x400a), "-m mark --mark 0/0x400a"),
 	Entry("MarkSet", Match().MarkSet(0x400a), "-m mark --mark 0x400a/0x400a"),
 	// Conntrack.
+	Entry("DSCP", Match().DSCP(46), "-m dscp --dscp 0x2e"),
 	Entry("ConntrackState", Match().ConntrackState("INVALID"), "-m conntrack --ctstate INVALID"),
 	// Interfaces.
 	Entry("InInterface", Match().InInterface("tap1234abcd"), "--in-interface tap1234abcd"),
@@ -45,6 +46,7 @@ var _ = DescribeTable("MatchBuilder",
 	Entry("SrcAddrType no limit iface", Match().SrcAddrType(AddrTypeLocal, false), "-m addrtype --src-type LOCAL"),
 	Entry("NotSrcAddrType limit iface", Match().NotSrcAddrType(AddrTypeLocal, true), "-m addrtype ! --src-type LOCAL --limit-iface-out"),
 	Entry("NotSrcAddrType no limit iface", Match().NotSrcAddrType(AddrTypeLocal, false), "-m addrtype ! --src-type LOCAL"),
+	Entry("IPVSForwarded", Match().IPVSForwarded(), "-m ipvs --ipvs --vdir ORIGINAL"),
 	// Protocol.
 	Entry("Protocol", Match().Protocol("tcp"), "-p tcp"),
 	Entry("NotProtocol", Match().NotProtocol("tcp"), "! -p tcp"),
@@ -53,6 +55,8 @@ var _ = DescribeTable("MatchBuilder",
 	// CIDRs.
 	Entry("SourceNet", Match().SourceNet("10.0.0.4"), "--source 10.0.0.4"),
 	Entry("NotSourceNet", Match().NotSourceNet("10.0.0.4"), "! --source 10.0.0.4"),
+	Entry("SourceMAC", Match().SourceMAC("01:02:03:04:05:06"), "-m mac --mac-source 01:02:03:04:05:06"),
+	Entry("NotSourceMAC", Match().NotSourceMAC("01:02:03:04:05:06"), "-m mac ! --mac-source 01:02:03:04:05:06"),
 	Entry("DestNet", Match().DestNet("10.0.0.4"), "--destination 10.0.0.4"),
 	Entry("NotDestNet", Match().NotDestNet("10.0.0.4"), "! --destination 10.0.0.4"),
 	// IP sets.
@@ -60,6 +64,11 @@ var _ = DescribeTable("MatchBuilder",
 	Entry("NotSourceIPSet", Match().NotSourceIPSet("calits:12345abc-_"), "-m set ! --match-set calits:12345abc-_ src"),
 	Entry("DestIPSet", Match().DestIPSet("calits:12345abc-_"), "-m set --match-set calits:12345abc-_ dst"),
 	Entry("NotDestIPSet", Match().NotDestIPSet("calits:12345abc-_"), "-m set ! --match-set calits:12345abc-_ dst"),
+	Entry("SourceIPPortSet", Match().SourceIPPortSet("calitn:12345abc-_"), "-m set --match-set calitn:12345abc-_ src,src"),
+	Entry("NotSourceIPPortSet", Match().NotSourceIPPortSet("calitn:12345abc-_"), "-m set ! --match-set calitn:12345abc-_ src,src"),
+	Entry("DestIPPortSet", Match().DestIPPortSet("calitn:12345abc-_"), "-m set --match-set calitn:12345abc-_ dst,dst"),
+	Entry("NotDestIPPortSet", Match().NotDestIPPortSet("calitn:12345abc-_"), "-m set ! --match-set calitn:12345abc-_ dst,dst"),
+	Entry("DestIPPortSet", Match().DestIPPortSet("KUBE-CLUSTER-IP"), "-m set --match-set KUBE-CLUSTER-IP dst,dst"),
 	// Ports.
 	Entry("SourcePorts", Match().SourcePorts(1234, 5678), "-m multiport --source-ports 1234,5678"),
 	Entry("NotSourcePorts", Match().NotSourcePorts(1234, 5678), "-m multiport ! --source-ports 1234,5678"),
@@ -18,6 +18,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"hash"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -28,12 +29,145 @@ const (
 	// collision-resistance.  16 chars gives us 96 bits of entropy, which is fairly collision
 	// resistant.
 	HashLength = 16
+
+	HashAlgorithmSHA224 = "sha224"
+	HashAlgorithmSHA256 = "sha256"
+
+	// maxHashDisambiguators limits the number of times we'll try to recalculate a colliding
+	// hash.  Only likely to be hit if the hash length is configured to be very short.
+	maxHashDisambiguators = 100
 )
 
+// DefaultRuleHasher is the RuleHasher used by Chain.RuleHashes().
+var DefaultRuleHasher = RuleHasher{}
+
+// RuleHasher calculates the IDs that we store in a comment on each rule in order to recognise
+// our rules in the dataplane.  The zero value uses SHA-224 and HashLength.
+type RuleHasher struct {
+	// Algorithm is one of the HashAlgorithm... constants.  Defaults to SHA-224.
+	Algorithm string
+	// Length is the number of characters of the encoded hash to use.  Defaults to HashLength.
+	Length int
+	// Seed, if non-empty, is mixed into every hash.  Setting a per-cluster seed makes the
+	// hashes unpredictable.
+	Seed string
+}
+
+// MaxLength returns the maximum hash length that the configured algorithm can support.
+func (h RuleHasher) MaxLength() int {
+	return base64.RawURLEncoding.EncodedLen(h.newHash().Size())
+}
+
+func (h RuleHasher) newHash() hash.Hash {
+	switch h.Algorithm {
+	case "", HashAlgorithmSHA224:
+		return sha256.New224()
+	case HashAlgorithmSHA256:
+		return sha256.New()
+	default:
+		log.WithField("algorithm", h.Algorithm).Panic("Unknown rule hash algorithm")
+		return nil
+	}
+}
+
+// RuleHashes calculates the hashes for the given rules in the given chain.  If isCollision is
+// non-nil, it is called with each candidate hash; if it returns true, the hash is recalculated
+// with a disambiguator mixed in until a hash is found that doesn't collide.
+func (h RuleHasher) RuleHashes(
+	chainName string,
+	rules []Rule,
+	isCollision func(ruleIdx int, hash string) bool,
+) []string {
+	length := h.Length
+	if length == 0 {
+		length = HashLength
+	}
+	hashes := make([]string, len(rules))
+	// First hash the seed and chain name so that identical rules in different chains will get
+	// different hashes.
+	s := h.newHash()
+	s.Write([]byte(h.Seed))
+	s.Write([]byte(chainName))
+	hash := s.Sum(nil)
+	for ii, rule := range rules {
+		// Each hash chains in the previous hash, so that its position in the chain and
+		// the rules before it affect its hash.
+		ruleForHashing := rule.RenderAppend(chainName, "HASH")
+		prevHash := hash
+		for disambiguator := 0; ; disambiguator++ {
+			s.Reset()
+			s.Write(prevHash)
+			s.Write([]byte(ruleForHashing))
+			if disambiguator > 0 {
+				s.Write([]byte(fmt.Sprintf("#%d", disambiguator)))
+			}
+			hash = s.Sum(nil)
+			// Encode the hash using a compact character set.  We use the URL-safe
+			// base64 variant because it uses '-' and '_', which are more
+			// shell-friendly.
+			hashes[ii] = base64.RawURLEncoding.EncodeToString(hash)[:length]
+			if isCollision == nil || !isCollision(ii, hashes[ii]) {
+				break
+			}
+			if disambiguator >= maxHashDisambiguators {
+				log.WithFields(log.Fields{
+					"position": ii,
+					"chain":    chainName,
+					"hash":     hashes[ii],
+				}).Error("Failed to find a non-colliding rule hash; is the hash length too short?")
+				break
+			}
+			log.WithFields(log.Fields{
+				"ruleFragment":  ruleForHashing,
+				"position":      ii,
+				"chain":         chainName,
+				"hash":          hashes[ii],
+				"disambiguator": disambiguator,
+			}).Warn("Rule hash collided with another rule, recalculating")
+		}
+		if log.GetLevel() >= log.DebugLevel {
+			log.WithFields(log.Fields{
+				"ruleFragment": ruleForHashing,
+				"action":       rule.Action,
+				"position":     ii,
+				"chain":        chainName,
+				"hash":         hashes[ii],
+			}).Debug("Hashed rule")
+		}
+	}
+	return hashes
+}
+
 type Rule struct {
 	Match   MatchCriteria
 	Action  Action
 	Comment string
+
+	// Origin, if non-nil, records where the rule came from.  It isn't rendered; the Table
+	// uses it to explain its rule hashes.
+	Origin *RuleOrigin
+}
+
+// RuleOrigin describes the policy or profile rule that an iptables Rule was rendered from.
+type RuleOrigin struct {
+	// Kind is the kind of object that the rule belongs to, such as "Policy" or "Profile".
+	Kind string
+	// Name is the name of the policy or profile.
+	Name string
+	// Direction is "inbound" or "outbound".
+	Direction string
+	// RuleIndex is the 0-indexed position of the rule in the policy's list of rules.
+	RuleIndex int
+	// RuleID is the opaque ID of the rule, if it has one.
+	RuleID string
+}
+
+func (o RuleOrigin) String() string {
+	desc := fmt.Sprintf("%s %s %s rule %d", strings.ToLower(o.Kind), o.Name, o.Direction, o.RuleIndex)
+	if o.RuleID != "" {
+		desc += fmt.Sprintf(" (ID %s)", o.RuleID)
+	}
+	return desc
 }
 
 func (r Rule) RenderAppend(chainName, prefixFragment string) string {
@@ -79,32 +213,5 @@ type Chain struct {
 }
 
 func (c *Chain) RuleHashes() []string {
-	hashes := make([]string, len(c.Rules))
-	// First hash the chain name so that identical rules in different chains will get different
-	// hashes.
-	s := sha256.New224()
-	s.Write([]byte(c.Name))
-	hash := s.Sum(nil)
-	for ii, rule := range c.Rules {
-		// Each hash chains in the previous hash, so that its position in the chain and
-		// the rules before it affect its hash.
-		s.Reset()
-		s.Write(hash)
-		ruleForHashing := rule.RenderAppend(c.Name, "HASH")
-		s.Write([]byte(ruleForHashing))
-		hash = s.Sum(hash[0:0])
-		// Encode the hash using a compact character set.  We use the URL-safe base64
-		// variant because it uses '-' and '_', which are more shell-friendly.
-		hashes[ii] = base64.RawURLEncoding.EncodeToString(hash)[:HashLength]
-		if log.GetLevel() >= log.DebugLevel {
-			log.WithFields(log.Fields{
-				"ruleFragment": ruleForHashing,
-				"action":       rule.Action,
-				"position":     ii,
-				"chain":        c.Name,
-				"hash":         hashes[ii],
-			}).Debug("Hashed rule")
-		}
-	}
-	return hashes
+	return DefaultRuleHasher.RuleHashes(c.Name, c.Rules, nil)
 }
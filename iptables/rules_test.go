@@ -16,6 +16,7 @@ package iptables
 
 import (
 	"bytes"
+	"fmt"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -62,6 +63,75 @@ var _ = Describe("Rule hashing tests", func() {
 	})
 })
 
+var _ = Describe("RuleHasher tests", func() {
+	It("should match Chain.RuleHashes() by default", func() {
+		Expect(RuleHasher{}.RuleHashes("chain", rules3, nil)).To(Equal(calculateHashes("chain", rules3)))
+	})
+	It("should generate different hashes with a seed", func() {
+		hasher := RuleHasher{Seed: "cluster-1"}
+		Expect(hasher.RuleHashes("chain", rules3, nil)).NotTo(Equal(calculateHashes("chain", rules3)))
+	})
+	It("should generate different hashes with SHA-256", func() {
+		hasher := RuleHasher{Algorithm: HashAlgorithmSHA256}
+		Expect(hasher.RuleHashes("chain", rules3, nil)).NotTo(Equal(calculateHashes("chain", rules3)))
+	})
+	It("should respect the configured length", func() {
+		hasher := RuleHasher{Length: 24}
+		hashes := hasher.RuleHashes("chain", rules3, nil)
+		Expect(hashes[0]).To(HaveLen(24))
+		Expect(hashes[0][:HashLength]).To(Equal(calculateHashes("chain", rules3)[0]))
+	})
+	It("should calculate the max length", func() {
+		Expect(RuleHasher{}.MaxLength()).To(Equal(38))
+		Expect(RuleHasher{Algorithm: HashAlgorithmSHA256}.MaxLength()).To(Equal(43))
+	})
+	It("should panic with an unknown algorithm", func() {
+		Expect(func() { RuleHasher{Algorithm: "md5"}.MaxLength() }).To(Panic())
+	})
+	It("should disambiguate a collision", func() {
+		normalHashes := calculateHashes("chain", rules3)
+		hashes := RuleHasher{}.RuleHashes("chain", rules3, func(ruleIdx int, hash string) bool {
+			return hash == normalHashes[0]
+		})
+		Expect(hashes[0]).NotTo(Equal(normalHashes[0]))
+		// Later hashes chain in the earlier ones so they should change too.
+		Expect(hashes[1]).NotTo(Equal(normalHashes[1]))
+	})
+})
+
+var _ = Describe("Table rule hash collision detection", func() {
+	It("should give every rule a distinct hash, even with very short hashes", func() {
+		table := NewTable(
+			"filter",
+			4,
+			"cali:",
+			TableOptions{
+				HistoricChainPrefixes: []string{"cali-"},
+				HashLength:            1,
+			},
+		)
+		var rules []Rule
+		for i := 0; i < 20; i++ {
+			rules = append(rules, Rule{
+				Match:  MatchCriteria{fmt.Sprintf("-m foo --foo %d", i)},
+				Action: AcceptAction{},
+			})
+		}
+		hashes := table.ruleHashes("cali-a", rules)
+		hashes = append(hashes, table.ruleHashes("cali-b", rules)...)
+		seen := map[string]bool{}
+		for _, hash := range hashes {
+			Expect(seen).NotTo(HaveKey(hash))
+			seen[hash] = true
+		}
+	})
+	It("should reject an over-long hash length", func() {
+		Expect(func() {
+			NewTable("filter", 4, "cali:", TableOptions{HashLength: 39})
+		}).To(Panic())
+	})
+})
+
 var _ = Describe("Hash extraction tests", func() {
 	var table *Table
 
@@ -0,0 +1,104 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sort"
+	"time"
+
+	"github.com/projectcalico/felix/set"
+)
+
+// TableSnapshot is a copy of a Table's view of the desired and actual state of the dataplane,
+// for debugging.  It is suitable for serialising as JSON.
+type TableSnapshot struct {
+	Name      string `json:"name"`
+	IPVersion uint8  `json:"ipVersion"`
+	InSync    bool   `json:"inSync"`
+	Degraded  bool   `json:"degraded"`
+
+	// DesiredChains and DesiredInserts hold the rendered rules that we want to program,
+	// indexed by chain name.  DesiredHashes holds the hashes of the rules in DesiredChains.
+	DesiredChains  map[string][]string `json:"desiredChains"`
+	DesiredInserts map[string][]string `json:"desiredInserts"`
+	DesiredHashes  map[string][]string `json:"desiredHashes"`
+	// DataplaneHashes holds the hashes that we found in the dataplane on our most recent
+	// read, with "" for rules that don't belong to us.
+	DataplaneHashes map[string][]string `json:"dataplaneHashes"`
+
+	DirtyChains           []string `json:"dirtyChains"`
+	DirtyInserts          []string `json:"dirtyInserts"`
+	ChainsPendingDeletion []string `json:"chainsPendingDeletion"`
+
+	LastReadTime  time.Time `json:"lastReadTime"`
+	LastWriteTime time.Time `json:"lastWriteTime"`
+}
+
+// Snapshot returns a deep copy of the Table's state.  Like the rest of the Table's methods,
+// it should be called from the same goroutine as Apply().
+func (t *Table) Snapshot() *TableSnapshot {
+	s := &TableSnapshot{
+		Name:            t.Name,
+		IPVersion:       t.IPVersion,
+		InSync:          t.InSync(),
+		Degraded:        t.degraded,
+		DesiredChains:   map[string][]string{},
+		DesiredInserts:  map[string][]string{},
+		DesiredHashes:   copyStringSliceMap(t.chainToHashes),
+		DataplaneHashes: copyStringSliceMap(t.chainToDataplaneHashes),
+		LastReadTime:    t.lastReadTime,
+		LastWriteTime:   t.lastWriteTime,
+	}
+	for chainName, chain := range t.chainNameToChain {
+		s.DesiredChains[chainName] = renderRules(chainName, chain.Rules)
+	}
+	for chainName, rules := range t.chainToInsertedRules {
+		s.DesiredInserts[chainName] = renderRules(chainName, rules)
+	}
+	s.DirtyChains = sortedStrings(t.dirtyChains)
+	s.DirtyInserts = sortedStrings(t.dirtyInserts)
+	for chainName := range t.chainsPendingDeletion {
+		s.ChainsPendingDeletion = append(s.ChainsPendingDeletion, chainName)
+	}
+	sort.Strings(s.ChainsPendingDeletion)
+	return s
+}
+
+func renderRules(chainName string, rules []Rule) []string {
+	rendered := make([]string, len(rules))
+	for i, rule := range rules {
+		rendered[i] = rule.RenderAppend(chainName, "")
+	}
+	return rendered
+}
+
+func copyStringSliceMap(m map[string][]string) map[string][]string {
+	c := make(map[string][]string, len(m))
+	for k, v := range m {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// sortedStrings returns the contents of the given set of strings as a sorted slice.
+func sortedStrings(s set.Set) []string {
+	strs := []string{}
+	s.Iter(func(item interface{}) error {
+		strs = append(strs, item.(string))
+		return nil
+	})
+	sort.Strings(strs)
+	return strs
+}
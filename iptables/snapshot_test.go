@@ -0,0 +1,75 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"encoding/json"
+
+	"github.com/projectcalico/felix/rules"
+)
+
+var _ = Describe("Table snapshots", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}})
+	})
+
+	It("should show dirty chains before Apply()", func() {
+		snapshot := table.Snapshot()
+		Expect(snapshot.InSync).To(BeFalse())
+		Expect(snapshot.DirtyChains).To(Equal([]string{"cali-foobar"}))
+		Expect(snapshot.DesiredChains["cali-foobar"]).To(Equal([]string{
+			"-A cali-foobar --jump ACCEPT",
+		}))
+	})
+
+	It("should show the dataplane hashes after Apply()", func() {
+		table.Apply()
+		snapshot := table.Snapshot()
+		Expect(snapshot.InSync).To(BeTrue())
+		Expect(snapshot.DirtyChains).To(BeEmpty())
+		Expect(snapshot.DesiredHashes["cali-foobar"]).To(HaveLen(1))
+		Expect(snapshot.DataplaneHashes["cali-foobar"]).To(Equal(snapshot.DesiredHashes["cali-foobar"]))
+	})
+
+	It("should serialise as JSON", func() {
+		table.Apply()
+		data, err := json.Marshal(table.Snapshot())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"desiredChains":{"cali-foobar":`))
+	})
+})
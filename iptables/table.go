@@ -19,17 +19,50 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/projectcalico/felix/dataplaneexec"
+	"github.com/projectcalico/felix/hashutils"
 	"github.com/projectcalico/felix/set"
 )
 
 const (
 	MaxChainNameLength = 28
+
+	// shardNameHashLength is the number of characters of hash in a shortened shard name.
+	shardNameHashLength = 8
+
+	// Values for TableOptions.FailureMode, which controls what we do if we repeatedly fail
+	// to program the table or an update fails validation.
+	//
+	// FailureModePanic, the default, panics, allowing a restart to fix the problem.
+	FailureModePanic = "Panic"
+	// FailureModeLeaveUntouched leaves the dataplane as it is and keeps retrying.
+	FailureModeLeaveUntouched = "LeaveUntouched"
+	// FailureModeFailsafeAllow inserts a rule that accepts all traffic at the top of each
+	// of the kernel chains of the filter table.
+	FailureModeFailsafeAllow = "FailsafeAllow"
+	// FailureModeDropAll inserts a rule that drops all traffic at the top of each of the
+	// kernel chains of the filter table.  Note: that includes our own traffic.
+	FailureModeDropAll = "DropAll"
+
+	// failsafeRuleHash is the hash that we put in the comment of the rules that we insert
+	// when we enter a failure mode.  Since it's not a valid rule hash, the rules are cleaned
+	// up like any other stale inserted rule once we recover.
+	failsafeRuleHash = "failsafe"
+	// failsafeRetryInterval is the interval at which we ask to be rescheduled to retry
+	// programming while we're in a failure mode.
+	failsafeRetryInterval = 10 * time.Second
+
+	// restoreErrorContextLines is the number of lines either side of a failed line of
+	// iptables-restore input that we include in the log.
+	restoreErrorContextLines = 3
 )
 
 var (
@@ -46,6 +79,14 @@ var (
 	chainCreateRegexp = regexp.MustCompile(`^:(\S+)`)
 	// appendRegexp matches an iptables-save output line for an append operation.
 	appendRegexp = regexp.MustCompile(`^-A (\S+)`)
+	// restoreErrorLineRegexp matches the part of iptables-restore's error output that
+	// identifies the line of input that it failed to apply.  Older versions of iptables-restore
+	// emit "line N failed", newer versions emit "Error occurred at line: N".
+	restoreErrorLineRegexp = regexp.MustCompile(`(?:line (\d+) failed|Error occurred at line: (\d+))`)
+	// instanceIDRegexp matches the comment on the rule in the instance marker chain,
+	// capturing the instance ID and epoch.  The epoch is missing from markers written by
+	// older versions.
+	instanceIDRegexp = regexp.MustCompile(`Felix instance id=([0-9a-zA-Z]+)(?: epoch=([0-9a-zA-Z]+))?`)
 
 	// Prometheus metrics.
 	countNumRestoreCalls = prometheus.NewCounter(prometheus.CounterOpts{
@@ -56,6 +97,33 @@ var (
 		Name: "felix_iptables_restore_errors",
 		Help: "Number of iptables-restore errors.",
 	})
+	countNumValidationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_validation_errors",
+		Help: "Number of updates rejected by iptables-restore --test.",
+	})
+	countNumFlushesDetected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_flushes_detected",
+		Help: "Number of times the instance marker rule was found to be missing, indicating " +
+			"that another process flushed the table.",
+	})
+	countNumFailureModeActivations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_failure_mode_activations",
+		Help: "Number of times a table entered its failure mode after failing to apply updates.",
+	})
+	countNumResyncsThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_resyncs_throttled",
+		Help: "Number of times a read of the dataplane was deferred due to the minimum " +
+			"resync interval.",
+	})
+	countNumForeignInstanceIDs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_foreign_instance_ids",
+		Help: "Number of times the instance marker chain was found to be overwritten by " +
+			"another instance of Felix.",
+	})
+	countNumHashCollisions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_rule_hash_collisions",
+		Help: "Number of rule hash collisions detected and disambiguated.",
+	})
 	countNumSaveCalls = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "felix_iptables_save_calls",
 		Help: "Number of iptables-save calls.",
@@ -81,6 +149,12 @@ var (
 func init() {
 	prometheus.MustRegister(countNumRestoreCalls)
 	prometheus.MustRegister(countNumRestoreErrors)
+	prometheus.MustRegister(countNumValidationErrors)
+	prometheus.MustRegister(countNumHashCollisions)
+	prometheus.MustRegister(countNumForeignInstanceIDs)
+	prometheus.MustRegister(countNumResyncsThrottled)
+	prometheus.MustRegister(countNumFlushesDetected)
+	prometheus.MustRegister(countNumFailureModeActivations)
 	prometheus.MustRegister(countNumSaveCalls)
 	prometheus.MustRegister(countNumSaveErrors)
 	prometheus.MustRegister(gaugeNumChains)
@@ -189,6 +263,10 @@ type Table struct {
 	// as needed).
 	chainNameToChain map[string]*Chain
 	dirtyChains      set.Set
+	// quarantinedChains contains the names of chains whose updates iptables-restore --test
+	// rejected.  We leave them out of our updates, so that the rest of the table can still be
+	// programmed, until they are next updated.
+	quarantinedChains set.Set
 
 	inSyncWithDataPlane bool
 
@@ -199,6 +277,13 @@ type Table struct {
 
 	// hashCommentPrefix holds the prefix that we prepend to our rule-tracking hashes.
 	hashCommentPrefix string
+	// ruleHasher calculates our rule-tracking hashes.
+	ruleHasher RuleHasher
+	// hashToChain maps from each rule hash that we currently want to program to the chain
+	// that owns it; chainToHashes is the reverse mapping.  We use these to detect hash
+	// collisions between distinct rules.
+	hashToChain   map[string]string
+	chainToHashes map[string][]string
 	// hashCommentRegexp matches the rule-tracking comment, capturing the rule hash.
 	hashCommentRegexp *regexp.Regexp
 	// ourChainsRegexp matches the names of chains that are "ours", i.e. start with one of our
@@ -207,6 +292,7 @@ type Table struct {
 	// oldInsertRegexp matches inserted rules from old pre rule-hash versions of felix.
 	oldInsertRegexp *regexp.Regexp
 
+	iptablesCmd        string
 	iptablesRestoreCmd string
 	iptablesSaveCmd    string
 
@@ -220,6 +306,64 @@ type Table struct {
 	lastWriteTime     time.Time
 	postWriteInterval time.Duration
 	refreshInterval   time.Duration
+	// minResyncInterval is the minimum time between reads of the dataplane; invalidations
+	// that occur within that interval are coalesced into a single read once it expires.
+	minResyncInterval time.Duration
+
+	// chainToReferrers maps from chain name to the set of chains that jump to it, including
+	// the kernel chains that we insert rules into and removed chains that are still in the
+	// dataplane.  chainsPendingDeletion maps from the name of a removed chain that we've yet
+	// to delete from the dataplane to the time it was removed and its rules.
+	chainToReferrers         map[string]set.Set
+	chainsPendingDeletion    map[string]pendingDeletion
+	chainDeletionGracePeriod time.Duration
+
+	// maxChainLength is the maximum number of rules in a chain; chainToShardNames maps from
+	// the name of each logical chain that has been split to the names of its shards.
+	maxChainLength    int
+	chainToShardNames map[string][]string
+	// shardNames records the shard names that we've shortened, to detect collisions.
+	shardNames *hashutils.NameRegistry
+
+	// maxRestoreLines is the maximum number of lines in an iptables-restore transaction, or
+	// 0 for no limit.
+	maxRestoreLines int
+
+	// preValidate is true if we should check updates with iptables-restore --test before
+	// applying them.
+	preValidate bool
+
+	// lock is held around calls to iptables-save and iptables-restore.
+	lock sync.Locker
+
+	// failureMode is one of the FailureModeXXX constants.  degraded is set when we've given
+	// up retrying an update and entered the failure mode; it is cleared by our next
+	// successful update.
+	failureMode string
+	degraded    bool
+
+	// auditLog, if non-nil, receives a record of each update that we make to the dataplane.
+	auditLog *AuditLog
+
+	// Instance marker tracking.  markerChainName is the name of our marker chain, or "" if
+	// disabled.  dataplaneInstanceID and dataplaneEpoch are the ID and epoch that we read
+	// from the dataplane on our most recent load, previousInstanceID is the ID that we found
+	// at start of day and foreignInstanceID and foreignEpoch identify the most recent other
+	// live instance that we've seen.  markerWritten is set once we've written our own marker.
+	markerChainName     string
+	instanceID          string
+	instanceEpoch       string
+	dataplaneInstanceID string
+	dataplaneEpoch      string
+	previousInstanceID  string
+	foreignInstanceID   string
+	foreignEpoch        string
+	markerWritten       bool
+
+	// flushCheckInterval is the interval at which we check for our instance marker rule;
+	// lastFlushCheck is the time of the most recent check.
+	flushCheckInterval time.Duration
+	lastFlushCheck     time.Time
 
 	logCxt *log.Entry
 
@@ -239,6 +383,61 @@ type TableOptions struct {
 	ExtraCleanupRegexPattern string
 	InsertMode               string
 	RefreshInterval          time.Duration
+	// MinResyncInterval, if non-zero, limits how often we re-read the dataplane after the
+	// cache is invalidated.  Reads that are needed to recover from a failed update are not
+	// limited.
+	MinResyncInterval time.Duration
+	// ChainDeletionGracePeriod, if non-zero, is the time that we wait after a chain is removed
+	// before we delete it from the dataplane.  A chain that is still referenced by another
+	// chain is kept until it is no longer referenced.  This avoids failures when an update to
+	// the referring chain arrives in a later Apply() than the removal.
+	ChainDeletionGracePeriod time.Duration
+	// MaxChainLength, if non-zero, is the maximum number of rules that we put in a single
+	// chain.  Longer chains are split into shards.  Must be at least 2.
+	MaxChainLength int
+	// MaxRestoreLines, if non-zero, limits the number of lines in each iptables-restore
+	// transaction; larger updates are split into several transactions.  This bounds the
+	// time that each iptables-restore holds the xtables lock, at the cost of the update as
+	// a whole no longer being atomic.  The update to a single chain is never split.
+	MaxRestoreLines int
+	// PreValidate, if true, causes the Table to check each update with
+	// "iptables-restore --test" before applying it.
+	PreValidate bool
+	// HashAlgorithm, HashLength and HashSeed control how rule hashes are calculated.  See
+	// RuleHasher for the defaults.
+	HashAlgorithm string
+	HashLength    int
+	HashSeed      string
+	// InstanceMarkerChain, if non-empty, is the name of a chain that the Table maintains to
+	// record the InstanceID, which should be unique to this instance of the process and stable
+	// across restarts, and the InstanceEpoch, which should be chosen at random each time the
+	// process starts.  On start up, the Table reads back the ID of the instance that wrote
+	// the existing rules, and, while running, it detects if another instance overwrites the
+	// marker.  The epoch lets us detect that even if the other instance has the same ID.
+	InstanceMarkerChain string
+	InstanceID          string
+	InstanceEpoch       string
+	// FlushCheckInterval, if non-zero, is the interval at which we check that the rule in
+	// the instance marker chain is still present.  That check is much cheaper than a full
+	// read of the table so it can be done frequently, allowing us to quickly detect and repair
+	// a flush of the table by another process.
+	FlushCheckInterval time.Duration
+	// Lock, if non-nil, is held while we run iptables-save and iptables-restore.  It is
+	// typically a SharedLock, which excludes other processes while allowing our Tables to be
+	// applied in parallel.  Holding it around iptables-save prevents us from reading a table
+	// that another process is part way through rewriting.
+	Lock sync.Locker
+
+	// FailureMode controls what we do if we still fail to apply updates after retrying, or if
+	// an update fails validation; one of the FailureModeXXX constants.  Defaults to FailureModePanic.  FailureModeFailsafeAllow
+	// and FailureModeDropAll are only valid for the filter table.
+	FailureMode string
+
+	// AuditLog, if non-nil, receives a record of each update that we make to the dataplane.
+	AuditLog *AuditLog
+
+	// Exec controls how we run iptables-save and iptables-restore.
+	Exec dataplaneexec.Options
 
 	// NewCmdOverride for tests, if non-nil, factory to use instead of the real exec.Command()
 	NewCmdOverride cmdFactory
@@ -291,8 +490,23 @@ func NewTable(
 		log.WithField("insertMode", options.InsertMode).Panic("Unknown insert mode")
 	}
 
+	ruleHasher := RuleHasher{
+		Algorithm: options.HashAlgorithm,
+		Length:    options.HashLength,
+		Seed:      options.HashSeed,
+	}
+	if options.MaxChainLength < 0 || options.MaxChainLength == 1 {
+		log.WithField("maxChainLength", options.MaxChainLength).Panic("Invalid max chain length")
+	}
+	if options.HashLength < 0 || options.HashLength > ruleHasher.MaxLength() {
+		log.WithFields(log.Fields{
+			"hashLength": options.HashLength,
+			"maxLength":  ruleHasher.MaxLength(),
+		}).Panic("Invalid rule hash length")
+	}
+
 	// Allow override of exec.Command() and time.Sleep() for test purposes.
-	newCmd := newRealCmd
+	newCmd := execCmdFactory(options.Exec)
 	if options.NewCmdOverride != nil {
 		newCmd = options.NewCmdOverride
 	}
@@ -304,6 +518,25 @@ func NewTable(
 	if options.NowOverride != nil {
 		now = options.NowOverride
 	}
+	var lock sync.Locker = dummyLock{}
+	if options.Lock != nil {
+		lock = options.Lock
+	}
+	failureMode := options.FailureMode
+	switch failureMode {
+	case "":
+		failureMode = FailureModePanic
+	case FailureModePanic, FailureModeLeaveUntouched:
+	case FailureModeFailsafeAllow, FailureModeDropAll:
+		if name != "filter" {
+			log.WithFields(log.Fields{
+				"table":       name,
+				"failureMode": failureMode,
+			}).Panic("Failure mode is only supported for the filter table")
+		}
+	default:
+		log.WithField("failureMode", failureMode).Panic("Unknown failure mode")
+	}
 
 	table := &Table{
 		Name:                   name,
@@ -312,12 +545,20 @@ func NewTable(
 		dirtyInserts:           dirtyInserts,
 		chainNameToChain:       map[string]*Chain{},
 		dirtyChains:            set.New(),
+		quarantinedChains:      set.New(),
 		chainToDataplaneHashes: map[string][]string{},
+		chainToReferrers:       map[string]set.Set{},
+		chainsPendingDeletion:  map[string]pendingDeletion{},
+		chainToShardNames:      map[string][]string{},
+		shardNames:             hashutils.NewNameRegistry(),
 		logCxt: log.WithFields(log.Fields{
 			"ipVersion": ipVersion,
 			"table":     name,
 		}),
 		hashCommentPrefix: hashPrefix,
+		ruleHasher:        ruleHasher,
+		hashToChain:       map[string]string{},
+		chainToHashes:     map[string][]string{},
 		hashCommentRegexp: hashCommentRegexp,
 		ourChainsRegexp:   ourChainsRegexp,
 		oldInsertRegexp:   oldInsertRegexp,
@@ -330,7 +571,23 @@ func NewTable(
 		lastWriteTime:     now(),
 		postWriteInterval: 50 * time.Millisecond,
 
-		refreshInterval: options.RefreshInterval,
+		refreshInterval:   options.RefreshInterval,
+		minResyncInterval: options.MinResyncInterval,
+		preValidate:       options.PreValidate,
+		lock:              lock,
+		failureMode:       failureMode,
+		auditLog:          options.AuditLog,
+
+		chainDeletionGracePeriod: options.ChainDeletionGracePeriod,
+		maxChainLength:           options.MaxChainLength,
+		maxRestoreLines:          options.MaxRestoreLines,
+
+		markerChainName: options.InstanceMarkerChain,
+		instanceID:      options.InstanceID,
+		instanceEpoch:   options.InstanceEpoch,
+
+		flushCheckInterval: options.FlushCheckInterval,
+		lastFlushCheck:     now(),
 
 		newCmd:    newCmd,
 		timeSleep: sleep,
@@ -342,12 +599,28 @@ func NewTable(
 	}
 
 	if ipVersion == 4 {
+		table.iptablesCmd = "iptables"
 		table.iptablesRestoreCmd = "iptables-restore"
 		table.iptablesSaveCmd = "iptables-save"
 	} else {
+		table.iptablesCmd = "ip6tables"
 		table.iptablesRestoreCmd = "ip6tables-restore"
 		table.iptablesSaveCmd = "ip6tables-save"
 	}
+
+	if table.markerChainName != "" {
+		if table.instanceID == "" || table.instanceEpoch == "" {
+			log.WithField("chain", table.markerChainName).Panic(
+				"Instance marker chain configured without an instance ID and epoch")
+		}
+		table.UpdateChain(&Chain{
+			Name: table.markerChainName,
+			Rules: []Rule{{
+				Action:  ReturnAction{},
+				Comment: table.markerComment(),
+			}},
+		})
+	}
 	return table
 }
 
@@ -355,9 +628,11 @@ func (t *Table) SetRuleInsertions(chainName string, rules []Rule) {
 	t.logCxt.WithField("chainName", chainName).Debug("Updating rule insertions")
 	oldRules := t.chainToInsertedRules[chainName]
 	t.chainToInsertedRules[chainName] = rules
+	t.updateReferences(chainName, oldRules, rules)
 	numRulesDelta := len(rules) - len(oldRules)
 	t.gaugeNumRules.Add(float64(numRulesDelta))
 	t.dirtyInserts.Add(chainName)
+	t.quarantinedChains.Discard(chainName)
 
 	// Defensive: make sure we re-read the dataplane state before we make updates.  While the
 	// code was originally designed not to need this, we found that other users of
@@ -372,22 +647,122 @@ func (t *Table) UpdateChains(chains []*Chain) {
 	}
 }
 
+// UpdateChain queues an update to the given chain.  If the chain is longer than the
+// configured maximum chain length, it is transparently split into shards, which are chained
+// together with gotos.
 func (t *Table) UpdateChain(chain *Chain) {
 	t.logCxt.WithField("chainName", chain.Name).Info("Queueing update of chain.")
+	if len(chain.Name) > MaxChainNameLength {
+		// iptables would reject the whole transaction; catch the bug here where it's
+		// easier to diagnose.  Callers should use hashutils to shorten long names.
+		t.logCxt.WithField("chainName", chain.Name).Panic("Chain name too long")
+	}
+	shards := t.shardChain(chain)
+	var shardNames []string
+	for _, shard := range shards {
+		t.updateShard(shard)
+		shardNames = append(shardNames, shard.Name)
+	}
+	// Clean up any shards that are no longer needed.  The first shard always has the name
+	// of the logical chain.
+	for i, oldName := range t.chainToShardNames[chain.Name] {
+		if _, ok := t.chainNameToChain[oldName]; ok && !containsString(shardNames, oldName) {
+			t.removeShard(oldName)
+			t.shardNames.Unregister(shardFullName(chain.Name, i))
+		}
+	}
+	if len(shards) > 1 {
+		t.chainToShardNames[chain.Name] = shardNames
+	} else {
+		delete(t.chainToShardNames, chain.Name)
+	}
+
+	// Defensive: make sure we re-read the dataplane state before we make updates.  While the
+	// code was originally designed not to need this, we found that other users of
+	// iptables-restore can still clobber out updates so it's safest to re-read the state before
+	// each write.
+	t.InvalidateDataplaneCache("chain update")
+}
+
+// shardChain splits the given chain into shards of at most maxChainLength rules.  Each shard
+// ends with a goto to the next.  Since a goto doesn't push a return frame, a RETURN or the end
+// of any shard returns to the logical chain's caller, giving the same behaviour as the
+// unsharded chain.
+func (t *Table) shardChain(chain *Chain) []*Chain {
+	if t.maxChainLength <= 0 || len(chain.Rules) <= t.maxChainLength {
+		return []*Chain{chain}
+	}
+	var shards []*Chain
+	rules := chain.Rules
+	name := chain.Name
+	for i := 1; len(rules) > t.maxChainLength; i++ {
+		nextName := t.shardChainName(chain.Name, i)
+		shardRules := make([]Rule, t.maxChainLength-1, t.maxChainLength)
+		copy(shardRules, rules)
+		shardRules = append(shardRules, Rule{Action: GotoAction{Target: nextName}})
+		shards = append(shards, &Chain{Name: name, Rules: shardRules})
+		rules = rules[t.maxChainLength-1:]
+		name = nextName
+	}
+	shards = append(shards, &Chain{Name: name, Rules: rules})
+	t.logCxt.WithFields(log.Fields{
+		"chainName": chain.Name,
+		"numRules":  len(chain.Rules),
+		"numShards": len(shards),
+	}).Debug("Split long chain into shards")
+	return shards
+}
+
+// shardChainName returns the name of the n-th shard of the given chain, shortening the
+// name if needed to stay within the maximum length.  A shortened name keeps the start of the
+// chain name, followed by a hash of the rest, so that shards of chains with a common prefix
+// don't collide.  We register the name to make sure of that.
+func (t *Table) shardChainName(chainName string, n int) string {
+	fullName := shardFullName(chainName, n)
+	prefixLen := MaxChainNameLength - 1 - shardNameHashLength
+	if prefixLen > len(chainName) {
+		prefixLen = len(chainName)
+	}
+	name := hashutils.GetLengthLimitedID(fullName[:prefixLen], fullName[prefixLen:], MaxChainNameLength)
+	if err := t.shardNames.Register(fullName, name); err != nil {
+		t.logCxt.WithError(err).Panic("Shortened chain shard name collides with another shard")
+	}
+	return name
+}
+
+func shardFullName(chainName string, n int) string {
+	return fmt.Sprintf("%s~%d", chainName, n)
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// updateShard queues an update to a single chain in the dataplane.
+func (t *Table) updateShard(chain *Chain) {
 	oldNumRules := 0
+	var oldRules []Rule
 	if oldChain := t.chainNameToChain[chain.Name]; oldChain != nil {
 		oldNumRules = len(oldChain.Rules)
+		oldRules = oldChain.Rules
+	}
+	if pending, ok := t.chainsPendingDeletion[chain.Name]; ok {
+		// Reviving a removed chain; its old rules are still in the dataplane and still
+		// hold references.
+		oldRules = pending.rules
+		delete(t.chainsPendingDeletion, chain.Name)
 	}
 	t.chainNameToChain[chain.Name] = chain
+	t.updateReferences(chain.Name, oldRules, chain.Rules)
 	numRulesDelta := len(chain.Rules) - oldNumRules
 	t.gaugeNumRules.Add(float64(numRulesDelta))
 	t.dirtyChains.Add(chain.Name)
-
-	// Defensive: make sure we re-read the dataplane state before we make updates.  While the
-	// code was originally designed not to need this, we found that other users of
-	// iptables-restore can still clobber out updates so it's safest to re-read the state before
-	// each write.
-	t.InvalidateDataplaneCache("chain update")
+	t.quarantinedChains.Discard(chain.Name)
 }
 
 func (t *Table) RemoveChains(chains []*Chain) {
@@ -398,10 +773,16 @@ func (t *Table) RemoveChains(chains []*Chain) {
 
 func (t *Table) RemoveChainByName(name string) {
 	t.logCxt.WithField("chainName", name).Info("Queing deletion of chain.")
-	if oldChain, known := t.chainNameToChain[name]; known {
-		t.gaugeNumRules.Sub(float64(len(oldChain.Rules)))
-		delete(t.chainNameToChain, name)
-		t.dirtyChains.Add(name)
+	if shardNames, ok := t.chainToShardNames[name]; ok {
+		for i, shardName := range shardNames {
+			t.removeShard(shardName)
+			if i > 0 {
+				t.shardNames.Unregister(shardFullName(name, i))
+			}
+		}
+		delete(t.chainToShardNames, name)
+	} else {
+		t.removeShard(name)
 	}
 
 	// Defensive: make sure we re-read the dataplane state before we make updates.  While the
@@ -411,16 +792,129 @@ func (t *Table) RemoveChainByName(name string) {
 	t.InvalidateDataplaneCache("chain removal")
 }
 
-func (t *Table) loadDataplaneState() {
+// removeShard queues the removal of a single chain from the dataplane.
+func (t *Table) removeShard(name string) {
+	t.quarantinedChains.Discard(name)
+	if oldChain, known := t.chainNameToChain[name]; known {
+		t.gaugeNumRules.Sub(float64(len(oldChain.Rules)))
+		delete(t.chainNameToChain, name)
+		t.releaseRuleHashes(name)
+		if t.chainDeletionGracePeriod > 0 {
+			// Leave the chain in the dataplane for now, we'll delete it once the grace
+			// period expires.  Until then, its rules still jump to other chains so we
+			// keep its references; otherwise we could delete one of its targets first.
+			t.chainsPendingDeletion[name] = pendingDeletion{
+				removedAt: t.timeNow(),
+				rules:     oldChain.Rules,
+			}
+		} else {
+			t.updateReferences(name, oldChain.Rules, nil)
+			t.dirtyChains.Add(name)
+		}
+	}
+}
+
+// updateReferences updates the index of chain references after the rules of the given chain
+// change from oldRules to newRules.
+func (t *Table) updateReferences(chainName string, oldRules, newRules []Rule) {
+	for _, target := range ruleTargets(oldRules) {
+		referrers := t.chainToReferrers[target]
+		if referrers == nil {
+			continue
+		}
+		referrers.Discard(chainName)
+		if referrers.Len() == 0 {
+			delete(t.chainToReferrers, target)
+		}
+	}
+	for _, target := range ruleTargets(newRules) {
+		referrers := t.chainToReferrers[target]
+		if referrers == nil {
+			referrers = set.New()
+			t.chainToReferrers[target] = referrers
+		}
+		referrers.Add(chainName)
+	}
+}
+
+// ruleTargets returns the chains that the given rules jump or goto.
+func ruleTargets(rules []Rule) (targets []string) {
+	for _, rule := range rules {
+		switch action := rule.Action.(type) {
+		case JumpAction:
+			targets = append(targets, action.Target)
+		case GotoAction:
+			targets = append(targets, action.Target)
+		}
+	}
+	return
+}
+
+// pendingDeletion records a removed chain that we're keeping in the dataplane until its
+// deletion grace period expires.
+type pendingDeletion struct {
+	removedAt time.Time
+	// rules are the chain's rules, which are still in the dataplane.
+	rules []Rule
+}
+
+// deleteExpiredChains queues the deletion of any removed chains whose grace period has
+// expired and that are no longer referenced.  It returns the time until the next grace period
+// expires, or 0 if there are no other chains waiting.
+func (t *Table) deleteExpiredChains(now time.Time) (nextExpiry time.Duration) {
+	// Deleting a chain drops its references, which may free up another expired chain that
+	// it jumps to, so we keep going until we make no more progress.
+	for progress := true; progress; {
+		progress = false
+		nextExpiry = 0
+		for chainName, pending := range t.chainsPendingDeletion {
+			logCxt := t.logCxt.WithField("chainName", chainName)
+			untilExpiry := pending.removedAt.Add(t.chainDeletionGracePeriod).Sub(now)
+			if untilExpiry > 0 {
+				if nextExpiry == 0 || untilExpiry < nextExpiry {
+					nextExpiry = untilExpiry
+				}
+				continue
+			}
+			if referrers := t.chainToReferrers[chainName]; referrers != nil {
+				logCxt.WithField("referrers", referrers).Debug(
+					"Grace period expired but chain is still referenced, keeping it")
+				continue
+			}
+			logCxt.Info("Grace period expired, queueing deletion of chain.")
+			delete(t.chainsPendingDeletion, chainName)
+			t.updateReferences(chainName, pending.rules, nil)
+			t.dirtyChains.Add(chainName)
+			progress = true
+		}
+	}
+	return
+}
+
+// loadDataplaneState reads the dataplane and marks any chains that differ from our cache as dirty.
+// It only returns an error if iptables-save keeps failing and our failure mode isn't
+// FailureModePanic.
+func (t *Table) loadDataplaneState() error {
 	// Load the hashes from the dataplane.
 	t.logCxt.Info("Loading current iptables state and checking it is correct.")
 	t.lastReadTime = t.timeNow()
-	dataplaneHashes := t.getHashesFromDataplane()
+	dataplaneHashes, err := t.getHashesFromDataplane()
+	if err != nil {
+		return err
+	}
+	if t.markerChainName != "" {
+		t.checkInstanceID()
+	}
 
 	// Check that the rules we think we've programmed are still there and mark any inconsistent
 	// chains for refresh.
 	for chainName, expectedHashes := range t.chainToDataplaneHashes {
 		logCxt := t.logCxt.WithField("chainName", chainName)
+		if _, ok := t.chainsPendingDeletion[chainName]; ok {
+			// Removed chain that we're keeping until its grace period expires.
+			logCxt.Debug("Skipping chain that is pending deletion")
+			continue
+		}
 		if t.dirtyChains.Contains(chainName) || t.dirtyInserts.Contains(chainName) {
 			// Already an update pending for this chain; no point in flagging it as
 			// out-of-sync.
@@ -487,6 +981,10 @@ func (t *Table) loadDataplaneState() {
 			logCxt.Debug("Skipping expected chain")
 			continue
 		}
+		if _, ok := t.chainsPendingDeletion[chainName]; ok {
+			logCxt.Debug("Skipping chain that is pending deletion")
+			continue
+		}
 		if !t.ourChainsRegexp.MatchString(chainName) {
 			// Non-calico chain that is not tracked in chainToDataplaneHashes. We
 			// haven't seen the chain before and we haven't been asked to insert
@@ -509,6 +1007,7 @@ func (t *Table) loadDataplaneState() {
 	t.logCxt.Debug("Finished loading iptables state")
 	t.chainToDataplaneHashes = dataplaneHashes
 	t.inSyncWithDataPlane = true
+	return nil
 }
 
 // expectedHashesForInsertChain calculates the expected hashes for a whole top-level chain
@@ -521,7 +1020,7 @@ func (t *Table) expectedHashesForInsertChain(
 ) (allHashes, ourHashes []string) {
 	insertedRules := t.chainToInsertedRules[chainName]
 	allHashes = make([]string, len(insertedRules)+numNonCalicoRules)
-	ourHashes = calculateRuleInsertHashes(chainName, insertedRules)
+	ourHashes = t.ruleHashes(chainName, insertedRules)
 	offset := 0
 	if t.insertMode == "append" {
 		log.Debug("In append mode, returning our hashes at end.")
@@ -536,16 +1035,16 @@ func (t *Table) expectedHashesForInsertChain(
 // getHashesFromDataplane loads the current state of our table and parses out the hashes that we
 // add to rules.  It returns a map with an entry for each chain in the table.  Each entry is a slice
 // containing the hashes for the rules in that table.  Rules with no hashes are represented by
-// an empty string.
-func (t *Table) getHashesFromDataplane() map[string][]string {
+// an empty string.  If the read still fails after retries, it panics in FailureModePanic and
+// returns an error otherwise.
+func (t *Table) getHashesFromDataplane() (map[string][]string, error) {
 	retries := 3
 	retryDelay := 100 * time.Millisecond
-	// Retry a few times before we panic.  This deals with any transient errors and it prevents
+	// Retry a few times before we give up.  This deals with any transient errors and it prevents
 	// us from spamming a panic into the log when we're being gracefully shut down by a SIGTERM.
 	for {
-		cmd := t.newCmd(t.iptablesSaveCmd, "-t", t.Name)
 		countNumSaveCalls.Inc()
-		output, err := cmd.Output()
+		output, err := t.runSave("-t", t.Name)
 		if err != nil {
 			countNumSaveErrors.Inc()
 			t.logCxt.WithError(err).Warnf("%s command failed", t.iptablesSaveCmd)
@@ -553,16 +1052,29 @@ func (t *Table) getHashesFromDataplane() map[string][]string {
 				retries--
 				t.timeSleep(retryDelay)
 				retryDelay *= 2
-			} else {
+			} else if t.failureMode == FailureModePanic {
 				t.logCxt.Panicf("%s command failed after retries", t.iptablesSaveCmd)
+			} else {
+				t.logCxt.WithError(err).Errorf("%s command failed after retries", t.iptablesSaveCmd)
+				return nil, err
 			}
 			continue
 		}
 		buf := bytes.NewBuffer(output)
-		return t.getHashesFromBuffer(buf)
+		return t.getHashesFromBuffer(buf), nil
 	}
 }
 
+// runSave runs iptables-save with the given arguments while holding the lock, returning its
+// output.  iptables-save doesn't take the xtables lock itself so, without ours, it can see a
+// partially-applied update from another process.
+func (t *Table) runSave(args ...string) ([]byte, error) {
+	cmd := t.newCmd(t.iptablesSaveCmd, args...)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return cmd.Output()
+}
+
 // getHashesFromBuffer parses a buffer containing iptables-save output for this table, extracting
 // our rule hashes.  Entries in the returned map are indexed by chain name.  For rules that we
 // wrote, the hash is extracted from a comment that we added to the rule.  For rules written by
@@ -571,6 +1083,8 @@ func (t *Table) getHashesFromDataplane() map[string][]string {
 // whether written by Felix or not.
 func (t *Table) getHashesFromBuffer(buf *bytes.Buffer) map[string][]string {
 	newHashes := map[string][]string{}
+	t.dataplaneInstanceID = ""
+	t.dataplaneEpoch = ""
 	for {
 		// Read the next line of the output.
 		line, err := buf.ReadString('\n')
@@ -601,6 +1115,17 @@ func (t *Table) getHashesFromBuffer(buf *bytes.Buffer) map[string][]string {
 		}
 		chainName := captures[1]
 
+		if chainName == t.markerChainName {
+			if captures := instanceIDRegexp.FindStringSubmatch(line); captures != nil {
+				t.dataplaneInstanceID = captures[1]
+				t.dataplaneEpoch = captures[2]
+				logCxt.WithFields(log.Fields{
+					"id":    t.dataplaneInstanceID,
+					"epoch": t.dataplaneEpoch,
+				}).Debug("Found instance ID")
+			}
+		}
+
 		// Look for one of our hashes on the rule.  We record a zero hash for unknown rules
 		// so that they get cleaned up.  Note: we're implicitly capturing the first match
 		// of the regex.  When writing the rules, we ensure that the hash is written as the
@@ -623,6 +1148,92 @@ func (t *Table) getHashesFromBuffer(buf *bytes.Buffer) map[string][]string {
 	return newHashes
 }
 
+// checkInstanceID compares the instance ID and epoch that we just read from the instance
+// marker chain with our own.  Before we've written our own marker, the ID tells us who wrote
+// the rules that we're about to adopt: our own ID means a previous run of this instance; a
+// different ID means another instance of Felix (or this one, if it has lost its persisted ID).
+// After that, a different ID or epoch means that another live instance of Felix has
+// overwritten our marker, and the two instances will fight over the dataplane.  The epoch
+// catches a second instance that shares our persisted ID, for example, an old process that is
+// still running during an upgrade.  In that case, we log and count the occurrence and then
+// reassert our marker along with any other chains that the other instance has modified.
+func (t *Table) checkInstanceID() {
+	if t.dataplaneInstanceID == "" {
+		return
+	}
+	logCxt := t.logCxt.WithFields(log.Fields{
+		"ourID":      t.instanceID,
+		"ourEpoch":   t.instanceEpoch,
+		"otherID":    t.dataplaneInstanceID,
+		"otherEpoch": t.dataplaneEpoch,
+	})
+	if !t.markerWritten {
+		if t.previousInstanceID == "" {
+			if t.dataplaneInstanceID == t.instanceID {
+				logCxt.Info("Found rules written by a previous run of this instance, adopting them.")
+			} else {
+				logCxt.Warn("Found rules written by a different instance of Felix, taking them over.")
+			}
+			t.previousInstanceID = t.dataplaneInstanceID
+		}
+		return
+	}
+	if t.dataplaneInstanceID == t.instanceID && t.dataplaneEpoch == t.instanceEpoch {
+		return
+	}
+	if t.dataplaneInstanceID != t.foreignInstanceID || t.dataplaneEpoch != t.foreignEpoch {
+		logCxt.Warn("Instance marker chain was overwritten; is another instance of " +
+			"Felix running on this host?")
+	}
+	t.foreignInstanceID = t.dataplaneInstanceID
+	t.foreignEpoch = t.dataplaneEpoch
+	countNumForeignInstanceIDs.Inc()
+}
+
+func (t *Table) markerComment() string {
+	return "Felix instance id=" + t.instanceID + " epoch=" + t.instanceEpoch
+}
+
+// markerRulePresent uses "iptables -S" to check that our instance marker rule is present in
+// the dataplane.  Listing a single chain is much cheaper than iptables-save and parsing its
+// output.
+func (t *Table) markerRulePresent() bool {
+	cmd := t.newCmd(t.iptablesCmd, "-t", t.Name, "-S", t.markerChainName)
+	output, err := cmd.Output()
+	if err != nil {
+		t.logCxt.WithError(err).Warn("Failed to list instance marker chain")
+		return false
+	}
+	return strings.Contains(string(output), t.markerComment())
+}
+
+// PreviousInstanceID returns the ID of the instance of Felix that wrote the rules that we
+// found at start of day, as read from the instance marker chain, or "" if there was none.  It
+// is our own ID if the rules were written by a previous run of this instance.
+func (t *Table) PreviousInstanceID() string {
+	return t.previousInstanceID
+}
+
+// ForeignInstanceID returns the ID of the most recent instance of Felix that we've
+// seen overwrite our instance marker chain while we were running, or "" if there was none.
+// It may be our own ID if the other instance shares our persisted ID.
+func (t *Table) ForeignInstanceID() string {
+	return t.foreignInstanceID
+}
+
+// SetRefreshInterval changes the interval after which we re-read the table from the dataplane
+// to check for changes made by other processes.  A zero interval disables the periodic refresh.
+func (t *Table) SetRefreshInterval(interval time.Duration) {
+	t.refreshInterval = interval
+}
+
+// InSync returns true if the most recent Apply() left no updates outstanding and we believe
+// that the dataplane matches our state.  A table with quarantined chains is never in sync.
+func (t *Table) InSync() bool {
+	return t.inSyncWithDataPlane && t.dirtyChains.Len() == 0 && t.dirtyInserts.Len() == 0 &&
+		t.quarantinedChains.Len() == 0
+}
+
 func (t *Table) InvalidateDataplaneCache(reason string) {
 	logCxt := t.logCxt.WithField("reason", reason)
 	if !t.inSyncWithDataPlane {
@@ -644,6 +1255,24 @@ func (t *Table) Apply() (rescheduleAfter time.Duration) {
 		t.InvalidateDataplaneCache("refresh timer")
 		invalidated = true
 	}
+	// If it's time, do a quick check that our marker rule is still there.  If it has gone,
+	// another process has probably flushed the table; we do a full read right away, without
+	// waiting for the minimum resync interval.
+	flushDetected := false
+	nextChainExpiry := t.deleteExpiredChains(now)
+	if t.flushCheckInterval > 0 && t.markerWritten && t.inSyncWithDataPlane &&
+		now.Sub(t.lastFlushCheck) >= t.flushCheckInterval {
+
+		t.lastFlushCheck = now
+		if !t.markerRulePresent() {
+			t.logCxt.Warn("Instance marker rule is missing; table may have been flushed " +
+				"by another process.")
+			countNumFlushesDetected.Inc()
+			t.InvalidateDataplaneCache("marker rule missing")
+			invalidated = true
+			flushDetected = true
+		}
+	}
 	// To workaround the possibility of another process clobbering our updates, we refresh the
 	// dataplane after we do a write at exponentially increasing intervals.  We do a refresh
 	// if the delta from the last write to now is twice the delta from the last read.
@@ -673,14 +1302,58 @@ func (t *Table) Apply() (rescheduleAfter time.Duration) {
 	retries := 10
 	backoffTime := 1 * time.Millisecond
 	failedAtLeastOnce := false
+	var resyncDeferredFor time.Duration
 	for {
 		if !t.inSyncWithDataPlane {
 			// We have reason to believe that our picture of the dataplane is out of
-			// sync.  Refresh it.  This may mark more chains as dirty.
-			t.loadDataplaneState()
+			// sync.  Refresh it, unless we did so very recently, in which case we defer
+			// the read and go ahead with our cached state.  If the cache really is out of
+			// date then the update may fail, and we'll then read the dataplane before
+			// retrying.
+			sinceLastRead := t.timeNow().Sub(t.lastReadTime)
+			if !failedAtLeastOnce && !flushDetected && sinceLastRead < t.minResyncInterval {
+				resyncDeferredFor = t.minResyncInterval - sinceLastRead
+				t.logCxt.WithField("delay", resyncDeferredFor).Debug(
+					"Deferring dataplane read, too soon since the last one")
+				countNumResyncsThrottled.Inc()
+			} else {
+				// This may mark more chains as dirty.
+				if err := t.loadDataplaneState(); err != nil {
+					// We can't read the dataplane so there's no point trying to
+					// write to it.
+					t.enterFailureMode(err)
+					break
+				}
+				resyncDeferredFor = 0
+			}
 		}
 
 		if err := t.applyUpdates(); err != nil {
+			valErr, isValidationErr := err.(validationError)
+			_, isUnknownChainErr := err.(unknownChainError)
+			if isValidationErr && valErr.chain != "" && !t.quarantinedChains.Contains(valErr.chain) {
+				// iptables-restore --test told us which chain is at fault.  Set it
+				// aside and try again without it so that one bad chain doesn't block
+				// updates to the rest of the table.  Each pass quarantines another
+				// chain so this terminates.
+				t.logCxt.WithError(err).WithField("chainName", valErr.chain).Error(
+					"Update to chain failed validation, quarantining it until it is updated")
+				t.quarantinedChains.Add(valErr.chain)
+				continue
+			}
+			if isValidationErr || isUnknownChainErr {
+				// Either iptables-restore --test rejected our update without telling
+				// us which chain is at fault or we found a reference to an unknown
+				// chain.  Retrying immediately won't help since the input is at
+				// fault so we go straight to our failure mode.  The table is left
+				// dirty so that we try again on the next Apply().
+				t.logCxt.WithError(err).Error("Update failed validation")
+				if t.failureMode == FailureModePanic {
+					t.logCxt.WithError(err).Panic("Update failed validation, giving up")
+				}
+				t.enterFailureMode(err)
+				break
+			}
 			if retries > 0 {
 				retries--
 				t.logCxt.WithError(err).Warn("Failed to program iptables, will retry")
@@ -691,19 +1364,26 @@ func (t *Table) Apply() (rescheduleAfter time.Duration) {
 				continue
 			} else {
 				t.logCxt.WithError(err).Error("Failed to program iptables, loading diags before panic.")
-				cmd := t.newCmd(t.iptablesSaveCmd, "-t", t.Name)
-				output, err2 := cmd.Output()
+				output, err2 := t.runSave("-t", t.Name)
 				if err2 != nil {
 					t.logCxt.WithError(err2).Error("Failed to load iptables state")
 				} else {
 					t.logCxt.WithField("iptablesState", string(output)).Error("Current state of iptables")
 				}
-				t.logCxt.WithError(err).Panic("Failed to program iptables, giving up after retries")
+				if t.failureMode == FailureModePanic {
+					t.logCxt.WithError(err).Panic("Failed to program iptables, giving up after retries")
+				}
+				t.enterFailureMode(err)
+				break
 			}
 		}
 		if failedAtLeastOnce {
 			t.logCxt.Warn("Succeeded after retry.")
 		}
+		if t.degraded {
+			t.logCxt.Info("Successfully programmed iptables, leaving failure mode.")
+			t.degraded = false
+		}
 		break
 	}
 
@@ -723,76 +1403,194 @@ func (t *Table) Apply() (rescheduleAfter time.Duration) {
 			rescheduleAfter = postWriteReched
 		}
 	}
+	if resyncDeferredFor > 0 && (rescheduleAfter <= 0 || resyncDeferredFor < rescheduleAfter) {
+		// Make sure we come back to do the read that we deferred.
+		rescheduleAfter = resyncDeferredFor
+	}
+	if nextChainExpiry > 0 && (rescheduleAfter <= 0 || nextChainExpiry < rescheduleAfter) {
+		// Come back to delete the chain whose grace period expires next.
+		rescheduleAfter = nextChainExpiry
+	}
+	if t.degraded && (rescheduleAfter <= 0 || failsafeRetryInterval < rescheduleAfter) {
+		// Keep trying to get out of the failure mode.
+		rescheduleAfter = failsafeRetryInterval
+	}
+	if t.flushCheckInterval > 0 && t.markerWritten {
+		flushCheckResched := t.lastFlushCheck.Add(t.flushCheckInterval).Sub(now)
+		if flushCheckResched <= 0 {
+			flushCheckResched = 1 * time.Millisecond
+		}
+		if rescheduleAfter <= 0 || flushCheckResched < rescheduleAfter {
+			rescheduleAfter = flushCheckResched
+		}
+	}
 
 	return
 }
 
-func (t *Table) applyUpdates() error {
+// HasPendingChainDeletions returns true if there are chains that we've removed but not yet
+// deleted from the dataplane, for example, because they're within their deletion grace period.
+// The rules in such chains may still reference IP sets.
+func (t *Table) HasPendingChainDeletions() bool {
+	return len(t.chainsPendingDeletion) > 0
+}
+
+// Degraded returns true if the Table has given up on an update and entered its failure mode.
+// It keeps retrying the update on each call to Apply().
+func (t *Table) Degraded() bool {
+	return t.degraded
+}
+
+// enterFailureMode is called when we've run out of retries or when an update fails validation.
+// It puts the dataplane into the state required by our failure mode, as best it can.
+func (t *Table) enterFailureMode(err error) {
+	logCxt := t.logCxt.WithField("failureMode", t.failureMode)
+	if !t.degraded {
+		logCxt.WithError(err).Error("Failed to program iptables, entering failure mode")
+		countNumFailureModeActivations.Inc()
+	}
+	t.degraded = true
+	// Make sure that we re-read the dataplane on the next attempt.
+	t.InvalidateDataplaneCache("failure mode")
+
+	var failsafeRule Rule
+	switch t.failureMode {
+	case FailureModeFailsafeAllow:
+		failsafeRule = Rule{Action: AcceptAction{}, Comment: "Failsafe: failed to program iptables"}
+	case FailureModeDropAll:
+		failsafeRule = Rule{Action: DropAction{}, Comment: "Failsafe: failed to program iptables"}
+	default:
+		return
+	}
+
+	// Insert the failsafe rule directly, bypassing our normal cache, which is out of sync.
 	var inputBuf bytes.Buffer
-	// iptables-restore input starts with a line indicating the table name.
-	tableNameLine := fmt.Sprintf("*%s\n", t.Name)
-	inputBuf.WriteString(tableNameLine)
+	inputBuf.WriteString(fmt.Sprintf("*%s\n", t.Name))
+	for _, chainName := range tableToKernelChains[t.Name] {
+		if containsString(t.chainToDataplaneHashes[chainName], failsafeRuleHash) {
+			// Already inserted by a previous attempt.
+			continue
+		}
+		inputBuf.WriteString(failsafeRule.RenderInsert(chainName, t.commentFrag(failsafeRuleHash)))
+		inputBuf.WriteString("\n")
+	}
+	inputBuf.WriteString("COMMIT\n")
+	input := inputBuf.String()
+	logCxt.WithField("iptablesInput", input).Debug("Writing failsafe rules to iptables")
+
+	var outputBuf, errBuf bytes.Buffer
+	cmd := t.newCmd(t.iptablesRestoreCmd, "--noflush", "--verbose")
+	cmd.SetStdin(&inputBuf)
+	cmd.SetStdout(&outputBuf)
+	cmd.SetStderr(&errBuf)
+	countNumRestoreCalls.Inc()
+	t.lock.Lock()
+	err = cmd.Run()
+	t.lock.Unlock()
+	if err != nil {
+		logCxt.WithError(err).WithFields(log.Fields{
+			"output":      outputBuf.String(),
+			"errorOutput": errBuf.String(),
+		}).Error("Failed to write failsafe rules to iptables")
+		countNumRestoreErrors.Inc()
+		return
+	}
+	t.recordAuditEvent(input, nil)
+	logCxt.Warn("Wrote failsafe rules to iptables")
+}
+
+func (t *Table) applyUpdates() error {
+	if err := t.checkChainReferences(); err != nil {
+		return err
+	}
+
+	// We build the update as a sequence of groups of lines.  Each group (for example, the
+	// update to a single chain) must be applied atomically but, if maxRestoreLines is set,
+	// the update may be split into several iptables-restore transactions between groups.
+	// The groups are ordered so that the dataplane stays consistent in between transactions:
+	// new chains are created and filled in before we add any references to them, and we
+	// only flush and delete chains once we've removed the references to them.
+	var groups [][]restoreLine
+	var group []restoreLine
+	writeLine := func(line string, origin lineOrigin) {
+		group = append(group, restoreLine{line: line, origin: origin})
+	}
+	endGroup := func() {
+		if len(group) > 0 {
+			groups = append(groups, group)
+			group = nil
+		}
+	}
 
 	// Make a pass over the dirty chains and generate a forward reference for any that need to
-	// be created or flushed.
-	t.dirtyChains.Iter(func(item interface{}) error {
-		chainName := item.(string)
-		chainNeedsToBeFlushed := false
+	// be created, splitting them into new chains and chains that already exist.
+	//
+	// We visit the chains in a deterministic order.  As well as making the update reproducible,
+	// that means that, if the hashes of rules in two chains collide, the same chain keeps the
+	// undisambiguated hash on every run, rather than that depending on map iteration order.
+	var newChainNames, existingChainNames, deletedChainNames []string
+	for _, chainName := range sortedStrings(t.dirtyChains) {
+		if t.quarantinedChains.Contains(chainName) {
+			continue
+		}
 		if _, ok := t.chainNameToChain[chainName]; !ok {
-			// About to delete this chain, flush it first to sever dependencies.
-			chainNeedsToBeFlushed = true
+			deletedChainNames = append(deletedChainNames, chainName)
 		} else if _, ok := t.chainToDataplaneHashes[chainName]; !ok {
 			// Chain doesn't exist in dataplane, mark it for creation.
-			chainNeedsToBeFlushed = true
-		}
-		if chainNeedsToBeFlushed {
-			inputBuf.WriteString(fmt.Sprintf(":%s - -\n", chainName))
-			t.countNumLinesExecuted.Inc()
+			writeLine(fmt.Sprintf(":%s - -", chainName), lineOrigin{Chain: chainName})
+			newChainNames = append(newChainNames, chainName)
+		} else {
+			existingChainNames = append(existingChainNames, chainName)
 		}
-		return nil
-	})
+	}
+	endGroup()
 
-	// Make a second pass over the dirty chains.  This time, we write out the rule changes.
+	// Make a second pass over the dirty chains.  This time, we write out the rule changes,
+	// starting with the new chains.
 	newHashes := map[string][]string{}
-	t.dirtyChains.Iter(func(item interface{}) error {
-		chainName := item.(string)
-		if chain, ok := t.chainNameToChain[chainName]; ok {
-			// Chain update or creation.  Scan the chain against its previous hashes
-			// and replace/append/delete as appropriate.
-			previousHashes := t.chainToDataplaneHashes[chainName]
-			currentHashes := chain.RuleHashes()
-			newHashes[chainName] = currentHashes
-			for i := 0; i < len(previousHashes) || i < len(currentHashes); i++ {
-				var line string
-				if i < len(previousHashes) && i < len(currentHashes) {
-					if previousHashes[i] == currentHashes[i] {
-						continue
-					}
-					// Hash doesn't match, replace the rule.
-					ruleNum := i + 1 // 1-indexed.
-					prefixFrag := t.commentFrag(currentHashes[i])
-					line = chain.Rules[i].RenderReplace(chainName, ruleNum, prefixFrag)
-				} else if i < len(previousHashes) {
-					// previousHashes was longer, remove the old rules from the end.
-					ruleNum := len(currentHashes) + 1 // 1-indexed
-					line = deleteRule(chainName, ruleNum)
-				} else {
-					// currentHashes was longer.  Append.
-					prefixFrag := t.commentFrag(currentHashes[i])
-					line = chain.Rules[i].RenderAppend(chainName, prefixFrag)
+	for _, chainName := range append(newChainNames, existingChainNames...) {
+		chain := t.chainNameToChain[chainName]
+		// Chain update or creation.  Scan the chain against its previous hashes
+		// and replace/append/delete as appropriate.
+		previousHashes := t.chainToDataplaneHashes[chainName]
+		currentHashes := t.ruleHashes(chainName, chain.Rules)
+		newHashes[chainName] = currentHashes
+		for i := 0; i < len(previousHashes) || i < len(currentHashes); i++ {
+			var line string
+			origin := lineOrigin{Chain: chainName, RuleNum: i + 1}
+			if i < len(previousHashes) && i < len(currentHashes) {
+				if previousHashes[i] == currentHashes[i] {
+					continue
 				}
-				inputBuf.WriteString(line)
-				inputBuf.WriteString("\n")
-				t.countNumLinesExecuted.Inc()
+				// Hash doesn't match, replace the rule.
+				ruleNum := i + 1 // 1-indexed.
+				prefixFrag := t.commentFrag(currentHashes[i])
+				line = chain.Rules[i].RenderReplace(chainName, ruleNum, prefixFrag)
+				origin.Comment = chain.Rules[i].Comment
+				origin.Rule = chain.Rules[i].Origin
+			} else if i < len(previousHashes) {
+				// previousHashes was longer, remove the old rules from the end.
+				ruleNum := len(currentHashes) + 1 // 1-indexed
+				line = deleteRule(chainName, ruleNum)
+				origin.RuleNum = ruleNum
+			} else {
+				// currentHashes was longer.  Append.
+				prefixFrag := t.commentFrag(currentHashes[i])
+				line = chain.Rules[i].RenderAppend(chainName, prefixFrag)
+				origin.Comment = chain.Rules[i].Comment
+				origin.Rule = chain.Rules[i].Origin
 			}
+			writeLine(line, origin)
 		}
-		return nil // Delay clearing the set until we've programmed iptables.
-	})
+		endGroup()
+	}
 
 	// Now calculate iptables updates for our inserted rules, which are used to hook top-level
 	// chains.
-	t.dirtyInserts.Iter(func(item interface{}) error {
-		chainName := item.(string)
+	for _, chainName := range sortedStrings(t.dirtyInserts) {
+		if t.quarantinedChains.Contains(chainName) {
+			continue
+		}
 		previousHashes := t.chainToDataplaneHashes[chainName]
 
 		// Calculate the hashes for our inserted rules.
@@ -801,7 +1599,7 @@ func (t *Table) applyUpdates() error {
 
 		if reflect.DeepEqual(newChainHashes, previousHashes) {
 			// Chain is in sync, skip to next one.
-			return nil
+			continue
 		}
 
 		// For simplicity, if we've discovered that we're out-of-sync, remove all our
@@ -813,9 +1611,7 @@ func (t *Table) applyUpdates() error {
 			if previousHashes[i] != "" {
 				ruleNum := i + 1
 				line := deleteRule(chainName, ruleNum)
-				inputBuf.WriteString(line)
-				inputBuf.WriteString("\n")
-				t.countNumLinesExecuted.Inc()
+				writeLine(line, lineOrigin{Chain: chainName, RuleNum: ruleNum})
 			}
 		}
 
@@ -828,78 +1624,78 @@ func (t *Table) applyUpdates() error {
 			for i := len(rules) - 1; i >= 0; i-- {
 				prefixFrag := t.commentFrag(newRuleHashes[i])
 				line := rules[i].RenderInsert(chainName, prefixFrag)
-				inputBuf.WriteString(line)
-				inputBuf.WriteString("\n")
-				t.countNumLinesExecuted.Inc()
+				writeLine(line, lineOrigin{
+					Chain:   chainName,
+					RuleNum: i + 1,
+					Comment: rules[i].Comment,
+					Rule:    rules[i].Origin,
+				})
 			}
 		} else {
 			t.logCxt.Debug("Rendering append rules.")
 			for i := 0; i < len(rules); i++ {
 				prefixFrag := t.commentFrag(newRuleHashes[i])
 				line := rules[i].RenderAppend(chainName, prefixFrag)
-				inputBuf.WriteString(line)
-				inputBuf.WriteString("\n")
-				t.countNumLinesExecuted.Inc()
+				writeLine(line, lineOrigin{
+					Chain:   chainName,
+					RuleNum: i + 1,
+					Comment: rules[i].Comment,
+					Rule:    rules[i].Origin,
+				})
 			}
 		}
+		endGroup()
 
 		newHashes[chainName] = newChainHashes
-
-		return nil // Delay clearing the set until we've programmed iptables.
-	})
+	}
 
 	// Do deletions at the end.  This ensures that we don't try to delete any chains that
 	// are still referenced (because we'll have removed the references in the modify pass
-	// above).  Note: if a chain is being deleted at the same time as a chain that it refers to
-	// then we'll issue a create+flush instruction in the very first pass, which will sever the
-	// references.
-	t.dirtyChains.Iter(func(item interface{}) error {
-		chainName := item.(string)
-		if _, ok := t.chainNameToChain[chainName]; !ok {
-			// Chain deletion
-			inputBuf.WriteString(fmt.Sprintf("--delete-chain %s\n", chainName))
-			t.countNumLinesExecuted.Inc()
-			newHashes[chainName] = nil
+	// above).  We flush all the chains before deleting any of them; that severs any
+	// references between chains that are being deleted together.
+	for _, chainName := range deletedChainNames {
+		writeLine(fmt.Sprintf(":%s - -", chainName), lineOrigin{Chain: chainName})
+	}
+	for _, chainName := range deletedChainNames {
+		writeLine(fmt.Sprintf("--delete-chain %s", chainName), lineOrigin{Chain: chainName})
+		newHashes[chainName] = nil
+	}
+	endGroup()
+
+	if len(groups) > 0 {
+		// We've figured out that we need to make some changes.
+		transactions := t.splitIntoTransactions(groups)
+		if t.preValidate {
+			// Validate the update as a whole; the later transactions may depend on
+			// the earlier ones so they can't be validated separately.
+			input, lineOrigins := t.renderRestoreInput(flattenGroups(groups))
+			if err := t.validateInput(input, lineOrigins); err != nil {
+				return err
+			}
 		}
-		return nil // Delay clearing the set until we've programmed iptables.
-	})
-
-	if inputBuf.Len() > len(tableNameLine) {
-		// We've figured out that we need to make some changes, finish off the input then
-		// execute iptables-restore.  iptables-restore input ends with a COMMIT.
-		inputBuf.WriteString("COMMIT\n")
-
-		// Annoying to have to copy the buffer here but reading from a buffer is
-		// destructive so if we want to trace out the contents after a failure, we have to
-		// take a copy.
-		input := inputBuf.String()
-		t.logCxt.WithField("iptablesInput", input).Debug("Writing to iptables")
-
-		var outputBuf, errBuf bytes.Buffer
-		cmd := t.newCmd(t.iptablesRestoreCmd, "--noflush", "--verbose")
-		cmd.SetStdin(&inputBuf)
-		cmd.SetStdout(&outputBuf)
-		cmd.SetStderr(&errBuf)
-		countNumRestoreCalls.Inc()
-		err := cmd.Run()
-		if err != nil {
-			t.logCxt.WithFields(log.Fields{
-				"output":      outputBuf.String(),
-				"errorOutput": errBuf.String(),
-				"error":       err,
-				"input":       input,
-			}).Warn("Failed to execute ip(6)tables-restore command")
-			t.inSyncWithDataPlane = false
-			countNumRestoreErrors.Inc()
-			return err
+		if len(transactions) > 1 {
+			t.logCxt.WithField("numTransactions", len(transactions)).Debug(
+				"Splitting update into several iptables-restore transactions")
+		}
+		var inputs []string
+		for _, txn := range transactions {
+			input, lineOrigins := t.renderRestoreInput(txn)
+			if err := t.execRestore(input, lineOrigins); err != nil {
+				// Some of the transactions may have been committed.  execRestore() has
+				// marked us as out of sync so we'll resync before we retry.
+				return err
+			}
+			inputs = append(inputs, input)
 		}
 		t.lastWriteTime = t.timeNow()
 		t.postWriteInterval = 50 * time.Millisecond
+		t.recordAuditEvent(strings.Join(inputs, ""), newHashes)
 	}
 
 	// Now we've successfully updated iptables, clear the dirty sets.  We do this even if we
 	// found there was nothing to do above, since we may have found out that a dirty chain
-	// was actually a no-op update.
+	// was actually a no-op update.  Quarantined chains are dropped from the dirty sets too;
+	// they'll be marked dirty again when they're next updated.
 	t.dirtyChains = set.New()
 	t.dirtyInserts = set.New()
 
@@ -911,24 +1707,417 @@ func (t *Table) applyUpdates() error {
 			t.chainToDataplaneHashes[chainName] = hashes
 		}
 	}
+	if _, ok := newHashes[t.markerChainName]; ok && t.markerChainName != "" {
+		t.markerWritten = true
+	}
+
+	return nil
+}
+
+// restoreLine is a line of iptables-restore input along with its origin.
+type restoreLine struct {
+	line   string
+	origin lineOrigin
+}
+
+func flattenGroups(groups [][]restoreLine) []restoreLine {
+	var lines []restoreLine
+	for _, group := range groups {
+		lines = append(lines, group...)
+	}
+	return lines
+}
+
+// splitIntoTransactions packs the groups of lines into transactions of at most
+// maxRestoreLines lines, without splitting any group.  A group that is longer than the limit
+// gets a transaction of its own.  If maxRestoreLines is 0, there's only one transaction.
+func (t *Table) splitIntoTransactions(groups [][]restoreLine) (transactions [][]restoreLine) {
+	var txn []restoreLine
+	for _, group := range groups {
+		if t.maxRestoreLines > 0 && len(txn) > 0 && len(txn)+len(group) > t.maxRestoreLines {
+			transactions = append(transactions, txn)
+			txn = nil
+		}
+		txn = append(txn, group...)
+	}
+	if len(txn) > 0 {
+		transactions = append(transactions, txn)
+	}
+	return
+}
+
+// renderRestoreInput renders the iptables-restore input for a single transaction containing
+// the given lines.  It returns the input along with the origin of each line; lineOrigins[n]
+// holds the origin of line n+1 of the input.
+func (t *Table) renderRestoreInput(lines []restoreLine) (input string, lineOrigins []lineOrigin) {
+	var inputBuf bytes.Buffer
+	// iptables-restore input starts with a line indicating the table name.
+	inputBuf.WriteString(fmt.Sprintf("*%s\n", t.Name))
+	lineOrigins = []lineOrigin{{}}
+	for _, l := range lines {
+		inputBuf.WriteString(l.line)
+		inputBuf.WriteString("\n")
+		lineOrigins = append(lineOrigins, l.origin)
+	}
+	// iptables-restore input ends with a COMMIT.
+	inputBuf.WriteString("COMMIT\n")
+	lineOrigins = append(lineOrigins, lineOrigin{})
+	return inputBuf.String(), lineOrigins
+}
 
+// execRestore runs iptables-restore to apply the given transaction.
+func (t *Table) execRestore(input string, lineOrigins []lineOrigin) error {
+	t.logCxt.WithField("iptablesInput", input).Debug("Writing to iptables")
+	t.countNumLinesExecuted.Add(float64(len(lineOrigins) - 2))
+
+	// Note: we start a fresh iptables-restore for each transaction rather than keeping a
+	// long-lived process and feeding it one transaction after another.  Although
+	// iptables-restore commits each table as it reads the COMMIT line, it gives no
+	// per-transaction acknowledgement; the only way to learn whether a transaction
+	// succeeded is to close its stdin and collect its exit code.
+	var outputBuf, errBuf bytes.Buffer
+	cmd := t.newCmd(t.iptablesRestoreCmd, "--noflush", "--verbose")
+	cmd.SetStdin(bytes.NewBufferString(input))
+	cmd.SetStdout(&outputBuf)
+	cmd.SetStderr(&errBuf)
+	countNumRestoreCalls.Inc()
+	t.lock.Lock()
+	err := cmd.Run()
+	t.lock.Unlock()
+	if err != nil {
+		errorOutput := errBuf.String()
+		logCxt := t.logCxt.WithFields(log.Fields{
+			"output":      outputBuf.String(),
+			"errorOutput": errorOutput,
+			"error":       err,
+		})
+		lineNum, line, origin, found := findFailedLine(errorOutput, input, lineOrigins)
+		if found {
+			// We know which line failed so, rather than dumping the whole input
+			// (which may be thousands of lines), log the offending line, where it
+			// came from and a few lines either side of it.
+			logCxt = logCxt.WithFields(log.Fields{
+				"failedLineNum": lineNum,
+				"failedLine":    line,
+				"chain":         origin.Chain,
+				"ruleNum":       origin.RuleNum,
+				"ruleComment":   origin.Comment,
+				"inputContext":  inputContext(input, lineNum, restoreErrorContextLines),
+			})
+			t.logCxt.WithField("input", input).Debug("Full input to failed iptables-restore")
+			err = fmt.Errorf("%v: iptables-restore rejected line %d (%v): %s",
+				err, lineNum, origin, line)
+		} else {
+			logCxt = logCxt.WithField("input", input)
+		}
+		logCxt.Warn("Failed to execute ip(6)tables-restore command")
+		t.inSyncWithDataPlane = false
+		countNumRestoreErrors.Inc()
+		return err
+	}
 	return nil
 }
 
+// unknownChainError is returned by applyUpdates when a rule jumps to one of our chains that
+// we don't know about.  iptables-restore would reject the whole transaction in that case.
+type unknownChainError struct {
+	origin lineOrigin
+	target string
+}
+
+func (e unknownChainError) Error() string {
+	return fmt.Sprintf("%v refers to unknown chain %s", e.origin, e.target)
+}
+
+// checkChainReferences checks that every jump or goto to one of our chains refers to a chain
+// that we're going to program.  Jumps to chains outside our namespace, such as the kernel's
+// chains, are not checked.  We check the rules in dirty chains and our inserts and, if we're
+// about to delete any chains, all the remaining chains, since a clean chain may still refer to
+// a chain that is being deleted.
+func (t *Table) checkChainReferences() error {
+	checkRules := func(chainName string, rules []Rule) error {
+		for i, rule := range rules {
+			var target string
+			switch action := rule.Action.(type) {
+			case JumpAction:
+				target = action.Target
+			case GotoAction:
+				target = action.Target
+			default:
+				continue
+			}
+			if !t.ourChainsRegexp.MatchString(target) {
+				continue
+			}
+			if _, ok := t.chainNameToChain[target]; ok {
+				continue
+			}
+			if _, ok := t.chainsPendingDeletion[target]; ok {
+				// Removed but still present in the dataplane.
+				continue
+			}
+			countNumValidationErrors.Inc()
+			return unknownChainError{
+				origin: lineOrigin{Chain: chainName, RuleNum: i + 1, Comment: rule.Comment},
+				target: target,
+			}
+		}
+		return nil
+	}
+
+	var err error
+	deletionPending := false
+	t.dirtyChains.Iter(func(item interface{}) error {
+		chainName := item.(string)
+		if t.quarantinedChains.Contains(chainName) {
+			return nil
+		}
+		chain, ok := t.chainNameToChain[chainName]
+		if !ok {
+			deletionPending = true
+			return nil
+		}
+		err = checkRules(chainName, chain.Rules)
+		if err != nil {
+			return set.StopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if deletionPending {
+		for chainName, chain := range t.chainNameToChain {
+			if err := checkRules(chainName, chain.Rules); err != nil {
+				return err
+			}
+		}
+	}
+	for chainName, rules := range t.chainToInsertedRules {
+		if err := checkRules(chainName, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validationError is returned by applyUpdates when iptables-restore --test rejects the input.
+type validationError struct {
+	err    error
+	chain  string
+	detail string
+}
+
+func (e validationError) Error() string {
+	if e.chain == "" {
+		return fmt.Sprintf("iptables-restore --test failed: %v: %s", e.err, e.detail)
+	}
+	return fmt.Sprintf("iptables-restore --test failed for chain %s: %v: %s",
+		e.chain, e.err, e.detail)
+}
+
+// validateInput runs the given input through iptables-restore --test, which parses the input
+// and checks that the kernel accepts it without committing it.  On failure, it returns a
+// validationError, which identifies the chain at fault, if possible.
+func (t *Table) validateInput(input string, lineOrigins []lineOrigin) error {
+	var outputBuf, errBuf bytes.Buffer
+	cmd := t.newCmd(t.iptablesRestoreCmd, "--noflush", "--test")
+	cmd.SetStdin(bytes.NewBufferString(input))
+	cmd.SetStdout(&outputBuf)
+	cmd.SetStderr(&errBuf)
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	countNumValidationErrors.Inc()
+	errorOutput := errBuf.String()
+	logCxt := t.logCxt.WithFields(log.Fields{
+		"output":      outputBuf.String(),
+		"errorOutput": errorOutput,
+		"error":       err,
+	})
+	valErr := validationError{err: err, detail: strings.TrimSpace(errorOutput)}
+	lineNum, line, origin, found := findFailedLine(errorOutput, input, lineOrigins)
+	if found {
+		logCxt = logCxt.WithFields(log.Fields{
+			"failedLineNum": lineNum,
+			"failedLine":    line,
+			"chain":         origin.Chain,
+			"ruleNum":       origin.RuleNum,
+			"ruleComment":   origin.Comment,
+		})
+		valErr.chain = origin.Chain
+		valErr.detail = fmt.Sprintf("line %d (%v): %s", lineNum, origin, line)
+	} else {
+		logCxt = logCxt.WithField("input", input)
+	}
+	logCxt.Warn("ip(6)tables-restore --test rejected update")
+	return valErr
+}
+
 func (t *Table) commentFrag(hash string) string {
 	return fmt.Sprintf(`-m comment --comment "%s%s"`, t.hashCommentPrefix, hash)
 }
 
+// lineOrigin records where a line of iptables-restore input came from.
+type lineOrigin struct {
+	// Chain is the name of the chain that the line modifies, or "" for the table header and
+	// COMMIT lines.
+	Chain string
+	// RuleNum is the 1-indexed position of the rule within the chain (or within the list of
+	// inserted rules), or 0 if the line doesn't correspond to a rule.
+	RuleNum int
+	// Comment is the comment attached to the Rule, if any.  For policy and profile rules,
+	// this typically identifies the policy.
+	Comment string
+	// Rule is the origin of the Rule, if known.
+	Rule *RuleOrigin
+}
+
+func (o lineOrigin) String() string {
+	if o.Chain == "" {
+		return "table header/footer"
+	}
+	desc := fmt.Sprintf("chain %s", o.Chain)
+	if o.RuleNum > 0 {
+		desc += fmt.Sprintf(" rule %d", o.RuleNum)
+	}
+	if o.Comment != "" {
+		desc += fmt.Sprintf(" (%s)", o.Comment)
+	}
+	if o.Rule != nil {
+		desc += fmt.Sprintf(" from %v", o.Rule)
+	}
+	return desc
+}
+
+// findFailedLine parses the error output from iptables-restore to find the line number that it
+// failed on.  If found, it returns the line number, the content of that line and its origin.
+func findFailedLine(errorOutput, input string, origins []lineOrigin) (
+	lineNum int, line string, origin lineOrigin, found bool,
+) {
+	match := restoreErrorLineRegexp.FindStringSubmatch(errorOutput)
+	if match == nil {
+		return
+	}
+	numStr := match[1]
+	if numStr == "" {
+		numStr = match[2]
+	}
+	lineNum, err := strconv.Atoi(numStr)
+	if err != nil || lineNum < 1 || lineNum > len(origins) {
+		log.WithField("errorOutput", errorOutput).Warn(
+			"Failed to parse line number from iptables-restore output")
+		return 0, "", lineOrigin{}, false
+	}
+	lines := strings.Split(input, "\n")
+	if lineNum <= len(lines) {
+		line = lines[lineNum-1]
+	}
+	return lineNum, line, origins[lineNum-1], true
+}
+
+// inputContext returns the lines of input within radius lines of the given (1-indexed) line,
+// each prefixed with its line number.  The target line is marked with ">".
+func inputContext(input string, lineNum int, radius int) string {
+	lines := strings.Split(input, "\n")
+	var buf bytes.Buffer
+	for i := lineNum - radius; i <= lineNum+radius; i++ {
+		if i < 1 || i > len(lines) {
+			continue
+		}
+		marker := " "
+		if i == lineNum {
+			marker = ">"
+		}
+		buf.WriteString(fmt.Sprintf("%s%5d: %s\n", marker, i, lines[i-1]))
+	}
+	return buf.String()
+}
+
 func deleteRule(chainName string, ruleNum int) string {
 	return fmt.Sprintf("-D %s %d", chainName, ruleNum)
 }
 
-func calculateRuleInsertHashes(chainName string, rules []Rule) []string {
-	chain := Chain{
-		Name:  chainName,
-		Rules: rules,
+// ruleHashes calculates the hashes for the given rules in the given chain and records them as
+// owned by that chain.  If a hash collides with a hash that is owned by another chain (or with
+// an earlier rule in the same chain) then the collision is logged and the hash is disambiguated
+// rather than allowing two distinct rules to share an ID.
+func (t *Table) ruleHashes(chainName string, rules []Rule) []string {
+	t.releaseRuleHashes(chainName)
+	ownHashes := set.New()
+	hashes := t.ruleHasher.RuleHashes(chainName, rules, func(ruleIdx int, hash string) bool {
+		owner, ownedByOtherChain := t.hashToChain[hash]
+		if ownedByOtherChain || ownHashes.Contains(hash) {
+			t.logCxt.WithFields(log.Fields{
+				"hash":       hash,
+				"chainName":  chainName,
+				"ruleIdx":    ruleIdx,
+				"otherChain": owner,
+			}).Warn("Detected rule hash collision")
+			countNumHashCollisions.Inc()
+			return true
+		}
+		ownHashes.Add(hash)
+		return false
+	})
+	for _, hash := range hashes {
+		t.hashToChain[hash] = chainName
+	}
+	t.chainToHashes[chainName] = hashes
+	return hashes
+}
+
+// RuleInfo describes one of the rules that the Table is programming.
+type RuleInfo struct {
+	// Chain is the name of the chain that contains the rule.
+	Chain string
+	// RuleNum is the 1-indexed position of the rule within the chain.
+	RuleNum int
+	// Origin is the origin of the rule, or nil if the rule didn't come from a policy or
+	// profile.
+	Origin *RuleOrigin
+}
+
+func (i RuleInfo) String() string {
+	desc := fmt.Sprintf("chain %s rule %d", i.Chain, i.RuleNum)
+	if i.Origin != nil {
+		desc = fmt.Sprintf("%v (%s)", i.Origin, desc)
+	}
+	return desc
+}
+
+// LookupRuleHash returns information about the rule with the given hash, allowing a rule
+// seen in the dataplane to be traced back to its policy.  The hash is the part of the rule's
+// comment that follows the hash prefix.  ok is false if the hash doesn't belong to any rule
+// that we've programmed.  Like the rest of the Table's methods, it should be called from the
+// same goroutine as Apply().
+func (t *Table) LookupRuleHash(hash string) (info RuleInfo, ok bool) {
+	chainName, ok := t.hashToChain[hash]
+	if !ok {
+		return
+	}
+	for i, h := range t.chainToHashes[chainName] {
+		if h != hash {
+			continue
+		}
+		info = RuleInfo{Chain: chainName, RuleNum: i + 1}
+		if chain, ok := t.chainNameToChain[chainName]; ok && i < len(chain.Rules) {
+			info.Origin = chain.Rules[i].Origin
+		}
+		return info, true
+	}
+	return RuleInfo{}, false
+}
+
+// releaseRuleHashes removes the record of the hashes owned by the given chain.
+func (t *Table) releaseRuleHashes(chainName string) {
+	for _, hash := range t.chainToHashes[chainName] {
+		if t.hashToChain[hash] == chainName {
+			delete(t.hashToChain, hash)
+		}
 	}
-	return (&chain).RuleHashes()
+	delete(t.chainToHashes, chainName)
 }
 
 func numEmptyStrings(strs []string) int {
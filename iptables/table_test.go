@@ -20,8 +20,12 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/projectcalico/felix/dataplaneexec"
 	"github.com/projectcalico/felix/rules"
 
+	"bytes"
+	"fmt"
+	"regexp"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -101,6 +105,44 @@ var _ = Describe("Table with an empty dataplane", func() {
 		}).To(Panic())
 	})
 
+	It("should attribute a restore failure to the rule that caused it", func() {
+		dataplane.FailAllRestores = true
+		dataplane.RestoreStderr = "iptables-restore: line 3 failed\n"
+		table.UpdateChains([]*Chain{
+			{Name: "cali-foobar", Rules: []Rule{
+				{Action: AcceptAction{}, Comment: "Policy foo"},
+			}},
+		})
+		var applyErr error
+		func() {
+			defer func() {
+				// logrus panics with the log entry, which has the error attached.
+				entry := recover().(*log.Entry)
+				applyErr = entry.Data["error"].(error)
+			}()
+			table.Apply()
+		}()
+		Expect(applyErr.Error()).To(ContainSubstring("line 3 (chain cali-foobar rule 1 (Policy foo))"))
+		Expect(applyErr.Error()).To(ContainSubstring("-A cali-foobar"))
+	})
+
+	It("should understand newer iptables-restore error output", func() {
+		dataplane.FailAllRestores = true
+		dataplane.RestoreStderr = "iptables-restore: invalid option\nError occurred at line: 2\n"
+		table.UpdateChains([]*Chain{
+			{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}},
+		})
+		var applyErr error
+		func() {
+			defer func() {
+				entry := recover().(*log.Entry)
+				applyErr = entry.Data["error"].(error)
+			}()
+			table.Apply()
+		}()
+		Expect(applyErr.Error()).To(ContainSubstring("line 2 (chain cali-foobar): :cali-foobar - -"))
+	})
+
 	Describe("after inserting a rule", func() {
 		BeforeEach(func() {
 			table.SetRuleInsertions("FORWARD", []Rule{
@@ -295,101 +337,807 @@ var _ = Describe("Table with an empty dataplane", func() {
 				Expect(dataplane.CmdNames).To(ConsistOf("iptables-save"))
 			})
 		})
-		Describe("then extending the chain", func() {
-			BeforeEach(func() {
-				table.UpdateChains([]*Chain{
-					{Name: "cali-foobar", Rules: []Rule{
-						{Action: AcceptAction{}},
-						{Action: DropAction{}},
-						{Action: ReturnAction{}},
-					}},
-				})
-				table.Apply()
-			})
-			It("should be updated", func() {
-				Expect(dataplane.Chains).To(Equal(map[string][]string{
-					"FORWARD": {},
-					"INPUT":   {},
-					"OUTPUT":  {},
-					"cali-foobar": {
-						"-m comment --comment \"cali:42h7Q64_2XDzpwKe\" --jump ACCEPT",
-						"-m comment --comment \"cali:0sUFHicPNNqNyNx8\" --jump DROP",
-						"-m comment --comment \"cali:yilSOZ62PxMhMnS9\" --jump RETURN",
-					},
-				}))
-			})
+		Describe("then extending the chain", func() {
+			BeforeEach(func() {
+				table.UpdateChains([]*Chain{
+					{Name: "cali-foobar", Rules: []Rule{
+						{Action: AcceptAction{}},
+						{Action: DropAction{}},
+						{Action: ReturnAction{}},
+					}},
+				})
+				table.Apply()
+			})
+			It("should be updated", func() {
+				Expect(dataplane.Chains).To(Equal(map[string][]string{
+					"FORWARD": {},
+					"INPUT":   {},
+					"OUTPUT":  {},
+					"cali-foobar": {
+						"-m comment --comment \"cali:42h7Q64_2XDzpwKe\" --jump ACCEPT",
+						"-m comment --comment \"cali:0sUFHicPNNqNyNx8\" --jump DROP",
+						"-m comment --comment \"cali:yilSOZ62PxMhMnS9\" --jump RETURN",
+					},
+				}))
+			})
+
+			Describe("then truncating the chain", func() {
+				BeforeEach(func() {
+					table.UpdateChains([]*Chain{
+						{Name: "cali-foobar", Rules: []Rule{
+							{Action: AcceptAction{}},
+						}},
+					})
+					table.Apply()
+				})
+				It("should be updated", func() {
+					Expect(dataplane.Chains).To(Equal(map[string][]string{
+						"FORWARD": {},
+						"INPUT":   {},
+						"OUTPUT":  {},
+						"cali-foobar": {
+							"-m comment --comment \"cali:42h7Q64_2XDzpwKe\" --jump ACCEPT",
+						},
+					}))
+				})
+			})
+			Describe("then replacing the chain", func() {
+				BeforeEach(func() {
+					table.UpdateChains([]*Chain{
+						{Name: "cali-foobar", Rules: []Rule{
+							{Action: ReturnAction{}},
+						}},
+					})
+					table.Apply()
+				})
+				It("should be updated", func() {
+					Expect(dataplane.Chains).To(Equal(map[string][]string{
+						"FORWARD": {},
+						"INPUT":   {},
+						"OUTPUT":  {},
+						"cali-foobar": {
+							"-m comment --comment \"cali:ZqwJQBzCmuABAOQt\" --jump RETURN",
+						},
+					}))
+				})
+			})
+		})
+		Describe("then removing the chain by name", func() {
+			BeforeEach(func() {
+				table.RemoveChainByName("cali-foobar")
+				table.Apply()
+			})
+			It("should be gone from the dataplane", func() {
+				Expect(dataplane.Chains).To(Equal(map[string][]string{
+					"FORWARD": {},
+					"INPUT":   {},
+					"OUTPUT":  {},
+				}))
+			})
+		})
+		Describe("then removing the chain", func() {
+			BeforeEach(func() {
+				table.RemoveChains([]*Chain{
+					{Name: "cali-foobar", Rules: []Rule{
+						{Action: AcceptAction{}},
+						{Action: DropAction{}},
+					}},
+				})
+				table.Apply()
+			})
+			It("should be gone from the dataplane", func() {
+				Expect(dataplane.Chains).To(Equal(map[string][]string{
+					"FORWARD": {},
+					"INPUT":   {},
+					"OUTPUT":  {},
+				}))
+			})
+		})
+	})
+})
+
+var _ = Describe("Table with pre-validation enabled", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				PreValidate:           true,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.UpdateChains([]*Chain{
+			{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}},
+		})
+	})
+
+	It("should validate then apply a good update", func() {
+		table.Apply()
+		Expect(dataplane.ValidationCalls).To(Equal(1))
+		Expect(dataplane.CmdNames).To(Equal([]string{
+			"iptables-save",
+			"iptables-restore",
+			"iptables-restore",
+		}))
+		Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(1))
+	})
+
+	Describe("with an update that fails validation", func() {
+		BeforeEach(func() {
+			dataplane.FailValidation = true
+			dataplane.RestoreStderr = "iptables-restore: line 3 failed\n"
+			table.Apply()
+		})
+
+		It("should leave the dataplane untouched", func() {
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar"))
+		})
+		It("should not retry or sleep", func() {
+			Expect(dataplane.ValidationCalls).To(Equal(1))
+			Expect(dataplane.CumulativeSleep).To(BeZero())
+		})
+		It("should not report in sync", func() {
+			Expect(table.InSync()).To(BeFalse())
+		})
+		It("should not retry the chain until it is updated", func() {
+			dataplane.FailValidation = false
+			table.Apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar"))
+			Expect(table.InSync()).To(BeFalse())
+			table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: DropAction{}}}})
+			table.Apply()
+			Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(1))
+			Expect(table.InSync()).To(BeTrue())
+		})
+	})
+
+	Describe("with one chain that fails validation", func() {
+		BeforeEach(func() {
+			dataplane.InvalidChain = "cali-bad"
+			table.UpdateChains([]*Chain{
+				{Name: "cali-bad", Rules: []Rule{{Action: DropAction{}}}},
+			})
+			table.Apply()
+		})
+
+		It("should program the other chains", func() {
+			Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(1))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-bad"))
+		})
+		It("should not retry or sleep", func() {
+			Expect(dataplane.ValidationCalls).To(Equal(2))
+			Expect(dataplane.CumulativeSleep).To(BeZero())
+		})
+		It("should not retry the bad chain on the next Apply()", func() {
+			table.Apply()
+			Expect(dataplane.ValidationCalls).To(Equal(2))
+			Expect(table.InSync()).To(BeFalse())
+		})
+		It("should retry the bad chain once it is updated", func() {
+			dataplane.InvalidChain = ""
+			table.UpdateChain(&Chain{Name: "cali-bad", Rules: []Rule{{Action: AcceptAction{}}}})
+			table.Apply()
+			Expect(dataplane.Chains["cali-bad"]).To(HaveLen(1))
+			Expect(table.InSync()).To(BeTrue())
+		})
+	})
+})
+
+var _ = Describe("Table with an instance marker chain", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+			"cali-instance": {
+				`-m comment --comment "cali:abcdefghij" -m comment --comment "Felix instance id=0011 epoch=5678" --jump RETURN`,
+			},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				InstanceMarkerChain:   "cali-instance",
+				InstanceID:            "aabb",
+				InstanceEpoch:         "1234",
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.Apply()
+	})
+
+	It("should record the ID of the instance that wrote the rules", func() {
+		Expect(table.PreviousInstanceID()).To(Equal("0011"))
+		Expect(table.ForeignInstanceID()).To(Equal(""))
+	})
+	It("should write its own ID", func() {
+		Expect(dataplane.Chains["cali-instance"]).To(HaveLen(1))
+		Expect(dataplane.Chains["cali-instance"][0]).To(ContainSubstring(
+			`--comment "Felix instance id=aabb epoch=1234"`))
+	})
+
+	Describe("after another instance overwrites the marker", func() {
+		BeforeEach(func() {
+			dataplane.Chains["cali-instance"] = []string{
+				`-m comment --comment "cali:klmnopqrst" -m comment --comment "Felix instance id=ccdd epoch=9abc" --jump RETURN`,
+			}
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+		})
+
+		It("should report the other instance's ID", func() {
+			Expect(table.ForeignInstanceID()).To(Equal("ccdd"))
+			Expect(table.PreviousInstanceID()).To(Equal("0011"))
+		})
+		It("should restore its own ID", func() {
+			Expect(dataplane.Chains["cali-instance"][0]).To(ContainSubstring(
+				`--comment "Felix instance id=aabb epoch=1234"`))
+		})
+	})
+
+	Describe("after another instance with the same ID overwrites the marker", func() {
+		BeforeEach(func() {
+			dataplane.Chains["cali-instance"] = []string{
+				`-m comment --comment "cali:klmnopqrst" -m comment --comment "Felix instance id=aabb epoch=9abc" --jump RETURN`,
+			}
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+		})
+
+		It("should report the other instance", func() {
+			Expect(table.ForeignInstanceID()).To(Equal("aabb"))
+		})
+		It("should restore its own epoch", func() {
+			Expect(dataplane.Chains["cali-instance"][0]).To(ContainSubstring(
+				`--comment "Felix instance id=aabb epoch=1234"`))
+		})
+	})
+})
+
+var _ = Describe("Table with an instance marker chain written by a previous run", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"cali-instance": {
+				`-m comment --comment "cali:abcdefghij" -m comment --comment "Felix instance id=aabb epoch=5678" --jump RETURN`,
+			},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				InstanceMarkerChain:   "cali-instance",
+				InstanceID:            "aabb",
+				InstanceEpoch:         "1234",
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.Apply()
+	})
+
+	It("should recognise its own ID", func() {
+		Expect(table.PreviousInstanceID()).To(Equal("aabb"))
+		Expect(table.ForeignInstanceID()).To(Equal(""))
+	})
+})
+
+var _ = Describe("Table chain reference validation", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				FailureMode:           FailureModeLeaveUntouched,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.UpdateChains([]*Chain{
+			{Name: "cali-foobar", Rules: []Rule{
+				{Action: AcceptAction{}},
+				{Action: JumpAction{Target: "cali-missing"}, Comment: "bad jump"},
+			}},
+		})
+		table.Apply()
+	})
+
+	It("should not program the update", func() {
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar"))
+		Expect(table.InSync()).To(BeFalse())
+	})
+	It("should enter failure mode without retrying", func() {
+		Expect(table.Degraded()).To(BeTrue())
+		Expect(dataplane.CumulativeSleep).To(BeZero())
+	})
+	It("should apply the update once the chain is defined", func() {
+		table.UpdateChain(&Chain{Name: "cali-missing", Rules: []Rule{{Action: DropAction{}}}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(2))
+		Expect(dataplane.Chains["cali-missing"]).To(HaveLen(1))
+		Expect(table.Degraded()).To(BeFalse())
+	})
+	It("should allow jumps to non-Calico chains", func() {
+		table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{
+			{Action: JumpAction{Target: "DOCKER"}},
+		}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(1))
+	})
+	It("should refuse to delete a chain that is still referenced", func() {
+		table.UpdateChains([]*Chain{
+			{Name: "cali-missing", Rules: []Rule{{Action: DropAction{}}}},
+		})
+		table.Apply()
+		table.RemoveChainByName("cali-missing")
+		table.Apply()
+		Expect(dataplane.Chains).To(HaveKey("cali-missing"))
+		Expect(table.InSync()).To(BeFalse())
+	})
+})
+
+var _ = Describe("Table with a chain deletion grace period", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes:    rules.AllHistoricChainNamePrefixes,
+				ChainDeletionGracePeriod: 10 * time.Second,
+				NewCmdOverride:           dataplane.newCmd,
+				SleepOverride:            dataplane.sleep,
+				NowOverride:              dataplane.now,
+			},
+		)
+		table.UpdateChains([]*Chain{
+			{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}},
+			{Name: "cali-referrer", Rules: []Rule{{Action: JumpAction{Target: "cali-foobar"}}}},
+		})
+		table.Apply()
+		table.RemoveChainByName("cali-foobar")
+		table.Apply()
+	})
+
+	It("should keep the chain during the grace period", func() {
+		Expect(dataplane.Chains).To(HaveKey("cali-foobar"))
+		Expect(table.InSync()).To(BeTrue())
+		Expect(table.HasPendingChainDeletions()).To(BeTrue())
+	})
+	It("should keep the chain after the grace period while it is referenced", func() {
+		dataplane.AdvanceTimeBy(10 * time.Second)
+		table.Apply()
+		Expect(dataplane.Chains).To(HaveKey("cali-foobar"))
+	})
+
+	Describe("after the referrer is updated", func() {
+		BeforeEach(func() {
+			table.UpdateChain(&Chain{Name: "cali-referrer", Rules: []Rule{{Action: DropAction{}}}})
+			table.Apply()
+		})
+
+		It("should keep the chain during the grace period", func() {
+			Expect(dataplane.Chains).To(HaveKey("cali-foobar"))
+		})
+		It("should ask to be rescheduled for the end of the grace period", func() {
+			dataplane.AdvanceTimeBy(9 * time.Second)
+			Expect(table.Apply()).To(BeNumerically("<=", time.Second))
+		})
+		It("should delete the chain once the grace period expires", func() {
+			dataplane.AdvanceTimeBy(10 * time.Second)
+			table.Apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar"))
+			Expect(table.HasPendingChainDeletions()).To(BeFalse())
+		})
+		It("should keep the chain if it is re-added", func() {
+			table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}})
+			dataplane.AdvanceTimeBy(10 * time.Second)
+			table.Apply()
+			Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(1))
+		})
+	})
+
+	Describe("after the referrer is removed a second later", func() {
+		BeforeEach(func() {
+			dataplane.AdvanceTimeBy(time.Second)
+			table.RemoveChainByName("cali-referrer")
+			table.Apply()
+		})
+
+		It("should keep the target while the removed referrer is still in the dataplane", func() {
+			dataplane.AdvanceTimeBy(9 * time.Second)
+			table.Apply()
+			Expect(dataplane.Chains).To(HaveKey("cali-foobar"))
+			Expect(dataplane.Chains).To(HaveKey("cali-referrer"))
+			Expect(table.InSync()).To(BeTrue())
+		})
+		It("should delete both chains once the referrer's grace period expires", func() {
+			dataplane.AdvanceTimeBy(9 * time.Second)
+			table.Apply()
+			dataplane.AdvanceTimeBy(time.Second)
+			table.Apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar"))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-referrer"))
+			Expect(table.HasPendingChainDeletions()).To(BeFalse())
+		})
+		It("should keep the target's references if the referrer is re-added", func() {
+			table.UpdateChain(&Chain{Name: "cali-referrer",
+				Rules: []Rule{{Action: JumpAction{Target: "cali-foobar"}}}})
+			dataplane.AdvanceTimeBy(20 * time.Second)
+			table.Apply()
+			Expect(dataplane.Chains).To(HaveKey("cali-foobar"))
+		})
+	})
+})
+
+var _ = Describe("Table with very short rule hashes", func() {
+	// With single-character hashes, the rules of the two chains are bound to collide.
+	programChains := func(chains []*Chain) map[string][]string {
+		dataplane := newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table := NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				HashLength:            1,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.UpdateChains(chains)
+		table.Apply()
+		return dataplane.Chains
+	}
+	chain := func(name string) *Chain {
+		var rules []Rule
+		for i := 0; i < 20; i++ {
+			rules = append(rules, Rule{
+				Match:  MatchCriteria{fmt.Sprintf("-m foo --foo %d", i)},
+				Action: AcceptAction{},
+			})
+		}
+		return &Chain{Name: name, Rules: rules}
+	}
+
+	It("should resolve collisions the same way every time", func() {
+		expected := programChains([]*Chain{chain("cali-a"), chain("cali-b")})
+		for i := 0; i < 10; i++ {
+			Expect(programChains([]*Chain{chain("cali-b"), chain("cali-a")})).To(Equal(expected))
+		}
+	})
+})
+
+var _ = Describe("Table with a maximum chain length", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				MaxChainLength:        3,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+	})
+
+	chainWithNRules := func(n int) *Chain {
+		chain := &Chain{Name: "cali-foobar"}
+		for i := 0; i < n; i++ {
+			chain.Rules = append(chain.Rules, Rule{
+				Match:  MatchCriteria{fmt.Sprintf("-m mark --mark %#x", i+1)},
+				Action: AcceptAction{},
+			})
+		}
+		return chain
+	}
+
+	It("should not shard a short chain", func() {
+		table.UpdateChain(chainWithNRules(3))
+		table.Apply()
+		Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(3))
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar~1"))
+	})
+
+	Describe("with a long chain", func() {
+		BeforeEach(func() {
+			table.UpdateChain(chainWithNRules(6))
+			table.Apply()
+		})
+
+		It("should split the chain into shards linked by gotos", func() {
+			Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(3))
+			Expect(dataplane.Chains["cali-foobar"][2]).To(HaveSuffix("--goto cali-foobar~1"))
+			Expect(dataplane.Chains["cali-foobar~1"]).To(HaveLen(3))
+			Expect(dataplane.Chains["cali-foobar~1"][2]).To(HaveSuffix("--goto cali-foobar~2"))
+			Expect(dataplane.Chains["cali-foobar~2"]).To(HaveLen(2))
+			Expect(dataplane.Chains["cali-foobar~2"][1]).To(ContainSubstring("--mark 0x6"))
+		})
+		It("should remove unneeded shards when the chain shrinks", func() {
+			table.UpdateChain(chainWithNRules(4))
+			table.Apply()
+			Expect(dataplane.Chains["cali-foobar~1"]).To(HaveLen(2))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar~2"))
+		})
+		It("should remove all the shards with the chain", func() {
+			table.RemoveChainByName("cali-foobar")
+			table.Apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar"))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar~1"))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar~2"))
+		})
+	})
+
+	It("should shorten the shard names of a chain with a long name", func() {
+		chain := chainWithNRules(4)
+		chain.Name = "cali-abcdefghijklmnopqrstuvw"
+		table.UpdateChain(chain)
+		table.Apply()
+		Expect(dataplane.Chains[chain.Name]).To(HaveLen(3))
+		Expect(dataplane.Chains[chain.Name][2]).To(HaveSuffix("--goto cali-abcdefghijklmn_bJc9eDoB"))
+		Expect(dataplane.Chains["cali-abcdefghijklmn_bJc9eDoB"]).To(HaveLen(2))
+	})
+
+	It("should reject an over-long chain name", func() {
+		chain := chainWithNRules(1)
+		chain.Name = "cali-abcdefghijklmnopqrstuvwxyz"
+		Expect(func() { table.UpdateChain(chain) }).To(Panic())
+	})
+})
+
+var _ = Describe("Table with a maximum restore transaction size", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				MaxRestoreLines:       4,
+				PreValidate:           true,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.Apply()
+		dataplane.ResetCmds()
+	})
+
+	chainWithNRules := func(name string, n int) *Chain {
+		chain := &Chain{Name: name}
+		for i := 0; i < n; i++ {
+			chain.Rules = append(chain.Rules, Rule{
+				Match:  MatchCriteria{fmt.Sprintf("-m mark --mark %#x", i+1)},
+				Action: AcceptAction{},
+			})
+		}
+		return chain
+	}
+
+	// countRestores returns the number of iptables-restore transactions, excluding the
+	// --test runs.
+	countRestores := func() int {
+		n := 0
+		for _, name := range dataplane.CmdNames {
+			if name == "iptables-restore" {
+				n++
+			}
+		}
+		return n - dataplane.ValidationCalls
+	}
+
+	Describe("after adding several chains", func() {
+		BeforeEach(func() {
+			table.UpdateChains([]*Chain{
+				chainWithNRules("cali-a", 2),
+				chainWithNRules("cali-b", 2),
+				chainWithNRules("cali-c", 2),
+			})
+			table.SetRuleInsertions("FORWARD", []Rule{
+				{Action: JumpAction{Target: "cali-a"}},
+			})
+			table.Apply()
+		})
+
+		It("should split the update into several transactions", func() {
+			// Forward references (3 lines), then two chains (4 lines), then the last
+			// chain and the insert (3 lines).
+			Expect(countRestores()).To(Equal(3))
+		})
+		It("should validate the update once, as a whole", func() {
+			Expect(dataplane.ValidationCalls).To(Equal(1))
+		})
+		It("should program the dataplane correctly", func() {
+			Expect(dataplane.Chains["cali-a"]).To(HaveLen(2))
+			Expect(dataplane.Chains["cali-b"]).To(HaveLen(2))
+			Expect(dataplane.Chains["cali-c"]).To(HaveLen(2))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(1))
+		})
+		It("should delete the chains", func() {
+			table.SetRuleInsertions("FORWARD", nil)
+			table.RemoveChainByName("cali-a")
+			table.RemoveChainByName("cali-b")
+			table.RemoveChainByName("cali-c")
+			table.Apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-a"))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-b"))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-c"))
+			Expect(dataplane.Chains["FORWARD"]).To(BeEmpty())
+		})
+	})
+
+	It("should not split the update to a single chain", func() {
+		table.UpdateChain(chainWithNRules("cali-a", 6))
+		table.Apply()
+		// The forward reference and then the whole chain.
+		Expect(countRestores()).To(Equal(2))
+		Expect(dataplane.Chains["cali-a"]).To(HaveLen(6))
+	})
+})
+
+var _ = Describe("Table with a flush check interval", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				InstanceMarkerChain:   "cali-instance",
+				InstanceID:            "aabb",
+				InstanceEpoch:         "1234",
+				FlushCheckInterval:    time.Second,
+				MinResyncInterval:     time.Minute,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.UpdateChains([]*Chain{
+			{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}},
+		})
+		table.Apply()
+		dataplane.ResetCmds()
+	})
+
+	It("should ask to be rescheduled for the next check", func() {
+		dataplane.AdvanceTimeBy(500 * time.Millisecond)
+		Expect(table.Apply()).To(BeNumerically("<=", 500*time.Millisecond))
+	})
+
+	It("should check the marker rule once the interval expires", func() {
+		dataplane.AdvanceTimeBy(time.Second)
+		table.Apply()
+		Expect(dataplane.CmdNames).To(Equal([]string{"iptables"}))
+	})
+
+	It("should detect and repair a flush, ignoring the minimum resync interval", func() {
+		dataplane.Chains["cali-foobar"] = []string{}
+		dataplane.Chains["cali-instance"] = []string{}
+		dataplane.AdvanceTimeBy(time.Second)
+		table.Apply()
+		Expect(dataplane.CmdNames).To(Equal([]string{"iptables", "iptables-save", "iptables-restore"}))
+		Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(1))
+		Expect(dataplane.Chains["cali-instance"]).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Table with a minimum resync interval", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				MinResyncInterval:     time.Second,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.UpdateChains([]*Chain{
+			{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}},
+		})
+		table.Apply()
+		dataplane.CmdNames = nil
+	})
+
+	Describe("after an invalidation soon after the last read", func() {
+		var rescheduleAfter time.Duration
+		BeforeEach(func() {
+			dataplane.AdvanceTimeBy(100 * time.Millisecond)
+			table.InvalidateDataplaneCache("test")
+			rescheduleAfter = table.Apply()
+		})
 
-			Describe("then truncating the chain", func() {
-				BeforeEach(func() {
-					table.UpdateChains([]*Chain{
-						{Name: "cali-foobar", Rules: []Rule{
-							{Action: AcceptAction{}},
-						}},
-					})
-					table.Apply()
-				})
-				It("should be updated", func() {
-					Expect(dataplane.Chains).To(Equal(map[string][]string{
-						"FORWARD": {},
-						"INPUT":   {},
-						"OUTPUT":  {},
-						"cali-foobar": {
-							"-m comment --comment \"cali:42h7Q64_2XDzpwKe\" --jump ACCEPT",
-						},
-					}))
-				})
-			})
-			Describe("then replacing the chain", func() {
-				BeforeEach(func() {
-					table.UpdateChains([]*Chain{
-						{Name: "cali-foobar", Rules: []Rule{
-							{Action: ReturnAction{}},
-						}},
-					})
-					table.Apply()
-				})
-				It("should be updated", func() {
-					Expect(dataplane.Chains).To(Equal(map[string][]string{
-						"FORWARD": {},
-						"INPUT":   {},
-						"OUTPUT":  {},
-						"cali-foobar": {
-							"-m comment --comment \"cali:ZqwJQBzCmuABAOQt\" --jump RETURN",
-						},
-					}))
-				})
-			})
+		It("should defer the read", func() {
+			Expect(dataplane.CmdNames).To(BeEmpty())
 		})
-		Describe("then removing the chain by name", func() {
-			BeforeEach(func() {
-				table.RemoveChainByName("cali-foobar")
-				table.Apply()
-			})
-			It("should be gone from the dataplane", func() {
-				Expect(dataplane.Chains).To(Equal(map[string][]string{
-					"FORWARD": {},
-					"INPUT":   {},
-					"OUTPUT":  {},
-				}))
-			})
+		It("should ask to be rescheduled before the interval expires", func() {
+			Expect(rescheduleAfter).To(BeNumerically(">", 0))
+			Expect(rescheduleAfter).To(BeNumerically("<=", 900*time.Millisecond))
 		})
-		Describe("then removing the chain", func() {
-			BeforeEach(func() {
-				table.RemoveChains([]*Chain{
-					{Name: "cali-foobar", Rules: []Rule{
-						{Action: AcceptAction{}},
-						{Action: DropAction{}},
-					}},
-				})
-				table.Apply()
-			})
-			It("should be gone from the dataplane", func() {
-				Expect(dataplane.Chains).To(Equal(map[string][]string{
-					"FORWARD": {},
-					"INPUT":   {},
-					"OUTPUT":  {},
-				}))
-			})
+		It("should read the dataplane once the interval has expired", func() {
+			dataplane.AdvanceTimeBy(time.Second)
+			table.Apply()
+			Expect(dataplane.CmdNames).To(Equal([]string{"iptables-save"}))
 		})
 	})
 })
@@ -973,3 +1721,306 @@ var _ = Describe("Table with inserts and a non-Calico chain", func() {
 		})
 	})
 })
+
+var _ = Describe("Table failure modes", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	newTable := func(failureMode string) *Table {
+		return NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				FailureMode:           failureMode,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		dataplane.FailRestoresContaining = "cali-foobar"
+	})
+
+	It("should panic by default", func() {
+		table = newTable("")
+		table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}})
+		Expect(func() { table.Apply() }).To(Panic())
+	})
+
+	It("should panic by default if an update fails validation", func() {
+		dataplane.FailRestoresContaining = ""
+		table = newTable("")
+		table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{
+			{Action: JumpAction{Target: "cali-missing"}},
+		}})
+		Expect(func() { table.Apply() }).To(Panic())
+	})
+
+	It("should reject an unknown failure mode", func() {
+		Expect(func() { newTable("Bogus") }).To(Panic())
+	})
+
+	It("should reject a failsafe mode for a table other than filter", func() {
+		Expect(func() {
+			NewTable("nat", 4, rules.RuleHashPrefix, TableOptions{
+				FailureMode: FailureModeDropAll,
+			})
+		}).To(Panic())
+	})
+
+	Describe("with FailureModeLeaveUntouched", func() {
+		BeforeEach(func() {
+			table = newTable(FailureModeLeaveUntouched)
+			table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}})
+		})
+
+		It("should leave the dataplane untouched and retry", func() {
+			rescheduleAfter := table.Apply()
+			Expect(table.Degraded()).To(BeTrue())
+			Expect(table.InSync()).To(BeFalse())
+			Expect(rescheduleAfter).To(BeNumerically(">", 0))
+			Expect(rescheduleAfter).To(BeNumerically("<=", 10*time.Second))
+			Expect(dataplane.Chains).To(Equal(map[string][]string{
+				"FORWARD": {},
+				"INPUT":   {},
+				"OUTPUT":  {},
+			}))
+
+			dataplane.FailRestoresContaining = ""
+			table.Apply()
+			Expect(table.Degraded()).To(BeFalse())
+			Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(1))
+		})
+
+		It("should not panic if iptables-save keeps failing", func() {
+			dataplane.FailRestoresContaining = ""
+			dataplane.FailAllSaves = true
+			Expect(func() { table.Apply() }).NotTo(Panic())
+			Expect(table.Degraded()).To(BeTrue())
+			Expect(table.InSync()).To(BeFalse())
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foobar"))
+
+			dataplane.FailAllSaves = false
+			table.Apply()
+			Expect(table.Degraded()).To(BeFalse())
+			Expect(table.InSync()).To(BeTrue())
+			Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(1))
+		})
+	})
+
+	Describe("with FailureModeDropAll", func() {
+		BeforeEach(func() {
+			table = newTable(FailureModeDropAll)
+			table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}})
+			table.Apply()
+		})
+
+		It("should insert drop rules into the kernel chains", func() {
+			Expect(table.Degraded()).To(BeTrue())
+			for _, chainName := range []string{"FORWARD", "INPUT", "OUTPUT"} {
+				Expect(dataplane.Chains[chainName]).To(HaveLen(1))
+				Expect(dataplane.Chains[chainName][0]).To(ContainSubstring("--jump DROP"))
+			}
+		})
+
+		It("should not insert the drop rules twice", func() {
+			table.Apply()
+			Expect(dataplane.Chains["INPUT"]).To(HaveLen(1))
+		})
+
+		It("should remove the drop rules once it recovers", func() {
+			dataplane.FailRestoresContaining = ""
+			table.Apply()
+			Expect(table.Degraded()).To(BeFalse())
+			Expect(dataplane.Chains["INPUT"]).To(BeEmpty())
+			Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(1))
+		})
+	})
+
+	Describe("with FailureModeFailsafeAllow", func() {
+		BeforeEach(func() {
+			table = newTable(FailureModeFailsafeAllow)
+			table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}})
+			table.Apply()
+		})
+
+		It("should insert accept rules into the kernel chains", func() {
+			Expect(table.Degraded()).To(BeTrue())
+			Expect(dataplane.Chains["INPUT"]).To(HaveLen(1))
+			Expect(dataplane.Chains["INPUT"][0]).To(ContainSubstring("--jump ACCEPT"))
+		})
+	})
+})
+
+var _ = Describe("Table rule hash lookup", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	origin := &RuleOrigin{
+		Kind:      "Policy",
+		Name:      "default/allow-db",
+		Direction: "inbound",
+		RuleIndex: 3,
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.UpdateChain(&Chain{
+			Name: "cali-foobar",
+			Rules: []Rule{
+				{Action: DropAction{}},
+				{Action: AcceptAction{}, Origin: origin},
+			},
+		})
+		table.Apply()
+	})
+
+	// hashOfRule extracts the rule hash from the given rule in the dataplane.
+	hashOfRule := func(chainName string, ruleIdx int) string {
+		captures := regexp.MustCompile(`cali:([a-zA-Z0-9_-]+)`).FindStringSubmatch(
+			dataplane.Chains[chainName][ruleIdx])
+		Expect(captures).To(HaveLen(2))
+		return captures[1]
+	}
+
+	It("should map a rule hash back to its origin", func() {
+		info, ok := table.LookupRuleHash(hashOfRule("cali-foobar", 1))
+		Expect(ok).To(BeTrue())
+		Expect(info).To(Equal(RuleInfo{Chain: "cali-foobar", RuleNum: 2, Origin: origin}))
+		Expect(info.String()).To(Equal(
+			"policy default/allow-db inbound rule 3 (chain cali-foobar rule 2)"))
+	})
+
+	It("should return the position of a rule without an origin", func() {
+		info, ok := table.LookupRuleHash(hashOfRule("cali-foobar", 0))
+		Expect(ok).To(BeTrue())
+		Expect(info).To(Equal(RuleInfo{Chain: "cali-foobar", RuleNum: 1}))
+	})
+
+	It("should not find an unknown hash", func() {
+		_, ok := table.LookupRuleHash("unknown")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should forget the hashes of a removed chain", func() {
+		hash := hashOfRule("cali-foobar", 1)
+		table.RemoveChainByName("cali-foobar")
+		table.Apply()
+		_, ok := table.LookupRuleHash(hash)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should read the counters of our rules", func() {
+		dataplane.Chains["FOREIGN"] = []string{"--jump ACCEPT"}
+		counters, err := table.ReadRuleCounters()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counters).To(Equal(map[string]RuleCounters{
+			hashOfRule("cali-foobar", 0): {Packets: 1, Bytes: 100},
+			hashOfRule("cali-foobar", 1): {Packets: 2, Bytes: 200},
+		}))
+	})
+
+	It("should return an error if iptables-save fails", func() {
+		dataplane.FailNextSave = true
+		_, err := table.ReadRuleCounters()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Table with a lock", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+		})
+		dataplane.Lock.CheckHeld = true
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+				Lock:                  &dataplane.Lock,
+			},
+		)
+		table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foobar"}}})
+	})
+
+	It("should hold the lock around iptables-save and iptables-restore", func() {
+		table.Apply()
+		Expect(dataplane.CmdNames).To(Equal([]string{"iptables-save", "iptables-restore"}))
+		Expect(dataplane.Lock.LockCalls).To(Equal(2))
+		Expect(dataplane.Lock.Held).To(BeFalse())
+	})
+
+	It("should hold the lock while reading counters", func() {
+		table.Apply()
+		dataplane.Lock.LockCalls = 0
+		_, err := table.ReadRuleCounters()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplane.Lock.LockCalls).To(Equal(1))
+		Expect(dataplane.Lock.Held).To(BeFalse())
+	})
+
+	It("should release the lock if iptables-save fails", func() {
+		dataplane.FailNextSave = true
+		table.Apply()
+		Expect(dataplane.Lock.Held).To(BeFalse())
+		Expect(dataplane.Chains).To(HaveKey("cali-foobar"))
+	})
+})
+
+var _ = Describe("Table in render-only mode", func() {
+	var output bytes.Buffer
+	var table *Table
+	BeforeEach(func() {
+		output.Reset()
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				Exec:                  dataplaneexec.Options{RenderOnly: &output},
+			},
+		)
+		table.UpdateChain(&Chain{Name: "cali-foobar", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foobar"}}})
+		table.Apply()
+	})
+
+	It("should render the update as if the dataplane were empty", func() {
+		Expect(output.String()).To(HavePrefix("*filter\n:cali-foobar - -\n"))
+		Expect(output.String()).To(ContainSubstring("-A cali-foobar "))
+		Expect(output.String()).To(ContainSubstring("-I FORWARD "))
+		Expect(output.String()).To(HaveSuffix("COMMIT\n"))
+	})
+})
@@ -58,11 +58,24 @@ type mockDataplane struct {
 	CmdNames        []string
 	FailNextRestore bool
 	FailAllRestores bool
+	RestoreStderr   string
+	FailValidation  bool
+	ValidationCalls int
+	// InvalidChain, if non-empty, causes the simulated iptables-restore --test to reject
+	// any input that appends a rule to that chain, reporting the offending line.
+	InvalidChain    string
 	OnPreRestore    func()
 	FailNextSave    bool
 	FailAllSaves    bool
 	CumulativeSleep time.Duration
 	Time            time.Time
+	// Lock is a lock for the Table to hold; if the Table is configured with it, the
+	// simulated iptables-save and iptables-restore check that it is held.
+	Lock mockLock
+
+	// FailRestoresContaining, if non-empty, causes any restore whose input contains the
+	// string to fail.
+	FailRestoresContaining string
 }
 
 func (d *mockDataplane) ResetCmds() {
@@ -85,14 +98,34 @@ func (d *mockDataplane) newCmd(name string, arg ...string) CmdIface {
 
 	switch name {
 	case "iptables-restore", "ip6tables-restore":
+		if len(arg) == 2 && arg[1] == "--test" {
+			Expect(arg).To(Equal([]string{"--noflush", "--test"}))
+			cmd = &restoreCmd{
+				Dataplane: d,
+				Test:      true,
+			}
+			break
+		}
 		Expect(arg).To(Equal([]string{"--noflush", "--verbose"}))
 		cmd = &restoreCmd{
 			Dataplane: d,
 		}
 	case "iptables-save", "ip6tables-save":
+		counters := len(arg) > 0 && arg[0] == "-c"
+		if counters {
+			arg = arg[1:]
+		}
 		Expect(arg).To(Equal([]string{"-t", d.Table}))
 		cmd = &saveCmd{
 			Dataplane: d,
+			Counters:  counters,
+		}
+	case "iptables", "ip6tables":
+		Expect(arg).To(HaveLen(4))
+		Expect(arg[:3]).To(Equal([]string{"-t", d.Table, "-S"}))
+		cmd = &listChainCmd{
+			Dataplane: d,
+			ChainName: arg[3],
 		}
 	default:
 		Fail(fmt.Sprintf("Unexpected command %v", name))
@@ -103,6 +136,30 @@ func (d *mockDataplane) newCmd(name string, arg ...string) CmdIface {
 	return cmd
 }
 
+// mockLock is a sync.Locker that records whether it is held.
+type mockLock struct {
+	Held      bool
+	CheckHeld bool
+	LockCalls int
+}
+
+func (l *mockLock) Lock() {
+	Expect(l.Held).To(BeFalse(), "Lock taken while already held")
+	l.Held = true
+	l.LockCalls++
+}
+
+func (l *mockLock) Unlock() {
+	Expect(l.Held).To(BeTrue(), "Unlock called while not held")
+	l.Held = false
+}
+
+func (l *mockLock) expectHeld(cmdName string) {
+	if l.CheckHeld {
+		Expect(l.Held).To(BeTrue(), cmdName+" run without holding the lock")
+	}
+}
+
 func (d *mockDataplane) sleep(duration time.Duration) {
 	d.CumulativeSleep += duration
 	d.Time = d.Time.Add(duration)
@@ -130,6 +187,7 @@ func (d *mockDataplane) RuleTouched(chainName string, ruleNum int) bool {
 
 type restoreCmd struct {
 	Dataplane     *mockDataplane
+	Test          bool
 	Stdin         *bytes.Buffer
 	CapturedStdin string
 	Stdout        io.Writer
@@ -160,12 +218,37 @@ func (d *restoreCmd) String() string {
 
 func (d *restoreCmd) Run() error {
 	log.Info("Running simulated iptables-restore")
+	if !d.Test {
+		d.Dataplane.Lock.expectHeld("iptables-restore")
+	}
 	// Get the input.
 	var buf bytes.Buffer
 	_, err := buf.ReadFrom(d.Stdin)
 	Expect(err).NotTo(HaveOccurred())
 	input := buf.String()
 
+	if d.Test {
+		// Simulated iptables-restore --test, doesn't modify the dataplane.
+		d.Dataplane.ValidationCalls++
+		if d.Dataplane.FailValidation {
+			log.Warn("Simulating an iptables-restore --test failure")
+			d.writeStderr()
+			return errors.New("Simulated validation failure")
+		}
+		if d.Dataplane.InvalidChain != "" {
+			for i, line := range strings.Split(input, "\n") {
+				if strings.HasPrefix(line, "-A "+d.Dataplane.InvalidChain+" ") {
+					log.WithField("line", line).Warn("Simulating an invalid rule")
+					if d.Stderr != nil {
+						fmt.Fprintf(d.Stderr, "iptables-restore: line %d failed\n", i+1)
+					}
+					return errors.New("Simulated validation failure")
+				}
+			}
+		}
+		return nil
+	}
+
 	if d.Dataplane.OnPreRestore != nil {
 		log.Warn("OnPreRestore set, calling it")
 		d.Dataplane.OnPreRestore()
@@ -174,10 +257,18 @@ func (d *restoreCmd) Run() error {
 	if d.Dataplane.FailNextRestore {
 		log.Warn("Simulating an iptables-restore failure")
 		d.Dataplane.FailNextRestore = false
+		d.writeStderr()
 		return errors.New("Simulated failure")
 	}
 	if d.Dataplane.FailAllRestores {
 		log.Warn("Simulating an iptables-restore failure")
+		d.writeStderr()
+		return errors.New("Simulated failure")
+	}
+	if d.Dataplane.FailRestoresContaining != "" &&
+		strings.Contains(input, d.Dataplane.FailRestoresContaining) {
+		log.Warn("Simulating an iptables-restore failure")
+		d.writeStderr()
 		return errors.New("Simulated failure")
 	}
 
@@ -269,6 +360,17 @@ func (d *restoreCmd) Run() error {
 			chainName = parts[1]
 			Expect(len(parts)).To(Equal(2), "--delete-chain only has one argument")
 			Expect(chains[chainName]).To(Equal([]string{}), "Only empty chains can be deleted")
+			for otherName, otherChain := range chains {
+				for _, rule := range otherChain {
+					fields := strings.Fields(rule)
+					for j := 0; j+1 < len(fields); j++ {
+						if (fields[j] == "--jump" || fields[j] == "--goto") && fields[j+1] == chainName {
+							Fail(fmt.Sprintf("Deleted chain %s is still referenced by %s",
+								chainName, otherName))
+						}
+					}
+				}
+			}
 			delete(chains, chainName)
 			d.Dataplane.DeletedChains.Add(chainName)
 		default:
@@ -281,8 +383,17 @@ func (d *restoreCmd) Run() error {
 	return nil
 }
 
+func (d *restoreCmd) writeStderr() {
+	if d.Stderr != nil && d.Dataplane.RestoreStderr != "" {
+		d.Stderr.Write([]byte(d.Dataplane.RestoreStderr))
+	}
+}
+
 type saveCmd struct {
 	Dataplane *mockDataplane
+	// Counters simulates "iptables-save -c".  The nth rule of each chain is given counters
+	// [n:n*100].
+	Counters bool
 }
 
 func (d *saveCmd) String() string {
@@ -302,6 +413,7 @@ func (d *saveCmd) SetStderr(w io.Writer) {
 }
 
 func (d *saveCmd) Output() ([]byte, error) {
+	d.Dataplane.Lock.expectHeld("iptables-save")
 	if d.Dataplane.FailNextSave {
 		d.Dataplane.FailNextSave = false
 		return nil, errors.New("Simulated failure")
@@ -318,7 +430,10 @@ func (d *saveCmd) Output() ([]byte, error) {
 	}
 
 	for chainName, chain := range d.Dataplane.Chains {
-		for _, rule := range chain {
+		for i, rule := range chain {
+			if d.Counters {
+				buf.WriteString(fmt.Sprintf("[%d:%d] ", i+1, (i+1)*100))
+			}
 			buf.WriteString(fmt.Sprintf("-A %s %s\n", chainName, rule))
 		}
 	}
@@ -333,3 +448,41 @@ func (d *saveCmd) Output() ([]byte, error) {
 func (d *saveCmd) Run() error {
 	return errors.New("Not implemented")
 }
+
+type listChainCmd struct {
+	Dataplane *mockDataplane
+	ChainName string
+}
+
+func (d *listChainCmd) String() string {
+	return "listChainCmd"
+}
+
+func (d *listChainCmd) SetStdin(r io.Reader) {
+	Fail("Not implemented")
+}
+
+func (d *listChainCmd) SetStdout(w io.Writer) {
+	Fail("Not implemented")
+}
+
+func (d *listChainCmd) SetStderr(w io.Writer) {
+	Fail("Not implemented")
+}
+
+func (d *listChainCmd) Output() ([]byte, error) {
+	chain, ok := d.Dataplane.Chains[d.ChainName]
+	if !ok {
+		return nil, errors.New("Simulated failure: no chain by that name")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("-N %s\n", d.ChainName))
+	for _, rule := range chain {
+		buf.WriteString(fmt.Sprintf("-A %s %s\n", d.ChainName, rule))
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *listChainCmd) Run() error {
+	return errors.New("Not implemented")
+}
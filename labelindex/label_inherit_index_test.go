@@ -20,6 +20,9 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"fmt"
+	"math/rand"
+
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/selector"
 )
@@ -202,4 +205,196 @@ var _ = Describe("Index", func() {
 			}))
 		})
 	})
+
+	// Namespace labels reach us as labels on the namespace's profile so workload endpoints
+	// pick them up by inheriting from their profiles.
+	Context("with labels inherited from a parent", func() {
+		BeforeEach(func() {
+			idx.UpdateSelector("e1", a_eq_a1)
+			idx.UpdateSelector("e2", c_eq_d)
+			idx.UpdateLabels("l1", map[string]string{"c": "d"}, []string{"ns1"})
+			idx.UpdateLabels("l2", map[string]string{}, []string{"ns1"})
+			idx.UpdateLabels("l3", map[string]string{}, []string{"ns2"})
+			updates = updates[:0]
+		})
+
+		It("should fire events for children when the parent's labels are added", func() {
+			idx.UpdateParentLabels("ns1", map[string]string{"a": "a1"})
+			Expect(updates).To(ConsistOf(
+				update{"start", "l1", "e1"},
+				update{"start", "l2", "e1"},
+			))
+		})
+		It("should recalculate children when the parent's labels change", func() {
+			idx.UpdateParentLabels("ns1", map[string]string{"a": "a1"})
+			updates = updates[:0]
+
+			By("ignoring idempotent update")
+			idx.UpdateParentLabels("ns1", map[string]string{"a": "a1"})
+			Expect(updates).To(BeEmpty())
+
+			By("firing stop and start events for a changed value")
+			idx.UpdateParentLabels("ns1", map[string]string{"a": "b", "c": "d"})
+			Expect(updates).To(ConsistOf(
+				update{"stop", "l1", "e1"},
+				update{"stop", "l2", "e1"},
+				update{"start", "l2", "e2"},
+			))
+			updates = updates[:0]
+
+			By("firing stop events when the parent's labels are deleted")
+			idx.DeleteParentLabels("ns1")
+			Expect(updates).To(ConsistOf(
+				update{"stop", "l2", "e2"},
+			))
+		})
+		It("should prefer the item's own labels to the parent's", func() {
+			// l1 already matches c=="d" through its own labels.
+			idx.UpdateParentLabels("ns1", map[string]string{"c": "e"})
+			Expect(updates).To(BeEmpty())
+			idx.DeleteLabels("l1")
+			Expect(updates).To(Equal([]update{
+				{"stop", "l1", "e2"},
+			}))
+		})
+		It("should recalculate when an item moves to a different parent", func() {
+			idx.UpdateParentLabels("ns2", map[string]string{"a": "a1"})
+			Expect(updates).To(Equal([]update{
+				{"start", "l3", "e1"},
+			}))
+			updates = updates[:0]
+
+			idx.UpdateLabels("l3", map[string]string{}, []string{"ns1"})
+			Expect(updates).To(Equal([]update{
+				{"stop", "l3", "e1"},
+			}))
+		})
+	})
+})
+
+// The index only re-evaluates the selectors that may be affected by a label change.  Check that
+// it gets the same answers as evaluating every selector against every item from scratch, over a
+// long sequence of random updates.
+var _ = Describe("Index consistency", func() {
+	labelNames := []string{"a", "b", "c"}
+	labelValues := []string{"x", "y", ""}
+	selectors := map[string]string{
+		"a-eq-x":      `a == "x"`,
+		"a-ne-y":      `a != "y"`,
+		"has-b":       `has(b)`,
+		"not-has-c":   `!has(c)`,
+		"a-in":        `a in {"x", ""}`,
+		"b-not-in":    `b not in {"y"}`,
+		"compound":    `(a == "x" && b == "y") || !(c == "")`,
+		"all":         `all()`,
+		"tag-or-prof": `has(x) || c == "x"`,
+	}
+
+	randomLabels := func(r *rand.Rand) map[string]string {
+		labels := map[string]string{}
+		for _, name := range labelNames {
+			if r.Intn(2) == 0 {
+				labels[name] = labelValues[r.Intn(len(labelValues))]
+			}
+		}
+		return labels
+	}
+
+	It("should match evaluating from scratch", func() {
+		r := rand.New(rand.NewSource(42))
+		matches := map[string]bool{}
+		idx := NewInheritIndex(
+			func(selId, labelId interface{}) {
+				matches[fmt.Sprint(selId, "/", labelId)] = true
+			},
+			func(selId, labelId interface{}) {
+				delete(matches, fmt.Sprint(selId, "/", labelId))
+			},
+		)
+
+		// Our own model of the data, for the from-scratch evaluation.
+		itemLabels := map[string]map[string]string{}
+		itemParents := map[string][]string{}
+		parentLabels := map[string]map[string]string{}
+		parentTags := map[string][]string{}
+		activeSels := map[string]selector.Selector{}
+
+		effectiveLabels := func(item string) map[string]string {
+			// Earlier parents take precedence over later ones and, within a parent,
+			// labels take precedence over tags.
+			labels := map[string]string{}
+			parents := itemParents[item]
+			for i := len(parents) - 1; i >= 0; i-- {
+				for _, tag := range parentTags[parents[i]] {
+					labels[tag] = ""
+				}
+				for k, v := range parentLabels[parents[i]] {
+					labels[k] = v
+				}
+			}
+			for k, v := range itemLabels[item] {
+				labels[k] = v
+			}
+			return labels
+		}
+
+		for i := 0; i < 2000; i++ {
+			item := fmt.Sprint("item", r.Intn(4))
+			parent := fmt.Sprint("prof", r.Intn(2))
+			switch r.Intn(8) {
+			case 0, 1:
+				labels := randomLabels(r)
+				var parents []string
+				for _, p := range r.Perm(2)[:r.Intn(3)] {
+					parents = append(parents, fmt.Sprint("prof", p))
+				}
+				idx.UpdateLabels(item, labels, parents)
+				itemLabels[item] = labels
+				itemParents[item] = parents
+			case 2:
+				idx.DeleteLabels(item)
+				delete(itemLabels, item)
+				delete(itemParents, item)
+			case 3:
+				labels := randomLabels(r)
+				idx.UpdateParentLabels(parent, labels)
+				parentLabels[parent] = labels
+			case 4:
+				idx.DeleteParentLabels(parent)
+				delete(parentLabels, parent)
+			case 5:
+				tags := []string{labelNames[r.Intn(len(labelNames))], "x"}[:1+r.Intn(2)]
+				idx.UpdateParentTags(parent, tags)
+				parentTags[parent] = tags
+			case 6:
+				idx.DeleteParentTags(parent)
+				delete(parentTags, parent)
+			case 7:
+				for id, selStr := range selectors {
+					if r.Intn(3) == 0 {
+						if _, ok := activeSels[id]; ok {
+							idx.DeleteSelector(id)
+							delete(activeSels, id)
+						} else {
+							sel, err := selector.Parse(selStr)
+							Expect(err).NotTo(HaveOccurred())
+							idx.UpdateSelector(id, sel)
+							activeSels[id] = sel
+						}
+					}
+				}
+			}
+
+			expected := map[string]bool{}
+			for item := range itemLabels {
+				labels := effectiveLabels(item)
+				for id, sel := range activeSels {
+					if sel.Evaluate(labels) {
+						expected[fmt.Sprint(id, "/", item)] = true
+					}
+				}
+			}
+			Expect(matches).To(Equal(expected), fmt.Sprintf("after update %d", i))
+		}
+	})
 })
@@ -54,6 +54,7 @@ import (
 
 	"github.com/projectcalico/felix/dispatcher"
 	"github.com/projectcalico/felix/set"
+	"github.com/projectcalico/felix/stringutils"
 	"github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/selector"
@@ -88,6 +89,18 @@ func (itemData *itemData) Get(labelName string) (value string, present bool) {
 	return
 }
 
+// labelNames returns the names of all the labels that the item has or inherits.
+func (itemData *itemData) labelNames() []string {
+	var names []string
+	for name := range itemData.labels {
+		names = append(names, name)
+	}
+	for _, parent := range itemData.parents {
+		names = append(names, parent.labelNames()...)
+	}
+	return names
+}
+
 // parentData holds the data that we know about each parent (i.e. each security profile).  Since,
 // profiles consist of multiple resources in our data-model, any of the fields may be nil if we
 // have partial information.
@@ -98,12 +111,28 @@ type parentData struct {
 	itemIDs set.Set
 }
 
+// labelNames returns the names of all the labels that the parent provides.
+func (parent *parentData) labelNames() []string {
+	names := make([]string, 0, len(parent.labels)+len(parent.tags))
+	for name := range parent.labels {
+		names = append(names, name)
+	}
+	return append(names, parent.tags...)
+}
+
+// maxFreeOldValueMaps is the maximum number of spare maps that the InheritIndex keeps for
+// reuse.
+const maxFreeOldValueMaps = 100
+
 type MatchCallback func(selId, labelId interface{})
 
 type InheritIndex struct {
 	itemDataByID         map[interface{}]*itemData
 	parentDataByParentID map[string]*parentData
 	selectorsById        map[interface{}]selector.Selector
+	// selectorIndex indexes the selectors by the label values that they test so that,
+	// when an item's labels change, we only re-evaluate the selectors that may be affected.
+	selectorIndex *selectorIndex
 
 	// Current matches.
 	selIdsByLabelId map[interface{}]set.Set
@@ -113,7 +142,22 @@ type InheritIndex struct {
 	OnMatchStarted MatchCallback
 	OnMatchStopped MatchCallback
 
-	dirtyItemIDs set.Set
+	// dirtyItems contains the IDs of the items that need to be re-evaluated.  For an item
+	// whose labels have changed, the value maps from the name of each label that may have
+	// changed to the label's value before the change.  For a new or deleted item, the value
+	// is nil, meaning that all selectors need to be re-evaluated.
+	dirtyItems map[interface{}]map[string]labelValue
+	// freeOldValueMaps holds emptied maps from dirtyItems for reuse, saving an allocation
+	// for every label update.  Capped at maxFreeOldValueMaps so that a large burst of updates
+	// doesn't pin memory.
+	freeOldValueMaps []map[string]labelValue
+	// candidateSelIDs is a scratch set, reused by scanCandidateSelectors().
+	candidateSelIDs set.Set
+
+	// interner deduplicates the label names and values (and tags) that we store.  Endpoints
+	// typically share most of their labels with many other endpoints so, at scale, this saves
+	// a lot of occupancy.
+	interner *stringutils.Interner
 }
 
 func NewInheritIndex(onMatchStarted, onMatchStopped MatchCallback) *InheritIndex {
@@ -122,6 +166,7 @@ func NewInheritIndex(onMatchStarted, onMatchStopped MatchCallback) *InheritIndex
 		itemDataByID:         itemData,
 		parentDataByParentID: map[string]*parentData{},
 		selectorsById:        map[interface{}]selector.Selector{},
+		selectorIndex:        newSelectorIndex(),
 
 		selIdsByLabelId: map[interface{}]set.Set{},
 		labelIdsBySelId: map[interface{}]set.Set{},
@@ -130,7 +175,10 @@ func NewInheritIndex(onMatchStarted, onMatchStopped MatchCallback) *InheritIndex
 		OnMatchStarted: onMatchStarted,
 		OnMatchStopped: onMatchStopped,
 
-		dirtyItemIDs: set.New(),
+		dirtyItems:      map[interface{}]map[string]labelValue{},
+		candidateSelIDs: set.New(),
+
+		interner: stringutils.NewInterner(),
 	}
 	return &inheritIDx
 }
@@ -196,6 +244,7 @@ func (idx *InheritIndex) UpdateSelector(id interface{}, sel selector.Selector) {
 	}
 	idx.scanAllLabels(id, sel)
 	idx.selectorsById[id] = sel
+	idx.selectorIndex.Update(id, sel)
 }
 
 func (idx *InheritIndex) DeleteSelector(id interface{}) {
@@ -209,11 +258,11 @@ func (idx *InheritIndex) DeleteSelector(id interface{}) {
 		})
 	}
 	delete(idx.selectorsById, id)
+	idx.selectorIndex.Delete(id)
 }
 
 func (idx *InheritIndex) UpdateLabels(id interface{}, labels map[string]string, parentIDs []string) {
 	log.Debug("Inherit index updating labels for ", id)
-	log.Debug("Num dirty items ", idx.dirtyItemIDs.Len(), " items")
 
 	oldItemData := idx.itemDataByID[id]
 	var oldParents []*parentData
@@ -226,9 +275,8 @@ func (idx *InheritIndex) UpdateLabels(id interface{}, labels map[string]string,
 			return
 		}
 	}
-	newItemData := &itemData{}
-	if len(labels) > 0 {
-		newItemData.labels = labels
+	newItemData := &itemData{
+		labels: idx.interner.InternMap(labels),
 	}
 	if len(parentIDs) > 0 {
 		parents := make([]*parentData, len(parentIDs))
@@ -237,13 +285,21 @@ func (idx *InheritIndex) UpdateLabels(id interface{}, labels map[string]string,
 		}
 		newItemData.parents = parents
 	}
+	if oldItemData != nil {
+		// Only the labels that the item had before or has now can have changed.  Record
+		// their old values before we replace the item's data.
+		idx.markItemDirty(id, append(oldItemData.labelNames(), newItemData.labelNames()...))
+	} else {
+		idx.markItemFullyDirty(id)
+	}
 	idx.itemDataByID[id] = newItemData
+	if oldItemData != nil {
+		idx.interner.ReleaseMap(oldItemData.labels)
+	}
 
 	idx.onItemParentsUpdate(id, oldParents, newItemData.parents)
 
-	idx.dirtyItemIDs.Add(id)
 	idx.flushUpdates()
-	log.Debug("Num ending dirty items ", idx.dirtyItemIDs.Len(), " items")
 }
 
 func (idx *InheritIndex) DeleteLabels(id interface{}) {
@@ -252,13 +308,51 @@ func (idx *InheritIndex) DeleteLabels(id interface{}) {
 	var oldParents []*parentData
 	if oldItemData != nil {
 		oldParents = oldItemData.parents
+		idx.interner.ReleaseMap(oldItemData.labels)
 	}
 	delete(idx.itemDataByID, id)
 	idx.onItemParentsUpdate(id, oldParents, nil)
-	idx.dirtyItemIDs.Add(id)
+	idx.markItemFullyDirty(id)
 	idx.flushUpdates()
 }
 
+// markItemDirty marks the item as needing re-evaluation because the named labels may have
+// changed.  It must be called before the change so that it can record the labels' old values.
+func (idx *InheritIndex) markItemDirty(id interface{}, labelNames []string) {
+	oldValues, alreadyDirty := idx.dirtyItems[id]
+	if alreadyDirty && oldValues == nil {
+		// Already needs a full re-evaluation.
+		return
+	}
+	item := idx.itemDataByID[id]
+	if item == nil {
+		idx.markItemFullyDirty(id)
+		return
+	}
+	if oldValues == nil {
+		if n := len(idx.freeOldValueMaps); n > 0 {
+			oldValues = idx.freeOldValueMaps[n-1]
+			idx.freeOldValueMaps = idx.freeOldValueMaps[:n-1]
+		} else {
+			oldValues = map[string]labelValue{}
+		}
+		idx.dirtyItems[id] = oldValues
+	}
+	for _, name := range labelNames {
+		if _, ok := oldValues[name]; ok {
+			// Keep the value from before the first change.
+			continue
+		}
+		value, present := item.Get(name)
+		oldValues[name] = labelValue{value: value, present: present}
+	}
+}
+
+// markItemFullyDirty marks the item as needing all selectors re-evaluated.
+func (idx *InheritIndex) markItemFullyDirty(id interface{}) {
+	idx.dirtyItems[id] = nil
+}
+
 func (idx *InheritIndex) getOrCreateParent(id string) *parentData {
 	parent := idx.parentDataByParentID[id]
 	if parent == nil {
@@ -316,8 +410,11 @@ func (idx *InheritIndex) onItemParentsUpdate(id interface{}, oldParents, newPare
 
 func (idx *InheritIndex) UpdateParentLabels(parentID string, labels map[string]string) {
 	parent := idx.getOrCreateParent(parentID)
-	parent.labels = labels
-	idx.flushChildren(parentID)
+	idx.markChildrenDirty(parent, labelNames(labels))
+	oldLabels := parent.labels
+	parent.labels = idx.interner.InternMap(labels)
+	idx.interner.ReleaseMap(oldLabels)
+	idx.flushUpdates()
 }
 
 func (idx *InheritIndex) DeleteParentLabels(parentID string) {
@@ -325,43 +422,62 @@ func (idx *InheritIndex) DeleteParentLabels(parentID string) {
 	if parent == nil {
 		return
 	}
+	idx.markChildrenDirty(parent, nil)
+	idx.interner.ReleaseMap(parent.labels)
 	parent.labels = nil
 	idx.discardParentIfEmpty(parentID)
-	idx.flushChildren(parentID)
+	idx.flushUpdates()
 }
 
 func (idx *InheritIndex) UpdateParentTags(parentID string, tags []string) {
 	parent := idx.getOrCreateParent(parentID)
-	parent.tags = tags
-	idx.flushChildren(parentID)
+	idx.markChildrenDirty(parent, tags)
+	oldTags := parent.tags
+	parent.tags = idx.interner.InternSlice(tags)
+	idx.interner.ReleaseSlice(oldTags)
+	idx.flushUpdates()
 }
 
 func (idx *InheritIndex) DeleteParentTags(parentID string) {
-	parentData := idx.parentDataByParentID[parentID]
-	if parentData == nil {
+	parent := idx.parentDataByParentID[parentID]
+	if parent == nil {
 		return
 	}
-	parentData.tags = nil
+	idx.markChildrenDirty(parent, nil)
+	idx.interner.ReleaseSlice(parent.tags)
+	parent.tags = nil
 	idx.discardParentIfEmpty(parentID)
-	idx.flushChildren(parentID)
+	idx.flushUpdates()
 }
 
-func (idx *InheritIndex) flushChildren(parentID string) {
-	parentData := idx.parentDataByParentID[parentID]
-	if parentData != nil && parentData.itemIDs != nil {
-		parentData.itemIDs.Iter(func(itemID interface{}) error {
-			log.Debug("Marking child ", itemID, " dirty")
-			idx.dirtyItemIDs.Add(itemID)
-			return nil
-		})
+// markChildrenDirty marks the parent's children as dirty ahead of a change to the parent's
+// labels or tags.  The labels that may change are the ones that the parent currently provides,
+// plus newLabelNames.
+func (idx *InheritIndex) markChildrenDirty(parent *parentData, newLabelNames []string) {
+	if parent.itemIDs == nil {
+		return
 	}
-	idx.flushUpdates()
+	changedNames := append(parent.labelNames(), newLabelNames...)
+	parent.itemIDs.Iter(func(itemID interface{}) error {
+		log.Debug("Marking child ", itemID, " dirty")
+		idx.markItemDirty(itemID, changedNames)
+		return nil
+	})
+}
+
+func labelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	return names
 }
 
 func (idx *InheritIndex) flushUpdates() {
-	idx.dirtyItemIDs.Iter(func(itemID interface{}) error {
+	for itemID, oldValues := range idx.dirtyItems {
+		delete(idx.dirtyItems, itemID)
 		log.Debugf("Flushing %#v", itemID)
-		_, ok := idx.itemDataByID[itemID]
+		item, ok := idx.itemDataByID[itemID]
 		if !ok {
 			// Item deleted.
 			log.Debugf("Flushing delete of item %v", itemID)
@@ -373,13 +489,22 @@ func (idx *InheritIndex) flushUpdates() {
 					return nil
 				})
 			}
+		} else if oldValues == nil {
+			// Item created, evaluate all selectors.
+			log.Debugf("Flushing creation of item %v", itemID)
+			idx.scanAllSelectors(itemID)
 		} else {
-			// Item updated/created, re-evaluate labels.
+			// Item's labels updated, re-evaluate the selectors that may be affected.
 			log.Debugf("Flushing update of item %v", itemID)
-			idx.scanAllSelectors(itemID)
+			idx.scanCandidateSelectors(itemID, item, oldValues)
 		}
-		return set.RemoveItem
-	})
+		if oldValues != nil && len(idx.freeOldValueMaps) < maxFreeOldValueMaps {
+			for name := range oldValues {
+				delete(oldValues, name)
+			}
+			idx.freeOldValueMaps = append(idx.freeOldValueMaps, oldValues)
+		}
+	}
 }
 
 func (idx *InheritIndex) scanAllLabels(selId interface{}, sel selector.Selector) {
@@ -399,6 +524,38 @@ func (idx *InheritIndex) scanAllSelectors(labelId interface{}) {
 	}
 }
 
+// scanCandidateSelectors re-evaluates the selectors whose results may have changed, given the
+// old values of the labels that may have changed.
+func (idx *InheritIndex) scanCandidateSelectors(
+	labelId interface{},
+	labels *itemData,
+	oldValues map[string]labelValue,
+) {
+	candidates := idx.candidateSelIDs
+	defer candidates.Clear()
+	anyChanged := false
+	for name, oldValue := range oldValues {
+		value, present := labels.Get(name)
+		newValue := labelValue{value: value, present: present}
+		if newValue == oldValue {
+			continue
+		}
+		anyChanged = true
+		idx.selectorIndex.AddCandidates(name, oldValue, newValue, candidates)
+	}
+	if !anyChanged {
+		log.Debugf("No change to effective labels of %v", labelId)
+		return
+	}
+	idx.selectorIndex.AddUnindexed(candidates)
+	log.Debugf("Scanning %v candidate selectors (of %v) against labels %v",
+		candidates.Len(), len(idx.selectorsById), labelId)
+	candidates.Iter(func(selId interface{}) error {
+		idx.updateMatches(selId, idx.selectorsById[selId], labelId, labels)
+		return nil
+	})
+}
+
 func (idx *InheritIndex) updateMatches(
 	selId interface{},
 	sel selector.Selector,
@@ -0,0 +1,48 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labelindex
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("InheritIndex string interning", func() {
+	var idx *InheritIndex
+
+	BeforeEach(func() {
+		idx = NewInheritIndex(func(selId, labelId interface{}) {}, func(selId, labelId interface{}) {})
+	})
+
+	It("should share label storage between items and release it on deletion", func() {
+		idx.UpdateLabels("l1", map[string]string{"a": "b", "c": "d"}, []string{"p1"})
+		idx.UpdateLabels("l2", map[string]string{"a": "b"}, []string{"p1"})
+		idx.UpdateParentLabels("p1", map[string]string{"a": "e"})
+		idx.UpdateParentTags("p1", []string{"c", "f"})
+		Expect(idx.interner.Len()).To(Equal(6))
+
+		By("releasing replaced labels")
+		idx.UpdateLabels("l1", map[string]string{"a": "b"}, []string{"p1"})
+		Expect(idx.interner.Len()).To(Equal(5))
+
+		By("releasing everything once all the data is deleted")
+		idx.DeleteLabels("l1")
+		idx.DeleteLabels("l2")
+		idx.DeleteParentLabels("p1")
+		idx.DeleteParentTags("p1")
+		Expect(idx.interner.Len()).To(Equal(0))
+		Expect(idx.parentDataByParentID).To(BeEmpty())
+	})
+})
@@ -0,0 +1,201 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labelindex
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/set"
+	"github.com/projectcalico/libcalico-go/lib/selector"
+	"github.com/projectcalico/libcalico-go/lib/selector/tokenizer"
+)
+
+// labelValue is the value of a label, as seen by a selector.  A label that is not present is
+// distinct from one with an empty value.
+type labelValue struct {
+	value   string
+	present bool
+}
+
+// selectorIndexKey is the key of the selectorIndex.  Either the label name and a value that a
+// selector compares it with or, if isHas is set, the name of a label in a has() term.
+type selectorIndexKey struct {
+	name  string
+	value string
+	isHas bool
+}
+
+// selectorIndex is an inverted index from label values to the selectors whose result may
+// depend on them.  It allows us to find the selectors that need to be re-evaluated when some
+// of an item's labels change, without scanning every selector.
+//
+// Every term in our selector language (other than all(), which is constant) tests a single
+// label:
+//
+//	a == "x", a != "x", a in {"x", "y"}, a not in {"x", "y"}, has(a)
+//
+// A comparison term's result can only change if the label's old or new value is one of the
+// values that it mentions.  A has() term's result can only change if the label is added or
+// removed.  Since a selector is a boolean combination of its terms, its result can only change
+// if one of its terms' results changes.  So, we index each selector by the (label, value)
+// pairs in its comparison terms and by the labels in its has() terms.
+//
+// We extract the terms from the selector's tokens.  If a selector contains a construct that
+// we don't recognise, we store it as unindexed, which makes it a candidate for every change.
+type selectorIndex struct {
+	selIDsByKey     map[selectorIndexKey]set.Set
+	unindexedSelIDs set.Set
+
+	// keysBySelID contains the keys that we stored each selector under, so that we can
+	// remove it.
+	keysBySelID map[interface{}][]selectorIndexKey
+}
+
+func newSelectorIndex() *selectorIndex {
+	return &selectorIndex{
+		selIDsByKey:     map[selectorIndexKey]set.Set{},
+		unindexedSelIDs: set.New(),
+		keysBySelID:     map[interface{}][]selectorIndexKey{},
+	}
+}
+
+// Update adds the selector to the index, replacing any previous selector with the same ID.
+func (s *selectorIndex) Update(selID interface{}, sel selector.Selector) {
+	s.Delete(selID)
+	keys, ok := extractSelectorIndexKeys(sel)
+	if !ok {
+		log.WithField("selector", sel.String()).Info(
+			"Unable to index selector, it will be re-evaluated on every label change")
+		s.unindexedSelIDs.Add(selID)
+		return
+	}
+	for _, key := range keys {
+		selIDs := s.selIDsByKey[key]
+		if selIDs == nil {
+			selIDs = set.New()
+			s.selIDsByKey[key] = selIDs
+		}
+		selIDs.Add(selID)
+	}
+	s.keysBySelID[selID] = keys
+}
+
+// Delete removes the selector from the index, if present.
+func (s *selectorIndex) Delete(selID interface{}) {
+	s.unindexedSelIDs.Discard(selID)
+	for _, key := range s.keysBySelID[selID] {
+		selIDs := s.selIDsByKey[key]
+		selIDs.Discard(selID)
+		if selIDs.Len() == 0 {
+			delete(s.selIDsByKey, key)
+		}
+	}
+	delete(s.keysBySelID, selID)
+}
+
+// AddCandidates adds to candidates the IDs of the selectors whose result may change if the
+// named label changes from oldValue to newValue.
+func (s *selectorIndex) AddCandidates(name string, oldValue, newValue labelValue, candidates set.Set) {
+	if oldValue.present {
+		s.addAll(selectorIndexKey{name: name, value: oldValue.value}, candidates)
+	}
+	if newValue.present {
+		s.addAll(selectorIndexKey{name: name, value: newValue.value}, candidates)
+	}
+	if oldValue.present != newValue.present {
+		s.addAll(selectorIndexKey{name: name, isHas: true}, candidates)
+	}
+}
+
+func (s *selectorIndex) addAll(key selectorIndexKey, candidates set.Set) {
+	selIDs := s.selIDsByKey[key]
+	if selIDs == nil {
+		return
+	}
+	selIDs.Iter(func(selID interface{}) error {
+		candidates.Add(selID)
+		return nil
+	})
+}
+
+// AddUnindexed adds to candidates the IDs of the selectors that we couldn't index.
+func (s *selectorIndex) AddUnindexed(candidates set.Set) {
+	s.unindexedSelIDs.Iter(func(selID interface{}) error {
+		candidates.Add(selID)
+		return nil
+	})
+}
+
+// extractSelectorIndexKeys tokenizes the selector and returns the keys for its terms.  It
+// returns ok=false if the selector contains something that we don't understand.
+func extractSelectorIndexKeys(sel selector.Selector) (keys []selectorIndexKey, ok bool) {
+	tokens, err := tokenizer.Tokenize(sel.String())
+	if err != nil {
+		return nil, false
+	}
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i].Kind {
+		case tokenizer.TokHas:
+			keys = append(keys, selectorIndexKey{name: tokens[i].Value.(string), isHas: true})
+		case tokenizer.TokLabel:
+			name := tokens[i].Value.(string)
+			values, consumed, ok := parseComparison(tokens[i+1:])
+			if !ok {
+				return nil, false
+			}
+			for _, value := range values {
+				keys = append(keys, selectorIndexKey{name: name, value: value})
+			}
+			i += consumed
+		case tokenizer.TokAll, tokenizer.TokNot, tokenizer.TokAnd, tokenizer.TokOr,
+			tokenizer.TokLParen, tokenizer.TokRParen, tokenizer.TokEof:
+			// Structural tokens, which don't test any labels.
+		default:
+			return nil, false
+		}
+	}
+	return keys, true
+}
+
+// parseComparison parses the operator and value(s) that follow the label in a comparison
+// term, returning the values and the number of tokens consumed.
+func parseComparison(tokens []tokenizer.Token) (values []string, consumed int, ok bool) {
+	if len(tokens) < 2 {
+		return
+	}
+	switch tokens[0].Kind {
+	case tokenizer.TokEq, tokenizer.TokNe:
+		if tokens[1].Kind != tokenizer.TokStringLiteral {
+			return
+		}
+		return []string{tokens[1].Value.(string)}, 2, true
+	case tokenizer.TokIn, tokenizer.TokNotIn:
+		if tokens[1].Kind != tokenizer.TokLBrace {
+			return
+		}
+		for i := 2; i < len(tokens); i++ {
+			switch tokens[i].Kind {
+			case tokenizer.TokStringLiteral:
+				values = append(values, tokens[i].Value.(string))
+			case tokenizer.TokComma:
+			case tokenizer.TokRBrace:
+				return values, i + 1, true
+			default:
+				return nil, 0, false
+			}
+		}
+	}
+	return nil, 0, false
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labelindex
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/set"
+	"github.com/projectcalico/libcalico-go/lib/selector"
+)
+
+var _ = DescribeTable("Selector index key extraction",
+	func(sel string, expectedKeys []selectorIndexKey, expectedOK bool) {
+		parsed, err := selector.Parse(sel)
+		Expect(err).NotTo(HaveOccurred())
+		keys, ok := extractSelectorIndexKeys(parsed)
+		Expect(ok).To(Equal(expectedOK))
+		Expect(keys).To(Equal(expectedKeys))
+	},
+	Entry("all()", "all()", []selectorIndexKey(nil), true),
+	Entry("equality", `a == "x"`, []selectorIndexKey{{name: "a", value: "x"}}, true),
+	Entry("inequality", `a != "x"`, []selectorIndexKey{{name: "a", value: "x"}}, true),
+	Entry("has", `has(a)`, []selectorIndexKey{{name: "a", isHas: true}}, true),
+	Entry("in", `a in {"x", "y"}`, []selectorIndexKey{
+		{name: "a", value: "x"},
+		{name: "a", value: "y"},
+	}, true),
+	Entry("not in", `a not in {"x"}`, []selectorIndexKey{{name: "a", value: "x"}}, true),
+	Entry("compound", `(a == "x" || !has(b)) && c in {}`, []selectorIndexKey{
+		{name: "a", value: "x"},
+		{name: "b", isHas: true},
+	}, true),
+)
+
+var _ = Describe("Selector index", func() {
+	var idx *selectorIndex
+
+	BeforeEach(func() {
+		idx = newSelectorIndex()
+		for id, sel := range map[string]string{
+			"a-eq-x":  `a == "x"`,
+			"a-ne-y":  `a != "y"`,
+			"has-a":   `has(a)`,
+			"b-in-xy": `b in {"x", "y"}`,
+			"all":     `all()`,
+		} {
+			parsed, err := selector.Parse(sel)
+			Expect(err).NotTo(HaveOccurred())
+			idx.Update(id, parsed)
+		}
+	})
+
+	candidates := func(name string, oldValue, newValue labelValue) set.Set {
+		c := set.New()
+		idx.AddCandidates(name, oldValue, newValue, c)
+		return c
+	}
+	present := func(value string) labelValue {
+		return labelValue{value: value, present: true}
+	}
+	absent := labelValue{}
+
+	It("should return selectors that test the old or new value", func() {
+		Expect(candidates("a", present("x"), present("z"))).To(Equal(set.From("a-eq-x")))
+		Expect(candidates("a", present("x"), present("y"))).To(Equal(set.From("a-eq-x", "a-ne-y")))
+		Expect(candidates("a", present("z"), present("w"))).To(Equal(set.New()))
+		Expect(candidates("b", present("x"), present("y"))).To(Equal(set.From("b-in-xy")))
+	})
+
+	It("should return has() selectors when a label is added or removed", func() {
+		Expect(candidates("a", absent, present("z"))).To(Equal(set.From("has-a")))
+		Expect(candidates("a", present("x"), absent)).To(Equal(set.From("a-eq-x", "has-a")))
+	})
+
+	It("should stop returning deleted selectors", func() {
+		idx.Delete("a-eq-x")
+		idx.Delete("has-a")
+		Expect(candidates("a", present("x"), absent)).To(Equal(set.New()))
+		Expect(idx.selIDsByKey).To(HaveLen(3))
+	})
+
+	It("should re-index updated selectors", func() {
+		parsed, err := selector.Parse(`a == "z"`)
+		Expect(err).NotTo(HaveOccurred())
+		idx.Update("a-eq-x", parsed)
+		Expect(candidates("a", present("x"), present("w"))).To(Equal(set.New()))
+		Expect(candidates("a", present("z"), present("w"))).To(Equal(set.From("a-eq-x")))
+	})
+})
@@ -0,0 +1,126 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/calc"
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/intdataplane"
+	"github.com/projectcalico/felix/loadgen"
+	"github.com/projectcalico/felix/mockdataplane"
+)
+
+const (
+	loadGenBatchSize = 100
+	loadGenTimeout   = 10 * time.Minute
+)
+
+// runLoadGen implements the --load-gen mode.  It loads the local config (but doesn't connect
+// to the datastore), starts the calculation graph and internal dataplane as usual and then
+// uses the loadgen package to feed them synthetic endpoints and policies.  It prints the
+// resulting throughput and latency percentiles and returns the exit code for the process.
+func runLoadGen(arguments map[string]interface{}) int {
+	numEndpoints, err := strconv.Atoi(arguments["--load-gen-endpoints"].(string))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --load-gen-endpoints: %v\n", err)
+		return 1
+	}
+	numPolicies, err := strconv.Atoi(arguments["--load-gen-policies"].(string))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --load-gen-policies: %v\n", err)
+		return 1
+	}
+
+	configFile := arguments["--config-file"].(string)
+	configParams := config.New()
+	envConfig := config.LoadConfigFromEnvironment(os.Environ())
+	fileConfig, err := config.LoadConfigFile(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config file %v: %v\n", configFile, err)
+		return 1
+	}
+	configParams.UpdateFrom(envConfig, config.EnvironmentVariable)
+	configParams.UpdateFrom(fileConfig, config.ConfigFile)
+	if configParams.Err == nil {
+		configParams.Validate()
+	}
+	if configParams.Err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration is invalid: %v\n", configParams.Err)
+		return 1
+	}
+
+	dpConfig := newIntDataplaneConfig(configParams, nil)
+	if !arguments["--load-gen-real-dataplane"].(bool) {
+		log.Info("Load generator using mock dataplane.")
+		dpConfig.ProgrammingLayerOverride = mockdataplane.New()
+	}
+	intDP := intdataplane.NewIntDataplaneDriver(dpConfig)
+	intDP.Start()
+
+	// Wire up the calculation graph and dataplane as the DataplaneConnector would.
+	toDataplane := make(chan interface{})
+	go func() {
+		for msg := range toDataplane {
+			if err := intDP.SendMessage(msg); err != nil {
+				log.WithError(err).Fatal("Failed to send message to dataplane")
+			}
+		}
+	}()
+	fromDataplane := make(chan interface{})
+	go func() {
+		for {
+			msg, err := intDP.RecvMessage()
+			if err != nil {
+				log.WithError(err).Fatal("Failed to receive message from dataplane")
+			}
+			fromDataplane <- msg
+		}
+	}()
+	asyncCalcGraph := calc.NewAsyncCalcGraph(config.NewLiveConfig(configParams), toDataplane, nil)
+	validator := calc.NewValidationFilter(asyncCalcGraph)
+	asyncCalcGraph.Start()
+
+	report, err := loadgen.Run(loadgen.Config{
+		Hostname:     configParams.FelixHostname,
+		NumEndpoints: numEndpoints,
+		NumPolicies:  numPolicies,
+		BatchSize:    loadGenBatchSize,
+		Timeout:      loadGenTimeout,
+	}, validator, fromDataplane)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Endpoints programmed:\t%d of %d\n", report.NumProgrammed(), numEndpoints)
+	fmt.Fprintf(w, "Policies:\t%d\n", numPolicies)
+	fmt.Fprintf(w, "Elapsed time:\t%v\n", report.Elapsed)
+	fmt.Fprintf(w, "Throughput:\t%.1f endpoints/s\n", report.Throughput())
+	for _, p := range []float64{50, 90, 99, 100} {
+		fmt.Fprintf(w, "Latency p%v:\t%v\n", p, report.Percentile(p))
+	}
+	w.Flush()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load generation failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
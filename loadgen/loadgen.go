@@ -0,0 +1,249 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loadgen implements Felix's load-generation mode, which measures how quickly Felix
+// programs endpoints without needing a cluster.  It synthesizes a configurable number of
+// workload endpoints and policies, feeds them through the real calculation graph and
+// dataplane driver, and reports the programming throughput and the distribution of the
+// time taken to program each endpoint.
+package loadgen
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
+
+const (
+	orchestratorID = "loadgen"
+	profileID      = "loadgen"
+
+	// groupLabel is the label that we use to divide the endpoints into numGroups groups.
+	// Each policy applies to one group and allows traffic from another so the IP sets that
+	// the policies use grow with the number of endpoints.
+	groupLabel = "loadgen-group"
+	numGroups  = 10
+)
+
+type Config struct {
+	// Hostname is the hostname that the synthetic endpoints belong to.  It must match
+	// Felix's hostname for the endpoints to be programmed.
+	Hostname     string
+	NumEndpoints int
+	NumPolicies  int
+	// BatchSize is the number of endpoint updates that we send to the calculation graph
+	// at once.
+	BatchSize int
+	// Timeout bounds the time that we wait for all the endpoints to be programmed.
+	Timeout time.Duration
+}
+
+// SnapshotUpdates returns the updates that make up the synthetic datastore's initial
+// snapshot: the ready flag, the profile that all the endpoints use and the policies.
+func (c *Config) SnapshotUpdates() []api.Update {
+	updates := []api.Update{
+		newUpdate(model.ReadyFlagKey{}, true),
+		newUpdate(model.ProfileRulesKey{ProfileKey: model.ProfileKey{Name: profileID}}, &model.ProfileRules{
+			InboundRules:  []model.Rule{{Action: "allow"}},
+			OutboundRules: []model.Rule{{Action: "allow"}},
+		}),
+	}
+	for i := 0; i < c.NumPolicies; i++ {
+		order := float64(i)
+		updates = append(updates, newUpdate(model.PolicyKey{Name: fmt.Sprintf("loadgen-%d", i)}, &model.Policy{
+			Order:    &order,
+			Selector: groupSelector(i),
+			InboundRules: []model.Rule{{
+				Action:      "allow",
+				SrcSelector: groupSelector(i + 1),
+			}},
+			OutboundRules: []model.Rule{{Action: "allow"}},
+		}))
+	}
+	return updates
+}
+
+// EndpointUpdate returns the update that creates the nth synthetic endpoint.
+func (c *Config) EndpointUpdate(n int) api.Update {
+	id := EndpointID(n)
+	_, ipNet, err := net.ParseCIDR(fmt.Sprintf("10.%d.%d.%d/32", (n>>16)&0xff, (n>>8)&0xff, n&0xff))
+	if err != nil {
+		log.WithError(err).Panic("Failed to generate endpoint IP")
+	}
+	return newUpdate(model.WorkloadEndpointKey{
+		Hostname:       c.Hostname,
+		OrchestratorID: id.OrchestratorId,
+		WorkloadID:     id.WorkloadId,
+		EndpointID:     id.EndpointId,
+	}, &model.WorkloadEndpoint{
+		State:      "active",
+		Name:       fmt.Sprintf("calilg%d", n),
+		ProfileIDs: []string{profileID},
+		IPv4Nets:   []net.IPNet{*ipNet},
+		Labels: map[string]string{
+			groupLabel: fmt.Sprint(n % numGroups),
+		},
+	})
+}
+
+// EndpointID returns the ID that the dataplane uses for the nth synthetic endpoint.
+func EndpointID(n int) proto.WorkloadEndpointID {
+	return proto.WorkloadEndpointID{
+		OrchestratorId: orchestratorID,
+		WorkloadId:     fmt.Sprintf("workload-%d", n),
+		EndpointId:     "eth0",
+	}
+}
+
+func groupSelector(i int) string {
+	return fmt.Sprintf("%s == '%d'", groupLabel, i%numGroups)
+}
+
+func newUpdate(key model.Key, value interface{}) api.Update {
+	return api.Update{
+		KVPair: model.KVPair{
+			Key:   key,
+			Value: value,
+		},
+		UpdateType: api.UpdateTypeKVNew,
+	}
+}
+
+// Run sends the synthetic snapshot to the calculation graph (via callbacks) and then streams
+// in the endpoints, recording the time between sending each endpoint and the dataplane
+// reporting its status on fromDataplane, which happens once the endpoint has been programmed.
+// It returns when every endpoint has been reported or the timeout expires, in which case the
+// report covers the endpoints that were programmed in time.
+func Run(config Config, callbacks api.SyncerCallbacks, fromDataplane <-chan interface{}) (*Report, error) {
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	callbacks.OnStatusUpdated(api.ResyncInProgress)
+	callbacks.OnUpdates(config.SnapshotUpdates())
+	callbacks.OnStatusUpdated(api.InSync)
+
+	// Send the endpoints from a background goroutine; sending may block until the
+	// dataplane catches up, which requires us to keep draining its status reports.
+	var lock sync.Mutex
+	sendTimes := map[proto.WorkloadEndpointID]time.Time{}
+	start := time.Now()
+	go func() {
+		for first := 0; first < config.NumEndpoints; first += batchSize {
+			last := first + batchSize
+			if last > config.NumEndpoints {
+				last = config.NumEndpoints
+			}
+			batch := make([]api.Update, 0, last-first)
+			now := time.Now()
+			lock.Lock()
+			for n := first; n < last; n++ {
+				batch = append(batch, config.EndpointUpdate(n))
+				sendTimes[EndpointID(n)] = now
+			}
+			lock.Unlock()
+			callbacks.OnUpdates(batch)
+		}
+		log.WithField("numEndpoints", config.NumEndpoints).Info("Sent all synthetic endpoints")
+	}()
+
+	var timeoutC <-chan time.Time
+	if config.Timeout > 0 {
+		timeoutC = time.After(config.Timeout)
+	}
+	latencies := make([]time.Duration, 0, config.NumEndpoints)
+	for len(latencies) < config.NumEndpoints {
+		select {
+		case msg := <-fromDataplane:
+			update, ok := msg.(*proto.WorkloadEndpointStatusUpdate)
+			if !ok {
+				continue
+			}
+			lock.Lock()
+			sendTime, ok := sendTimes[*update.Id]
+			delete(sendTimes, *update.Id)
+			lock.Unlock()
+			if !ok {
+				// Not one of ours, or a repeat report.
+				continue
+			}
+			latencies = append(latencies, time.Since(sendTime))
+		case <-timeoutC:
+			return newReport(latencies, time.Since(start)), fmt.Errorf(
+				"timed out after programming %d of %d endpoints", len(latencies), config.NumEndpoints)
+		}
+	}
+	return newReport(latencies, time.Since(start)), nil
+}
+
+// Report summarises a load-generation run.
+type Report struct {
+	// Elapsed is the time from sending the first endpoint until the last one was
+	// programmed.
+	Elapsed time.Duration
+	// latencies holds the time taken to program each endpoint, in ascending order.
+	latencies []time.Duration
+}
+
+func newReport(latencies []time.Duration, elapsed time.Duration) *Report {
+	sort.Sort(durations(latencies))
+	return &Report{
+		Elapsed:   elapsed,
+		latencies: latencies,
+	}
+}
+
+// NumProgrammed returns the number of endpoints that were programmed.
+func (r *Report) NumProgrammed() int {
+	return len(r.latencies)
+}
+
+// Throughput returns the number of endpoints programmed per second.
+func (r *Report) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(len(r.latencies)) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the pth percentile (0 < p <= 100) of the time taken to program an
+// endpoint, using the nearest-rank method.  It returns 0 if no endpoints were programmed.
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(r.latencies)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(r.latencies) {
+		rank = len(r.latencies) - 1
+	}
+	return r.latencies[rank]
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
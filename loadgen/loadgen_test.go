@@ -0,0 +1,128 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadgen_test
+
+import (
+	. "github.com/projectcalico/felix/loadgen"
+
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+// fakePipeline stands in for the calculation graph and dataplane.  It reports a status for
+// each workload endpoint that it's sent, unless dropEndpoints is set.
+type fakePipeline struct {
+	fromDataplane chan interface{}
+	statuses      []api.SyncStatus
+	dropEndpoints bool
+}
+
+func (f *fakePipeline) OnStatusUpdated(status api.SyncStatus) {
+	f.statuses = append(f.statuses, status)
+}
+
+func (f *fakePipeline) OnUpdates(updates []api.Update) {
+	for _, u := range updates {
+		key, ok := u.Key.(model.WorkloadEndpointKey)
+		if !ok || f.dropEndpoints {
+			continue
+		}
+		id := proto.WorkloadEndpointID{
+			OrchestratorId: key.OrchestratorID,
+			WorkloadId:     key.WorkloadID,
+			EndpointId:     key.EndpointID,
+		}
+		status := &proto.WorkloadEndpointStatusUpdate{
+			Id:     &id,
+			Status: &proto.EndpointStatus{Status: "down"},
+		}
+		// Repeated reports and other messages should be ignored.
+		f.fromDataplane <- status
+		f.fromDataplane <- &proto.ProcessStatusUpdate{}
+		f.fromDataplane <- status
+	}
+}
+
+var _ = Describe("Load generator", func() {
+	var config Config
+	var pipeline *fakePipeline
+
+	BeforeEach(func() {
+		config = Config{
+			Hostname:     "myhost",
+			NumEndpoints: 25,
+			NumPolicies:  3,
+			BatchSize:    10,
+			Timeout:      10 * time.Second,
+		}
+		pipeline = &fakePipeline{
+			fromDataplane: make(chan interface{}, 100),
+		}
+	})
+
+	It("should generate a snapshot with the ready flag, profile and policies", func() {
+		updates := config.SnapshotUpdates()
+		Expect(updates).To(HaveLen(5))
+		Expect(updates[0].Key).To(Equal(model.ReadyFlagKey{}))
+		Expect(updates[0].Value).To(Equal(true))
+		var numPolicies int
+		for _, u := range updates {
+			if _, ok := u.Key.(model.PolicyKey); ok {
+				numPolicies++
+				Expect(u.Value.(*model.Policy).Selector).NotTo(BeEmpty())
+			}
+		}
+		Expect(numPolicies).To(Equal(3))
+	})
+
+	It("should generate distinct local endpoints", func() {
+		u1 := config.EndpointUpdate(1)
+		u2 := config.EndpointUpdate(257)
+		Expect(u1.Key.(model.WorkloadEndpointKey).Hostname).To(Equal("myhost"))
+		Expect(u1.Key).NotTo(Equal(u2.Key))
+		ep1 := u1.Value.(*model.WorkloadEndpoint)
+		ep2 := u2.Value.(*model.WorkloadEndpoint)
+		Expect(ep1.Name).NotTo(Equal(ep2.Name))
+		Expect(ep1.IPv4Nets[0].String()).To(Equal("10.0.0.1/32"))
+		Expect(ep2.IPv4Nets[0].String()).To(Equal("10.0.1.1/32"))
+		Expect(u1.Key.(model.WorkloadEndpointKey).WorkloadID).To(Equal(EndpointID(1).WorkloadId))
+	})
+
+	It("should report on every endpoint", func() {
+		report, err := Run(config, pipeline, pipeline.fromDataplane)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pipeline.statuses).To(Equal([]api.SyncStatus{api.ResyncInProgress, api.InSync}))
+		Expect(report.NumProgrammed()).To(Equal(25))
+		Expect(report.Throughput()).To(BeNumerically(">", 0))
+		Expect(report.Percentile(50)).To(BeNumerically("<=", report.Percentile(100)))
+		Expect(report.Percentile(100)).To(BeNumerically("<=", report.Elapsed))
+	})
+
+	It("should time out if the endpoints aren't programmed", func() {
+		pipeline.dropEndpoints = true
+		config.Timeout = 50 * time.Millisecond
+		report, err := Run(config, pipeline, pipeline.fromDataplane)
+		Expect(err).To(HaveOccurred())
+		Expect(report.NumProgrammed()).To(Equal(0))
+		Expect(report.Throughput()).To(BeZero())
+		Expect(report.Percentile(99)).To(BeZero())
+	})
+})
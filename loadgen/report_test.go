@@ -0,0 +1,48 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadgen
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Report", func() {
+	var report *Report
+
+	BeforeEach(func() {
+		var latencies []time.Duration
+		for i := 10; i > 0; i-- {
+			latencies = append(latencies, time.Duration(i)*time.Millisecond)
+		}
+		report = newReport(latencies, 2*time.Second)
+	})
+
+	It("should calculate throughput", func() {
+		Expect(report.NumProgrammed()).To(Equal(10))
+		Expect(report.Throughput()).To(BeNumerically("==", 5))
+	})
+
+	It("should calculate nearest-rank percentiles", func() {
+		Expect(report.Percentile(1)).To(Equal(1 * time.Millisecond))
+		Expect(report.Percentile(50)).To(Equal(5 * time.Millisecond))
+		Expect(report.Percentile(51)).To(Equal(6 * time.Millisecond))
+		Expect(report.Percentile(90)).To(Equal(9 * time.Millisecond))
+		Expect(report.Percentile(99)).To(Equal(10 * time.Millisecond))
+		Expect(report.Percentile(100)).To(Equal(10 * time.Millisecond))
+	})
+})
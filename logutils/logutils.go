@@ -16,6 +16,8 @@ package logutils
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/syslog"
@@ -32,6 +34,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/flowlog"
 )
 
 var (
@@ -54,6 +57,55 @@ func init() {
 
 const logQueueSize = 100
 
+// subsystemPathFragments maps from a fragment of the path of a source file to the subsystem
+// that the file's logs belong to, for the purposes of the per-subsystem log levels.
+var subsystemPathFragments = []struct {
+	fragment  string
+	subsystem string
+}{
+	{"/felix/iptables/", "iptables"},
+	{"/felix/ipsets/", "ipsets"},
+	{"/felix/routetable/", "routes"},
+	{"/felix/calc/", "calc-graph"},
+	{"/libcalico-go/lib/backend/", "datastore"},
+}
+
+// subsystemForFile returns the subsystem that the given source file belongs to, or "" if it
+// doesn't belong to one.
+func subsystemForFile(file string) string {
+	for _, f := range subsystemPathFragments {
+		if strings.Contains(file, f.fragment) {
+			return f.subsystem
+		}
+	}
+	return ""
+}
+
+// subsystemLevels returns the per-subsystem log level overrides from the config.
+func subsystemLevels(configParams *config.Config) map[string]log.Level {
+	levels := map[string]log.Level{}
+	for subsystem, rawLevel := range map[string]string{
+		"iptables":   configParams.LogSeverityIptables,
+		"ipsets":     configParams.LogSeverityIPSets,
+		"routes":     configParams.LogSeverityRoutes,
+		"calc-graph": configParams.LogSeverityCalcGraph,
+		"datastore":  configParams.LogSeverityDatastore,
+	} {
+		if rawLevel != "" {
+			levels[subsystem] = safeParseLogLevel(rawLevel)
+		}
+	}
+	return levels
+}
+
+// configured records the logging targets that ConfigureLogging set up so that UpdateLogLevels
+// can adjust their levels later.
+var configured struct {
+	hook                                      *BackgroundHook
+	screenDest, fileDest, syslogDest          *Destination
+	screenEnabled, fileEnabled, syslogEnabled bool
+}
+
 // ConfigureEarlyLogging installs our logging adapters, and enables early logging to screen
 // if it is enabled by either the FELIX_EARLYLOGSEVERITYSCREEN or FELIX_LOGSEVERITYSCREEN
 // environment variable.
@@ -97,23 +149,17 @@ func ConfigureLogging(configParams *config.Config) {
 	logLevelScreen := safeParseLogLevel(configParams.LogSeverityScreen)
 	logLevelFile := safeParseLogLevel(configParams.LogSeverityFile)
 	logLevelSyslog := safeParseLogLevel(configParams.LogSeveritySys)
+	logLevelsBySubsystem := subsystemLevels(configParams)
 
-	// Work out the most verbose level that is being logged.
-	mostVerboseLevel := logLevelScreen
-	if logLevelFile > mostVerboseLevel {
-		mostVerboseLevel = logLevelFile
-	}
-	if logLevelSyslog > mostVerboseLevel {
-		mostVerboseLevel = logLevelScreen
-	}
 	// Disable all more-verbose levels using the global setting, this ensures that debug logs
 	// are filtered out as early as possible.
-	log.SetLevel(mostVerboseLevel)
+	log.SetLevel(mostVerbose(logLevelScreen, logLevelFile, logLevelSyslog, logLevelsBySubsystem))
 
 	// Screen target.
 	var dests []*Destination
+	var screenDest, fileDest, syslogDest *Destination
 	if configParams.LogSeverityScreen != "" {
-		screenDest := NewStreamDestination(
+		screenDest = NewStreamDestination(
 			logLevelScreen,
 			os.Stderr,
 			make(chan QueuedLog, logQueueSize),
@@ -127,12 +173,29 @@ func ConfigureLogging(configParams *config.Config) {
 	var fileDirErr, fileOpenErr error
 	if configParams.LogSeverityFile != "" && configParams.LogFilePath != "" {
 		fileDirErr = os.MkdirAll(path.Dir(configParams.LogFilePath), 0755)
-		var rotAwareFile io.Writer
-		rotAwareFile, fileOpenErr = rfw.Open(configParams.LogFilePath, 0644)
+		var logFile io.Writer
+		if configParams.LogFileMaxSizeMB > 0 {
+			rotatingFile := flowlog.NewRotatingFile(
+				configParams.LogFilePath,
+				int64(configParams.LogFileMaxSizeMB)*1024*1024,
+				configParams.LogFileMaxFiles,
+			)
+			// The file is opened lazily; do an empty write to open it now so that we
+			// find out about problems straight away.
+			_, fileOpenErr = rotatingFile.Write(nil)
+			logFile = rotatingFile
+		} else {
+			// No size limit, use a file that reopens itself if it's rotated externally.
+			logFile, fileOpenErr = rfw.Open(configParams.LogFilePath, 0644)
+		}
 		if fileDirErr == nil && fileOpenErr == nil {
-			fileDest := NewStreamDestination(
+			newDest := NewStreamDestination
+			if configParams.LogFileFormat == "json" {
+				newDest = NewJSONStreamDestination
+			}
+			fileDest = newDest(
 				logLevelFile,
-				rotAwareFile,
+				logFile,
 				make(chan QueuedLog, logQueueSize),
 				configParams.DebugDisableLogDropping,
 			)
@@ -155,7 +218,7 @@ func ConfigureLogging(configParams *config.Config) {
 		tag := "calico-felix"
 		w, sysErr := syslog.Dial(net, addr, priority, tag)
 		if sysErr == nil {
-			syslogDest := NewSyslogDestination(
+			syslogDest = NewSyslogDestination(
 				logLevelSyslog,
 				w,
 				make(chan QueuedLog, logQueueSize),
@@ -165,10 +228,27 @@ func ConfigureLogging(configParams *config.Config) {
 		}
 	}
 
-	hook := NewBackgroundHook(filterLevels(mostVerboseLevel), logLevelSyslog, dests)
+	// Register the hook for all levels; the global level set above does the filtering, and we
+	// may lower it later in UpdateLogLevels().
+	hook := NewBackgroundHook(filterLevels(log.DebugLevel), logLevelSyslog, dests)
+	hook.SetSubsystemLevels(logLevelsBySubsystem)
+	if configParams.LogRateLimitIntervalSecs > 0 {
+		hook.EnableRateLimiting(
+			time.Duration(configParams.LogRateLimitIntervalSecs)*time.Second,
+			configParams.LogRateLimitBurst,
+		)
+	}
 	hook.Start()
 	log.AddHook(hook)
 
+	configured.hook = hook
+	configured.screenDest = screenDest
+	configured.fileDest = fileDest
+	configured.syslogDest = syslogDest
+	configured.screenEnabled = configParams.LogSeverityScreen != ""
+	configured.fileEnabled = configParams.LogSeverityFile != "" && configParams.LogFilePath != ""
+	configured.syslogEnabled = configParams.LogSeveritySys != ""
+
 	// Disable logrus' default output, which only supports a single destination.  We use the
 	// hook above to fan out logs to multiple destinations.
 	log.SetOutput(&NullWriter{})
@@ -196,6 +276,70 @@ func ConfigureLogging(configParams *config.Config) {
 	}
 }
 
+// UpdateLogLevels applies changes to the LogSeverityXXX parameters to the logging targets that
+// ConfigureLogging set up.  Enabling or disabling a target isn't supported at runtime so, in
+// that case, it leaves the levels unchanged and returns an error.
+func UpdateLogLevels(configParams *config.Config) error {
+	hook := configured.hook
+	if hook == nil {
+		return errors.New("logging has not been configured")
+	}
+	if configured.screenEnabled != (configParams.LogSeverityScreen != "") ||
+		configured.fileEnabled != (configParams.LogSeverityFile != "" && configParams.LogFilePath != "") ||
+		configured.syslogEnabled != (configParams.LogSeveritySys != "") {
+		return errors.New("enabling or disabling a log target requires a restart")
+	}
+
+	logLevelScreen := safeParseLogLevel(configParams.LogSeverityScreen)
+	logLevelFile := safeParseLogLevel(configParams.LogSeverityFile)
+	logLevelSyslog := safeParseLogLevel(configParams.LogSeveritySys)
+	logLevelsBySubsystem := subsystemLevels(configParams)
+
+	hook.lock.Lock()
+	if configured.screenDest != nil {
+		configured.screenDest.Level = logLevelScreen
+	}
+	if configured.fileDest != nil {
+		configured.fileDest.Level = logLevelFile
+	}
+	if configured.syslogDest != nil {
+		configured.syslogDest.Level = logLevelSyslog
+	}
+	hook.syslogLevel = logLevelSyslog
+	hook.lock.Unlock()
+	hook.SetSubsystemLevels(logLevelsBySubsystem)
+
+	log.SetLevel(mostVerbose(logLevelScreen, logLevelFile, logLevelSyslog, logLevelsBySubsystem))
+	log.WithFields(log.Fields{
+		"screen":     logLevelScreen,
+		"file":       logLevelFile,
+		"syslog":     logLevelSyslog,
+		"subsystems": logLevelsBySubsystem,
+	}).Info("Updated log levels.")
+	return nil
+}
+
+// mostVerbose returns the most verbose of the given levels, including the per-subsystem levels.
+// Logs from a subsystem with a more verbose level have to get past the global level so, when
+// such a level is set, the other subsystems' logs are filtered later, in BackgroundHook.
+func mostVerbose(
+	screen, file, syslog log.Level,
+	levelsBySubsystem map[string]log.Level,
+) log.Level {
+	mostVerboseLevel := log.PanicLevel
+	for _, level := range []log.Level{screen, file, syslog} {
+		if level > mostVerboseLevel {
+			mostVerboseLevel = level
+		}
+	}
+	for _, level := range levelsBySubsystem {
+		if level > mostVerboseLevel {
+			mostVerboseLevel = level
+		}
+	}
+	return mostVerboseLevel
+}
+
 // filterLevels returns all the logrus.Level values <= maxLevel.
 func filterLevels(maxLevel log.Level) []log.Level {
 	levels := []log.Level{}
@@ -249,6 +393,91 @@ func FormatForSyslog(entry *log.Entry) string {
 	return b.String()
 }
 
+// jsonLog is the structure of each log written by FormatJSON.  Fields that identify the
+// table, chain, endpoint or policy that a log relates to are pulled out into their own
+// top-level fields so that they can be searched for consistently, whatever name the code that
+// made the log gave them; all other fields go in Fields.
+type jsonLog struct {
+	Time      string                     `json:"time"`
+	Level     string                     `json:"level"`
+	PID       int                        `json:"pid"`
+	File      interface{}                `json:"file"`
+	Line      interface{}                `json:"line"`
+	Subsystem string                     `json:"subsystem,omitempty"`
+	Message   string                     `json:"msg"`
+	Table     string                     `json:"table,omitempty"`
+	Chain     string                     `json:"chain,omitempty"`
+	Endpoint  string                     `json:"endpoint,omitempty"`
+	Policy    string                     `json:"policy,omitempty"`
+	Fields    map[string]json.RawMessage `json:"fields,omitempty"`
+}
+
+// jsonStableFields maps from the field names used in our logs to the top-level field of
+// jsonLog that FormatJSON puts them in.
+var jsonStableFields = map[string]func(l *jsonLog) *string{
+	"table":              func(l *jsonLog) *string { return &l.Table },
+	"chain":              func(l *jsonLog) *string { return &l.Chain },
+	"chainName":          func(l *jsonLog) *string { return &l.Chain },
+	"endpointID":         func(l *jsonLog) *string { return &l.Endpoint },
+	"workloadEndpointID": func(l *jsonLog) *string { return &l.Endpoint },
+	"hostEndpointID":     func(l *jsonLog) *string { return &l.Endpoint },
+	"policy":             func(l *jsonLog) *string { return &l.Policy },
+	"policyID":           func(l *jsonLog) *string { return &l.Policy },
+	"policyKey":          func(l *jsonLog) *string { return &l.Policy },
+}
+
+// FormatJSON formats logs as a single line of JSON, for consumption by log processing tools.
+//
+//    {"time":"2017-01-05T09:17:48.238Z","level":"info","pid":85386,"file":"table.go",
+//    "line":434,"subsystem":"iptables","msg":"Queueing update of chain.","table":"filter",
+//    "chain":"cali-FORWARD"}
+func FormatJSON(entry *log.Entry) ([]byte, error) {
+	l := jsonLog{
+		Time:    entry.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Level:   entry.Level.String(),
+		PID:     os.Getpid(),
+		File:    entry.Data["__file__"],
+		Line:    entry.Data["__line__"],
+		Message: entry.Message,
+	}
+	l.Subsystem, _ = entry.Data["__subsystem__"].(string)
+	for key, value := range entry.Data {
+		if strings.HasPrefix(key, "__") {
+			// Internal metadata, handled above.
+			continue
+		}
+		if stableField, ok := jsonStableFields[key]; ok {
+			*stableField(&l) = fmt.Sprint(jsonValue(value))
+			continue
+		}
+		rawValue, err := json.Marshal(jsonValue(value))
+		if err != nil {
+			// Not all values can be marshalled; channels, for example.
+			rawValue, _ = json.Marshal(fmt.Sprintf("%#v", value))
+		}
+		if l.Fields == nil {
+			l.Fields = map[string]json.RawMessage{}
+		}
+		l.Fields[key] = rawValue
+	}
+	b, err := json.Marshal(&l)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// jsonValue converts errors and fmt.Stringers to strings, which are more useful in the JSON
+// output than their marshalled structs.
+func jsonValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	} else if stringer, ok := value.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return value
+}
+
 // appendKeysAndNewLine writes the KV pairs attached to the entry to the end of the buffer, then
 // finishes it with a newline.
 func appendKVsAndNewLine(b *bytes.Buffer, entry *log.Entry) {
@@ -260,7 +489,8 @@ func appendKVsAndNewLine(b *bytes.Buffer, entry *log.Entry) {
 	sort.Strings(keys)
 
 	for _, key := range keys {
-		if key == "__file__" || key == "__line__" {
+		if strings.HasPrefix(key, "__") {
+			// Internal metadata, such as our __file__ and __line__ fields.
 			continue
 		}
 		var value interface{} = entry.Data[key]
@@ -306,6 +536,9 @@ func (hook ContextHook) Fire(entry *log.Entry) error {
 			if !shouldSkipFrame(frame) {
 				entry.Data["__file__"] = path.Base(frame.File)
 				entry.Data["__line__"] = frame.Line
+				if subsystem := subsystemForFile(frame.File); subsystem != "" {
+					entry.Data["__subsystem__"] = subsystem
+				}
 				break
 			}
 			if !more {
@@ -328,6 +561,10 @@ type QueuedLog struct {
 	SyslogMessage string
 	WaitGroup     *sync.WaitGroup
 
+	// JSONMessage is the log formatted by FormatJSON, only filled in if one of the
+	// destinations needs it.
+	JSONMessage []byte
+
 	// NumSkippedLogs contains the number of logs that were skipped before this log (due to the
 	// queue being blocked).
 	NumSkippedLogs uint
@@ -360,6 +597,30 @@ func NewStreamDestination(
 	}
 }
 
+// NewJSONStreamDestination creates a destination that writes logs to the given stream in JSON
+// format, as generated by FormatJSON.
+func NewJSONStreamDestination(
+	level log.Level,
+	writer io.Writer,
+	c chan QueuedLog,
+	disableLogDropping bool,
+) *Destination {
+	return &Destination{
+		Level:   level,
+		channel: c,
+		writeLog: func(ql QueuedLog) error {
+			if ql.NumSkippedLogs > 0 {
+				fmt.Fprintf(writer, "{\"level\":\"warning\",\"msg\":\"... dropped %d logs ...\"}\n",
+					ql.NumSkippedLogs)
+			}
+			_, err := writer.Write(ql.JSONMessage)
+			return err
+		},
+		needsJSON:          true,
+		disableLogDropping: disableLogDropping,
+	}
+}
+
 func NewSyslogDestination(
 	level log.Level,
 	writer syslogWriter,
@@ -390,6 +651,8 @@ type Destination struct {
 	// writeLog is the function to actually make a log.  The constructors above initialise this
 	// with a function that logs to a stream or to syslog, for example.
 	writeLog func(ql QueuedLog) error
+	// needsJSON is true if writeLog uses the QueuedLog's JSONMessage.
+	needsJSON bool
 
 	// disableLogDropping forces all logs to be queued even if the destination blocks.
 	disableLogDropping bool
@@ -474,11 +737,23 @@ func writeToSyslog(writer syslogWriter, ql QueuedLog) error {
 // stream doesn't block the mainline code.  Up to a point, we queue logs for writing, then we start
 // dropping logs.
 type BackgroundHook struct {
-	levels      []log.Level
+	levels []log.Level
+
+	// lock protects syslogLevel, subsystemLevels and the Level of each of our destinations,
+	// which can be updated at runtime by UpdateLogLevels().
+	lock        sync.RWMutex
 	syslogLevel log.Level
+	// subsystemLevels maps from subsystem name (as set in the __subsystem__ field by
+	// ContextHook) to a level that overrides the destinations' levels for that subsystem.
+	subsystemLevels map[string]log.Level
 
 	destinations []*Destination
 
+	// rateLimiter, if non-nil, suppresses logs that are repeated too often.  It's flushed
+	// every rateLimitInterval.
+	rateLimiter       *rateLimiter
+	rateLimitInterval time.Duration
+
 	// Our own copy of the dropped logs counter, used for logging out when we drop logs.
 	// Must be read/updated using atomic.XXX.
 	numDroppedLogs  uint64
@@ -493,11 +768,47 @@ func NewBackgroundHook(levels []log.Level, syslogLevel log.Level, destinations [
 	}
 }
 
+// SetSubsystemLevels sets the per-subsystem log levels.  For logs from one of the given
+// subsystems, the subsystem's level overrides the levels of the destinations.
+func (h *BackgroundHook) SetSubsystemLevels(levels map[string]log.Level) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.subsystemLevels = levels
+}
+
+// EnableRateLimiting enables suppression of repeated logs: in each interval, after burst
+// repeats of the same log, further repeats are suppressed until the end of the interval, when
+// a single log reports how many were suppressed.  Must be called before Start().
+func (h *BackgroundHook) EnableRateLimiting(interval time.Duration, burst int) {
+	h.rateLimiter = newRateLimiter(burst)
+	h.rateLimitInterval = interval
+}
+
 func (h *BackgroundHook) Levels() []log.Level {
 	return h.levels
 }
 
-func (h *BackgroundHook) Fire(entry *log.Entry) (err error) {
+func (h *BackgroundHook) Fire(entry *log.Entry) error {
+	if h.rateLimiter != nil && !h.rateLimiter.allow(entry) {
+		return nil
+	}
+	return h.send(entry)
+}
+
+// FlushRateLimiter ends the current rate limiting interval, logging a summary of any logs that
+// were suppressed.  It is called periodically by the goroutine started by Start().
+func (h *BackgroundHook) FlushRateLimiter() {
+	if h.rateLimiter == nil {
+		return
+	}
+	for _, summary := range h.rateLimiter.flush(time.Now()) {
+		if err := h.send(summary); err != nil {
+			counterLogErrors.Inc()
+		}
+	}
+}
+
+func (h *BackgroundHook) send(entry *log.Entry) (err error) {
 	var serialized []byte
 	if serialized, err = entry.Logger.Formatter.Format(entry); err != nil {
 		return
@@ -516,7 +827,10 @@ func (h *BackgroundHook) Fire(entry *log.Entry) (err error) {
 		Message: bufCopy,
 	}
 
-	if entry.Level <= h.syslogLevel {
+	h.lock.RLock()
+	subsystem, _ := entry.Data["__subsystem__"].(string)
+	subsystemLevel, subsystemLevelSet := h.subsystemLevels[subsystem]
+	if entry.Level <= h.syslogLevel || subsystemLevelSet {
 		// syslog gets its own log string since our default log string duplicates a lot of
 		// syslog metadata.  Only calculate that string if it's needed.
 		ql.SyslogMessage = FormatForSyslog(entry)
@@ -531,9 +845,23 @@ func (h *BackgroundHook) Fire(entry *log.Entry) (err error) {
 	}
 
 	for _, dest := range h.destinations {
-		if ql.Level > dest.Level {
+		maxLevel := dest.Level
+		if subsystemLevelSet {
+			maxLevel = subsystemLevel
+		}
+		if ql.Level > maxLevel {
 			continue
 		}
+		if dest.needsJSON && ql.JSONMessage == nil {
+			// Only calculate the JSON form if it's needed.  Since ql is passed by
+			// value, this copy gets reused for any subsequent destinations.
+			jsonMessage, jsonErr := FormatJSON(entry)
+			if jsonErr != nil {
+				counterLogErrors.Inc()
+				continue
+			}
+			ql.JSONMessage = jsonMessage
+		}
 		if waitGroup != nil {
 			// Thread safety: we must call add before we send the wait group over the
 			// channel (or the background thread could be scheduled immediately and
@@ -552,6 +880,7 @@ func (h *BackgroundHook) Fire(entry *log.Entry) (err error) {
 			counterDroppedLogs.Inc()
 		}
 	}
+	h.lock.RUnlock()
 	if waitGroup != nil {
 		waitGroup.Wait()
 	}
@@ -562,6 +891,15 @@ func (h *BackgroundHook) Start() {
 	for _, d := range h.destinations {
 		go d.LoopWritingLogs()
 	}
+	if h.rateLimiter != nil {
+		go h.loopFlushingRateLimiter()
+	}
+}
+
+func (h *BackgroundHook) loopFlushingRateLimiter() {
+	for range time.NewTicker(h.rateLimitInterval).C {
+		h.FlushRateLimiter()
+	}
 }
 
 // safeParseLogLevel parses a string version of a logrus log level, defaulting
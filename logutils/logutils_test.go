@@ -116,6 +116,64 @@ var _ = DescribeTable("Formatter",
 		"WARNING foo.go 123: The answer is 42. a=10 b=\"foobar\" c=2017-03-15 11:22:33.123 +0000 UTC err=an error\n"),
 )
 
+var _ = DescribeTable("FormatJSON",
+	func(entry log.Entry, expectedLog string) {
+		out, err := FormatJSON(&entry)
+		Expect(err).NotTo(HaveOccurred())
+		expectedLog = strings.Replace(expectedLog, "<PID>", fmt.Sprintf("%v", os.Getpid()), 1)
+		Expect(string(out)).To(Equal(expectedLog))
+	},
+	Entry("Basic",
+		log.Entry{
+			Level: log.InfoLevel,
+			Time:  theTime(),
+			Data: log.Fields{
+				"__file__": "foo.go",
+				"__line__": 123,
+			},
+			Message: "The answer is 42.",
+		},
+		`{"time":"2017-03-15T11:22:33.123Z","level":"info","pid":<PID>,"file":"foo.go","line":123,"msg":"The answer is 42."}`+"\n",
+	),
+	Entry("With fields",
+		log.Entry{
+			Level: log.WarnLevel,
+			Time:  theTime(),
+			Data: log.Fields{
+				"__file__":      "foo.go",
+				"__line__":      123,
+				"__subsystem__": "iptables",
+				"a":             10,
+				"b":             "foobar",
+				"err":           errors.New("an error"),
+				"ch":            (chan int)(nil),
+			},
+			Message: "The answer is 42.",
+		},
+		`{"time":"2017-03-15T11:22:33.123Z","level":"warning","pid":<PID>,"file":"foo.go","line":123,`+
+			`"subsystem":"iptables","msg":"The answer is 42.",`+
+			`"fields":{"a":10,"b":"foobar","ch":"(chan int)(nil)","err":"an error"}}`+"\n",
+	),
+	Entry("With stable fields",
+		log.Entry{
+			Level: log.InfoLevel,
+			Time:  theTime(),
+			Data: log.Fields{
+				"__file__":           "foo.go",
+				"__line__":           123,
+				"table":              "filter",
+				"chainName":          "cali-FORWARD",
+				"workloadEndpointID": "k8s/default.nginx/eth0",
+				"policyKey":          "default/allow",
+			},
+			Message: "The answer is 42.",
+		},
+		`{"time":"2017-03-15T11:22:33.123Z","level":"info","pid":<PID>,"file":"foo.go","line":123,`+
+			`"msg":"The answer is 42.","table":"filter","chain":"cali-FORWARD",`+
+			`"endpoint":"k8s/default.nginx/eth0","policy":"default/allow"}`+"\n",
+	),
+)
+
 func theTime() time.Time {
 	theTime, err := time.Parse("2006-01-02 15:04:05.000", "2017-03-15 11:22:33.123")
 	if err != nil {
@@ -395,3 +453,137 @@ func (s *mockSyslogWriter) Crit(m string) error {
 	_, err := fmt.Fprintf((*io.PipeWriter)(s), "CRITICAL %s", m)
 	return err
 }
+
+var _ = Describe("BackgroundHook with subsystem levels", func() {
+	var c chan QueuedLog
+	var hook *BackgroundHook
+
+	BeforeEach(func() {
+		c = make(chan QueuedLog, 10)
+		dest := NewStreamDestination(log.InfoLevel, &bytes.Buffer{}, c, false)
+		hook = NewBackgroundHook(log.AllLevels, log.PanicLevel, []*Destination{dest})
+		hook.SetSubsystemLevels(map[string]log.Level{
+			"iptables":   log.DebugLevel,
+			"calc-graph": log.WarnLevel,
+		})
+	})
+
+	fire := func(level log.Level, subsystem string) {
+		data := log.Fields{"__file__": "foo.go", "__line__": 123}
+		if subsystem != "" {
+			data["__subsystem__"] = subsystem
+		}
+		err := hook.Fire(&log.Entry{
+			Logger:  &log.Logger{Formatter: &Formatter{}},
+			Level:   level,
+			Data:    data,
+			Message: "A log",
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("should use the destination's level for other subsystems", func() {
+		fire(log.InfoLevel, "")
+		fire(log.DebugLevel, "")
+		fire(log.DebugLevel, "ipsets")
+		Expect(c).To(HaveLen(1))
+	})
+
+	It("should allow more verbose logs from a subsystem", func() {
+		fire(log.DebugLevel, "iptables")
+		Expect(c).To(HaveLen(1))
+	})
+
+	It("should allow a subsystem to be quietened", func() {
+		fire(log.InfoLevel, "calc-graph")
+		Expect(c).To(HaveLen(0))
+		fire(log.WarnLevel, "calc-graph")
+		Expect(c).To(HaveLen(1))
+	})
+
+	It("should not include the subsystem in the formatted log", func() {
+		fire(log.DebugLevel, "iptables")
+		Expect(string((<-c).Message)).NotTo(ContainSubstring("iptables"))
+	})
+})
+
+var _ = Describe("JSON Stream Destination", func() {
+	It("should write the JSON form of the log", func() {
+		c := make(chan QueuedLog, 1)
+		buf := &bytes.Buffer{}
+		dest := NewJSONStreamDestination(log.InfoLevel, buf, c, false)
+		hook := NewBackgroundHook(log.AllLevels, log.PanicLevel, []*Destination{dest})
+		err := hook.Fire(&log.Entry{
+			Logger:  &log.Logger{Formatter: &Formatter{}},
+			Level:   log.InfoLevel,
+			Data:    log.Fields{"__file__": "foo.go", "__line__": 123},
+			Message: "A log",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		dest.Close()
+		dest.LoopWritingLogs()
+		Expect(buf.String()).To(HavePrefix(`{"time":`))
+		Expect(buf.String()).To(HaveSuffix(`"file":"foo.go","line":123,"msg":"A log"}` + "\n"))
+	})
+})
+
+var _ = Describe("BackgroundHook with rate limiting", func() {
+	var c chan QueuedLog
+	var hook *BackgroundHook
+
+	BeforeEach(func() {
+		c = make(chan QueuedLog, 10)
+		dest := NewStreamDestination(log.InfoLevel, &bytes.Buffer{}, c, false)
+		hook = NewBackgroundHook(log.AllLevels, log.PanicLevel, []*Destination{dest})
+		hook.EnableRateLimiting(time.Hour, 2)
+	})
+
+	fire := func(level log.Level, line int, message string, fields log.Fields) {
+		data := log.Fields{"__file__": "foo.go", "__line__": line}
+		for k, v := range fields {
+			data[k] = v
+		}
+		err := hook.Fire(&log.Entry{
+			Logger:  &log.Logger{Formatter: &Formatter{}},
+			Level:   level,
+			Data:    data,
+			Message: message,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("should suppress repeats beyond the burst and then summarise them", func() {
+		for i := 0; i < 5; i++ {
+			fire(log.InfoLevel, 123, "Parsed line", log.Fields{"line": i})
+		}
+		Expect(c).To(HaveLen(2))
+		<-c
+		<-c
+
+		hook.FlushRateLimiter()
+		Expect(c).To(HaveLen(1))
+		summary := string((<-c).Message)
+		Expect(summary).To(ContainSubstring("foo.go 123: Message repeated 3 times: Parsed line"))
+		Expect(summary).To(ContainSubstring("suppressedLogs=3"))
+
+		// The flush starts a new interval.
+		fire(log.InfoLevel, 123, "Parsed line", nil)
+		Expect(c).To(HaveLen(1))
+	})
+
+	It("should treat logs from different lines or with different messages separately", func() {
+		for i := 0; i < 3; i++ {
+			fire(log.InfoLevel, 123, "Parsed line", nil)
+			fire(log.InfoLevel, 124, "Parsed line", nil)
+			fire(log.InfoLevel, 123, "Resync failed", nil)
+		}
+		Expect(c).To(HaveLen(6))
+	})
+
+	It("should not log a summary if nothing was suppressed", func() {
+		fire(log.InfoLevel, 123, "Parsed line", nil)
+		<-c
+		hook.FlushRateLimiter()
+		Expect(c).To(HaveLen(0))
+	})
+})
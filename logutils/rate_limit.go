@@ -0,0 +1,124 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxRateLimitedLogs limits the number of distinct logs that a rateLimiter tracks in each
+// interval; logs beyond that are allowed through without rate limiting.
+const maxRateLimitedLogs = 1000
+
+// rateLimiter suppresses logs that are repeated too often.  Logs are treated as repeats if they
+// come from the same line of code and have the same level and message; their fields may differ,
+// so, for example, a per-line parse log is treated as one log.  In each interval, up to burst
+// repeats of each log are allowed through; further repeats are counted and then summarised in a
+// single log when the interval is flushed.
+type rateLimiter struct {
+	burst int
+
+	lock sync.Mutex
+	logs map[rateLimitKey]*rateLimitedLog
+}
+
+type rateLimitKey struct {
+	file    string
+	line    int
+	level   log.Level
+	message string
+}
+
+type rateLimitedLog struct {
+	count int
+	// logger and data are copied from the first instance of the log; they're used to make the
+	// summary log.
+	logger *log.Logger
+	data   log.Fields
+}
+
+func newRateLimiter(burst int) *rateLimiter {
+	return &rateLimiter{
+		burst: burst,
+		logs:  map[rateLimitKey]*rateLimitedLog{},
+	}
+}
+
+// allow records the given log and returns whether it should be logged.
+func (r *rateLimiter) allow(entry *log.Entry) bool {
+	if entry.Level <= log.FatalLevel {
+		// Never suppress the log that explains why we're about to exit.
+		return true
+	}
+	key := rateLimitKey{
+		level:   entry.Level,
+		message: entry.Message,
+	}
+	key.file, _ = entry.Data["__file__"].(string)
+	key.line, _ = entry.Data["__line__"].(int)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	l := r.logs[key]
+	if l == nil {
+		if len(r.logs) >= maxRateLimitedLogs {
+			return true
+		}
+		l = &rateLimitedLog{
+			logger: entry.Logger,
+			data:   log.Fields{},
+		}
+		for _, k := range []string{"__file__", "__line__", "__subsystem__"} {
+			if v, ok := entry.Data[k]; ok {
+				l.data[k] = v
+			}
+		}
+		r.logs[key] = l
+	}
+	l.count++
+	return l.count <= r.burst
+}
+
+// flush starts a new interval, returning a summary log for each log that was suppressed in the
+// previous one.
+func (r *rateLimiter) flush(now time.Time) (summaries []*log.Entry) {
+	r.lock.Lock()
+	logs := r.logs
+	r.logs = map[rateLimitKey]*rateLimitedLog{}
+	r.lock.Unlock()
+
+	for key, l := range logs {
+		numSuppressed := l.count - r.burst
+		if numSuppressed <= 0 {
+			continue
+		}
+		data := log.Fields{"suppressedLogs": numSuppressed}
+		for k, v := range l.data {
+			data[k] = v
+		}
+		summaries = append(summaries, &log.Entry{
+			Logger:  l.logger,
+			Data:    data,
+			Time:    now,
+			Level:   key.level,
+			Message: fmt.Sprintf("Message repeated %d times: %s", numSuppressed, key.message),
+		})
+	}
+	return
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package markbits allocates packet-mark bits to Felix's subsystems.  The bits that Felix may
+// use are given by a mask (typically IptablesMarkMask, less any bits reserved for other agents
+// such as kube-proxy) so that Felix's marks don't collide with marks used by other software on
+// the host.
+//
+// Single-bit marks are used as flags, such as the accept and pass marks.  A block of bits can
+// also be allocated to hold a number, such as an endpoint index; MapNumberToMark and
+// MapMarkToNumber convert between numbers and marks within such a block.  The bits of a block
+// needn't be contiguous.
+package markbits
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var ErrNotEnoughBits = errors.New("not enough mark bits available")
+
+// MarkBitsManager allocates bits from a mark mask.  It isn't safe for concurrent use.
+type MarkBitsManager struct {
+	name          string
+	mask          uint32
+	availableMask uint32
+}
+
+func NewMarkBitsManager(mask uint32, name string) *MarkBitsManager {
+	return &MarkBitsManager{
+		name:          name,
+		mask:          mask,
+		availableMask: mask,
+	}
+}
+
+// NextSingleBitMark allocates the lowest available bit.  It returns ErrNotEnoughBits if all
+// the bits have been allocated.
+func (m *MarkBitsManager) NextSingleBitMark() (uint32, error) {
+	return m.NextBlockBitsMark(1)
+}
+
+// NextBlockBitsMark allocates the lowest size available bits as a block.  It returns
+// ErrNotEnoughBits, without allocating anything, if there aren't enough bits left.
+func (m *MarkBitsManager) NextBlockBitsMark(size int) (uint32, error) {
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid mark block size %d", size)
+	}
+	if m.AvailableMarkBitCount() < size {
+		log.WithFields(log.Fields{
+			"name":          m.name,
+			"mask":          fmt.Sprintf("%#x", m.mask),
+			"availableMask": fmt.Sprintf("%#x", m.availableMask),
+			"requestedBits": size,
+		}).Error("Not enough mark bits available")
+		return 0, ErrNotEnoughBits
+	}
+	var block uint32
+	numBits := 0
+	for shift := uint(0); shift < 32 && numBits < size; shift++ {
+		candidate := uint32(1) << shift
+		if m.availableMask&candidate != 0 {
+			block |= candidate
+			numBits++
+		}
+	}
+	m.availableMask &^= block
+	log.WithFields(log.Fields{
+		"name":  m.name,
+		"block": fmt.Sprintf("%#x", block),
+	}).Debug("Allocated mark bits")
+	return block, nil
+}
+
+// AvailableMarkBitCount returns the number of bits that are yet to be allocated.
+func (m *MarkBitsManager) AvailableMarkBitCount() int {
+	return countBits(m.availableMask)
+}
+
+// GetMask returns the mask that the bits are allocated from.
+func (m *MarkBitsManager) GetMask() uint32 {
+	return m.mask
+}
+
+// MapNumberToMark returns the mark that represents n within the given block: the bits of n are
+// spread, from least significant upwards, across the bits of the block.  It returns an error
+// if n doesn't fit in the block.
+func MapNumberToMark(block uint32, n int) (uint32, error) {
+	if n < 0 || n >= 1<<uint(countBits(block)) {
+		return 0, fmt.Errorf("number %d doesn't fit in mark block %#x", n, block)
+	}
+	var mark uint32
+	numBits := uint(0)
+	for shift := uint(0); shift < 32; shift++ {
+		candidate := uint32(1) << shift
+		if block&candidate == 0 {
+			continue
+		}
+		if n&(1<<numBits) != 0 {
+			mark |= candidate
+		}
+		numBits++
+	}
+	return mark, nil
+}
+
+// MapMarkToNumber is the inverse of MapNumberToMark.  It returns an error if the mark has bits
+// set outside the block.
+func MapMarkToNumber(block uint32, mark uint32) (int, error) {
+	if mark&^block != 0 {
+		return 0, fmt.Errorf("mark %#x has bits outside mark block %#x", mark, block)
+	}
+	n := 0
+	numBits := uint(0)
+	for shift := uint(0); shift < 32; shift++ {
+		candidate := uint32(1) << shift
+		if block&candidate == 0 {
+			continue
+		}
+		if mark&candidate != 0 {
+			n |= 1 << numBits
+		}
+		numBits++
+	}
+	return n, nil
+}
+
+func countBits(x uint32) int {
+	count := 0
+	for ; x != 0; x &= x - 1 {
+		count++
+	}
+	return count
+}
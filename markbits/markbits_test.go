@@ -0,0 +1,112 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package markbits_test
+
+import (
+	. "github.com/projectcalico/felix/markbits"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("Single bit allocation",
+	func(mask uint32, numCalls int, expected uint32) {
+		m := NewMarkBitsManager(mask, "test")
+		var mark uint32
+		var err error
+		for i := 0; i < numCalls; i++ {
+			mark, err = m.NextSingleBitMark()
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(mark).To(Equal(expected))
+	},
+	Entry("0th bit in 0xf", uint32(0xf), 1, uint32(0x1)),
+	Entry("1st bit in 0xf", uint32(0xf), 2, uint32(0x2)),
+	Entry("7th bit in 0xff", uint32(0xff), 8, uint32(0x80)),
+	Entry("7th bit in 0xf00f", uint32(0xf00f), 8, uint32(0x8000)),
+	Entry("0th bit of 0xff000000", uint32(0xff000000), 1, uint32(0x01000000)),
+)
+
+var _ = Describe("MarkBitsManager", func() {
+	var m *MarkBitsManager
+
+	BeforeEach(func() {
+		m = NewMarkBitsManager(0xf0f0, "test")
+	})
+
+	It("should report its mask", func() {
+		Expect(m.GetMask()).To(Equal(uint32(0xf0f0)))
+		Expect(m.AvailableMarkBitCount()).To(Equal(8))
+	})
+
+	It("should allocate non-contiguous blocks", func() {
+		mark, err := m.NextSingleBitMark()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mark).To(Equal(uint32(0x10)))
+		block, err := m.NextBlockBitsMark(4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(block).To(Equal(uint32(0x10e0)))
+		Expect(m.AvailableMarkBitCount()).To(Equal(3))
+	})
+
+	It("should detect exhaustion without allocating", func() {
+		_, err := m.NextBlockBitsMark(7)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = m.NextBlockBitsMark(2)
+		Expect(err).To(Equal(ErrNotEnoughBits))
+		mark, err := m.NextSingleBitMark()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mark).To(Equal(uint32(0x8000)))
+		_, err = m.NextSingleBitMark()
+		Expect(err).To(Equal(ErrNotEnoughBits))
+	})
+
+	It("should reject an invalid block size", func() {
+		_, err := m.NextBlockBitsMark(0)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Mapping numbers to marks", func() {
+	const block = uint32(0x1a0) // Bits 5, 7 and 8.
+
+	It("should spread the number's bits across the block", func() {
+		Expect(MapNumberToMark(block, 0)).To(Equal(uint32(0)))
+		Expect(MapNumberToMark(block, 1)).To(Equal(uint32(0x20)))
+		Expect(MapNumberToMark(block, 2)).To(Equal(uint32(0x80)))
+		Expect(MapNumberToMark(block, 7)).To(Equal(uint32(0x1a0)))
+	})
+
+	It("should round-trip", func() {
+		for n := 0; n < 8; n++ {
+			mark, err := MapNumberToMark(block, n)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(MapMarkToNumber(block, mark)).To(Equal(n))
+		}
+	})
+
+	It("should reject numbers that don't fit", func() {
+		_, err := MapNumberToMark(block, 8)
+		Expect(err).To(HaveOccurred())
+		_, err = MapNumberToMark(block, -1)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject marks outside the block", func() {
+		_, err := MapMarkToNumber(block, 0x1)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,442 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// mockdataplane provides an in-memory implementation of the internal dataplane's programming
+// layer.  Passing a MockProgrammingLayer as intdataplane.Config.ProgrammingLayerOverride runs
+// the internal dataplane without root access or a kernel; the state that it would have
+// programmed can then be inspected.
+//
+// Like the real implementations, the mocks queue updates until they're applied; the accessors
+// return the applied state.  All methods are safe to call concurrently.
+package mockdataplane
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/felix/dataplaneexec"
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/intdataplane"
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/routetable"
+	"github.com/projectcalico/felix/set"
+)
+
+// MockProgrammingLayer implements intdataplane.ProgrammingLayer, recording the objects that
+// it creates.
+type MockProgrammingLayer struct {
+	lock        sync.Mutex
+	tables      map[string]*MockIptablesTable
+	ipSets      map[ipsets.IPFamily]*MockIPSets
+	routeTables map[uint8]*MockRouteTable
+}
+
+func New() *MockProgrammingLayer {
+	return &MockProgrammingLayer{
+		tables:      map[string]*MockIptablesTable{},
+		ipSets:      map[ipsets.IPFamily]*MockIPSets{},
+		routeTables: map[uint8]*MockRouteTable{},
+	}
+}
+
+var _ intdataplane.ProgrammingLayer = (*MockProgrammingLayer)(nil)
+
+func tableKey(table string, ipVersion uint8) string {
+	return fmt.Sprintf("%s-v%d", table, ipVersion)
+}
+
+func (l *MockProgrammingLayer) NewIptablesTable(
+	table string,
+	ipVersion uint8,
+	options iptables.TableOptions,
+) intdataplane.IptablesTable {
+	t := NewMockIptablesTable(table, ipVersion)
+	l.lock.Lock()
+	l.tables[tableKey(table, ipVersion)] = t
+	l.lock.Unlock()
+	return t
+}
+
+func (l *MockProgrammingLayer) NewIPSets(
+	ipVersionConfig *ipsets.IPVersionConfig,
+	execOptions dataplaneexec.Options,
+) intdataplane.IPSets {
+	s := NewMockIPSets()
+	l.lock.Lock()
+	l.ipSets[ipVersionConfig.Family] = s
+	l.lock.Unlock()
+	return s
+}
+
+func (l *MockProgrammingLayer) NewRouteTable(
+	interfacePrefixes []string,
+	ipVersion uint8,
+	options routetable.Options,
+) intdataplane.RouteTable {
+	r := NewMockRouteTable()
+	l.lock.Lock()
+	l.routeTables[ipVersion] = r
+	l.lock.Unlock()
+	return r
+}
+
+// Table returns the given iptables table, or nil if it hasn't been created.
+func (l *MockProgrammingLayer) Table(table string, ipVersion uint8) *MockIptablesTable {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.tables[tableKey(table, ipVersion)]
+}
+
+// IPSets returns the IP sets for the given family, or nil if they haven't been created.
+func (l *MockProgrammingLayer) IPSets(family ipsets.IPFamily) *MockIPSets {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.ipSets[family]
+}
+
+// RouteTable returns the route table for the given IP version, or nil if it hasn't been
+// created.
+func (l *MockProgrammingLayer) RouteTable(ipVersion uint8) *MockRouteTable {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.routeTables[ipVersion]
+}
+
+// MockIptablesTable implements intdataplane.IptablesTable.
+type MockIptablesTable struct {
+	lock      sync.Mutex
+	name      string
+	ipVersion uint8
+
+	pendingChains     map[string]*iptables.Chain
+	pendingInsertions map[string][]iptables.Rule
+
+	chains     map[string]*iptables.Chain
+	insertions map[string][]iptables.Rule
+	numApplies int
+}
+
+var _ intdataplane.IptablesTable = (*MockIptablesTable)(nil)
+
+func NewMockIptablesTable(table string, ipVersion uint8) *MockIptablesTable {
+	return &MockIptablesTable{
+		name:              table,
+		ipVersion:         ipVersion,
+		pendingChains:     map[string]*iptables.Chain{},
+		pendingInsertions: map[string][]iptables.Rule{},
+		chains:            map[string]*iptables.Chain{},
+		insertions:        map[string][]iptables.Rule{},
+	}
+}
+
+func (t *MockIptablesTable) UpdateChain(chain *iptables.Chain) {
+	t.UpdateChains([]*iptables.Chain{chain})
+}
+
+func (t *MockIptablesTable) UpdateChains(chains []*iptables.Chain) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, chain := range chains {
+		t.pendingChains[chain.Name] = chain
+	}
+}
+
+func (t *MockIptablesTable) RemoveChains(chains []*iptables.Chain) {
+	for _, chain := range chains {
+		t.RemoveChainByName(chain.Name)
+	}
+}
+
+func (t *MockIptablesTable) RemoveChainByName(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.pendingChains, name)
+}
+
+func (t *MockIptablesTable) SetRuleInsertions(chainName string, rules []iptables.Rule) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pendingInsertions[chainName] = rules
+}
+
+func (t *MockIptablesTable) Apply() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.chains = map[string]*iptables.Chain{}
+	for name, chain := range t.pendingChains {
+		t.chains[name] = chain
+	}
+	t.insertions = map[string][]iptables.Rule{}
+	for name, rules := range t.pendingInsertions {
+		t.insertions[name] = rules
+	}
+	t.numApplies++
+	return 0
+}
+
+func (t *MockIptablesTable) SetRefreshInterval(interval time.Duration) {
+}
+
+func (t *MockIptablesTable) InSync() bool {
+	return true
+}
+
+func (t *MockIptablesTable) Degraded() bool {
+	return false
+}
+
+func (t *MockIptablesTable) HasPendingChainDeletions() bool {
+	return false
+}
+
+func (t *MockIptablesTable) ReadRuleCounters() (map[string]iptables.RuleCounters, error) {
+	return map[string]iptables.RuleCounters{}, nil
+}
+
+func (t *MockIptablesTable) LookupRuleHash(hash string) (iptables.RuleInfo, bool) {
+	return iptables.RuleInfo{}, false
+}
+
+func (t *MockIptablesTable) Snapshot() *iptables.TableSnapshot {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := &iptables.TableSnapshot{
+		Name:           t.name,
+		IPVersion:      t.ipVersion,
+		InSync:         true,
+		DesiredChains:  map[string][]string{},
+		DesiredInserts: map[string][]string{},
+	}
+	for name, chain := range t.pendingChains {
+		s.DesiredChains[name] = renderRules(name, chain.Rules)
+	}
+	for name, rules := range t.pendingInsertions {
+		s.DesiredInserts[name] = renderRules(name, rules)
+	}
+	return s
+}
+
+func renderRules(chainName string, rules []iptables.Rule) []string {
+	rendered := make([]string, len(rules))
+	for i, rule := range rules {
+		rendered[i] = rule.RenderAppend(chainName, "")
+	}
+	return rendered
+}
+
+// Chain returns the applied chain with the given name, or nil if there is no such chain.
+func (t *MockIptablesTable) Chain(name string) *iptables.Chain {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.chains[name]
+}
+
+// ChainNames returns the sorted names of the applied chains.
+func (t *MockIptablesTable) ChainNames() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var names []string
+	for name := range t.chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Insertions returns the applied rules that are inserted into the given kernel chain.
+func (t *MockIptablesTable) Insertions(chainName string) []iptables.Rule {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.insertions[chainName]
+}
+
+// NumApplies returns the number of times that Apply() has been called.
+func (t *MockIptablesTable) NumApplies() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.numApplies
+}
+
+// MockIPSets implements intdataplane.IPSets.
+type MockIPSets struct {
+	lock           sync.Mutex
+	pendingMembers map[string]set.Set
+	pendingMeta    map[string]ipsets.IPSetMetadata
+
+	members  map[string]set.Set
+	metadata map[string]ipsets.IPSetMetadata
+}
+
+var _ intdataplane.IPSets = (*MockIPSets)(nil)
+
+func NewMockIPSets() *MockIPSets {
+	return &MockIPSets{
+		pendingMembers: map[string]set.Set{},
+		pendingMeta:    map[string]ipsets.IPSetMetadata{},
+		members:        map[string]set.Set{},
+		metadata:       map[string]ipsets.IPSetMetadata{},
+	}
+}
+
+func (s *MockIPSets) AddOrReplaceIPSet(setMetadata ipsets.IPSetMetadata, members []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	memberSet := set.New()
+	for _, m := range members {
+		memberSet.Add(m)
+	}
+	s.pendingMembers[setMetadata.SetID] = memberSet
+	s.pendingMeta[setMetadata.SetID] = setMetadata
+}
+
+func (s *MockIPSets) AddMembers(setID string, newMembers []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	members := s.pendingMembers[setID]
+	if members == nil {
+		return
+	}
+	for _, m := range newMembers {
+		members.Add(m)
+	}
+}
+
+func (s *MockIPSets) RemoveMembers(setID string, removedMembers []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	members := s.pendingMembers[setID]
+	if members == nil {
+		return
+	}
+	for _, m := range removedMembers {
+		members.Discard(m)
+	}
+}
+
+func (s *MockIPSets) RemoveIPSet(setID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.pendingMembers, setID)
+	delete(s.pendingMeta, setID)
+}
+
+func (s *MockIPSets) QueueResync() {
+}
+
+// ApplyUpdates applies the pending creations and updates.  Like the real IPSets, deletions
+// wait for ApplyDeletions().
+func (s *MockIPSets) ApplyUpdates() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, members := range s.pendingMembers {
+		s.members[id] = members.Copy()
+		s.metadata[id] = s.pendingMeta[id]
+	}
+}
+
+func (s *MockIPSets) ApplyDeletions() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id := range s.members {
+		if _, ok := s.pendingMembers[id]; !ok {
+			delete(s.members, id)
+			delete(s.metadata, id)
+		}
+	}
+}
+
+// Members returns a copy of the applied members of the given IP set, or nil if there is no
+// such IP set.
+func (s *MockIPSets) Members(setID string) set.Set {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	members := s.members[setID]
+	if members == nil {
+		return nil
+	}
+	return members.Copy()
+}
+
+// Metadata returns the metadata of the given applied IP set.
+func (s *MockIPSets) Metadata(setID string) (meta ipsets.IPSetMetadata, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	meta, ok = s.metadata[setID]
+	return
+}
+
+// MockRouteTable implements intdataplane.RouteTable.
+type MockRouteTable struct {
+	lock          sync.Mutex
+	pendingRoutes map[string][]routetable.Target
+	routes        map[string][]routetable.Target
+	ifaceStates   map[string]ifacemonitor.State
+}
+
+var _ intdataplane.RouteTable = (*MockRouteTable)(nil)
+
+func NewMockRouteTable() *MockRouteTable {
+	return &MockRouteTable{
+		pendingRoutes: map[string][]routetable.Target{},
+		routes:        map[string][]routetable.Target{},
+		ifaceStates:   map[string]ifacemonitor.State{},
+	}
+}
+
+func (r *MockRouteTable) SetRoutes(ifaceName string, targets []routetable.Target) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(targets) == 0 {
+		delete(r.pendingRoutes, ifaceName)
+		return
+	}
+	r.pendingRoutes[ifaceName] = targets
+}
+
+func (r *MockRouteTable) Conflicts() []routetable.RouteConflict {
+	return nil
+}
+
+func (r *MockRouteTable) ConflictsChanged() bool {
+	return false
+}
+
+func (r *MockRouteTable) OnIfaceStateChanged(ifaceName string, state ifacemonitor.State) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ifaceStates[ifaceName] = state
+}
+
+func (r *MockRouteTable) QueueResync() {
+}
+
+func (r *MockRouteTable) Apply() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes = map[string][]routetable.Target{}
+	for ifaceName, targets := range r.pendingRoutes {
+		r.routes[ifaceName] = targets
+	}
+	return nil
+}
+
+// Routes returns the applied routes for the given interface.
+func (r *MockRouteTable) Routes(ifaceName string) []routetable.Target {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.routes[ifaceName]
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mockdataplane_test
+
+import (
+	. "github.com/projectcalico/felix/mockdataplane"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/intdataplane"
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/rules"
+	"github.com/projectcalico/felix/set"
+)
+
+var _ = Describe("MockIptablesTable", func() {
+	var table *MockIptablesTable
+
+	BeforeEach(func() {
+		table = NewMockIptablesTable("filter", 4)
+	})
+
+	It("should only expose chains once applied", func() {
+		chain := &iptables.Chain{Name: "cali-foo"}
+		table.UpdateChain(chain)
+		table.SetRuleInsertions("FORWARD", []iptables.Rule{{Action: iptables.AcceptAction{}}})
+		Expect(table.Chain("cali-foo")).To(BeNil())
+		table.Apply()
+		Expect(table.Chain("cali-foo")).To(Equal(chain))
+		Expect(table.ChainNames()).To(Equal([]string{"cali-foo"}))
+		Expect(table.Insertions("FORWARD")).To(HaveLen(1))
+		Expect(table.NumApplies()).To(Equal(1))
+
+		table.RemoveChainByName("cali-foo")
+		table.Apply()
+		Expect(table.Chain("cali-foo")).To(BeNil())
+	})
+})
+
+var _ = Describe("MockIPSets", func() {
+	var ipSets *MockIPSets
+	meta := ipsets.IPSetMetadata{SetID: "s1", Type: ipsets.IPSetTypeHashIP}
+
+	BeforeEach(func() {
+		ipSets = NewMockIPSets()
+	})
+
+	It("should apply updates and deletions separately", func() {
+		ipSets.AddOrReplaceIPSet(meta, []string{"10.0.0.1"})
+		ipSets.AddMembers("s1", []string{"10.0.0.2"})
+		Expect(ipSets.Members("s1")).To(BeNil())
+		ipSets.ApplyUpdates()
+		Expect(ipSets.Members("s1")).To(Equal(set.From("10.0.0.1", "10.0.0.2")))
+
+		ipSets.RemoveIPSet("s1")
+		ipSets.ApplyUpdates()
+		Expect(ipSets.Members("s1")).NotTo(BeNil())
+		ipSets.ApplyDeletions()
+		Expect(ipSets.Members("s1")).To(BeNil())
+	})
+})
+
+var _ = Describe("Internal dataplane with mock programming layer", func() {
+	var layer *MockProgrammingLayer
+	var dp *intdataplane.InternalDataplane
+
+	BeforeEach(func() {
+		layer = New()
+		dp = intdataplane.NewIntDataplaneDriver(intdataplane.Config{
+			ProgrammingLayerOverride: layer,
+			RulesConfig: rules.Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				IPSetConfigV4: ipsets.NewIPVersionConfig(
+					ipsets.IPFamilyV4,
+					rules.IPSetNamePrefix,
+					rules.AllHistoricIPSetNamePrefixes,
+					rules.LegacyV4IPSetNames,
+				),
+				IptablesMarkAccept:   0x1000000,
+				IptablesMarkPass:     0x2000000,
+				EndpointToHostAction: "DROP",
+			},
+		})
+		dp.Start()
+	})
+
+	It("should program the mock", func() {
+		Expect(dp.SendMessage(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}})).To(Succeed())
+		Expect(dp.SendMessage(&proto.InSync{})).To(Succeed())
+
+		Eventually(func() set.Set {
+			ipSets := layer.IPSets(ipsets.IPFamilyV4)
+			if ipSets == nil {
+				return nil
+			}
+			return ipSets.Members("s1")
+		}).Should(Equal(set.From("10.0.0.1")))
+		Eventually(func() *iptables.Chain {
+			return layer.Table("filter", 4).Chain(rules.ChainFilterForward)
+		}).ShouldNot(BeNil())
+		Expect(layer.Table("filter", 4).Insertions("FORWARD")).To(Equal([]iptables.Rule{{
+			Action: iptables.JumpAction{Target: rules.ChainFilterForward},
+		}}))
+	})
+})
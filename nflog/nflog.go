@@ -0,0 +1,269 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nflog receives packets that iptables rules send to an NFLOG group, by speaking
+// the nfnetlink_log protocol directly over a netlink socket.
+package nflog
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Constants from linux/netfilter/nfnetlink.h and linux/netfilter/nfnetlink_log.h.
+const (
+	netlinkNetfilter = 12
+
+	nfnlSubsysULOG = 4
+
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaPayload = 9
+	nfulaPrefix  = 10
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind   = 1
+	nfulnlCfgCmdPfBind = 3
+
+	nfulnlCopyPacket = 2
+
+	nfgenMsgLen = 4
+	nlaHdrLen   = 4
+	// nlaTypeMask strips the NLA_F_NESTED and NLA_F_NET_BYTEORDER flags.
+	nlaTypeMask = 0x3fff
+
+	// copyRange is the maximum number of bytes of each packet that we ask the kernel to
+	// send us.
+	copyRange   = 0xffff
+	recvBufSize = 0x10000
+)
+
+var (
+	countPacketsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_nflog_packets_received",
+		Help: "Number of packets received from NFLOG groups.",
+	})
+	countOverruns = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_nflog_overruns",
+		Help: "Number of times that the kernel dropped NFLOG packets because we fell behind.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(countPacketsReceived)
+	prometheus.MustRegister(countOverruns)
+}
+
+var errTruncated = errors.New("truncated nfnetlink message")
+
+// Packet is a packet received from an NFLOG group.
+type Packet struct {
+	// Prefix is the --nflog-prefix of the rule that logged the packet.
+	Prefix string
+	// Payload is the packet, starting with its IP header.
+	Payload []byte
+}
+
+// Subscribe binds to the given NFLOG group and starts a background goroutine that sends
+// each packet that is logged to the group to packetsC.  It returns an error if the kernel
+// rejects the subscription; errors after that point are logged and the goroutine carries on.
+func Subscribe(group uint16, packetsC chan<- Packet) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, netlinkNetfilter)
+	if err != nil {
+		return err
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	// Older kernels require us to bind to the protocol families before they'll log
+	// anything for them; newer kernels ignore the request.
+	for seq, req := range [][]byte{
+		configRequest(0, syscall.AF_INET, 1, cmdAttr(nfulnlCfgCmdPfBind)),
+		configRequest(0, syscall.AF_INET6, 2, cmdAttr(nfulnlCfgCmdPfBind)),
+		configRequest(group, syscall.AF_UNSPEC, 3, cmdAttr(nfulnlCfgCmdBind)),
+		configRequest(group, syscall.AF_UNSPEC, 4, modeAttr(copyRange, nfulnlCopyPacket)),
+	} {
+		err = syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+		if err == nil {
+			err = waitForAck(fd, uint32(seq+1))
+		}
+		if err != nil && seq >= 2 {
+			// Only the group binding and mode are essential.
+			syscall.Close(fd)
+			return err
+		}
+	}
+
+	log.WithField("group", group).Info("Subscribed to NFLOG group")
+	go loopReadingPackets(fd, group, packetsC)
+	return nil
+}
+
+func loopReadingPackets(fd int, group uint16, packetsC chan<- Packet) {
+	logCxt := log.WithField("group", group)
+	buf := make([]byte, recvBufSize)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.ENOBUFS {
+			// The socket's receive buffer overflowed so the kernel dropped some
+			// packets.  Nothing we can do but carry on.
+			countOverruns.Inc()
+			logCxt.Warn("NFLOG socket overrun, some packets were lost")
+			continue
+		} else if err != nil {
+			logCxt.WithError(err).Error("Failed to read from NFLOG socket")
+			continue
+		}
+		packets, err := parsePacketMessages(buf[:n])
+		if err != nil {
+			logCxt.WithError(err).Warn("Failed to parse NFLOG message")
+		}
+		for _, p := range packets {
+			countPacketsReceived.Inc()
+			packetsC <- p
+		}
+	}
+}
+
+// waitForAck reads messages from the socket until it sees the ack (or error) for the request
+// with the given sequence number.
+func waitForAck(fd int, seq uint32) error {
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errTruncated
+			}
+			errno := int32(nativeEndian.Uint32(m.Data[:4]))
+			if errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// parsePacketMessages extracts the packets from a buffer of netlink messages.  Messages
+// other than NFLOG packets are ignored.
+func parsePacketMessages(buf []byte) (packets []Packet, err error) {
+	msgs, err := syscall.ParseNetlinkMessage(buf)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		if m.Header.Type != (nfnlSubsysULOG<<8)|nfulnlMsgPacket {
+			continue
+		}
+		if len(m.Data) < nfgenMsgLen {
+			return packets, errTruncated
+		}
+		var p Packet
+		attrs := m.Data[nfgenMsgLen:]
+		for len(attrs) >= nlaHdrLen {
+			attrLen := int(nativeEndian.Uint16(attrs[0:2]))
+			attrType := nativeEndian.Uint16(attrs[2:4]) & nlaTypeMask
+			if attrLen < nlaHdrLen || attrLen > len(attrs) {
+				return packets, errTruncated
+			}
+			value := attrs[nlaHdrLen:attrLen]
+			switch attrType {
+			case nfulaPayload:
+				p.Payload = append([]byte(nil), value...)
+			case nfulaPrefix:
+				// The prefix is NUL-terminated.
+				for i, b := range value {
+					if b == 0 {
+						value = value[:i]
+						break
+					}
+				}
+				p.Prefix = string(value)
+			}
+			attrs = attrs[align(attrLen):]
+		}
+		packets = append(packets, p)
+	}
+	return
+}
+
+// configRequest builds a NFULNL_MSG_CONFIG request carrying the given attribute.
+func configRequest(group uint16, family uint8, seq uint32, attr []byte) []byte {
+	msgLen := syscall.NLMSG_HDRLEN + nfgenMsgLen + len(attr)
+	buf := make([]byte, msgLen)
+	nativeEndian.PutUint32(buf[0:4], uint32(msgLen))
+	nativeEndian.PutUint16(buf[4:6], (nfnlSubsysULOG<<8)|nfulnlMsgConfig)
+	nativeEndian.PutUint16(buf[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	nativeEndian.PutUint32(buf[8:12], seq)
+	// nfgenmsg: family, version, then the group (res_id) in network order.
+	buf[16] = family
+	buf[17] = 0
+	binary.BigEndian.PutUint16(buf[18:20], group)
+	copy(buf[20:], attr)
+	return buf
+}
+
+func cmdAttr(cmd uint8) []byte {
+	return attr(nfulaCfgCmd, []byte{cmd})
+}
+
+func modeAttr(copyRange uint32, copyMode uint8) []byte {
+	value := make([]byte, 6)
+	binary.BigEndian.PutUint32(value[0:4], copyRange)
+	value[4] = copyMode
+	return attr(nfulaCfgMode, value)
+}
+
+func attr(attrType uint16, value []byte) []byte {
+	attrLen := nlaHdrLen + len(value)
+	buf := make([]byte, align(attrLen))
+	nativeEndian.PutUint16(buf[0:2], uint16(attrLen))
+	nativeEndian.PutUint16(buf[2:4], attrType)
+	copy(buf[nlaHdrLen:], value)
+	return buf
+}
+
+func align(l int) int {
+	return (l + syscall.NLA_ALIGNTO - 1) & ^(syscall.NLA_ALIGNTO - 1)
+}
+
+// nativeEndian is the byte order of the host, which netlink uses for its headers.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
@@ -0,0 +1,91 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nflog
+
+import (
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// packetMessage builds a netlink message as the kernel would send it for a logged packet.
+func packetMessage(attrs ...[]byte) []byte {
+	var body []byte
+	for _, a := range attrs {
+		body = append(body, a...)
+	}
+	msg := configRequest(0, syscall.AF_INET, 0, body)
+	nativeEndian.PutUint16(msg[4:6], (nfnlSubsysULOG<<8)|nfulnlMsgPacket)
+	return msg
+}
+
+var _ = Describe("NFLOG message parsing", func() {
+	It("should extract the prefix and payload", func() {
+		msg := packetMessage(
+			attr(nfulaPrefix, []byte("abcd\x00")),
+			attr(nfulaPayload, []byte{1, 2, 3, 4, 5}),
+		)
+		packets, err := parsePacketMessages(msg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packets).To(Equal([]Packet{{Prefix: "abcd", Payload: []byte{1, 2, 3, 4, 5}}}))
+	})
+
+	It("should handle multiple messages in one buffer", func() {
+		buf := append(
+			packetMessage(attr(nfulaPayload, []byte{1})),
+			packetMessage(attr(nfulaPayload, []byte{2, 3}))...,
+		)
+		packets, err := parsePacketMessages(buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packets).To(Equal([]Packet{{Payload: []byte{1}}, {Payload: []byte{2, 3}}}))
+	})
+
+	It("should ignore attributes that it doesn't understand", func() {
+		msg := packetMessage(
+			attr(2, []byte{0, 0, 0, 1}),
+			attr(nfulaPayload, []byte{1, 2, 3}),
+		)
+		packets, err := parsePacketMessages(msg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packets).To(Equal([]Packet{{Payload: []byte{1, 2, 3}}}))
+	})
+
+	It("should ignore other message types", func() {
+		msg := configRequest(1, syscall.AF_INET, 1, cmdAttr(nfulnlCfgCmdBind))
+		packets, err := parsePacketMessages(msg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packets).To(BeEmpty())
+	})
+
+	It("should reject a truncated attribute", func() {
+		msg := packetMessage(attr(nfulaPayload, []byte{1, 2, 3, 4}))
+		nativeEndian.PutUint16(msg[20:22], 100)
+		_, err := parsePacketMessages(msg)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("NFLOG config requests", func() {
+	It("should encode the group in network order", func() {
+		msg := configRequest(0x0102, syscall.AF_INET, 7, modeAttr(0xffff, nfulnlCopyPacket))
+		Expect(msg).To(HaveLen(syscall.NLMSG_HDRLEN + 4 + 12))
+		Expect(nativeEndian.Uint32(msg[0:4])).To(Equal(uint32(len(msg))))
+		Expect(nativeEndian.Uint32(msg[8:12])).To(Equal(uint32(7)))
+		Expect(msg[16:20]).To(Equal([]byte{syscall.AF_INET, 0, 1, 2}))
+		// Attribute header, then the copy range and mode.
+		Expect(msg[24:30]).To(Equal([]byte{0, 0, 0xff, 0xff, nfulnlCopyPacket, 0}))
+	})
+})
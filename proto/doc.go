@@ -121,7 +121,11 @@
 // in a section below.  The dataplane driver has the same lifetime as the
 // main process.
 //
-// In either case, the protocol (described in more detail below) starts
+// Alternatively, the main process can connect to an external dataplane driver
+// that implements the DataplaneDriver gRPC service.  The messages are then sent
+// over a bidirectional gRPC stream instead of the pipes.
+//
+// In any case, the protocol (described in more detail below) starts
 // with a handshake to exchange configuration.  Then the calculation engine
 // begins its resync with the datastore, emitting updates as it scans
 // through the current state. Once complete, the calculation engine enters
@@ -133,6 +137,15 @@
 //
 // Handshake
 //
+// An external dataplane driver is first sent a Hello message containing the
+// protocol version and the list of optional features that the main process
+// supports.  The driver should reply with its own Hello, listing the features
+// that it supports.  The main process only sends the messages that belong to
+// an optional feature if the driver supports that feature.  This allows older
+// drivers to keep working as new message types are added.  Drivers that
+// predate the Hello message never reply; the main process times out waiting
+// for a reply and then treats them as supporting no optional features.
+//
 // Before sending its stream of updates, the calculation engine loads and resolves
 // the configuration (from file, environment variables and the datastore) and
 // then sends a ConfigUpdate message with the resolved configuration.  This
@@ -173,7 +186,10 @@
 // the dataplane immediately, message-by-message after a restart then it may
 // disrupt connectivity to already-configured workloads.  To prevent this,
 // the dataplane driver should delay programming of potentially incorrect
-// state until after it receives the InSync message.
+// state until after it receives the InSync message.  (The internal dataplane
+// driver can be configured to give up waiting after GracefulRestartTimeoutSecs,
+// trading the risk of disruption for not leaving new workloads unprogrammed if
+// the resync is very slow.)
 //
 // Driver status updates
 //
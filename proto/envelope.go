@@ -0,0 +1,112 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proto
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// WrapToDataplane wraps the given message in a ToDataplane envelope.  It panics if the
+// message is of an unknown type.
+func WrapToDataplane(msg interface{}) *ToDataplane {
+	envelope := &ToDataplane{}
+	switch msg := msg.(type) {
+	case *ConfigUpdate:
+		envelope.Payload = &ToDataplane_ConfigUpdate{msg}
+	case *InSync:
+		envelope.Payload = &ToDataplane_InSync{msg}
+	case *IPSetUpdate:
+		envelope.Payload = &ToDataplane_IpsetUpdate{msg}
+	case *IPSetDeltaUpdate:
+		envelope.Payload = &ToDataplane_IpsetDeltaUpdate{msg}
+	case *IPSetRemove:
+		envelope.Payload = &ToDataplane_IpsetRemove{msg}
+	case *ActivePolicyUpdate:
+		envelope.Payload = &ToDataplane_ActivePolicyUpdate{msg}
+	case *ActivePolicyRemove:
+		envelope.Payload = &ToDataplane_ActivePolicyRemove{msg}
+	case *ActiveProfileUpdate:
+		envelope.Payload = &ToDataplane_ActiveProfileUpdate{msg}
+	case *ActiveProfileRemove:
+		envelope.Payload = &ToDataplane_ActiveProfileRemove{msg}
+	case *HostEndpointUpdate:
+		envelope.Payload = &ToDataplane_HostEndpointUpdate{msg}
+	case *HostEndpointRemove:
+		envelope.Payload = &ToDataplane_HostEndpointRemove{msg}
+	case *WorkloadEndpointUpdate:
+		envelope.Payload = &ToDataplane_WorkloadEndpointUpdate{msg}
+	case *WorkloadEndpointRemove:
+		envelope.Payload = &ToDataplane_WorkloadEndpointRemove{msg}
+	case *HostMetadataUpdate:
+		envelope.Payload = &ToDataplane_HostMetadataUpdate{msg}
+	case *HostMetadataRemove:
+		envelope.Payload = &ToDataplane_HostMetadataRemove{msg}
+	case *IPAMPoolUpdate:
+		envelope.Payload = &ToDataplane_IpamPoolUpdate{msg}
+	case *IPAMPoolRemove:
+		envelope.Payload = &ToDataplane_IpamPoolRemove{msg}
+	case *Hello:
+		envelope.Payload = &ToDataplane_Hello{msg}
+	default:
+		log.WithField("msg", msg).Panic("Unknown message type")
+	}
+	return envelope
+}
+
+// UnwrapToDataplane extracts the payload message from the given ToDataplane envelope.  It
+// returns nil if the payload is of an unknown type.
+func UnwrapToDataplane(envelope *ToDataplane) (msg interface{}) {
+	switch payload := envelope.Payload.(type) {
+	case *ToDataplane_ConfigUpdate:
+		msg = payload.ConfigUpdate
+	case *ToDataplane_InSync:
+		msg = payload.InSync
+	case *ToDataplane_IpsetUpdate:
+		msg = payload.IpsetUpdate
+	case *ToDataplane_IpsetDeltaUpdate:
+		msg = payload.IpsetDeltaUpdate
+	case *ToDataplane_IpsetRemove:
+		msg = payload.IpsetRemove
+	case *ToDataplane_ActivePolicyUpdate:
+		msg = payload.ActivePolicyUpdate
+	case *ToDataplane_ActivePolicyRemove:
+		msg = payload.ActivePolicyRemove
+	case *ToDataplane_ActiveProfileUpdate:
+		msg = payload.ActiveProfileUpdate
+	case *ToDataplane_ActiveProfileRemove:
+		msg = payload.ActiveProfileRemove
+	case *ToDataplane_HostEndpointUpdate:
+		msg = payload.HostEndpointUpdate
+	case *ToDataplane_HostEndpointRemove:
+		msg = payload.HostEndpointRemove
+	case *ToDataplane_WorkloadEndpointUpdate:
+		msg = payload.WorkloadEndpointUpdate
+	case *ToDataplane_WorkloadEndpointRemove:
+		msg = payload.WorkloadEndpointRemove
+	case *ToDataplane_HostMetadataUpdate:
+		msg = payload.HostMetadataUpdate
+	case *ToDataplane_HostMetadataRemove:
+		msg = payload.HostMetadataRemove
+	case *ToDataplane_IpamPoolUpdate:
+		msg = payload.IpamPoolUpdate
+	case *ToDataplane_IpamPoolRemove:
+		msg = payload.IpamPoolRemove
+	case *ToDataplane_Hello:
+		msg = payload.Hello
+	default:
+		log.WithField("payload", payload).Warn("Ignoring unknown message to dataplane")
+	}
+	return
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routerule
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/set"
+)
+
+var (
+	ListFailed   = errors.New("netlink list operation failed")
+	UpdateFailed = errors.New("netlink update operation failed")
+
+	countNumRuleUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_route_rule_updates",
+		Help: "Number of policy routing rules that we've added or removed.",
+	}, []string{"ip_version", "op"})
+)
+
+func init() {
+	prometheus.MustRegister(countNumRuleUpdates)
+}
+
+// Rule is a policy routing rule ("ip rule") that steers matching traffic into one of our
+// routing tables.
+type Rule struct {
+	// Priority of the rule; the kernel evaluates rules in order of increasing priority.
+	Priority int
+	// Src, if non-nil, limits the rule to traffic from the given CIDR.
+	Src ip.CIDR
+	// Mark and Mask, if Mask is non-zero, limit the rule to traffic with the given fwmark.
+	Mark uint32
+	Mask uint32
+	// TableIndex is the routing table in which to look up matching traffic.
+	TableIndex int
+}
+
+// RouteRules manages the policy routing rules that point to a set of routing tables that we
+// own.  Like the iptables Table, it takes a desired state and, on Apply(), it reads back the
+// rules from the dataplane and makes the minimal changes to bring the dataplane in line.  Rules
+// that point to tables that we don't own are left untouched.
+type RouteRules struct {
+	logCxt *log.Entry
+
+	ipVersion     uint8
+	netlinkFamily int
+
+	// tableIndices contains the indices of the routing tables that we own.
+	tableIndices set.Set
+
+	// desiredRules contains the Rule structs that we want in the dataplane.
+	desiredRules set.Set
+
+	// dirty is set when the desired state changes; inSync is cleared to force a resync.
+	dirty  bool
+	inSync bool
+
+	// dataplane is our shim for the netlink interface.
+	dataplane dataplaneIface
+}
+
+func New(ipVersion uint8, tableIndices []int) *RouteRules {
+	return NewWithShims(ipVersion, tableIndices, realDataplane{})
+}
+
+// NewWithShims is a test constructor, which allows netlink to be replaced by a shim.
+func NewWithShims(ipVersion uint8, tableIndices []int, nl dataplaneIface) *RouteRules {
+	var family int
+	switch ipVersion {
+	case 4:
+		family = netlink.FAMILY_V4
+	case 6:
+		family = netlink.FAMILY_V6
+	default:
+		log.WithField("ipVersion", ipVersion).Panic("Unknown IP version")
+	}
+	indices := set.New()
+	for _, idx := range tableIndices {
+		indices.Add(idx)
+	}
+	return &RouteRules{
+		logCxt: log.WithFields(log.Fields{
+			"ipVersion": ipVersion,
+		}),
+		ipVersion:     ipVersion,
+		netlinkFamily: family,
+		tableIndices:  indices,
+		desiredRules:  set.New(),
+		dataplane:     nl,
+	}
+}
+
+// SetRule adds the given rule to the desired state.  The rule must point to one of our tables.
+func (r *RouteRules) SetRule(rule Rule) {
+	if !r.tableIndices.Contains(rule.TableIndex) {
+		r.logCxt.WithField("rule", rule).Panic("Rule points to a routing table that we don't own")
+	}
+	if r.desiredRules.Contains(rule) {
+		return
+	}
+	r.logCxt.WithField("rule", rule).Debug("Adding rule to desired state")
+	r.desiredRules.Add(rule)
+	r.dirty = true
+}
+
+// RemoveRule removes the given rule from the desired state.
+func (r *RouteRules) RemoveRule(rule Rule) {
+	if !r.desiredRules.Contains(rule) {
+		return
+	}
+	r.logCxt.WithField("rule", rule).Debug("Removing rule from desired state")
+	r.desiredRules.Discard(rule)
+	r.dirty = true
+}
+
+func (r *RouteRules) QueueResync() {
+	r.logCxt.Info("Queueing a resync of routing rules.")
+	r.inSync = false
+}
+
+func (r *RouteRules) Apply() error {
+	if r.inSync && !r.dirty {
+		return nil
+	}
+
+	nlRules, err := r.dataplane.RuleList(r.netlinkFamily)
+	if err != nil {
+		r.logCxt.WithError(err).Error("Failed to list routing rules, will retry...")
+		r.inSync = false
+		return ListFailed
+	}
+
+	// Remove any rules that point to our tables but that we don't want, including rules
+	// that use matches that we don't support.
+	seenRules := set.New()
+	updatesFailed := false
+	for _, nlRule := range nlRules {
+		if !r.tableIndices.Contains(nlRule.Table) {
+			continue
+		}
+		rule, ok := ruleFromNetlink(&nlRule)
+		if ok && r.desiredRules.Contains(rule) && !seenRules.Contains(rule) {
+			seenRules.Add(rule)
+			continue
+		}
+		logCxt := r.logCxt.WithField("rule", nlRule)
+		logCxt.Info("Syncing rules: removing old rule.")
+		nlRule := nlRule
+		if err := r.dataplane.RuleDel(&nlRule); err != nil {
+			logCxt.WithError(err).Warn("Failed to remove rule")
+			updatesFailed = true
+			continue
+		}
+		countNumRuleUpdates.WithLabelValues(fmt.Sprint(r.ipVersion), "del").Inc()
+	}
+
+	// Then add any that are missing.
+	r.desiredRules.Iter(func(item interface{}) error {
+		rule := item.(Rule)
+		if seenRules.Contains(rule) {
+			return nil
+		}
+		logCxt := r.logCxt.WithField("rule", rule)
+		logCxt.Info("Syncing rules: adding new rule.")
+		if err := r.dataplane.RuleAdd(r.ruleToNetlink(rule)); err != nil {
+			logCxt.WithError(err).Warn("Failed to add rule")
+			updatesFailed = true
+			return nil
+		}
+		countNumRuleUpdates.WithLabelValues(fmt.Sprint(r.ipVersion), "add").Inc()
+		return nil
+	})
+
+	if updatesFailed {
+		r.logCxt.Warn("Failed to sync some routing rules, will retry...")
+		r.inSync = false
+		return UpdateFailed
+	}
+	r.dirty = false
+	r.inSync = true
+	return nil
+}
+
+func (r *RouteRules) ruleToNetlink(rule Rule) *netlink.Rule {
+	nlRule := netlink.NewRule()
+	nlRule.Family = r.netlinkFamily
+	nlRule.Priority = rule.Priority
+	nlRule.Table = rule.TableIndex
+	if rule.Src != nil {
+		src := rule.Src.ToIPNet()
+		nlRule.Src = &src
+	}
+	if rule.Mask != 0 {
+		nlRule.Mark = int(rule.Mark)
+		nlRule.Mask = int(rule.Mask)
+	}
+	return nlRule
+}
+
+// ruleFromNetlink converts a rule read from the dataplane into a Rule.  ok is false if the rule
+// uses matches that a Rule can't express.
+func ruleFromNetlink(nlRule *netlink.Rule) (rule Rule, ok bool) {
+	if nlRule.Dst != nil || nlRule.IifName != "" || nlRule.OifName != "" ||
+		nlRule.Goto > 0 || nlRule.Flow > 0 {
+		return
+	}
+	rule = Rule{
+		Priority:   nlRule.Priority,
+		TableIndex: nlRule.Table,
+	}
+	if nlRule.Src != nil {
+		rule.Src = ip.CIDRFromIPNet(nlRule.Src)
+	}
+	if nlRule.Mask > 0 {
+		rule.Mark = uint32(nlRule.Mark)
+		rule.Mask = uint32(nlRule.Mask)
+	}
+	ok = true
+	return
+}
+
+// dataplaneIface is our shim for the netlink calls that we make.
+type dataplaneIface interface {
+	RuleList(family int) ([]netlink.Rule, error)
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+}
+
+type realDataplane struct{}
+
+func (realDataplane) RuleList(family int) ([]netlink.Rule, error) {
+	return netlink.RuleList(family)
+}
+
+func (realDataplane) RuleAdd(rule *netlink.Rule) error {
+	return netlink.RuleAdd(rule)
+}
+
+func (realDataplane) RuleDel(rule *netlink.Rule) error {
+	return netlink.RuleDel(rule)
+}
+
+var _ dataplaneIface = realDataplane{}
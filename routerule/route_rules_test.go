@@ -0,0 +1,153 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routerule
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/ip"
+)
+
+var simulatedError = errors.New("dummy error")
+
+var _ = Describe("RouteRules", func() {
+	var dataplane *mockDataplane
+	var rules *RouteRules
+
+	rule1 := Rule{Priority: 100, Src: ip.MustParseCIDR("10.0.0.1/32"), TableIndex: 250}
+	rule2 := Rule{Priority: 101, Mark: 0x100, Mask: 0x100, TableIndex: 251}
+
+	BeforeEach(func() {
+		dataplane = &mockDataplane{}
+		rules = NewWithShims(4, []int{250, 251}, dataplane)
+	})
+
+	It("should add desired rules", func() {
+		rules.SetRule(rule1)
+		rules.SetRule(rule2)
+		Expect(rules.Apply()).To(Succeed())
+		Expect(dataplane.rules()).To(ConsistOf(rule1, rule2))
+	})
+
+	It("should panic if a rule points to a table that we don't own", func() {
+		Expect(func() {
+			rules.SetRule(Rule{Priority: 100, TableIndex: 254})
+		}).To(Panic())
+	})
+
+	Describe("with some rules in the dataplane", func() {
+		var foreignRule netlink.Rule
+		BeforeEach(func() {
+			foreignRule = *netlink.NewRule()
+			foreignRule.Priority = 32766
+			foreignRule.Table = 254
+			dataplane.nlRules = append(dataplane.nlRules,
+				foreignRule,
+				*rules.ruleToNetlink(rule1),
+				*rules.ruleToNetlink(Rule{Priority: 99, TableIndex: 251}),
+			)
+			rules.SetRule(rule1)
+			rules.SetRule(rule2)
+			Expect(rules.Apply()).To(Succeed())
+		})
+
+		It("should remove only stale rules that point to our tables", func() {
+			Expect(dataplane.nlRules).To(ContainElement(foreignRule))
+			Expect(dataplane.rules()).To(ConsistOf(rule1, rule2))
+			Expect(dataplane.numAdds).To(Equal(1))
+			Expect(dataplane.numDels).To(Equal(1))
+		})
+
+		It("should remove a rule once it is no longer wanted", func() {
+			rules.RemoveRule(rule1)
+			Expect(rules.Apply()).To(Succeed())
+			Expect(dataplane.rules()).To(ConsistOf(rule2))
+		})
+
+		It("should only read back the dataplane on resync", func() {
+			dataplane.nlRules = nil
+			Expect(rules.Apply()).To(Succeed())
+			Expect(dataplane.rules()).To(BeEmpty())
+			rules.QueueResync()
+			Expect(rules.Apply()).To(Succeed())
+			Expect(dataplane.rules()).To(ConsistOf(rule1, rule2))
+		})
+	})
+
+	Describe("with a transient failure", func() {
+		BeforeEach(func() {
+			rules.SetRule(rule1)
+			dataplane.failNextAdd = true
+		})
+
+		It("should retry on the next Apply()", func() {
+			Expect(rules.Apply()).To(Equal(UpdateFailed))
+			Expect(dataplane.rules()).To(BeEmpty())
+			Expect(rules.Apply()).To(Succeed())
+			Expect(dataplane.rules()).To(ConsistOf(rule1))
+		})
+	})
+})
+
+type mockDataplane struct {
+	nlRules     []netlink.Rule
+	failNextAdd bool
+	numAdds     int
+	numDels     int
+}
+
+func (d *mockDataplane) RuleList(family int) ([]netlink.Rule, error) {
+	return append([]netlink.Rule(nil), d.nlRules...), nil
+}
+
+func (d *mockDataplane) RuleAdd(rule *netlink.Rule) error {
+	if d.failNextAdd {
+		d.failNextAdd = false
+		return simulatedError
+	}
+	d.numAdds++
+	d.nlRules = append(d.nlRules, *rule)
+	return nil
+}
+
+func (d *mockDataplane) RuleDel(rule *netlink.Rule) error {
+	for i, r := range d.nlRules {
+		if r.Priority == rule.Priority && r.Table == rule.Table {
+			d.numDels++
+			d.nlRules = append(d.nlRules[:i], d.nlRules[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+// rules returns the dataplane's rules that point to our tables, converted to Rules.
+func (d *mockDataplane) rules() []Rule {
+	var rules []Rule
+	for _, nlRule := range d.nlRules {
+		if nlRule.Table != 250 && nlRule.Table != 251 {
+			continue
+		}
+		rule, ok := ruleFromNetlink(&nlRule)
+		Expect(ok).To(BeTrue())
+		rules = append(rules, rule)
+	}
+	return rules
+}
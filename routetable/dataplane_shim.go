@@ -16,12 +16,9 @@ package routetable
 
 import (
 	"net"
-	"os/exec"
 
+	log "github.com/Sirupsen/logrus"
 	. "github.com/vishvananda/netlink"
-
-	"github.com/projectcalico/felix/conntrack"
-	"github.com/projectcalico/felix/ip"
 )
 
 type dataplaneIface interface {
@@ -30,12 +27,16 @@ type dataplaneIface interface {
 	RouteList(link Link, family int) ([]Route, error)
 	RouteAdd(route *Route) error
 	RouteDel(route *Route) error
-	AddStaticArpEntry(cidr ip.CIDR, destMAC net.HardwareAddr, ifaceName string) error
+	NeighList(linkIndex, family int) ([]Neigh, error)
+	NeighSet(neigh *Neigh) error
+	NeighDel(neigh *Neigh) error
 	RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP)
 }
 
 type realDataplane struct {
-	conntrack *conntrack.Conntrack
+	conntrack ConntrackRemover
+	// tableIndex is the routing table that we list routes from, or 0 for the main table.
+	tableIndex int
 }
 
 func (r realDataplane) LinkList() ([]Link, error) {
@@ -47,7 +48,17 @@ func (r realDataplane) LinkByName(name string) (Link, error) {
 }
 
 func (r realDataplane) RouteList(link Link, family int) ([]Route, error) {
-	return RouteList(link, family)
+	if r.tableIndex == 0 {
+		return RouteList(link, family)
+	}
+	// RouteList() only lists the main table, filter on our table instead.
+	filter := &Route{Table: r.tableIndex}
+	filterMask := uint64(RT_FILTER_TABLE)
+	if link != nil {
+		filter.LinkIndex = link.Attrs().Index
+		filterMask |= RT_FILTER_OIF
+	}
+	return RouteListFiltered(family, filter, filterMask)
 }
 
 func (r realDataplane) RouteAdd(route *Route) error {
@@ -58,11 +69,16 @@ func (r realDataplane) RouteDel(route *Route) error {
 	return RouteDel(route)
 }
 
-func (r realDataplane) AddStaticArpEntry(cidr ip.CIDR, destMAC net.HardwareAddr, ifaceName string) error {
-	cmd := exec.Command("arp",
-		"-s", cidr.Addr().String(), destMAC.String(),
-		"-i", ifaceName)
-	return cmd.Run()
+func (r realDataplane) NeighList(linkIndex, family int) ([]Neigh, error) {
+	return NeighList(linkIndex, family)
+}
+
+func (r realDataplane) NeighSet(neigh *Neigh) error {
+	return NeighSet(neigh)
+}
+
+func (r realDataplane) NeighDel(neigh *Neigh) error {
+	return NeighDel(neigh)
 }
 
 func (r realDataplane) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
@@ -70,3 +86,37 @@ func (r realDataplane) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
 }
 
 var _ dataplaneIface = realDataplane{}
+
+// readOnlyDataplane passes through the calls that read the dataplane but, rather than making any
+// changes, it logs the changes that it would have made.
+type readOnlyDataplane struct {
+	dataplaneIface
+}
+
+func (r readOnlyDataplane) RouteAdd(route *Route) error {
+	countNumReadOnlyUpdatesSuppressed.Inc()
+	log.WithField("route", route).Warn("Read-only mode: route missing, not adding it")
+	return nil
+}
+
+func (r readOnlyDataplane) RouteDel(route *Route) error {
+	countNumReadOnlyUpdatesSuppressed.Inc()
+	log.WithField("route", route).Warn("Read-only mode: found unexpected route, not removing it")
+	return nil
+}
+
+func (r readOnlyDataplane) NeighSet(neigh *Neigh) error {
+	log.WithField("neigh", neigh).Debug("Read-only mode: not setting neighbour entry")
+	return nil
+}
+
+func (r readOnlyDataplane) NeighDel(neigh *Neigh) error {
+	log.WithField("neigh", neigh).Debug("Read-only mode: not removing neighbour entry")
+	return nil
+}
+
+func (r readOnlyDataplane) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
+	log.WithField("ipAddr", ipAddr).Debug("Read-only mode: not removing conntrack flows")
+}
+
+var _ dataplaneIface = readOnlyDataplane{}
@@ -16,8 +16,10 @@ package routetable
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"regexp"
+	"sort"
 	"strings"
 	"syscall"
 
@@ -50,15 +52,74 @@ var (
 		Name: "felix_route_table_per_iface_sync_seconds",
 		Help: "Time taken to sync each interface",
 	})
+	countNumReadOnlyUpdatesSuppressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_route_table_read_only_updates_suppressed",
+		Help: "Number of route updates that we didn't make because we're in read-only mode.",
+	})
+	gaugeNumConflicts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_route_table_conflicts",
+		Help: "Number of our routes that are blocked by a conflicting route on another interface.",
+	}, []string{"ip_version"})
 )
 
 func init() {
-	prometheus.MustRegister(listIfaceTime, perIfaceSyncTime)
+	prometheus.MustRegister(
+		listIfaceTime,
+		perIfaceSyncTime,
+		countNumReadOnlyUpdatesSuppressed,
+		gaugeNumConflicts,
+	)
 }
 
 type Target struct {
 	CIDR    ip.CIDR
 	DestMAC net.HardwareAddr
+	// GW, if non-nil, is the next hop for the route.  Otherwise, the route sends traffic
+	// directly to the interface.
+	GW ip.Addr
+}
+
+// RouteConflict describes a route that we failed to program because another route for the same
+// destination already exists on an interface that we don't own; for example, a stale route via a
+// docker bridge.  Rather than fighting with the other route, we leave it in place and report the
+// conflict until it is resolved.
+type RouteConflict struct {
+	CIDR ip.CIDR
+	// IfaceName is the name of our interface, which should own the route.
+	IfaceName string
+
+	// Attributes of the conflicting route.
+	ConflictingIfaceIndex int
+	ConflictingProtocol   int
+	ConflictingGW         net.IP
+}
+
+// Options controls the attributes of the routes that we program and how we clean up after
+// them.
+type Options struct {
+	// Metric, if non-zero, is the metric (priority) of our routes.
+	Metric int
+	// Protocol, if non-zero, is the routing protocol number that we tag our routes with.
+	// Using a distinct protocol number makes our routes easy to pick out with
+	// "ip route show proto <number>".  Defaults to RTPROT_BOOT.
+	Protocol int
+	// OnLink, if true, causes us to set the onlink flag on routes that have a next hop so
+	// that the kernel doesn't require the next hop to be reachable.  This is needed for
+	// next hops on tunnel devices.
+	OnLink bool
+	// TableIndex, if non-zero, is the auxiliary routing table to program our routes into.
+	// Otherwise, we use the main routing table.  Traffic is steered into auxiliary tables
+	// by policy routing rules; see the routerule package.
+	TableIndex int
+	// Conntrack, if non-nil, is used to remove the conntrack flows of routes that we remove.
+	// Normally a *conntrack.FlushQueue, shared between route tables, so that the removal
+	// doesn't block our Apply().  If nil, we remove the flows synchronously.
+	Conntrack ConntrackRemover
+}
+
+// ConntrackRemover is the interface that we use to remove conntrack flows.
+type ConntrackRemover interface {
+	RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP)
 }
 
 type RouteTable struct {
@@ -77,17 +138,52 @@ type RouteTable struct {
 
 	inSync bool
 
+	metric   int
+	protocol int
+	onLink   bool
+	// tableIndex is the routing table that we program, or 0 for the main table.
+	tableIndex int
+
+	// conflicts contains the routes that we've failed to program due to a conflicting
+	// route, indexed by destination CIDR.
+	conflicts map[ip.CIDR]RouteConflict
+	// conflictsChanged is set when conflicts is updated; cleared by ConflictsChanged().
+	conflictsChanged bool
+
 	// dataplane is our shim for the netlink/arp interface.  In production, it maps directly
 	// through to calls to the netlink package and the arp command.
 	dataplane dataplaneIface
 }
 
-func New(interfacePrefixes []string, ipVersion uint8) *RouteTable {
-	return NewWithShims(interfacePrefixes, ipVersion, realDataplane{conntrack: conntrack.New()})
+func New(interfacePrefixes []string, ipVersion uint8, options Options) *RouteTable {
+	return NewWithShims(interfacePrefixes, ipVersion, options, realDataplane{
+		conntrack:  conntrackRemover(options),
+		tableIndex: options.TableIndex,
+	})
+}
+
+// NewReadOnly creates a RouteTable that calculates the changes that are needed to bring the
+// routes into sync but, rather than applying them, only logs them.
+func NewReadOnly(interfacePrefixes []string, ipVersion uint8, options Options) *RouteTable {
+	return NewWithShims(interfacePrefixes, ipVersion, options, readOnlyDataplane{
+		realDataplane{conntrack: conntrackRemover(options), tableIndex: options.TableIndex},
+	})
+}
+
+func conntrackRemover(options Options) ConntrackRemover {
+	if options.Conntrack != nil {
+		return options.Conntrack
+	}
+	return conntrack.New()
 }
 
 // NewWithShims is a test constructor, which allows netlink to be replaced by a shim.
-func NewWithShims(interfacePrefixes []string, ipVersion uint8, nl dataplaneIface) *RouteTable {
+func NewWithShims(
+	interfacePrefixes []string,
+	ipVersion uint8,
+	options Options,
+	nl dataplaneIface,
+) *RouteTable {
 	prefixSet := set.New()
 	regexpParts := []string{}
 	for _, prefix := range interfacePrefixes {
@@ -104,6 +200,10 @@ func NewWithShims(interfacePrefixes []string, ipVersion uint8, nl dataplaneIface
 	} else if ipVersion != 4 {
 		log.WithField("ipVersion", ipVersion).Panic("Unknown IP version")
 	}
+	protocol := options.Protocol
+	if protocol == 0 {
+		protocol = syscall.RTPROT_BOOT
+	}
 
 	return &RouteTable{
 		logCxt: log.WithFields(log.Fields{
@@ -116,6 +216,11 @@ func NewWithShims(interfacePrefixes []string, ipVersion uint8, nl dataplaneIface
 		ifaceNameToTargets:        map[string][]Target{},
 		pendingIfaceNameToTargets: map[string][]Target{},
 		dirtyIfaces:               set.New(),
+		metric:                    options.Metric,
+		protocol:                  protocol,
+		onLink:                    options.OnLink,
+		tableIndex:                options.TableIndex,
+		conflicts:                 map[ip.CIDR]RouteConflict{},
 		dataplane:                 nl,
 	}
 }
@@ -236,9 +341,11 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 
 	expectedTargets := r.ifaceNameToTargets[ifaceName]
 	expectedCIDRs := set.New()
+	cidrToTarget := map[ip.CIDR]Target{}
 	for _, t := range expectedTargets {
 		expectedCIDRs.Add(t.CIDR)
 		oldCIDRs.Discard(t.CIDR)
+		cidrToTarget[t.CIDR] = t
 	}
 	if r.ipVersion == 6 {
 		expectedCIDRs.Add(ipV6LinkLocalCIDR)
@@ -250,6 +357,7 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 	defer oldCIDRs.Iter(func(item interface{}) error {
 		// Remove and conntrack entries that should no longer be there.
 		dest := item.(ip.CIDR)
+		r.clearConflict(dest, ifaceName)
 		r.dataplane.RemoveConntrackFlows(dest.Version(), dest.Addr().AsNetIP())
 		return nil
 	})
@@ -293,6 +401,19 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 		if route.Dst != nil {
 			dest = ip.CIDRFromIPNet(route.Dst)
 		}
+		target, isTarget := cidrToTarget[dest]
+		if isTarget && !r.routeMatchesTarget(&route, target) {
+			// The route is for one of our targets but it has the wrong attributes;
+			// remove it so that it gets re-added below.
+			logCxt := logCxt.WithField("dest", dest)
+			logCxt.Info("Syncing routes: removing route with incorrect attributes.")
+			if err := r.dataplane.RouteDel(&route); err != nil {
+				logCxt.WithError(err).Info(
+					"Route deletion failed, assuming someone got there first.")
+				updatesFailed = true
+			}
+			continue
+		}
 		if !expectedCIDRs.Contains(dest) {
 			logCxt := logCxt.WithField("dest", dest)
 			logCxt.Info("Syncing routes: removing old route.")
@@ -315,29 +436,29 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 		if !seenCIDRs.Contains(cidr) {
 			logCxt := logCxt.WithField("targetCIDR", target.CIDR)
 			logCxt.Info("Syncing routes: adding new route.")
-			ipNet := cidr.ToIPNet()
-			route := netlink.Route{
-				LinkIndex: linkAttrs.Index,
-				Dst:       &ipNet,
-				Type:      syscall.RTN_UNICAST,
-				Protocol:  syscall.RTPROT_BOOT,
-				Scope:     netlink.SCOPE_LINK,
-			}
+			route := r.routeForTarget(linkAttrs.Index, target)
 			if err := r.dataplane.RouteAdd(&route); err != nil {
-				logCxt.WithError(err).Warn("Failed to add route")
-				updatesFailed = true
-			}
-		}
-		if r.ipVersion == 4 && target.DestMAC != nil {
-			// TODO(smc) clean up/sync old ARP entries
-			err := r.dataplane.AddStaticArpEntry(cidr, target.DestMAC, ifaceName)
-			if err != nil {
-				logCxt.WithError(err).Warn("Failed to set ARP entry")
-				updatesFailed = true
+				if conflict := r.findConflict(ifaceName, linkAttrs.Index, cidr); conflict != nil {
+					// Another route is in the way; report it rather than retrying
+					// in a tight loop.  We'll try again on the next resync.
+					r.setConflict(*conflict)
+				} else {
+					logCxt.WithError(err).Warn("Failed to add route")
+					updatesFailed = true
+				}
+			} else {
+				r.clearConflict(cidr, ifaceName)
 			}
+		} else {
+			r.clearConflict(cidr, ifaceName)
 		}
 	}
 
+	if err := r.syncNeighbours(linkAttrs.Index, expectedTargets); err != nil {
+		logCxt.WithError(err).Warn("Failed to sync neighbour entries")
+		updatesFailed = true
+	}
+
 	if updatesFailed {
 		// Recheck whether the interface exists so we don't produce spammy logs during
 		// interface removal.
@@ -347,6 +468,202 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 	return nil
 }
 
+// syncNeighbours programs permanent ARP (IPv4) or NDP (IPv6) entries for the targets that have
+// a MAC, so that the host doesn't need to do neighbour discovery to reach the workload.  It also
+// removes any other permanent entries from the interface, such as those left behind when an IP
+// moves to a different workload.  Entries created by neighbour discovery are left alone.
+//
+// We don't program proxy-NDP (NTF_PROXY) entries.  An IPv6 workload's gateway is the link-local
+// address of the host end of its veth, which the host answers for without a proxy entry, and we
+// don't know of any other address that the workload needs to resolve.  Proxy entries added by
+// other processes are listed separately by the kernel so this function doesn't touch them.
+func (r *RouteTable) syncNeighbours(linkIndex int, targets []Target) error {
+	ipToMAC := map[string]net.HardwareAddr{}
+	for _, target := range targets {
+		if target.DestMAC == nil {
+			continue
+		}
+		ipToMAC[target.CIDR.Addr().String()] = target.DestMAC
+	}
+
+	neighs, err := r.dataplane.NeighList(linkIndex, r.netlinkFamily)
+	if err != nil {
+		return err
+	}
+	correctIPs := set.New()
+	var lastErr error
+	for _, neigh := range neighs {
+		if neigh.IP == nil || neigh.State&netlink.NUD_PERMANENT == 0 {
+			continue
+		}
+		ipStr := neigh.IP.String()
+		mac, ok := ipToMAC[ipStr]
+		if ok && neigh.HardwareAddr.String() == mac.String() {
+			correctIPs.Add(ipStr)
+			continue
+		}
+		if ok {
+			// Wrong MAC, NeighSet() will replace the entry below.
+			continue
+		}
+		logCxt := r.logCxt.WithField("neigh", neigh)
+		logCxt.Info("Syncing neighbours: removing stale entry.")
+		neigh := neigh
+		if err := r.dataplane.NeighDel(&neigh); err != nil {
+			logCxt.WithError(err).Warn("Failed to remove neighbour entry")
+			lastErr = err
+		}
+	}
+
+	for ipStr, mac := range ipToMAC {
+		if correctIPs.Contains(ipStr) {
+			continue
+		}
+		neigh := &netlink.Neigh{
+			LinkIndex:    linkIndex,
+			Family:       r.netlinkFamily,
+			State:        netlink.NUD_PERMANENT,
+			IP:           net.ParseIP(ipStr),
+			HardwareAddr: mac,
+		}
+		logCxt := r.logCxt.WithField("neigh", neigh)
+		logCxt.Debug("Syncing neighbours: setting entry.")
+		if err := r.dataplane.NeighSet(neigh); err != nil {
+			logCxt.WithError(err).Warn("Failed to set neighbour entry")
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// routeForTarget calculates the route that we program for the given target.
+func (r *RouteTable) routeForTarget(linkIndex int, target Target) netlink.Route {
+	ipNet := target.CIDR.ToIPNet()
+	route := netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       &ipNet,
+		Type:      syscall.RTN_UNICAST,
+		Protocol:  r.protocol,
+		Priority:  r.metric,
+		Table:     r.tableIndex,
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if target.GW != nil {
+		route.Gw = target.GW.AsNetIP()
+		route.Scope = netlink.SCOPE_UNIVERSE
+		if r.onLink {
+			route.SetFlag(netlink.FLAG_ONLINK)
+		}
+	}
+	return route
+}
+
+// routeMatchesTarget returns true if the given route from the dataplane has the attributes that
+// we'd program for the target.
+func (r *RouteTable) routeMatchesTarget(route *netlink.Route, target Target) bool {
+	if route.Protocol != r.protocol {
+		return false
+	}
+	// The kernel picks a default metric for IPv6 routes so we only check the metric if
+	// we're setting it.
+	if r.metric != 0 && route.Priority != r.metric {
+		return false
+	}
+	if target.GW == nil {
+		return route.Gw == nil
+	}
+	return target.GW.AsNetIP().Equal(route.Gw)
+}
+
+// findConflict looks for a route to the given CIDR on an interface other than ours, returning
+// a RouteConflict describing it, if found.
+func (r *RouteTable) findConflict(ifaceName string, linkIndex int, cidr ip.CIDR) *RouteConflict {
+	routes, err := r.dataplane.RouteList(nil, r.netlinkFamily)
+	if err != nil {
+		r.logCxt.WithError(err).Warn("Failed to list routes while checking for conflicts")
+		return nil
+	}
+	for _, route := range routes {
+		if route.Dst == nil || route.LinkIndex == linkIndex {
+			continue
+		}
+		if ip.CIDRFromIPNet(route.Dst) != cidr {
+			continue
+		}
+		return &RouteConflict{
+			CIDR:                  cidr,
+			IfaceName:             ifaceName,
+			ConflictingIfaceIndex: route.LinkIndex,
+			ConflictingProtocol:   route.Protocol,
+			ConflictingGW:         route.Gw,
+		}
+	}
+	return nil
+}
+
+func (r *RouteTable) setConflict(conflict RouteConflict) {
+	if oldConflict, ok := r.conflicts[conflict.CIDR]; ok &&
+		oldConflict.IfaceName == conflict.IfaceName &&
+		oldConflict.ConflictingIfaceIndex == conflict.ConflictingIfaceIndex &&
+		oldConflict.ConflictingProtocol == conflict.ConflictingProtocol &&
+		oldConflict.ConflictingGW.Equal(conflict.ConflictingGW) {
+		// Already reported.
+		return
+	}
+	r.logCxt.WithFields(log.Fields{
+		"cidr":                  conflict.CIDR,
+		"ifaceName":             conflict.IfaceName,
+		"conflictingIfaceIndex": conflict.ConflictingIfaceIndex,
+		"conflictingProtocol":   conflict.ConflictingProtocol,
+		"conflictingGW":         conflict.ConflictingGW,
+	}).Warn("Route conflict: another interface already has a route for an endpoint IP. " +
+		"Leaving the conflicting route in place.")
+	r.conflicts[conflict.CIDR] = conflict
+	r.conflictsChanged = true
+	r.updateConflictsGauge()
+}
+
+func (r *RouteTable) clearConflict(cidr ip.CIDR, ifaceName string) {
+	conflict, ok := r.conflicts[cidr]
+	if !ok || conflict.IfaceName != ifaceName {
+		return
+	}
+	r.logCxt.WithFields(log.Fields{
+		"cidr":      cidr,
+		"ifaceName": ifaceName,
+	}).Info("Route conflict resolved.")
+	delete(r.conflicts, cidr)
+	r.conflictsChanged = true
+	r.updateConflictsGauge()
+}
+
+func (r *RouteTable) updateConflictsGauge() {
+	gaugeNumConflicts.WithLabelValues(fmt.Sprint(r.ipVersion)).Set(float64(len(r.conflicts)))
+}
+
+// Conflicts returns the currently-active route conflicts, sorted by CIDR.
+func (r *RouteTable) Conflicts() []RouteConflict {
+	conflicts := make([]RouteConflict, 0, len(r.conflicts))
+	for _, c := range r.conflicts {
+		conflicts = append(conflicts, c)
+	}
+	sort.Sort(conflictsByCIDR(conflicts))
+	return conflicts
+}
+
+type conflictsByCIDR []RouteConflict
+
+func (c conflictsByCIDR) Len() int           { return len(c) }
+func (c conflictsByCIDR) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c conflictsByCIDR) Less(i, j int) bool { return c[i].CIDR.String() < c[j].CIDR.String() }
+
+// ConflictsChanged returns true if the set of route conflicts has changed since the last call.
+func (r *RouteTable) ConflictsChanged() bool {
+	changed := r.conflictsChanged
+	r.conflictsChanged = false
+	return changed
+}
+
 // filterErrorByIfaceState checks the current state of the interface; if it's down or gone, it
 // returns IfaceDown or IfaceNotPresent, otherwise, it returns the given defaultErr.
 func (r *RouteTable) filterErrorByIfaceState(ifaceName string, currentErr, defaultErr error) error {
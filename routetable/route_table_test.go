@@ -61,8 +61,9 @@ var _ = Describe("RouteTable", func() {
 			routeKeyToRoute:  map[string]netlink.Route{},
 			addedRouteKeys:   set.New(),
 			deletedRouteKeys: set.New(),
+			neighKeyToNeigh:  map[string]netlink.Neigh{},
 		}
-		rt = NewWithShims([]string{"cali"}, 4, dataplane)
+		rt = NewWithShims([]string{"cali"}, 4, Options{}, dataplane)
 	})
 
 	It("should be constructable", func() {
@@ -108,6 +109,163 @@ var _ = Describe("RouteTable", func() {
 			Expect(dataplane.addedRouteKeys).To(BeEmpty())
 		})
 
+		Describe("with some neighbour entries", func() {
+			var dynamicNeigh netlink.Neigh
+			BeforeEach(func() {
+				// A stale permanent entry for an IP that has moved away.
+				dataplane.neighKeyToNeigh["1-10.0.0.9"] = netlink.Neigh{
+					LinkIndex:    1,
+					Family:       netlink.FAMILY_V4,
+					State:        netlink.NUD_PERMANENT,
+					IP:           net.ParseIP("10.0.0.9"),
+					HardwareAddr: mac2,
+				}
+				// An entry learned by ARP, which we should leave alone.
+				dynamicNeigh = netlink.Neigh{
+					LinkIndex:    1,
+					Family:       netlink.FAMILY_V4,
+					State:        netlink.NUD_REACHABLE,
+					IP:           net.ParseIP("10.0.0.8"),
+					HardwareAddr: mac3,
+				}
+				dataplane.neighKeyToNeigh["1-10.0.0.8"] = dynamicNeigh
+				rt.SetRoutes("cali1", []Target{
+					{CIDR: ip.MustParseCIDR("10.0.0.1/32"), DestMAC: mac1},
+				})
+				Expect(rt.Apply()).To(Succeed())
+			})
+
+			It("should program a permanent entry for the workload and remove stale ones", func() {
+				Expect(dataplane.neighKeyToNeigh).To(Equal(map[string]netlink.Neigh{
+					"1-10.0.0.1": {
+						LinkIndex:    1,
+						Family:       netlink.FAMILY_V4,
+						State:        netlink.NUD_PERMANENT,
+						IP:           net.ParseIP("10.0.0.1"),
+						HardwareAddr: mac1,
+					},
+					"1-10.0.0.8": dynamicNeigh,
+				}))
+			})
+
+			It("should update the entry if the MAC changes", func() {
+				rt.SetRoutes("cali1", []Target{
+					{CIDR: ip.MustParseCIDR("10.0.0.1/32"), DestMAC: mac2},
+				})
+				Expect(rt.Apply()).To(Succeed())
+				Expect(dataplane.neighKeyToNeigh["1-10.0.0.1"].HardwareAddr).To(Equal(mac2))
+			})
+
+			It("should remove the entry when the workload goes away", func() {
+				rt.SetRoutes("cali1", nil)
+				Expect(rt.Apply()).To(Succeed())
+				Expect(dataplane.neighKeyToNeigh).To(Equal(map[string]netlink.Neigh{
+					"1-10.0.0.8": dynamicNeigh,
+				}))
+			})
+		})
+
+		Describe("with a conflicting route on another interface", func() {
+			var conflictingRoute netlink.Route
+			BeforeEach(func() {
+				conflictingRoute = netlink.Route{
+					LinkIndex: eth0.attrs.Index,
+					Dst:       mustParseCIDR("10.0.0.2/32"),
+					Type:      syscall.RTN_UNICAST,
+					Protocol:  syscall.RTPROT_STATIC,
+					Scope:     netlink.SCOPE_LINK,
+				}
+				dataplane.addMockRoute(&conflictingRoute)
+				rt.SetRoutes("cali2", []Target{
+					{CIDR: ip.MustParseCIDR("10.0.0.2/32"), DestMAC: mac1},
+				})
+			})
+
+			It("should report the conflict rather than failing", func() {
+				Expect(rt.Apply()).To(Succeed())
+				Expect(dataplane.routeKeyToRoute).To(ContainElement(conflictingRoute))
+				Expect(rt.ConflictsChanged()).To(BeTrue())
+				Expect(rt.ConflictsChanged()).To(BeFalse())
+				Expect(rt.Conflicts()).To(Equal([]RouteConflict{{
+					CIDR:                  ip.MustParseCIDR("10.0.0.2/32"),
+					IfaceName:             "cali2",
+					ConflictingIfaceIndex: eth0.attrs.Index,
+					ConflictingProtocol:   syscall.RTPROT_STATIC,
+				}}))
+			})
+			It("should clear the conflict once the other route is removed", func() {
+				Expect(rt.Apply()).To(Succeed())
+				Expect(rt.ConflictsChanged()).To(BeTrue())
+				dataplane.removeMockRoute(&conflictingRoute)
+				rt.QueueResync()
+				Expect(rt.Apply()).To(Succeed())
+				Expect(rt.ConflictsChanged()).To(BeTrue())
+				Expect(rt.Conflicts()).To(BeEmpty())
+				Expect(dataplane.routeKeyToRoute).To(HaveKey("2-10.0.0.2/32"))
+			})
+			It("should clear the conflict if the endpoint is removed", func() {
+				Expect(rt.Apply()).To(Succeed())
+				rt.SetRoutes("cali2", nil)
+				Expect(rt.Apply()).To(Succeed())
+				Expect(rt.Conflicts()).To(BeEmpty())
+			})
+		})
+
+		Describe("with route options", func() {
+			BeforeEach(func() {
+				rt = NewWithShims([]string{"cali"}, 4, Options{
+					Metric:   100,
+					Protocol: 80,
+					OnLink:   true,
+				}, dataplane)
+				rt.SetRoutes("cali1", []Target{
+					{CIDR: ip.MustParseCIDR("10.0.0.1/32"), DestMAC: mac1},
+				})
+				rt.SetRoutes("cali3", []Target{
+					{
+						CIDR:    ip.MustParseCIDR("10.0.0.3/32"),
+						DestMAC: mac1,
+						GW:      ip.FromString("10.0.0.254"),
+					},
+				})
+				rt.Apply()
+			})
+
+			It("should replace routes that have the wrong attributes", func() {
+				Expect(dataplane.deletedRouteKeys.Contains("1-10.0.0.1/32")).To(BeTrue())
+				Expect(dataplane.routeKeyToRoute["1-10.0.0.1/32"]).To(Equal(netlink.Route{
+					LinkIndex: cali1.attrs.Index,
+					Dst:       mustParseCIDR("10.0.0.1/32"),
+					Type:      syscall.RTN_UNICAST,
+					Protocol:  80,
+					Priority:  100,
+					Scope:     netlink.SCOPE_LINK,
+				}))
+			})
+			It("should program next hops with the onlink flag", func() {
+				expectedRoute := netlink.Route{
+					LinkIndex: cali3.attrs.Index,
+					Dst:       mustParseCIDR("10.0.0.3/32"),
+					Gw:        net.ParseIP("10.0.0.254").To4(),
+					Type:      syscall.RTN_UNICAST,
+					Protocol:  80,
+					Priority:  100,
+					Scope:     netlink.SCOPE_UNIVERSE,
+				}
+				expectedRoute.SetFlag(netlink.FLAG_ONLINK)
+				Expect(dataplane.deletedRouteKeys.Contains("3-10.0.0.3/32")).To(BeTrue())
+				Expect(dataplane.routeKeyToRoute["3-10.0.0.3/32"]).To(Equal(expectedRoute))
+			})
+			It("should leave correct routes alone on resync", func() {
+				dataplane.addedRouteKeys = set.New()
+				dataplane.deletedRouteKeys = set.New()
+				rt.QueueResync()
+				rt.Apply()
+				Expect(dataplane.addedRouteKeys).To(BeEmpty())
+				Expect(dataplane.deletedRouteKeys).To(BeEmpty())
+			})
+		})
+
 		// We do the following tests in different failure (and non-failure) scenarios.  In
 		// each case, we make the failure transient so that only the first Apply() should
 		// fail.  Then, at most, the second call to Apply() should succeed.
@@ -328,7 +486,7 @@ const (
 	failNextRouteList
 	failNextRouteAdd
 	failNextRouteDel
-	failNextAddARP
+	failNextNeighSet
 	failNone failFlags = 0
 )
 
@@ -340,7 +498,7 @@ var failureScenarios = []failFlags{
 	failNextRouteList,
 	failNextRouteAdd,
 	failNextRouteDel,
-	failNextAddARP,
+	failNextNeighSet,
 }
 
 func (f failFlags) String() string {
@@ -363,8 +521,8 @@ func (f failFlags) String() string {
 	if f&failNextRouteDel != 0 {
 		parts = append(parts, "failNextRouteDel")
 	}
-	if f&failNextAddARP != 0 {
-		parts = append(parts, "failNextAddARP")
+	if f&failNextNeighSet != 0 {
+		parts = append(parts, "failNextNeighSet")
 	}
 	if f == 0 {
 		parts = append(parts, "failNone")
@@ -377,6 +535,7 @@ type mockDataplane struct {
 	routeKeyToRoute  map[string]netlink.Route
 	addedRouteKeys   set.Set
 	deletedRouteKeys set.Set
+	neighKeyToNeigh  map[string]netlink.Neigh
 
 	failuresToSimulate failFlags
 }
@@ -443,7 +602,7 @@ func (d *mockDataplane) RouteList(link netlink.Link, family int) ([]netlink.Rout
 	}
 	var routes []netlink.Route
 	for _, route := range d.routeKeyToRoute {
-		if route.LinkIndex == link.Attrs().Index {
+		if link == nil || route.LinkIndex == link.Attrs().Index {
 			routes = append(routes, route)
 		}
 	}
@@ -469,12 +628,27 @@ func (d *mockDataplane) RouteAdd(route *netlink.Route) error {
 	d.addedRouteKeys.Add(key)
 	if _, ok := d.routeKeyToRoute[key]; ok {
 		return alreadyExists
+	} else if d.routeExistsForDest(route.Dst) {
+		// Like the kernel, refuse to add a second route to the same destination.
+		return alreadyExists
 	} else {
 		d.routeKeyToRoute[key] = *route
 		return nil
 	}
 }
 
+func (d *mockDataplane) routeExistsForDest(dst *net.IPNet) bool {
+	if dst == nil {
+		return false
+	}
+	for _, route := range d.routeKeyToRoute {
+		if route.Dst != nil && route.Dst.String() == dst.String() {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *mockDataplane) RouteDel(route *netlink.Route) error {
 	if d.shouldFail(failNextRouteDel) {
 		return simulatedError
@@ -490,15 +664,32 @@ func (d *mockDataplane) RouteDel(route *netlink.Route) error {
 	}
 }
 
-func (d *mockDataplane) AddStaticArpEntry(cidr ip.CIDR, destMAC net.HardwareAddr, ifaceName string) error {
-	if d.shouldFail(failNextAddARP) {
+func (d *mockDataplane) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	var neighs []netlink.Neigh
+	for _, neigh := range d.neighKeyToNeigh {
+		if neigh.LinkIndex == linkIndex && neigh.Family == family {
+			neighs = append(neighs, neigh)
+		}
+	}
+	return neighs, nil
+}
+
+func (d *mockDataplane) NeighSet(neigh *netlink.Neigh) error {
+	if d.shouldFail(failNextNeighSet) {
 		return simulatedError
 	}
-	log.WithFields(log.Fields{
-		"cidr":      cidr,
-		"destMac":   destMAC,
-		"ifaceName": ifaceName,
-	}).Info("Mock dataplane: adding ARP entry")
+	log.WithField("neigh", neigh).Info("Mock dataplane: setting neighbour entry")
+	d.neighKeyToNeigh[keyForNeigh(neigh)] = *neigh
+	return nil
+}
+
+func (d *mockDataplane) NeighDel(neigh *netlink.Neigh) error {
+	log.WithField("neigh", neigh).Info("Mock dataplane: removing neighbour entry")
+	key := keyForNeigh(neigh)
+	if _, ok := d.neighKeyToNeigh[key]; !ok {
+		return notFound
+	}
+	delete(d.neighKeyToNeigh, key)
 	return nil
 }
 
@@ -509,6 +700,10 @@ func (d *mockDataplane) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
 	}).Info("Mock dataplane: Removing conntrack flows")
 }
 
+func keyForNeigh(neigh *netlink.Neigh) string {
+	return fmt.Sprintf("%v-%v", neigh.LinkIndex, neigh.IP)
+}
+
 func keyForRoute(route *netlink.Route) string {
 	key := fmt.Sprintf("%v-%v", route.LinkIndex, route.Dst)
 	log.WithField("routeKey", key).Debug("Calculated route key")
@@ -65,6 +65,10 @@ func (r *DefaultRuleRenderer) HostDispatchChains(
 	)
 }
 
+// maxDispatchChildChainNames is the number of interface names above which a child dispatch
+// chain is itself split into a further level of child chains.
+const maxDispatchChildChainNames = 16
+
 func (r *DefaultRuleRenderer) dispatchChains(
 	names []string,
 	fromEndpointPfx,
@@ -78,9 +82,49 @@ func (r *DefaultRuleRenderer) dispatchChains(
 	sort.Strings(names)
 	log.WithField("ifaceNames", names).Debug("Rendering dispatch chains")
 
+	uniqueNames := make([]string, 0, len(names))
+	lastName := ""
+	for _, name := range names {
+		if name == "" {
+			log.Panic("Unable to render dispatch chain. Empty interface name.")
+		}
+		if name == lastName {
+			log.WithField("ifaceName", name).Error(
+				"Multiple endpoints with same interface name detected. " +
+					"Incorrect policy may be applied.")
+			continue
+		}
+		uniqueNames = append(uniqueNames, name)
+		lastName = name
+	}
+
+	return r.dispatchTree(
+		uniqueNames,
+		fromEndpointPfx,
+		toEndpointPfx,
+		dispatchFromEndpointChainName,
+		dispatchToEndpointChainName,
+		dropAtEndOfChain,
+		true,
+	)
+}
+
+// dispatchTree renders a pair of dispatch chains for the given sorted, unique interface names,
+// along with any child chains that they need.
+func (r *DefaultRuleRenderer) dispatchTree(
+	names []string,
+	fromEndpointPfx,
+	toEndpointPfx,
+	dispatchFromEndpointChainName,
+	dispatchToEndpointChainName string,
+	dropAtEndOfChain bool,
+	isRoot bool,
+) []*Chain {
 	// Since there can be >100 endpoints, putting them in a single list adds some latency to
-	// endpoints that are later in the chain.  To reduce that impact, we build a shallow tree of
-	// chains based on the prefixes of the chains.
+	// endpoints that are later in the chain.  To reduce that impact, we build a tree of
+	// chains based on the prefixes of the chains.  Usually the tree is shallow but, if a child
+	// chain would have many names, we split it again, giving a deeper tree for hosts with
+	// very many endpoints.
 
 	// Start by figuring out the common prefix of the endpoint names.  Commonly, this will
 	// be the interface prefix, e.g. "cali", but we may get lucky if multiple interfaces share
@@ -91,17 +135,7 @@ func (r *DefaultRuleRenderer) dispatchChains(
 	// Then, divide the names into bins based on their next character.
 	prefixes := []string{}
 	prefixToNames := map[string][]string{}
-	lastName := ""
 	for _, name := range names {
-		if name == "" {
-			log.Panic("Unable to render dispatch chain. Empty interface name.")
-		}
-		if name == lastName {
-			log.WithField("ifaceName", name).Error(
-				"Multiple endpoints with same interface name detected. " +
-					"Incorrect policy may be applied.")
-			continue
-		}
 		prefix := commonPrefix
 		if len(name) > len(commonPrefix) {
 			prefix = name[:len(commonPrefix)+1]
@@ -112,11 +146,10 @@ func (r *DefaultRuleRenderer) dispatchChains(
 			prefixes = append(prefixes, prefix)
 		}
 		prefixToNames[prefix] = append(prefixToNames[prefix], name)
-		lastName = name
 	}
 
-	rootFromEndpointRules := make([]Rule, 0)
-	rootToEndpointRules := make([]Rule, 0)
+	fromEndpointRules := make([]Rule, 0)
+	toEndpointRules := make([]Rule, 0)
 
 	// Now, iterate over the prefixes.  If there are multiple names in a prefix, we render a
 	// child chain for that prefix.  Otherwise, we render the rule directly to avoid the cost
@@ -130,34 +163,54 @@ func (r *DefaultRuleRenderer) dispatchChains(
 		})
 		logCxt.Debug("Considering prefix")
 		if len(ifaceNames) > 1 {
-			// More than one name, render a prefix match in the root chain...
+			// More than one name, render a prefix match in this chain...
 			nextChar := prefix[len(commonPrefix):]
 			ifaceMatch := prefix + "+"
-			childFromChainName := dispatchFromEndpointChainName + "-" + nextChar
-			childToChainName := dispatchToEndpointChainName + "-" + nextChar
+			childFromChainName := dispatchFromEndpointChainName + nextChar
+			childToChainName := dispatchToEndpointChainName + nextChar
+			if isRoot {
+				childFromChainName = dispatchFromEndpointChainName + "-" + nextChar
+				childToChainName = dispatchToEndpointChainName + "-" + nextChar
+			}
 			logCxt := logCxt.WithFields(log.Fields{
 				"childFromChainName": childFromChainName,
 				"childToChainName":   childToChainName,
 				"ifaceMatch":         ifaceMatch,
 			})
 			logCxt.Debug("Multiple interfaces with prefix, rendering child chain")
-			rootFromEndpointRules = append(rootFromEndpointRules, Rule{
+			fromEndpointRules = append(fromEndpointRules, Rule{
 				Match: Match().InInterface(ifaceMatch),
 				// Note: we use a goto here, which means that packets will not
 				// return to this chain.  This prevents packets from traversing the
-				// rest of the root chain once we've found their prefix.
+				// rest of the chain once we've found their prefix.
 				Action: GotoAction{
 					Target: childFromChainName,
 				},
 			})
-			rootToEndpointRules = append(rootToEndpointRules, Rule{
+			toEndpointRules = append(toEndpointRules, Rule{
 				Match: Match().OutInterface(ifaceMatch),
 				Action: GotoAction{
 					Target: childToChainName,
 				},
 			})
 
-			// ...and child chains.
+			// ...and child chains.  If there are many names, we split the child chain
+			// again, as long as the grandchild chains' names would fit.
+			if len(ifaceNames) > maxDispatchChildChainNames &&
+				len(childFromChainName) < MaxChainNameLength &&
+				len(childToChainName) < MaxChainNameLength {
+				logCxt.Debug("Many interfaces with prefix, splitting child chain")
+				chains = append(chains, r.dispatchTree(
+					ifaceNames,
+					fromEndpointPfx,
+					toEndpointPfx,
+					childFromChainName,
+					childToChainName,
+					dropAtEndOfChain,
+					false,
+				)...)
+				continue
+			}
 			childFromEndpointRules := make([]Rule, 0)
 			childToEndpointRules := make([]Rule, 0)
 			for _, name := range ifaceNames {
@@ -202,17 +255,16 @@ func (r *DefaultRuleRenderer) dispatchChains(
 			}
 			chains = append(chains, childFromEndpointChain, childToEndpointChain)
 		} else {
-			// Only one name with this prefix, render rules directly into the root
-			// chains.
+			// Only one name with this prefix, render rules directly into this chain.
 			ifaceName := ifaceNames[0]
-			logCxt.WithField("ifaceName", ifaceName).Debug("Adding rule to root chains")
-			rootFromEndpointRules = append(rootFromEndpointRules, Rule{
+			logCxt.WithField("ifaceName", ifaceName).Debug("Adding rule to chains")
+			fromEndpointRules = append(fromEndpointRules, Rule{
 				Match: Match().InInterface(ifaceName),
 				Action: GotoAction{
 					Target: EndpointChainName(fromEndpointPfx, ifaceName),
 				},
 			})
-			rootToEndpointRules = append(rootToEndpointRules, Rule{
+			toEndpointRules = append(toEndpointRules, Rule{
 				Match: Match().OutInterface(ifaceName),
 				Action: GotoAction{
 					Target: EndpointChainName(toEndpointPfx, ifaceName),
@@ -222,13 +274,13 @@ func (r *DefaultRuleRenderer) dispatchChains(
 	}
 
 	if dropAtEndOfChain {
-		log.Debug("Adding drop rules at end of root chains.")
-		rootFromEndpointRules = append(rootFromEndpointRules, Rule{
+		log.Debug("Adding drop rules at end of chains.")
+		fromEndpointRules = append(fromEndpointRules, Rule{
 			Match:   Match(),
 			Action:  DropAction{},
 			Comment: "Unknown interface",
 		})
-		rootToEndpointRules = append(rootToEndpointRules, Rule{
+		toEndpointRules = append(toEndpointRules, Rule{
 			Match:   Match(),
 			Action:  DropAction{},
 			Comment: "Unknown interface",
@@ -237,11 +289,11 @@ func (r *DefaultRuleRenderer) dispatchChains(
 
 	fromEndpointDispatchChain := &Chain{
 		Name:  dispatchFromEndpointChainName,
-		Rules: rootFromEndpointRules,
+		Rules: fromEndpointRules,
 	}
 	toEndpointDispatchChain := &Chain{
 		Name:  dispatchToEndpointChainName,
-		Rules: rootToEndpointRules,
+		Rules: toEndpointRules,
 	}
 	chains = append(chains, fromEndpointDispatchChain, toEndpointDispatchChain)
 
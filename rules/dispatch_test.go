@@ -60,6 +60,57 @@ var _ = Describe("Dispatch chains", func() {
 		Expect(func() { renderer.WorkloadDispatchChains(input) }).To(Panic())
 	})
 
+	It("should split child chains with many interfaces into a deeper tree", func() {
+		input := map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{}
+		for i := 0; i < 40; i++ {
+			name := fmt.Sprintf("cali1%02d", i)
+			id := proto.WorkloadEndpointID{
+				OrchestratorId: "foobar",
+				WorkloadId:     fmt.Sprintf("workload-%v", i),
+				EndpointId:     name,
+			}
+			input[id] = &proto.WorkloadEndpoint{Name: name}
+		}
+		input[proto.WorkloadEndpointID{EndpointId: "cali2"}] = &proto.WorkloadEndpoint{Name: "cali2"}
+
+		chains := renderer.WorkloadDispatchChains(input)
+		chainsByName := map[string]*iptables.Chain{}
+		var chainNames []string
+		for _, chain := range chains {
+			chainsByName[chain.Name] = chain
+			chainNames = append(chainNames, chain.Name)
+		}
+		Expect(chainNames).To(Equal([]string{
+			"cali-from-wl-dispatch-10",
+			"cali-to-wl-dispatch-10",
+			"cali-from-wl-dispatch-11",
+			"cali-to-wl-dispatch-11",
+			"cali-from-wl-dispatch-12",
+			"cali-to-wl-dispatch-12",
+			"cali-from-wl-dispatch-13",
+			"cali-to-wl-dispatch-13",
+			"cali-from-wl-dispatch-1",
+			"cali-to-wl-dispatch-1",
+			"cali-from-wl-dispatch",
+			"cali-to-wl-dispatch",
+		}))
+		Expect(chainsByName["cali-from-wl-dispatch"].Rules).To(Equal([]iptables.Rule{
+			inboundGotoRule("cali1+", "cali-from-wl-dispatch-1"),
+			inboundGotoRule("cali2", "cali-fw-cali2"),
+			expDropRule,
+		}))
+		Expect(chainsByName["cali-from-wl-dispatch-1"].Rules).To(Equal([]iptables.Rule{
+			inboundGotoRule("cali10+", "cali-from-wl-dispatch-10"),
+			inboundGotoRule("cali11+", "cali-from-wl-dispatch-11"),
+			inboundGotoRule("cali12+", "cali-from-wl-dispatch-12"),
+			inboundGotoRule("cali13+", "cali-from-wl-dispatch-13"),
+			expDropRule,
+		}))
+		Expect(chainsByName["cali-to-wl-dispatch-13"].Rules).To(HaveLen(11))
+		Expect(chainsByName["cali-to-wl-dispatch-13"].Rules[0]).To(Equal(
+			outboundGotoRule("cali130", "cali-tw-cali130")))
+	})
+
 	DescribeTable("workload rendering tests",
 		func(names []string, expectedChains []*iptables.Chain) {
 			var input map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
@@ -15,6 +15,8 @@
 package rules
 
 import (
+	"strings"
+
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/projectcalico/felix/hashutils"
@@ -25,11 +27,13 @@ import (
 func (r *DefaultRuleRenderer) WorkloadEndpointToIptablesChains(
 	ifaceName string,
 	adminUp bool,
-	policies []string,
+	tiers []*proto.TierInfo,
 	profileIDs []string,
+	sourceNets []string,
+	sourceMAC string,
 ) []*Chain {
 	return r.endpointToIptablesChains(
-		policies,
+		tiers,
 		profileIDs,
 		ifaceName,
 		PolicyInboundPfx,
@@ -40,19 +44,66 @@ func (r *DefaultRuleRenderer) WorkloadEndpointToIptablesChains(
 		WorkloadFromEndpointPfx,
 		"", // No fail-safe chains for workloads.
 		"", // No fail-safe chains for workloads.
+		r.sourceCheckRules(ifaceName, sourceNets, sourceMAC),
 		chainTypeTracked,
 		adminUp,
 	)
 }
 
+// sourceCheckRules returns the rules that drop packets from a workload whose source address
+// isn't one of the given nets (and, if configured, whose source MAC isn't the given MAC).
+// sourceNets should contain the nets for the IP version of the chain; if it is empty, all
+// packets of that IP version are treated as spoofed.
+func (r *DefaultRuleRenderer) sourceCheckRules(ifaceName string, sourceNets []string, sourceMAC string) []Rule {
+	if r.WorkloadSourceCheck != SourceCheckIP && r.WorkloadSourceCheck != SourceCheckIPAndMAC {
+		return nil
+	}
+	for _, prefix := range r.WorkloadSourceCheckExemptIfacePrefixes {
+		if strings.HasPrefix(ifaceName, prefix) {
+			return nil
+		}
+	}
+
+	var rules []Rule
+	if r.WorkloadSourceCheck == SourceCheckIPAndMAC && sourceMAC != "" {
+		rules = r.appendDropRules(rules, Match().NotSourceMAC(sourceMAC),
+			"Drop packets from spoofed source MAC", DropPrefixSpoofed+"mac")
+	}
+
+	switch len(sourceNets) {
+	case 0:
+		rules = r.appendDropRules(rules, Match(),
+			"Drop packets from spoofed source IP", DropPrefixSpoofed+"ip")
+	case 1:
+		rules = r.appendDropRules(rules, Match().NotSourceNet(sourceNets[0]),
+			"Drop packets from spoofed source IP", DropPrefixSpoofed+"ip")
+	default:
+		// iptables can't negate a list of nets so we use the accept mark bit as scratch
+		// space: set it for each valid source and then drop packets that don't have it.
+		// The policy rules below clear it again before they use it.
+		rules = append(rules, Rule{
+			Action: ClearMarkAction{Mark: r.IptablesMarkAccept},
+		})
+		for _, n := range sourceNets {
+			rules = append(rules, Rule{
+				Match:  Match().SourceNet(n),
+				Action: SetMarkAction{Mark: r.IptablesMarkAccept},
+			})
+		}
+		rules = r.appendDropRules(rules, Match().MarkClear(r.IptablesMarkAccept),
+			"Drop packets from spoofed source IP", DropPrefixSpoofed+"ip")
+	}
+	return rules
+}
+
 func (r *DefaultRuleRenderer) HostEndpointToFilterChains(
 	ifaceName string,
-	policyNames []string,
+	tiers []*proto.TierInfo,
 	profileIDs []string,
 ) []*Chain {
 	log.WithField("ifaceName", ifaceName).Debug("Rendering filter host endpoint chain.")
 	return r.endpointToIptablesChains(
-		policyNames,
+		tiers,
 		profileIDs,
 		ifaceName,
 		PolicyOutboundPfx,
@@ -63,6 +114,7 @@ func (r *DefaultRuleRenderer) HostEndpointToFilterChains(
 		HostFromEndpointPfx,
 		ChainFailsafeOut,
 		ChainFailsafeIn,
+		nil, // No source check for host endpoints.
 		chainTypeTracked,
 		true, // Host endpoints are always admin up.
 	)
@@ -70,11 +122,11 @@ func (r *DefaultRuleRenderer) HostEndpointToFilterChains(
 
 func (r *DefaultRuleRenderer) HostEndpointToRawChains(
 	ifaceName string,
-	untrackedPolicyNames []string,
+	untrackedTiers []*proto.TierInfo,
 ) []*Chain {
 	log.WithField("ifaceName", ifaceName).Debug("Rendering raw (untracked) host endpoint chain.")
 	return r.endpointToIptablesChains(
-		untrackedPolicyNames,
+		untrackedTiers,
 		nil, // We don't render profiles into the raw chain.
 		ifaceName,
 		PolicyOutboundPfx,
@@ -85,6 +137,7 @@ func (r *DefaultRuleRenderer) HostEndpointToRawChains(
 		HostFromEndpointPfx,
 		ChainFailsafeOut,
 		ChainFailsafeIn,
+		nil,                // No source check for host endpoints.
 		chainTypeUntracked, // Render "untracked" version of chain for the raw table.
 		true,               // Host endpoints are always admin up.
 	)
@@ -98,7 +151,7 @@ const (
 )
 
 func (r *DefaultRuleRenderer) endpointToIptablesChains(
-	policyNames []string,
+	tiers []*proto.TierInfo,
 	profileIds []string,
 	name string,
 	toPolicyPrefix PolicyChainNamePrefix,
@@ -109,6 +162,7 @@ func (r *DefaultRuleRenderer) endpointToIptablesChains(
 	fromEndpointPrefix string,
 	toFailsafeChain string,
 	fromFailsafeChain string,
+	fromSourceCheckRules []Rule,
 	chainType endpointChainType,
 	adminUp bool,
 ) []*Chain {
@@ -116,6 +170,11 @@ func (r *DefaultRuleRenderer) endpointToIptablesChains(
 	fromRules := []Rule{}
 	toChainName := EndpointChainName(toEndpointPrefix, name)
 	fromChainName := EndpointChainName(fromEndpointPrefix, name)
+	// Direction of the policies that apply in each chain, for drop attribution.
+	toDirection, fromDirection := "i", "o"
+	if toPolicyPrefix == PolicyOutboundPfx {
+		toDirection, fromDirection = "o", "i"
+	}
 
 	if !adminUp {
 		// Endpoint is admin-down, drop all traffic to/from it.
@@ -140,6 +199,10 @@ func (r *DefaultRuleRenderer) endpointToIptablesChains(
 		return []*Chain{&toEndpointChain, &fromEndpointChain}
 	}
 
+	// Drop spoofed packets before anything else, in particular, before the conntrack rules
+	// so that a spoofed packet can't match another endpoint's connection.
+	fromRules = append(fromRules, fromSourceCheckRules...)
+
 	if chainType == chainTypeTracked {
 		// Tracked chain: install conntrack rules, which implement our stateful connections.
 		// This allows return traffic associated with a previously-permitted request.
@@ -172,27 +235,31 @@ func (r *DefaultRuleRenderer) endpointToIptablesChains(
 		},
 	})
 
-	if len(policyNames) > 0 {
-		// Clear the "pass" mark.  If a policy sets that mark, we'll skip the rest of the policies
-		// continue processing the profiles, if there are any.
+	for _, tier := range tiers {
+		if len(tier.Policies) == 0 {
+			continue
+		}
+
+		// Clear the "pass" mark.  If a policy sets that mark, we'll skip the rest of the
+		// policies in this tier and continue processing the next tier or the profiles.
 		toRules = append(toRules, Rule{
-			Comment: "Start of policies",
+			Comment: "Start of tier " + tier.Name,
 			Action: ClearMarkAction{
 				Mark: r.IptablesMarkPass,
 			},
 		})
 		fromRules = append(fromRules, Rule{
-			Comment: "Start of policies",
+			Comment: "Start of tier " + tier.Name,
 			Action: ClearMarkAction{
 				Mark: r.IptablesMarkPass,
 			},
 		})
 
 		// Then, jump to each policy in turn.
-		for _, polID := range policyNames {
+		for _, polName := range tier.Policies {
 			toPolChainName := PolicyChainName(
 				toPolicyPrefix,
-				&proto.PolicyID{Name: polID},
+				&proto.PolicyID{Tier: tier.Name, Name: polName},
 			)
 			// If a previous policy didn't set the "pass" mark, jump to the policy.
 			toRules = append(toRules, Rule{
@@ -218,7 +285,7 @@ func (r *DefaultRuleRenderer) endpointToIptablesChains(
 
 			fromPolChainName := PolicyChainName(
 				fromPolicyPrefix,
-				&proto.PolicyID{Name: polID},
+				&proto.PolicyID{Tier: tier.Name, Name: polName},
 			)
 			// If a previous policy didn't set the "pass" mark, jump to the policy.
 			fromRules = append(fromRules, Rule{
@@ -243,22 +310,21 @@ func (r *DefaultRuleRenderer) endpointToIptablesChains(
 			})
 		}
 
-		if chainType == chainTypeTracked {
-			// When rendering normal rules, if no policy marked the packet as "pass", drop the
-			// packet.
+		if chainType == chainTypeTracked && tier.EndOfTierAction != EndOfTierActionPass {
+			// When rendering normal rules, if no policy in the tier marked the packet as
+			// "pass", drop the packet.  A tier whose end-of-tier action is "pass" falls
+			// through to the next tier instead.
 			//
 			// For untracked rules, we don't do that because there may be tracked rules
 			// still to be applied to the packet in the filter table.
-			toRules = append(toRules, Rule{
-				Match:   Match().MarkClear(r.IptablesMarkPass),
-				Action:  DropAction{},
-				Comment: "Drop if no policies passed packet",
-			})
-			fromRules = append(fromRules, Rule{
-				Match:   Match().MarkClear(r.IptablesMarkPass),
-				Action:  DropAction{},
-				Comment: "Drop if no policies passed packet",
-			})
+			toRules = r.appendDropRules(toRules,
+				Match().MarkClear(r.IptablesMarkPass),
+				"Drop if no policies passed packet",
+				DropPrefixEndOfTier+toDirection+":"+tier.Name)
+			fromRules = r.appendDropRules(fromRules,
+				Match().MarkClear(r.IptablesMarkPass),
+				"Drop if no policies passed packet",
+				DropPrefixEndOfTier+fromDirection+":"+tier.Name)
 		}
 	}
 
@@ -292,16 +358,10 @@ func (r *DefaultRuleRenderer) endpointToIptablesChains(
 		//
 		// For untracked rules, we don't do that because there may be tracked rules
 		// still to be applied to the packet in the filter table.
-		toRules = append(toRules, Rule{
-			Match:   Match(),
-			Action:  DropAction{},
-			Comment: "Drop if no profiles matched",
-		})
-		fromRules = append(fromRules, Rule{
-			Match:   Match(),
-			Action:  DropAction{},
-			Comment: "Drop if no profiles matched",
-		})
+		toRules = r.appendDropRules(toRules, Match(), "Drop if no profiles matched",
+			DropPrefixNoProfile+toDirection)
+		fromRules = r.appendDropRules(fromRules, Match(), "Drop if no profiles matched",
+			DropPrefixNoProfile+fromDirection)
 	}
 
 	toEndpointChain := Chain{
@@ -315,6 +375,31 @@ func (r *DefaultRuleRenderer) endpointToIptablesChains(
 	return []*Chain{&toEndpointChain, &fromEndpointChain}
 }
 
+// appendDropRules appends a rule that drops packets that match the given criteria.  If drop
+// attribution is enabled, it is preceded by a rule that sends the packets to the drop NFLOG
+// group with the given prefix.
+func (r *DefaultRuleRenderer) appendDropRules(
+	rules []Rule,
+	match MatchCriteria,
+	comment string,
+	nflogPrefix string,
+) []Rule {
+	if r.DropNFLOGGroup != 0 {
+		if len(nflogPrefix) > MaxNFLOGPrefixLength {
+			nflogPrefix = nflogPrefix[:MaxNFLOGPrefixLength]
+		}
+		rules = append(rules, Rule{
+			Match:  match,
+			Action: NflogAction{Group: r.DropNFLOGGroup, Prefix: nflogPrefix},
+		})
+	}
+	return append(rules, Rule{
+		Match:   match,
+		Action:  DropAction{},
+		Comment: comment,
+	})
+}
+
 func (r *DefaultRuleRenderer) appendConntrackRules(rules []Rule) []Rule {
 	// Allow return packets for established connections.
 	rules = append(rules,
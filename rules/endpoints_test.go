@@ -22,6 +22,7 @@ import (
 
 	"github.com/projectcalico/felix/ipsets"
 	. "github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
 )
 
 var _ = Describe("Endpoints", func() {
@@ -49,7 +50,7 @@ var _ = Describe("Endpoints", func() {
 	})
 
 	It("should render a minimal workload endpoint", func() {
-		Expect(renderer.WorkloadEndpointToIptablesChains("cali1234", true, nil, nil)).To(Equal([]*Chain{
+		Expect(renderer.WorkloadEndpointToIptablesChains("cali1234", true, nil, nil, nil, "")).To(Equal([]*Chain{
 			{
 				Name: "cali-tw-cali1234",
 				Rules: []Rule{
@@ -87,7 +88,7 @@ var _ = Describe("Endpoints", func() {
 		})
 
 		It("should render a minimal workload endpoint", func() {
-			Expect(renderer.WorkloadEndpointToIptablesChains("cali1234", true, nil, nil)).To(Equal([]*Chain{
+			Expect(renderer.WorkloadEndpointToIptablesChains("cali1234", true, nil, nil, nil, "")).To(Equal([]*Chain{
 				{
 					Name: "cali-tw-cali1234",
 					Rules: []Rule{
@@ -117,7 +118,7 @@ var _ = Describe("Endpoints", func() {
 	})
 
 	It("should render a disabled workload endpoint", func() {
-		Expect(renderer.WorkloadEndpointToIptablesChains("cali1234", false, nil, nil)).To(Equal([]*Chain{
+		Expect(renderer.WorkloadEndpointToIptablesChains("cali1234", false, nil, nil, nil, "")).To(Equal([]*Chain{
 			{
 				Name: "cali-tw-cali1234",
 				Rules: []Rule{
@@ -139,8 +140,10 @@ var _ = Describe("Endpoints", func() {
 		Expect(renderer.WorkloadEndpointToIptablesChains(
 			"cali1234",
 			true,
-			[]string{"a", "b"},
+			[]*proto.TierInfo{{Name: "default", Policies: []string{"a", "b"}}},
 			[]string{"prof1", "prof2"},
+			nil,
+			"",
 		)).To(Equal([]*Chain{
 			{
 				Name: "cali-tw-cali1234",
@@ -153,7 +156,7 @@ var _ = Describe("Endpoints", func() {
 
 					{Action: ClearMarkAction{Mark: 0x8}},
 
-					{Comment: "Start of policies",
+					{Comment: "Start of tier default",
 						Action: ClearMarkAction{Mark: 0x10}},
 					{Match: Match().MarkClear(0x10),
 						Action: JumpAction{Target: "cali-pi-a"}},
@@ -193,7 +196,7 @@ var _ = Describe("Endpoints", func() {
 
 					{Action: ClearMarkAction{Mark: 0x8}},
 
-					{Comment: "Start of policies",
+					{Comment: "Start of tier default",
 						Action: ClearMarkAction{Mark: 0x10}},
 					{Match: Match().MarkClear(0x10),
 						Action: JumpAction{Target: "cali-po-a"}},
@@ -225,8 +228,94 @@ var _ = Describe("Endpoints", func() {
 		}))
 	})
 
+	It("should render a workload endpoint with multiple tiers", func() {
+		chains := renderer.WorkloadEndpointToIptablesChains(
+			"cali1234",
+			true,
+			[]*proto.TierInfo{
+				{Name: "tier1", Policies: []string{"a"}, EndOfTierAction: "pass"},
+				{Name: "empty", Policies: []string{}},
+				{Name: "tier2", Policies: []string{"b"}},
+			},
+			[]string{"prof1"},
+			nil,
+			"",
+		)
+		Expect(chains[0].Name).To(Equal("cali-tw-cali1234"))
+		Expect(chains[0].Rules).To(Equal([]Rule{
+			// conntrack rules.
+			{Match: Match().ConntrackState("RELATED,ESTABLISHED"),
+				Action: AcceptAction{}},
+			{Match: Match().ConntrackState("INVALID"),
+				Action: DropAction{}},
+
+			{Action: ClearMarkAction{Mark: 0x8}},
+
+			// First tier ends with "pass" so there's no drop rule.
+			{Comment: "Start of tier tier1",
+				Action: ClearMarkAction{Mark: 0x10}},
+			{Match: Match().MarkClear(0x10),
+				Action: JumpAction{Target: PolicyChainName(PolicyInboundPfx,
+					&proto.PolicyID{Tier: "tier1", Name: "a"})}},
+			{Match: Match().MarkSet(0x8),
+				Action:  ReturnAction{},
+				Comment: "Return if policy accepted"},
+
+			// Empty tier is skipped; the next tier gets the default "deny".
+			{Comment: "Start of tier tier2",
+				Action: ClearMarkAction{Mark: 0x10}},
+			{Match: Match().MarkClear(0x10),
+				Action: JumpAction{Target: PolicyChainName(PolicyInboundPfx,
+					&proto.PolicyID{Tier: "tier2", Name: "b"})}},
+			{Match: Match().MarkSet(0x8),
+				Action:  ReturnAction{},
+				Comment: "Return if policy accepted"},
+			{Match: Match().MarkClear(0x10),
+				Action:  DropAction{},
+				Comment: "Drop if no policies passed packet"},
+
+			{Action: JumpAction{Target: "cali-pri-prof1"}},
+			{Match: Match().MarkSet(0x8),
+				Action:  ReturnAction{},
+				Comment: "Return if profile accepted"},
+
+			{Action: DropAction{},
+				Comment: "Drop if no profiles matched"},
+		}))
+	})
+
+	Describe("with drop attribution enabled", func() {
+		BeforeEach(func() {
+			rrConfigDropNflog := rrConfigNormal
+			rrConfigDropNflog.DropNFLOGGroup = 3
+			renderer = NewRenderer(rrConfigDropNflog)
+		})
+
+		It("should copy implicitly-dropped packets to the NFLOG group", func() {
+			chains := renderer.HostEndpointToFilterChains(
+				"eth0",
+				[]*proto.TierInfo{{Name: "default", Policies: []string{"a"}}},
+				[]string{"prof1"},
+			)
+			// For host endpoints, the "to" chain applies outbound policy.
+			Expect(chains[0].Rules[len(chains[0].Rules)-2:]).To(Equal([]Rule{
+				{Action: NflogAction{Group: 3, Prefix: "D:P:o"}},
+				{Action: DropAction{},
+					Comment: "Drop if no profiles matched"},
+			}))
+			Expect(chains[1].Rules).To(ContainElement(Rule{
+				Match:  Match().MarkClear(0x10),
+				Action: NflogAction{Group: 3, Prefix: "D:T:i:default"},
+			}))
+		})
+	})
+
 	It("should render a host endpoint", func() {
-		Expect(renderer.HostEndpointToFilterChains("eth0", []string{"a", "b"}, []string{"prof1", "prof2"})).To(Equal([]*Chain{
+		Expect(renderer.HostEndpointToFilterChains(
+			"eth0",
+			[]*proto.TierInfo{{Name: "default", Policies: []string{"a", "b"}}},
+			[]string{"prof1", "prof2"},
+		)).To(Equal([]*Chain{
 			{
 				Name: "cali-th-eth0",
 				Rules: []Rule{
@@ -241,7 +330,7 @@ var _ = Describe("Endpoints", func() {
 
 					{Action: ClearMarkAction{Mark: 0x8}},
 
-					{Comment: "Start of policies",
+					{Comment: "Start of tier default",
 						Action: ClearMarkAction{Mark: 0x10}},
 					{Match: Match().MarkClear(0x10),
 						Action: JumpAction{Target: "cali-po-a"}},
@@ -284,7 +373,7 @@ var _ = Describe("Endpoints", func() {
 
 					{Action: ClearMarkAction{Mark: 0x8}},
 
-					{Comment: "Start of policies",
+					{Comment: "Start of tier default",
 						Action: ClearMarkAction{Mark: 0x10}},
 					{Match: Match().MarkClear(0x10),
 						Action: JumpAction{Target: "cali-pi-a"}},
@@ -317,7 +406,10 @@ var _ = Describe("Endpoints", func() {
 	})
 
 	It("should render host endpoint raw chains with untracked policies", func() {
-		Expect(renderer.HostEndpointToRawChains("eth0", []string{"c"})).To(Equal([]*Chain{
+		Expect(renderer.HostEndpointToRawChains(
+			"eth0",
+			[]*proto.TierInfo{{Name: "default", Policies: []string{"c"}}},
+		)).To(Equal([]*Chain{
 			{
 				Name: "cali-th-eth0",
 				Rules: []Rule{
@@ -326,7 +418,7 @@ var _ = Describe("Endpoints", func() {
 
 					{Action: ClearMarkAction{Mark: 0x8}},
 
-					{Comment: "Start of policies",
+					{Comment: "Start of tier default",
 						Action: ClearMarkAction{Mark: 0x10}},
 					{Match: Match().MarkClear(0x10),
 						Action: JumpAction{Target: "cali-po-c"}},
@@ -348,7 +440,7 @@ var _ = Describe("Endpoints", func() {
 
 					{Action: ClearMarkAction{Mark: 0x8}},
 
-					{Comment: "Start of policies",
+					{Comment: "Start of tier default",
 						Action: ClearMarkAction{Mark: 0x10}},
 					{Match: Match().MarkClear(0x10),
 						Action: JumpAction{Target: "cali-pi-c"}},
@@ -364,4 +456,129 @@ var _ = Describe("Endpoints", func() {
 			},
 		}))
 	})
+
+	Describe("with the workload source check enabled", func() {
+		var conf Config
+		BeforeEach(func() {
+			conf = rrConfigNormal
+			conf.WorkloadSourceCheck = "ip-and-mac"
+		})
+		JustBeforeEach(func() {
+			renderer = NewRenderer(conf)
+		})
+
+		fromChainRules := func(nets []string, mac string) []Rule {
+			chains := renderer.WorkloadEndpointToIptablesChains("cali1234", true, nil, nil, nets, mac)
+			Expect(chains[0].Rules[0]).To(Equal(Rule{
+				Match:  Match().ConntrackState("RELATED,ESTABLISHED"),
+				Action: AcceptAction{},
+			}), "Source check shouldn't apply to packets to the workload")
+			Expect(chains[1].Name).To(Equal("cali-fw-cali1234"))
+			return chains[1].Rules
+		}
+
+		It("should drop packets from other sources before the conntrack rules", func() {
+			Expect(fromChainRules([]string{"10.0.0.1/32"}, "01:02:03:04:05:06")[:3]).To(Equal([]Rule{
+				{Match: Match().NotSourceMAC("01:02:03:04:05:06"),
+					Action:  DropAction{},
+					Comment: "Drop packets from spoofed source MAC"},
+				{Match: Match().NotSourceNet("10.0.0.1/32"),
+					Action:  DropAction{},
+					Comment: "Drop packets from spoofed source IP"},
+				{Match: Match().ConntrackState("RELATED,ESTABLISHED"),
+					Action: AcceptAction{}},
+			}))
+		})
+		It("should skip the MAC check if the endpoint has no MAC", func() {
+			Expect(fromChainRules([]string{"10.0.0.1/32"}, "")[0]).To(Equal(Rule{
+				Match:   Match().NotSourceNet("10.0.0.1/32"),
+				Action:  DropAction{},
+				Comment: "Drop packets from spoofed source IP",
+			}))
+		})
+		It("should use the accept mark to check multiple nets", func() {
+			Expect(fromChainRules([]string{"10.0.0.1/32", "10.1.0.0/16"}, "")[:4]).To(Equal([]Rule{
+				{Action: ClearMarkAction{Mark: 0x8}},
+				{Match: Match().SourceNet("10.0.0.1/32"),
+					Action: SetMarkAction{Mark: 0x8}},
+				{Match: Match().SourceNet("10.1.0.0/16"),
+					Action: SetMarkAction{Mark: 0x8}},
+				{Match: Match().MarkClear(0x8),
+					Action:  DropAction{},
+					Comment: "Drop packets from spoofed source IP"},
+			}))
+		})
+		It("should drop everything if the endpoint has no addresses", func() {
+			Expect(fromChainRules(nil, "")[0]).To(Equal(Rule{
+				Match:   Match(),
+				Action:  DropAction{},
+				Comment: "Drop packets from spoofed source IP",
+			}))
+		})
+
+		Describe("with drop attribution", func() {
+			BeforeEach(func() {
+				conf.DropNFLOGGroup = 3
+			})
+
+			It("should send spoofed packets to the drop NFLOG group", func() {
+				Expect(fromChainRules([]string{"10.0.0.1/32"}, "")[:2]).To(Equal([]Rule{
+					{Match: Match().NotSourceNet("10.0.0.1/32"),
+						Action: NflogAction{Group: 3, Prefix: "D:S:ip"}},
+					{Match: Match().NotSourceNet("10.0.0.1/32"),
+						Action:  DropAction{},
+						Comment: "Drop packets from spoofed source IP"},
+				}))
+			})
+		})
+
+		Describe("with only the IP check", func() {
+			BeforeEach(func() {
+				conf.WorkloadSourceCheck = "ip"
+			})
+
+			It("should ignore the MAC", func() {
+				Expect(fromChainRules([]string{"10.0.0.1/32"}, "01:02:03:04:05:06")[0]).To(Equal(Rule{
+					Match:   Match().NotSourceNet("10.0.0.1/32"),
+					Action:  DropAction{},
+					Comment: "Drop packets from spoofed source IP",
+				}))
+			})
+		})
+
+		Describe("with exempt interface prefixes", func() {
+			BeforeEach(func() {
+				conf.WorkloadSourceCheckExemptIfacePrefixes = []string{"tap", "cali12"}
+			})
+
+			It("should render no source check for a matching interface", func() {
+				Expect(fromChainRules([]string{"10.0.0.1/32"}, "01:02:03:04:05:06")[0]).To(Equal(Rule{
+					Match:  Match().ConntrackState("RELATED,ESTABLISHED"),
+					Action: AcceptAction{},
+				}))
+			})
+			It("should still check other interfaces", func() {
+				conf.WorkloadSourceCheckExemptIfacePrefixes = []string{"tap", "cali5"}
+				renderer = NewRenderer(conf)
+				Expect(fromChainRules([]string{"10.0.0.1/32"}, "")[0]).To(Equal(Rule{
+					Match:   Match().NotSourceNet("10.0.0.1/32"),
+					Action:  DropAction{},
+					Comment: "Drop packets from spoofed source IP",
+				}))
+			})
+		})
+
+		Describe("with the check disabled", func() {
+			BeforeEach(func() {
+				conf.WorkloadSourceCheck = "none"
+			})
+
+			It("should render no source check", func() {
+				Expect(fromChainRules([]string{"10.0.0.1/32"}, "01:02:03:04:05:06")[0]).To(Equal(Rule{
+					Match:  Match().ConntrackState("RELATED,ESTABLISHED"),
+					Action: AcceptAction{},
+				}))
+			})
+		})
+	})
 })
@@ -16,6 +16,7 @@ package rules
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -28,25 +29,45 @@ import (
 // ruleRenderer defined in rules_defs.go.
 
 func (r *DefaultRuleRenderer) PolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain {
+	return r.policyToIptablesChains(policyID, policy, ipVersion, false)
+}
+
+// RawPolicyToIptablesChains renders the policy's chains for the raw table.  The kernel only
+// allows the REJECT target in the filter table so reject rules are rendered as drops.
+func (r *DefaultRuleRenderer) RawPolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain {
+	return r.policyToIptablesChains(policyID, policy, ipVersion, true)
+}
+
+func (r *DefaultRuleRenderer) policyToIptablesChains(
+	policyID *proto.PolicyID,
+	policy *proto.Policy,
+	ipVersion uint8,
+	forRaw bool,
+) []*iptables.Chain {
+	policyName := policyID.Tier + "/" + policyID.Name
 	inbound := iptables.Chain{
-		Name:  PolicyChainName(PolicyInboundPfx, policyID),
-		Rules: r.ProtoRulesToIptablesRules(policy.InboundRules, ipVersion),
+		Name: PolicyChainName(PolicyInboundPfx, policyID),
+		Rules: r.protoRulesToIptablesRulesWithOrigins(policy.InboundRules, ipVersion,
+			forRaw, "Policy", policyName, "inbound"),
 	}
 	outbound := iptables.Chain{
-		Name:  PolicyChainName(PolicyOutboundPfx, policyID),
-		Rules: r.ProtoRulesToIptablesRules(policy.OutboundRules, ipVersion),
+		Name: PolicyChainName(PolicyOutboundPfx, policyID),
+		Rules: r.protoRulesToIptablesRulesWithOrigins(policy.OutboundRules, ipVersion,
+			forRaw, "Policy", policyName, "outbound"),
 	}
 	return []*iptables.Chain{&inbound, &outbound}
 }
 
 func (r *DefaultRuleRenderer) ProfileToIptablesChains(profileID *proto.ProfileID, profile *proto.Profile, ipVersion uint8) []*iptables.Chain {
 	inbound := iptables.Chain{
-		Name:  ProfileChainName(ProfileInboundPfx, profileID),
-		Rules: r.ProtoRulesToIptablesRules(profile.InboundRules, ipVersion),
+		Name: ProfileChainName(ProfileInboundPfx, profileID),
+		Rules: r.protoRulesToIptablesRulesWithOrigins(profile.InboundRules, ipVersion,
+			false, "Profile", profileID.Name, "inbound"),
 	}
 	outbound := iptables.Chain{
-		Name:  ProfileChainName(ProfileOutboundPfx, profileID),
-		Rules: r.ProtoRulesToIptablesRules(profile.OutboundRules, ipVersion),
+		Name: ProfileChainName(ProfileOutboundPfx, profileID),
+		Rules: r.protoRulesToIptablesRulesWithOrigins(profile.OutboundRules, ipVersion,
+			false, "Profile", profileID.Name, "outbound"),
 	}
 	return []*iptables.Chain{&inbound, &outbound}
 }
@@ -59,7 +80,59 @@ func (r *DefaultRuleRenderer) ProtoRulesToIptablesRules(protoRules []*proto.Rule
 	return rules
 }
 
+// protoRulesToIptablesRulesWithOrigins is like ProtoRulesToIptablesRules but it also records
+// the origin of each rendered rule, which allows the Table to map rule hashes back to
+// policies.  If policy name comments are enabled, it also annotates each rendered rule with a
+// human-readable comment of the form "<kind> <name> <direction> rule <n>", where n is the
+// index of the rule in the input list.  If forRaw is set, the rules are rendered for the raw
+// table, where reject rules become drops.
+func (r *DefaultRuleRenderer) protoRulesToIptablesRulesWithOrigins(
+	protoRules []*proto.Rule,
+	ipVersion uint8,
+	forRaw bool,
+	kind, name, direction string,
+) []iptables.Rule {
+	var rules []iptables.Rule
+	for i, protoRule := range protoRules {
+		origin := &iptables.RuleOrigin{
+			Kind:      kind,
+			Name:      name,
+			Direction: direction,
+			RuleIndex: i,
+			RuleID:    protoRule.RuleId,
+		}
+		comment := truncateComment(fmt.Sprintf("%s %s %s rule %d", kind, name, direction, i))
+		for _, rule := range r.protoRuleToIptablesRules(protoRule, ipVersion, forRaw, r.logPrefix(kind, name)) {
+			if r.PolicyNameComments {
+				rule.Comment = comment
+			}
+			rule.Origin = origin
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// truncateComment makes the given string safe to use as an iptables comment by removing
+// double quotes and truncating it to the maximum length that iptables allows.
+func truncateComment(comment string) string {
+	comment = strings.Replace(comment, `"`, "", -1)
+	if len(comment) > MaxCommentLength {
+		comment = comment[:MaxCommentLength]
+	}
+	return comment
+}
+
 func (r *DefaultRuleRenderer) ProtoRuleToIptablesRules(pRule *proto.Rule, ipVersion uint8) []iptables.Rule {
+	return r.protoRuleToIptablesRules(pRule, ipVersion, false, r.logPrefix("", ""))
+}
+
+func (r *DefaultRuleRenderer) protoRuleToIptablesRules(
+	pRule *proto.Rule,
+	ipVersion uint8,
+	forRaw bool,
+	logPrefix string,
+) []iptables.Rule {
 	rules := []iptables.Rule{}
 	ruleCopy := *pRule
 
@@ -84,7 +157,7 @@ func (r *DefaultRuleRenderer) ProtoRuleToIptablesRules(pRule *proto.Rule, ipVers
 				return nil
 			}
 
-			markBit, actions := r.CalculateActions(match, &ruleCopy, ipVersion)
+			markBit, actions := r.calculateActions(&ruleCopy, ipVersion, forRaw, logPrefix)
 			if markBit != 0 {
 				// An accept or next-tier rule say, which needs to set a mark bit.  We render one
 				// with the full match criteria, which sets the mark.
@@ -97,8 +170,15 @@ func (r *DefaultRuleRenderer) ProtoRuleToIptablesRules(pRule *proto.Rule, ipVers
 				match = iptables.Match().MarkSet(markBit)
 			}
 			for _, action := range actions {
+				actionMatch := match
+				if reject, ok := action.(iptables.RejectAction); ok &&
+					reject.With == RejectWithTCPReset && ruleCopy.Protocol == nil {
+					// iptables only allows TCP reset for TCP packets; rejectActions()
+					// follows this action with an ICMP reject for everything else.
+					actionMatch = match.Protocol("tcp")
+				}
 				rules = append(rules, iptables.Rule{
-					Match:  match,
+					Match:  actionMatch,
 					Action: action,
 				})
 			}
@@ -138,6 +218,15 @@ func SplitPortList(ports []*proto.PortRange) (splits [][]*proto.PortRange) {
 }
 
 func (r *DefaultRuleRenderer) CalculateActions(match iptables.MatchCriteria, pRule *proto.Rule, ipVersion uint8) (mark uint32, actions []iptables.Action) {
+	return r.calculateActions(pRule, ipVersion, false, r.logPrefix("", ""))
+}
+
+func (r *DefaultRuleRenderer) calculateActions(
+	pRule *proto.Rule,
+	ipVersion uint8,
+	forRaw bool,
+	logPrefix string,
+) (mark uint32, actions []iptables.Action) {
 	actions = []iptables.Action{}
 
 	switch pRule.Action {
@@ -153,18 +242,137 @@ func (r *DefaultRuleRenderer) CalculateActions(match iptables.MatchCriteria, pRu
 		actions = append(actions, iptables.ReturnAction{})
 	case "deny":
 		// Deny maps to DROP.
+		actions = append(actions, r.dropNflogActions(pRule)...)
 		actions = append(actions, iptables.DropAction{})
 	case "log":
 		// This rule should log.
-		actions = append(actions, iptables.LogAction{
-			Prefix: r.IptablesLogPrefix,
-		})
+		actions = append(actions, r.logAction(logPrefix))
+	case "log-and-allow":
+		// As for allow, but log first.  The log rule matches on the accept mark.
+		mark = r.IptablesMarkAccept
+		actions = append(actions, r.logAction(logPrefix), iptables.ReturnAction{})
+	case "log-and-deny":
+		actions = append(actions, r.logAction(logPrefix))
+		actions = append(actions, r.dropNflogActions(pRule)...)
+		actions = append(actions, iptables.DropAction{})
+	case "reject":
+		actions = append(actions, r.dropNflogActions(pRule)...)
+		if forRaw {
+			// REJECT is only valid in the filter table.
+			actions = append(actions, iptables.DropAction{})
+		} else {
+			actions = append(actions, r.rejectActions(pRule, ipVersion)...)
+		}
 	default:
 		log.WithField("action", pRule.Action).Panic("Unknown rule action")
 	}
 	return
 }
 
+// dropNflogActions returns an action that copies packets to the drop NFLOG group, so that the
+// drop can be attributed to the given rule.  It returns nothing if that is disabled or if
+// the rule has no ID.
+func (r *DefaultRuleRenderer) dropNflogActions(pRule *proto.Rule) []iptables.Action {
+	if r.DropNFLOGGroup == 0 || pRule.RuleId == "" {
+		return nil
+	}
+	return []iptables.Action{iptables.NflogAction{
+		Group:  r.DropNFLOGGroup,
+		Prefix: DropPrefixRule + pRule.RuleId,
+	}}
+}
+
+// rejectActions returns the actions for a "reject" rule.  TCP reset can only be sent in
+// response to TCP packets so, unless the rule only matches TCP, we follow it with a
+// port unreachable reject, which catches other protocols.
+func (r *DefaultRuleRenderer) rejectActions(pRule *proto.Rule, ipVersion uint8) []iptables.Action {
+	with := pRule.RejectWith
+	if with == "" {
+		with = r.RejectWith
+	}
+	if with == RejectWithTCPReset {
+		switch protocolName(pRule.Protocol) {
+		case "tcp":
+			return []iptables.Action{iptables.RejectAction{With: with}}
+		case "":
+			return []iptables.Action{
+				iptables.RejectAction{With: with},
+				iptables.RejectAction{With: rejectWithICMP(RejectWithPortUnreachable, ipVersion)},
+			}
+		}
+		with = RejectWithPortUnreachable
+	}
+	return []iptables.Action{iptables.RejectAction{With: rejectWithICMP(with, ipVersion)}}
+}
+
+// rejectWithICMP maps one of our RejectWith values to the iptables name for the equivalent
+// ICMP or ICMPv6 error.
+func rejectWithICMP(with string, ipVersion uint8) string {
+	if ipVersion == 4 {
+		switch with {
+		case RejectWithHostUnreachable:
+			return "icmp-host-unreachable"
+		case RejectWithNetUnreachable:
+			return "icmp-net-unreachable"
+		case RejectWithAdminProhibited:
+			return "icmp-admin-prohibited"
+		}
+		return "icmp-port-unreachable"
+	}
+	switch with {
+	case RejectWithHostUnreachable:
+		return "icmp6-addr-unreachable"
+	case RejectWithNetUnreachable:
+		return "icmp6-no-route"
+	case RejectWithAdminProhibited:
+		return "icmp6-adm-prohibited"
+	}
+	return "icmp6-port-unreachable"
+}
+
+// protocolName returns the lower-case name of the given protocol, or "" if it is nil.
+func protocolName(p *proto.Protocol) string {
+	if p == nil {
+		return ""
+	}
+	switch p := p.NumberOrName.(type) {
+	case *proto.Protocol_Name:
+		return strings.ToLower(p.Name)
+	case *proto.Protocol_Number:
+		switch p.Number {
+		case 6:
+			return "tcp"
+		case 17:
+			return "udp"
+		}
+		return fmt.Sprint(p.Number)
+	}
+	return ""
+}
+
+// logPrefix expands the configured log prefix for a rule in the given policy or profile:
+// "%k" is replaced by the kind ("Policy" or "Profile") and "%n" by the name.
+func (r *DefaultRuleRenderer) logPrefix(kind, name string) string {
+	prefix := strings.Replace(r.IptablesLogPrefix, "%k", kind, -1)
+	return strings.Replace(prefix, "%n", name, -1)
+}
+
+// logAction returns an action that logs packets with the given prefix, either to the kernel
+// log or, if configured, to an NFLOG group.  The prefix is truncated to fit.
+func (r *DefaultRuleRenderer) logAction(prefix string) iptables.Action {
+	prefix = strings.Replace(prefix, `"`, "", -1)
+	if r.IptablesLogNFLOGGroup != 0 {
+		if len(prefix) > MaxNFLOGPrefixLength {
+			prefix = prefix[:MaxNFLOGPrefixLength]
+		}
+		return iptables.NflogAction{Group: r.IptablesLogNFLOGGroup, Prefix: prefix}
+	}
+	if len(prefix) > MaxLogPrefixLength {
+		prefix = prefix[:MaxLogPrefixLength]
+	}
+	return iptables.LogAction{Prefix: prefix}
+}
+
 var SkipRule = errors.New("Rule skipped")
 
 func (r *DefaultRuleRenderer) CalculateRuleMatch(pRule *proto.Rule, ipVersion uint8) (iptables.MatchCriteria, error) {
@@ -229,6 +437,15 @@ func (r *DefaultRuleRenderer) CalculateRuleMatch(pRule *proto.Rule, ipVersion ui
 		match = match.SourcePortRanges(pRule.SrcPorts)
 	}
 
+	for _, ipsetID := range pRule.SrcNamedPortIpSetIds {
+		ipsetName := r.ipSetName(ipsetID, ipVersion)
+		logCxt.WithFields(log.Fields{
+			"ipsetID":   ipsetID,
+			"ipSetName": ipsetName,
+		}).Debug("Adding src named port IP set match")
+		match = match.SourceIPPortSet(ipsetName)
+	}
+
 	if pRule.DstNet != "" {
 		isV6 := strings.Index(pRule.DstNet, ":") >= 0
 		wantV6 := ipVersion == 6
@@ -265,6 +482,15 @@ func (r *DefaultRuleRenderer) CalculateRuleMatch(pRule *proto.Rule, ipVersion ui
 		match = match.DestPortRanges(pRule.DstPorts)
 	}
 
+	for _, ipsetID := range pRule.DstNamedPortIpSetIds {
+		ipsetName := r.ipSetName(ipsetID, ipVersion)
+		logCxt.WithFields(log.Fields{
+			"ipsetID":   ipsetID,
+			"ipSetName": ipsetName,
+		}).Debug("Adding dst named port IP set match")
+		match = match.DestIPPortSet(ipsetName)
+	}
+
 	if ipVersion == 4 {
 		switch icmp := pRule.Icmp.(type) {
 		case *proto.Rule_IcmpTypeCode:
@@ -338,6 +564,15 @@ func (r *DefaultRuleRenderer) CalculateRuleMatch(pRule *proto.Rule, ipVersion ui
 		}
 	}
 
+	for _, ipsetID := range pRule.NotSrcNamedPortIpSetIds {
+		ipsetName := r.ipSetName(ipsetID, ipVersion)
+		logCxt.WithFields(log.Fields{
+			"ipsetID":   ipsetID,
+			"ipSetName": ipsetName,
+		}).Debug("Adding src named port IP set match")
+		match = match.NotSourceIPPortSet(ipsetName)
+	}
+
 	if pRule.NotDstNet != "" {
 		isV6 := strings.Index(pRule.NotDstNet, ":") >= 0
 		wantV6 := ipVersion == 6
@@ -376,6 +611,15 @@ func (r *DefaultRuleRenderer) CalculateRuleMatch(pRule *proto.Rule, ipVersion ui
 		}
 	}
 
+	for _, ipsetID := range pRule.NotDstNamedPortIpSetIds {
+		ipsetName := r.ipSetName(ipsetID, ipVersion)
+		logCxt.WithFields(log.Fields{
+			"ipsetID":   ipsetID,
+			"ipSetName": ipsetName,
+		}).Debug("Adding dst named port IP set match")
+		match = match.NotDestIPPortSet(ipsetName)
+	}
+
 	if ipVersion == 4 {
 		switch icmp := pRule.NotIcmp.(type) {
 		case *proto.Rule_NotIcmpTypeCode:
@@ -400,10 +644,23 @@ func (r *DefaultRuleRenderer) CalculateRuleMatch(pRule *proto.Rule, ipVersion ui
 	return match, nil
 }
 
+// ipSetName returns the name of the main IP set with the given ID for the given IP version.
+func (r *DefaultRuleRenderer) ipSetName(ipsetID string, ipVersion uint8) string {
+	if ipVersion == 4 {
+		return r.IPSetConfigV4.NameForMainIPSet(ipsetID)
+	}
+	return r.IPSetConfigV6.NameForMainIPSet(ipsetID)
+}
+
 func PolicyChainName(prefix PolicyChainNamePrefix, polID *proto.PolicyID) string {
+	name := polID.Name
+	if polID.Tier != "" && polID.Tier != DefaultTierName {
+		// Policies in different tiers may have the same name.
+		name = polID.Tier + "/" + polID.Name
+	}
 	return hashutils.GetLengthLimitedID(
 		string(prefix),
-		polID.Name,
+		name,
 		iptables.MaxChainNameLength,
 	)
 }
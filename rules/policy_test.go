@@ -17,6 +17,8 @@ package rules_test
 import (
 	. "github.com/projectcalico/felix/rules"
 
+	"strings"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
@@ -57,6 +59,9 @@ var ruleTestData = []TableEntry{
 			{First: 8080, Last: 8080},
 		}},
 		"-m multiport --source-ports 10:12,20:30,8080"),
+	Entry("Source named port IP set", 4,
+		proto.Rule{SrcNamedPortIpSetIds: []string{"ipsetid1"}},
+		"-m set --match-set cali4-ipsetid1 src,src"),
 	Entry("ICMP", 4,
 		proto.Rule{Icmp: &proto.Rule_IcmpType{IcmpType: 10}},
 		"-m icmp --icmp-type 10"),
@@ -89,6 +94,12 @@ var ruleTestData = []TableEntry{
 			{First: 8080, Last: 8080},
 		}},
 		"-m multiport --destination-ports 10:12,20:30,8080"),
+	Entry("Dest named port IP set", 4,
+		proto.Rule{DstNamedPortIpSetIds: []string{"ipsetid1"}},
+		"-m set --match-set cali4-ipsetid1 dst,dst"),
+	Entry("Dest named port IP set", 6,
+		proto.Rule{DstNamedPortIpSetIds: []string{"ipsetid1"}},
+		"-m set --match-set cali6-ipsetid1 dst,dst"),
 
 	// Negated matches...
 
@@ -161,6 +172,9 @@ var ruleTestData = []TableEntry{
 	Entry("Dest ports", 4,
 		proto.Rule{NotDstPorts: []*proto.PortRange{{First: 10, Last: 12}}},
 		"-m multiport ! --destination-ports 10:12"),
+	Entry("Dest named port IP set", 4,
+		proto.Rule{NotDstNamedPortIpSetIds: []string{"ipsetid1"}},
+		"-m set ! --match-set cali4-ipsetid1 dst,dst"),
 	Entry("Dest ports (>15) should be broken into blocks", 4,
 		proto.Rule{NotDstPorts: []*proto.PortRange{
 			{First: 1, Last: 2},
@@ -270,6 +284,45 @@ var _ = Describe("Protobuf rule to iptables rule conversion", func() {
 		ruleTestData...,
 	)
 
+	DescribeTable(
+		"Log-and-allow rules should be correctly rendered",
+		func(ipVer int, in proto.Rule, expMatch string) {
+			renderer := NewRenderer(rrConfigNormal)
+			logRule := in
+			logRule.Action = "log-and-allow"
+			rules := renderer.ProtoRuleToIptablesRules(&logRule, uint8(ipVer))
+			// One rule to set the accept mark, then log and return based on the mark.
+			Expect(rules).To(HaveLen(3))
+			Expect(rules[0].Match.Render()).To(Equal(expMatch))
+			Expect(rules[0].Action).To(Equal(iptables.SetMarkAction{Mark: 0x8}))
+			Expect(rules[1]).To(Equal(iptables.Rule{
+				Match:  iptables.Match().MarkSet(0x8),
+				Action: iptables.LogAction{Prefix: "calico-packet"},
+			}))
+			Expect(rules[2]).To(Equal(iptables.Rule{
+				Match:  iptables.Match().MarkSet(0x8),
+				Action: iptables.ReturnAction{},
+			}))
+		},
+		ruleTestData...,
+	)
+
+	DescribeTable(
+		"Log-and-deny rules should be correctly rendered",
+		func(ipVer int, in proto.Rule, expMatch string) {
+			renderer := NewRenderer(rrConfigNormal)
+			logRule := in
+			logRule.Action = "log-and-deny"
+			rules := renderer.ProtoRuleToIptablesRules(&logRule, uint8(ipVer))
+			Expect(rules).To(HaveLen(2))
+			Expect(rules[0].Match.Render()).To(Equal(expMatch))
+			Expect(rules[0].Action).To(Equal(iptables.LogAction{Prefix: "calico-packet"}))
+			Expect(rules[1].Match.Render()).To(Equal(expMatch))
+			Expect(rules[1].Action).To(Equal(iptables.DropAction{}))
+		},
+		ruleTestData...,
+	)
+
 	DescribeTable(
 		"Deny rules should be correctly rendered",
 		func(ipVer int, in proto.Rule, expMatch string) {
@@ -290,6 +343,252 @@ var _ = Describe("Protobuf rule to iptables rule conversion", func() {
 		renderer = NewRenderer(rrConfigNormal).(*DefaultRuleRenderer)
 	})
 
+	It("should not add policy name comments by default", func() {
+		chains := renderer.PolicyToIptablesChains(
+			&proto.PolicyID{Tier: "default", Name: "pol1"},
+			&proto.Policy{InboundRules: []*proto.Rule{{Action: "deny"}}},
+			4,
+		)
+		Expect(chains[0].Rules[0].Comment).To(Equal(""))
+	})
+
+	It("should name default tier policy chains after the policy alone", func() {
+		Expect(PolicyChainName(PolicyInboundPfx, &proto.PolicyID{Tier: "default", Name: "pol1"})).
+			To(Equal("cali-pi-pol1"))
+		Expect(PolicyChainName(PolicyInboundPfx, &proto.PolicyID{Name: "pol1"})).
+			To(Equal("cali-pi-pol1"))
+	})
+
+	It("should give same-named policies in different tiers different chains", func() {
+		chainName := PolicyChainName(PolicyInboundPfx, &proto.PolicyID{Tier: "tier1", Name: "pol1"})
+		Expect(chainName).To(Equal("cali-pi-tier1/pol1"))
+		Expect(chainName).NotTo(Equal(
+			PolicyChainName(PolicyInboundPfx, &proto.PolicyID{Tier: "tier2", Name: "pol1"})))
+	})
+
+	It("should record the origin of policy rules", func() {
+		chains := renderer.PolicyToIptablesChains(
+			&proto.PolicyID{Tier: "default", Name: "pol1"},
+			&proto.Policy{
+				InboundRules:  []*proto.Rule{{Action: "deny"}, {Action: "allow", RuleId: "abcd"}},
+				OutboundRules: []*proto.Rule{{Action: "deny"}},
+			},
+			4,
+		)
+		Expect(chains[0].Rules[0].Origin).To(Equal(&iptables.RuleOrigin{
+			Kind:      "Policy",
+			Name:      "default/pol1",
+			Direction: "inbound",
+			RuleIndex: 0,
+		}))
+		Expect(chains[0].Rules[2].Origin.String()).To(Equal(
+			"policy default/pol1 inbound rule 1 (ID abcd)"))
+		Expect(chains[1].Rules[0].Origin.Direction).To(Equal("outbound"))
+	})
+
+	Describe("with policy name comments enabled", func() {
+		BeforeEach(func() {
+			rrConfigComments := rrConfigNormal
+			rrConfigComments.PolicyNameComments = true
+			renderer = NewRenderer(rrConfigComments).(*DefaultRuleRenderer)
+		})
+
+		It("should annotate policy rules with the policy name and rule index", func() {
+			chains := renderer.PolicyToIptablesChains(
+				&proto.PolicyID{Tier: "default", Name: "pol1"},
+				&proto.Policy{
+					InboundRules:  []*proto.Rule{{Action: "deny"}, {Action: "allow"}},
+					OutboundRules: []*proto.Rule{{Action: "deny"}},
+				},
+				4,
+			)
+			Expect(chains[0].Rules[0].Comment).To(Equal("Policy default/pol1 inbound rule 0"))
+			// The allow rule renders as two iptables rules, both should get the comment.
+			Expect(chains[0].Rules).To(HaveLen(3))
+			Expect(chains[0].Rules[1].Comment).To(Equal("Policy default/pol1 inbound rule 1"))
+			Expect(chains[0].Rules[2].Comment).To(Equal("Policy default/pol1 inbound rule 1"))
+			Expect(chains[1].Rules[0].Comment).To(Equal("Policy default/pol1 outbound rule 0"))
+		})
+
+		It("should annotate profile rules with the profile name and rule index", func() {
+			chains := renderer.ProfileToIptablesChains(
+				&proto.ProfileID{Name: "prof1"},
+				&proto.Profile{OutboundRules: []*proto.Rule{{Action: "deny"}}},
+				4,
+			)
+			Expect(chains[1].Rules[0].Comment).To(Equal("Profile prof1 outbound rule 0"))
+		})
+
+		It("should truncate over-long comments", func() {
+			chains := renderer.ProfileToIptablesChains(
+				&proto.ProfileID{Name: strings.Repeat("a", 300)},
+				&proto.Profile{InboundRules: []*proto.Rule{{Action: "deny"}}},
+				4,
+			)
+			Expect(chains[0].Rules[0].Comment).To(HaveLen(MaxCommentLength))
+		})
+	})
+
+	Describe("with a log prefix that includes the policy name", func() {
+		BeforeEach(func() {
+			rrConfigPrefix := rrConfigNormal
+			rrConfigPrefix.IptablesLogPrefix = "cali %k %n"
+			renderer = NewRenderer(rrConfigPrefix).(*DefaultRuleRenderer)
+		})
+
+		It("should expand the kind and name", func() {
+			chains := renderer.PolicyToIptablesChains(
+				&proto.PolicyID{Tier: "default", Name: "pol1"},
+				&proto.Policy{InboundRules: []*proto.Rule{{Action: "log"}}},
+				4,
+			)
+			Expect(chains[0].Rules[0].Action).To(Equal(
+				iptables.LogAction{Prefix: "cali Policy default/pol1"}))
+		})
+
+		It("should truncate long prefixes", func() {
+			chains := renderer.ProfileToIptablesChains(
+				&proto.ProfileID{Name: strings.Repeat("a", 40)},
+				&proto.Profile{InboundRules: []*proto.Rule{{Action: "log"}}},
+				4,
+			)
+			Expect(chains[0].Rules[0].Action.(iptables.LogAction).Prefix).To(HaveLen(MaxLogPrefixLength))
+		})
+	})
+
+	Describe("with drop attribution enabled", func() {
+		BeforeEach(func() {
+			rrConfigDropNflog := rrConfigNormal
+			rrConfigDropNflog.DropNFLOGGroup = 3
+			renderer = NewRenderer(rrConfigDropNflog).(*DefaultRuleRenderer)
+		})
+
+		It("should copy denied packets to the NFLOG group", func() {
+			rules := renderer.ProtoRuleToIptablesRules(
+				&proto.Rule{Action: "deny", RuleId: "abcd"}, 4)
+			Expect(rules).To(Equal([]iptables.Rule{
+				{
+					Match:  iptables.Match(),
+					Action: iptables.NflogAction{Group: 3, Prefix: "D:R:abcd"},
+				},
+				{
+					Match:  iptables.Match(),
+					Action: iptables.DropAction{},
+				},
+			}))
+		})
+		It("should copy rejected packets to the NFLOG group", func() {
+			rules := renderer.ProtoRuleToIptablesRules(
+				&proto.Rule{Action: "reject", RuleId: "abcd"}, 4)
+			Expect(rules).To(HaveLen(2))
+			Expect(rules[0].Action).To(Equal(iptables.NflogAction{Group: 3, Prefix: "D:R:abcd"}))
+		})
+		It("should not copy allowed packets", func() {
+			rules := renderer.ProtoRuleToIptablesRules(
+				&proto.Rule{Action: "allow", RuleId: "abcd"}, 4)
+			Expect(rules).To(HaveLen(2))
+			Expect(rules[0].Action).To(Equal(iptables.SetMarkAction{Mark: 0x8}))
+		})
+	})
+
+	Describe("reject rules", func() {
+		tcp := &proto.Protocol{NumberOrName: &proto.Protocol_Name{"tcp"}}
+		udp := &proto.Protocol{NumberOrName: &proto.Protocol_Name{"udp"}}
+
+		It("should use the configured default", func() {
+			rules := renderer.ProtoRuleToIptablesRules(&proto.Rule{Action: "reject"}, 4)
+			Expect(rules).To(Equal([]iptables.Rule{{
+				Match:  iptables.Match(),
+				Action: iptables.RejectAction{With: "icmp-port-unreachable"},
+			}}))
+		})
+		It("should map the rule's error to ICMPv6", func() {
+			rules := renderer.ProtoRuleToIptablesRules(
+				&proto.Rule{Action: "reject", RejectWith: "admin-prohibited"}, 6)
+			Expect(rules).To(Equal([]iptables.Rule{{
+				Match:  iptables.Match(),
+				Action: iptables.RejectAction{With: "icmp6-adm-prohibited"},
+			}}))
+		})
+		It("should send TCP reset for a TCP rule", func() {
+			rules := renderer.ProtoRuleToIptablesRules(
+				&proto.Rule{Action: "reject", RejectWith: "tcp-reset", Protocol: tcp}, 4)
+			Expect(rules).To(Equal([]iptables.Rule{{
+				Match:  iptables.Match().Protocol("tcp"),
+				Action: iptables.RejectAction{With: "tcp-reset"},
+			}}))
+		})
+		It("should fall back to ICMP for a non-TCP rule", func() {
+			rules := renderer.ProtoRuleToIptablesRules(
+				&proto.Rule{Action: "reject", RejectWith: "tcp-reset", Protocol: udp}, 4)
+			Expect(rules).To(Equal([]iptables.Rule{{
+				Match:  iptables.Match().Protocol("udp"),
+				Action: iptables.RejectAction{With: "icmp-port-unreachable"},
+			}}))
+		})
+		It("should send TCP reset to TCP packets and ICMP to others if the rule matches any protocol", func() {
+			rules := renderer.ProtoRuleToIptablesRules(
+				&proto.Rule{Action: "reject", RejectWith: "tcp-reset", SrcNet: "10.0.0.0/8"}, 4)
+			Expect(rules).To(Equal([]iptables.Rule{
+				{
+					Match:  iptables.Match().SourceNet("10.0.0.0/8").Protocol("tcp"),
+					Action: iptables.RejectAction{With: "tcp-reset"},
+				},
+				{
+					Match:  iptables.Match().SourceNet("10.0.0.0/8"),
+					Action: iptables.RejectAction{With: "icmp-port-unreachable"},
+				},
+			}))
+		})
+		It("should render reject rules as drops for the raw table", func() {
+			chains := renderer.RawPolicyToIptablesChains(
+				&proto.PolicyID{Tier: "default", Name: "pol1"},
+				&proto.Policy{
+					InboundRules: []*proto.Rule{
+						{Action: "reject", RejectWith: "tcp-reset", SrcNet: "10.0.0.0/8"},
+					},
+					OutboundRules: []*proto.Rule{{Action: "reject", Protocol: udp}},
+					Untracked:     true,
+				},
+				4,
+			)
+			Expect(chains).To(HaveLen(2))
+			Expect(chains[0].Rules).To(HaveLen(1))
+			Expect(chains[0].Rules[0].Match).To(Equal(iptables.Match().SourceNet("10.0.0.0/8")))
+			Expect(chains[0].Rules[0].Action).To(Equal(iptables.DropAction{}))
+			Expect(chains[1].Rules).To(HaveLen(1))
+			Expect(chains[1].Rules[0].Action).To(Equal(iptables.DropAction{}))
+		})
+		It("should still reject in the filter table's rendering of the same policy", func() {
+			chains := renderer.PolicyToIptablesChains(
+				&proto.PolicyID{Tier: "default", Name: "pol1"},
+				&proto.Policy{
+					InboundRules: []*proto.Rule{{Action: "reject"}},
+					Untracked:    true,
+				},
+				4,
+			)
+			Expect(chains[0].Rules[0].Action).To(Equal(
+				iptables.RejectAction{With: "icmp-port-unreachable"}))
+		})
+	})
+
+	Describe("with logging to NFLOG", func() {
+		BeforeEach(func() {
+			rrConfigNflog := rrConfigNormal
+			rrConfigNflog.IptablesLogNFLOGGroup = 5
+			renderer = NewRenderer(rrConfigNflog).(*DefaultRuleRenderer)
+		})
+
+		It("should render log rules as NFLOG", func() {
+			rules := renderer.ProtoRuleToIptablesRules(&proto.Rule{Action: "log"}, 4)
+			Expect(rules).To(Equal([]iptables.Rule{{
+				Match:  iptables.Match(),
+				Action: iptables.NflogAction{Group: 5, Prefix: "calico-packet"},
+			}}))
+		})
+	})
+
 	It("should skip rules of incorrect IP version", func() {
 		rules := renderer.ProtoRulesToIptablesRules([]*proto.Rule{{IpVersion: 4}}, 6)
 		Expect(rules).To(BeEmpty())
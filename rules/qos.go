@@ -0,0 +1,133 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+// StaticMangleTableChains returns the static chains for the mangle table, which we use to police
+// the DSCP values in packets from workloads.  The cali-PREROUTING chain jumps to the
+// cali-from-wl-dscp chain for packets from workloads; that chain is maintained by
+// WorkloadDSCPChain() and it dispatches to one of the DSCP treatment chains below, by interface.
+func (r *DefaultRuleRenderer) StaticMangleTableChains(ipVersion uint8) []*Chain {
+	var preroutingRules []Rule
+	for _, prefix := range r.WorkloadIfacePrefixes {
+		log.WithField("ifacePrefix", prefix).Debug("Adding workload match rules")
+		ifaceMatch := prefix + "+"
+		preroutingRules = append(preroutingRules, Rule{
+			Match:  Match().InInterface(ifaceMatch),
+			Action: JumpAction{Target: ChainFromWorkloadDSCP},
+		})
+	}
+
+	chains := []*Chain{
+		{
+			Name:  ChainManglePrerouting,
+			Rules: preroutingRules,
+		},
+		{
+			Name: ChainDSCPZero,
+			Rules: []Rule{{
+				Action: SetDSCPAction{Value: 0},
+			}},
+		},
+	}
+
+	// Render the map chain.  The DSCP target doesn't terminate processing of the chain so,
+	// to avoid one mapping feeding into another, we goto a chain that sets the new value.
+	// Values that aren't in the map are left as they are.
+	var fromValues []int
+	toValues := map[uint8]bool{}
+	for from, to := range r.WorkloadDSCPMap {
+		fromValues = append(fromValues, int(from))
+		toValues[to] = true
+	}
+	sort.Ints(fromValues)
+	var mapRules []Rule
+	for _, from := range fromValues {
+		to := r.WorkloadDSCPMap[uint8(from)]
+		mapRules = append(mapRules, Rule{
+			Match:  Match().DSCP(uint8(from)),
+			Action: GotoAction{Target: DSCPSetChainName(to)},
+		})
+	}
+	chains = append(chains, &Chain{
+		Name:  ChainDSCPMap,
+		Rules: mapRules,
+	})
+	var sortedToValues []int
+	for to := range toValues {
+		sortedToValues = append(sortedToValues, int(to))
+	}
+	sort.Ints(sortedToValues)
+	for _, to := range sortedToValues {
+		chains = append(chains, &Chain{
+			Name: DSCPSetChainName(uint8(to)),
+			Rules: []Rule{{
+				Action: SetDSCPAction{Value: uint8(to)},
+			}},
+		})
+	}
+	return chains
+}
+
+// WorkloadDSCPChain renders the chain that applies the DSCP treatment for each workload
+// interface.  Interfaces in DSCPModePreserve are omitted.
+func (r *DefaultRuleRenderer) WorkloadDSCPChain(ifaceNameToMode map[string]string) *Chain {
+	// Sort the interface names so that we render rules in a determined order.
+	ifaceNames := make([]string, 0, len(ifaceNameToMode))
+	for ifaceName := range ifaceNameToMode {
+		ifaceNames = append(ifaceNames, ifaceName)
+	}
+	sort.Strings(ifaceNames)
+
+	rules := []Rule{}
+	for _, ifaceName := range ifaceNames {
+		var target string
+		switch mode := ifaceNameToMode[ifaceName]; mode {
+		case DSCPModeZero:
+			target = ChainDSCPZero
+		case DSCPModeMap:
+			target = ChainDSCPMap
+		case DSCPModePreserve:
+			continue
+		default:
+			log.WithFields(log.Fields{
+				"ifaceName": ifaceName,
+				"mode":      mode,
+			}).Warn("Unknown DSCP mode, leaving DSCP unchanged")
+			continue
+		}
+		rules = append(rules, Rule{
+			Match:  Match().InInterface(ifaceName),
+			Action: GotoAction{Target: target},
+		})
+	}
+	return &Chain{
+		Name:  ChainFromWorkloadDSCP,
+		Rules: rules,
+	}
+}
+
+// DSCPSetChainName returns the name of the chain that sets the DSCP to the given value.
+func DSCPSetChainName(value uint8) string {
+	return fmt.Sprintf("%s%d", DSCPSetChainPfx, value)
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/ipsets"
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("DSCP rendering", func() {
+	var rrConfig = Config{
+		IPSetConfigV4:         ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+		IPSetConfigV6:         ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+		WorkloadIfacePrefixes: []string{"cali", "tap"},
+		IptablesMarkAccept:    0x8,
+		IptablesMarkPass:      0x10,
+		WorkloadDSCPMap:       map[uint8]uint8{46: 0, 34: 10, 36: 10},
+	}
+
+	var renderer RuleRenderer
+	BeforeEach(func() {
+		renderer = NewRenderer(rrConfig)
+	})
+
+	It("should render the static mangle chains", func() {
+		Expect(renderer.StaticMangleTableChains(4)).To(Equal([]*Chain{
+			{
+				Name: "cali-PREROUTING",
+				Rules: []Rule{
+					{
+						Match:  Match().InInterface("cali+"),
+						Action: JumpAction{Target: "cali-from-wl-dscp"},
+					},
+					{
+						Match:  Match().InInterface("tap+"),
+						Action: JumpAction{Target: "cali-from-wl-dscp"},
+					},
+				},
+			},
+			{
+				Name:  "cali-dscp-zero",
+				Rules: []Rule{{Action: SetDSCPAction{Value: 0}}},
+			},
+			{
+				Name: "cali-dscp-map",
+				Rules: []Rule{
+					{
+						Match:  Match().DSCP(34),
+						Action: GotoAction{Target: "cali-dscp-set-10"},
+					},
+					{
+						Match:  Match().DSCP(36),
+						Action: GotoAction{Target: "cali-dscp-set-10"},
+					},
+					{
+						Match:  Match().DSCP(46),
+						Action: GotoAction{Target: "cali-dscp-set-0"},
+					},
+				},
+			},
+			{
+				Name:  "cali-dscp-set-0",
+				Rules: []Rule{{Action: SetDSCPAction{Value: 0}}},
+			},
+			{
+				Name:  "cali-dscp-set-10",
+				Rules: []Rule{{Action: SetDSCPAction{Value: 10}}},
+			},
+		}))
+	})
+
+	It("should render the per-workload chain", func() {
+		Expect(renderer.WorkloadDSCPChain(map[string]string{
+			"cali1234": "zero",
+			"cali5678": "map",
+			"cali0000": "preserve",
+			"caliabcd": "unknown",
+		})).To(Equal(&Chain{
+			Name: "cali-from-wl-dscp",
+			Rules: []Rule{
+				{
+					Match:  Match().InInterface("cali1234"),
+					Action: GotoAction{Target: "cali-dscp-zero"},
+				},
+				{
+					Match:  Match().InInterface("cali5678"),
+					Action: GotoAction{Target: "cali-dscp-map"},
+				},
+			},
+		}))
+	})
+
+	It("should render an empty per-workload chain with no workloads", func() {
+		Expect(renderer.WorkloadDSCPChain(map[string]string{})).To(Equal(&Chain{
+			Name:  "cali-from-wl-dscp",
+			Rules: []Rule{},
+		}))
+	})
+})
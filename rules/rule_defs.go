@@ -57,6 +57,68 @@ const (
 	ChainFIPDnat = ChainNamePrefix + "fip-dnat"
 	ChainFIPSnat = ChainNamePrefix + "fip-snat"
 
+	// KubeIPVSClusterIPSetName is the hash:ip,port IP set that kube-proxy maintains in IPVS
+	// mode, containing the cluster IP and port of each service.
+	KubeIPVSClusterIPSetName = "KUBE-CLUSTER-IP"
+
+	// ChainInstanceMarker is a chain that holds a single rule, whose comment records the
+	// persisted ID of the instance of Felix that owns the dataplane and the random epoch
+	// of its current run.
+	ChainInstanceMarker = ChainNamePrefix + "instance"
+
+	ChainManglePrerouting = ChainNamePrefix + "PREROUTING"
+	ChainFromWorkloadDSCP = ChainNamePrefix + "from-wl-dscp"
+	ChainDSCPZero         = ChainNamePrefix + "dscp-zero"
+	ChainDSCPMap          = ChainNamePrefix + "dscp-map"
+	DSCPSetChainPfx       = ChainNamePrefix + "dscp-set-"
+
+	// DSCP handling modes for packets from workloads.  "preserve" leaves the DSCP as set by
+	// the workload, "zero" clears it and "map" rewrites it according to the configured map.
+	DSCPModePreserve = "preserve"
+	DSCPModeZero     = "zero"
+	DSCPModeMap      = "map"
+
+	// Source address checks for packets from workloads.  "none" disables the check, "ip"
+	// drops packets whose source IP isn't one of the endpoint's and "ip-and-mac" also drops
+	// packets whose source MAC isn't the endpoint's.
+	SourceCheckNone     = "none"
+	SourceCheckIP       = "ip"
+	SourceCheckIPAndMAC = "ip-and-mac"
+
+	// End-of-tier actions, from proto.TierInfo.  "deny" drops packets that no policy in the
+	// tier accepted or passed; "pass" lets them fall through to the next tier.  An empty
+	// action means "deny".
+	EndOfTierActionDeny = "deny"
+	EndOfTierActionPass = "pass"
+
+	// DefaultTierName is the name of the tier that policies belong to if they don't specify
+	// one.  Its policies' chains are named after the policy alone, for compatibility.
+	DefaultTierName = "default"
+
+	// Errors that "reject" rules can send, as found in proto.Rule and the RejectWith config
+	// parameter.  Each maps to the equivalent ICMP or ICMPv6 error, apart from TCP reset.
+	RejectWithPortUnreachable = "port-unreachable"
+	RejectWithHostUnreachable = "host-unreachable"
+	RejectWithNetUnreachable  = "net-unreachable"
+	RejectWithAdminProhibited = "admin-prohibited"
+	RejectWithTCPReset        = "tcp-reset"
+
+	// NFLOG prefixes for packets that we drop, if Config.DropNFLOGGroup is set.  They allow
+	// a collector to attribute each drop to the rule that caused it:
+	//
+	// - DropPrefixRule + <rule ID>, for explicit deny rules;
+	// - DropPrefixEndOfTier + <"i" or "o"> + ":" + <tier name>, for the drop at the end of
+	//   a tier, where "i" and "o" mean that the tier's inbound or outbound policies were
+	//   being applied;
+	// - DropPrefixNoProfile + <"i" or "o">, if none of the endpoint's profiles accepted the
+	//   packet;
+	// - DropPrefixSpoofed + <"ip" or "mac">, for packets from a workload with a source
+	//   address that doesn't belong to it.
+	DropPrefixRule      = "D:R:"
+	DropPrefixEndOfTier = "D:T:"
+	DropPrefixNoProfile = "D:P:"
+	DropPrefixSpoofed   = "D:S:"
+
 	PolicyInboundPfx   PolicyChainNamePrefix  = ChainNamePrefix + "pi-"
 	PolicyOutboundPfx  PolicyChainNamePrefix  = ChainNamePrefix + "po-"
 	ProfileInboundPfx  ProfileChainNamePrefix = ChainNamePrefix + "pri-"
@@ -77,6 +139,16 @@ const (
 
 	RuleHashPrefix = "cali:"
 
+	// MaxCommentLength is the maximum length of an iptables comment; the kernel allows 256
+	// bytes, including the terminating NUL.
+	MaxCommentLength = 255
+
+	// MaxLogPrefixLength is the longest log prefix that we pass to LogAction, which appends
+	// ": " to it; the kernel allows 29 characters in total.
+	MaxLogPrefixLength = 27
+	// MaxNFLOGPrefixLength is the longest prefix that the NFLOG target accepts.
+	MaxNFLOGPrefixLength = 63
+
 	// HistoricNATRuleInsertRegex is a regex pattern to match to match
 	// special-case rules inserted by old versions of felix.  Specifically,
 	// Python felix used to insert a masquerade rule directly into the
@@ -126,27 +198,31 @@ type RuleRenderer interface {
 	StaticFilterTableChains(ipVersion uint8) []*iptables.Chain
 	StaticNATTableChains(ipVersion uint8) []*iptables.Chain
 	StaticRawTableChains(ipVersion uint8) []*iptables.Chain
+	StaticMangleTableChains(ipVersion uint8) []*iptables.Chain
 
 	WorkloadDispatchChains(map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint) []*iptables.Chain
 	WorkloadEndpointToIptablesChains(
 		ifaceName string,
 		adminUp bool,
-		policies []string,
+		tiers []*proto.TierInfo,
 		profileIDs []string,
+		sourceNets []string,
+		sourceMAC string,
 	) []*iptables.Chain
 
 	HostDispatchChains(map[string]proto.HostEndpointID) []*iptables.Chain
 	HostEndpointToFilterChains(
 		ifaceName string,
-		policyNames []string,
+		tiers []*proto.TierInfo,
 		profileIDs []string,
 	) []*iptables.Chain
 	HostEndpointToRawChains(
 		ifaceName string,
-		untrackedPolicyNames []string,
+		untrackedTiers []*proto.TierInfo,
 	) []*iptables.Chain
 
 	PolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain
+	RawPolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain
 	ProfileToIptablesChains(profileID *proto.ProfileID, policy *proto.Profile, ipVersion uint8) []*iptables.Chain
 	ProtoRuleToIptablesRules(pRule *proto.Rule, ipVersion uint8) []iptables.Rule
 
@@ -154,12 +230,15 @@ type RuleRenderer interface {
 
 	DNATsToIptablesChains(dnats map[string]string) []*iptables.Chain
 	SNATsToIptablesChains(snats map[string]string) []*iptables.Chain
+
+	WorkloadDSCPChain(ifaceNameToMode map[string]string) *iptables.Chain
 }
 
 type DefaultRuleRenderer struct {
 	Config
 
 	inputAcceptActions []iptables.Action
+	filterAllowAction  iptables.Action
 }
 
 func (r *DefaultRuleRenderer) ipSetConfig(ipVersion uint8) *ipsets.IPVersionConfig {
@@ -182,6 +261,9 @@ type Config struct {
 	IptablesMarkAccept       uint32
 	IptablesMarkPass         uint32
 	IptablesMarkFromWorkload uint32
+	// IptablesMarkService is set on packets that IPVS is forwarding to a service backend.
+	// Only allocated if KubeIPVSSupportEnabled is set.
+	IptablesMarkService uint32
 
 	OpenStackMetadataIP          net.IP
 	OpenStackMetadataPort        uint16
@@ -190,13 +272,48 @@ type Config struct {
 	IPIPEnabled       bool
 	IPIPTunnelAddress net.IP
 
-	IptablesLogPrefix    string
-	EndpointToHostAction string
+	// IptablesLogPrefix is the prefix for packets logged by "log" rules.  "%k" and "%n" are
+	// replaced by the kind and name of the policy or profile containing the rule.
+	IptablesLogPrefix string
+	// IptablesLogNFLOGGroup, if non-zero, causes "log" rules to send packets to the given
+	// NFLOG group rather than the kernel log.
+	IptablesLogNFLOGGroup uint16
+	EndpointToHostAction  string
+	// FilterAllowAction is the action used in the filter table once a packet has been
+	// allowed: "ACCEPT" (the default) or "RETURN", which hands the packet back to the
+	// top-level chain so that non-Calico rules get a chance to run.  Failsafe rules and
+	// the conntrack rules in the endpoint chains always ACCEPT.
+	FilterAllowAction string
+	// RejectWith is the error that "reject" rules send if the rule doesn't specify one.
+	RejectWith string
+	// DropNFLOGGroup, if non-zero, causes packets that we drop because of policy to be sent
+	// to the given NFLOG group first, with one of the DropPrefix... prefixes.
+	DropNFLOGGroup uint16
 
 	FailsafeInboundHostPorts  []config.ProtoPort
 	FailsafeOutboundHostPorts []config.ProtoPort
 
 	DisableConntrackInvalid bool
+
+	// WorkloadSourceCheck is one of the SourceCheck... constants; it controls whether we
+	// drop packets from workloads that don't come from the endpoint's own addresses.
+	WorkloadSourceCheck string
+	// WorkloadSourceCheckExemptIfacePrefixes lists the prefixes of workload interfaces that
+	// are exempt from the source check.
+	WorkloadSourceCheckExemptIfacePrefixes []string
+
+	// PolicyNameComments, if true, causes policy and profile rules to be annotated with a
+	// comment containing the policy/profile name and the index of the rule.
+	PolicyNameComments bool
+
+	// WorkloadDSCPMap maps from DSCP value set by a workload to the value that we rewrite it
+	// to, for endpoints in DSCPModeMap.
+	WorkloadDSCPMap map[uint8]uint8
+
+	// KubeIPVSSupportEnabled, if true, adds rules to police traffic that kube-proxy's IPVS
+	// mode forwards to service backends.  Such traffic arrives via the INPUT chain and leaves
+	// via the OUTPUT chain rather than traversing the FORWARD chain.
+	KubeIPVSSupportEnabled bool
 }
 
 func NewRenderer(config Config) RuleRenderer {
@@ -216,8 +333,20 @@ func NewRenderer(config Config) RuleRenderer {
 		inputAcceptActions = []iptables.Action{iptables.ReturnAction{}}
 	}
 
+	// Second, what should we do with packets that Calico allows in the filter table.
+	var filterAllowAction iptables.Action
+	switch config.FilterAllowAction {
+	case "RETURN":
+		log.Info("Packets allowed by Calico will be returned to the top-level chain.")
+		filterAllowAction = iptables.ReturnAction{}
+	default:
+		log.Info("Packets allowed by Calico will be accepted.")
+		filterAllowAction = iptables.AcceptAction{}
+	}
+
 	return &DefaultRuleRenderer{
 		Config:             config,
 		inputAcceptActions: inputAcceptActions,
+		filterAllowAction:  filterAllowAction,
 	}
 }
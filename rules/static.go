@@ -15,6 +15,8 @@
 package rules
 
 import (
+	"strings"
+
 	log "github.com/Sirupsen/logrus"
 
 	. "github.com/projectcalico/felix/iptables"
@@ -23,7 +25,7 @@ import (
 func (r *DefaultRuleRenderer) StaticFilterTableChains(ipVersion uint8) (chains []*Chain) {
 	chains = append(chains, r.StaticFilterForwardChains()...)
 	chains = append(chains, r.StaticFilterInputChains(ipVersion)...)
-	chains = append(chains, r.StaticFilterOutputChains()...)
+	chains = append(chains, r.StaticFilterOutputChains(ipVersion)...)
 	return
 }
 
@@ -36,7 +38,7 @@ func (r *DefaultRuleRenderer) StaticFilterInputChains(ipVersion uint8) []*Chain
 	return []*Chain{
 		r.filterInputChain(ipVersion),
 		r.filterWorkloadToHostChain(ipVersion),
-		r.failsafeInChain(),
+		r.failsafeInChain(ipVersion),
 	}
 }
 
@@ -44,7 +46,7 @@ func (r *DefaultRuleRenderer) acceptUntrackedRules() []Rule {
 	return []Rule{
 		{
 			Match:  Match().MarkSet(r.IptablesMarkAccept).ConntrackState("UNTRACKED"),
-			Action: AcceptAction{},
+			Action: r.filterAllowAction,
 		},
 	}
 }
@@ -89,7 +91,7 @@ func (r *DefaultRuleRenderer) filterInputChain(ipVersion uint8) *Chain {
 		},
 		Rule{
 			Match:   Match().MarkSet(r.IptablesMarkAccept),
-			Action:  AcceptAction{},
+			Action:  r.filterAllowAction,
 			Comment: "Host endpoint policy accepted packet.",
 		},
 	)
@@ -123,7 +125,7 @@ func (r *DefaultRuleRenderer) filterWorkloadToHostChain(ipVersion uint8) *Chain
 				Match: Match().
 					ProtocolNum(ProtoICMPv6).
 					ICMPV6Type(icmpType),
-				Action: AcceptAction{},
+				Action: r.filterAllowAction,
 			})
 		}
 	}
@@ -142,7 +144,7 @@ func (r *DefaultRuleRenderer) filterWorkloadToHostChain(ipVersion uint8) *Chain
 					Protocol("tcp").
 					DestNet(r.OpenStackMetadataIP.String()).
 					DestPorts(r.OpenStackMetadataPort),
-				Action: AcceptAction{},
+				Action: r.filterAllowAction,
 			})
 		}
 
@@ -162,13 +164,13 @@ func (r *DefaultRuleRenderer) filterWorkloadToHostChain(ipVersion uint8) *Chain
 					Protocol("udp").
 					SourcePorts(dhcpSrcPort).
 					DestPorts(dhcpDestPort),
-				Action: AcceptAction{},
+				Action: r.filterAllowAction,
 			},
 			Rule{
 				Match: Match().
 					Protocol("udp").
 					DestPorts(dnsDestPort),
-				Action: AcceptAction{},
+				Action: r.filterAllowAction,
 			},
 		)
 	}
@@ -178,6 +180,17 @@ func (r *DefaultRuleRenderer) filterWorkloadToHostChain(ipVersion uint8) *Chain
 		Action: JumpAction{Target: ChainFromWorkloadDispatch},
 	})
 
+	if r.KubeIPVSSupportEnabled {
+		// Traffic to an IPVS service arrives here, rather than in the FORWARD chain, since
+		// kube-proxy assigns the service IPs to the host.  It isn't really destined for the
+		// host so it shouldn't be subject to the DefaultEndpointToHostAction.
+		rules = append(rules, Rule{
+			Match:   Match().DestIPPortSet(KubeIPVSClusterIPSetName),
+			Action:  r.filterAllowAction,
+			Comment: "Allow workload to IPVS service",
+		})
+	}
+
 	// If the dispatch chain accepts the packet, it returns to us here.  Apply the configured
 	// action.  Note: we may have done work above to allow the packet and then end up dropping
 	// it here.  We can't optimize that away because there may be other rules (such as log
@@ -195,14 +208,31 @@ func (r *DefaultRuleRenderer) filterWorkloadToHostChain(ipVersion uint8) *Chain
 	}
 }
 
-func (r *DefaultRuleRenderer) failsafeInChain() *Chain {
+// failsafeNetApplies returns true if a failsafe entry with the given net (which may be empty,
+// meaning "any") should be rendered for the given IP version.
+func failsafeNetApplies(net string, ipVersion uint8) bool {
+	if net == "" {
+		return true
+	}
+	isV6 := strings.Contains(net, ":")
+	return isV6 == (ipVersion == 6)
+}
+
+func (r *DefaultRuleRenderer) failsafeInChain(ipVersion uint8) *Chain {
 	rules := []Rule{}
 
 	for _, protoPort := range r.Config.FailsafeInboundHostPorts {
+		if !failsafeNetApplies(protoPort.Net, ipVersion) {
+			continue
+		}
+		match := Match().
+			Protocol(protoPort.Protocol).
+			DestPorts(protoPort.Port)
+		if protoPort.Net != "" {
+			match = match.SourceNet(protoPort.Net)
+		}
 		rules = append(rules, Rule{
-			Match: Match().
-				Protocol(protoPort.Protocol).
-				DestPorts(protoPort.Port),
+			Match:  match,
 			Action: AcceptAction{},
 		})
 	}
@@ -213,14 +243,21 @@ func (r *DefaultRuleRenderer) failsafeInChain() *Chain {
 	}
 }
 
-func (r *DefaultRuleRenderer) failsafeOutChain() *Chain {
+func (r *DefaultRuleRenderer) failsafeOutChain(ipVersion uint8) *Chain {
 	rules := []Rule{}
 
 	for _, protoPort := range r.Config.FailsafeOutboundHostPorts {
+		if !failsafeNetApplies(protoPort.Net, ipVersion) {
+			continue
+		}
+		match := Match().
+			Protocol(protoPort.Protocol).
+			DestPorts(protoPort.Port)
+		if protoPort.Net != "" {
+			match = match.DestNet(protoPort.Net)
+		}
 		rules = append(rules, Rule{
-			Match: Match().
-				Protocol(protoPort.Protocol).
-				DestPorts(protoPort.Port),
+			Match:  match,
 			Action: AcceptAction{},
 		})
 	}
@@ -272,11 +309,11 @@ func (r *DefaultRuleRenderer) StaticFilterForwardChains() []*Chain {
 		rules = append(rules,
 			Rule{
 				Match:  Match().InInterface(ifaceMatch),
-				Action: AcceptAction{},
+				Action: r.filterAllowAction,
 			},
 			Rule{
 				Match:  Match().OutInterface(ifaceMatch),
-				Action: AcceptAction{},
+				Action: r.filterAllowAction,
 			},
 		)
 	}
@@ -296,7 +333,7 @@ func (r *DefaultRuleRenderer) StaticFilterForwardChains() []*Chain {
 		},
 		Rule{
 			Match:   Match().MarkSet(r.IptablesMarkAccept),
-			Action:  AcceptAction{},
+			Action:  r.filterAllowAction,
 			Comment: "Host endpoint policy accepted packet.",
 		},
 	)
@@ -307,10 +344,10 @@ func (r *DefaultRuleRenderer) StaticFilterForwardChains() []*Chain {
 	}}
 }
 
-func (r *DefaultRuleRenderer) StaticFilterOutputChains() []*Chain {
+func (r *DefaultRuleRenderer) StaticFilterOutputChains(ipVersion uint8) []*Chain {
 	return []*Chain{
 		r.filterOutputChain(),
-		r.failsafeOutChain(),
+		r.failsafeOutChain(ipVersion),
 	}
 }
 
@@ -321,6 +358,29 @@ func (r *DefaultRuleRenderer) filterOutputChain() *Chain {
 	// raw chain.
 	rules = append(rules, r.acceptUntrackedRules()...)
 
+	if r.KubeIPVSSupportEnabled {
+		// IPVS forwards service traffic via the OUTPUT chain instead of the FORWARD
+		// chain.  Mark it so that we can apply the destination workload's ingress policy
+		// below.
+		rules = append(rules,
+			Rule{
+				Action: ClearMarkAction{Mark: r.IptablesMarkService},
+			},
+			Rule{
+				Match:  Match().IPVSForwarded(),
+				Action: SetMarkAction{Mark: r.IptablesMarkService},
+			},
+		)
+		for _, prefix := range r.WorkloadIfacePrefixes {
+			rules = append(rules, Rule{
+				Match: Match().
+					MarkSet(r.IptablesMarkService).
+					OutInterface(prefix + "+"),
+				Action: JumpAction{Target: ChainToWorkloadDispatch},
+			})
+		}
+	}
+
 	// We don't currently police host -> endpoint according to the endpoint's ingress policy.
 	// That decision is based on pragmatism; it's generally very useful to be able to contact
 	// any local workload from the host and policing the traffic doesn't really protect
@@ -350,7 +410,7 @@ func (r *DefaultRuleRenderer) filterOutputChain() *Chain {
 		},
 		Rule{
 			Match:   Match().MarkSet(r.IptablesMarkAccept),
-			Action:  AcceptAction{},
+			Action:  r.filterAllowAction,
 			Comment: "Host endpoint policy accepted packet.",
 		},
 	)
@@ -457,8 +517,8 @@ func (r *DefaultRuleRenderer) StaticNATOutputChains(ipVersion uint8) []*Chain {
 
 func (r *DefaultRuleRenderer) StaticRawTableChains(ipVersion uint8) []*Chain {
 	return []*Chain{
-		r.failsafeInChain(),
-		r.failsafeOutChain(),
+		r.failsafeInChain(ipVersion),
+		r.failsafeOutChain(ipVersion),
 		r.StaticRawPreroutingChain(ipVersion),
 		r.StaticRawOutputChain(),
 	}
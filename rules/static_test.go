@@ -281,6 +281,170 @@ var _ = Describe("Static", func() {
 		})
 	})
 
+	Describe("with failsafe entries limited to CIDRs", func() {
+		BeforeEach(func() {
+			conf = Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				FailsafeInboundHostPorts: []config.ProtoPort{
+					{Protocol: "tcp", Port: 22},
+					{Protocol: "tcp", Port: 22, Net: "10.0.0.0/8"},
+					{Protocol: "udp", Port: 53, Net: "fd00::/8"},
+				},
+				FailsafeOutboundHostPorts: []config.ProtoPort{
+					{Protocol: "tcp", Port: 2379, Net: "10.1.0.1/32"},
+					{Protocol: "tcp", Port: 2379, Net: "fd00::1/128"},
+				},
+				IptablesMarkAccept:       0x10,
+				IptablesMarkPass:         0x20,
+				IptablesMarkFromWorkload: 0x40,
+			}
+		})
+
+		It("should render only the IPv4 entries for IPv4", func() {
+			Expect(findChain(rr.StaticFilterTableChains(4), "cali-failsafe-in")).To(Equal(&Chain{
+				Name: "cali-failsafe-in",
+				Rules: []Rule{
+					{Match: Match().Protocol("tcp").DestPorts(22), Action: AcceptAction{}},
+					{Match: Match().Protocol("tcp").DestPorts(22).SourceNet("10.0.0.0/8"), Action: AcceptAction{}},
+				},
+			}))
+			Expect(findChain(rr.StaticRawTableChains(4), "cali-failsafe-out")).To(Equal(&Chain{
+				Name: "cali-failsafe-out",
+				Rules: []Rule{
+					{Match: Match().Protocol("tcp").DestPorts(2379).DestNet("10.1.0.1/32"), Action: AcceptAction{}},
+				},
+			}))
+		})
+		It("should render only the IPv6 entries for IPv6", func() {
+			Expect(findChain(rr.StaticRawTableChains(6), "cali-failsafe-in")).To(Equal(&Chain{
+				Name: "cali-failsafe-in",
+				Rules: []Rule{
+					{Match: Match().Protocol("tcp").DestPorts(22), Action: AcceptAction{}},
+					{Match: Match().Protocol("udp").DestPorts(53).SourceNet("fd00::/8"), Action: AcceptAction{}},
+				},
+			}))
+			Expect(findChain(rr.StaticFilterTableChains(6), "cali-failsafe-out")).To(Equal(&Chain{
+				Name: "cali-failsafe-out",
+				Rules: []Rule{
+					{Match: Match().Protocol("tcp").DestPorts(2379).DestNet("fd00::1/128"), Action: AcceptAction{}},
+				},
+			}))
+		})
+	})
+
+	Describe("with RETURN as the filter allow action", func() {
+		BeforeEach(func() {
+			conf = Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				FailsafeInboundHostPorts: []config.ProtoPort{
+					{Protocol: "tcp", Port: 22},
+				},
+				IptablesMarkAccept:       0x10,
+				IptablesMarkPass:         0x20,
+				IptablesMarkFromWorkload: 0x40,
+				FilterAllowAction:        "RETURN",
+			}
+		})
+
+		It("should return, rather than accept, packets that host endpoint policy allowed", func() {
+			for _, chainName := range []string{"cali-INPUT", "cali-FORWARD", "cali-OUTPUT"} {
+				chain := findChain(rr.StaticFilterTableChains(4), chainName)
+				Expect(chain.Rules[0]).To(Equal(Rule{
+					Match:  Match().MarkSet(0x10).ConntrackState("UNTRACKED"),
+					Action: ReturnAction{},
+				}), chainName)
+				Expect(chain.Rules[len(chain.Rules)-1]).To(Equal(Rule{
+					Match:   Match().MarkSet(0x10),
+					Action:  ReturnAction{},
+					Comment: "Host endpoint policy accepted packet.",
+				}), chainName)
+			}
+		})
+		It("should return workload traffic that passed policy from the forward chain", func() {
+			chain := findChain(rr.StaticFilterTableChains(4), "cali-FORWARD")
+			Expect(chain.Rules[3:5]).To(Equal([]Rule{
+				{Match: Match().InInterface("cali+"), Action: ReturnAction{}},
+				{Match: Match().OutInterface("cali+"), Action: ReturnAction{}},
+			}))
+		})
+		It("should still accept failsafe traffic", func() {
+			Expect(findChain(rr.StaticFilterTableChains(4), "cali-failsafe-in").Rules).To(Equal([]Rule{
+				{Match: Match().Protocol("tcp").DestPorts(22), Action: AcceptAction{}},
+			}))
+		})
+	})
+
+	for _, ep2HostAction := range []string{"DROP", "ACCEPT", "RETURN"} {
+		ep2HostAction := ep2HostAction
+		expectedAction := map[string]Action{
+			"DROP":   DropAction{},
+			"ACCEPT": AcceptAction{},
+			"RETURN": ReturnAction{},
+		}[ep2HostAction]
+
+		Describe(fmt.Sprintf("with DefaultEndpointToHostAction %s", ep2HostAction), func() {
+			BeforeEach(func() {
+				conf = Config{
+					WorkloadIfacePrefixes:    []string{"cali"},
+					IptablesMarkAccept:       0x10,
+					IptablesMarkPass:         0x20,
+					IptablesMarkFromWorkload: 0x40,
+					EndpointToHostAction:     ep2HostAction,
+				}
+			})
+
+			for _, ipVersion := range []uint8{4, 6} {
+				ipVersion := ipVersion
+				It(fmt.Sprintf("IPv%d: should end the workload-to-host chain with the configured action", ipVersion), func() {
+					chain := findChain(rr.StaticFilterTableChains(ipVersion), "cali-wl-to-host")
+					Expect(chain.Rules[len(chain.Rules)-2:]).To(Equal([]Rule{
+						{Action: JumpAction{Target: "cali-from-wl-dispatch"}},
+						{Action: expectedAction,
+							Comment: "Configured DefaultEndpointToHostAction"},
+					}))
+				})
+			}
+		})
+	}
+
+	Describe("with kube-proxy IPVS support", func() {
+		BeforeEach(func() {
+			conf = Config{
+				WorkloadIfacePrefixes:    []string{"cali"},
+				IptablesMarkAccept:       0x10,
+				IptablesMarkPass:         0x20,
+				IptablesMarkFromWorkload: 0x40,
+				IptablesMarkService:      0x80,
+				KubeIPVSSupportEnabled:   true,
+			}
+		})
+
+		It("should allow workload traffic to IPVS services after egress policy", func() {
+			chain := findChain(rr.StaticFilterTableChains(4), "cali-wl-to-host")
+			Expect(chain.Rules[len(chain.Rules)-2]).To(Equal(Rule{
+				Match:   Match().DestIPPortSet("KUBE-CLUSTER-IP"),
+				Action:  AcceptAction{},
+				Comment: "Allow workload to IPVS service",
+			}))
+		})
+
+		It("should apply workload ingress policy to IPVS-forwarded traffic", func() {
+			chain := findChain(rr.StaticFilterTableChains(4), "cali-OUTPUT")
+			Expect(chain.Rules[1:5]).To(Equal([]Rule{
+				{Action: ClearMarkAction{Mark: 0x80}},
+				{Match: Match().IPVSForwarded(), Action: SetMarkAction{Mark: 0x80}},
+				{
+					Match:  Match().MarkSet(0x80).OutInterface("cali+"),
+					Action: JumpAction{Target: "cali-to-wl-dispatch"},
+				},
+				{
+					Match:  Match().OutInterface("cali+"),
+					Action: ReturnAction{},
+				},
+			}))
+		})
+	})
+
 	Describe("with openstack special-cases", func() {
 		BeforeEach(func() {
 			conf = Config{
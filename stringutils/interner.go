@@ -0,0 +1,110 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stringutils
+
+// Interner deduplicates strings so that equal strings that we hold onto for a long time share
+// the same backing storage.  For example, every endpoint in a namespace typically carries the
+// same labels; without interning, each endpoint's copy of the labels is a separate allocation.
+//
+// The Interner is reference counted: each call to Intern() takes a reference to the string,
+// which must be returned by a matching call to Release().  A string is forgotten when its last
+// reference is released so that the Interner doesn't grow without bound as strings churn.
+//
+// An Interner is not safe for concurrent use.
+type Interner struct {
+	entries map[string]internEntry
+}
+
+type internEntry struct {
+	value    string
+	refCount int
+}
+
+func NewInterner() *Interner {
+	return &Interner{
+		entries: map[string]internEntry{},
+	}
+}
+
+// Intern returns the canonical copy of s and takes a reference to it.
+func (i *Interner) Intern(s string) string {
+	entry, ok := i.entries[s]
+	if !ok {
+		entry.value = s
+	}
+	entry.refCount++
+	i.entries[s] = entry
+	return entry.value
+}
+
+// Release returns a reference taken by Intern().
+func (i *Interner) Release(s string) {
+	entry, ok := i.entries[s]
+	if !ok {
+		return
+	}
+	entry.refCount--
+	if entry.refCount <= 0 {
+		delete(i.entries, s)
+		return
+	}
+	i.entries[s] = entry
+}
+
+// InternMap returns a copy of m with its keys and values interned.  It returns nil for an
+// empty map.
+func (i *Interner) InternMap(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	interned := make(map[string]string, len(m))
+	for k, v := range m {
+		interned[i.Intern(k)] = i.Intern(v)
+	}
+	return interned
+}
+
+// ReleaseMap releases the keys and values of a map returned by InternMap().
+func (i *Interner) ReleaseMap(m map[string]string) {
+	for k, v := range m {
+		i.Release(k)
+		i.Release(v)
+	}
+}
+
+// InternSlice returns a copy of s with its elements interned.  It returns nil for an empty
+// slice.
+func (i *Interner) InternSlice(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	interned := make([]string, len(s))
+	for j, str := range s {
+		interned[j] = i.Intern(str)
+	}
+	return interned
+}
+
+// ReleaseSlice releases the elements of a slice returned by InternSlice().
+func (i *Interner) ReleaseSlice(s []string) {
+	for _, str := range s {
+		i.Release(str)
+	}
+}
+
+// Len returns the number of distinct strings that are currently interned.
+func (i *Interner) Len() int {
+	return len(i.entries)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stringutils_test
+
+import (
+	. "github.com/projectcalico/felix/stringutils"
+
+	"reflect"
+	"unsafe"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// dataPtr returns the address of the string's backing storage.
+func dataPtr(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+var _ = Describe("Interner", func() {
+	var interner *Interner
+
+	BeforeEach(func() {
+		interner = NewInterner()
+	})
+
+	It("should return the same copy for equal strings", func() {
+		a := interner.Intern(string([]byte("foo")))
+		b := interner.Intern(string([]byte("foo")))
+		Expect(a).To(Equal("foo"))
+		Expect(dataPtr(a)).To(Equal(dataPtr(b)))
+		Expect(interner.Len()).To(Equal(1))
+	})
+	It("should forget a string once all references are released", func() {
+		interner.Intern("foo")
+		interner.Intern("foo")
+		interner.Intern("bar")
+		Expect(interner.Len()).To(Equal(2))
+		interner.Release("foo")
+		Expect(interner.Len()).To(Equal(2))
+		interner.Release("foo")
+		Expect(interner.Len()).To(Equal(1))
+		interner.Release("bar")
+		Expect(interner.Len()).To(Equal(0))
+	})
+	It("should ignore release of an unknown string", func() {
+		interner.Release("foo")
+		Expect(interner.Len()).To(Equal(0))
+	})
+	It("should intern maps", func() {
+		m1 := interner.InternMap(map[string]string{"a": "b", "c": "b"})
+		m2 := interner.InternMap(map[string]string{"a": "d"})
+		Expect(m1).To(Equal(map[string]string{"a": "b", "c": "b"}))
+		Expect(m2).To(Equal(map[string]string{"a": "d"}))
+		Expect(interner.Len()).To(Equal(4))
+		interner.ReleaseMap(m1)
+		Expect(interner.Len()).To(Equal(2))
+		interner.ReleaseMap(m2)
+		Expect(interner.Len()).To(Equal(0))
+	})
+	It("should return nil for an empty map", func() {
+		Expect(interner.InternMap(map[string]string{})).To(BeNil())
+	})
+	It("should intern slices", func() {
+		s := interner.InternSlice([]string{"a", "b", "a"})
+		Expect(s).To(Equal([]string{"a", "b", "a"}))
+		Expect(interner.Len()).To(Equal(2))
+		interner.ReleaseSlice(s)
+		Expect(interner.Len()).To(Equal(0))
+	})
+	It("should return nil for an empty slice", func() {
+		Expect(interner.InternSlice([]string{})).To(BeNil())
+	})
+})
@@ -0,0 +1,328 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package syncclient implements a syncer that receives its updates from a Typha-style fan-out
+// proxy (see the syncproto package) rather than from the datastore directly.
+package syncclient
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/felix/syncproto"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultReadTimeout    = 30 * time.Second
+	defaultWriteTimeout   = 10 * time.Second
+	retryInterval         = 1 * time.Second
+)
+
+// Options controls the SyncerClient.
+type Options struct {
+	// Addresses are the host:port addresses of the proxies.  The client tries them in a random
+	// order so that clients are spread across the proxies.
+	Addresses []string
+	// ConnectTimeout, ReadTimeout and WriteTimeout default to sensible values if zero.  Since
+	// the server sends regular pings, ReadTimeout also bounds the time that it takes to
+	// notice a dead connection.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	// FallbackTimeout is how long the client tries to connect to a proxy before it gives up
+	// and falls back to syncing directly with the datastore.  Zero disables fallback.
+	FallbackTimeout time.Duration
+
+	// Hostname, Version and Info identify us to the server.
+	Hostname string
+	Version  string
+	Info     string
+}
+
+// SyncerClient is a bapi.Syncer that connects to one of a set of proxies and passes the
+// updates that it receives to its callbacks.  If the connection fails, it reconnects, to a
+// different proxy if possible, and reconciles the new snapshot with the updates that it has
+// already sent so that the callbacks see a consistent stream of updates and don't drop out
+// of sync.
+type SyncerClient struct {
+	options   Options
+	callbacks *snapshotReconciler
+	// newFallbackSyncer creates a syncer that talks to the datastore directly; for example,
+	// the Syncer method of a bapi.Client.
+	newFallbackSyncer func(callbacks bapi.SyncerCallbacks) bapi.Syncer
+
+	// Shims for testing.
+	dial    func(address string, timeout time.Duration) (net.Conn, error)
+	sleep   func(time.Duration)
+	timeNow func() time.Time
+}
+
+func New(
+	options Options,
+	callbacks bapi.SyncerCallbacks,
+	newFallbackSyncer func(callbacks bapi.SyncerCallbacks) bapi.Syncer,
+) *SyncerClient {
+	return NewWithShims(options, callbacks, newFallbackSyncer, dialTCP, time.Sleep, time.Now)
+}
+
+func dialTCP(address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+// NewWithShims is a test constructor that allows for shimming the network and time.
+func NewWithShims(
+	options Options,
+	callbacks bapi.SyncerCallbacks,
+	newFallbackSyncer func(callbacks bapi.SyncerCallbacks) bapi.Syncer,
+	dial func(address string, timeout time.Duration) (net.Conn, error),
+	sleep func(time.Duration),
+	timeNow func() time.Time,
+) *SyncerClient {
+	if options.ConnectTimeout == 0 {
+		options.ConnectTimeout = defaultConnectTimeout
+	}
+	if options.ReadTimeout == 0 {
+		options.ReadTimeout = defaultReadTimeout
+	}
+	if options.WriteTimeout == 0 {
+		options.WriteTimeout = defaultWriteTimeout
+	}
+	return &SyncerClient{
+		options:           options,
+		callbacks:         newSnapshotReconciler(callbacks),
+		newFallbackSyncer: newFallbackSyncer,
+		dial:              dial,
+		sleep:             sleep,
+		timeNow:           timeNow,
+	}
+}
+
+func (c *SyncerClient) Start() {
+	go c.loop()
+}
+
+func (c *SyncerClient) loop() {
+	c.callbacks.OnStatusUpdated(bapi.WaitForDatastore)
+	lastConnectedTime := c.timeNow()
+	for {
+		for _, i := range rand.Perm(len(c.options.Addresses)) {
+			address := c.options.Addresses[i]
+			logCxt := log.WithField("address", address)
+			logCxt.Info("Connecting to sync server")
+			connected, err := c.runConnection(address)
+			if connected {
+				lastConnectedTime = c.timeNow()
+			}
+			logCxt.WithError(err).Warn("Connection to sync server failed")
+		}
+		if c.options.FallbackTimeout > 0 &&
+			c.timeNow().Sub(lastConnectedTime) >= c.options.FallbackTimeout {
+			log.WithField("timeout", c.options.FallbackTimeout).Warn(
+				"Failed to connect to any sync server, falling back to the datastore")
+			c.callbacks.StartSnapshot()
+			c.newFallbackSyncer(c.callbacks).Start()
+			return
+		}
+		c.sleep(retryInterval)
+	}
+}
+
+// runConnection connects to the given server and processes its messages until the connection
+// fails.  connected is true if the handshake succeeded.
+func (c *SyncerClient) runConnection(address string) (connected bool, err error) {
+	conn, err := c.dial(address, c.options.ConnectTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	encoder := gob.NewEncoder(conn)
+	decoder := gob.NewDecoder(conn)
+
+	send := func(msg interface{}) error {
+		if err := conn.SetWriteDeadline(c.timeNow().Add(c.options.WriteTimeout)); err != nil {
+			return err
+		}
+		return encoder.Encode(&syncproto.Envelope{Message: msg})
+	}
+	receive := func() (interface{}, error) {
+		if err := conn.SetReadDeadline(c.timeNow().Add(c.options.ReadTimeout)); err != nil {
+			return nil, err
+		}
+		var envelope syncproto.Envelope
+		err := decoder.Decode(&envelope)
+		return envelope.Message, err
+	}
+
+	err = send(syncproto.MsgClientHello{
+		Hostname:        c.options.Hostname,
+		Info:            c.options.Info,
+		Version:         c.options.Version,
+		ProtocolVersion: syncproto.ProtocolVersion,
+	})
+	if err != nil {
+		return
+	}
+	msg, err := receive()
+	if err != nil {
+		return
+	}
+	serverHello, ok := msg.(syncproto.MsgServerHello)
+	if !ok {
+		err = fmt.Errorf("unexpected message from server during handshake: %#v", msg)
+		return
+	}
+	if serverHello.ProtocolVersion != syncproto.ProtocolVersion {
+		err = fmt.Errorf("server uses protocol version %d, we need %d",
+			serverHello.ProtocolVersion, syncproto.ProtocolVersion)
+		return
+	}
+	log.WithFields(log.Fields{
+		"address":       address,
+		"serverVersion": serverHello.Version,
+	}).Info("Connected to sync server")
+	connected = true
+
+	// The server starts by sending a complete snapshot.
+	c.callbacks.StartSnapshot()
+	for {
+		msg, err = receive()
+		if err != nil {
+			return
+		}
+		switch msg := msg.(type) {
+		case syncproto.MsgSyncStatus:
+			c.callbacks.OnStatusUpdated(msg.SyncStatus)
+		case syncproto.MsgKVs:
+			updates := make([]bapi.Update, 0, len(msg.KVs))
+			for _, kv := range msg.KVs {
+				update, err := kv.ToUpdate()
+				if err != nil {
+					log.WithError(err).WithField("key", kv.Key).Warn(
+						"Failed to parse update from sync server, ignoring")
+					continue
+				}
+				updates = append(updates, update)
+			}
+			c.callbacks.OnUpdates(updates)
+		case syncproto.MsgPing:
+			if err = send(syncproto.MsgPong{PingTimestamp: msg.Timestamp}); err != nil {
+				return
+			}
+		default:
+			log.WithField("msg", msg).Warn("Ignoring unexpected message from sync server")
+		}
+	}
+}
+
+// snapshotReconciler sits between the current source of updates and the downstream callbacks.
+// Each time that we switch source (by reconnecting or by falling back to the datastore), the
+// new source starts by sending a complete snapshot.  The reconciler converts that snapshot
+// into the differences from what was sent previously: it fixes up the update types and, when
+// the snapshot completes, sends deletions for any keys that the snapshot didn't include.  Once
+// the downstream callbacks are in sync, they stay in sync.
+type snapshotReconciler struct {
+	callbacks bapi.SyncerCallbacks
+
+	// knownKeys contains the key of each KV that we've sent downstream, indexed by path.
+	knownKeys map[string]model.Key
+	// snapshotKeys contains the paths of the keys seen in the current snapshot; it is nil
+	// if there is no snapshot in progress.
+	snapshotKeys map[string]bool
+	// lastStatus is the last status that we sent downstream, if statusSent is true.
+	lastStatus bapi.SyncStatus
+	statusSent bool
+	inSync     bool
+}
+
+func newSnapshotReconciler(callbacks bapi.SyncerCallbacks) *snapshotReconciler {
+	return &snapshotReconciler{
+		callbacks: callbacks,
+		knownKeys: map[string]model.Key{},
+	}
+}
+
+// StartSnapshot is called when we're about to receive a new snapshot.
+func (r *snapshotReconciler) StartSnapshot() {
+	r.snapshotKeys = map[string]bool{}
+}
+
+func (r *snapshotReconciler) OnStatusUpdated(status bapi.SyncStatus) {
+	if status == bapi.InSync && r.snapshotKeys != nil {
+		var deletions []bapi.Update
+		for path, key := range r.knownKeys {
+			if !r.snapshotKeys[path] {
+				deletions = append(deletions, bapi.Update{
+					KVPair:     model.KVPair{Key: key},
+					UpdateType: bapi.UpdateTypeKVDeleted,
+				})
+				delete(r.knownKeys, path)
+			}
+		}
+		r.snapshotKeys = nil
+		if len(deletions) > 0 {
+			log.WithField("numDeletions", len(deletions)).Info(
+				"Snapshot complete, deleting keys that are no longer present")
+			r.callbacks.OnUpdates(deletions)
+		}
+	}
+	if r.inSync {
+		// Once downstream is in sync, a new snapshot is just a source of updates.
+		return
+	}
+	if r.statusSent && status == r.lastStatus {
+		// Avoid repeating the status if we switch source before we're in sync.
+		return
+	}
+	if status == bapi.InSync {
+		r.inSync = true
+	}
+	r.lastStatus = status
+	r.statusSent = true
+	r.callbacks.OnStatusUpdated(status)
+}
+
+func (r *snapshotReconciler) OnUpdates(updates []bapi.Update) {
+	for i := range updates {
+		update := &updates[i]
+		path, err := model.KeyToDefaultPath(update.Key)
+		if err != nil {
+			log.WithError(err).WithField("key", update.Key).Warn("Failed to convert key to path")
+			continue
+		}
+		if update.UpdateType == bapi.UpdateTypeKVDeleted || update.Value == nil {
+			delete(r.knownKeys, path)
+			continue
+		}
+		if _, known := r.knownKeys[path]; known {
+			update.UpdateType = bapi.UpdateTypeKVUpdated
+		} else {
+			update.UpdateType = bapi.UpdateTypeKVNew
+		}
+		r.knownKeys[path] = update.Key
+		if r.snapshotKeys != nil {
+			r.snapshotKeys[path] = true
+		}
+	}
+	if len(updates) > 0 {
+		r.callbacks.OnUpdates(updates)
+	}
+}
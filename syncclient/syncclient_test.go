@@ -0,0 +1,266 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncclient_test
+
+import (
+	. "github.com/projectcalico/felix/syncclient"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"encoding/gob"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/projectcalico/felix/syncproto"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+var _ = Describe("SyncerClient", func() {
+	var servers chan *mockServer
+	var dialFails int32
+	var callbacks *mockCallbacks
+	var fallbackStarted chan bool
+	var client *SyncerClient
+
+	BeforeEach(func() {
+		servers = make(chan *mockServer, 10)
+		atomic.StoreInt32(&dialFails, 0)
+		callbacks = &mockCallbacks{}
+		fallbackStarted = make(chan bool, 1)
+		dial := func(address string, timeout time.Duration) (net.Conn, error) {
+			if atomic.LoadInt32(&dialFails) == 1 {
+				return nil, errors.New("connection refused")
+			}
+			clientConn, serverConn := net.Pipe()
+			servers <- newMockServer(address, serverConn)
+			return clientConn, nil
+		}
+		newFallbackSyncer := func(cbs bapi.SyncerCallbacks) bapi.Syncer {
+			return &mockSyncer{callbacks: cbs, started: fallbackStarted}
+		}
+		client = NewWithShims(Options{
+			Addresses:       []string{"typha1:5473", "typha2:5473"},
+			ReadTimeout:     5 * time.Second,
+			FallbackTimeout: 10 * time.Millisecond,
+			Hostname:        "felix-host",
+		}, callbacks, newFallbackSyncer, dial, func(time.Duration) {
+			time.Sleep(time.Millisecond)
+		}, time.Now)
+	})
+
+	nextServer := func() *mockServer {
+		var s *mockServer
+		Eventually(servers).Should(Receive(&s))
+		return s
+	}
+
+	connect := func() *mockServer {
+		s := nextServer()
+		hello := s.receive().(syncproto.MsgClientHello)
+		Expect(hello.Hostname).To(Equal("felix-host"))
+		Expect(hello.ProtocolVersion).To(Equal(syncproto.ProtocolVersion))
+		s.send(syncproto.MsgServerHello{ProtocolVersion: syncproto.ProtocolVersion})
+		return s
+	}
+
+	Describe("after connecting", func() {
+		var s *mockServer
+
+		BeforeEach(func() {
+			client.Start()
+			s = connect()
+			s.send(syncproto.MsgSyncStatus{SyncStatus: bapi.ResyncInProgress})
+			s.sendKVs(kv("Foo", "bar"), kv("Baz", "qux"))
+			s.send(syncproto.MsgSyncStatus{SyncStatus: bapi.InSync})
+			Eventually(callbacks.getStatuses).Should(Equal([]bapi.SyncStatus{
+				bapi.WaitForDatastore,
+				bapi.ResyncInProgress,
+				bapi.InSync,
+			}))
+		})
+
+		It("should pass on the snapshot and subsequent updates", func() {
+			s.sendKVs(kv("Foo", "bar2"))
+			Eventually(callbacks.getUpdates).Should(Equal([]bapi.Update{
+				update("Foo", "bar", bapi.UpdateTypeKVNew),
+				update("Baz", "qux", bapi.UpdateTypeKVNew),
+				update("Foo", "bar2", bapi.UpdateTypeKVUpdated),
+			}))
+		})
+
+		It("should reply to pings", func() {
+			s.send(syncproto.MsgPing{Timestamp: time.Unix(1234, 0)})
+			pong := s.receive().(syncproto.MsgPong)
+			Expect(pong.PingTimestamp.Equal(time.Unix(1234, 0))).To(BeTrue())
+		})
+
+		It("should reconnect and reconcile the new snapshot", func() {
+			s.conn.Close()
+			s2 := connect()
+			callbacks.clearUpdates()
+			s2.send(syncproto.MsgSyncStatus{SyncStatus: bapi.ResyncInProgress})
+			s2.sendKVs(kv("Foo", "bar2"), kv("New", "value"))
+			s2.send(syncproto.MsgSyncStatus{SyncStatus: bapi.InSync})
+			Eventually(callbacks.getUpdates).Should(Equal([]bapi.Update{
+				update("Foo", "bar2", bapi.UpdateTypeKVUpdated),
+				update("New", "value", bapi.UpdateTypeKVNew),
+				update("Baz", nil, bapi.UpdateTypeKVDeleted),
+			}))
+			// Downstream stays in sync throughout.
+			Expect(callbacks.getStatuses()).To(HaveLen(3))
+		})
+
+		It("should fall back to the datastore if it can't reconnect", func() {
+			atomic.StoreInt32(&dialFails, 1)
+			s.conn.Close()
+			Eventually(fallbackStarted).Should(Receive())
+			Eventually(callbacks.getUpdates).Should(ContainElement(
+				update("Baz", nil, bapi.UpdateTypeKVDeleted),
+			))
+			Expect(callbacks.getStatuses()).To(HaveLen(3))
+		})
+	})
+
+	It("should disconnect from a server with the wrong protocol version", func() {
+		client.Start()
+		s := nextServer()
+		s.receive()
+		s.send(syncproto.MsgServerHello{ProtocolVersion: syncproto.ProtocolVersion + 1})
+		// Client should hang up and try again.
+		_, err := s.tryReceive()
+		Expect(err).To(HaveOccurred())
+		connect()
+	})
+
+	It("should fall back to the datastore if it can't connect at all", func() {
+		atomic.StoreInt32(&dialFails, 1)
+		client.Start()
+		Eventually(fallbackStarted).Should(Receive())
+		Eventually(callbacks.getStatuses).Should(Equal([]bapi.SyncStatus{
+			bapi.WaitForDatastore,
+			bapi.ResyncInProgress,
+			bapi.InSync,
+		}))
+		Expect(callbacks.getUpdates()).To(Equal([]bapi.Update{
+			update("Foo", "fallback", bapi.UpdateTypeKVNew),
+		}))
+	})
+})
+
+func kv(name, value string) syncproto.SerializedUpdate {
+	s, err := syncproto.SerializeUpdate(update(name, value, bapi.UpdateTypeKVNew))
+	Expect(err).NotTo(HaveOccurred())
+	return s
+}
+
+func update(name string, value interface{}, updateType bapi.UpdateType) bapi.Update {
+	return bapi.Update{
+		KVPair:     model.KVPair{Key: model.GlobalConfigKey{Name: name}, Value: value},
+		UpdateType: updateType,
+	}
+}
+
+// mockServer is the server end of a connection from the client.
+type mockServer struct {
+	address string
+	conn    net.Conn
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+}
+
+func newMockServer(address string, conn net.Conn) *mockServer {
+	return &mockServer{
+		address: address,
+		conn:    conn,
+		encoder: gob.NewEncoder(conn),
+		decoder: gob.NewDecoder(conn),
+	}
+}
+
+func (s *mockServer) send(msg interface{}) {
+	Expect(s.encoder.Encode(&syncproto.Envelope{Message: msg})).To(Succeed())
+}
+
+func (s *mockServer) sendKVs(kvs ...syncproto.SerializedUpdate) {
+	s.send(syncproto.MsgKVs{KVs: kvs})
+}
+
+func (s *mockServer) tryReceive() (interface{}, error) {
+	s.conn.SetReadDeadline(time.Now().Add(time.Second))
+	var envelope syncproto.Envelope
+	err := s.decoder.Decode(&envelope)
+	return envelope.Message, err
+}
+
+func (s *mockServer) receive() interface{} {
+	msg, err := s.tryReceive()
+	Expect(err).NotTo(HaveOccurred())
+	return msg
+}
+
+// mockSyncer stands in for the datastore's syncer; it sends a snapshot when started.
+type mockSyncer struct {
+	callbacks bapi.SyncerCallbacks
+	started   chan bool
+}
+
+func (s *mockSyncer) Start() {
+	s.callbacks.OnStatusUpdated(bapi.WaitForDatastore)
+	s.callbacks.OnStatusUpdated(bapi.ResyncInProgress)
+	s.callbacks.OnUpdates([]bapi.Update{update("Foo", "fallback", bapi.UpdateTypeKVNew)})
+	s.callbacks.OnStatusUpdated(bapi.InSync)
+	s.started <- true
+}
+
+type mockCallbacks struct {
+	lock     sync.Mutex
+	statuses []bapi.SyncStatus
+	updates  []bapi.Update
+}
+
+func (c *mockCallbacks) OnStatusUpdated(status bapi.SyncStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.statuses = append(c.statuses, status)
+}
+
+func (c *mockCallbacks) OnUpdates(updates []bapi.Update) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updates = append(c.updates, updates...)
+}
+
+func (c *mockCallbacks) getStatuses() []bapi.SyncStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.statuses
+}
+
+func (c *mockCallbacks) getUpdates() []bapi.Update {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.updates
+}
+
+func (c *mockCallbacks) clearUpdates() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updates = nil
+}
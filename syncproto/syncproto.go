@@ -0,0 +1,139 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package syncproto defines the protocol between Felix and a Typha-style fan-out proxy.  The
+// proxy runs a single datastore syncer and fans out its updates to many Felix instances, so
+// that, in a large cluster, the datastore only has to serve a handful of watches.
+//
+// The connection is a stream of gob-encoded Envelopes.  After connecting, the client sends a
+// MsgClientHello and the server replies with a MsgServerHello.  The server then sends a
+// complete snapshot of the datastore as a series of MsgKVs, followed by a MsgSyncStatus
+// with status InSync, and then streams further updates.  The server sends periodic MsgPings,
+// to which the client replies with a MsgPong; each side closes the connection if it hears
+// nothing from the other for too long.
+package syncproto
+
+import (
+	"encoding/gob"
+	"time"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+// ProtocolVersion is the version of the protocol; the client and server must agree on it.
+const ProtocolVersion = 1
+
+func init() {
+	// Since Envelope.Message is an interface, gob needs to know the concrete types.
+	gob.Register(MsgClientHello{})
+	gob.Register(MsgServerHello{})
+	gob.Register(MsgSyncStatus{})
+	gob.Register(MsgPing{})
+	gob.Register(MsgPong{})
+	gob.Register(MsgKVs{})
+}
+
+// Envelope wraps each message sent over the connection.
+type Envelope struct {
+	Message interface{}
+}
+
+type MsgClientHello struct {
+	Hostname        string
+	Info            string
+	Version         string
+	ProtocolVersion int
+}
+
+type MsgServerHello struct {
+	Version         string
+	ProtocolVersion int
+}
+
+type MsgSyncStatus struct {
+	SyncStatus bapi.SyncStatus
+}
+
+type MsgPing struct {
+	Timestamp time.Time
+}
+
+type MsgPong struct {
+	PingTimestamp time.Time
+}
+
+type MsgKVs struct {
+	KVs []SerializedUpdate
+}
+
+// SerializedUpdate is a bapi.Update in a form that can be sent over the wire: the key as its
+// default datastore path and the value in its datastore encoding.
+type SerializedUpdate struct {
+	Key        string
+	Value      []byte
+	UpdateType bapi.UpdateType
+}
+
+func SerializeUpdate(u bapi.Update) (SerializedUpdate, error) {
+	path, err := model.KeyToDefaultPath(u.Key)
+	if err != nil {
+		return SerializedUpdate{}, err
+	}
+	var value []byte
+	if u.Value != nil {
+		value, err = model.SerializeValue(&u.KVPair)
+		if err != nil {
+			return SerializedUpdate{}, err
+		}
+	}
+	return SerializedUpdate{
+		Key:        path,
+		Value:      value,
+		UpdateType: u.UpdateType,
+	}, nil
+}
+
+// ToUpdate converts the SerializedUpdate back to a bapi.Update.
+func (s SerializedUpdate) ToUpdate() (bapi.Update, error) {
+	key := model.KeyFromDefaultPath(s.Key)
+	if key == nil {
+		return bapi.Update{}, UnknownKeyError{Key: s.Key}
+	}
+	var value interface{}
+	if s.Value != nil {
+		var err error
+		value, err = model.ParseValue(key, s.Value)
+		if err != nil {
+			return bapi.Update{}, err
+		}
+	}
+	return bapi.Update{
+		KVPair: model.KVPair{
+			Key:   key,
+			Value: value,
+		},
+		UpdateType: s.UpdateType,
+	}, nil
+}
+
+// UnknownKeyError is returned by ToUpdate if the key isn't one that we know how to parse; for
+// example, because the server is newer than the client.
+type UnknownKeyError struct {
+	Key string
+}
+
+func (e UnknownKeyError) Error() string {
+	return "unknown key: " + e.Key
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncproto_test
+
+import (
+	. "github.com/projectcalico/felix/syncproto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/gob"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+var _ = Describe("SerializedUpdate", func() {
+	It("should round-trip an update", func() {
+		update := bapi.Update{
+			KVPair: model.KVPair{
+				Key:   model.GlobalConfigKey{Name: "LogSeverityScreen"},
+				Value: "Debug",
+			},
+			UpdateType: bapi.UpdateTypeKVUpdated,
+		}
+		serialized, err := SerializeUpdate(update)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(serialized.Key).To(Equal("/calico/v1/config/LogSeverityScreen"))
+		Expect(serialized.ToUpdate()).To(Equal(update))
+	})
+
+	It("should round-trip a deletion", func() {
+		update := bapi.Update{
+			KVPair:     model.KVPair{Key: model.GlobalConfigKey{Name: "LogSeverityScreen"}},
+			UpdateType: bapi.UpdateTypeKVDeleted,
+		}
+		serialized, err := SerializeUpdate(update)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(serialized.Value).To(BeNil())
+		Expect(serialized.ToUpdate()).To(Equal(update))
+	})
+
+	It("should reject an unknown key", func() {
+		_, err := SerializedUpdate{Key: "/calico/v9/foo"}.ToUpdate()
+		Expect(err).To(Equal(UnknownKeyError{Key: "/calico/v9/foo"}))
+	})
+})
+
+var _ = Describe("Envelope", func() {
+	It("should gob-encode the messages", func() {
+		var buf bytes.Buffer
+		msg := MsgKVs{KVs: []SerializedUpdate{{
+			Key:        "/calico/v1/config/Foo",
+			Value:      []byte("bar"),
+			UpdateType: bapi.UpdateTypeKVNew,
+		}}}
+		Expect(gob.NewEncoder(&buf).Encode(&Envelope{Message: msg})).To(Succeed())
+		var decoded Envelope
+		Expect(gob.NewDecoder(&buf).Decode(&decoded)).To(Succeed())
+		Expect(decoded.Message).To(Equal(msg))
+	})
+})
@@ -0,0 +1,80 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/projectcalico/felix/config"
+)
+
+// validateConfig implements the --validate-config mode.  It loads the config from all sources,
+// including the datastore, prints the effective value of each parameter along with the source
+// that it came from, and reports any errors.  Unlike the normal start-up path, it doesn't retry
+// so that it can be used to lint a node's config in CI.  It returns the exit code for the
+// process, which is non-zero if there were any errors.
+func validateConfig(configFile string) int {
+	var errs []error
+	configParams := config.New()
+	envConfig := config.LoadConfigFromEnvironment(os.Environ())
+	fileConfig, err := config.LoadConfigFile(configFile)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to load config file %v: %v", configFile, err))
+	}
+	configParams.UpdateFrom(envConfig, config.EnvironmentVariable)
+	configParams.UpdateFrom(fileConfig, config.ConfigFile)
+
+	if configParams.Err == nil {
+		// We have enough config to connect to the datastore.
+		datastore, err := newDatastoreClient(configParams)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to connect to datastore: %v", err))
+		} else {
+			globalConfig, hostConfig, err := tryLoadConfigFromDatastore(
+				datastore, configParams.FelixHostname)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to load config from datastore: %v", err))
+			}
+			configParams.UpdateFrom(globalConfig, config.DatastoreGlobal)
+			configParams.UpdateFrom(hostConfig, config.DatastorePerHost)
+		}
+	}
+	if configParams.Err == nil {
+		configParams.Validate()
+	}
+	if configParams.Err != nil {
+		errs = append(errs, configParams.Err)
+	}
+	errs = append(errs, configParams.InvalidValues...)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PARAMETER\tVALUE\tSOURCE")
+	for _, value := range configParams.EffectiveValues() {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", value.Name, value.Value, value.Source)
+	}
+	w.Flush()
+
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, "\nConfiguration is invalid:")
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "  %v\n", err)
+		}
+		return 1
+	}
+	fmt.Println("\nConfiguration is valid.")
+	return 0
+}